@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// agentConfig is read from ~/.MobileCoder/config.json, e.g.
+//
+//	{"upload_dir": ".mobilecoder/uploads", "upload_max_bytes": 10485760,
+//	 "ping_interval_seconds": 25, "read_timeout_seconds": 60,
+//	 "workspace_roots": ["/Users/me/code"],
+//	 "projects": {"/Users/me/repo": {"git_actions": ["commit", "push"], "upload_dir": "tmp/uploads"}}}
+//
+// Remote git actions are refused for projects that are not listed.
+// Sessions the cloud creates (scheduled runs) may only start in a listed
+// project or below a workspace root.
+// upload_dir is relative to the project; a project setting wins.
+// upload_max_bytes caps every upload, whatever the request asks for.
+type agentConfig struct {
+	UploadDir           string                   `json:"upload_dir"`
+	UploadMaxBytes      int64                    `json:"upload_max_bytes"`
+	WorkspaceRoots      []string                 `json:"workspace_roots"`
+	PingIntervalSeconds int                      `json:"ping_interval_seconds"`
+	ReadTimeoutSeconds  int                      `json:"read_timeout_seconds"`
+	Projects            map[string]projectConfig `json:"projects"`
+}
+
+type projectConfig struct {
+	GitActions []string `json:"git_actions"`
+	UploadDir  string   `json:"upload_dir"`
+}
+
+func getAgentConfigPath() string {
+	homeDir, _ := os.UserHomeDir()
+	return filepath.Join(homeDir, ".MobileCoder", "config.json")
+}
+
+// loadAgentConfig reads the config file. A missing file is an empty config.
+func loadAgentConfig(path string) (*agentConfig, error) {
+	config := &agentConfig{Projects: map[string]projectConfig{}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	if config.Projects == nil {
+		config.Projects = map[string]projectConfig{}
+	}
+	return config, nil
+}
+
+// gitActionAllowed reports whether the project allowlists the git action.
+func (c *agentConfig) gitActionAllowed(projectPath, action string) bool {
+	if c == nil {
+		return false
+	}
+	for path, project := range c.Projects {
+		if filepath.Clean(path) != filepath.Clean(projectPath) {
+			continue
+		}
+		for _, allowed := range project.GitActions {
+			if allowed == action {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// remoteSessionAllowed reports whether the cloud may start a session in
+// projectPath: a listed project or a directory below a workspace root.
+// Symlinks are resolved first so a link cannot lead out of a root.
+func (c *agentConfig) remoteSessionAllowed(projectPath string) bool {
+	if c == nil || !filepath.IsAbs(projectPath) {
+		return false
+	}
+	resolved, err := filepath.EvalSymlinks(projectPath)
+	if err != nil {
+		return false
+	}
+	for path := range c.Projects {
+		if project, err := filepath.EvalSymlinks(path); err == nil && project == resolved {
+			return true
+		}
+	}
+	for _, root := range c.WorkspaceRoots {
+		root, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			continue
+		}
+		if rel, err := filepath.Rel(root, resolved); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadDir returns the drop folder for uploads into the project. Empty
+// means the default folder.
+func (c *agentConfig) uploadDir(projectPath string) string {
+	if c == nil {
+		return ""
+	}
+	for path, project := range c.Projects {
+		if filepath.Clean(path) == filepath.Clean(projectPath) && project.UploadDir != "" {
+			return project.UploadDir
+		}
+	}
+	return c.UploadDir
+}
+
+// defaultUploadMaxBytes matches the cloud's default UPLOAD_MAX_BYTES.
+const defaultUploadMaxBytes = 10 << 20
+
+// uploadMaxBytes returns the upload size limit. A request may only lower
+// it, so a frame that skipped the cloud's checks cannot write more.
+func (c *agentConfig) uploadMaxBytes(requested int64) int64 {
+	limit := int64(defaultUploadMaxBytes)
+	if c != nil && c.UploadMaxBytes > 0 {
+		limit = c.UploadMaxBytes
+	}
+	if requested > 0 && requested < limit {
+		return requested
+	}
+	return limit
+}
+
+// heartbeat returns the WebSocket ping interval and read timeout; zero
+// keeps the client defaults.
+func (c *agentConfig) heartbeat() (pingInterval, readTimeout time.Duration) {
+	if c == nil {
+		return 0, 0
+	}
+	return time.Duration(c.PingIntervalSeconds) * time.Second, time.Duration(c.ReadTimeoutSeconds) * time.Second
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"log/slog"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mobile-coder/agent/internal/client"
+)
+
+// agentVersion is set at build time with -ldflags "-X main.agentVersion=v1.2.3".
+var agentVersion = "dev"
+
+// agentCapabilities lists the cloud requests and reports this agent supports.
+// The cloud hides features that are missing here.
+var agentCapabilities = []string{
+	"terminal",
+	"submit_prompt",
+	"prompt_done",
+	"create_session",
+	"workspace_status",
+	"diff",
+	"git_action",
+	"files",
+	"upload",
+	"resume",
+}
+
+type helloTool struct {
+	Name      string `json:"name"`
+	Installed bool   `json:"installed"`
+	Version   string `json:"version,omitempty"`
+}
+
+type helloPayload struct {
+	Version         string      `json:"version"`
+	ProtocolVersion int         `json:"protocol_version"`
+	OS              string      `json:"os"`
+	Arch            string      `json:"arch"`
+	TmuxVersion     string      `json:"tmux_version,omitempty"`
+	Tools           []helloTool `json:"tools"`
+	Capabilities    []string    `json:"capabilities"`
+	Encodings       []string    `json:"encodings"`
+
+	// Resume state of this connection, filled per hello
+	StreamID       string `json:"stream_id,omitempty"`
+	ResumeStreamID string `json:"resume_stream_id,omitempty"`
+	ResumeSeq      uint64 `json:"resume_seq,omitempty"`
+}
+
+var (
+	helloOnce  sync.Once
+	helloCache helloPayload
+)
+
+// agentHello describes this agent for the hello handshake. Tool discovery
+// runs commands, so it happens once per process.
+func agentHello() helloPayload {
+	helloOnce.Do(func() {
+		helloCache = helloPayload{
+			Version:         agentVersion,
+			ProtocolVersion: client.ProtocolVersion,
+			OS:              runtime.GOOS,
+			Arch:            runtime.GOARCH,
+			Capabilities:    agentCapabilities,
+			Encodings:       []string{client.EncodingCBOR, client.EncodingJSON},
+		}
+		if output, err := exec.Command("tmux", "-V").Output(); err == nil {
+			helloCache.TmuxVersion = strings.TrimSpace(string(output))
+		}
+		for tool, config := range toolConfigs {
+			version, err := inspectTool(tool)
+			helloCache.Tools = append(helloCache.Tools, helloTool{
+				Name:      config.Name,
+				Installed: err == nil,
+				Version:   version,
+			})
+		}
+		sort.Slice(helloCache.Tools, func(i, j int) bool {
+			return helloCache.Tools[i].Name < helloCache.Tools[j].Name
+		})
+	})
+	return helloCache
+}
+
+// sendHello opens the handshake on every (re)connect; the cloud answers
+// with hello_result. It also tells the cloud where to resume its stream.
+func sendHello(ws *client.WSClient) {
+	hello := agentHello()
+	hello.StreamID, hello.ResumeStreamID, hello.ResumeSeq = ws.ResumeState()
+	if err := ws.SendControl("hello", hello); err != nil {
+		slog.Warn("send hello failed", "error", err)
+	}
+}
+
+// handleHelloResult switches to the frame encoding the cloud chose, resumes
+// the reliable stream and warns when the cloud cannot serve this agent
+// fully.
+func handleHelloResult(ws *client.WSClient, env *client.Envelope) {
+	result := env.PayloadMap()
+	streamID, _ := result["stream_id"].(string)
+	resumeSeq, _ := result["resume_seq"].(float64)
+	defer ws.Resume(streamID, uint64(resumeSeq))
+	if env.Error != nil {
+		slog.Warn("cloud rejected this agent, please update the agent", "reason", env.Error.Message)
+		return
+	}
+	if compatible, _ := result["compatible"].(bool); !compatible {
+		slog.Warn("cloud protocol does not match, some features are disabled",
+			"cloud_protocol", result["protocol_version"], "agent_protocol", client.ProtocolVersion)
+	}
+	if encoding, _ := result["encoding"].(string); encoding == client.EncodingCBOR {
+		ws.SetEncoding(client.EncodingCBOR)
+	} else {
+		ws.SetEncoding(client.EncodingJSON)
+	}
+}
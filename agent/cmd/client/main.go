@@ -5,7 +5,7 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"os"
@@ -14,7 +14,8 @@ import (
 	"strings"
 	"time"
 
-	"github.com/mobile-coder/agent/internal/client"
+	"github.com/mobile-coder/logging"
+	"github.com/mobile-coder/tracing"
 )
 
 // AI coding tool types
@@ -61,28 +62,40 @@ var toolConfigs = map[AIClient]ToolConfig{
 
 // checkTool checks if the AI tool is installed and available
 func checkTool(tool AIClient) error {
+	version, err := inspectTool(tool)
+	if err != nil {
+		return err
+	}
+	if version == "" {
+		slog.Warn("tool --version failed", "tool", toolConfigs[tool].Name)
+		// Still allow running if command exists
+	} else {
+		slog.Info("tool version", "tool", toolConfigs[tool].Name, "version", version)
+	}
+	return nil
+}
+
+// inspectTool returns the version output of an installed tool; an empty
+// version means the tool exists but --version failed.
+func inspectTool(tool AIClient) (string, error) {
 	config, ok := toolConfigs[tool]
 	if !ok {
-		return fmt.Errorf("unknown AI tool: %s", tool)
+		return "", fmt.Errorf("unknown AI tool: %s", tool)
 	}
 
 	// Check if command exists
 	cmd := exec.Command("which", config.CheckCmd)
 	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("%s not found. Install with: %s", config.Name, config.InstallHint)
+		return "", fmt.Errorf("%s not found. Install with: %s", config.Name, config.InstallHint)
 	}
 
 	// Try to get version
 	cmd = exec.Command(config.CheckCmd, config.CheckArgs...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Printf("Warning: %s --version failed: %v", config.Name, err)
-		// Still allow running if command exists
-	} else {
-		log.Printf("%s version: %s", config.Name, strings.TrimSpace(string(output)))
+		return "", nil
 	}
-
-	return nil
+	return strings.TrimSpace(string(output)), nil
 }
 
 // getToolCommand returns the command and args to start the AI tool
@@ -114,9 +127,9 @@ func checkDependencies() error {
 	cmd = exec.Command("tmux", "-V")
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Printf("Warning: tmux -V failed: %v", err)
+		slog.Warn("tmux -V failed", "error", err)
 	} else {
-		log.Printf("tmux version: %s", strings.TrimSpace(string(output)))
+		slog.Info("tmux version", "version", strings.TrimSpace(string(output)))
 	}
 
 	return nil
@@ -230,6 +243,30 @@ func agentTokenUsableForDevice(token string, deviceID string, now time.Time) boo
 	return claims.TokenType == "agent" && claims.DeviceID == deviceID && claims.ExpiresAt > now.Unix()
 }
 
+// agentTokenRefreshMargin refreshes the agent token this long before it
+// expires, since the cloud refuses expired ones on /ws.
+const agentTokenRefreshMargin = time.Minute
+
+// agentTokenFor returns the agent token of deviceID, refreshed through
+// /api/device/check when it is about to expire.
+func agentTokenFor(serverURL, deviceID string) func() string {
+	return func() string {
+		token := loadAgentToken()
+		if agentTokenUsableForDevice(token, deviceID, time.Now().Add(agentTokenRefreshMargin)) {
+			return token
+		}
+		result, err := checkDevice(serverURL, deviceID, "")
+		if err != nil || result.AgentToken == "" {
+			slog.Warn("agent token refresh failed", "device_id", deviceID, "error", err)
+			return token
+		}
+		if err := saveAgentToken(result.AgentToken); err != nil {
+			slog.Warn("save agent token failed", "error", err)
+		}
+		return result.AgentToken
+	}
+}
+
 func saveAgentToken(token string) error {
 	if err := os.MkdirAll(filepath.Dir(getAgentTokenPath()), 0755); err != nil {
 		return err
@@ -351,6 +388,16 @@ func terminalInputToTmuxCommands(sessionName string, payload map[string]interfac
 	return commands
 }
 
+// submitPromptToTmuxCommands types a queued prompt into the session and
+// submits it, the same way a typed terminal line is sent.
+func submitPromptToTmuxCommands(sessionName string, payload map[string]interface{}) [][]string {
+	prompt, _ := payload["prompt"].(string)
+	if strings.TrimSpace(prompt) == "" {
+		return nil
+	}
+	return terminalInputToTmuxCommands(sessionName, map[string]interface{}{"content": prompt})
+}
+
 func tmuxKeyCommand(sessionName string, key string, modifiers []interface{}) []string {
 	hasCtrl := false
 	hasShift := false
@@ -422,7 +469,16 @@ func isLiteralTmuxInput(args []string) bool {
 func main() {
 	serverURL := flag.String("server", "localhost:8080", "Cloud server URL")
 	aiTool := flag.String("ai", "claude", "AI coding tool: claude, codex, cursor")
+	logLevel := flag.String("log-level", "info", "Log level: debug, info, warn, error")
+	logFormat := flag.String("log-format", "text", "Log format: text, json")
+	logDebug := flag.Bool("log-debug", false, "Log terminal content and message payloads (tokens stay redacted)")
+	traceExporter := flag.String("trace-exporter", os.Getenv("OTEL_TRACES_EXPORTER"), "Trace exporter: otlp, stdout, none")
+	traceEndpoint := flag.String("trace-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "OTLP/HTTP collector URL (default http://localhost:4318)")
 	flag.Parse()
+	logging.Setup(logging.Options{Level: *logLevel, Format: *logFormat, Debug: *logDebug})
+	if _, err := tracing.Setup(tracing.Options{Service: "mobilecoder-agent", Exporter: *traceExporter, Endpoint: *traceEndpoint}); err != nil {
+		fatal("set up tracing failed", err)
+	}
 
 	// Check dependencies first
 	fmt.Println("==========================================")
@@ -471,7 +527,7 @@ func main() {
 	fmt.Println("Connecting to server...")
 	deviceID, bindCode, err := loadOrCreateDeviceID(*serverURL)
 	if err != nil {
-		log.Fatalf("Failed to load/create device ID: %v", err)
+		fatal("load or create device ID failed", err)
 	}
 
 	// 如果有绑定码，说明需要绑定
@@ -485,7 +541,7 @@ func main() {
 		fmt.Println()
 		fmt.Println("等待 H5 页面完成绑定...")
 		if err := waitForDeviceBinding(*serverURL, deviceID, bindCode, 10*time.Minute, 2*time.Second); err != nil {
-			log.Fatalf("Device binding failed: %v", err)
+			fatal("device binding failed", err)
 		}
 		fmt.Println("设备绑定成功，继续启动...")
 	} else {
@@ -506,13 +562,11 @@ func main() {
 	dirName = strings.ReplaceAll(dirName, "/", "-")
 	dirName = strings.ReplaceAll(dirName, " ", "_")
 	sessionName := fmt.Sprintf("%s-%s-%s", tool, deviceID[:6], dirName)
-	log.Printf("Agent starting with tool=%s, sessionName=%s, deviceID=%s, dirName=%s", tool, sessionName, deviceID, dirName)
+	slog.Info("agent starting", "tool", tool, "session_name", sessionName, "device_id", deviceID)
 
-	// WebSocket 连接
-	log.Printf("Connecting to WebSocket with sessionName=%s", sessionName)
-	ws, err := client.NewWSClient("ws://"+*serverURL+"/ws", deviceID, sessionName)
-	if err != nil {
-		log.Fatalf("Failed to connect: %v", err)
+	manager := newSessionManager(*serverURL, deviceID)
+	if _, err := manager.start(tool, projectPath, sessionName); err != nil {
+		fatal("connect failed", err)
 	}
 
 	// 更新设备名称（如果与当前主机名不同）
@@ -533,109 +587,6 @@ func main() {
 		}
 	}()
 
-	// Get command for the selected AI tool
-	cmdName, cmdArgs := getToolCommand(tool, projectPath)
-
-	// 设置较大的历史记录缓冲，避免长输出被截断
-	historyLimit := 5000
-
-	// 检查 tmux session 是否已存在
-	cmd := exec.Command("tmux", "-u", "has-session", "-t", sessionName)
-	if err := cmd.Run(); err != nil {
-		// 创建新的 tmux session 并在其中运行 AI 工具
-		if tool == AIClientClaude {
-			// Claude Code: 使用 env -u CLAUDECODE 移除环境变量
-			fullArgs := []string{"-u", "new-session", "-d", "-s", sessionName, "env", "-u", "CLAUDECODE", cmdName}
-			fullArgs = append(fullArgs, cmdArgs...)
-			exec.Command("tmux", fullArgs...).Run()
-		} else {
-			// Codex/Cursor: 直接运行
-			fullArgs := []string{"-u", "new-session", "-d", "-s", sessionName, cmdName}
-			fullArgs = append(fullArgs, cmdArgs...)
-			exec.Command("tmux", fullArgs...).Run()
-		}
-		// 设置历史记录大小
-		exec.Command("tmux", "-u", "set-option", "-t", sessionName, "history-limit", fmt.Sprintf("%d", historyLimit)).Run()
-	} else {
-		// session 已存在时只接管，不重启。对 Codex/Claude 发送 Ctrl+C 可能会让
-		// 唯一 pane 退出并销毁 tmux session，导致 H5 看起来在线但无法接收输入。
-		exec.Command("tmux", "-u", "set-option", "-t", sessionName, "history-limit", fmt.Sprintf("%d", historyLimit)).Run()
-	}
-
-	// 向服务器注册 session
-	sessionJSON := fmt.Sprintf(`{"device_id":"%s","session_name":"%s","project_path":"%s"}`, deviceID, sessionName, projectPath)
-	log.Printf("Registering session: %s", sessionJSON)
-	req, err := http.NewRequest("POST", "http://"+*serverURL+"/api/sessions", strings.NewReader(sessionJSON))
-	if err != nil {
-		log.Printf("Session registration request build failed: %v", err)
-	} else {
-		req.Header.Set("Content-Type", "application/json")
-		if token := loadAgentToken(); token != "" {
-			req.Header.Set("Authorization", token)
-		}
-		resp, err := http.DefaultClient.Do(req)
-		if err == nil {
-			defer resp.Body.Close()
-			var result map[string]interface{}
-			json.NewDecoder(resp.Body).Decode(&result)
-			if sessionID, ok := result["session_id"].(float64); ok {
-				log.Printf("Session registered: %d, name: %s", int(sessionID), sessionName)
-			} else if resp.StatusCode >= 400 {
-				log.Printf("Session registration failed: status=%d body=%v", resp.StatusCode, result)
-			}
-		} else {
-			log.Printf("Session registration failed: %v", err)
-		}
-	}
-
-	// 捕获终端输出并发送到 H5
-	go func() {
-		ticker := time.NewTicker(500 * time.Millisecond)
-		defer ticker.Stop()
-
-		var lastContent string
-
-		for range ticker.C {
-			// 捕获 tmux 历史记录（完整历史，不只是可见区域）
-			// -S -5000 从最后 5000 行开始捕获
-			cmd := exec.Command("tmux", "-u", "capture-pane", "-t", sessionName, "-p", "-e", "-S", "-5000")
-			out, err := cmd.Output()
-			if err != nil {
-				continue
-			}
-			output := string(out)
-
-			// 只发送有变化的内容
-			if output != lastContent && output != "" {
-				lastContent = output
-				ws.Send("terminal_output", map[string]interface{}{
-					"content": output,
-				})
-			}
-		}
-	}()
-
-	// 处理 H5 输入
-	go func() {
-		ws.OnMessage(func(data []byte) {
-			var msg map[string]interface{}
-			json.Unmarshal(data, &msg)
-			log.Printf("Received WS message: %s", string(data))
-			if msg["type"] == "terminal_input" {
-				payload := msg["payload"].(map[string]interface{})
-				for _, args := range terminalInputToTmuxCommands(sessionName, payload) {
-					log.Printf("tmux %s", strings.Join(args, " "))
-					if err := exec.Command("tmux", args...).Run(); err != nil {
-						log.Printf("tmux send failed: %v", err)
-					}
-					if isLiteralTmuxInput(args) {
-						time.Sleep(150 * time.Millisecond)
-					}
-				}
-			}
-		})
-	}()
-
 	// 提示
 	fmt.Printf("\n%s 已在 tmux 会话中启动!\n", strings.Title(string(tool)))
 	fmt.Printf("查看终端: tmux attach -t %s\n", sessionName)
@@ -645,3 +596,8 @@ func main() {
 	// 保持运行
 	select {}
 }
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
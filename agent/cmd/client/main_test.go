@@ -11,6 +11,11 @@ import (
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/mobile-coder/agent/internal/client"
+	"github.com/mobile-coder/agent/internal/filebrowser"
+	"github.com/mobile-coder/agent/internal/gitstatus"
+	"github.com/mobile-coder/agent/internal/upload"
 )
 
 func TestLoadOrCreateDeviceIDClearsStaleBindCodeForDeviceWithAgentToken(t *testing.T) {
@@ -113,6 +118,40 @@ func TestLoadOrCreateDeviceIDRefreshesExpiredAgentToken(t *testing.T) {
 	}
 }
 
+func TestAgentTokenForRefreshesATokenAboutToExpire(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	agentTokenPath := getAgentTokenPath()
+	if err := os.MkdirAll(filepath.Dir(agentTokenPath), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	expiringToken := testAgentToken(t, "dev-123", time.Now().Add(10*time.Second))
+	freshToken := testAgentToken(t, "dev-123", time.Now().Add(time.Hour))
+	if err := os.WriteFile(agentTokenPath, []byte(expiringToken), 0o644); err != nil {
+		t.Fatalf("write agent-token: %v", err)
+	}
+
+	var checks atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checks.Add(1)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"valid":       true,
+			"bound":       true,
+			"agent_token": freshToken,
+		})
+	}))
+	defer server.Close()
+
+	token := agentTokenFor(server.Listener.Addr().String(), "dev-123")
+	if got := token(); got != freshToken {
+		t.Fatalf("token = %q, want the refreshed token", got)
+	}
+	// The refreshed token is saved and used as is until it nears expiry
+	if got := token(); got != freshToken || checks.Load() != 1 {
+		t.Fatalf("token = %q after %d checks, want the saved token without another check", got, checks.Load())
+	}
+}
+
 func TestWaitForDeviceBindingClearsBindCodeAfterServerConfirms(t *testing.T) {
 	t.Setenv("HOME", t.TempDir())
 
@@ -260,6 +299,25 @@ func TestTerminalInputToTmuxCommandsUsesNativeControlKey(t *testing.T) {
 	}
 }
 
+func TestSubmitPromptToTmuxCommandsTypesPromptAndSubmits(t *testing.T) {
+	got := submitPromptToTmuxCommands("codex-session", map[string]interface{}{
+		"prompt":        "add tests for the parser\n",
+		"queue_item_id": float64(3),
+	})
+
+	want := [][]string{
+		{"send-keys", "-t", "codex-session", "-l", "add tests for the parser"},
+		{"send-keys", "-t", "codex-session", "C-m"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("commands = %#v, want %#v", got, want)
+	}
+
+	if got := submitPromptToTmuxCommands("codex-session", map[string]interface{}{"prompt": "  "}); got != nil {
+		t.Fatalf("commands = %#v, want nil for blank prompt", got)
+	}
+}
+
 func TestIsLiteralTmuxInput(t *testing.T) {
 	if !isLiteralTmuxInput([]string{"send-keys", "-t", "codex-session", "-l", "hello"}) {
 		t.Fatal("literal command was not detected")
@@ -282,3 +340,215 @@ func testAgentToken(t *testing.T, deviceID string, expiresAt time.Time) string {
 	}
 	return base64.RawURLEncoding.EncodeToString(payload) + ".signature"
 }
+
+func TestParseCreateSessionPayloadValidatesRequest(t *testing.T) {
+	req, err := parseCreateSessionPayload(map[string]interface{}{
+		"session_name": "codex-device-repo-s1-2604160200",
+		"tool":         "codex",
+		"project_path": "/Users/me/repo",
+		"prompt":       "update dependencies",
+		"schedule_id":  float64(1),
+	})
+	if err != nil {
+		t.Fatalf("parseCreateSessionPayload: %v", err)
+	}
+	if req.Tool != AIClientCodex || req.ProjectPath != "/Users/me/repo" || req.Prompt != "update dependencies" {
+		t.Fatalf("req = %+v, want parsed payload", req)
+	}
+
+	invalid := []map[string]interface{}{
+		{"session_name": "", "tool": "codex", "project_path": "/repo"},
+		{"session_name": "bad:name", "tool": "codex", "project_path": "/repo"},
+		{"session_name": "ok", "tool": "vim", "project_path": "/repo"},
+		{"session_name": "ok", "tool": "codex", "project_path": ""},
+	}
+	for _, payload := range invalid {
+		if _, err := parseCreateSessionPayload(payload); err == nil {
+			t.Fatalf("parseCreateSessionPayload(%v) succeeded, want error", payload)
+		}
+	}
+}
+
+func TestTmuxNewSessionArgsStartsToolInProjectPath(t *testing.T) {
+	got := tmuxNewSessionArgs(AIClientCodex, "codex-session", "/Users/me/repo")
+	want := []string{"-u", "new-session", "-d", "-s", "codex-session", "-c", "/Users/me/repo", "codex"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("args = %#v, want %#v", got, want)
+	}
+}
+
+func TestWorkspaceStatusPayloadIncludesSummary(t *testing.T) {
+	payload := workspaceStatusPayload(&gitstatus.Status{
+		IsRepo:       true,
+		Branch:       "main",
+		FilesChanged: 5,
+		Additions:    120,
+		Deletions:    30,
+	})
+	if payload["summary"] != "5 files changed, +120/-30" || payload["branch"] != "main" {
+		t.Fatalf("payload = %+v", payload)
+	}
+	if _, ok := payload["last_commit"]; ok {
+		t.Fatal("payload should omit last_commit when there is none")
+	}
+}
+
+func TestAgentConfigGitActionAllowlist(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+
+	config, err := loadAgentConfig(path)
+	if err != nil {
+		t.Fatalf("loadAgentConfig missing file: %v", err)
+	}
+	if config.gitActionAllowed("/repo", "commit") {
+		t.Fatal("empty config should allow nothing")
+	}
+
+	if err := os.WriteFile(path, []byte(`{"projects":{"/repo/":{"git_actions":["commit","push"]}}}`), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	config, err = loadAgentConfig(path)
+	if err != nil {
+		t.Fatalf("loadAgentConfig: %v", err)
+	}
+	if !config.gitActionAllowed("/repo", "commit") || !config.gitActionAllowed("/repo", "push") {
+		t.Fatal("commit and push should be allowed for /repo")
+	}
+	if config.gitActionAllowed("/repo", "discard") || config.gitActionAllowed("/other", "commit") {
+		t.Fatal("unlisted action or project should be refused")
+	}
+}
+
+func TestAgentConfigRemoteSessionsStayInWorkspaceRoots(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "code")
+	project := filepath.Join(dir, "listed")
+	outside := filepath.Join(dir, "secrets")
+	for _, path := range []string{filepath.Join(root, "app"), project, outside} {
+		if err := os.MkdirAll(path, 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	escape := filepath.Join(root, "escape")
+	if err := os.Symlink(outside, escape); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	var empty *agentConfig
+	if empty.remoteSessionAllowed(filepath.Join(root, "app")) {
+		t.Fatal("no config should allow no remote sessions")
+	}
+
+	config := &agentConfig{
+		WorkspaceRoots: []string{root},
+		Projects:       map[string]projectConfig{project: {}},
+	}
+	for _, path := range []string{root, filepath.Join(root, "app"), project} {
+		if !config.remoteSessionAllowed(path) {
+			t.Fatalf("remoteSessionAllowed(%q) = false, want true", path)
+		}
+	}
+	for _, path := range []string{outside, escape, filepath.Join(root, "..", "secrets"), "code/app", filepath.Join(root, "missing")} {
+		if config.remoteSessionAllowed(path) {
+			t.Fatalf("remoteSessionAllowed(%q) = true, want false", path)
+		}
+	}
+}
+
+func TestAgentConfigCapsUploadsWhateverTheRequestSays(t *testing.T) {
+	var unset *agentConfig
+	if got := unset.uploadMaxBytes(0); got != defaultUploadMaxBytes {
+		t.Fatalf("no config, no request: limit = %d, want the default", got)
+	}
+	config := &agentConfig{UploadMaxBytes: 1024}
+	for requested, want := range map[int64]int64{0: 1024, 1 << 30: 1024, 512: 512} {
+		if got := config.uploadMaxBytes(requested); got != want {
+			t.Errorf("uploadMaxBytes(%d) = %d, want %d", requested, got, want)
+		}
+	}
+}
+
+func TestAgentConfigUploadDir(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"upload_dir":"inbox","projects":{"/repo":{"upload_dir":"tmp/uploads"}}}`), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	config, err := loadAgentConfig(path)
+	if err != nil {
+		t.Fatalf("loadAgentConfig: %v", err)
+	}
+	if got := config.uploadDir("/repo"); got != "tmp/uploads" {
+		t.Fatalf("uploadDir(/repo) = %q, want project setting", got)
+	}
+	if got := config.uploadDir("/other"); got != "inbox" {
+		t.Fatalf("uploadDir(/other) = %q, want global setting", got)
+	}
+
+	args := uploadPathTmuxCommand("claude-session", "inbox/shot.png")
+	if !reflect.DeepEqual(args, []string{"send-keys", "-t", "claude-session", "-l", "inbox/shot.png "}) {
+		t.Fatalf("args = %q, want literal path without Enter", args)
+	}
+}
+
+func TestReplyErrorCode(t *testing.T) {
+	cases := map[error]string{
+		filebrowser.ErrOutsideRoot: "forbidden",
+		filebrowser.ErrHidden:      "forbidden",
+		filebrowser.ErrNotFound:    "not_found",
+		filebrowser.ErrIsDirectory: "invalid",
+		gitstatus.ErrNotRepository: "invalid",
+		upload.ErrInvalidDropDir:   "forbidden",
+		upload.ErrChecksum:         "invalid",
+		os.ErrPermission:           "failed",
+	}
+	for err, want := range cases {
+		if got := replyErrorCode(err); got != want {
+			t.Fatalf("replyErrorCode(%v) = %q, want %q", err, got, want)
+		}
+	}
+}
+
+func TestAgentHelloReportsToolsAndCapabilities(t *testing.T) {
+	hello := agentHello()
+	if hello.ProtocolVersion != client.ProtocolVersion || hello.OS == "" || hello.Version == "" {
+		t.Fatalf("hello = %+v", hello)
+	}
+	if len(hello.Tools) != len(toolConfigs) {
+		t.Fatalf("tools = %+v, want one entry per known tool", hello.Tools)
+	}
+	for _, capability := range []string{"diff", "files", "git_action", "upload"} {
+		found := false
+		for _, c := range hello.Capabilities {
+			found = found || c == capability
+		}
+		if !found {
+			t.Fatalf("capabilities = %v, missing %s", hello.Capabilities, capability)
+		}
+	}
+}
+
+func TestPromptWatchReportsQueueItemOnceOutputSettles(t *testing.T) {
+	var prompts promptWatch
+	start := time.Date(2026, 4, 14, 10, 0, 0, 0, time.UTC)
+
+	if _, done := prompts.observe(false, start.Add(time.Hour)); done {
+		t.Fatal("observe reported a prompt before any was submitted")
+	}
+
+	prompts.start(12, start)
+	if _, done := prompts.observe(false, start.Add(promptSettleTime*2)); done {
+		t.Fatal("observe reported a prompt that produced no output")
+	}
+	prompts.observe(true, start.Add(time.Second))
+	if _, done := prompts.observe(false, start.Add(time.Second+promptSettleTime/2)); done {
+		t.Fatal("observe reported a prompt whose output has not settled")
+	}
+	itemID, done := prompts.observe(false, start.Add(time.Second+promptSettleTime))
+	if !done || itemID != 12 {
+		t.Fatalf("observe = %d, %v; want 12, true", itemID, done)
+	}
+	if _, done := prompts.observe(false, start.Add(time.Hour)); done {
+		t.Fatal("observe reported the same prompt twice")
+	}
+}
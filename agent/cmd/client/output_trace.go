@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mobile-coder/tracing"
+)
+
+// outputTraceTTL bounds how long a keystroke's trace waits for the screen
+// to change.
+const outputTraceTTL = 10 * time.Second
+
+// outputTrace hands the trace of the latest terminal input to the captures
+// that follow it, so one trace covers a keystroke on the phone up to the
+// screen update it causes.
+type outputTrace struct {
+	mu    sync.Mutex
+	ctx   context.Context
+	since time.Time
+}
+
+// set makes ctx the trace waiting for output, if it is traced.
+func (t *outputTrace) set(ctx context.Context) {
+	if tracing.TraceParent(ctx) == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ctx, t.since = ctx, time.Now()
+}
+
+// pending returns the trace waiting for output, or nil.
+func (t *outputTrace) pending() context.Context {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ctx != nil && time.Since(t.since) > outputTraceTTL {
+		t.ctx = nil
+	}
+	return t.ctx
+}
+
+// done ends the wait of ctx unless newer input replaced it.
+func (t *outputTrace) done(ctx context.Context) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ctx == ctx {
+		t.ctx = nil
+	}
+}
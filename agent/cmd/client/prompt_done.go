@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// promptSettleTime is how long the pane must stay unchanged after a queued
+// prompt produced output before the agent reports the prompt as done.
+const promptSettleTime = 20 * time.Second
+
+// promptWatch tracks the queued prompt last submitted to a session and
+// decides when it is done, so the cloud queue advances on a signal for that
+// queue item instead of guessing from the text on screen.
+type promptWatch struct {
+	mu         sync.Mutex
+	itemID     int64
+	output     bool // the pane changed since the prompt was submitted
+	lastChange time.Time
+}
+
+// start watches the queue item whose prompt was just submitted. Prompts
+// without a queue item replace nothing.
+func (p *promptWatch) start(itemID int64, now time.Time) {
+	if itemID <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.itemID, p.output, p.lastChange = itemID, false, now
+}
+
+// observe is called after every capture of the pane. It returns the queue
+// item once its prompt produced output and the pane then stayed unchanged
+// for promptSettleTime; each item is returned once.
+func (p *promptWatch) observe(changed bool, now time.Time) (int64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.itemID == 0 {
+		return 0, false
+	}
+	if changed {
+		p.output, p.lastChange = true, now
+		return 0, false
+	}
+	if !p.output || now.Sub(p.lastChange) < promptSettleTime {
+		return 0, false
+	}
+	itemID := p.itemID
+	p.itemID = 0
+	return itemID, true
+}
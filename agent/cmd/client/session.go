@@ -0,0 +1,528 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mobile-coder/agent/internal/client"
+	"github.com/mobile-coder/agent/internal/filebrowser"
+	"github.com/mobile-coder/agent/internal/gitaction"
+	"github.com/mobile-coder/agent/internal/gitstatus"
+	"github.com/mobile-coder/agent/internal/upload"
+	"github.com/mobile-coder/tracing"
+)
+
+// 设置较大的历史记录缓冲，避免长输出被截断
+const historyLimit = 5000
+
+// 工作区 git 状态的检查间隔
+const workspaceStatusInterval = 15 * time.Second
+
+// 定时任务创建的新会话需要等 AI 工具启动后再输入提示词
+const scheduledPromptDelay = 5 * time.Second
+
+// sessionManager runs the tmux sessions of this agent. Each session has its
+// own WebSocket connection so the cloud can route input by session name.
+type sessionManager struct {
+	serverURL string
+	deviceID  string
+
+	mu       sync.Mutex
+	running  map[string]*client.WSClient
+	projects map[string]string
+	uploads  *upload.Receiver
+}
+
+func newSessionManager(serverURL, deviceID string) *sessionManager {
+	return &sessionManager{
+		serverURL: serverURL,
+		deviceID:  deviceID,
+		running:   make(map[string]*client.WSClient),
+		projects:  make(map[string]string),
+		uploads:   upload.NewReceiver(),
+	}
+}
+
+// createSessionRequest is the payload of a create_session command sent by
+// the cloud scheduler.
+type createSessionRequest struct {
+	SessionName string
+	Tool        AIClient
+	ProjectPath string
+	Prompt      string
+}
+
+func parseCreateSessionPayload(payload map[string]interface{}) (createSessionRequest, error) {
+	req := createSessionRequest{}
+	req.SessionName, _ = payload["session_name"].(string)
+	tool, _ := payload["tool"].(string)
+	req.Tool = AIClient(tool)
+	req.ProjectPath, _ = payload["project_path"].(string)
+	req.Prompt, _ = payload["prompt"].(string)
+
+	if req.SessionName == "" || strings.ContainsAny(req.SessionName, ".: ") {
+		return req, fmt.Errorf("invalid session name %q", req.SessionName)
+	}
+	if _, ok := toolConfigs[req.Tool]; !ok {
+		return req, fmt.Errorf("unknown AI tool: %s", tool)
+	}
+	if req.ProjectPath == "" {
+		return req, fmt.Errorf("project_path required")
+	}
+	return req, nil
+}
+
+// tmuxNewSessionArgs builds the tmux command that starts the AI tool in a
+// detached session rooted at the project path.
+func tmuxNewSessionArgs(tool AIClient, sessionName, projectPath string) []string {
+	cmdName, cmdArgs := getToolCommand(tool, projectPath)
+	args := []string{"-u", "new-session", "-d", "-s", sessionName, "-c", projectPath}
+	if tool == AIClientClaude {
+		// Claude Code: 使用 env -u CLAUDECODE 移除环境变量
+		args = append(args, "env", "-u", "CLAUDECODE")
+	}
+	args = append(args, cmdName)
+	return append(args, cmdArgs...)
+}
+
+// start connects a session to the cloud, creating its tmux session if
+// needed, and relays terminal output and input until the process exits.
+func (m *sessionManager) start(tool AIClient, projectPath, sessionName string) (*client.WSClient, error) {
+	m.mu.Lock()
+	if ws, ok := m.running[sessionName]; ok {
+		m.mu.Unlock()
+		return ws, nil
+	}
+	m.mu.Unlock()
+
+	// WebSocket 连接
+	slog.Info("connecting to cloud", "session_name", sessionName)
+	ws, err := client.NewWSClient("ws://"+m.serverURL+"/ws", m.deviceID, sessionName, agentTokenFor(m.serverURL, m.deviceID))
+	if err != nil {
+		return nil, err
+	}
+	config, err := loadAgentConfig(getAgentConfigPath())
+	if err != nil {
+		slog.Warn("load agent config failed", "error", err)
+	}
+	ws.SetHeartbeat(config.heartbeat())
+
+	// 检查 tmux session 是否已存在
+	cmd := exec.Command("tmux", "-u", "has-session", "-t", sessionName)
+	if err := cmd.Run(); err != nil {
+		// 创建新的 tmux session 并在其中运行 AI 工具
+		exec.Command("tmux", tmuxNewSessionArgs(tool, sessionName, projectPath)...).Run()
+	}
+	// session 已存在时只接管，不重启。对 Codex/Claude 发送 Ctrl+C 可能会让
+	// 唯一 pane 退出并销毁 tmux session，导致 H5 看起来在线但无法接收输入。
+	exec.Command("tmux", "-u", "set-option", "-t", sessionName, "history-limit", fmt.Sprintf("%d", historyLimit)).Run()
+
+	m.registerSession(sessionName, projectPath)
+
+	m.mu.Lock()
+	m.running[sessionName] = ws
+	m.projects[sessionName] = projectPath
+	m.mu.Unlock()
+
+	trace := &outputTrace{}
+	prompts := &promptWatch{}
+	go captureTerminalOutput(ws, sessionName, trace, prompts)
+	go reportWorkspaceStatus(ws, projectPath)
+	ws.OnBinary(func(frame []byte) {
+		if err := m.uploads.WriteFrame(frame); err != nil {
+			slog.Warn("upload frame rejected", "session_name", sessionName, "error", err)
+		}
+	})
+	m.registerHandlers(ws, sessionName, trace, prompts)
+	ws.OnConnect(func() { sendHello(ws) })
+	sendHello(ws)
+	ws.OnMessage(func(data []byte) {
+		slog.Debug("unhandled ws message", "session_name", sessionName, "payload", data)
+	})
+	return ws, nil
+}
+
+// 向服务器注册 session
+func (m *sessionManager) registerSession(sessionName, projectPath string) {
+	sessionJSON, _ := json.Marshal(map[string]string{
+		"device_id":    m.deviceID,
+		"session_name": sessionName,
+		"project_path": projectPath,
+	})
+	slog.Debug("registering session", "session_name", sessionName, "project_path", projectPath)
+	req, err := http.NewRequest("POST", "http://"+m.serverURL+"/api/sessions", strings.NewReader(string(sessionJSON)))
+	if err != nil {
+		slog.Warn("session registration request build failed", "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token := agentTokenFor(m.serverURL, m.deviceID)(); token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		slog.Warn("session registration failed", "session_name", sessionName, "error", err)
+		return
+	}
+	defer resp.Body.Close()
+	var result map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if sessionID, ok := result["session_id"].(float64); ok {
+		slog.Info("session registered", "session_id", int(sessionID), "session_name", sessionName)
+	} else if resp.StatusCode >= 400 {
+		slog.Warn("session registration failed", "session_name", sessionName, "status", resp.StatusCode, "error", result["error"])
+	}
+}
+
+// 捕获终端输出并发送到 H5。输入之后的捕获记录在输入的 trace 中，直到画面变化。
+// 队列提示词执行完、画面稳定后上报 prompt_done
+func captureTerminalOutput(ws *client.WSClient, sessionName string, trace *outputTrace, prompts *promptWatch) {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	var lastContent string
+
+	for range ticker.C {
+		ctx := context.Background()
+		var span *tracing.Span
+		input := trace.pending()
+		if input != nil {
+			ctx, span = tracing.Start(input, "agent.capture", "session_name", sessionName)
+		}
+
+		// 捕获 tmux 历史记录（完整历史，不只是可见区域）
+		// -S -5000 从最后 5000 行开始捕获
+		cmd := exec.Command("tmux", "-u", "capture-pane", "-t", sessionName, "-p", "-e", "-S", "-5000")
+		out, err := cmd.Output()
+		if err != nil {
+			span.RecordError(err)
+			span.End()
+			continue
+		}
+		output := string(out)
+
+		// 只发送有变化的内容
+		changed := output != lastContent && output != ""
+		if changed {
+			lastContent = output
+			ws.SendSnapshot(ctx, "terminal_output", map[string]interface{}{
+				"content": output,
+			})
+			trace.done(input)
+		}
+		span.SetAttributes("changed", changed, "bytes", len(out))
+		span.End()
+
+		if itemID, done := prompts.observe(changed, time.Now()); done {
+			slog.Info("queued prompt done", "session_name", sessionName, "queue_item_id", itemID)
+			ws.Send("prompt_done", map[string]interface{}{
+				"queue_item_id": itemID,
+			})
+		}
+	}
+}
+
+// 定期上报项目的 git 状态（分支、改动文件、最近提交），只在变化时发送
+func reportWorkspaceStatus(ws *client.WSClient, projectPath string) {
+	ticker := time.NewTicker(workspaceStatusInterval)
+	defer ticker.Stop()
+
+	var lastStatus string
+	for {
+		status, err := gitstatus.Inspect(projectPath)
+		if err != nil {
+			slog.Warn("workspace status failed", "project_path", projectPath, "error", err)
+		} else if encoded, _ := json.Marshal(status); string(encoded) != lastStatus {
+			lastStatus = string(encoded)
+			ws.Send("workspace_status", workspaceStatusPayload(status))
+		}
+		<-ticker.C
+	}
+}
+
+func workspaceStatusPayload(status *gitstatus.Status) map[string]interface{} {
+	payload := map[string]interface{}{
+		"is_repo":       status.IsRepo,
+		"branch":        status.Branch,
+		"upstream":      status.Upstream,
+		"ahead":         status.Ahead,
+		"behind":        status.Behind,
+		"dirty":         status.Dirty,
+		"files_changed": status.FilesChanged,
+		"additions":     status.Additions,
+		"deletions":     status.Deletions,
+		"files":         status.Files,
+		"summary":       status.Summary(),
+	}
+	if status.LastCommit != nil {
+		payload["last_commit"] = status.LastCommit
+	}
+	return payload
+}
+
+// 处理 H5 输入和云端命令。输入按到达顺序同步执行；云端请求在 goroutine
+// 中处理，通过 Reply 按 id 回复。
+func (m *sessionManager) registerHandlers(ws *client.WSClient, sessionName string, trace *outputTrace, prompts *promptWatch) {
+	input := func(name string, commands [][]string, env *client.Envelope) {
+		ctx, span := tracing.Start(env.Context(), name, "session_name", sessionName)
+		runTmuxCommands(ctx, commands)
+		span.End()
+		trace.set(ctx)
+	}
+	ws.Handle("terminal_input", func(env *client.Envelope) {
+		input("agent.terminal_input", terminalInputToTmuxCommands(sessionName, env.PayloadMap()), env)
+	})
+	ws.Handle("submit_prompt", func(env *client.Envelope) {
+		payload := env.PayloadMap()
+		input("agent.submit_prompt", submitPromptToTmuxCommands(sessionName, payload), env)
+		itemID, _ := payload["queue_item_id"].(float64)
+		prompts.start(int64(itemID), time.Now())
+	})
+	ws.Handle("create_session", func(env *client.Envelope) {
+		go m.createScheduledSession(env.PayloadMap())
+	})
+	ws.Handle("hello_result", func(env *client.Envelope) {
+		handleHelloResult(ws, env)
+	})
+
+	requests := map[string]func(sessionName string, req *client.Envelope){
+		"get_diff":   m.replyDiff,
+		"git_action": m.replyGitAction,
+		"list_dir":   m.replyFiles,
+		"read_file":  m.replyFiles,
+		// 分块数据在 readPump 中同步写入，finish 一定在所有分块之后到达
+		"upload_start":  m.replyUpload,
+		"upload_finish": m.replyUpload,
+		"upload_abort":  m.replyUpload,
+	}
+	for msgType, reply := range requests {
+		reply := reply
+		ws.Handle(msgType, func(req *client.Envelope) {
+			go reply(sessionName, req)
+		})
+	}
+}
+
+func runTmuxCommands(ctx context.Context, commands [][]string) {
+	for _, args := range commands {
+		slog.Debug("tmux", "command", args[0], "input", strings.Join(args, " "))
+		_, span := tracing.Start(ctx, "tmux "+args[0])
+		if err := exec.Command("tmux", args...).Run(); err != nil {
+			slog.Warn("tmux command failed", "command", args[0], "error", err)
+			span.RecordError(err)
+		}
+		span.End()
+		if isLiteralTmuxInput(args) {
+			time.Sleep(150 * time.Millisecond)
+		}
+	}
+}
+
+// replyDiff answers a get_diff request with the structured diff of the
+// session's project.
+func (m *sessionManager) replyDiff(sessionName string, req *client.Envelope) {
+	m.mu.Lock()
+	ws := m.running[sessionName]
+	projectPath := m.projects[sessionName]
+	m.mu.Unlock()
+	if ws == nil || req.ID == "" {
+		return
+	}
+	payload := req.PayloadMap()
+
+	opts := gitstatus.DiffOptions{}
+	opts.Base, _ = payload["base"].(string)
+	if maxBytes, ok := payload["max_bytes"].(float64); ok {
+		opts.MaxBytes = int(maxBytes)
+	}
+	diff, err := gitstatus.WorkingTreeDiff(projectPath, opts)
+	if err := sendReply(ws, req, diff, err); err != nil {
+		slog.Warn("reply failed", "type", req.Type, "session_name", sessionName, "error", err)
+	}
+}
+
+// replyGitAction runs a remote git action if the project's allowlist in the
+// agent config permits it. The config is re-read so edits apply without a
+// restart.
+func (m *sessionManager) replyGitAction(sessionName string, req *client.Envelope) {
+	m.mu.Lock()
+	ws := m.running[sessionName]
+	projectPath := m.projects[sessionName]
+	m.mu.Unlock()
+	if ws == nil || req.ID == "" {
+		return
+	}
+
+	var action gitaction.Request
+	json.Unmarshal(req.Payload, &action)
+
+	config, err := loadAgentConfig(getAgentConfigPath())
+	if err != nil {
+		slog.Warn("load agent config failed", "error", err)
+	}
+	var result gitaction.Result
+	if !config.gitActionAllowed(projectPath, action.Action) {
+		result = gitaction.Result{
+			Action:  action.Action,
+			Denied:  true,
+			Error:   fmt.Sprintf("git %s is not allowed for %s", action.Action, projectPath),
+			Summary: fmt.Sprintf("git %s refused by agent allowlist", action.Action),
+		}
+	} else {
+		result = gitaction.Run(projectPath, action)
+	}
+	slog.Info("git action", "action", action.Action, "project_path", projectPath, "ok", result.OK, "denied", result.Denied)
+	if err := sendReply(ws, req, result, nil); err != nil {
+		slog.Warn("reply failed", "type", req.Type, "session_name", sessionName, "error", err)
+	}
+}
+
+// replyFiles answers list_dir and read_file requests. Paths are relative to
+// the session's project and may not leave it.
+func (m *sessionManager) replyFiles(sessionName string, req *client.Envelope) {
+	m.mu.Lock()
+	ws := m.running[sessionName]
+	projectPath := m.projects[sessionName]
+	m.mu.Unlock()
+	if ws == nil || req.ID == "" {
+		return
+	}
+	payload := req.PayloadMap()
+
+	path, _ := payload["path"].(string)
+	var result interface{}
+	var err error
+	if req.Type == "list_dir" {
+		result, err = filebrowser.ListDir(projectPath, path)
+	} else {
+		maxBytes, _ := payload["max_bytes"].(float64)
+		result, err = filebrowser.ReadFile(projectPath, path, int(maxBytes))
+	}
+	if err := sendReply(ws, req, result, err); err != nil {
+		slog.Warn("reply failed", "type", req.Type, "session_name", sessionName, "error", err)
+	}
+}
+
+// replyUpload drives an upload into the project's drop folder. When the
+// file is complete its path is typed into the tool's prompt, without Enter,
+// so the user can keep writing the prompt around it.
+func (m *sessionManager) replyUpload(sessionName string, req *client.Envelope) {
+	m.mu.Lock()
+	ws := m.running[sessionName]
+	projectPath := m.projects[sessionName]
+	m.mu.Unlock()
+	if ws == nil || req.ID == "" {
+		return
+	}
+	payload := req.PayloadMap()
+
+	uploadID, _ := payload["upload_id"].(string)
+	var result interface{}
+	var err error
+	switch req.Type {
+	case "upload_start":
+		config, configErr := loadAgentConfig(getAgentConfigPath())
+		if configErr != nil {
+			slog.Warn("load agent config failed", "error", configErr)
+		}
+		filename, _ := payload["filename"].(string)
+		maxBytes, _ := payload["max_bytes"].(float64)
+		err = m.uploads.Start(uploadID, projectPath, config.uploadDir(projectPath), filename, config.uploadMaxBytes(int64(maxBytes)))
+		result = map[string]interface{}{"upload_id": uploadID}
+	case "upload_finish":
+		size, _ := payload["size"].(float64)
+		sum, _ := payload["sha256"].(string)
+		var path string
+		path, err = m.uploads.Finish(uploadID, int64(size), sum)
+		if err == nil {
+			runTmuxCommands(context.Background(), [][]string{uploadPathTmuxCommand(sessionName, path)})
+		}
+		result = map[string]interface{}{"path": path}
+	case "upload_abort":
+		m.uploads.Abort(uploadID)
+		result = map[string]interface{}{"upload_id": uploadID}
+	}
+	if err := sendReply(ws, req, result, err); err != nil {
+		slog.Warn("reply failed", "type", req.Type, "session_name", sessionName, "error", err)
+	}
+}
+
+// uploadPathTmuxCommand types the uploaded file's path followed by a space.
+func uploadPathTmuxCommand(sessionName, path string) []string {
+	return []string{"send-keys", "-t", sessionName, "-l", path + " "}
+}
+
+// sendReply answers a cloud request; the cloud matches the reply by id.
+func sendReply(ws *client.WSClient, req *client.Envelope, payload interface{}, replyErr error) error {
+	if replyErr != nil {
+		return ws.Reply(req, nil, &client.EnvelopeError{Code: replyErrorCode(replyErr), Message: replyErr.Error()})
+	}
+	return ws.Reply(req, payload, nil)
+}
+
+// replyErrorCode classifies errors so the cloud can pick an HTTP status.
+func replyErrorCode(err error) string {
+	switch {
+	case errors.Is(err, filebrowser.ErrOutsideRoot), errors.Is(err, filebrowser.ErrHidden), errors.Is(err, upload.ErrInvalidDropDir):
+		return "forbidden"
+	case errors.Is(err, filebrowser.ErrNotFound):
+		return "not_found"
+	case errors.Is(err, filebrowser.ErrNotDirectory), errors.Is(err, filebrowser.ErrIsDirectory), errors.Is(err, gitstatus.ErrNotRepository),
+		errors.Is(err, upload.ErrChecksum), errors.Is(err, upload.ErrTooLarge), errors.Is(err, upload.ErrUnknownUpload), errors.Is(err, upload.ErrInvalidFrame):
+		return "invalid"
+	default:
+		return "failed"
+	}
+}
+
+// createScheduledSession starts the session requested by a cloud schedule
+// and types its prompt once the AI tool is up.
+func (m *sessionManager) createScheduledSession(payload map[string]interface{}) {
+	req, err := parseCreateSessionPayload(payload)
+	if err != nil {
+		slog.Warn("create_session rejected", "error", err)
+		return
+	}
+	if info, err := os.Stat(req.ProjectPath); err != nil || !info.IsDir() {
+		slog.Warn("create_session rejected: project path is not a directory", "project_path", req.ProjectPath)
+		return
+	}
+	if err := checkTool(req.Tool); err != nil {
+		slog.Warn("create_session rejected", "error", err)
+		return
+	}
+	config, err := loadAgentConfig(getAgentConfigPath())
+	if err != nil {
+		slog.Warn("load agent config failed", "error", err)
+	}
+	if !config.remoteSessionAllowed(req.ProjectPath) {
+		slog.Warn("create_session rejected: project path is outside the workspace roots", "project_path", req.ProjectPath)
+		return
+	}
+
+	m.mu.Lock()
+	_, exists := m.running[req.SessionName]
+	m.mu.Unlock()
+	if exists {
+		slog.Info("create_session ignored: session is already running", "session_name", req.SessionName)
+		return
+	}
+
+	if _, err := m.start(req.Tool, req.ProjectPath, req.SessionName); err != nil {
+		slog.Warn("create_session failed", "session_name", req.SessionName, "error", err)
+		return
+	}
+	slog.Info("scheduled session started", "session_name", req.SessionName, "tool", req.Tool, "project_path", req.ProjectPath)
+
+	time.Sleep(scheduledPromptDelay)
+	runTmuxCommands(context.Background(), submitPromptToTmuxCommands(req.SessionName, map[string]interface{}{"prompt": req.Prompt}))
+}
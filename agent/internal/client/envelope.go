@@ -0,0 +1,85 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/mobile-coder/cbor"
+	"github.com/mobile-coder/tracing"
+)
+
+// ProtocolVersion is the envelope version this agent speaks.
+const ProtocolVersion = 1
+
+// Frame encodings the agent can read and write. JSON text frames are the
+// default; CBOR (RFC 8949) binary frames carry the same envelope.
+const (
+	EncodingJSON = "json"
+	EncodingCBOR = "cbor"
+)
+
+// Envelope is the JSON frame exchanged with the cloud. Plain events only
+// carry type and payload; a request from the cloud sets ID and the agent's
+// reply sets ReplyTo to that ID. Messages that must survive a reconnect
+// carry Seq, and an "ack" envelope acknowledges every Seq up to Ack.
+// TraceParent is the W3C trace context the message belongs to.
+type Envelope struct {
+	ID          string          `json:"id,omitempty"`
+	ReplyTo     string          `json:"reply_to,omitempty"`
+	Type        string          `json:"type"`
+	Version     int             `json:"version,omitempty"`
+	Seq         uint64          `json:"seq,omitempty"`
+	Ack         uint64          `json:"ack,omitempty"`
+	TraceParent string          `json:"traceparent,omitempty"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	Error       *EnvelopeError  `json:"error,omitempty"`
+}
+
+// EnvelopeError is the failure of a request; Code lets the cloud pick an
+// HTTP status (forbidden, not_found, invalid, failed).
+type EnvelopeError struct {
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+var errMissingType = errors.New("envelope has no type")
+
+// DecodeEnvelope parses a text frame.
+func DecodeEnvelope(data []byte) (*Envelope, error) {
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+	if envelope.Type == "" {
+		return nil, errMissingType
+	}
+	return &envelope, nil
+}
+
+// decodeCBOREnvelope is DecodeEnvelope for a CBOR frame.
+func decodeCBOREnvelope(frame []byte) (*Envelope, error) {
+	var envelope Envelope
+	if err := cbor.Unmarshal(frame, &envelope); err != nil {
+		return nil, err
+	}
+	if envelope.Type == "" {
+		return nil, errMissingType
+	}
+	return &envelope, nil
+}
+
+// PayloadMap decodes the payload as a JSON object; anything else is empty.
+func (e *Envelope) PayloadMap() map[string]interface{} {
+	payload := map[string]interface{}{}
+	json.Unmarshal(e.Payload, &payload)
+	if payload == nil {
+		payload = map[string]interface{}{}
+	}
+	return payload
+}
+
+// Context returns a context continuing the trace the envelope carries.
+func (e *Envelope) Context() context.Context {
+	return tracing.Extract(context.Background(), e.TraceParent)
+}
@@ -1,30 +1,89 @@
 package client
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
-	"log"
+	"log/slog"
+	"net/http"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/mobile-coder/cbor"
+	"github.com/mobile-coder/tracing"
 )
 
+// dialer negotiates permessage-deflate; terminal output compresses well.
+var dialer = &websocket.Dialer{
+	Proxy:             http.ProxyFromEnvironment,
+	HandshakeTimeout:  45 * time.Second,
+	EnableCompression: true,
+}
+
+// Heartbeat defaults; the cloud pings too, so either side notices a
+// half-open connection.
+const (
+	defaultPingInterval = 25 * time.Second
+	defaultReadTimeout  = 60 * time.Second
+	writeWait           = 10 * time.Second
+)
+
+// resumeTimeout is how long a new connection waits for hello_result. A
+// cloud that never answers gets messages live, without the resume
+// handshake, rather than having them buffered forever.
+var resumeTimeout = 15 * time.Second
+
+// maxOutbox bounds the messages kept until the cloud acks them. Terminal
+// output is a full snapshot, so dropping the oldest during a long outage
+// loses nothing the next one does not repeat.
+const maxOutbox = 256
+
 type WSClient struct {
 	conn       *websocket.Conn
 	deviceID   string
 	sessionName string
 	serverURL  string
+	token      func() string // agent token, read again on every dial
 	mu         sync.Mutex
 	onMessage  func(msg []byte)
+	onBinary   func(msg []byte)
+	handlers   map[string]func(env *Envelope)
+	onConnect  func()
+	encoding   string // EncodingJSON or EncodingCBOR, guarded by mu
 	reconnect  bool
+	pingInterval time.Duration
+	readTimeout  time.Duration
+
+	// Reliable delivery, guarded by mu. Sent messages stay in outbox until
+	// acked and are replayed after Resume; until then a new connection
+	// only buffers them.
+	streamID     string
+	nextSeq      uint64
+	outbox       []*Envelope
+	resumed      bool
+	reliable     bool
+	peerStreamID string
+	lastReceived uint64 // highest seq received from the cloud
+	snapshot     *Envelope // newest snapshot waiting for the stream to resume
 }
 
-func NewWSClient(serverURL, deviceID, sessionName string) (*WSClient, error) {
+// NewWSClient dials the cloud as the agent of deviceID. token returns the
+// agent token sent in the Authorization header; it is called again on every
+// reconnect, so a token refreshed on disk is picked up.
+func NewWSClient(serverURL, deviceID, sessionName string, token func() string) (*WSClient, error) {
 	ws := &WSClient{
 		serverURL:   serverURL,
+		token:       token,
 		deviceID:    deviceID,
 		sessionName: sessionName,
 		reconnect:   true,
+		handlers:    make(map[string]func(env *Envelope)),
+		streamID:    newStreamID(),
+		reliable:    true,
+		pingInterval: defaultPingInterval,
+		readTimeout:  defaultReadTimeout,
 	}
 	if err := ws.connect(); err != nil {
 		return nil, err
@@ -37,32 +96,162 @@ func (c *WSClient) connect() error {
 	if c.sessionName != "" {
 		url += "&session_name=" + c.sessionName
 	}
-	log.Printf("WebSocket connecting to: %s", url)
-	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	header := http.Header{}
+	if c.token != nil {
+		if token := c.token(); token != "" {
+			header.Set("Authorization", token)
+		}
+	}
+	slog.Info("websocket connecting", "url", url)
+	conn, _, err := dialer.Dial(url, header)
 	if err != nil {
 		return err
 	}
+	c.mu.Lock()
 	c.conn = conn
+	c.resumed = false
+	c.mu.Unlock()
+	time.AfterFunc(resumeTimeout, func() { c.resumeWithoutHello(conn) })
 	return nil
 }
 
+func newStreamID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// SetHeartbeat sets how often the agent pings the cloud and how long the
+// connection may stay silent before it is treated as dead and redialed.
+// Call it before OnMessage starts reading.
+func (c *WSClient) SetHeartbeat(pingInterval, readTimeout time.Duration) {
+	if pingInterval > 0 {
+		c.pingInterval = pingInterval
+	}
+	if readTimeout > 0 {
+		c.readTimeout = readTimeout
+	}
+}
+
+// OnMessage sets the handler of messages no Handle handler claims and
+// starts reading.
 func (c *WSClient) OnMessage(handler func(msg []byte)) {
 	c.onMessage = handler
 	go c.readPump()
 }
 
+// OnConnect sets a callback run after every successful reconnect, e.g. to
+// repeat the hello handshake.
+func (c *WSClient) OnConnect(handler func()) {
+	c.onConnect = handler
+}
+
+// Handle registers the handler of one message type. Handlers run on the
+// read loop in arrival order; slow work should move to a goroutine. Call it
+// before OnMessage starts reading.
+func (c *WSClient) Handle(msgType string, handler func(env *Envelope)) {
+	c.handlers[msgType] = handler
+}
+
+// OnBinary sets the handler of binary frames (file uploads). Call it before
+// OnMessage starts reading.
+func (c *WSClient) OnBinary(handler func(msg []byte)) {
+	c.onBinary = handler
+}
+
 func (c *WSClient) readPump() {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+
+	// Any frame, ping or pong from the cloud proves the connection alive
+	extend := func() { conn.SetReadDeadline(time.Now().Add(c.readTimeout)) }
+	extend()
+	conn.SetPongHandler(func(string) error {
+		extend()
+		return nil
+	})
+	conn.SetPingHandler(func(data string) error {
+		extend()
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(writeWait))
+	})
+	done := make(chan struct{})
+	defer close(done)
+	go c.pingLoop(conn, done)
+
 	for {
-		_, msg, err := c.conn.ReadMessage()
+		msgType, msg, err := conn.ReadMessage()
 		if err != nil {
+			slog.Warn("websocket read failed", "error", err)
+			conn.Close()
 			if c.reconnect {
-				c.reconnectLoop()
+				go c.reconnectLoop()
 			}
 			return
 		}
-		if c.onMessage != nil {
+		extend()
+		var env *Envelope
+		if msgType == websocket.BinaryMessage {
+			if !cbor.IsFrame(msg) {
+				if c.onBinary != nil {
+					c.onBinary(msg)
+				}
+				continue
+			}
+			// CBOR envelopes are decoded straight into the struct; msg is
+			// only rebuilt as JSON for onMessage.
+			env, err = decodeCBOREnvelope(msg)
+			if err != nil {
+				slog.Warn("dropping undecodable frame", "error", err)
+				continue
+			}
+			msg = nil
+		} else {
+			env, err = DecodeEnvelope(msg)
+		}
+		if err == nil && env.Type == "ack" {
+			c.ack(env.Ack)
+			continue
+		}
+		if err == nil && env.Seq > 0 && !c.receive(env.Seq) {
+			// Replayed after a reconnect but already handled
+			c.sendAck(env.Seq)
+			continue
+		}
+		if handler, ok := c.handlers[envType(env)]; ok {
+			handler(env)
+		} else if c.onMessage != nil {
+			if msg == nil {
+				msg, _ = json.Marshal(env)
+			}
 			c.onMessage(msg)
 		}
+		if err == nil && env.Seq > 0 {
+			c.sendAck(env.Seq)
+		}
+	}
+}
+
+func envType(env *Envelope) string {
+	if env == nil {
+		return ""
+	}
+	return env.Type
+}
+
+// pingLoop pings the cloud until the connection's readPump ends.
+func (c *WSClient) pingLoop(conn *websocket.Conn, done chan struct{}) {
+	ticker := time.NewTicker(c.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				return
+			}
+		}
 	}
 }
 
@@ -71,9 +260,9 @@ func (c *WSClient) reconnectLoop() {
 	maxBackoff := 30 * time.Second
 
 	for {
-		log.Printf("Attempting to reconnect...")
+		slog.Info("websocket reconnecting")
 		if err := c.connect(); err != nil {
-			log.Printf("Reconnect failed: %v, retrying in %v", err, backoff)
+			slog.Warn("websocket reconnect failed", "error", err, "retry_in", backoff)
 			time.Sleep(backoff)
 			backoff *= 2
 			if backoff > maxBackoff {
@@ -82,41 +271,246 @@ func (c *WSClient) reconnectLoop() {
 			continue
 		}
 
-		log.Printf("Reconnected successfully")
+		slog.Info("websocket reconnected")
+		if c.onConnect != nil {
+			c.onConnect()
+		}
 		// 重连成功后恢复读取
 		go c.readPump()
 		return
 	}
 }
 
+// Send delivers an event to the cloud reliably: it gets a sequence number
+// and stays buffered until acked, so messages sent while disconnected go
+// out after the next Resume instead of failing.
 func (c *WSClient) Send(msgType string, payload interface{}) error {
-	msg := map[string]interface{}{
-		"type":    msgType,
-		"payload": payload,
+	return c.SendContext(context.Background(), msgType, payload)
+}
+
+// SendContext is Send carrying the trace of ctx to the cloud.
+func (c *WSClient) SendContext(ctx context.Context, msgType string, payload interface{}) error {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
 	}
-	data, _ := json.Marshal(msg)
+	env := &Envelope{Type: msgType, Version: ProtocolVersion, TraceParent: tracing.TraceParent(ctx), Payload: raw}
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if !c.reliable {
+		return c.writeLocked(env)
+	}
+	c.nextSeq++
+	env.Seq = c.nextSeq
+	if len(c.outbox) == maxOutbox {
+		slog.Warn("outbox full, dropping message", "type", c.outbox[0].Type, "seq", c.outbox[0].Seq)
+		c.outbox = c.outbox[1:]
+	}
+	c.outbox = append(c.outbox, env)
+	if c.resumed {
+		// A failed write is replayed after the reconnect
+		c.writeLocked(env)
+	}
+	return nil
+}
 
-	if c.conn == nil {
-		return websocket.ErrCloseSent
+// SendSnapshot sends a message that supersedes the previous one of its
+// type, such as a full-screen terminal_output. It is not sequenced: until
+// the stream resumes only the newest snapshot is kept, and it is sent
+// after the replayed messages, so a reconnect does not replay stale ones.
+func (c *WSClient) SendSnapshot(ctx context.Context, msgType string, payload interface{}) error {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
 	}
+	env := &Envelope{Type: msgType, Version: ProtocolVersion, TraceParent: tracing.TraceParent(ctx), Payload: raw}
 
-	return c.conn.WriteMessage(websocket.TextMessage, data)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.resumed {
+		c.snapshot = env
+		return nil
+	}
+	if err := c.writeLocked(env); err != nil {
+		// Sent after the reconnect unless a newer snapshot replaces it
+		c.snapshot = env
+	}
+	return nil
+}
+
+// flushSnapshotLocked sends the snapshot kept while the stream was not
+// resumed; c.mu must be held.
+func (c *WSClient) flushSnapshotLocked() {
+	if c.snapshot != nil && c.writeLocked(c.snapshot) == nil {
+		c.snapshot = nil
+	}
+}
+
+// SendControl sends a message outside the reliable stream, e.g. hello,
+// which must go out before the stream resumes.
+func (c *WSClient) SendControl(msgType string, payload interface{}) error {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return c.sendEnvelope(&Envelope{Type: msgType, Version: ProtocolVersion, Payload: raw})
+}
+
+// ResumeState is what hello tells the cloud: the agent's stream id and the
+// last message received on the cloud's stream.
+func (c *WSClient) ResumeState() (streamID, peerStreamID string, lastReceived uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.streamID, c.peerStreamID, c.lastReceived
+}
+
+// Resume finishes the handshake with what hello_result reported: the
+// cloud's stream id and the last seq it received from this agent. Unacked
+// messages after that are replayed in order. A cloud without a stream id
+// does not ack, so messages are then sent without buffering.
+func (c *WSClient) Resume(peerStreamID string, ackedSeq uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if peerStreamID == "" {
+		c.sendLiveLocked()
+		return
+	}
+	if peerStreamID != c.peerStreamID {
+		// The cloud restarted; its seq starts over
+		c.peerStreamID = peerStreamID
+		c.lastReceived = 0
+	}
+	c.reliable = true
+	c.ackLocked(ackedSeq)
+	for _, env := range c.outbox {
+		if err := c.writeLocked(env); err != nil {
+			break
+		}
+	}
+	c.flushSnapshotLocked()
+	c.resumed = true
+}
+
+// resumeWithoutHello stops buffering when conn got no hello_result in
+// time, e.g. from a cloud that lost or never sent it. A hello_result that
+// still arrives later resumes the stream as usual.
+func (c *WSClient) resumeWithoutHello(conn *websocket.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != conn || c.resumed {
+		return
+	}
+	slog.Warn("no hello_result from the cloud, sending without resume", "buffered", len(c.outbox))
+	c.sendLiveLocked()
+}
+
+// sendLiveLocked flushes the outbox and sends later messages without
+// sequence numbers; c.mu must be held.
+func (c *WSClient) sendLiveLocked() {
+	for _, env := range c.outbox {
+		c.writeLocked(env)
+	}
+	c.outbox = nil
+	c.flushSnapshotLocked()
+	c.reliable = false
+	c.resumed = true
+}
+
+func (c *WSClient) ack(seq uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ackLocked(seq)
+}
+
+func (c *WSClient) ackLocked(seq uint64) {
+	i := 0
+	for i < len(c.outbox) && c.outbox[i].Seq <= seq {
+		i++
+	}
+	c.outbox = c.outbox[i:]
+}
+
+// receive records a sequenced message from the cloud and reports whether
+// it is new.
+func (c *WSClient) receive(seq uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if seq <= c.lastReceived {
+		return false
+	}
+	c.lastReceived = seq
+	return true
+}
+
+func (c *WSClient) sendAck(seq uint64) {
+	c.sendEnvelope(&Envelope{Type: "ack", Version: ProtocolVersion, Ack: seq})
+}
+
+// Reply answers the request req with payload, or with replyErr if set. The
+// reply type is the request type with a _result suffix.
+func (c *WSClient) Reply(req *Envelope, payload interface{}, replyErr *EnvelopeError) error {
+	env := &Envelope{ReplyTo: req.ID, Type: req.Type + "_result", Version: ProtocolVersion, Error: replyErr}
+	if replyErr == nil {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		env.Payload = raw
+	}
+	return c.sendEnvelope(env)
+}
+
+func (c *WSClient) sendEnvelope(env *Envelope) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeLocked(env)
 }
 
 func (c *WSClient) SendRaw(data []byte) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	return c.writeRawLocked(data)
+}
+
+func (c *WSClient) writeLocked(env *Envelope) error {
+	if c.encoding == EncodingCBOR && c.conn != nil {
+		frame, err := cbor.Marshal(env)
+		if err != nil {
+			return err
+		}
+		c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		return c.conn.WriteMessage(websocket.BinaryMessage, frame)
+	}
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return c.writeRawLocked(data)
+}
 
+func (c *WSClient) writeRawLocked(data []byte) error {
 	if c.conn == nil {
 		return websocket.ErrCloseSent
 	}
 
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if c.encoding == EncodingCBOR {
+		if frame, err := cbor.FromJSON(data); err == nil {
+			return c.conn.WriteMessage(websocket.BinaryMessage, frame)
+		}
+	}
 	return c.conn.WriteMessage(websocket.TextMessage, data)
 }
 
+// SetEncoding switches outgoing envelopes to the encoding the cloud chose
+// in hello_result. Incoming frames are decoded whatever their encoding.
+func (c *WSClient) SetEncoding(encoding string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.encoding = encoding
+}
+
 func (c *WSClient) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -0,0 +1,401 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mobile-coder/cbor"
+)
+
+func TestWSClientDispatchesByTypeAndReplies(t *testing.T) {
+	replies := make(chan *Envelope, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"terminal_output","payload":{}}`))
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"id":"req-1","type":"list_dir","version":1,"payload":{"path":"src"}}`))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		env, _ := DecodeEnvelope(data)
+		replies <- env
+		conn.ReadMessage()
+	}))
+	defer server.Close()
+
+	ws, err := NewWSClient("ws"+strings.TrimPrefix(server.URL, "http"), "dev-1", "feature", nil)
+	if err != nil {
+		t.Fatalf("NewWSClient: %v", err)
+	}
+	defer ws.Close()
+
+	unhandled := make(chan string, 1)
+	ws.Handle("list_dir", func(req *Envelope) {
+		if req.PayloadMap()["path"] != "src" {
+			ws.Reply(req, nil, &EnvelopeError{Code: "invalid", Message: "bad path"})
+			return
+		}
+		ws.Reply(req, map[string]string{"path": "src"}, nil)
+	})
+	ws.OnMessage(func(msg []byte) {
+		unhandled <- string(msg)
+	})
+
+	select {
+	case msg := <-unhandled:
+		if !strings.Contains(msg, "terminal_output") {
+			t.Fatalf("unhandled = %s", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("unhandled message not delivered to OnMessage")
+	}
+	select {
+	case reply := <-replies:
+		if reply.ReplyTo != "req-1" || reply.Type != "list_dir_result" || reply.Version != ProtocolVersion || reply.Error != nil || string(reply.Payload) != `{"path":"src"}` {
+			t.Fatalf("reply = %+v payload=%s", reply, reply.Payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no reply from handler")
+	}
+}
+
+func TestDecodeEnvelopeRequiresType(t *testing.T) {
+	if _, err := DecodeEnvelope([]byte(`{"payload":{}}`)); err == nil {
+		t.Fatal("envelope without type should be rejected")
+	}
+	env, err := DecodeEnvelope([]byte(`{"type":"terminal_input","payload":"oops"}`))
+	if err != nil || len(env.PayloadMap()) != 0 {
+		t.Fatalf("env = %+v, err = %v; want empty payload map", env, err)
+	}
+}
+
+func TestWSClientSpeaksCBORWithCompression(t *testing.T) {
+	frames := make(chan int, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate") {
+			t.Errorf("client did not offer permessage-deflate")
+		}
+		conn, err := (&websocket.Upgrader{EnableCompression: true}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, _ := cbor.FromJSON([]byte(`{"id":"req-2","type":"get_diff","version":1,"payload":{"base":"main"}}`))
+		conn.WriteMessage(websocket.BinaryMessage, request)
+		conn.WriteMessage(websocket.BinaryMessage, []byte("MCUP\x01upload-chunk"))
+		messageType, reply, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var env Envelope
+		if err := cbor.Unmarshal(reply, &env); err != nil || env.ReplyTo != "req-2" || env.PayloadMap()["base"] != "main" {
+			t.Errorf("reply = %+v (%v), want the get_diff payload echoed to req-2", env, err)
+		}
+		frames <- messageType
+		conn.ReadMessage()
+	}))
+	defer server.Close()
+
+	ws, err := NewWSClient("ws"+strings.TrimPrefix(server.URL, "http"), "dev-1", "feature", nil)
+	if err != nil {
+		t.Fatalf("NewWSClient: %v", err)
+	}
+	defer ws.Close()
+	ws.SetEncoding(EncodingCBOR)
+
+	chunks := make(chan []byte, 1)
+	ws.OnBinary(func(msg []byte) { chunks <- msg })
+	ws.Handle("get_diff", func(req *Envelope) {
+		ws.Reply(req, req.PayloadMap(), nil)
+	})
+	ws.OnMessage(func([]byte) {})
+
+	select {
+	case messageType := <-frames:
+		if messageType != websocket.BinaryMessage {
+			t.Fatalf("reply frame type = %d, want binary CBOR", messageType)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no reply to CBOR request")
+	}
+	select {
+	case chunk := <-chunks:
+		if !strings.HasPrefix(string(chunk), "MCUP") {
+			t.Fatalf("chunk = %q", chunk)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("upload chunk not passed to OnBinary")
+	}
+}
+
+func TestWSClientResumesAfterReconnect(t *testing.T) {
+	firstOutput := make(chan struct{})
+	hellos := make(chan map[string]interface{}, 1)
+	resumed := make(chan *Envelope, 1)
+	connections := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		connections++
+		if connections == 1 {
+			conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"hello_result","payload":{"stream_id":"cloud-1","resume_seq":0}}`))
+			conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"terminal_input","seq":1,"payload":{"data":"a"}}`))
+			for {
+				_, data, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				if env, _ := DecodeEnvelope(data); env.Type == "terminal_output" {
+					// Drop the connection before acking the output
+					close(firstOutput)
+					return
+				}
+			}
+		}
+
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		hello, _ := DecodeEnvelope(data)
+		hellos <- hello.PayloadMap()
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"hello_result","payload":{"stream_id":"cloud-1","resume_seq":1}}`))
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"terminal_input","seq":1,"payload":{"data":"a"}}`))
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"terminal_input","seq":2,"payload":{"data":"b"}}`))
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if env, _ := DecodeEnvelope(data); env.Type == "terminal_output" {
+				resumed <- env
+			}
+		}
+	}))
+	defer server.Close()
+
+	ws, err := NewWSClient("ws"+strings.TrimPrefix(server.URL, "http"), "dev-1", "feature", nil)
+	if err != nil {
+		t.Fatalf("NewWSClient: %v", err)
+	}
+	defer ws.Close()
+
+	inputs := make(chan string, 4)
+	ws.Handle("terminal_input", func(env *Envelope) {
+		inputs <- env.PayloadMap()["data"].(string)
+	})
+	ws.Handle("hello_result", func(env *Envelope) {
+		result := env.PayloadMap()
+		ws.Resume(result["stream_id"].(string), uint64(result["resume_seq"].(float64)))
+	})
+	ws.OnConnect(func() {
+		streamID, peerStreamID, lastReceived := ws.ResumeState()
+		ws.SendControl("hello", map[string]interface{}{"stream_id": streamID, "resume_stream_id": peerStreamID, "resume_seq": lastReceived})
+	})
+	ws.OnMessage(func([]byte) {})
+
+	ws.Send("terminal_output", map[string]string{"content": "first"})
+	select {
+	case <-firstOutput:
+	case <-time.After(2 * time.Second):
+		t.Fatal("first output not received")
+	}
+	// Sent while the agent reconnects: buffered, not lost
+	if err := ws.Send("terminal_output", map[string]string{"content": "second"}); err != nil {
+		t.Fatalf("Send during outage: %v", err)
+	}
+
+	select {
+	case hello := <-hellos:
+		if hello["resume_stream_id"] != "cloud-1" || hello["resume_seq"] != float64(1) {
+			t.Fatalf("hello = %v, want resume from cloud-1 seq 1", hello)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("no hello after reconnect")
+	}
+	select {
+	case env := <-resumed:
+		if env.Seq != 2 || !strings.Contains(string(env.Payload), "second") {
+			t.Fatalf("first frame after resume = seq %d %s, want the unacked seq 2", env.Seq, env.Payload)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("buffered output not replayed")
+	}
+
+	var got []string
+	for len(got) < 2 {
+		select {
+		case data := <-inputs:
+			got = append(got, data)
+		case <-time.After(time.Second):
+			t.Fatalf("inputs = %v, want [a b]", got)
+		}
+	}
+	if got[0] != "a" || got[1] != "b" {
+		t.Fatalf("inputs = %v, want replayed duplicate dropped", got)
+	}
+	select {
+	case data := <-inputs:
+		t.Fatalf("unexpected input %q", data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWSClientRedialsSilentConnection(t *testing.T) {
+	connected := make(chan string, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		connected <- r.Header.Get("Authorization")
+		// Half-open: never reads, so pings go unanswered
+		time.Sleep(2 * time.Second)
+	}))
+	defer server.Close()
+
+	var dials atomic.Int32
+	token := func() string { return fmt.Sprintf("agent-token-%d", dials.Add(1)) }
+	ws, err := NewWSClient("ws"+strings.TrimPrefix(server.URL, "http"), "dev-1", "feature", token)
+	if err != nil {
+		t.Fatalf("NewWSClient: %v", err)
+	}
+	defer ws.Close()
+	ws.SetHeartbeat(20*time.Millisecond, 100*time.Millisecond)
+	reconnected := make(chan struct{}, 1)
+	ws.OnConnect(func() { reconnected <- struct{}{} })
+	ws.OnMessage(func([]byte) {})
+
+	if auth := <-connected; auth != "agent-token-1" {
+		t.Fatalf("Authorization = %q, want agent-token-1", auth)
+	}
+	select {
+	case <-reconnected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("silent connection was not detected and redialed")
+	}
+	// The token is read again for the new connection
+	if auth := <-connected; auth != "agent-token-2" {
+		t.Fatalf("Authorization after redial = %q, want agent-token-2", auth)
+	}
+}
+
+func TestWSClientSendsLiveWithoutHelloResult(t *testing.T) {
+	defer func(timeout time.Duration) { resumeTimeout = timeout }(resumeTimeout)
+	resumeTimeout = 50 * time.Millisecond
+
+	received := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Never answers hello
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			received <- string(data)
+		}
+	}))
+	defer server.Close()
+
+	ws, err := NewWSClient("ws"+strings.TrimPrefix(server.URL, "http"), "dev-1", "feature", nil)
+	if err != nil {
+		t.Fatalf("NewWSClient: %v", err)
+	}
+	defer ws.Close()
+	ws.OnMessage(func([]byte) {})
+
+	if err := ws.Send("terminal_output", map[string]string{"content": "buffered"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	select {
+	case data := <-received:
+		t.Fatalf("sent %s before hello_result or the timeout", data)
+	case <-time.After(20 * time.Millisecond):
+	}
+	select {
+	case data := <-received:
+		if !strings.Contains(data, "buffered") {
+			t.Fatalf("first message = %s, want the buffered output", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("buffered output never sent without hello_result")
+	}
+
+	ws.Send("terminal_output", map[string]string{"content": "live"})
+	select {
+	case data := <-received:
+		if !strings.Contains(data, "live") || strings.Contains(data, `"seq"`) {
+			t.Fatalf("message = %s, want the live output without seq", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("live output not sent")
+	}
+}
+
+func TestWSClientKeepsOnlyTheNewestSnapshotUntilResumed(t *testing.T) {
+	defer func(timeout time.Duration) { resumeTimeout = timeout }(resumeTimeout)
+	resumeTimeout = 50 * time.Millisecond
+
+	received := make(chan string, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			received <- string(data)
+		}
+	}))
+	defer server.Close()
+
+	ws, err := NewWSClient("ws"+strings.TrimPrefix(server.URL, "http"), "dev-1", "feature", nil)
+	if err != nil {
+		t.Fatalf("NewWSClient: %v", err)
+	}
+	defer ws.Close()
+	ws.OnMessage(func([]byte) {})
+
+	for _, content := range []string{"first", "second", "newest"} {
+		if err := ws.SendSnapshot(context.Background(), "terminal_output", map[string]string{"content": content}); err != nil {
+			t.Fatalf("SendSnapshot: %v", err)
+		}
+	}
+	select {
+	case data := <-received:
+		if !strings.Contains(data, "newest") || strings.Contains(data, `"seq"`) {
+			t.Fatalf("message = %s, want only the newest snapshot, without seq", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("snapshot never sent")
+	}
+	select {
+	case data := <-received:
+		t.Fatalf("stale snapshot %s sent", data)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,247 @@
+// Package filebrowser gives read-only access to the files of a project,
+// confined to the project root.
+package filebrowser
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultMaxBytes is the file content returned when the caller sets no limit.
+	DefaultMaxBytes = 256 * 1024
+	// maxEntries bounds a directory listing.
+	maxEntries = 1000
+	// sniffBytes is how much of a file is checked for binary content.
+	sniffBytes = 8000
+)
+
+var (
+	ErrOutsideRoot  = errors.New("path is outside the project")
+	ErrHidden       = errors.New("path is not browsable")
+	ErrNotFound     = errors.New("file not found")
+	ErrNotDirectory = errors.New("not a directory")
+	ErrIsDirectory  = errors.New("is a directory")
+)
+
+// Entry is an item of a directory listing. Path is relative to the root.
+type Entry struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Type    string `json:"type"` // file, dir, symlink
+	Size    int64  `json:"size"`
+	ModTime string `json:"mod_time"`
+}
+
+// Listing is the content of a directory.
+type Listing struct {
+	Path      string  `json:"path"`
+	Entries   []Entry `json:"entries"`
+	Truncated bool    `json:"truncated,omitempty"`
+}
+
+// File is the content of a file. Binary files carry no content.
+type File struct {
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	ModTime   string `json:"mod_time"`
+	Binary    bool   `json:"binary"`
+	Truncated bool   `json:"truncated,omitempty"`
+	Content   string `json:"content"`
+}
+
+// ListDir lists the directory rel of root. Directories come first.
+func ListDir(root, rel string) (*Listing, error) {
+	realRoot, path, err := resolve(root, rel)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	if !info.IsDir() {
+		return nil, ErrNotDirectory
+	}
+
+	dirEntries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	listing := &Listing{Path: relativePath(realRoot, path), Entries: []Entry{}}
+	for _, dirEntry := range dirEntries {
+		if isHidden(dirEntry.Name()) {
+			continue
+		}
+		if len(listing.Entries) == maxEntries {
+			listing.Truncated = true
+			break
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			continue
+		}
+		entry := Entry{
+			Name:    dirEntry.Name(),
+			Path:    relativePath(realRoot, filepath.Join(path, dirEntry.Name())),
+			Type:    "file",
+			Size:    info.Size(),
+			ModTime: info.ModTime().UTC().Format("2006-01-02T15:04:05Z"),
+		}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			entry.Type = "symlink"
+		case info.IsDir():
+			entry.Type = "dir"
+			entry.Size = 0
+		}
+		listing.Entries = append(listing.Entries, entry)
+	}
+
+	sort.SliceStable(listing.Entries, func(i, j int) bool {
+		iDir, jDir := listing.Entries[i].Type == "dir", listing.Entries[j].Type == "dir"
+		if iDir != jDir {
+			return iDir
+		}
+		return listing.Entries[i].Name < listing.Entries[j].Name
+	})
+	return listing, nil
+}
+
+// ReadFile reads up to maxBytes of the file rel of root.
+func ReadFile(root, rel string, maxBytes int) (*File, error) {
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBytes
+	}
+	realRoot, path, err := resolve(root, rel)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	if info.IsDir() {
+		return nil, ErrIsDirectory
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, int64(maxBytes)))
+	if err != nil {
+		return nil, err
+	}
+
+	file := &File{
+		Path:    relativePath(realRoot, path),
+		Size:    info.Size(),
+		ModTime: info.ModTime().UTC().Format("2006-01-02T15:04:05Z"),
+	}
+	if isBinary(data) {
+		file.Binary = true
+		return file, nil
+	}
+	if info.Size() > int64(len(data)) {
+		file.Truncated = true
+		// Do not cut a multi-byte character in half.
+		for len(data) > 0 && !utf8.Valid(data) {
+			data = data[:len(data)-1]
+		}
+	}
+	file.Content = string(data)
+	return file, nil
+}
+
+// resolve maps rel to an absolute path inside root, following symlinks, and
+// refuses anything that ends up outside the root or inside .git, before or
+// after following symlinks.
+func resolve(root, rel string) (string, string, error) {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", "", err
+	}
+	realRoot, err = filepath.Abs(realRoot)
+	if err != nil {
+		return "", "", err
+	}
+
+	if filepath.IsAbs(rel) {
+		return "", "", ErrOutsideRoot
+	}
+	joined := filepath.Join(realRoot, filepath.Clean("/"+rel))
+	if !within(realRoot, joined) {
+		return "", "", ErrOutsideRoot
+	}
+	resolved, err := filepath.EvalSymlinks(joined)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", "", ErrNotFound
+		}
+		return "", "", err
+	}
+	if !within(realRoot, resolved) {
+		return "", "", ErrOutsideRoot
+	}
+	if inHiddenDir(realRoot, joined) || inHiddenDir(realRoot, resolved) {
+		return "", "", ErrHidden
+	}
+	return realRoot, resolved, nil
+}
+
+// isHidden reports whether a file or directory is kept out of browsing: the
+// git directory holds remote URLs with credentials and hooks.
+func isHidden(name string) bool {
+	return strings.EqualFold(name, ".git")
+}
+
+func inHiddenDir(root, path string) bool {
+	for _, part := range strings.Split(relativePath(root, path), "/") {
+		if isHidden(part) {
+			return true
+		}
+	}
+	return false
+}
+
+func within(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+func relativePath(root, path string) string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+func isBinary(data []byte) bool {
+	sniff := data
+	if len(sniff) > sniffBytes {
+		sniff = sniff[:sniffBytes]
+	}
+	if bytes.IndexByte(sniff, 0) >= 0 {
+		return true
+	}
+	// Allow a truncated trailing rune at the sniff boundary.
+	for i := 0; i < utf8.UTFMax && len(sniff) > 0; i++ {
+		if utf8.Valid(sniff) {
+			return false
+		}
+		sniff = sniff[:len(sniff)-1]
+	}
+	return !utf8.Valid(sniff)
+}
@@ -0,0 +1,126 @@
+package filebrowser
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newProject(t *testing.T) (string, string) {
+	t.Helper()
+	root := t.TempDir()
+	outside := t.TempDir()
+	files := map[string]string{
+		"main.go":         "package main\n",
+		"docs/guide.md":   "# Guide\n",
+		"assets/logo.png": "\x89PNG\r\n\x1a\n\x00\x00",
+		".git/config":     "[core]\n",
+		"large.txt":       strings.Repeat("你好", 100),
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("token"), 0o600); err != nil {
+		t.Fatalf("write secret: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "escape.txt")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape-dir")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	if err := os.Symlink("main.go", filepath.Join(root, "alias.go")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	return root, outside
+}
+
+func TestListDirSortsAndHidesGit(t *testing.T) {
+	root, _ := newProject(t)
+
+	listing, err := ListDir(root, "")
+	if err != nil {
+		t.Fatalf("ListDir: %v", err)
+	}
+	var names []string
+	for _, entry := range listing.Entries {
+		names = append(names, entry.Name+":"+entry.Type)
+	}
+	want := "assets:dir,docs:dir,alias.go:symlink,escape-dir:symlink,escape.txt:symlink,large.txt:file,main.go:file"
+	if got := strings.Join(names, ","); got != want {
+		t.Fatalf("entries = %s, want %s", got, want)
+	}
+
+	docs, err := ListDir(root, "docs")
+	if err != nil || len(docs.Entries) != 1 || docs.Entries[0].Path != "docs/guide.md" {
+		t.Fatalf("docs = %+v, %v", docs, err)
+	}
+	if _, err := ListDir(root, "main.go"); !errors.Is(err, ErrNotDirectory) {
+		t.Fatalf("err = %v, want ErrNotDirectory", err)
+	}
+}
+
+func TestReadFileDetectsBinaryAndTruncates(t *testing.T) {
+	root, _ := newProject(t)
+
+	file, err := ReadFile(root, "main.go", 0)
+	if err != nil || file.Content != "package main\n" || file.Binary {
+		t.Fatalf("main.go = %+v, %v", file, err)
+	}
+	if file, err := ReadFile(root, "alias.go", 0); err != nil || file.Path != "main.go" {
+		t.Fatalf("alias.go = %+v, %v, want symlink inside root followed", file, err)
+	}
+	if file, err := ReadFile(root, "assets/logo.png", 0); err != nil || !file.Binary || file.Content != "" {
+		t.Fatalf("logo.png = %+v, %v, want binary without content", file, err)
+	}
+
+	file, err = ReadFile(root, "large.txt", 10)
+	if err != nil {
+		t.Fatalf("ReadFile large: %v", err)
+	}
+	if !file.Truncated || file.Binary || file.Content != "你好你" || file.Size != 600 {
+		t.Fatalf("large.txt = %+v, want truncated on a rune boundary", file)
+	}
+	if _, err := ReadFile(root, "docs", 0); !errors.Is(err, ErrIsDirectory) {
+		t.Fatalf("err = %v, want ErrIsDirectory", err)
+	}
+	if _, err := ReadFile(root, "missing.go", 0); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestPathsEscapingRootAreRefused(t *testing.T) {
+	root, outside := newProject(t)
+
+	for _, rel := range []string{"escape.txt", "escape-dir/secret.txt", filepath.Join(outside, "secret.txt")} {
+		if _, err := ReadFile(root, rel, 0); !errors.Is(err, ErrOutsideRoot) {
+			t.Fatalf("ReadFile(%q) err = %v, want ErrOutsideRoot", rel, err)
+		}
+	}
+	if _, err := ListDir(root, "escape-dir"); !errors.Is(err, ErrOutsideRoot) {
+		t.Fatalf("ListDir(escape-dir) err = %v, want ErrOutsideRoot", err)
+	}
+	if err := os.Symlink(".git", filepath.Join(root, "git-alias")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	for _, rel := range []string{".git/config", ".git", "docs/../.git/config", "git-alias/config"} {
+		if _, err := ReadFile(root, rel, 0); !errors.Is(err, ErrHidden) {
+			t.Fatalf("ReadFile(%q) err = %v, want ErrHidden", rel, err)
+		}
+	}
+	if _, err := ListDir(root, ".git"); !errors.Is(err, ErrHidden) {
+		t.Fatalf("ListDir(.git) err = %v, want ErrHidden", err)
+	}
+	// ".." is clamped to the root rather than leaving it.
+	if listing, err := ListDir(root, "../.."); err != nil || listing.Path != "" {
+		t.Fatalf("ListDir(../..) = %+v, %v, want the root", listing, err)
+	}
+}
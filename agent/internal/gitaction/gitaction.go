@@ -0,0 +1,197 @@
+// Package gitaction runs the git write operations that can be triggered
+// remotely: commit, discard, stash, create branch and push.
+package gitaction
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	ActionCommit       = "commit"
+	ActionDiscard      = "discard"
+	ActionStash        = "stash"
+	ActionCreateBranch = "create_branch"
+	ActionPush         = "push"
+)
+
+// Actions lists every supported action.
+var Actions = []string{ActionCommit, ActionDiscard, ActionStash, ActionCreateBranch, ActionPush}
+
+// maxOutput bounds the git output returned to the cloud.
+const maxOutput = 4096
+
+var ErrInvalidParams = errors.New("invalid git action parameters")
+
+// Request is a git action with its parameters.
+type Request struct {
+	Action  string   `json:"action"`
+	Message string   `json:"message,omitempty"` // commit, stash
+	Paths   []string `json:"paths,omitempty"`   // commit, defaults to tracked changes
+	Path    string   `json:"path,omitempty"`    // discard
+	Branch  string   `json:"branch,omitempty"`  // create_branch
+	Remote  string   `json:"remote,omitempty"`  // push, defaults to origin
+}
+
+// Result is what the agent reports back.
+type Result struct {
+	Action  string `json:"action"`
+	OK      bool   `json:"ok"`
+	Denied  bool   `json:"denied,omitempty"`
+	Output  string `json:"output,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Commit  string `json:"commit,omitempty"`
+	Branch  string `json:"branch,omitempty"`
+	Summary string `json:"summary"`
+}
+
+// Run executes req in the repository at dir.
+func Run(dir string, req Request) Result {
+	result := Result{Action: req.Action}
+	output, err := run(dir, req)
+	result.Output = truncate(strings.TrimSpace(output))
+	if err != nil {
+		result.Error = err.Error()
+		result.Summary = fmt.Sprintf("git %s failed: %v", req.Action, err)
+		return result
+	}
+
+	result.OK = true
+	if head, err := git(dir, "rev-parse", "--short", "HEAD"); err == nil {
+		result.Commit = strings.TrimSpace(head)
+	}
+	if branch, err := git(dir, "rev-parse", "--abbrev-ref", "HEAD"); err == nil {
+		result.Branch = strings.TrimSpace(branch)
+	}
+	result.Summary = summarize(req, result)
+	return result
+}
+
+func run(dir string, req Request) (string, error) {
+	switch req.Action {
+	case ActionCommit:
+		message := strings.TrimSpace(req.Message)
+		if message == "" {
+			return "", fmt.Errorf("%w: commit message required", ErrInvalidParams)
+		}
+		// Untracked files are only committed when named, so a stray
+		// secret or build output is never picked up by accident.
+		add := []string{"add", "-u"}
+		if len(req.Paths) > 0 {
+			add = []string{"add", "--"}
+			for _, path := range req.Paths {
+				cleaned, err := cleanRepoPath(path)
+				if err != nil {
+					return "", err
+				}
+				add = append(add, cleaned)
+			}
+		}
+		if out, err := git(dir, add...); err != nil {
+			return out, err
+		}
+		return git(dir, "commit", "-m", message)
+	case ActionDiscard:
+		path, err := cleanRepoPath(req.Path)
+		if err != nil {
+			return "", err
+		}
+		if _, err := git(dir, "ls-files", "--error-unmatch", "--", path); err != nil {
+			// Untracked files have nothing to restore; remove them instead.
+			return git(dir, "clean", "-f", "--", path)
+		}
+		return git(dir, "restore", "--staged", "--worktree", "--source=HEAD", "--", path)
+	case ActionStash:
+		args := []string{"stash", "push", "--include-untracked"}
+		if message := strings.TrimSpace(req.Message); message != "" {
+			args = append(args, "-m", message)
+		}
+		return git(dir, args...)
+	case ActionCreateBranch:
+		if req.Branch == "" || strings.HasPrefix(req.Branch, "-") {
+			return "", fmt.Errorf("%w: invalid branch name %q", ErrInvalidParams, req.Branch)
+		}
+		if _, err := git(dir, "check-ref-format", "--branch", req.Branch); err != nil {
+			return "", fmt.Errorf("%w: invalid branch name %q", ErrInvalidParams, req.Branch)
+		}
+		return git(dir, "switch", "-c", req.Branch)
+	case ActionPush:
+		remote := req.Remote
+		if remote == "" {
+			remote = "origin"
+		}
+		if err := checkRemote(dir, remote); err != nil {
+			return "", err
+		}
+		// Never force-push from a phone.
+		return git(dir, "push", "--set-upstream", remote, "HEAD")
+	default:
+		return "", fmt.Errorf("%w: unknown action %q", ErrInvalidParams, req.Action)
+	}
+}
+
+// cleanRepoPath accepts only relative paths that stay inside the repository.
+func cleanRepoPath(path string) (string, error) {
+	if path == "" || filepath.IsAbs(path) || strings.HasPrefix(path, "-") {
+		return "", fmt.Errorf("%w: invalid path %q", ErrInvalidParams, path)
+	}
+	cleaned := filepath.Clean(path)
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: invalid path %q", ErrInvalidParams, path)
+	}
+	return cleaned, nil
+}
+
+// checkRemote accepts only the name of a remote configured in the
+// repository, never a URL or path to push to.
+func checkRemote(dir, remote string) error {
+	out, err := git(dir, "remote")
+	if err != nil {
+		return err
+	}
+	for _, name := range strings.Fields(out) {
+		if name == remote {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: unknown remote %q", ErrInvalidParams, remote)
+}
+
+func summarize(req Request, result Result) string {
+	switch req.Action {
+	case ActionCommit:
+		return fmt.Sprintf("git commit %s: %s", result.Commit, strings.TrimSpace(req.Message))
+	case ActionDiscard:
+		return fmt.Sprintf("git discard: %s", req.Path)
+	case ActionStash:
+		return "git stash: working tree changes stashed"
+	case ActionCreateBranch:
+		return fmt.Sprintf("git branch: switched to %s", req.Branch)
+	case ActionPush:
+		return fmt.Sprintf("git push: %s pushed", result.Branch)
+	default:
+		return "git " + req.Action
+	}
+}
+
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return output.String(), fmt.Errorf("git %s: %v: %s", args[0], err, truncate(strings.TrimSpace(output.String())))
+	}
+	return output.String(), nil
+}
+
+func truncate(output string) string {
+	if len(output) <= maxOutput {
+		return output
+	}
+	return output[:maxOutput] + "\n…"
+}
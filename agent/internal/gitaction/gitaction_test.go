@@ -0,0 +1,97 @@
+package gitaction
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCleanRepoPathRejectsEscapes(t *testing.T) {
+	for _, path := range []string{"", "/etc/passwd", "../secret", "a/../../b", "-f", "."} {
+		if _, err := cleanRepoPath(path); !errors.Is(err, ErrInvalidParams) {
+			t.Fatalf("cleanRepoPath(%q) err = %v, want ErrInvalidParams", path, err)
+		}
+	}
+	if got, err := cleanRepoPath("src/../main.go"); err != nil || got != "main.go" {
+		t.Fatalf("cleanRepoPath = %q, %v", got, err)
+	}
+}
+
+func TestRunCommitDiscardAndBranch(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	t.Setenv("GIT_AUTHOR_NAME", "Test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "Test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+
+	dir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	if out, err := exec.Command("git", "-C", dir, "init", "-q", "-b", "main").CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v: %s", err, out)
+	}
+
+	write("main.go", "package main\n")
+	if result := Run(dir, Request{Action: ActionCommit}); result.OK || !strings.Contains(result.Error, "message required") {
+		t.Fatalf("commit without message = %+v, want failure", result)
+	}
+	if result := Run(dir, Request{Action: ActionCommit, Message: "Initial commit", Paths: []string{"../main.go"}}); result.OK {
+		t.Fatalf("commit outside the repository = %+v, want failure", result)
+	}
+	result := Run(dir, Request{Action: ActionCommit, Message: "Initial commit", Paths: []string{"main.go"}})
+	if !result.OK || result.Commit == "" || !strings.Contains(result.Summary, "Initial commit") {
+		t.Fatalf("commit = %+v", result)
+	}
+
+	// Without paths only tracked changes are committed.
+	write("main.go", "package main\n\n// v2\n")
+	write(".env", "TOKEN=secret\n")
+	if result := Run(dir, Request{Action: ActionCommit, Message: "Update main"}); !result.OK {
+		t.Fatalf("commit tracked = %+v", result)
+	}
+	if out, _ := exec.Command("git", "-C", dir, "ls-files", ".env").Output(); len(out) != 0 {
+		t.Fatalf(".env was committed without being named")
+	}
+	if err := os.Remove(filepath.Join(dir, ".env")); err != nil {
+		t.Fatalf("remove .env: %v", err)
+	}
+
+	if result := Run(dir, Request{Action: ActionPush, Remote: "https://evil.example.com/repo.git"}); result.OK || !strings.Contains(result.Error, "unknown remote") {
+		t.Fatalf("push to a URL = %+v, want unknown remote", result)
+	}
+
+	write("main.go", "package main\n\nfunc main() {}\n")
+	write("scratch.txt", "tmp\n")
+	if result := Run(dir, Request{Action: ActionDiscard, Path: "main.go"}); !result.OK {
+		t.Fatalf("discard tracked = %+v", result)
+	}
+	if result := Run(dir, Request{Action: ActionDiscard, Path: "scratch.txt"}); !result.OK {
+		t.Fatalf("discard untracked = %+v", result)
+	}
+	content, _ := os.ReadFile(filepath.Join(dir, "main.go"))
+	if string(content) != "package main\n\n// v2\n" {
+		t.Fatalf("main.go = %q, want restored", content)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "scratch.txt")); !os.IsNotExist(err) {
+		t.Fatalf("scratch.txt should be removed, stat err = %v", err)
+	}
+
+	if result := Run(dir, Request{Action: ActionCreateBranch, Branch: "feature/login"}); !result.OK || result.Branch != "feature/login" {
+		t.Fatalf("create_branch = %+v", result)
+	}
+	if result := Run(dir, Request{Action: ActionCreateBranch, Branch: "bad..name"}); result.OK {
+		t.Fatalf("create_branch with invalid name = %+v, want failure", result)
+	}
+	if result := Run(dir, Request{Action: "rebase"}); result.OK {
+		t.Fatalf("unknown action = %+v, want failure", result)
+	}
+}
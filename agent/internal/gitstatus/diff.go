@@ -0,0 +1,267 @@
+package gitstatus
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// DiffLine is one line of a hunk. Kind is context, add or delete.
+type DiffLine struct {
+	Kind    string `json:"kind"`
+	Content string `json:"content"`
+	OldLine int    `json:"old_line,omitempty"`
+	NewLine int    `json:"new_line,omitempty"`
+}
+
+// Hunk is a contiguous block of changes in a file.
+type Hunk struct {
+	Header   string     `json:"header"`
+	OldStart int        `json:"old_start"`
+	OldLines int        `json:"old_lines"`
+	NewStart int        `json:"new_start"`
+	NewLines int        `json:"new_lines"`
+	Lines    []DiffLine `json:"lines"`
+}
+
+// FileDiff is the diff of one file. Binary files and files over the size
+// limits carry only counts, with Hunks left empty.
+type FileDiff struct {
+	Path      string `json:"path"`
+	OldPath   string `json:"old_path,omitempty"`
+	Status    string `json:"status"` // modified, added, deleted, renamed, untracked
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+	Binary    bool   `json:"binary,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+	Hunks     []Hunk `json:"hunks"`
+}
+
+// Diff is the working tree compared to HEAD or to a base branch.
+type Diff struct {
+	Base      string     `json:"base"`
+	Files     []FileDiff `json:"files"`
+	Additions int        `json:"additions"`
+	Deletions int        `json:"deletions"`
+	Truncated bool       `json:"truncated,omitempty"`
+}
+
+// DiffOptions bounds how much hunk content a Diff carries.
+type DiffOptions struct {
+	// Base is a branch or commit to compare against; empty means HEAD.
+	Base string
+	// MaxFileLines drops the hunks of files with more changed lines.
+	MaxFileLines int
+	// MaxBytes drops the hunks of files once the total content exceeds it.
+	MaxBytes int
+}
+
+const (
+	defaultMaxFileLines = 2000
+	defaultMaxDiffBytes = 512 * 1024
+)
+
+var ErrNotRepository = errors.New("not a git repository")
+
+// WorkingTreeDiff diffs the working tree of dir, including untracked files,
+// against HEAD or against the merge base with opts.Base.
+func WorkingTreeDiff(dir string, opts DiffOptions) (*Diff, error) {
+	if opts.MaxFileLines <= 0 {
+		opts.MaxFileLines = defaultMaxFileLines
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = defaultMaxDiffBytes
+	}
+	if _, err := git(dir, "rev-parse", "--is-inside-work-tree"); err != nil {
+		return nil, ErrNotRepository
+	}
+
+	base := "HEAD"
+	target := "HEAD"
+	if opts.Base != "" {
+		if strings.HasPrefix(opts.Base, "-") {
+			return nil, fmt.Errorf("invalid base %q", opts.Base)
+		}
+		base = opts.Base
+		mergeBase, err := git(dir, "merge-base", opts.Base, "HEAD")
+		if err != nil {
+			return nil, fmt.Errorf("unknown base %q", opts.Base)
+		}
+		target = strings.TrimSpace(mergeBase)
+	}
+
+	output, err := git(dir, "-c", "core.quotepath=false", "diff", target, "-M", "--no-color", "--no-ext-diff", "-U3")
+	if err != nil {
+		return nil, err
+	}
+	files := parseUnifiedDiff(output)
+
+	untracked, err := git(dir, "ls-files", "--others", "--exclude-standard", "-z")
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range strings.Split(untracked, "\x00") {
+		if path == "" {
+			continue
+		}
+		for _, file := range parseUnifiedDiff(untrackedDiff(dir, path)) {
+			file.Status = "untracked"
+			files = append(files, file)
+		}
+	}
+
+	diff := &Diff{Base: base, Files: files}
+	diff.applyLimits(opts)
+	return diff, nil
+}
+
+// untrackedDiff renders an untracked file as an addition. git diff
+// --no-index exits with status 1 when the files differ.
+func untrackedDiff(dir, path string) string {
+	cmd := exec.Command("git", "-C", dir, "-c", "core.quotepath=false", "diff", "--no-index", "--no-color", "--no-ext-diff", "--", "/dev/null", path)
+	out, _ := cmd.Output()
+	return string(out)
+}
+
+func (d *Diff) applyLimits(opts DiffOptions) {
+	size := 0
+	for i := range d.Files {
+		file := &d.Files[i]
+		d.Additions += file.Additions
+		d.Deletions += file.Deletions
+		if file.Binary || len(file.Hunks) == 0 {
+			continue
+		}
+
+		fileBytes := 0
+		for _, hunk := range file.Hunks {
+			for _, line := range hunk.Lines {
+				fileBytes += len(line.Content)
+			}
+		}
+		if file.Additions+file.Deletions > opts.MaxFileLines || size+fileBytes > opts.MaxBytes {
+			file.Hunks = []Hunk{}
+			file.Truncated = true
+			d.Truncated = true
+			continue
+		}
+		size += fileBytes
+	}
+}
+
+// parseUnifiedDiff reads `git diff` output into per-file hunks.
+func parseUnifiedDiff(output string) []FileDiff {
+	files := []FileDiff{}
+	var file *FileDiff
+	var hunk *Hunk
+	oldLine, newLine := 0, 0
+
+	flush := func() {
+		if file == nil {
+			return
+		}
+		if hunk != nil {
+			file.Hunks = append(file.Hunks, *hunk)
+			hunk = nil
+		}
+		files = append(files, *file)
+		file = nil
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			flush()
+			file = &FileDiff{Status: "modified", Hunks: []Hunk{}}
+			file.OldPath, file.Path = splitDiffGitHeader(strings.TrimPrefix(line, "diff --git "))
+		case file == nil:
+			continue
+		case hunk == nil && strings.HasPrefix(line, "new file mode"):
+			file.Status = "added"
+		case hunk == nil && strings.HasPrefix(line, "deleted file mode"):
+			file.Status = "deleted"
+		case hunk == nil && strings.HasPrefix(line, "rename from "):
+			file.Status = "renamed"
+			file.OldPath = strings.TrimPrefix(line, "rename from ")
+		case hunk == nil && strings.HasPrefix(line, "rename to "):
+			file.Path = strings.TrimPrefix(line, "rename to ")
+		case hunk == nil && strings.HasPrefix(line, "Binary files "):
+			file.Binary = true
+		case hunk == nil && strings.HasPrefix(line, "--- "):
+			if path := strings.TrimPrefix(line, "--- "); path != "/dev/null" {
+				file.OldPath = strings.TrimPrefix(path, "a/")
+			}
+		case hunk == nil && strings.HasPrefix(line, "+++ "):
+			if path := strings.TrimPrefix(line, "+++ "); path != "/dev/null" {
+				file.Path = strings.TrimPrefix(path, "b/")
+			}
+		case strings.HasPrefix(line, "@@ "):
+			if hunk != nil {
+				file.Hunks = append(file.Hunks, *hunk)
+			}
+			hunk = parseHunkHeader(line)
+			oldLine, newLine = hunk.OldStart, hunk.NewStart
+		case hunk == nil:
+			continue
+		case strings.HasPrefix(line, "+"):
+			hunk.Lines = append(hunk.Lines, DiffLine{Kind: "add", Content: line[1:], NewLine: newLine})
+			file.Additions++
+			newLine++
+		case strings.HasPrefix(line, "-"):
+			hunk.Lines = append(hunk.Lines, DiffLine{Kind: "delete", Content: line[1:], OldLine: oldLine})
+			file.Deletions++
+			oldLine++
+		case strings.HasPrefix(line, " "):
+			hunk.Lines = append(hunk.Lines, DiffLine{Kind: "context", Content: line[1:], OldLine: oldLine, NewLine: newLine})
+			oldLine++
+			newLine++
+		}
+	}
+	flush()
+
+	for i := range files {
+		if files[i].OldPath == files[i].Path {
+			files[i].OldPath = ""
+		}
+	}
+	return files
+}
+
+// splitDiffGitHeader splits "a/old b/new". Both halves have the same length
+// unless the file was renamed, in which case later lines fix the paths.
+func splitDiffGitHeader(header string) (string, string) {
+	if len(header)%2 == 1 {
+		half := (len(header) - 1) / 2
+		if header[half] == ' ' && strings.HasPrefix(header, "a/") && strings.HasPrefix(header[half+1:], "b/") {
+			return header[2:half], header[half+3:]
+		}
+	}
+	if i := strings.Index(header, " b/"); i > 0 {
+		return strings.TrimPrefix(header[:i], "a/"), header[i+3:]
+	}
+	return "", header
+}
+
+// parseHunkHeader reads "@@ -1,3 +1,4 @@ func main() {".
+func parseHunkHeader(line string) *Hunk {
+	hunk := &Hunk{Header: line, Lines: []DiffLine{}}
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return hunk
+	}
+	hunk.OldStart, hunk.OldLines = parseHunkRange(strings.TrimPrefix(fields[1], "-"))
+	hunk.NewStart, hunk.NewLines = parseHunkRange(strings.TrimPrefix(fields[2], "+"))
+	return hunk
+}
+
+func parseHunkRange(value string) (int, int) {
+	start, count, found := strings.Cut(value, ",")
+	first, _ := strconv.Atoi(start)
+	if !found {
+		return first, 1
+	}
+	lines, _ := strconv.Atoi(count)
+	return first, lines
+}
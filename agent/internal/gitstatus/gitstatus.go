@@ -0,0 +1,212 @@
+// Package gitstatus inspects the git repository of a project directory.
+package gitstatus
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// File is a changed path in the working tree, compared to HEAD.
+type File struct {
+	Path      string `json:"path"`
+	Status    string `json:"status"` // modified, added, deleted, renamed, untracked
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+	Binary    bool   `json:"binary,omitempty"`
+}
+
+// Commit describes the HEAD commit.
+type Commit struct {
+	Hash        string `json:"hash"`
+	Subject     string `json:"subject"`
+	Author      string `json:"author"`
+	CommittedAt string `json:"committed_at"`
+}
+
+// Status is a snapshot of a repository's branch and working tree.
+type Status struct {
+	IsRepo       bool    `json:"is_repo"`
+	Branch       string  `json:"branch,omitempty"`
+	Upstream     string  `json:"upstream,omitempty"`
+	Ahead        int     `json:"ahead"`
+	Behind       int     `json:"behind"`
+	Dirty        bool    `json:"dirty"`
+	FilesChanged int     `json:"files_changed"`
+	Additions    int     `json:"additions"`
+	Deletions    int     `json:"deletions"`
+	Files        []File  `json:"files"`
+	LastCommit   *Commit `json:"last_commit,omitempty"`
+}
+
+// maxFiles bounds the per-file list sent to the cloud; totals still count
+// every file.
+const maxFiles = 200
+
+// Inspect collects the status of the repository containing dir. A directory
+// outside any repository returns a Status with IsRepo false.
+func Inspect(dir string) (*Status, error) {
+	if _, err := git(dir, "rev-parse", "--is-inside-work-tree"); err != nil {
+		return &Status{IsRepo: false, Files: []File{}}, nil
+	}
+
+	status := &Status{IsRepo: true}
+	if branch, err := git(dir, "rev-parse", "--abbrev-ref", "HEAD"); err == nil {
+		status.Branch = strings.TrimSpace(branch)
+	}
+	if upstream, err := git(dir, "rev-parse", "--abbrev-ref", "--symbolic-full-name", "@{upstream}"); err == nil {
+		status.Upstream = strings.TrimSpace(upstream)
+		if counts, err := git(dir, "rev-list", "--left-right", "--count", "HEAD...@{upstream}"); err == nil {
+			status.Ahead, status.Behind = parseAheadBehind(counts)
+		}
+	}
+	if log, err := git(dir, "log", "-1", "--format=%H%x1f%s%x1f%an%x1f%cI"); err == nil {
+		status.LastCommit = parseLastCommit(log)
+	}
+
+	porcelain, err := git(dir, "status", "--porcelain=v1", "-z", "--untracked-files=all")
+	if err != nil {
+		return nil, err
+	}
+	files := parsePorcelain(porcelain)
+
+	// A repository without commits has nothing to diff against.
+	if status.LastCommit != nil {
+		if numstat, err := git(dir, "diff", "HEAD", "--numstat", "-z", "-M"); err == nil {
+			applyNumstat(files, numstat)
+		}
+	}
+
+	status.setFiles(files)
+	return status, nil
+}
+
+// Summary is the readable form of the counts, sent next to them as the
+// summary field of workspace_status.
+func (s *Status) Summary() string {
+	noun := "files"
+	if s.FilesChanged == 1 {
+		noun = "file"
+	}
+	return fmt.Sprintf("%d %s changed, +%d/-%d", s.FilesChanged, noun, s.Additions, s.Deletions)
+}
+
+func (s *Status) setFiles(files map[string]*File) {
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	s.Files = make([]File, 0, len(paths))
+	for _, path := range paths {
+		file := files[path]
+		s.Additions += file.Additions
+		s.Deletions += file.Deletions
+		if len(s.Files) < maxFiles {
+			s.Files = append(s.Files, *file)
+		}
+	}
+	s.FilesChanged = len(paths)
+	s.Dirty = len(paths) > 0
+}
+
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+func parseAheadBehind(output string) (int, int) {
+	fields := strings.Fields(output)
+	if len(fields) != 2 {
+		return 0, 0
+	}
+	ahead, _ := strconv.Atoi(fields[0])
+	behind, _ := strconv.Atoi(fields[1])
+	return ahead, behind
+}
+
+func parseLastCommit(output string) *Commit {
+	parts := strings.Split(strings.TrimRight(output, "\n"), "\x1f")
+	if len(parts) != 4 || parts[0] == "" {
+		return nil
+	}
+	return &Commit{Hash: parts[0], Subject: parts[1], Author: parts[2], CommittedAt: parts[3]}
+}
+
+// parsePorcelain reads `git status --porcelain=v1 -z` output.
+func parsePorcelain(output string) map[string]*File {
+	files := make(map[string]*File)
+	entries := strings.Split(output, "\x00")
+	for i := 0; i < len(entries); i++ {
+		entry := entries[i]
+		if len(entry) < 4 {
+			continue
+		}
+		code, path := entry[:2], entry[3:]
+		file := &File{Path: path, Status: porcelainStatus(code)}
+		if code[0] == 'R' || code[0] == 'C' {
+			// The original path follows as its own entry.
+			i++
+		}
+		files[path] = file
+	}
+	return files
+}
+
+func porcelainStatus(code string) string {
+	switch {
+	case code == "??":
+		return "untracked"
+	case strings.ContainsRune(code, 'R'):
+		return "renamed"
+	case strings.ContainsRune(code, 'D'):
+		return "deleted"
+	case strings.ContainsRune(code, 'A'):
+		return "added"
+	default:
+		return "modified"
+	}
+}
+
+// applyNumstat adds line counts from `git diff --numstat -z` output. Binary
+// files report "-" for both counts.
+func applyNumstat(files map[string]*File, output string) {
+	entries := strings.Split(output, "\x00")
+	for i := 0; i < len(entries); i++ {
+		fields := strings.SplitN(entries[i], "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		path := fields[2]
+		if path == "" {
+			// Renames list the old and new path as the next two entries.
+			if i+2 >= len(entries) {
+				break
+			}
+			path = entries[i+2]
+			i += 2
+		}
+
+		file, ok := files[path]
+		if !ok {
+			file = &File{Path: path, Status: "modified"}
+			files[path] = file
+		}
+		if fields[0] == "-" && fields[1] == "-" {
+			file.Binary = true
+			continue
+		}
+		file.Additions, _ = strconv.Atoi(fields[0])
+		file.Deletions, _ = strconv.Atoi(fields[1])
+	}
+}
@@ -0,0 +1,179 @@
+package gitstatus
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestParsePorcelainAndNumstat(t *testing.T) {
+	files := parsePorcelain(" M main.go\x00A  new.go\x00R  renamed.go\x00old.go\x00?? notes.txt\x00 D gone.go\x00")
+	applyNumstat(files, "3\t1\tmain.go\x0010\t0\tnew.go\x000\t0\t\x00old.go\x00renamed.go\x00-\t-\tlogo.png\x000\t4\tgone.go\x00")
+
+	status := &Status{}
+	status.setFiles(files)
+
+	want := map[string]File{
+		"main.go":    {Path: "main.go", Status: "modified", Additions: 3, Deletions: 1},
+		"new.go":     {Path: "new.go", Status: "added", Additions: 10},
+		"renamed.go": {Path: "renamed.go", Status: "renamed"},
+		"notes.txt":  {Path: "notes.txt", Status: "untracked"},
+		"gone.go":    {Path: "gone.go", Status: "deleted", Deletions: 4},
+		"logo.png":   {Path: "logo.png", Status: "modified", Binary: true},
+	}
+	if len(status.Files) != len(want) {
+		t.Fatalf("files = %+v, want %d entries", status.Files, len(want))
+	}
+	for _, file := range status.Files {
+		if file != want[file.Path] {
+			t.Fatalf("file %s = %+v, want %+v", file.Path, file, want[file.Path])
+		}
+	}
+	if status.FilesChanged != 6 || status.Additions != 13 || status.Deletions != 5 || !status.Dirty {
+		t.Fatalf("totals = %d files +%d/-%d, want 6 files +13/-5", status.FilesChanged, status.Additions, status.Deletions)
+	}
+	if got := status.Summary(); got != "6 files changed, +13/-5" {
+		t.Fatalf("Summary = %q", got)
+	}
+}
+
+func TestParseAheadBehindAndLastCommit(t *testing.T) {
+	if ahead, behind := parseAheadBehind("2\t5\n"); ahead != 2 || behind != 5 {
+		t.Fatalf("ahead/behind = %d/%d, want 2/5", ahead, behind)
+	}
+	commit := parseLastCommit("abc123\x1fFix login\x1fAda\x1f2026-04-17T10:00:00+08:00\n")
+	if commit == nil || commit.Hash != "abc123" || commit.Subject != "Fix login" || commit.Author != "Ada" {
+		t.Fatalf("commit = %+v", commit)
+	}
+	if parseLastCommit("") != nil {
+		t.Fatal("empty log should have no commit")
+	}
+}
+
+func TestInspectReportsWorkingTreeChanges(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := t.TempDir()
+	run := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=Test", "GIT_AUTHOR_EMAIL=test@example.com", "GIT_COMMITTER_NAME=Test", "GIT_COMMITTER_EMAIL=test@example.com")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+
+	run("init", "-q", "-b", "main")
+	write("main.go", "package main\n\nfunc main() {}\n")
+	run("add", ".")
+	run("commit", "-q", "-m", "Initial commit")
+
+	write("main.go", "package main\n\nfunc main() {\n\tprintln(\"hi\")\n}\n")
+	write("extra.go", "package main\n")
+
+	status, err := Inspect(dir)
+	if err != nil {
+		t.Fatalf("Inspect: %v", err)
+	}
+	if !status.IsRepo || status.Branch != "main" || status.LastCommit == nil || status.LastCommit.Subject != "Initial commit" {
+		t.Fatalf("status = %+v, want repo on main with last commit", status)
+	}
+	if status.FilesChanged != 2 || status.Additions != 3 || status.Deletions != 1 {
+		t.Fatalf("totals = %d files +%d/-%d, want 2 files +3/-1", status.FilesChanged, status.Additions, status.Deletions)
+	}
+
+	diff, err := WorkingTreeDiff(dir, DiffOptions{})
+	if err != nil {
+		t.Fatalf("WorkingTreeDiff: %v", err)
+	}
+	if len(diff.Files) != 2 || diff.Files[0].Path != "main.go" || diff.Files[1].Path != "extra.go" || diff.Files[1].Status != "untracked" {
+		t.Fatalf("diff files = %+v, want main.go and untracked extra.go", diff.Files)
+	}
+	if diff.Additions != 4 || diff.Deletions != 1 {
+		t.Fatalf("diff totals = +%d/-%d, want +4/-1", diff.Additions, diff.Deletions)
+	}
+	if _, err := WorkingTreeDiff(dir, DiffOptions{Base: "--output=x"}); err == nil {
+		t.Fatal("expected error for option-like base")
+	}
+	if _, err := WorkingTreeDiff(dir, DiffOptions{Base: "main"}); err != nil {
+		t.Fatalf("WorkingTreeDiff against main: %v", err)
+	}
+
+	outside, err := Inspect(t.TempDir())
+	if err != nil {
+		t.Fatalf("Inspect outside repo: %v", err)
+	}
+	if outside.IsRepo {
+		t.Fatal("temp dir should not be a repo")
+	}
+}
+
+func TestParseUnifiedDiff(t *testing.T) {
+	output := "diff --git a/main.go b/main.go\n" +
+		"index 1111111..2222222 100644\n" +
+		"--- a/main.go\n" +
+		"+++ b/main.go\n" +
+		"@@ -1,3 +1,4 @@ package main\n" +
+		" package main\n" +
+		"-func main() {}\n" +
+		"+func main() {\n" +
+		"+\tprintln(\"hi\")\n" +
+		" // end\n" +
+		"diff --git a/old name.go b/new name.go\n" +
+		"similarity index 100%\n" +
+		"rename from old name.go\n" +
+		"rename to new name.go\n" +
+		"diff --git a/logo.png b/logo.png\n" +
+		"new file mode 100644\n" +
+		"Binary files /dev/null and b/logo.png differ\n"
+
+	files := parseUnifiedDiff(output)
+	if len(files) != 3 {
+		t.Fatalf("files = %+v, want 3", files)
+	}
+
+	main := files[0]
+	if main.Path != "main.go" || main.Status != "modified" || main.Additions != 2 || main.Deletions != 1 || len(main.Hunks) != 1 {
+		t.Fatalf("main.go = %+v", main)
+	}
+	hunk := main.Hunks[0]
+	if hunk.OldStart != 1 || hunk.OldLines != 3 || hunk.NewStart != 1 || hunk.NewLines != 4 || len(hunk.Lines) != 5 {
+		t.Fatalf("hunk = %+v", hunk)
+	}
+	if last := hunk.Lines[4]; last.Kind != "context" || last.OldLine != 3 || last.NewLine != 4 {
+		t.Fatalf("last line = %+v, want context at 3/4", last)
+	}
+
+	if renamed := files[1]; renamed.Status != "renamed" || renamed.Path != "new name.go" || renamed.OldPath != "old name.go" {
+		t.Fatalf("renamed = %+v", renamed)
+	}
+	if binary := files[2]; !binary.Binary || binary.Status != "added" || binary.Path != "logo.png" || len(binary.Hunks) != 0 {
+		t.Fatalf("binary = %+v", binary)
+	}
+}
+
+func TestDiffLimitsSummarizeLargeFiles(t *testing.T) {
+	diff := &Diff{Files: []FileDiff{
+		{Path: "small.go", Additions: 1, Hunks: []Hunk{{Lines: []DiffLine{{Kind: "add", Content: "x"}}}}},
+		{Path: "big.go", Additions: 3, Hunks: []Hunk{{Lines: []DiffLine{{Kind: "add", Content: "a"}, {Kind: "add", Content: "b"}, {Kind: "add", Content: "c"}}}}},
+	}}
+	diff.applyLimits(DiffOptions{MaxFileLines: 2, MaxBytes: 1024})
+
+	if len(diff.Files[0].Hunks) != 1 || diff.Files[0].Truncated {
+		t.Fatalf("small.go = %+v, want hunks kept", diff.Files[0])
+	}
+	if len(diff.Files[1].Hunks) != 0 || !diff.Files[1].Truncated || !diff.Truncated {
+		t.Fatalf("big.go = %+v, want summarized", diff.Files[1])
+	}
+	if diff.Additions != 4 {
+		t.Fatalf("Additions = %d, want 4", diff.Additions)
+	}
+}
@@ -0,0 +1,247 @@
+// Package upload receives files streamed from the cloud in chunked binary
+// WebSocket frames and stores them in a drop folder of the project.
+//
+// A chunk frame is laid out as
+//
+//	"MCUP" | version (1 byte) | id length (1 byte) | upload id | seq (uint32 BE) | crc32 IEEE of data (uint32 BE) | data
+package upload
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	frameMagic   = "MCUP"
+	frameVersion = 1
+
+	// DefaultDir is the drop folder, relative to the project root.
+	DefaultDir = ".mobilecoder/uploads"
+)
+
+var (
+	ErrInvalidFrame   = errors.New("invalid upload frame")
+	ErrChecksum       = errors.New("upload checksum mismatch")
+	ErrUnknownUpload  = errors.New("unknown upload")
+	ErrTooLarge       = errors.New("upload exceeds size limit")
+	ErrInvalidDropDir = errors.New("upload folder must stay inside the project")
+)
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Chunk is a decoded binary frame.
+type Chunk struct {
+	UploadID string
+	Seq      uint32
+	Data     []byte
+}
+
+// DecodeFrame parses a chunk frame and verifies its checksum.
+func DecodeFrame(frame []byte) (*Chunk, error) {
+	if len(frame) < 6 || string(frame[:4]) != frameMagic || frame[4] != frameVersion {
+		return nil, ErrInvalidFrame
+	}
+	idLen := int(frame[5])
+	header := 6 + idLen + 8
+	if idLen == 0 || len(frame) < header {
+		return nil, ErrInvalidFrame
+	}
+	chunk := &Chunk{
+		UploadID: string(frame[6 : 6+idLen]),
+		Seq:      binary.BigEndian.Uint32(frame[6+idLen:]),
+		Data:     frame[header:],
+	}
+	if crc32.ChecksumIEEE(chunk.Data) != binary.BigEndian.Uint32(frame[10+idLen:]) {
+		return nil, ErrChecksum
+	}
+	return chunk, nil
+}
+
+// EncodeFrame builds a chunk frame; the cloud has its own copy.
+func EncodeFrame(uploadID string, seq uint32, data []byte) []byte {
+	frame := make([]byte, 0, 14+len(uploadID)+len(data))
+	frame = append(frame, frameMagic...)
+	frame = append(frame, frameVersion, byte(len(uploadID)))
+	frame = append(frame, uploadID...)
+	frame = binary.BigEndian.AppendUint32(frame, seq)
+	frame = binary.BigEndian.AppendUint32(frame, crc32.ChecksumIEEE(data))
+	return append(frame, data...)
+}
+
+type pending struct {
+	projectPath string
+	dropDir     string
+	filename    string
+	file        *os.File
+	hash        hash.Hash
+	size        int64
+	maxBytes    int64
+	nextSeq     uint32
+}
+
+// Receiver tracks uploads in progress.
+type Receiver struct {
+	mu      sync.Mutex
+	uploads map[string]*pending
+}
+
+func NewReceiver() *Receiver {
+	return &Receiver{uploads: make(map[string]*pending)}
+}
+
+// Start prepares an upload into dropDir (relative to projectPath).
+func (r *Receiver) Start(uploadID, projectPath, dropDir, filename string, maxBytes int64) error {
+	if uploadID == "" || len(uploadID) > 255 {
+		return fmt.Errorf("%w: bad upload id", ErrInvalidFrame)
+	}
+	dir, err := resolveDropDir(projectPath, dropDir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, ".upload-*.part")
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if previous, ok := r.uploads[uploadID]; ok {
+		previous.discard()
+	}
+	r.uploads[uploadID] = &pending{
+		projectPath: projectPath,
+		dropDir:     dir,
+		filename:    sanitizeFilename(filename),
+		file:        file,
+		hash:        sha256.New(),
+		maxBytes:    maxBytes,
+	}
+	return nil
+}
+
+// WriteFrame appends a chunk to its upload. Chunks must arrive in order.
+func (r *Receiver) WriteFrame(frame []byte) error {
+	chunk, err := DecodeFrame(frame)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	upload, ok := r.uploads[chunk.UploadID]
+	if !ok {
+		return ErrUnknownUpload
+	}
+	if chunk.Seq != upload.nextSeq {
+		return fmt.Errorf("%w: chunk %d, want %d", ErrInvalidFrame, chunk.Seq, upload.nextSeq)
+	}
+	if upload.maxBytes > 0 && upload.size+int64(len(chunk.Data)) > upload.maxBytes {
+		return ErrTooLarge
+	}
+	if _, err := upload.file.Write(chunk.Data); err != nil {
+		return err
+	}
+	upload.hash.Write(chunk.Data)
+	upload.size += int64(len(chunk.Data))
+	upload.nextSeq++
+	return nil
+}
+
+// Finish checks the total size and SHA-256 and moves the file into place.
+// It returns the path relative to the project root.
+func (r *Receiver) Finish(uploadID string, size int64, sha256Hex string) (string, error) {
+	r.mu.Lock()
+	upload, ok := r.uploads[uploadID]
+	delete(r.uploads, uploadID)
+	r.mu.Unlock()
+	if !ok {
+		return "", ErrUnknownUpload
+	}
+
+	if upload.size != size || hex.EncodeToString(upload.hash.Sum(nil)) != strings.ToLower(sha256Hex) {
+		upload.discard()
+		return "", ErrChecksum
+	}
+	if err := upload.file.Close(); err != nil {
+		os.Remove(upload.file.Name())
+		return "", err
+	}
+
+	dest := uniquePath(filepath.Join(upload.dropDir, upload.filename))
+	if err := os.Rename(upload.file.Name(), dest); err != nil {
+		os.Remove(upload.file.Name())
+		return "", err
+	}
+	rel, err := filepath.Rel(upload.projectPath, dest)
+	if err != nil {
+		return dest, nil
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// Abort drops an upload and its partial file.
+func (r *Receiver) Abort(uploadID string) {
+	r.mu.Lock()
+	upload, ok := r.uploads[uploadID]
+	delete(r.uploads, uploadID)
+	r.mu.Unlock()
+	if ok {
+		upload.discard()
+	}
+}
+
+func (p *pending) discard() {
+	p.file.Close()
+	os.Remove(p.file.Name())
+}
+
+func resolveDropDir(projectPath, dropDir string) (string, error) {
+	if dropDir == "" {
+		dropDir = DefaultDir
+	}
+	if filepath.IsAbs(dropDir) {
+		return "", ErrInvalidDropDir
+	}
+	cleaned := filepath.Clean(dropDir)
+	if cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", ErrInvalidDropDir
+	}
+	return filepath.Join(projectPath, cleaned), nil
+}
+
+func sanitizeFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Trim(unsafeNameChars.ReplaceAllString(name, "_"), "._")
+	if name == "" {
+		return "upload"
+	}
+	return name
+}
+
+// uniquePath appends -1, -2, ... before the extension until the path is free.
+func uniquePath(path string) string {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return path
+	}
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s-%d%s", base, i, ext)
+		if _, err := os.Stat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package upload
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFrameRoundTripAndChecksum(t *testing.T) {
+	frame := EncodeFrame("up-1", 3, []byte("hello"))
+	chunk, err := DecodeFrame(frame)
+	if err != nil {
+		t.Fatalf("DecodeFrame: %v", err)
+	}
+	if chunk.UploadID != "up-1" || chunk.Seq != 3 || string(chunk.Data) != "hello" {
+		t.Fatalf("chunk = %+v", chunk)
+	}
+
+	frame[len(frame)-1] ^= 0xff
+	if _, err := DecodeFrame(frame); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("err = %v, want ErrChecksum", err)
+	}
+	if _, err := DecodeFrame([]byte(`{"type":"x"}`)); !errors.Is(err, ErrInvalidFrame) {
+		t.Fatalf("err = %v, want ErrInvalidFrame", err)
+	}
+}
+
+func TestReceiverWritesFileIntoDropFolder(t *testing.T) {
+	project := t.TempDir()
+	receiver := NewReceiver()
+	if err := receiver.Start("up-1", project, "", "../../screen shot.png", 1024); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	parts := [][]byte{[]byte("first-"), []byte("second")}
+	for i, part := range parts {
+		if err := receiver.WriteFrame(EncodeFrame("up-1", uint32(i), part)); err != nil {
+			t.Fatalf("WriteFrame %d: %v", i, err)
+		}
+	}
+	sum := sha256.Sum256([]byte("first-second"))
+
+	path, err := receiver.Finish("up-1", 12, hex.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	if path != ".mobilecoder/uploads/screen_shot.png" {
+		t.Fatalf("path = %q", path)
+	}
+	content, err := os.ReadFile(filepath.Join(project, path))
+	if err != nil || string(content) != "first-second" {
+		t.Fatalf("content = %q, %v", content, err)
+	}
+
+	// A second upload with the same name does not overwrite the first.
+	receiver.Start("up-2", project, "", "screen shot.png", 0)
+	receiver.WriteFrame(EncodeFrame("up-2", 0, []byte("x")))
+	sum = sha256.Sum256([]byte("x"))
+	if path, err := receiver.Finish("up-2", 1, hex.EncodeToString(sum[:])); err != nil || path != ".mobilecoder/uploads/screen_shot-1.png" {
+		t.Fatalf("second path = %q, %v", path, err)
+	}
+}
+
+func TestReceiverRejectsBadUploads(t *testing.T) {
+	project := t.TempDir()
+	receiver := NewReceiver()
+
+	if err := receiver.Start("up-1", project, "../outside", "a.txt", 0); !errors.Is(err, ErrInvalidDropDir) {
+		t.Fatalf("err = %v, want ErrInvalidDropDir", err)
+	}
+
+	receiver.Start("up-1", project, "drop", "a.txt", 4)
+	if err := receiver.WriteFrame(EncodeFrame("up-1", 1, []byte("a"))); !errors.Is(err, ErrInvalidFrame) {
+		t.Fatalf("out of order err = %v, want ErrInvalidFrame", err)
+	}
+	if err := receiver.WriteFrame(EncodeFrame("up-1", 0, []byte("too long"))); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("oversize err = %v, want ErrTooLarge", err)
+	}
+	receiver.WriteFrame(EncodeFrame("up-1", 0, []byte("abc")))
+	if _, err := receiver.Finish("up-1", 3, "deadbeef"); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("finish err = %v, want ErrChecksum", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(project, "drop")); len(entries) != 0 {
+		t.Fatalf("drop folder = %v, want partial file removed", entries)
+	}
+	if err := receiver.WriteFrame(EncodeFrame("up-9", 0, []byte("a"))); !errors.Is(err, ErrUnknownUpload) {
+		t.Fatalf("err = %v, want ErrUnknownUpload", err)
+	}
+}
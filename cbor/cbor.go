@@ -0,0 +1,231 @@
+// Package cbor is the CBOR (RFC 8949) codec of the WebSocket protocol
+// shared by the cloud server and the desktop agent. Envelopes are encoded
+// from and decoded into their structs by json tags; FromJSON and ToJSON
+// convert frames the cloud relays as JSON.
+package cbor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// maxCBORDepth bounds nesting when decoding untrusted frames.
+const maxCBORDepth = 64
+
+// ErrInvalid is returned for malformed or unsupported frames.
+var ErrInvalid = errors.New("invalid cbor frame")
+
+// IsFrame reports whether a binary frame is a CBOR envelope (a map) rather
+// than an upload chunk.
+func IsFrame(frame []byte) bool {
+	return len(frame) > 0 && frame[0]>>5 == 5
+}
+
+// FromJSON converts a JSON value, e.g. an envelope the cloud keeps as JSON
+// to fan out to clients of either encoding, to CBOR.
+func FromJSON(jsonText []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(len(jsonText))
+	if err := writeJSON(&buf, jsonText); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeJSON appends the JSON value jsonText as CBOR.
+func writeJSON(buf *bytes.Buffer, jsonText []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(jsonText))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return err
+	}
+	return writeCBOR(buf, value)
+}
+
+// ToJSON converts a CBOR item back to JSON.
+func ToJSON(frame []byte) ([]byte, error) {
+	value, rest, err := readCBOR(frame, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%w: trailing bytes", ErrInvalid)
+	}
+	return json.Marshal(value)
+}
+
+func writeCBORHead(buf *bytes.Buffer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		buf.WriteByte(major<<5 | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(major<<5 | 24)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(major<<5 | 25)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	case n <= math.MaxUint32:
+		buf.WriteByte(major<<5 | 26)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	default:
+		buf.WriteByte(major<<5 | 27)
+		buf.Write(binary.BigEndian.AppendUint64(nil, n))
+	}
+}
+
+func writeCBOR(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteByte(0xf6)
+	case bool:
+		if v {
+			buf.WriteByte(0xf5)
+		} else {
+			buf.WriteByte(0xf4)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			if i >= 0 {
+				writeCBORHead(buf, 0, uint64(i))
+			} else {
+				writeCBORHead(buf, 1, uint64(-1-i))
+			}
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(0xfb)
+		buf.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(f)))
+	case string:
+		writeCBORHead(buf, 3, uint64(len(v)))
+		buf.WriteString(v)
+	case []interface{}:
+		writeCBORHead(buf, 4, uint64(len(v)))
+		for _, item := range v {
+			if err := writeCBOR(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		writeCBORHead(buf, 5, uint64(len(v)))
+		for _, key := range keys {
+			writeCBORHead(buf, 3, uint64(len(key)))
+			buf.WriteString(key)
+			if err := writeCBOR(buf, v[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cbor: unsupported type %T", value)
+	}
+	return nil
+}
+
+func readCBORHead(data []byte) (major byte, info byte, n uint64, rest []byte, err error) {
+	if len(data) == 0 {
+		return 0, 0, 0, nil, ErrInvalid
+	}
+	major, info = data[0]>>5, data[0]&0x1f
+	data = data[1:]
+	switch {
+	case info < 24:
+		return major, info, uint64(info), data, nil
+	case info == 24 && len(data) >= 1:
+		return major, info, uint64(data[0]), data[1:], nil
+	case info == 25 && len(data) >= 2:
+		return major, info, uint64(binary.BigEndian.Uint16(data)), data[2:], nil
+	case info == 26 && len(data) >= 4:
+		return major, info, uint64(binary.BigEndian.Uint32(data)), data[4:], nil
+	case info == 27 && len(data) >= 8:
+		return major, info, binary.BigEndian.Uint64(data), data[8:], nil
+	}
+	return 0, 0, 0, nil, ErrInvalid
+}
+
+func readCBOR(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > maxCBORDepth {
+		return nil, nil, fmt.Errorf("%w: nested too deep", ErrInvalid)
+	}
+	major, info, n, rest, err := readCBORHead(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch major {
+	case 0:
+		if n > math.MaxInt64 {
+			return float64(n), rest, nil
+		}
+		return int64(n), rest, nil
+	case 1:
+		if n > math.MaxInt64 {
+			return -1 - float64(n), rest, nil
+		}
+		return -1 - int64(n), rest, nil
+	case 3:
+		if n > uint64(len(rest)) {
+			return nil, nil, ErrInvalid
+		}
+		return string(rest[:n]), rest[n:], nil
+	case 4:
+		// Every item takes at least one byte.
+		if n > uint64(len(rest)) {
+			return nil, nil, ErrInvalid
+		}
+		items := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			var item interface{}
+			if item, rest, err = readCBOR(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, rest, nil
+	case 5:
+		if n > uint64(len(rest))/2 {
+			return nil, nil, ErrInvalid
+		}
+		object := make(map[string]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			var key, value interface{}
+			if key, rest, err = readCBOR(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, nil, fmt.Errorf("%w: map key is not a string", ErrInvalid)
+			}
+			if value, rest, err = readCBOR(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			object[name] = value
+		}
+		return object, rest, nil
+	case 7:
+		switch {
+		case info == 20:
+			return false, rest, nil
+		case info == 21:
+			return true, rest, nil
+		case info == 22 || info == 23:
+			return nil, rest, nil
+		case info == 26:
+			return float64(math.Float32frombits(uint32(n))), rest, nil
+		case info == 27:
+			return math.Float64frombits(n), rest, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("%w: unsupported item %d/%d", ErrInvalid, major, info)
+}
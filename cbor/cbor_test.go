@@ -0,0 +1,111 @@
+package cbor
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestRoundTripKeepsEnvelope(t *testing.T) {
+	original := []byte(`{"id":"req-1","type":"get_diff_result","version":1,"payload":{"files":[{"path":"main.go","additions":12,"deletions":-3,"ratio":0.25,"binary":false,"old":null}],"summary":"ок ✓ \u001b[32mgreen\u001b[0m"}}`)
+
+	frame, err := FromJSON(original)
+	if err != nil {
+		t.Fatalf("FromJSON: %v", err)
+	}
+	if !IsFrame(frame) || len(frame) >= len(original) {
+		t.Fatalf("frame = %d bytes, json = %d bytes", len(frame), len(original))
+	}
+	decoded, err := ToJSON(frame)
+	if err != nil {
+		t.Fatalf("ToJSON: %v", err)
+	}
+
+	var want, got interface{}
+	json.Unmarshal(original, &want)
+	json.Unmarshal(decoded, &got)
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("round trip = %s, want %s", decoded, original)
+	}
+}
+
+func TestToJSONRejectsMalformedFrames(t *testing.T) {
+	frame, _ := FromJSON([]byte(`{"type":"terminal_output","payload":{"content":"hello"}}`))
+	for name, bad := range map[string][]byte{
+		"truncated":      frame[:len(frame)-2],
+		"trailing":       append(append([]byte{}, frame...), 0x00),
+		"huge length":    {0xbb, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"non-string key": {0xa1, 0x01, 0x02},
+		"byte string":    {0xa1, 0x61, 'a', 0x41, 'b'},
+		"empty":          {},
+	} {
+		if _, err := ToJSON(bad); err == nil {
+			t.Fatalf("%s: ToJSON accepted a malformed frame", name)
+		}
+		var envelope testEnvelope
+		if err := Unmarshal(bad, &envelope); err == nil {
+			t.Fatalf("%s: Unmarshal accepted a malformed frame", name)
+		}
+	}
+	if IsFrame([]byte("MCUP\x01")) {
+		t.Fatal("upload frames must not be taken for CBOR")
+	}
+}
+
+type testEnvelope struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Version int             `json:"version,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+func TestMarshalMatchesJSONEncoding(t *testing.T) {
+	envelope := testEnvelope{Type: "terminal_output", Version: 1, Payload: json.RawMessage(`{"content":"hello","lines":[1,2.5,null,true]}`)}
+
+	frame, err := Marshal(envelope)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	viaJSON, _ := json.Marshal(envelope)
+	decoded, err := ToJSON(frame)
+	if err != nil {
+		t.Fatalf("ToJSON: %v", err)
+	}
+	var want, got interface{}
+	json.Unmarshal(viaJSON, &want)
+	json.Unmarshal(decoded, &got)
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("Marshal = %s, want %s", decoded, viaJSON)
+	}
+
+	var back testEnvelope
+	if err := Unmarshal(frame, &back); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if back.Type != envelope.Type || back.Version != 1 || back.ID != "" {
+		t.Fatalf("Unmarshal = %+v, want %+v", back, envelope)
+	}
+	var payload, wantPayload interface{}
+	json.Unmarshal(back.Payload, &payload)
+	json.Unmarshal(envelope.Payload, &wantPayload)
+	if !reflect.DeepEqual(payload, wantPayload) {
+		t.Fatalf("payload = %s, want %s", back.Payload, envelope.Payload)
+	}
+}
+
+func TestUnmarshalSkipsUnknownKeys(t *testing.T) {
+	frame, _ := FromJSON([]byte(`{"type":"ping","extra":{"nested":[1,2]},"version":300000}`))
+
+	var envelope testEnvelope
+	if err := Unmarshal(frame, &envelope); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if envelope.Type != "ping" || envelope.Version != 300000 || envelope.Payload != nil {
+		t.Fatalf("envelope = %+v", envelope)
+	}
+
+	frame, _ = FromJSON([]byte(`{"type":1}`))
+	if err := Unmarshal(frame, &envelope); err == nil {
+		t.Fatal("Unmarshal accepted a number for a string field")
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/mobile-coder/cbor
+
+go 1.25.6
@@ -0,0 +1,281 @@
+package cbor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+var rawMessageType = reflect.TypeFor[json.RawMessage]()
+
+// Marshal encodes v, typically an envelope struct, as CBOR without going
+// through JSON: struct fields become map entries named by their json tags,
+// in declaration order, and omitempty fields are left out when empty as
+// encoding/json does. Only json.RawMessage fields, the payload, are
+// converted from JSON.
+func Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := marshalValue(&buf, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes a CBOR frame into the struct v points to, matching map
+// keys to json tags and skipping unknown ones. json.RawMessage fields get
+// their item as JSON.
+func Unmarshal(frame []byte, v interface{}) error {
+	target := reflect.ValueOf(v)
+	if target.Kind() != reflect.Pointer || target.IsNil() {
+		return fmt.Errorf("cbor: Unmarshal needs a non-nil pointer, got %T", v)
+	}
+	rest, err := unmarshalValue(frame, target.Elem(), 0)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 0 {
+		return fmt.Errorf("%w: trailing bytes", ErrInvalid)
+	}
+	return nil
+}
+
+type structField struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+// structFields lists the exported fields of t as encoding/json names them.
+func structFields(t reflect.Type) []structField {
+	fields := make([]structField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = field.Name
+		}
+		fields = append(fields, structField{name: name, index: i, omitEmpty: strings.Contains(","+options+",", ",omitempty,")})
+	}
+	return fields
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	}
+	return false
+}
+
+func marshalValue(buf *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		buf.WriteByte(0xf6)
+		return nil
+	}
+	if v.Type() == rawMessageType {
+		if v.Len() == 0 {
+			buf.WriteByte(0xf6)
+			return nil
+		}
+		return writeJSON(buf, v.Bytes())
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			buf.WriteByte(0xf6)
+			return nil
+		}
+		return marshalValue(buf, v.Elem())
+	case reflect.Struct:
+		fields := structFields(v.Type())
+		present := make([]structField, 0, len(fields))
+		for _, field := range fields {
+			if field.omitEmpty && isEmptyValue(v.Field(field.index)) {
+				continue
+			}
+			present = append(present, field)
+		}
+		writeCBORHead(buf, 5, uint64(len(present)))
+		for _, field := range present {
+			writeCBORHead(buf, 3, uint64(len(field.name)))
+			buf.WriteString(field.name)
+			if err := marshalValue(buf, v.Field(field.index)); err != nil {
+				return err
+			}
+		}
+	case reflect.String:
+		writeCBORHead(buf, 3, uint64(v.Len()))
+		buf.WriteString(v.String())
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteByte(0xf5)
+		} else {
+			buf.WriteByte(0xf4)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i := v.Int(); i >= 0 {
+			writeCBORHead(buf, 0, uint64(i))
+		} else {
+			writeCBORHead(buf, 1, uint64(-1-i))
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		writeCBORHead(buf, 0, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		buf.WriteByte(0xfb)
+		buf.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(v.Float())))
+	default:
+		return fmt.Errorf("cbor: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func unmarshalValue(data []byte, v reflect.Value, depth int) ([]byte, error) {
+	if depth > maxCBORDepth {
+		return nil, fmt.Errorf("%w: nested too deep", ErrInvalid)
+	}
+	if len(data) == 0 {
+		return nil, ErrInvalid
+	}
+	if v.Type() == rawMessageType {
+		item, rest, err := readCBOR(data, depth)
+		if err != nil {
+			return nil, err
+		}
+		raw, err := json.Marshal(item)
+		if err != nil {
+			return nil, err
+		}
+		v.SetBytes(raw)
+		return rest, nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if data[0] == 0xf6 {
+			v.SetZero()
+			return data[1:], nil
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return unmarshalValue(data, v.Elem(), depth)
+	case reflect.Struct:
+		return unmarshalStruct(data, v, depth)
+	}
+
+	item, rest, err := readCBOR(data, depth)
+	if err != nil {
+		return nil, err
+	}
+	if err := assign(v, item); err != nil {
+		return nil, err
+	}
+	return rest, nil
+}
+
+func unmarshalStruct(data []byte, v reflect.Value, depth int) ([]byte, error) {
+	major, _, n, rest, err := readCBORHead(data)
+	if err != nil {
+		return nil, err
+	}
+	if major != 5 {
+		return nil, fmt.Errorf("%w: want a map for %s", ErrInvalid, v.Type())
+	}
+	if n > uint64(len(rest))/2 {
+		return nil, ErrInvalid
+	}
+	fields := make(map[string]int)
+	for _, field := range structFields(v.Type()) {
+		fields[field.name] = field.index
+	}
+	for i := uint64(0); i < n; i++ {
+		var key interface{}
+		if key, rest, err = readCBOR(rest, depth+1); err != nil {
+			return nil, err
+		}
+		name, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: map key is not a string", ErrInvalid)
+		}
+		index, ok := fields[name]
+		if !ok {
+			if _, rest, err = readCBOR(rest, depth+1); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if rest, err = unmarshalValue(rest, v.Field(index), depth+1); err != nil {
+			return nil, err
+		}
+	}
+	return rest, nil
+}
+
+// assign stores a decoded scalar in v.
+func assign(v reflect.Value, item interface{}) error {
+	if item == nil {
+		v.SetZero()
+		return nil
+	}
+	mismatch := fmt.Errorf("%w: cannot decode %T into %s", ErrInvalid, item, v.Type())
+	switch v.Kind() {
+	case reflect.String:
+		s, ok := item.(string)
+		if !ok {
+			return mismatch
+		}
+		v.SetString(s)
+	case reflect.Bool:
+		b, ok := item.(bool)
+		if !ok {
+			return mismatch
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, ok := item.(int64)
+		if !ok || v.OverflowInt(i) {
+			return mismatch
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, ok := item.(int64)
+		if !ok || i < 0 || v.OverflowUint(uint64(i)) {
+			return mismatch
+		}
+		v.SetUint(uint64(i))
+	case reflect.Float32, reflect.Float64:
+		switch n := item.(type) {
+		case float64:
+			v.SetFloat(n)
+		case int64:
+			v.SetFloat(float64(n))
+		default:
+			return mismatch
+		}
+	default:
+		return fmt.Errorf("cbor: unsupported type %s", v.Type())
+	}
+	return nil
+}
@@ -3,6 +3,7 @@
 import { useEffect, useState } from 'react';
 import { useRouter } from 'next/navigation';
 import { getApiBaseUrl } from '@/lib/api';
+import type { AgentInfo } from '@/lib/devices';
 import { LogoutConfirmButton } from '@/components/logout-confirm-button';
 
 interface Device {
@@ -10,6 +11,7 @@ interface Device {
   DeviceID: string;
   DeviceName: string;
   Status: string;
+  Agent?: AgentInfo | null;
 }
 
 export default function DevicesPage() {
@@ -85,6 +87,12 @@ export default function DevicesPage() {
                     <div className="min-w-0">
                       <h3 className="truncate text-lg font-black text-slate-50">{device.DeviceName || '未命名'}</h3>
                       <p className="mt-1 truncate font-mono text-xs text-slate-500">{device.DeviceID}</p>
+                      {device.Agent && (
+                        <p className={`mt-1 truncate text-xs ${device.Agent.compatible ? 'text-slate-500' : 'text-amber-300'}`}>
+                          Agent {device.Agent.version} · {device.Agent.os}
+                          {!device.Agent.compatible && ' · 版本不兼容，请更新 agent'}
+                        </p>
+                      )}
                     </div>
                     <span className={`shrink-0 rounded-full px-3 py-1 text-xs font-semibold ${device.Status === 'online' ? 'bg-emerald-500/20 text-emerald-200 border border-emerald-400/30' : 'bg-slate-800 text-slate-400 border border-slate-700'}`}>
                       {device.Status === 'online' ? '在线' : '离线'}
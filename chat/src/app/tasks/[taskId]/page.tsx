@@ -4,6 +4,8 @@ import { useEffect, useState } from 'react';
 import { useParams, useRouter } from 'next/navigation';
 import { getTask, Task, TaskEventKind } from '@/lib/tasks';
 import { NotificationBell } from '@/components/notifications/notification-bell';
+import { WorkspacePanel } from '@/components/tasks/workspace-panel';
+import { getDeviceAgent, type AgentInfo } from '@/lib/devices';
 
 const stateStyles: Record<Task['state'], string> = {
   running: 'bg-emerald-600/20 text-emerald-300 border border-emerald-500/30',
@@ -21,6 +23,7 @@ const stateLabels: Record<Task['state'], string> = {
 
 export default function TaskDetailPage() {
   const [task, setTask] = useState<Task | null>(null);
+  const [agent, setAgent] = useState<AgentInfo | null>(null);
   const [loading, setLoading] = useState(true);
   const [error, setError] = useState('');
   const params = useParams();
@@ -49,6 +52,7 @@ export default function TaskDetailPage() {
       setError('');
       const data = await getTask(taskId);
       setTask(data);
+      setAgent(await getDeviceAgent(data.device_id).catch(() => null));
     } catch (err) {
       setError(err instanceof Error ? err.message : 'Failed to fetch task');
     } finally {
@@ -143,6 +147,8 @@ export default function TaskDetailPage() {
           </div>
         </section>
 
+          <WorkspacePanel task={task} agent={agent} />
+
           <section className="mt-4 rounded-[24px] border border-cyan-400/10 bg-slate-950/80 p-4 md:p-5">
             <div className="flex items-center justify-between gap-3">
               <div>
@@ -0,0 +1,166 @@
+'use client';
+
+import { useState } from 'react';
+import { agentSupports, type AgentInfo } from '@/lib/devices';
+import {
+  getTaskDiff,
+  getTaskFile,
+  listTaskFiles,
+  runGitAction,
+  type DirListing,
+  type FileContent,
+  type GitAction,
+  type Task,
+  type TaskDiff,
+} from '@/lib/tasks';
+
+interface WorkspacePanelProps {
+  task: Task;
+  agent: AgentInfo | null;
+}
+
+// 改动、文件和 git 操作只对上报了对应能力的 agent 显示，旧版 agent 不会收到不认识的请求
+export function WorkspacePanel({ task, agent }: WorkspacePanelProps) {
+  const canDiff = agentSupports(agent, 'diff');
+  const canBrowse = agentSupports(agent, 'files');
+  const canGit = agentSupports(agent, 'git_action');
+
+  const [diff, setDiff] = useState<TaskDiff | null>(null);
+  const [listing, setListing] = useState<DirListing | null>(null);
+  const [file, setFile] = useState<FileContent | null>(null);
+  const [gitSummary, setGitSummary] = useState('');
+  const [busy, setBusy] = useState(false);
+  const [error, setError] = useState('');
+
+  async function run(action: () => Promise<void>) {
+    setBusy(true);
+    setError('');
+    try {
+      await action();
+    } catch (err) {
+      setError(err instanceof Error ? err.message : 'Request failed');
+    } finally {
+      setBusy(false);
+    }
+  }
+
+  const showDiff = () => run(async () => {
+    setDiff(await getTaskDiff(task.id));
+  });
+
+  const openDir = (path: string) => run(async () => {
+    setFile(null);
+    setListing(await listTaskFiles(task.id, path));
+  });
+
+  const openFile = (path: string) => run(async () => {
+    setFile(await getTaskFile(task.id, path));
+  });
+
+  const git = (action: GitAction) => run(async () => {
+    let message: string | undefined;
+    if (action === 'commit') {
+      message = window.prompt('提交说明（只提交已跟踪文件的改动）')?.trim();
+      if (!message) {
+        return;
+      }
+    }
+    const result = await runGitAction(task.id, action, { message });
+    setGitSummary(result.summary);
+  });
+
+  if (!canDiff && !canBrowse && !canGit) {
+    return (
+      <section className="mt-4 rounded-[24px] border border-dashed border-slate-800 p-4 text-sm text-slate-400">
+        当前 agent 不支持查看改动、浏览文件和 git 操作，请更新 agent。
+      </section>
+    );
+  }
+
+  return (
+    <section className="mt-4 rounded-[24px] border border-cyan-400/10 bg-slate-950/80 p-4 md:p-5">
+      <p className="text-[11px] uppercase tracking-[0.2em] text-slate-500">Workspace</p>
+      <div className="mt-3 flex flex-wrap gap-2">
+        {canDiff && (
+          <PanelButton onClick={showDiff} disabled={busy}>查看改动</PanelButton>
+        )}
+        {canBrowse && (
+          <PanelButton onClick={() => openDir('')} disabled={busy}>浏览文件</PanelButton>
+        )}
+        {canGit && (
+          <>
+            <PanelButton onClick={() => git('commit')} disabled={busy}>提交</PanelButton>
+            <PanelButton onClick={() => git('stash')} disabled={busy}>暂存</PanelButton>
+            <PanelButton onClick={() => git('push')} disabled={busy}>推送</PanelButton>
+          </>
+        )}
+      </div>
+
+      {error && <p className="mt-3 text-sm text-rose-300">{error}</p>}
+      {gitSummary && <p className="mt-3 text-sm text-slate-300">{gitSummary}</p>}
+
+      {diff && (
+        <div className="mt-4 space-y-1 text-sm">
+          <p className="text-slate-400">
+            {diff.files.length} 个文件，+{diff.additions}/-{diff.deletions}
+          </p>
+          {diff.files.map((item) => (
+            <div key={item.path} className="flex items-center justify-between gap-3">
+              <span className="min-w-0 truncate text-slate-200">{item.path}</span>
+              <span className="shrink-0 text-xs text-slate-500">
+                {item.binary ? 'binary' : `+${item.additions}/-${item.deletions}`}
+              </span>
+            </div>
+          ))}
+        </div>
+      )}
+
+      {listing && !file && (
+        <div className="mt-4 space-y-1 text-sm">
+          {listing.path && (
+            <button onClick={() => openDir(parentPath(listing.path))} className="text-slate-400">
+              ← {listing.path}
+            </button>
+          )}
+          {listing.entries.map((entry) => (
+            <button
+              key={entry.path}
+              onClick={() => (entry.type === 'dir' ? openDir(entry.path) : openFile(entry.path))}
+              className="block w-full truncate text-left text-slate-200"
+            >
+              {entry.type === 'dir' ? `${entry.name}/` : entry.name}
+            </button>
+          ))}
+        </div>
+      )}
+
+      {file && (
+        <div className="mt-4">
+          <button onClick={() => setFile(null)} className="text-sm text-slate-400">
+            ← {file.path}
+          </button>
+          <pre className="mt-2 max-h-96 overflow-auto rounded-2xl bg-slate-900 p-3 text-xs text-slate-200">
+            {file.binary ? '二进制文件' : file.content}
+          </pre>
+        </div>
+      )}
+    </section>
+  );
+}
+
+function PanelButton({ children, onClick, disabled }: { children: React.ReactNode; onClick: () => void; disabled?: boolean }) {
+  return (
+    <button
+      onClick={onClick}
+      disabled={disabled}
+      className="rounded-2xl border border-cyan-400/10 bg-slate-900/80 px-4 py-2 text-sm font-semibold text-slate-200 disabled:opacity-50"
+    >
+      {children}
+    </button>
+  );
+}
+
+function parentPath(path: string): string {
+  const index = path.lastIndexOf('/');
+  return index < 0 ? '' : path.slice(0, index);
+}
@@ -0,0 +1,44 @@
+import { getApiBaseUrl } from '@/lib/api'
+
+export type AgentCapability = 'terminal' | 'submit_prompt' | 'create_session' | 'workspace_status' | 'diff' | 'git_action' | 'files' | 'upload'
+
+export interface AgentTool {
+  name: string
+  installed: boolean
+  version?: string
+}
+
+// agent 连接时 hello 握手上报的信息，离线或旧版 agent 为空
+export interface AgentInfo {
+  version: string
+  protocol_version: number
+  os: string
+  arch: string
+  tmux_version?: string
+  tools: AgentTool[]
+  capabilities: string[]
+  compatible: boolean
+  connected_at: string
+}
+
+// 旧版 agent 没有握手信息时按支持处理，由云端返回错误兜底
+export function agentSupports(agent: AgentInfo | null | undefined, capability: AgentCapability): boolean {
+  if (!agent) {
+    return true
+  }
+  return agent.compatible && agent.capabilities.includes(capability)
+}
+
+// 任务所在设备的 agent 握手信息，设备不存在或 agent 离线时为 null
+export async function getDeviceAgent(deviceId: string): Promise<AgentInfo | null> {
+  const token = localStorage.getItem('token') || ''
+  const res = await fetch(`${getApiBaseUrl()}/api/devices`, {
+    headers: { Authorization: token },
+  })
+  if (!res.ok) {
+    throw new Error('Failed to fetch devices')
+  }
+  const data = await res.json()
+  const device = (data.devices || []).find((item: { DeviceID: string }) => item.DeviceID === deviceId)
+  return device?.Agent || null
+}
@@ -0,0 +1,69 @@
+import { getApiBaseUrl } from '@/lib/api'
+
+export type QueueItemStatus = 'queued' | 'dispatched' | 'completed' | 'failed' | 'cancelled'
+
+export interface QueueItem {
+  id: number
+  device_id: string
+  session_name: string
+  title: string
+  prompt: string
+  position: number
+  status: QueueItemStatus
+  task_id: string
+  created_at: string
+  dispatched_at: string
+  finished_at: string
+}
+
+export interface TaskQueue {
+  device_id: string
+  session_name: string
+  paused: boolean
+  pause_reason?: string
+  items: QueueItem[]
+}
+
+async function postQueue(path: string, body: Record<string, unknown>) {
+  const token = localStorage.getItem('token') || ''
+  const res = await fetch(`${getApiBaseUrl()}/api/queue/${path}`, {
+    method: 'POST',
+    headers: { Authorization: token, 'Content-Type': 'application/json' },
+    body: JSON.stringify(body),
+  })
+  if (!res.ok) {
+    throw new Error((await res.text()) || `Failed to ${path} queue`)
+  }
+  return res.json()
+}
+
+export async function getQueue(deviceId: string, sessionName: string): Promise<TaskQueue> {
+  const token = localStorage.getItem('token') || ''
+  const params = new URLSearchParams({ device_id: deviceId, session_name: sessionName })
+  const res = await fetch(`${getApiBaseUrl()}/api/queue?${params.toString()}`, {
+    headers: { Authorization: token },
+  })
+  if (!res.ok) {
+    throw new Error('Failed to fetch queue')
+  }
+  const data = await res.json()
+  return data.queue
+}
+
+export async function enqueuePrompt(deviceId: string, sessionName: string, prompt: string, title = ''): Promise<QueueItem> {
+  const data = await postQueue('enqueue', { device_id: deviceId, session_name: sessionName, title, prompt })
+  return data.item
+}
+
+export async function reorderQueue(deviceId: string, sessionName: string, itemIds: number[]): Promise<void> {
+  await postQueue('reorder', { device_id: deviceId, session_name: sessionName, item_ids: itemIds })
+}
+
+export async function cancelQueueItem(itemId: number): Promise<QueueItem> {
+  const data = await postQueue('cancel', { item_id: itemId })
+  return data.item
+}
+
+export async function resumeQueue(deviceId: string, sessionName: string): Promise<void> {
+  await postQueue('resume', { device_id: deviceId, session_name: sessionName })
+}
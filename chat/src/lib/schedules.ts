@@ -0,0 +1,105 @@
+import { getApiBaseUrl } from '@/lib/api'
+
+export type CatchUpPolicy = '' | 'skip' | 'latest' | 'all'
+
+export interface TaskSchedule {
+  id: number
+  device_id: string
+  name: string
+  cron_expr: string
+  timezone: string
+  tool: string
+  project_path: string
+  prompt: string
+  catch_up: CatchUpPolicy
+  enabled: boolean
+  next_run_at: string
+  last_run_at: string
+  created_at: string
+}
+
+export interface TaskScheduleRun {
+  id: number
+  schedule_id: number
+  session_name: string
+  task_id: string
+  scheduled_for: string
+  status: 'dispatched' | 'skipped' | 'completed' | 'failed'
+  error: string
+  finished_at: string
+}
+
+export interface ScheduleInput {
+  device_id: string
+  name: string
+  cron_expr: string
+  timezone?: string
+  tool?: string
+  project_path: string
+  prompt: string
+  catch_up?: CatchUpPolicy
+}
+
+function authHeaders(json = false): Record<string, string> {
+  const headers: Record<string, string> = { Authorization: localStorage.getItem('token') || '' }
+  if (json) {
+    headers['Content-Type'] = 'application/json'
+  }
+  return headers
+}
+
+export async function getSchedules(): Promise<TaskSchedule[]> {
+  const res = await fetch(`${getApiBaseUrl()}/api/schedules`, { headers: authHeaders() })
+  if (!res.ok) {
+    throw new Error('Failed to fetch schedules')
+  }
+  const data = await res.json()
+  return data.schedules || []
+}
+
+export async function createSchedule(input: ScheduleInput): Promise<TaskSchedule> {
+  const res = await fetch(`${getApiBaseUrl()}/api/schedules/create`, {
+    method: 'POST',
+    headers: authHeaders(true),
+    body: JSON.stringify(input),
+  })
+  if (!res.ok) {
+    throw new Error((await res.text()) || 'Failed to create schedule')
+  }
+  const data = await res.json()
+  return data.schedule
+}
+
+export async function setScheduleEnabled(id: number, enabled: boolean): Promise<TaskSchedule> {
+  const res = await fetch(`${getApiBaseUrl()}/api/schedules/enable`, {
+    method: 'POST',
+    headers: authHeaders(true),
+    body: JSON.stringify({ id, enabled }),
+  })
+  if (!res.ok) {
+    throw new Error('Failed to update schedule')
+  }
+  const data = await res.json()
+  return data.schedule
+}
+
+export async function deleteSchedule(id: number): Promise<void> {
+  const res = await fetch(`${getApiBaseUrl()}/api/schedules/delete`, {
+    method: 'POST',
+    headers: authHeaders(true),
+    body: JSON.stringify({ id }),
+  })
+  if (!res.ok) {
+    throw new Error('Failed to delete schedule')
+  }
+}
+
+export async function getScheduleRuns(id: number, limit = 20): Promise<TaskScheduleRun[]> {
+  const params = new URLSearchParams({ id: String(id), limit: String(limit) })
+  const res = await fetch(`${getApiBaseUrl()}/api/schedules/runs?${params.toString()}`, { headers: authHeaders() })
+  if (!res.ok) {
+    throw new Error('Failed to fetch schedule runs')
+  }
+  const data = await res.json()
+  return data.runs || []
+}
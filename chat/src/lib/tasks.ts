@@ -3,6 +3,7 @@ import { getApiBaseUrl } from '@/lib/api'
 export type TaskState = 'running' | 'waiting' | 'completed' | 'attention'
 
 export interface TaskEvent {
+  id?: number
   summary: string
   timestamp: string
   kind: TaskEventKind
@@ -24,6 +25,40 @@ export interface Task {
   recent_event: string
   last_activity_at: string
   timeline?: TaskEvent[]
+  goal?: string
+  created_at?: string
+  finished_at?: string
+  final_state?: TaskState
+  sessions?: string[]
+  workspace?: WorkspaceStatus
+}
+
+export interface WorkspaceFile {
+  path: string
+  status: 'modified' | 'added' | 'deleted' | 'renamed' | 'untracked'
+  additions: number
+  deletions: number
+  binary?: boolean
+}
+
+export interface WorkspaceStatus {
+  is_repo: boolean
+  branch?: string
+  upstream?: string
+  ahead: number
+  behind: number
+  dirty: boolean
+  files_changed: number
+  additions: number
+  deletions: number
+  files: WorkspaceFile[]
+  last_commit?: {
+    hash: string
+    subject: string
+    author: string
+    committed_at: string
+  }
+  updated_at?: string
 }
 
 export async function getTasks(): Promise<Task[]> {
@@ -49,3 +84,208 @@ export async function getTask(taskId: string): Promise<Task> {
   const data = await res.json()
   return data.task
 }
+
+export async function updateTask(taskId: string, fields: { title?: string; goal?: string }): Promise<Task> {
+  const token = localStorage.getItem('token') || ''
+  const res = await fetch(`${getApiBaseUrl()}/api/tasks/update`, {
+    method: 'POST',
+    headers: { Authorization: token, 'Content-Type': 'application/json' },
+    body: JSON.stringify({ id: taskId, ...fields }),
+  })
+  if (!res.ok) {
+    throw new Error('Failed to update task')
+  }
+  const data = await res.json()
+  return data.task
+}
+
+export interface TaskTimelinePage {
+  events: TaskEvent[]
+  next_before: string
+  next_before_id: number
+}
+
+export async function getTaskTimeline(taskId: string, before = '', beforeId = 0, limit = 50): Promise<TaskTimelinePage> {
+  const token = localStorage.getItem('token') || ''
+  const params = new URLSearchParams({ task_id: taskId, limit: String(limit) })
+  if (before) {
+    params.set('before', before)
+  }
+  if (beforeId > 0) {
+    params.set('before_id', String(beforeId))
+  }
+  const res = await fetch(`${getApiBaseUrl()}/api/tasks/timeline?${params.toString()}`, {
+    headers: { Authorization: token },
+  })
+  if (!res.ok) {
+    throw new Error('Failed to fetch task timeline')
+  }
+  const data = await res.json()
+  return {
+    events: data.events || [],
+    next_before: data.next_before || '',
+    next_before_id: data.next_before_id || 0,
+  }
+}
+
+export interface DiffLine {
+  kind: 'context' | 'add' | 'delete'
+  content: string
+  old_line?: number
+  new_line?: number
+}
+
+export interface DiffHunk {
+  header: string
+  old_start: number
+  old_lines: number
+  new_start: number
+  new_lines: number
+  lines: DiffLine[]
+}
+
+export interface FileDiff {
+  path: string
+  old_path?: string
+  status: 'modified' | 'added' | 'deleted' | 'renamed' | 'untracked'
+  additions: number
+  deletions: number
+  binary?: boolean
+  // 超过大小限制的文件只返回统计，不返回 hunks
+  truncated?: boolean
+  hunks: DiffHunk[]
+}
+
+export interface TaskDiff {
+  task_id: string
+  base: string
+  files: FileDiff[]
+  additions: number
+  deletions: number
+  truncated?: boolean
+}
+
+export async function getTaskDiff(taskId: string, base = ''): Promise<TaskDiff> {
+  const token = localStorage.getItem('token') || ''
+  const params = new URLSearchParams({ task_id: taskId })
+  if (base) {
+    params.set('base', base)
+  }
+  const res = await fetch(`${getApiBaseUrl()}/api/tasks/diff?${params.toString()}`, {
+    headers: { Authorization: token },
+  })
+  if (!res.ok) {
+    throw new Error('Failed to fetch task diff')
+  }
+  const data = await res.json()
+  return data.diff
+}
+
+export type GitAction = 'commit' | 'discard' | 'stash' | 'create_branch' | 'push'
+
+export interface GitActionResult {
+  action: GitAction
+  ok: boolean
+  denied?: boolean
+  output?: string
+  error?: string
+  commit?: string
+  branch?: string
+  summary: string
+}
+
+export async function runGitAction(
+  taskId: string,
+  action: GitAction,
+  params: { message?: string; paths?: string[]; path?: string; branch?: string; remote?: string } = {},
+): Promise<GitActionResult> {
+  const token = localStorage.getItem('token') || ''
+  const res = await fetch(`${getApiBaseUrl()}/api/tasks/git`, {
+    method: 'POST',
+    headers: { Authorization: token, 'Content-Type': 'application/json' },
+    body: JSON.stringify({ task_id: taskId, action, ...params }),
+  })
+  if (!res.ok) {
+    throw new Error((await res.text()) || 'Failed to run git action')
+  }
+  const data = await res.json()
+  return data.result
+}
+
+export interface FileEntry {
+  name: string
+  path: string
+  type: 'file' | 'dir' | 'symlink'
+  size: number
+  mod_time: string
+}
+
+export interface DirListing {
+  task_id: string
+  path: string
+  entries: FileEntry[]
+  truncated?: boolean
+}
+
+export interface FileContent {
+  task_id: string
+  path: string
+  size: number
+  mod_time: string
+  // 二进制文件不返回内容
+  binary: boolean
+  truncated?: boolean
+  content: string
+}
+
+export async function listTaskFiles(taskId: string, path = ''): Promise<DirListing> {
+  const token = localStorage.getItem('token') || ''
+  const params = new URLSearchParams({ task_id: taskId, path })
+  const res = await fetch(`${getApiBaseUrl()}/api/tasks/files?${params.toString()}`, {
+    headers: { Authorization: token },
+  })
+  if (!res.ok) {
+    throw new Error('Failed to list task files')
+  }
+  const data = await res.json()
+  return data.listing
+}
+
+export async function getTaskFile(taskId: string, path: string): Promise<FileContent> {
+  const token = localStorage.getItem('token') || ''
+  const params = new URLSearchParams({ task_id: taskId, path })
+  const res = await fetch(`${getApiBaseUrl()}/api/tasks/file?${params.toString()}`, {
+    headers: { Authorization: token },
+  })
+  if (!res.ok) {
+    throw new Error('Failed to fetch task file')
+  }
+  const data = await res.json()
+  return data.file
+}
+
+export interface UploadResult {
+  task_id: string
+  // 相对项目根目录，已输入到 AI 工具的提示词中
+  path: string
+  content_type: string
+  size: number
+  sha256: string
+}
+
+export async function uploadTaskFile(taskId: string, file: File): Promise<UploadResult> {
+  const token = localStorage.getItem('token') || ''
+  const form = new FormData()
+  form.append('file', file)
+  const params = new URLSearchParams({ task_id: taskId })
+  const res = await fetch(`${getApiBaseUrl()}/api/tasks/upload?${params.toString()}`, {
+    method: 'POST',
+    headers: { Authorization: token },
+    body: form,
+  })
+  if (!res.ok) {
+    throw new Error('Failed to upload file')
+  }
+  const data = await res.json()
+  return data.upload
+}
@@ -0,0 +1,77 @@
+import { getApiBaseUrl } from '@/lib/api'
+
+export interface PromptTemplate {
+  id: number
+  user_id: number
+  team_id: number | null
+  name: string
+  description: string
+  content: string
+  variables: string[]
+  created_at: string
+  updated_at: string
+}
+
+export interface TemplateInput {
+  name: string
+  description?: string
+  content: string
+  team_id?: number | null
+}
+
+function authHeaders(json = false): Record<string, string> {
+  const headers: Record<string, string> = { Authorization: localStorage.getItem('token') || '' }
+  if (json) {
+    headers['Content-Type'] = 'application/json'
+  }
+  return headers
+}
+
+async function postTemplate(path: string, body: Record<string, unknown>) {
+  const res = await fetch(`${getApiBaseUrl()}/api/templates/${path}`, {
+    method: 'POST',
+    headers: authHeaders(true),
+    body: JSON.stringify(body),
+  })
+  if (!res.ok) {
+    throw new Error((await res.text()) || `Failed to ${path} template`)
+  }
+  return res.json()
+}
+
+export async function getTemplates(): Promise<PromptTemplate[]> {
+  const res = await fetch(`${getApiBaseUrl()}/api/templates`, { headers: authHeaders() })
+  if (!res.ok) {
+    throw new Error('Failed to fetch templates')
+  }
+  const data = await res.json()
+  return data.templates || []
+}
+
+export async function createTemplate(input: TemplateInput): Promise<PromptTemplate> {
+  const data = await postTemplate('create', { ...input })
+  return data.template
+}
+
+export async function updateTemplate(id: number, input: TemplateInput): Promise<PromptTemplate> {
+  const data = await postTemplate('update', { id, ...input })
+  return data.template
+}
+
+export async function deleteTemplate(id: number): Promise<void> {
+  await postTemplate('delete', { id })
+}
+
+export async function renderTemplate(templateId: number, variables: Record<string, string>): Promise<string> {
+  const data = await postTemplate('render', { template_id: templateId, variables })
+  return data.content
+}
+
+// templateInputMessage builds a terminal_input that the server renders from a
+// saved template before forwarding it to the agent.
+export function templateInputMessage(templateId: number, variables: Record<string, string>): string {
+  return JSON.stringify({
+    type: 'terminal_input',
+    payload: { template_id: templateId, variables },
+  })
+}
@@ -1,18 +1,28 @@
 package main
 
 import (
-	"log"
+	"context"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	cloudauth "github.com/mobile-coder/cloud/internal/auth"
 	"github.com/mobile-coder/cloud/internal/config"
+	"github.com/mobile-coder/cloud/internal/cors"
 	"github.com/mobile-coder/cloud/internal/db"
 	"github.com/mobile-coder/cloud/internal/handler"
+	"github.com/mobile-coder/cloud/internal/metrics"
+	"github.com/mobile-coder/cloud/internal/ratelimit"
 	"github.com/mobile-coder/cloud/internal/service"
 	"github.com/mobile-coder/cloud/internal/ws"
+	"github.com/mobile-coder/logging"
+	"github.com/mobile-coder/tracing"
 )
 
 // Static file handler for Capacitor app
@@ -46,24 +56,43 @@ func staticHandler(dir string) http.Handler {
 	})
 }
 
-// CORS middleware
-func corsMiddleware(next http.Handler) http.Handler {
+// realIPMiddleware replaces the remote address with the client address the
+// reverse proxy reports, so audit entries carry the phone's IP. Only enable
+// it behind a proxy that sets these headers, since clients can forge them.
+func realIPMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
+		ip := strings.TrimSpace(r.Header.Get("X-Real-IP"))
+		if ip == "" {
+			// The proxy appends the address it saw last
+			forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+			ip = strings.TrimSpace(forwarded[len(forwarded)-1])
+		}
+		if net.ParseIP(ip) != nil {
+			r.RemoteAddr = net.JoinHostPort(ip, "0")
 		}
-
 		next.ServeHTTP(w, r)
 	})
 }
 
+// withMiddleware wraps the routes with CORS; latency is recorded per mux
+// route, logs carry a request ID.
+func withMiddleware(origins *cors.Policy, mux *http.ServeMux) http.Handler {
+	return cors.Middleware(origins, logging.Middleware(tracing.Middleware(metrics.InstrumentHTTP(mux))))
+}
+
 func main() {
 	cfg := config.Load()
+	logging.Setup(logging.Options{Level: cfg.LogLevel, Format: cfg.LogFormat, Debug: cfg.LogDebug})
+	shutdownTracing, err := tracing.Setup(tracing.Options{
+		Service:     cfg.ServiceName,
+		Exporter:    cfg.TraceExporter,
+		Endpoint:    cfg.TraceEndpoint,
+		SampleRatio: cfg.TraceSampleRatio,
+	})
+	if err != nil {
+		fatal("set up tracing failed", err)
+	}
+	defer shutdownTracing(context.Background())
 
 	// Initialize Supabase DB via REST API
 	database, err := db.InitDB(&db.Config{
@@ -76,26 +105,104 @@ func main() {
 		ProjectURL: cfg.SupabaseProjectURL,
 	})
 	if err != nil {
-		log.Fatal(err)
+		fatal("connect to database failed", err)
 	}
 
 	// Initialize services
 	deviceService := service.NewDeviceService(database)
-	hub := ws.NewHub()
-	taskService := service.NewTaskService(deviceService, hub)
+	taskEventService := service.NewTaskEventService(database)
+	hub := ws.NewHub(taskEventService)
+	taskService := service.NewTaskService(deviceService, taskEventService)
+	taskService.EnableTaskRecords(database)
+	taskEventService.SetTaskResolver(taskService)
+	hub.AddTaskEventHandler(taskService) // after the event store, so the refresh sees the event
 	notificationService := service.NewNotificationService(database)
+	queueService := service.NewTaskQueueService(database, hub, taskService)
+	hub.AddTaskEventHandler(queueService)
+	scheduleService := service.NewScheduleService(database, hub, taskService, notificationService, service.CatchUpPolicy(cfg.ScheduleCatchUp))
+	hub.AddTaskEventHandler(scheduleService)
+	hub.AddPresenceHandler(deviceService)
+	hub.AddPresenceHandler(taskService) // after the device service, so the status is stored
+	templateService := service.NewTemplateService(database)
 	tokenManager := cloudauth.NewManager(cfg.JWTSecret, 24*time.Hour)
+	auditService := service.NewAuditService(database, cfg.AuditStoreContent)
+
+	// Replicas behind a load balancer share agents and viewers via the backplane
+	backplane, err := ws.NewBackplane(cfg.BackplaneURL)
+	if err != nil {
+		fatal("create backplane failed", err)
+	}
+	if backplane != nil {
+		if err := hub.SetBackplane(backplane); err != nil {
+			fatal("attach backplane failed", err)
+		}
+		defer backplane.Close()
+	}
+
+	hub.SetSlowClientTimeout(cfg.WSSlowClientTimeout)
 
 	// Start WebSocket hub
 	go hub.Run()
+	go scheduleService.Run()
+	go queueService.Run()
+	go auditService.Run()
+
+	// Browser origins allowed to call the API and open WebSockets
+	origins := cors.New(cfg.AllowedOrigins, cfg.CORSAllowCredentials)
 
 	// Initialize handlers
 	deviceHandler := handler.NewDeviceHandler(deviceService, tokenManager)
+	deviceHandler.SetAgentInfoSource(hub)
+	deviceHandler.SetAuditRecorder(auditService)
+	deviceHandler.SetSessionCache(taskService, hub)
 	taskHandler := handler.NewTaskHandler(taskService, tokenManager)
+	diffHandler := handler.NewDiffHandler(service.NewDiffService(taskService, hub), tokenManager)
+	fileHandler := handler.NewFileHandler(service.NewFileService(taskService, hub), tokenManager)
+	uploadHandler := handler.NewUploadHandler(service.NewUploadService(taskService, hub, cfg.UploadMaxBytes, cfg.UploadAllowedTypes), tokenManager)
+	gitActionService := service.NewGitActionService(database, taskService, hub, hub)
+	gitActionService.SetAuditRecorder(auditService)
+	gitActionHandler := handler.NewGitActionHandler(gitActionService, tokenManager)
 	notificationHandler := handler.NewNotificationHandler(notificationService, tokenManager, taskService)
 	authService := service.NewAuthService(database)
 	authHandler := handler.NewAuthHandler(authService, tokenManager)
+	authHandler.SetAuditRecorder(auditService)
 	wsHandler := handler.NewWSHubHandler(hub, deviceService, tokenManager)
+	wsHandler.SetTransport(cfg.WSCompression, cfg.WSEncoding)
+	wsHandler.SetHeartbeat(cfg.WSPingInterval, cfg.WSReadTimeout)
+	wsHandler.SetTemplateRenderer(templateService)
+	wsHandler.SetWorkspaceStatusHandler(taskService)
+	wsHandler.SetPromptDoneHandler(queueService)
+	wsHandler.SetAuditRecorder(auditService)
+	wsHandler.SetOriginPolicy(origins)
+	auditHandler := handler.NewAuditHandler(auditService, tokenManager)
+
+	// Brute-force protection for logins and bind codes
+	requestLimiter := ratelimit.New(ratelimit.Policy{
+		Limit:      cfg.RateLimitRequests,
+		Window:     cfg.RateLimitWindow,
+		Lockout:    cfg.RateLimitLockout,
+		MaxLockout: cfg.RateLimitMaxLockout,
+	})
+	failureLimiter := ratelimit.New(ratelimit.Policy{
+		Limit:      cfg.RateLimitFailures,
+		Window:     cfg.RateLimitFailureWindow,
+		Lockout:    cfg.RateLimitLockout,
+		MaxLockout: cfg.RateLimitMaxLockout,
+	})
+	bindCodeLimiter := ratelimit.New(ratelimit.Policy{
+		Limit:      cfg.BindCodeMaxAttempts,
+		Window:     10 * time.Minute, // bind codes expire after 10 minutes
+		Lockout:    cfg.RateLimitMaxLockout,
+		MaxLockout: cfg.RateLimitMaxLockout,
+	})
+	authHandler.SetLoginLimiter(failureLimiter)
+	deviceHandler.SetRateLimits(failureLimiter, bindCodeLimiter)
+	limited := func(handle http.HandlerFunc) http.Handler {
+		return ratelimit.Middleware(requestLimiter, handle)
+	}
+	templateHandler := handler.NewTemplateHandler(templateService, tokenManager)
+	queueHandler := handler.NewQueueHandler(queueService, deviceService, tokenManager)
+	scheduleHandler := handler.NewScheduleHandler(scheduleService, deviceService, tokenManager)
 
 	// Routes
 	mux := http.NewServeMux()
@@ -104,34 +211,62 @@ func main() {
 	staticDir := os.Getenv("STATIC_DIR")
 	if staticDir != "" {
 		mux.Handle("/", staticHandler(staticDir))
-		log.Printf("Serving static files from: %s", staticDir)
+		slog.Info("serving static files", "dir", staticDir)
 	}
 
 	// Auth routes
 	mux.HandleFunc("/api/auth/register", authHandler.Register)
-	mux.HandleFunc("/api/auth/login", authHandler.Login)
+	mux.Handle("/api/auth/login", limited(authHandler.Login))
 
 	// Device routes
-	mux.HandleFunc("/api/device/register", deviceHandler.Register)
-	mux.HandleFunc("/api/device/bind", deviceHandler.BindDevice)
-	mux.HandleFunc("/api/device/bind-agent", deviceHandler.BindAgent)
+	mux.Handle("/api/device/register", limited(deviceHandler.Register))
+	mux.Handle("/api/device/bind", limited(deviceHandler.BindDevice))
+	mux.Handle("/api/device/bind-agent", limited(deviceHandler.BindAgent))
 	mux.HandleFunc("/api/device/list", deviceHandler.ListDevices)
-	mux.HandleFunc("/api/device/check", deviceHandler.CheckDevice)
+	mux.Handle("/api/device/check", limited(deviceHandler.CheckDevice))
 	mux.HandleFunc("/api/device/update", deviceHandler.UpdateDevice)
 	mux.HandleFunc("/api/device/delete", deviceHandler.DeleteDevice)
 	mux.HandleFunc("/api/devices", deviceHandler.GetUserDevices)
 	mux.HandleFunc("/api/tasks", taskHandler.GetTasks)
 	mux.HandleFunc("/api/tasks/detail", taskHandler.GetTask)
+	mux.HandleFunc("/api/tasks/timeline", taskHandler.GetTaskTimeline)
+	mux.HandleFunc("/api/tasks/update", taskHandler.UpdateTask)
+	mux.HandleFunc("/api/tasks/diff", diffHandler.GetTaskDiff)
+	mux.HandleFunc("/api/tasks/git", gitActionHandler.RunGitAction)
+	mux.HandleFunc("/api/tasks/files", fileHandler.ListFiles)
+	mux.HandleFunc("/api/tasks/file", fileHandler.GetFile)
+	mux.HandleFunc("/api/tasks/upload", uploadHandler.Upload)
+	mux.HandleFunc("/api/queue", queueHandler.GetQueue)
+	mux.HandleFunc("/api/queue/enqueue", queueHandler.Enqueue)
+	mux.HandleFunc("/api/queue/reorder", queueHandler.Reorder)
+	mux.HandleFunc("/api/queue/cancel", queueHandler.Cancel)
+	mux.HandleFunc("/api/queue/resume", queueHandler.Resume)
+	mux.HandleFunc("/api/schedules", scheduleHandler.ListSchedules)
+	mux.HandleFunc("/api/schedules/create", scheduleHandler.CreateSchedule)
+	mux.HandleFunc("/api/schedules/enable", scheduleHandler.SetScheduleEnabled)
+	mux.HandleFunc("/api/schedules/delete", scheduleHandler.DeleteSchedule)
+	mux.HandleFunc("/api/schedules/runs", scheduleHandler.ListRuns)
+	mux.HandleFunc("/api/templates", templateHandler.ListTemplates)
+	mux.HandleFunc("/api/templates/create", templateHandler.CreateTemplate)
+	mux.HandleFunc("/api/templates/update", templateHandler.UpdateTemplate)
+	mux.HandleFunc("/api/templates/delete", templateHandler.DeleteTemplate)
+	mux.HandleFunc("/api/templates/render", templateHandler.RenderTemplate)
 	mux.HandleFunc("/api/notifications", notificationHandler.ListNotifications)
 	mux.HandleFunc("/api/notifications/read", notificationHandler.MarkNotificationRead)
 	mux.HandleFunc("/api/notifications/read-all", notificationHandler.MarkAllNotificationsRead)
 	mux.HandleFunc("/api/devices/sessions", deviceHandler.GetDeviceSessions)
+	mux.HandleFunc("/api/devices/presence", deviceHandler.GetDevicePresence)
 	mux.HandleFunc("/api/sessions", deviceHandler.CreateSession)
 	mux.HandleFunc("/api/sessions/delete", deviceHandler.DeleteSession)
+	mux.HandleFunc("/api/audit", auditHandler.ListAudit)
 
 	// WebSocket
 	mux.HandleFunc("/ws", wsHandler.HandleConnection)
 
+	// Prometheus metrics
+	registerMetrics(metrics.Default, hub, taskService)
+	mux.Handle("/metrics", metrics.Handler(metrics.Default, cfg.MetricsToken))
+
 	// Health check
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -139,9 +274,36 @@ func main() {
 		w.Write([]byte(`{"status":"ok"}`))
 	})
 
-	// Wrap with CORS
-	handler := corsMiddleware(mux)
+	handler := withMiddleware(origins, mux)
+	if cfg.TrustProxyHeaders {
+		handler = realIPMiddleware(handler)
+	}
+
+	server := &http.Server{Addr: ":" + cfg.Port, Handler: handler}
+	go func() {
+		slog.Info("cloud server starting", "port", cfg.Port)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			fatal("server stopped", err)
+		}
+	}()
+
+	stop, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	<-stop.Done()
+	slog.Info("cloud server shutting down")
+	shutdown, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdown); err != nil {
+		slog.Warn("http shutdown incomplete", "error", err)
+	}
+	// Write out the audit entries still queued
+	auditService.Close()
+}
+
+// shutdownTimeout bounds how long requests in flight may finish on SIGTERM.
+const shutdownTimeout = 10 * time.Second
 
-	log.Printf("Cloud server starting on port %s (no auth mode)", cfg.Port)
-	log.Fatal(http.ListenAndServe(":"+cfg.Port, handler))
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
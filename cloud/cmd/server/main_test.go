@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/mobile-coder/cloud/internal/cors"
+	"github.com/mobile-coder/logging"
+)
+
+func TestMiddlewareLetsWebSocketsUpgrade(t *testing.T) {
+	requestIDs := make(chan string, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		requestIDs <- logging.RequestID(r.Context())
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		conn.Close()
+	})
+	server := httptest.NewServer(withMiddleware(cors.New(nil, false), mux))
+	defer server.Close()
+
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+	// The socket keeps the request ID of its upgrade request
+	if id := <-requestIDs; id == "" {
+		t.Fatal("upgrade request has no request ID")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sort"
+
+	"github.com/mobile-coder/cloud/internal/metrics"
+	"github.com/mobile-coder/cloud/internal/service"
+	"github.com/mobile-coder/cloud/internal/ws"
+)
+
+// registerMetrics exposes state the hub and task service keep themselves.
+func registerMetrics(registry *metrics.Registry, hub *ws.Hub, taskService *service.TaskService) {
+	registry.NewGaugeFunc("mobilecoder_ws_connections",
+		"Connected WebSocket clients on this replica by role (agent, viewer).",
+		[]string{"role"}, func() []metrics.Sample {
+			agents, viewers := 0, 0
+			for _, client := range hub.Clients() {
+				if client.IsAgent {
+					agents++
+				} else {
+					viewers++
+				}
+			}
+			return []metrics.Sample{
+				{Labels: []string{"agent"}, Value: float64(agents)},
+				{Labels: []string{"viewer"}, Value: float64(viewers)},
+			}
+		})
+
+	// Queue depth is summed and maxed per role: a series per client would
+	// grow with every session
+	queueDepths := func(aggregate func(total, depth int) int) []metrics.Sample {
+		agents, viewers := 0, 0
+		for _, client := range hub.Clients() {
+			if client.IsAgent {
+				agents = aggregate(agents, client.QueueDepth)
+			} else {
+				viewers = aggregate(viewers, client.QueueDepth)
+			}
+		}
+		return []metrics.Sample{
+			{Labels: []string{"agent"}, Value: float64(agents)},
+			{Labels: []string{"viewer"}, Value: float64(viewers)},
+		}
+	}
+	registry.NewGaugeFunc("mobilecoder_ws_queued_frames",
+		"Frames waiting in the send queues of connected clients, summed by role.",
+		[]string{"role"}, func() []metrics.Sample {
+			return queueDepths(func(total, depth int) int { return total + depth })
+		})
+	registry.NewGaugeFunc("mobilecoder_ws_client_queue_depth_max",
+		"Deepest send queue of a connected client by role.",
+		[]string{"role"}, func() []metrics.Sample {
+			return queueDepths(func(deepest, depth int) int { return max(deepest, depth) })
+		})
+
+	registry.NewCounterFunc("mobilecoder_ws_frames_not_delivered_total",
+		"Frames that did not reach a client as sent: dropped for a full queue, or snapshots coalesced into a newer one.",
+		[]string{"reason"}, func() []metrics.Sample {
+			stats := hub.QueueStats()
+			return []metrics.Sample{
+				{Labels: []string{"dropped"}, Value: float64(stats.Dropped)},
+				{Labels: []string{"coalesced"}, Value: float64(stats.Coalesced)},
+			}
+		})
+
+	registry.NewCounterFunc("mobilecoder_ws_slow_disconnects_total",
+		"Viewers disconnected for staying behind longer than WS_SLOW_CLIENT_TIMEOUT.",
+		nil, func() []metrics.Sample {
+			return []metrics.Sample{{Value: float64(hub.QueueStats().SlowDisconnects)}}
+		})
+
+	registry.NewGaugeFunc("mobilecoder_tasks",
+		"Task records by state, counted in the store at scrape time.",
+		[]string{"state"}, func() []metrics.Sample {
+			counts, err := taskService.CountTasksByState(context.Background())
+			if err != nil {
+				if !errors.Is(err, service.ErrTaskRecordsUnavailable) {
+					slog.Warn("metrics: counting tasks failed", "error", err)
+				}
+				return nil
+			}
+			states := make([]string, 0, len(counts))
+			for state := range counts {
+				states = append(states, string(state))
+			}
+			sort.Strings(states)
+			samples := make([]metrics.Sample, 0, len(states))
+			for _, state := range states {
+				samples = append(samples, metrics.Sample{Labels: []string{state}, Value: float64(counts[service.TaskState(state)])})
+			}
+			return samples
+		})
+}
@@ -2,4 +2,15 @@ module github.com/mobile-coder/cloud
 
 go 1.25.6
 
-require github.com/gorilla/websocket v1.5.3
+require (
+	github.com/gorilla/websocket v1.5.3
+	github.com/mobile-coder/cbor v0.0.0
+	github.com/mobile-coder/logging v0.0.0
+	github.com/mobile-coder/tracing v0.0.0
+)
+
+replace (
+	github.com/mobile-coder/cbor => ../cbor
+	github.com/mobile-coder/logging => ../logging
+	github.com/mobile-coder/tracing => ../tracing
+)
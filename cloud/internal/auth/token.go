@@ -12,6 +12,14 @@ import (
 	"time"
 )
 
+// RegistrationTTL is how long a registration token lasts, as long as the
+// bind code it is issued with.
+const RegistrationTTL = 10 * time.Minute
+
+// RefreshGrace is how long after it expires a token can still be exchanged
+// for a new one. An agent offline for longer binds again with a bind code.
+const RefreshGrace = 7 * 24 * time.Hour
+
 var (
 	ErrInvalidToken = errors.New("invalid token")
 	ErrExpiredToken = errors.New("expired token")
@@ -75,15 +83,43 @@ func (m *Manager) IssueAgent(userID int64, deviceID string) (string, error) {
 	return encodedPayload + "." + signature, nil
 }
 
+// IssueRegistration issues the token a freshly registered agent holds until
+// a user binds its device; it carries no user.
+func (m *Manager) IssueRegistration(deviceID string) (string, error) {
+	claims := Claims{
+		DeviceID:  deviceID,
+		TokenType: "registration",
+		ExpiresAt: m.now().Add(RegistrationTTL).Unix(),
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	encodedPayload := base64.RawURLEncoding.EncodeToString(payload)
+	signature := m.sign(encodedPayload)
+	return encodedPayload + "." + signature, nil
+}
+
+// Verify accepts user and agent tokens; registration tokens are only good
+// for VerifyRegistration.
 func (m *Manager) Verify(token string) (*Claims, error) {
-	return m.verify(token, false)
+	return m.verify(token, 0, false)
+}
+
+// VerifyForRefresh also accepts tokens that expired less than RefreshGrace
+// ago.
+func (m *Manager) VerifyForRefresh(token string) (*Claims, error) {
+	return m.verify(token, RefreshGrace, false)
 }
 
-func (m *Manager) VerifyAllowExpired(token string) (*Claims, error) {
-	return m.verify(token, true)
+// VerifyRegistration accepts only registration tokens.
+func (m *Manager) VerifyRegistration(token string) (*Claims, error) {
+	return m.verify(token, 0, true)
 }
 
-func (m *Manager) verify(token string, allowExpired bool) (*Claims, error) {
+func (m *Manager) verify(token string, grace time.Duration, registration bool) (*Claims, error) {
 	parts := strings.Split(token, ".")
 	if len(parts) != 2 {
 		return nil, ErrInvalidToken
@@ -103,7 +139,10 @@ func (m *Manager) verify(token string, allowExpired bool) (*Claims, error) {
 		return nil, ErrInvalidToken
 	}
 
-	if claims.UserID == 0 {
+	if (claims.TokenType == "registration") != registration {
+		return nil, ErrInvalidToken
+	}
+	if claims.UserID == 0 && claims.TokenType != "registration" {
 		return nil, ErrInvalidToken
 	}
 
@@ -113,7 +152,7 @@ func (m *Manager) verify(token string, allowExpired bool) (*Claims, error) {
 			return nil, ErrInvalidToken
 		}
 		claims.TokenType = "user"
-	case "agent":
+	case "agent", "registration":
 		if claims.DeviceID == "" {
 			return nil, ErrInvalidToken
 		}
@@ -121,7 +160,7 @@ func (m *Manager) verify(token string, allowExpired bool) (*Claims, error) {
 		return nil, ErrInvalidToken
 	}
 
-	if !allowExpired && m.now().Unix() > claims.ExpiresAt {
+	if m.now().Add(-grace).Unix() > claims.ExpiresAt {
 		return nil, ErrExpiredToken
 	}
 
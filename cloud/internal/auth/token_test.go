@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"errors"
 	"testing"
 	"time"
 )
@@ -61,9 +62,9 @@ func TestManagerVerifiesExpiredTokenForRefresh(t *testing.T) {
 		t.Fatalf("IssueAgent returned error: %v", err)
 	}
 
-	claims, err := manager.VerifyAllowExpired(token)
+	claims, err := manager.VerifyForRefresh(token)
 	if err != nil {
-		t.Fatalf("VerifyAllowExpired returned error: %v", err)
+		t.Fatalf("VerifyForRefresh returned error: %v", err)
 	}
 
 	if claims.UserID != 42 {
@@ -77,6 +78,26 @@ func TestManagerVerifiesExpiredTokenForRefresh(t *testing.T) {
 	}
 }
 
+func TestManagerRefusesRefreshLongAfterExpiry(t *testing.T) {
+	manager := NewManager("test-secret", time.Hour)
+	issued := time.Date(2026, 4, 1, 9, 0, 0, 0, time.UTC)
+	manager.now = func() time.Time { return issued }
+
+	token, err := manager.IssueAgent(42, "device-123")
+	if err != nil {
+		t.Fatalf("IssueAgent returned error: %v", err)
+	}
+
+	manager.now = func() time.Time { return issued.Add(time.Hour + RefreshGrace - time.Minute) }
+	if _, err := manager.VerifyForRefresh(token); err != nil {
+		t.Fatalf("VerifyForRefresh within the grace: %v", err)
+	}
+	manager.now = func() time.Time { return issued.Add(time.Hour + RefreshGrace + time.Minute) }
+	if _, err := manager.VerifyForRefresh(token); !errors.Is(err, ErrExpiredToken) {
+		t.Fatalf("err = %v, want ErrExpiredToken past the grace", err)
+	}
+}
+
 func TestManagerIssuesAndVerifiesAgentToken(t *testing.T) {
 	manager := NewManager("test-secret", time.Minute)
 
@@ -100,3 +121,32 @@ func TestManagerIssuesAndVerifiesAgentToken(t *testing.T) {
 		t.Fatalf("TokenType = %q, want agent", claims.TokenType)
 	}
 }
+
+func TestManagerKeepsRegistrationTokensApart(t *testing.T) {
+	manager := NewManager("test-secret", time.Hour)
+
+	token, err := manager.IssueRegistration("device-123")
+	if err != nil {
+		t.Fatalf("IssueRegistration returned error: %v", err)
+	}
+	if _, err := manager.Verify(token); err == nil {
+		t.Fatal("Verify accepted a registration token")
+	}
+	claims, err := manager.VerifyRegistration(token)
+	if err != nil {
+		t.Fatalf("VerifyRegistration returned error: %v", err)
+	}
+	if claims.TokenType != "registration" || claims.DeviceID != "device-123" || claims.UserID != 0 {
+		t.Fatalf("claims = %+v, want a registration token of device-123", claims)
+	}
+
+	agent, _ := manager.IssueAgent(42, "device-123")
+	if _, err := manager.VerifyRegistration(agent); err == nil {
+		t.Fatal("VerifyRegistration accepted an agent token")
+	}
+
+	manager.now = func() time.Time { return time.Now().Add(RegistrationTTL + time.Minute) }
+	if _, err := manager.VerifyRegistration(token); err == nil {
+		t.Fatal("VerifyRegistration accepted an expired registration token")
+	}
+}
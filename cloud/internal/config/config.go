@@ -2,6 +2,9 @@ package config
 
 import (
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
@@ -14,6 +17,34 @@ type Config struct {
 	DBName            string
 	SupabaseAPIKey    string
 	SupabaseProjectURL string
+	ScheduleCatchUp   string // skip | latest | all, for runs missed while a device was offline
+	UploadMaxBytes    int64    // 上传到 agent 项目的单个文件大小上限
+	UploadAllowedTypes []string // 允许上传的 MIME 类型，按内容嗅探判断（纯文本按扩展名细分）
+	WSCompression     bool   // 协商 permessage-deflate
+	WSEncoding        string // cbor | json，agent 在 hello 中支持 cbor 时改用二进制帧
+	WSPingInterval    time.Duration // 服务端发 ping 的间隔
+	WSReadTimeout     time.Duration // 超过这么久没收到任何帧（含 pong）就断开连接
+	WSSlowClientTimeout time.Duration // H5 发送队列持续积压这么久就断开，重连后从最新画面开始
+	BackplaneURL      string // 多副本部署时的 hub backplane：redis://host:6379，空为单副本
+	MetricsToken      string // 设置后 /metrics 需要 Authorization: Bearer <token>
+	LogLevel          string // debug | info | warn | error
+	LogFormat         string // text | json
+	LogDebug          bool   // 日志中保留终端内容和消息体；token、密码始终脱敏
+	TraceExporter     string  // otlp | stdout | none
+	TraceEndpoint     string  // OTLP/HTTP collector，如 http://localhost:4318
+	TraceSampleRatio  float64 // 新 trace 的采样比例，0-1
+	ServiceName       string
+	AuditStoreContent bool // 审计日志保存终端输入原文，默认只存 SHA-256
+	TrustProxyHeaders bool // 在 nginx 等反向代理后面时，从 X-Real-IP / X-Forwarded-For 取客户端 IP
+	AllowedOrigins    []string // 允许调用 API 和打开 WebSocket 的浏览器 Origin，空为与 API 同主机的页面，* 为任意
+	CORSAllowCredentials bool  // 对允许的 Origin 返回 Access-Control-Allow-Credentials
+	RateLimitRequests int           // 登录、绑定接口每个 IP 每个窗口内的请求数
+	RateLimitWindow   time.Duration
+	RateLimitFailures int           // 每个账号（或绑定用户/IP）窗口内允许的失败次数
+	RateLimitFailureWindow time.Duration
+	RateLimitLockout  time.Duration // 首次锁定时长，之后每次翻倍
+	RateLimitMaxLockout time.Duration
+	BindCodeMaxAttempts int // 同一绑定码被试错这么多次后作废，agent 需重新注册
 }
 
 func Load() *Config {
@@ -27,6 +58,34 @@ func Load() *Config {
 		DBName:            getEnv("DB_NAME", "agentapi"),
 		SupabaseAPIKey:    getEnv("SUPABASE_API_KEY", ""),
 		SupabaseProjectURL: getEnv("SUPABASE_PROJECT_URL", ""),
+		ScheduleCatchUp:   getEnv("SCHEDULE_CATCH_UP", "latest"),
+		UploadMaxBytes:    getEnvInt64("UPLOAD_MAX_BYTES", 10*1024*1024),
+		WSCompression:     getEnv("WS_COMPRESSION", "true") != "false",
+		WSEncoding:        getEnv("WS_ENCODING", "cbor"),
+		WSPingInterval:    getEnvDuration("WS_PING_INTERVAL", 25*time.Second),
+		WSReadTimeout:     getEnvDuration("WS_READ_TIMEOUT", 60*time.Second),
+		WSSlowClientTimeout: getEnvDuration("WS_SLOW_CLIENT_TIMEOUT", 30*time.Second),
+		BackplaneURL:      getEnv("BACKPLANE_URL", ""),
+		MetricsToken:      getEnv("METRICS_TOKEN", ""),
+		LogLevel:          getEnv("LOG_LEVEL", "info"),
+		LogFormat:         getEnv("LOG_FORMAT", "text"),
+		LogDebug:          getEnv("LOG_DEBUG", "false") == "true",
+		TraceExporter:     getEnv("OTEL_TRACES_EXPORTER", "none"),
+		TraceEndpoint:     getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4318"),
+		TraceSampleRatio:  getEnvFloat("OTEL_TRACES_SAMPLER_ARG", 1),
+		ServiceName:       getEnv("OTEL_SERVICE_NAME", "mobilecoder-cloud"),
+		AuditStoreContent: getEnv("AUDIT_STORE_CONTENT", "false") == "true",
+		TrustProxyHeaders: getEnv("TRUST_PROXY_HEADERS", "false") == "true",
+		AllowedOrigins:    getEnvList("ALLOWED_ORIGINS", ""),
+		CORSAllowCredentials: getEnv("CORS_ALLOW_CREDENTIALS", "false") == "true",
+		RateLimitRequests: int(getEnvInt64("RATE_LIMIT_REQUESTS", 60)),
+		RateLimitWindow:   getEnvDuration("RATE_LIMIT_WINDOW", time.Minute),
+		RateLimitFailures: int(getEnvInt64("RATE_LIMIT_FAILURES", 5)),
+		RateLimitFailureWindow: getEnvDuration("RATE_LIMIT_FAILURE_WINDOW", 15*time.Minute),
+		RateLimitLockout:  getEnvDuration("RATE_LIMIT_LOCKOUT", time.Minute),
+		RateLimitMaxLockout: getEnvDuration("RATE_LIMIT_MAX_LOCKOUT", time.Hour),
+		BindCodeMaxAttempts: int(getEnvInt64("BIND_CODE_MAX_ATTEMPTS", 5)),
+		UploadAllowedTypes: getEnvList("UPLOAD_ALLOWED_TYPES", "image/png,image/jpeg,image/gif,image/webp,text/plain,application/json,application/pdf"),
 	}
 }
 
@@ -36,3 +95,36 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getEnvInt64(key string, defaultValue int64) int64 {
+	if value, err := strconv.ParseInt(os.Getenv(key), 10, 64); err == nil && value > 0 {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil && value > 0 {
+		return value
+	}
+	return defaultValue
+}
+
+// getEnvDuration reads a Go duration such as "30s".
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil && value > 0 {
+		return value
+	}
+	return defaultValue
+}
+
+// getEnvList reads a comma separated list.
+func getEnvList(key, defaultValue string) []string {
+	var values []string
+	for _, value := range strings.Split(getEnv(key, defaultValue), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
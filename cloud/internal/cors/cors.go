@@ -0,0 +1,109 @@
+// Package cors decides which browser origins may call the API and open
+// WebSockets. Requests without an Origin header (the agent, native clients,
+// curl) are not from a browser page and always pass.
+package cors
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Policy is the set of allowed origins.
+type Policy struct {
+	origins     map[string]bool
+	any         bool // "*": every origin, for development only
+	credentials bool
+}
+
+// New builds a Policy from exact origins such as https://app.example.com,
+// or "*" for any origin. With no origins, only pages served from the API's
+// own host (on any port, e.g. the H5 on :3001 next to the API on :8080) are
+// allowed. allowCredentials lets browsers send cookies and read responses
+// of credentialed requests; it is ignored with "*".
+func New(origins []string, allowCredentials bool) *Policy {
+	p := &Policy{origins: make(map[string]bool), credentials: allowCredentials}
+	for _, origin := range origins {
+		if origin == "*" {
+			p.any = true
+			continue
+		}
+		p.origins[normalize(origin)] = true
+	}
+	if p.any && p.credentials {
+		slog.Warn("cors: credentials are not allowed with the * origin, ignoring CORS_ALLOW_CREDENTIALS")
+		p.credentials = false
+	}
+	return p
+}
+
+// AllowOrigin reports whether a page at origin may use the API served at
+// host (the request's Host).
+func (p *Policy) AllowOrigin(origin, host string) bool {
+	if p.any {
+		return true
+	}
+	if len(p.origins) > 0 {
+		return p.origins[normalize(origin)]
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	return strings.EqualFold(u.Hostname(), strings.Trim(host, "[]"))
+}
+
+// CheckOrigin is the websocket.Upgrader check: cross-origin upgrades from
+// unknown sites are refused, so a page elsewhere cannot open a viewer
+// socket with a stolen token.
+func (p *Policy) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || p.AllowOrigin(origin, r.Host)
+}
+
+// Middleware answers preflight requests and adds the CORS headers for
+// allowed origins. Other origins get no CORS headers, so browsers keep the
+// response from the page; their preflights are refused with 403.
+func Middleware(p *Policy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := origin != "" && p.AllowOrigin(origin, r.Host)
+		if !p.any {
+			w.Header().Add("Vary", "Origin")
+		}
+		if allowed {
+			if p.any {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+			if p.credentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		}
+
+		if r.Method == "OPTIONS" {
+			if origin != "" && !allowed {
+				http.Error(w, "origin not allowed", http.StatusForbidden)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// normalize makes origins comparable: browsers send scheme and host in
+// lower case and never a trailing slash.
+func normalize(origin string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(origin)), "/")
+}
@@ -0,0 +1,108 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPolicyDefaultsToTheAPIsHost(t *testing.T) {
+	policy := New(nil, false)
+
+	for origin, want := range map[string]bool{
+		"http://121.41.69.142:3001": true, // H5 next to the API on another port
+		"https://121.41.69.142":     true,
+		"http://evil.example":       false,
+		"null":                      false,
+		"file://121.41.69.142":      false,
+	} {
+		if got := policy.AllowOrigin(origin, "121.41.69.142:8080"); got != want {
+			t.Errorf("AllowOrigin(%q) = %v, want %v", origin, got, want)
+		}
+	}
+}
+
+func TestPolicyAllowsOnlyListedOrigins(t *testing.T) {
+	policy := New([]string{"https://App.example.com/", "capacitor://localhost"}, true)
+
+	for origin, want := range map[string]bool{
+		"https://app.example.com":      true,
+		"capacitor://localhost":        true,
+		"http://app.example.com":       false,
+		"https://api.example.com":      false, // the API's own host is not implied
+		"https://app.example.com:8443": false,
+	} {
+		if got := policy.AllowOrigin(origin, "api.example.com"); got != want {
+			t.Errorf("AllowOrigin(%q) = %v, want %v", origin, got, want)
+		}
+	}
+}
+
+func serve(policy *Policy, method, origin string) *httptest.ResponseRecorder {
+	served := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	req := httptest.NewRequest(method, "http://api.example.com/api/devices", nil)
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	rec := httptest.NewRecorder()
+	Middleware(policy, served).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestMiddlewareReflectsAllowedOriginsWithCredentials(t *testing.T) {
+	policy := New([]string{"https://app.example.com"}, true)
+
+	rec := serve(policy, http.MethodGet, "https://app.example.com")
+	if rec.Code != http.StatusTeapot {
+		t.Fatalf("status = %d, want the handler's", rec.Code)
+	}
+	if rec.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		rec.Header().Get("Access-Control-Allow-Credentials") != "true" || rec.Header().Get("Vary") != "Origin" {
+		t.Fatalf("headers = %v", rec.Header())
+	}
+
+	rec = serve(policy, http.MethodOptions, "https://app.example.com")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("preflight status = %d, want 200", rec.Code)
+	}
+}
+
+func TestMiddlewareRefusesUnknownOrigins(t *testing.T) {
+	policy := New([]string{"https://app.example.com"}, true)
+
+	rec := serve(policy, http.MethodGet, "https://evil.example")
+	if rec.Header().Get("Access-Control-Allow-Origin") != "" || rec.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Fatalf("unknown origin got CORS headers: %v", rec.Header())
+	}
+	if rec := serve(policy, http.MethodOptions, "https://evil.example"); rec.Code != http.StatusForbidden {
+		t.Fatalf("preflight status = %d, want 403", rec.Code)
+	}
+	// No Origin: the agent or a native client
+	if rec := serve(policy, http.MethodGet, ""); rec.Code != http.StatusTeapot {
+		t.Fatalf("status without Origin = %d", rec.Code)
+	}
+}
+
+func TestWildcardNeverAllowsCredentials(t *testing.T) {
+	policy := New([]string{"*"}, true)
+
+	rec := serve(policy, http.MethodGet, "https://anywhere.example")
+	if rec.Header().Get("Access-Control-Allow-Origin") != "*" || rec.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Fatalf("headers = %v, want * without credentials", rec.Header())
+	}
+}
+
+func TestCheckOriginPassesRequestsWithoutOrigin(t *testing.T) {
+	policy := New([]string{"https://app.example.com"}, false)
+
+	req := httptest.NewRequest(http.MethodGet, "http://api.example.com/ws", nil)
+	if !policy.CheckOrigin(req) {
+		t.Fatal("request without Origin refused")
+	}
+	req.Header.Set("Origin", "https://evil.example")
+	if policy.CheckOrigin(req) {
+		t.Fatal("cross-origin upgrade from an unknown site allowed")
+	}
+}
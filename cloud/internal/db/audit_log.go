@@ -0,0 +1,108 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// AuditEntry is one row of the append-only audit log.
+type AuditEntry struct {
+	ID          int64             `json:"id"`
+	Action      string            `json:"action"`
+	Status      string            `json:"status"`
+	UserID      int64             `json:"user_id"`
+	DeviceID    string            `json:"device_id"`
+	SessionName string            `json:"session_name"`
+	SourceIP    string            `json:"source_ip"`
+	RequestID   string            `json:"request_id"`
+	ContentHash string            `json:"content_hash"`
+	Content     *string           `json:"content,omitempty"`
+	Detail      map[string]string `json:"detail"`
+	CreatedAt   string            `json:"created_at"`
+}
+
+// AuditFilter selects audit entries, newest first. Zero fields match
+// everything; BeforeID pages backwards from an entry ID.
+type AuditFilter struct {
+	UserID      int64
+	Action      string
+	DeviceID    string
+	SessionName string
+	Since       string
+	Until       string
+	BeforeID    int64
+	Limit       int
+}
+
+func (s *SupabaseDB) CreateAuditEntries(ctx context.Context, entries []AuditEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	rows := make([]map[string]interface{}, 0, len(entries))
+	for _, entry := range entries {
+		detail := entry.Detail
+		if detail == nil {
+			detail = map[string]string{}
+		}
+		row := map[string]interface{}{
+			"action":       entry.Action,
+			"status":       entry.Status,
+			"user_id":      entry.UserID,
+			"device_id":    entry.DeviceID,
+			"session_name": entry.SessionName,
+			"source_ip":    entry.SourceIP,
+			"request_id":   entry.RequestID,
+			"content_hash": entry.ContentHash,
+			"content":      entry.Content,
+			"detail":       detail,
+		}
+		if entry.CreatedAt != "" {
+			row["created_at"] = entry.CreatedAt
+		}
+		rows = append(rows, row)
+	}
+	body, _ := json.Marshal(rows)
+
+	_, err := s.do(ctx, "POST", "/audit_log", body)
+	return err
+}
+
+func (s *SupabaseDB) ListAuditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	query := []string{"order=id.desc"}
+	if filter.UserID > 0 {
+		query = append(query, fmt.Sprintf("user_id=eq.%d", filter.UserID))
+	}
+	if filter.Action != "" {
+		query = append(query, "action=eq."+url.QueryEscape(filter.Action))
+	}
+	if filter.DeviceID != "" {
+		query = append(query, "device_id=eq."+url.QueryEscape(filter.DeviceID))
+	}
+	if filter.SessionName != "" {
+		query = append(query, "session_name=eq."+url.QueryEscape(filter.SessionName))
+	}
+	if filter.Since != "" {
+		query = append(query, "created_at=gte."+url.QueryEscape(filter.Since))
+	}
+	if filter.Until != "" {
+		query = append(query, "created_at=lt."+url.QueryEscape(filter.Until))
+	}
+	if filter.BeforeID > 0 {
+		query = append(query, fmt.Sprintf("id=lt.%d", filter.BeforeID))
+	}
+	if filter.Limit > 0 {
+		query = append(query, fmt.Sprintf("limit=%d", filter.Limit))
+	}
+
+	resp, err := s.do(ctx, "GET", "/audit_log?select=*&"+strings.Join(query, "&"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []AuditEntry
+	json.Unmarshal(resp, &entries)
+	return entries, nil
+}
@@ -0,0 +1,107 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// PromptTemplate is a saved prompt with {{variable}} placeholders. Templates
+// without a team belong to their author only.
+type PromptTemplate struct {
+	ID          int64  `json:"id"`
+	UserID      int64  `json:"user_id"`
+	TeamID      *int64 `json:"team_id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Content     string `json:"content"`
+	CreatedAt   string `json:"created_at"`
+	UpdatedAt   string `json:"updated_at"`
+}
+
+type TeamMember struct {
+	TeamID int64  `json:"team_id"`
+	UserID int64  `json:"user_id"`
+	Role   string `json:"role"`
+}
+
+func (s *SupabaseDB) CreatePromptTemplate(ctx context.Context, template *PromptTemplate) (*PromptTemplate, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"user_id":     template.UserID,
+		"team_id":     template.TeamID,
+		"name":        template.Name,
+		"description": template.Description,
+		"content":     template.Content,
+	})
+
+	resp, err := s.do(ctx, "POST", "/prompt_templates", body)
+	if err != nil {
+		return nil, err
+	}
+
+	var templates []PromptTemplate
+	json.Unmarshal(resp, &templates)
+	if len(templates) == 0 {
+		return nil, fmt.Errorf("template not created")
+	}
+	return &templates[0], nil
+}
+
+func (s *SupabaseDB) GetPromptTemplate(ctx context.Context, templateID int64) (*PromptTemplate, error) {
+	resp, err := s.do(ctx, "GET", "/prompt_templates?id=eq."+fmt.Sprintf("%d", templateID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var templates []PromptTemplate
+	json.Unmarshal(resp, &templates)
+	if len(templates) == 0 {
+		return nil, nil
+	}
+	return &templates[0], nil
+}
+
+// ListPromptTemplates returns the user's personal templates and the
+// templates shared with the given teams.
+func (s *SupabaseDB) ListPromptTemplates(ctx context.Context, userID int64, teamIDs []int64) ([]PromptTemplate, error) {
+	filter := fmt.Sprintf("and(user_id.eq.%d,team_id.is.null)", userID)
+	if len(teamIDs) > 0 {
+		ids := make([]string, 0, len(teamIDs))
+		for _, id := range teamIDs {
+			ids = append(ids, fmt.Sprintf("%d", id))
+		}
+		filter += ",team_id.in.(" + strings.Join(ids, ",") + ")"
+	}
+
+	resp, err := s.do(ctx, "GET", "/prompt_templates?select=*&or=("+filter+")&order=name.asc,id.asc", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var templates []PromptTemplate
+	json.Unmarshal(resp, &templates)
+	return templates, nil
+}
+
+func (s *SupabaseDB) UpdatePromptTemplate(ctx context.Context, templateID int64, fields map[string]interface{}) error {
+	body, _ := json.Marshal(fields)
+	_, err := s.do(ctx, "PATCH", "/prompt_templates?id=eq."+fmt.Sprintf("%d", templateID), body)
+	return err
+}
+
+func (s *SupabaseDB) DeletePromptTemplate(ctx context.Context, templateID int64) error {
+	_, err := s.do(ctx, "DELETE", "/prompt_templates?id=eq."+fmt.Sprintf("%d", templateID), nil)
+	return err
+}
+
+func (s *SupabaseDB) ListTeamMembershipsByUser(ctx context.Context, userID int64) ([]TeamMember, error) {
+	resp, err := s.do(ctx, "GET", "/team_members?select=*&user_id=eq."+fmt.Sprintf("%d", userID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var members []TeamMember
+	json.Unmarshal(resp, &members)
+	return members, nil
+}
@@ -2,14 +2,20 @@ package db
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/mobile-coder/cloud/internal/metrics"
+	"github.com/mobile-coder/tracing"
 )
 
 type Config struct {
@@ -53,39 +59,86 @@ func NewSupabaseDB(cfg *Config) *SupabaseDB {
 	}
 }
 
-func (s *SupabaseDB) do(method, endpoint string, body []byte) ([]byte, error) {
+func (s *SupabaseDB) do(ctx context.Context, method, endpoint string, body []byte) ([]byte, error) {
+	respBody, _, err := s.instrumented(ctx, method, endpoint, body, "return=representation")
+	return respBody, err
+}
+
+// count returns how many rows a select endpoint matches without fetching
+// them, from the Content-Range PostgREST sends for "Prefer: count=exact".
+func (s *SupabaseDB) count(ctx context.Context, endpoint string) (int, error) {
+	_, header, err := s.instrumented(ctx, http.MethodHead, endpoint, nil, "count=exact")
+	if err != nil {
+		return 0, err
+	}
+	// Content-Range: 0-24/3573, or */0 when nothing matches
+	contentRange := header.Get("Content-Range")
+	_, total, ok := strings.Cut(contentRange, "/")
+	n, err := strconv.Atoi(total)
+	if !ok || err != nil {
+		return 0, fmt.Errorf("unexpected Content-Range %q", contentRange)
+	}
+	return n, nil
+}
+
+// instrumented times a store call and records it as a span of the caller's
+// trace.
+func (s *SupabaseDB) instrumented(ctx context.Context, method, endpoint string, body []byte, prefer string) ([]byte, http.Header, error) {
+	table := storeTable(endpoint)
+	ctx, span := tracing.Start(ctx, "store "+method+" "+table, "db.system", "supabase", "db.operation", method, "db.table", table)
+	defer span.End()
+	start := time.Now()
+	respBody, header, err := s.request(ctx, method, endpoint, body, prefer)
+	metrics.StoreRequestDuration.With(method, table).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.StoreErrors.With(method, table).Inc()
+		span.RecordError(err)
+	}
+	return respBody, header, err
+}
+
+// storeTable is the table (or rpc) an endpoint addresses, for metrics.
+func storeTable(endpoint string) string {
+	table := strings.TrimPrefix(endpoint, "/")
+	if i := strings.IndexByte(table, '?'); i >= 0 {
+		table = table[:i]
+	}
+	return table
+}
+
+func (s *SupabaseDB) request(ctx context.Context, method, endpoint string, body []byte, prefer string) ([]byte, http.Header, error) {
 	url := s.baseURL + endpoint
-	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	req.Header.Set("apikey", s.apiKey)
 	req.Header.Set("Authorization", "Bearer "+s.apiKey)
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Prefer", "return=representation")
+	req.Header.Set("Prefer", prefer)
 
 	resp, err := s.client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
 
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if resp.StatusCode >= 400 {
-		return nil, fmt.Errorf("API error: %s %s", resp.Status, string(respBody))
+		return nil, nil, fmt.Errorf("API error: %s %s", resp.Status, string(respBody))
 	}
 
 	// Handle empty responses
 	if len(respBody) == 0 {
-		return []byte("[]"), nil
+		return []byte("[]"), resp.Header, nil
 	}
 
-	return respBody, nil
+	return respBody, resp.Header, nil
 }
 
 // User operations
@@ -94,25 +147,25 @@ type User struct {
 	Username  string `json:"username"`
 	Password  string `json:"password"`
 	Email     string `json:"email"`
+	Role      string `json:"role"`
 	CreatedAt string `json:"created_at"`
 	UpdatedAt string `json:"updated_at"`
 }
 
-func (s *SupabaseDB) CreateUser(username, password, email string) (*User, error) {
+func (s *SupabaseDB) CreateUser(ctx context.Context, username, password, email string) (*User, error) {
 	body, _ := json.Marshal(map[string]string{
 		"username": username,
 		"password": password,
 		"email":    email,
 	})
 
-	log.Printf("Creating user: %s", username)
-	resp, err := s.do("POST", "/users", body)
+	slog.Debug("supabase create user", "username", username)
+	resp, err := s.do(ctx, "POST", "/users", body)
 	if err != nil {
-		log.Printf("CreateUser error: %v", err)
+		slog.Warn("supabase create user failed", "username", username, "error", err)
 		return nil, err
 	}
-
-	log.Printf("CreateUser response: %s", string(resp))
+	slog.Debug("supabase create user response", "response", resp)
 	// Supabase returns an array
 	var users []User
 	json.Unmarshal(resp, &users)
@@ -122,14 +175,13 @@ func (s *SupabaseDB) CreateUser(username, password, email string) (*User, error)
 	return &users[0], nil
 }
 
-func (s *SupabaseDB) GetUserByUsername(username string) (*User, error) {
-	log.Printf("GetUserByUsername: %s", username)
-	resp, err := s.do("GET", "/users?username=eq."+username, nil)
+func (s *SupabaseDB) GetUserByUsername(ctx context.Context, username string) (*User, error) {
+	resp, err := s.do(ctx, "GET", "/users?username=eq."+username, nil)
 	if err != nil {
-		log.Printf("GetUserByUsername error: %v", err)
+		slog.Warn("supabase get user by username failed", "username", username, "error", err)
 		return nil, err
 	}
-	log.Printf("GetUserByUsername response: %s", string(resp))
+	slog.Debug("supabase get user by username", "username", username, "response", resp)
 
 	var users []User
 	json.Unmarshal(resp, &users)
@@ -139,14 +191,13 @@ func (s *SupabaseDB) GetUserByUsername(username string) (*User, error) {
 	return &users[0], nil
 }
 
-func (s *SupabaseDB) GetUserByEmail(email string) (*User, error) {
-	log.Printf("GetUserByEmail: %s", email)
-	resp, err := s.do("GET", "/users?email=eq."+email, nil)
+func (s *SupabaseDB) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	resp, err := s.do(ctx, "GET", "/users?email=eq."+url.QueryEscape(email), nil)
 	if err != nil {
-		log.Printf("GetUserByEmail error: %v", err)
+		slog.Warn("supabase get user by email failed", "error", err)
 		return nil, err
 	}
-	log.Printf("GetUserByEmail response: %s", string(resp))
+	slog.Debug("supabase get user by email", "response", resp)
 
 	var users []User
 	json.Unmarshal(resp, &users)
@@ -156,6 +207,20 @@ func (s *SupabaseDB) GetUserByEmail(email string) (*User, error) {
 	return &users[0], nil
 }
 
+func (s *SupabaseDB) GetUserByID(ctx context.Context, userID int64) (*User, error) {
+	resp, err := s.do(ctx, "GET", fmt.Sprintf("/users?id=eq.%d", userID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []User
+	json.Unmarshal(resp, &users)
+	if len(users) == 0 {
+		return nil, nil
+	}
+	return &users[0], nil
+}
+
 // Device operations
 type Device struct {
 	ID           int64  `json:"id"`
@@ -194,7 +259,7 @@ type Notification struct {
 	CreatedAt   string `json:"created_at"`
 }
 
-func (s *SupabaseDB) CreateSession(deviceID, sessionName, projectPath string) (*Session, error) {
+func (s *SupabaseDB) CreateSession(ctx context.Context, deviceID, sessionName, projectPath string) (*Session, error) {
 	body, _ := json.Marshal(map[string]interface{}{
 		"device_id":    deviceID,
 		"session_name": sessionName,
@@ -202,7 +267,7 @@ func (s *SupabaseDB) CreateSession(deviceID, sessionName, projectPath string) (*
 		"status":       "active",
 	})
 
-	resp, err := s.do("POST", "/sessions", body)
+	resp, err := s.do(ctx, "POST", "/sessions", body)
 	if err != nil {
 		return nil, err
 	}
@@ -216,25 +281,40 @@ func (s *SupabaseDB) CreateSession(deviceID, sessionName, projectPath string) (*
 }
 
 // UpdateSessionStatus updates session status by device_id and session_name
-func (s *SupabaseDB) UpdateSessionStatus(deviceID, sessionName, status string) error {
+func (s *SupabaseDB) UpdateSessionStatus(ctx context.Context, deviceID, sessionName, status string) error {
 	body, _ := json.Marshal(map[string]string{
 		"status": status,
 	})
 	encodedSessionName := url.QueryEscape(sessionName)
-	_, err := s.do("PATCH", "/sessions?device_id=eq."+deviceID+"&session_name=eq."+encodedSessionName, body)
+	_, err := s.do(ctx, "PATCH", "/sessions?device_id=eq."+deviceID+"&session_name=eq."+encodedSessionName, body)
 	return err
 }
 
 // DeleteSession deletes a session by ID
-func (s *SupabaseDB) DeleteSession(sessionID int64) error {
-	_, err := s.do("DELETE", "/sessions?id=eq."+fmt.Sprintf("%d", sessionID), nil)
+func (s *SupabaseDB) DeleteSession(ctx context.Context, sessionID int64) error {
+	_, err := s.do(ctx, "DELETE", "/sessions?id=eq."+fmt.Sprintf("%d", sessionID), nil)
 	return err
 }
 
+// GetSessionByID finds a session by id, nil if there is none
+func (s *SupabaseDB) GetSessionByID(ctx context.Context, sessionID int64) (*Session, error) {
+	resp, err := s.do(ctx, "GET", "/sessions?id=eq."+fmt.Sprintf("%d", sessionID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []Session
+	json.Unmarshal(resp, &sessions)
+	if len(sessions) == 0 {
+		return nil, nil
+	}
+	return &sessions[0], nil
+}
+
 // GetSessionByName finds an existing session by device_id and session_name
-func (s *SupabaseDB) GetSessionByName(deviceID, sessionName string) (*Session, error) {
+func (s *SupabaseDB) GetSessionByName(ctx context.Context, deviceID, sessionName string) (*Session, error) {
 	encodedSessionName := url.QueryEscape(sessionName)
-	resp, err := s.do("GET", "/sessions?device_id=eq."+deviceID+"&session_name=eq."+encodedSessionName, nil)
+	resp, err := s.do(ctx, "GET", "/sessions?device_id=eq."+deviceID+"&session_name=eq."+encodedSessionName, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -248,8 +328,8 @@ func (s *SupabaseDB) GetSessionByName(deviceID, sessionName string) (*Session, e
 }
 
 // GetActiveSession finds the active session for a device
-func (s *SupabaseDB) GetActiveSession(deviceID string) (*Session, error) {
-	resp, err := s.do("GET", "/sessions?device_id=eq."+deviceID+"&status=eq.active", nil)
+func (s *SupabaseDB) GetActiveSession(ctx context.Context, deviceID string) (*Session, error) {
+	resp, err := s.do(ctx, "GET", "/sessions?device_id=eq."+deviceID+"&status=eq.active", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -263,9 +343,9 @@ func (s *SupabaseDB) GetActiveSession(deviceID string) (*Session, error) {
 }
 
 // CreateOrUpdateSession creates a new session or updates existing one
-func (s *SupabaseDB) CreateOrUpdateSession(deviceID, sessionName, projectPath string) (*Session, error) {
+func (s *SupabaseDB) CreateOrUpdateSession(ctx context.Context, deviceID, sessionName, projectPath string) (*Session, error) {
 	// First try to find existing session
-	existing, err := s.GetSessionByName(deviceID, sessionName)
+	existing, err := s.GetSessionByName(ctx, deviceID, sessionName)
 	if err != nil {
 		return nil, err
 	}
@@ -276,7 +356,7 @@ func (s *SupabaseDB) CreateOrUpdateSession(deviceID, sessionName, projectPath st
 			"status":       "active",
 			"project_path": projectPath,
 		})
-		_, err := s.do("PATCH", "/sessions?id=eq."+fmt.Sprintf("%d", existing.ID), body)
+		_, err := s.do(ctx, "PATCH", "/sessions?id=eq."+fmt.Sprintf("%d", existing.ID), body)
 		if err != nil {
 			return nil, err
 		}
@@ -286,11 +366,11 @@ func (s *SupabaseDB) CreateOrUpdateSession(deviceID, sessionName, projectPath st
 	}
 
 	// Create new session
-	return s.CreateSession(deviceID, sessionName, projectPath)
+	return s.CreateSession(ctx, deviceID, sessionName, projectPath)
 }
 
-func (s *SupabaseDB) GetSessionsByDevice(deviceID string) ([]Session, error) {
-	resp, err := s.do("GET", "/sessions?device_id=eq."+deviceID, nil)
+func (s *SupabaseDB) GetSessionsByDevice(ctx context.Context, deviceID string) ([]Session, error) {
+	resp, err := s.do(ctx, "GET", "/sessions?device_id=eq."+deviceID, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -300,9 +380,9 @@ func (s *SupabaseDB) GetSessionsByDevice(deviceID string) ([]Session, error) {
 	return sessions, nil
 }
 
-func (s *SupabaseDB) CreateDevice(userID int64, deviceID, deviceName, bindCode string, bindCodeExp string) (*Device, error) {
-	log.Printf("CreateDevice: userID=%d, deviceID=%s, deviceName=%s, bindCode=%s, bindCodeExp=%s",
-		userID, deviceID, deviceName, bindCode, bindCodeExp)
+func (s *SupabaseDB) CreateDevice(ctx context.Context, userID int64, deviceID, deviceName, bindCode string, bindCodeExp string) (*Device, error) {
+	slog.Debug("supabase create device", "user_id", userID, "device_id", deviceID, "device_name", deviceName,
+		"bind_code", bindCode, "bind_code_exp", bindCodeExp)
 
 	// If userID is 0, use null (device not yet bound to user)
 	var userIDPtr *int64
@@ -319,12 +399,12 @@ func (s *SupabaseDB) CreateDevice(userID int64, deviceID, deviceName, bindCode s
 		"status":        "offline",
 	})
 
-	resp, err := s.do("POST", "/devices", body)
+	resp, err := s.do(ctx, "POST", "/devices", body)
 	if err != nil {
-		log.Printf("CreateDevice error: %v", err)
+		slog.Warn("supabase create device failed", "device_id", deviceID, "error", err)
 		return nil, err
 	}
-	log.Printf("CreateDevice response: %s", string(resp))
+	slog.Debug("supabase create device response", "response", resp)
 
 	// Supabase returns an array
 	var devices []Device
@@ -335,26 +415,24 @@ func (s *SupabaseDB) CreateDevice(userID int64, deviceID, deviceName, bindCode s
 	return &devices[0], nil
 }
 
-func (s *SupabaseDB) GetDeviceByBindCode(bindCode string) (*Device, error) {
-	log.Printf("GetDeviceByBindCode: %s", bindCode)
-	resp, err := s.do("GET", "/devices?bind_code=eq."+bindCode, nil)
+func (s *SupabaseDB) GetDeviceByBindCode(ctx context.Context, bindCode string) (*Device, error) {
+	resp, err := s.do(ctx, "GET", "/devices?bind_code=eq."+url.QueryEscape(bindCode), nil)
 	if err != nil {
-		log.Printf("GetDeviceByBindCode error: %v", err)
+		slog.Warn("supabase get device by bind code failed", "error", err)
 		return nil, err
 	}
-	log.Printf("GetDeviceByBindCode response: %s", string(resp))
+	slog.Debug("supabase get device by bind code", "response", resp)
 
 	var devices []Device
 	json.Unmarshal(resp, &devices)
 	if len(devices) == 0 {
 		return nil, fmt.Errorf("device not found")
 	}
-	log.Printf("Found device: %+v", devices[0])
 	return &devices[0], nil
 }
 
-func (s *SupabaseDB) GetDeviceByDeviceID(deviceID string) (*Device, error) {
-	resp, err := s.do("GET", "/devices?device_id=eq."+deviceID, nil)
+func (s *SupabaseDB) GetDeviceByDeviceID(ctx context.Context, deviceID string) (*Device, error) {
+	resp, err := s.do(ctx, "GET", "/devices?device_id=eq."+deviceID, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -367,7 +445,7 @@ func (s *SupabaseDB) GetDeviceByDeviceID(deviceID string) (*Device, error) {
 	return &devices[0], nil
 }
 
-func (s *SupabaseDB) UpdateDeviceBindCode(deviceID string) error {
+func (s *SupabaseDB) UpdateDeviceBindCode(ctx context.Context, deviceID string) error {
 	// Clear bind code after successful binding
 	body, _ := json.Marshal(map[string]interface{}{
 		"bind_code":     nil,
@@ -375,21 +453,32 @@ func (s *SupabaseDB) UpdateDeviceBindCode(deviceID string) error {
 		"status":        "online",
 	})
 
-	_, err := s.do("PATCH", "/devices?device_id=eq."+deviceID, body)
+	_, err := s.do(ctx, "PATCH", "/devices?device_id=eq."+deviceID, body)
 	return err
 }
 
-func (s *SupabaseDB) BindDeviceToUser(deviceID string, userID int64) error {
+// ClearDeviceBindCode invalidates a device's bind code without marking
+// the device online.
+func (s *SupabaseDB) ClearDeviceBindCode(ctx context.Context, deviceID string) error {
+	body, _ := json.Marshal(map[string]interface{}{
+		"bind_code":     nil,
+		"bind_code_exp": nil,
+	})
+	_, err := s.do(ctx, "PATCH", "/devices?device_id=eq."+deviceID, body)
+	return err
+}
+
+func (s *SupabaseDB) BindDeviceToUser(ctx context.Context, deviceID string, userID int64) error {
 	body, _ := json.Marshal(map[string]interface{}{
 		"user_id": userID,
 		"status":  "online",
 	})
-	_, err := s.do("PATCH", "/devices?device_id=eq."+deviceID, body)
+	_, err := s.do(ctx, "PATCH", "/devices?device_id=eq."+deviceID, body)
 	return err
 }
 
-func (s *SupabaseDB) GetUserDevices(userID int64) ([]Device, error) {
-	resp, err := s.do("GET", "/devices?user_id=eq."+fmt.Sprintf("%d", userID), nil)
+func (s *SupabaseDB) GetUserDevices(ctx context.Context, userID int64) ([]Device, error) {
+	resp, err := s.do(ctx, "GET", "/devices?user_id=eq."+fmt.Sprintf("%d", userID), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -400,8 +489,8 @@ func (s *SupabaseDB) GetUserDevices(userID int64) ([]Device, error) {
 }
 
 // ListAllDevices returns all devices (simplified - no user filter)
-func (s *SupabaseDB) ListAllDevices() ([]Device, error) {
-	resp, err := s.do("GET", "/devices?select=*&order=created_at.desc", nil)
+func (s *SupabaseDB) ListAllDevices(ctx context.Context) ([]Device, error) {
+	resp, err := s.do(ctx, "GET", "/devices?select=*&order=created_at.desc", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -412,7 +501,7 @@ func (s *SupabaseDB) ListAllDevices() ([]Device, error) {
 }
 
 // Notification operations
-func (s *SupabaseDB) CreateNotification(notification *Notification) (*Notification, error) {
+func (s *SupabaseDB) CreateNotification(ctx context.Context, notification *Notification) (*Notification, error) {
 	body, _ := json.Marshal(map[string]interface{}{
 		"user_id":      notification.UserID,
 		"task_id":      notification.TaskID,
@@ -424,7 +513,7 @@ func (s *SupabaseDB) CreateNotification(notification *Notification) (*Notificati
 		"dedupe_key":   notification.DedupeKey,
 	})
 
-	resp, err := s.do("POST", "/notifications", body)
+	resp, err := s.do(ctx, "POST", "/notifications", body)
 	if err != nil {
 		return nil, err
 	}
@@ -437,7 +526,7 @@ func (s *SupabaseDB) CreateNotification(notification *Notification) (*Notificati
 	return &notifications[0], nil
 }
 
-func (s *SupabaseDB) ListNotificationsByUser(userID int64, limit int, since string, unreadOnly bool) ([]Notification, error) {
+func (s *SupabaseDB) ListNotificationsByUser(ctx context.Context, userID int64, limit int, since string, unreadOnly bool) ([]Notification, error) {
 	query := []string{
 		"user_id=eq." + fmt.Sprintf("%d", userID),
 		"order=created_at.desc",
@@ -452,7 +541,7 @@ func (s *SupabaseDB) ListNotificationsByUser(userID int64, limit int, since stri
 		query = append(query, "read_at=is.null")
 	}
 
-	resp, err := s.do("GET", "/notifications?select=*&"+strings.Join(query, "&"), nil)
+	resp, err := s.do(ctx, "GET", "/notifications?select=*&"+strings.Join(query, "&"), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -462,8 +551,8 @@ func (s *SupabaseDB) ListNotificationsByUser(userID int64, limit int, since stri
 	return notifications, nil
 }
 
-func (s *SupabaseDB) GetNotificationByID(notificationID int64) (*Notification, error) {
-	resp, err := s.do("GET", "/notifications?id=eq."+fmt.Sprintf("%d", notificationID), nil)
+func (s *SupabaseDB) GetNotificationByID(ctx context.Context, notificationID int64) (*Notification, error) {
+	resp, err := s.do(ctx, "GET", "/notifications?id=eq."+fmt.Sprintf("%d", notificationID), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -476,8 +565,8 @@ func (s *SupabaseDB) GetNotificationByID(notificationID int64) (*Notification, e
 	return &notifications[0], nil
 }
 
-func (s *SupabaseDB) GetLatestNotificationByDedupeKey(userID int64, dedupeKey string) (*Notification, error) {
-	resp, err := s.do("GET", "/notifications?user_id=eq."+fmt.Sprintf("%d", userID)+"&dedupe_key=eq."+url.QueryEscape(dedupeKey)+"&order=created_at.desc&limit=1", nil)
+func (s *SupabaseDB) GetLatestNotificationByDedupeKey(ctx context.Context, userID int64, dedupeKey string) (*Notification, error) {
+	resp, err := s.do(ctx, "GET", "/notifications?user_id=eq."+fmt.Sprintf("%d", userID)+"&dedupe_key=eq."+url.QueryEscape(dedupeKey)+"&order=created_at.desc&limit=1", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -490,28 +579,28 @@ func (s *SupabaseDB) GetLatestNotificationByDedupeKey(userID int64, dedupeKey st
 	return &notifications[0], nil
 }
 
-func (s *SupabaseDB) MarkNotificationRead(notificationID int64, readAt string) error {
+func (s *SupabaseDB) MarkNotificationRead(ctx context.Context, notificationID int64, readAt string) error {
 	body, _ := json.Marshal(map[string]interface{}{
 		"read_at": readAt,
 	})
-	_, err := s.do("PATCH", "/notifications?id=eq."+fmt.Sprintf("%d", notificationID), body)
+	_, err := s.do(ctx, "PATCH", "/notifications?id=eq."+fmt.Sprintf("%d", notificationID), body)
 	return err
 }
 
-func (s *SupabaseDB) MarkAllNotificationsRead(userID int64, readAt string) error {
+func (s *SupabaseDB) MarkAllNotificationsRead(ctx context.Context, userID int64, readAt string) error {
 	body, _ := json.Marshal(map[string]interface{}{
 		"read_at": readAt,
 	})
-	_, err := s.do("PATCH", "/notifications?user_id=eq."+fmt.Sprintf("%d", userID)+"&read_at=is.null", body)
+	_, err := s.do(ctx, "PATCH", "/notifications?user_id=eq."+fmt.Sprintf("%d", userID)+"&read_at=is.null", body)
 	return err
 }
 
-func (s *SupabaseDB) DeleteNotificationsBefore(userID int64, cutoff string) error {
-	_, err := s.do("DELETE", "/notifications?user_id=eq."+fmt.Sprintf("%d", userID)+"&created_at=lt."+url.QueryEscape(cutoff), nil)
+func (s *SupabaseDB) DeleteNotificationsBefore(ctx context.Context, userID int64, cutoff string) error {
+	_, err := s.do(ctx, "DELETE", "/notifications?user_id=eq."+fmt.Sprintf("%d", userID)+"&created_at=lt."+url.QueryEscape(cutoff), nil)
 	return err
 }
 
-func (s *SupabaseDB) DeleteNotificationsByIDs(userID int64, notificationIDs []int64) error {
+func (s *SupabaseDB) DeleteNotificationsByIDs(ctx context.Context, userID int64, notificationIDs []int64) error {
 	if len(notificationIDs) == 0 {
 		return nil
 	}
@@ -522,23 +611,34 @@ func (s *SupabaseDB) DeleteNotificationsByIDs(userID int64, notificationIDs []in
 	}
 
 	endpoint := "/notifications?user_id=eq." + fmt.Sprintf("%d", userID) + "&id=in.(" + strings.Join(ids, ",") + ")"
-	_, err := s.do("DELETE", endpoint, nil)
+	_, err := s.do(ctx, "DELETE", endpoint, nil)
 	return err
 }
 
 // UpdateDeviceName updates the device name
-func (s *SupabaseDB) UpdateDeviceName(deviceID, deviceName string) error {
+func (s *SupabaseDB) UpdateDeviceName(ctx context.Context, deviceID, deviceName string) error {
 	data := map[string]string{
 		"device_name": deviceName,
 	}
 	body, _ := json.Marshal(data)
-	_, err := s.do("PATCH", "/devices?device_id=eq."+deviceID, body)
+	_, err := s.do(ctx, "PATCH", "/devices?device_id=eq."+deviceID, body)
+	return err
+}
+
+// UpdateDeviceStatus records whether the device's agent is connected and
+// when it was last seen.
+func (s *SupabaseDB) UpdateDeviceStatus(ctx context.Context, deviceID, status, lastActiveAt string) error {
+	body, _ := json.Marshal(map[string]string{
+		"status":         status,
+		"last_active_at": lastActiveAt,
+	})
+	_, err := s.do(ctx, "PATCH", "/devices?device_id=eq."+deviceID, body)
 	return err
 }
 
 // DeleteDevice deletes a device by device_id
-func (s *SupabaseDB) DeleteDevice(deviceID string) error {
-	_, err := s.do("DELETE", "/devices?device_id=eq."+deviceID, nil)
+func (s *SupabaseDB) DeleteDevice(ctx context.Context, deviceID string) error {
+	_, err := s.do(ctx, "DELETE", "/devices?device_id=eq."+deviceID, nil)
 	return err
 }
 
@@ -547,11 +647,11 @@ func InitDB(cfg *Config) (*SupabaseDB, error) {
 	db := NewSupabaseDB(cfg)
 
 	// Test connection
-	_, err := db.do("GET", "/users?limit=1", nil)
+	_, err := db.do(context.Background(), "GET", "/users?limit=1", nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to Supabase: %w", err)
 	}
 
-	log.Println("Connected to Supabase via REST API")
+	slog.Info("connected to Supabase via REST API")
 	return db, nil
 }
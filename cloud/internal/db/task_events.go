@@ -0,0 +1,116 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// TaskEvent is a persisted entry of a task timeline.
+type TaskEvent struct {
+	ID          int64  `json:"id"`
+	TaskID      string `json:"task_id"`
+	DeviceID    string `json:"device_id"`
+	SessionName string `json:"session_name"`
+	Kind        string `json:"kind"`
+	Summary     string `json:"summary"`
+	CreatedAt   string `json:"created_at"`
+}
+
+func (s *SupabaseDB) CreateTaskEvent(ctx context.Context, event *TaskEvent) (*TaskEvent, error) {
+	payload := map[string]interface{}{
+		"task_id":      event.TaskID,
+		"device_id":    event.DeviceID,
+		"session_name": event.SessionName,
+		"kind":         event.Kind,
+		"summary":      event.Summary,
+	}
+	if event.CreatedAt != "" {
+		payload["created_at"] = event.CreatedAt
+	}
+	body, _ := json.Marshal(payload)
+
+	resp, err := s.do(ctx, "POST", "/task_events", body)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []TaskEvent
+	json.Unmarshal(resp, &events)
+	if len(events) == 0 {
+		return nil, fmt.Errorf("task event not created")
+	}
+	return &events[0], nil
+}
+
+// ListTaskEvents returns events of a task, newest first. before and
+// beforeID are a keyset cursor: events older than before, or as old with an
+// id below beforeID, so events sharing a timestamp are not skipped. A zero
+// beforeID compares on created_at alone; offset skips the newest rows.
+func (s *SupabaseDB) ListTaskEvents(ctx context.Context, taskID string, before string, beforeID int64, limit, offset int) ([]TaskEvent, error) {
+	query := []string{
+		"task_id=eq." + url.QueryEscape(taskID),
+		"order=created_at.desc,id.desc",
+	}
+	switch {
+	case before != "" && beforeID > 0:
+		cursor := fmt.Sprintf(`(created_at.lt."%s",and(created_at.eq."%s",id.lt.%d))`, before, before, beforeID)
+		query = append(query, "or="+url.QueryEscape(cursor))
+	case before != "":
+		query = append(query, "created_at=lt."+url.QueryEscape(before))
+	}
+	if limit > 0 {
+		query = append(query, fmt.Sprintf("limit=%d", limit))
+	}
+	if offset > 0 {
+		query = append(query, fmt.Sprintf("offset=%d", offset))
+	}
+
+	resp, err := s.do(ctx, "GET", "/task_events?select=*&"+strings.Join(query, "&"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []TaskEvent
+	json.Unmarshal(resp, &events)
+	return events, nil
+}
+
+// ListRecentTaskEvents returns up to perTask newest events of each task in
+// one call (see sql/2026-04-21_recent_task_events.sql).
+func (s *SupabaseDB) ListRecentTaskEvents(ctx context.Context, taskIDs []string, perTask int) ([]TaskEvent, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"task_ids": taskIDs,
+		"per_task": perTask,
+	})
+	resp, err := s.do(ctx, "POST", "/rpc/recent_task_events", body)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []TaskEvent
+	json.Unmarshal(resp, &events)
+	return events, nil
+}
+
+func (s *SupabaseDB) DeleteTaskEventsBefore(ctx context.Context, taskID string, cutoff string) error {
+	_, err := s.do(ctx, "DELETE", "/task_events?task_id=eq."+url.QueryEscape(taskID)+"&created_at=lt."+url.QueryEscape(cutoff), nil)
+	return err
+}
+
+func (s *SupabaseDB) DeleteTaskEventsByIDs(ctx context.Context, taskID string, eventIDs []int64) error {
+	if len(eventIDs) == 0 {
+		return nil
+	}
+
+	ids := make([]string, 0, len(eventIDs))
+	for _, id := range eventIDs {
+		ids = append(ids, fmt.Sprintf("%d", id))
+	}
+
+	endpoint := "/task_events?task_id=eq." + url.QueryEscape(taskID) + "&id=in.(" + strings.Join(ids, ",") + ")"
+	_, err := s.do(ctx, "DELETE", endpoint, nil)
+	return err
+}
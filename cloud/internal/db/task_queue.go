@@ -0,0 +1,139 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// TaskQueueItem is a prompt waiting to be dispatched to a session.
+type TaskQueueItem struct {
+	ID           int64  `json:"id"`
+	UserID       int64  `json:"user_id"`
+	DeviceID     string `json:"device_id"`
+	SessionName  string `json:"session_name"`
+	Title        string `json:"title"`
+	Prompt       string `json:"prompt"`
+	Position     int    `json:"position"`
+	Status       string `json:"status"`
+	TaskID       string `json:"task_id"`
+	CreatedAt    string `json:"created_at"`
+	DispatchedAt string `json:"dispatched_at"`
+	FinishedAt   string `json:"finished_at"`
+}
+
+// TaskQueue holds the pause state of a session's queue.
+type TaskQueue struct {
+	DeviceID    string `json:"device_id"`
+	SessionName string `json:"session_name"`
+	Paused      bool   `json:"paused"`
+	PauseReason string `json:"pause_reason"`
+	UpdatedAt   string `json:"updated_at"`
+}
+
+func (s *SupabaseDB) CreateTaskQueueItem(ctx context.Context, item *TaskQueueItem) (*TaskQueueItem, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"user_id":      item.UserID,
+		"device_id":    item.DeviceID,
+		"session_name": item.SessionName,
+		"title":        item.Title,
+		"prompt":       item.Prompt,
+		"position":     item.Position,
+		"status":       item.Status,
+	})
+
+	resp, err := s.do(ctx, "POST", "/task_queue_items", body)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []TaskQueueItem
+	json.Unmarshal(resp, &items)
+	if len(items) == 0 {
+		return nil, fmt.Errorf("queue item not created")
+	}
+	return &items[0], nil
+}
+
+func (s *SupabaseDB) GetTaskQueueItem(ctx context.Context, itemID int64) (*TaskQueueItem, error) {
+	resp, err := s.do(ctx, "GET", "/task_queue_items?id=eq."+fmt.Sprintf("%d", itemID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []TaskQueueItem
+	json.Unmarshal(resp, &items)
+	if len(items) == 0 {
+		return nil, nil
+	}
+	return &items[0], nil
+}
+
+// ListTaskQueueItems returns the items of a session queue in dispatch order,
+// optionally filtered by status.
+func (s *SupabaseDB) ListTaskQueueItems(ctx context.Context, deviceID, sessionName string, statuses []string) ([]TaskQueueItem, error) {
+	query := []string{
+		"device_id=eq." + deviceID,
+		"session_name=eq." + url.QueryEscape(sessionName),
+		"order=position.asc,id.asc",
+	}
+	if len(statuses) > 0 {
+		query = append(query, "status=in.("+strings.Join(statuses, ",")+")")
+	}
+
+	resp, err := s.do(ctx, "GET", "/task_queue_items?select=*&"+strings.Join(query, "&"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []TaskQueueItem
+	json.Unmarshal(resp, &items)
+	return items, nil
+}
+
+func (s *SupabaseDB) UpdateTaskQueueItem(ctx context.Context, itemID int64, fields map[string]interface{}) error {
+	body, _ := json.Marshal(fields)
+	_, err := s.do(ctx, "PATCH", "/task_queue_items?id=eq."+fmt.Sprintf("%d", itemID), body)
+	return err
+}
+
+func (s *SupabaseDB) GetTaskQueue(ctx context.Context, deviceID, sessionName string) (*TaskQueue, error) {
+	resp, err := s.do(ctx, "GET", "/task_queues?device_id=eq."+deviceID+"&session_name=eq."+url.QueryEscape(sessionName), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var queues []TaskQueue
+	json.Unmarshal(resp, &queues)
+	if len(queues) == 0 {
+		return nil, nil
+	}
+	return &queues[0], nil
+}
+
+// SaveTaskQueue creates or updates the pause state of a session queue.
+func (s *SupabaseDB) SaveTaskQueue(ctx context.Context, queue *TaskQueue) error {
+	existing, err := s.GetTaskQueue(ctx, queue.DeviceID, queue.SessionName)
+	if err != nil {
+		return err
+	}
+
+	fields := map[string]interface{}{
+		"paused":       queue.Paused,
+		"pause_reason": queue.PauseReason,
+		"updated_at":   queue.UpdatedAt,
+	}
+	if existing != nil {
+		body, _ := json.Marshal(fields)
+		_, err := s.do(ctx, "PATCH", "/task_queues?device_id=eq."+queue.DeviceID+"&session_name=eq."+url.QueryEscape(queue.SessionName), body)
+		return err
+	}
+
+	fields["device_id"] = queue.DeviceID
+	fields["session_name"] = queue.SessionName
+	body, _ := json.Marshal(fields)
+	_, err = s.do(ctx, "POST", "/task_queues", body)
+	return err
+}
@@ -0,0 +1,189 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+// TaskSchedule starts a new agent session on a device from a cron expression.
+type TaskSchedule struct {
+	ID          int64  `json:"id"`
+	UserID      int64  `json:"user_id"`
+	DeviceID    string `json:"device_id"`
+	Name        string `json:"name"`
+	CronExpr    string `json:"cron_expr"`
+	Timezone    string `json:"timezone"`
+	Tool        string `json:"tool"`
+	ProjectPath string `json:"project_path"`
+	Prompt      string `json:"prompt"`
+	CatchUp     string `json:"catch_up"`
+	Enabled     bool   `json:"enabled"`
+	NextRunAt   string `json:"next_run_at"`
+	LastRunAt   string `json:"last_run_at"`
+	CreatedAt   string `json:"created_at"`
+	UpdatedAt   string `json:"updated_at"`
+}
+
+// TaskScheduleRun records one occurrence of a schedule.
+type TaskScheduleRun struct {
+	ID           int64  `json:"id"`
+	ScheduleID   int64  `json:"schedule_id"`
+	UserID       int64  `json:"user_id"`
+	DeviceID     string `json:"device_id"`
+	SessionName  string `json:"session_name"`
+	TaskID       string `json:"task_id"`
+	ScheduledFor string `json:"scheduled_for"`
+	Status       string `json:"status"`
+	Error        string `json:"error"`
+	CreatedAt    string `json:"created_at"`
+	FinishedAt   string `json:"finished_at"`
+}
+
+func (s *SupabaseDB) CreateTaskSchedule(ctx context.Context, schedule *TaskSchedule) (*TaskSchedule, error) {
+	fields := map[string]interface{}{
+		"user_id":      schedule.UserID,
+		"device_id":    schedule.DeviceID,
+		"name":         schedule.Name,
+		"cron_expr":    schedule.CronExpr,
+		"timezone":     schedule.Timezone,
+		"tool":         schedule.Tool,
+		"project_path": schedule.ProjectPath,
+		"prompt":       schedule.Prompt,
+		"catch_up":     schedule.CatchUp,
+		"enabled":      schedule.Enabled,
+	}
+	if schedule.NextRunAt != "" {
+		fields["next_run_at"] = schedule.NextRunAt
+	}
+	body, _ := json.Marshal(fields)
+
+	resp, err := s.do(ctx, "POST", "/task_schedules", body)
+	if err != nil {
+		return nil, err
+	}
+
+	var schedules []TaskSchedule
+	json.Unmarshal(resp, &schedules)
+	if len(schedules) == 0 {
+		return nil, fmt.Errorf("schedule not created")
+	}
+	return &schedules[0], nil
+}
+
+func (s *SupabaseDB) GetTaskSchedule(ctx context.Context, scheduleID int64) (*TaskSchedule, error) {
+	resp, err := s.do(ctx, "GET", "/task_schedules?id=eq."+fmt.Sprintf("%d", scheduleID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var schedules []TaskSchedule
+	json.Unmarshal(resp, &schedules)
+	if len(schedules) == 0 {
+		return nil, nil
+	}
+	return &schedules[0], nil
+}
+
+func (s *SupabaseDB) ListTaskSchedulesByUser(ctx context.Context, userID int64) ([]TaskSchedule, error) {
+	resp, err := s.do(ctx, "GET", "/task_schedules?select=*&user_id=eq."+fmt.Sprintf("%d", userID)+"&order=created_at.desc", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var schedules []TaskSchedule
+	json.Unmarshal(resp, &schedules)
+	return schedules, nil
+}
+
+func (s *SupabaseDB) ListEnabledTaskSchedules(ctx context.Context) ([]TaskSchedule, error) {
+	resp, err := s.do(ctx, "GET", "/task_schedules?select=*&enabled=eq.true&order=next_run_at.asc", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var schedules []TaskSchedule
+	json.Unmarshal(resp, &schedules)
+	return schedules, nil
+}
+
+func (s *SupabaseDB) UpdateTaskSchedule(ctx context.Context, scheduleID int64, fields map[string]interface{}) error {
+	body, _ := json.Marshal(fields)
+	_, err := s.do(ctx, "PATCH", "/task_schedules?id=eq."+fmt.Sprintf("%d", scheduleID), body)
+	return err
+}
+
+func (s *SupabaseDB) DeleteTaskSchedule(ctx context.Context, scheduleID int64) error {
+	_, err := s.do(ctx, "DELETE", "/task_schedules?id=eq."+fmt.Sprintf("%d", scheduleID), nil)
+	return err
+}
+
+func (s *SupabaseDB) CreateTaskScheduleRun(ctx context.Context, run *TaskScheduleRun) (*TaskScheduleRun, error) {
+	fields := map[string]interface{}{
+		"schedule_id":   run.ScheduleID,
+		"user_id":       run.UserID,
+		"device_id":     run.DeviceID,
+		"session_name":  run.SessionName,
+		"scheduled_for": run.ScheduledFor,
+		"status":        run.Status,
+		"error":         run.Error,
+	}
+	if run.TaskID != "" {
+		fields["task_id"] = run.TaskID
+	}
+	if run.FinishedAt != "" {
+		fields["finished_at"] = run.FinishedAt
+	}
+	body, _ := json.Marshal(fields)
+
+	resp, err := s.do(ctx, "POST", "/task_schedule_runs", body)
+	if err != nil {
+		return nil, err
+	}
+
+	var runs []TaskScheduleRun
+	json.Unmarshal(resp, &runs)
+	if len(runs) == 0 {
+		return nil, fmt.Errorf("schedule run not created")
+	}
+	return &runs[0], nil
+}
+
+func (s *SupabaseDB) ListTaskScheduleRuns(ctx context.Context, scheduleID int64, limit int) ([]TaskScheduleRun, error) {
+	endpoint := "/task_schedule_runs?select=*&schedule_id=eq." + fmt.Sprintf("%d", scheduleID) + "&order=scheduled_for.desc,id.desc"
+	if limit > 0 {
+		endpoint += fmt.Sprintf("&limit=%d", limit)
+	}
+
+	resp, err := s.do(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var runs []TaskScheduleRun
+	json.Unmarshal(resp, &runs)
+	return runs, nil
+}
+
+// GetDispatchedScheduleRun returns the running schedule occurrence that owns
+// a session, or nil if the session was not started by a schedule.
+func (s *SupabaseDB) GetDispatchedScheduleRun(ctx context.Context, deviceID, sessionName string) (*TaskScheduleRun, error) {
+	resp, err := s.do(ctx, "GET", "/task_schedule_runs?device_id=eq."+deviceID+"&session_name=eq."+url.QueryEscape(sessionName)+"&status=eq.dispatched&order=id.desc&limit=1", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var runs []TaskScheduleRun
+	json.Unmarshal(resp, &runs)
+	if len(runs) == 0 {
+		return nil, nil
+	}
+	return &runs[0], nil
+}
+
+func (s *SupabaseDB) UpdateTaskScheduleRun(ctx context.Context, runID int64, fields map[string]interface{}) error {
+	body, _ := json.Marshal(fields)
+	_, err := s.do(ctx, "PATCH", "/task_schedule_runs?id=eq."+fmt.Sprintf("%d", runID), body)
+	return err
+}
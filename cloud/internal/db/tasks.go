@@ -0,0 +1,134 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+// Task is a persisted task record. A task outlives the tmux sessions that
+// run it; sessions are attached through task_sessions.
+type Task struct {
+	ID          string `json:"id"`
+	UserID      int64  `json:"user_id"`
+	DeviceID    string `json:"device_id"`
+	SessionName string `json:"session_name"`
+	Title       string `json:"title"`
+	TitleEdited bool   `json:"title_edited"`
+	Goal        string `json:"goal"`
+	State       string `json:"state"`
+	FinalState  string `json:"final_state"`
+	CreatedAt   string `json:"created_at"`
+	UpdatedAt   string `json:"updated_at"`
+	FinishedAt  string `json:"finished_at"`
+	// Workspace is the latest git status reported by the agent.
+	Workspace json.RawMessage `json:"workspace,omitempty"`
+}
+
+// TaskSession links a tmux session to a task.
+type TaskSession struct {
+	ID          int64  `json:"id"`
+	TaskID      string `json:"task_id"`
+	DeviceID    string `json:"device_id"`
+	SessionName string `json:"session_name"`
+	LinkedAt    string `json:"linked_at"`
+}
+
+func (s *SupabaseDB) CreateTask(ctx context.Context, task *Task) (*Task, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":           task.ID,
+		"user_id":      task.UserID,
+		"device_id":    task.DeviceID,
+		"session_name": task.SessionName,
+		"title":        task.Title,
+		"title_edited": task.TitleEdited,
+		"goal":         task.Goal,
+		"state":        task.State,
+	})
+
+	resp, err := s.do(ctx, "POST", "/tasks", body)
+	if err != nil {
+		return nil, err
+	}
+
+	var tasks []Task
+	json.Unmarshal(resp, &tasks)
+	if len(tasks) == 0 {
+		return nil, fmt.Errorf("task not created")
+	}
+	return &tasks[0], nil
+}
+
+func (s *SupabaseDB) GetTaskByID(ctx context.Context, taskID string) (*Task, error) {
+	resp, err := s.do(ctx, "GET", "/tasks?id=eq."+url.QueryEscape(taskID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var tasks []Task
+	json.Unmarshal(resp, &tasks)
+	if len(tasks) == 0 {
+		return nil, nil
+	}
+	return &tasks[0], nil
+}
+
+func (s *SupabaseDB) ListTasksByUser(ctx context.Context, userID int64) ([]Task, error) {
+	resp, err := s.do(ctx, "GET", "/tasks?select=*&user_id=eq."+fmt.Sprintf("%d", userID)+"&order=created_at.desc", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var tasks []Task
+	json.Unmarshal(resp, &tasks)
+	return tasks, nil
+}
+
+// CountTasks counts the tasks of all users in the given state.
+func (s *SupabaseDB) CountTasks(ctx context.Context, state string) (int, error) {
+	return s.count(ctx, "/tasks?select=id&state=eq."+url.QueryEscape(state))
+}
+
+// UpdateTask patches the given columns of a task.
+func (s *SupabaseDB) UpdateTask(ctx context.Context, taskID string, fields map[string]interface{}) error {
+	body, _ := json.Marshal(fields)
+	_, err := s.do(ctx, "PATCH", "/tasks?id=eq."+url.QueryEscape(taskID), body)
+	return err
+}
+
+func (s *SupabaseDB) LinkTaskSession(ctx context.Context, taskID, deviceID, sessionName string) error {
+	body, _ := json.Marshal(map[string]interface{}{
+		"task_id":      taskID,
+		"device_id":    deviceID,
+		"session_name": sessionName,
+	})
+	_, err := s.do(ctx, "POST", "/task_sessions", body)
+	return err
+}
+
+// GetLatestTaskSession returns the most recent task link of a session.
+func (s *SupabaseDB) GetLatestTaskSession(ctx context.Context, deviceID, sessionName string) (*TaskSession, error) {
+	resp, err := s.do(ctx, "GET", "/task_sessions?device_id=eq."+deviceID+"&session_name=eq."+url.QueryEscape(sessionName)+"&order=linked_at.desc&limit=1", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var links []TaskSession
+	json.Unmarshal(resp, &links)
+	if len(links) == 0 {
+		return nil, nil
+	}
+	return &links[0], nil
+}
+
+func (s *SupabaseDB) ListTaskSessions(ctx context.Context, taskID string) ([]TaskSession, error) {
+	resp, err := s.do(ctx, "GET", "/task_sessions?task_id=eq."+url.QueryEscape(taskID)+"&order=linked_at.asc", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var links []TaskSession
+	json.Unmarshal(resp, &links)
+	return links, nil
+}
@@ -0,0 +1,226 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	cloudauth "github.com/mobile-coder/cloud/internal/auth"
+	"github.com/mobile-coder/cloud/internal/db"
+	"github.com/mobile-coder/cloud/internal/service"
+)
+
+// auditRecorder appends remote actions to the audit log.
+type auditRecorder interface {
+	Record(ctx context.Context, event service.AuditEvent)
+}
+
+// recordAudit records event with the request's source IP. A nil recorder
+// records nothing.
+func recordAudit(recorder auditRecorder, r *http.Request, event service.AuditEvent) {
+	if recorder == nil {
+		return
+	}
+	event.SourceIP = clientIP(r)
+	recorder.Record(r.Context(), event)
+}
+
+// clientIP is the host part of the request's remote address, which the
+// server rewrites from proxy headers when it trusts them.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type auditService interface {
+	ListAudit(ctx context.Context, userID int64, filter db.AuditFilter) ([]db.AuditEntry, error)
+}
+
+// auditExportPage is how many entries a JSONL export reads per query.
+const auditExportPage = 1000
+
+type AuditHandler struct {
+	service      auditService
+	tokenManager *cloudauth.Manager
+}
+
+func NewAuditHandler(service auditService, tokenManager *cloudauth.Manager) *AuditHandler {
+	return &AuditHandler{
+		service:      service,
+		tokenManager: tokenManager,
+	}
+}
+
+// ListAudit returns audit entries, newest first, filtered by user_id,
+// action, device_id, session_name, since, until and before_id. With
+// format=jsonl every matching entry is streamed, one JSON object per line.
+func (h *AuditHandler) ListAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := requireClaimsFromRequest(r, h.tokenManager)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "jsonl" {
+		h.exportAudit(w, r, claims.UserID, filter)
+		return
+	}
+
+	entries, err := h.service.ListAudit(r.Context(), claims.UserID, filter)
+	if err != nil {
+		writeAuditError(w, err)
+		return
+	}
+	if entries == nil {
+		entries = []db.AuditEntry{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"entries": entries,
+	})
+}
+
+// exportAudit pages through the matching entries by ID, up to filter.Limit
+// entries if one was given.
+func (h *AuditHandler) exportAudit(w http.ResponseWriter, r *http.Request, userID int64, filter db.AuditFilter) {
+	remaining := filter.Limit
+	var encoder *json.Encoder
+	for {
+		filter.Limit = auditExportPage
+		if remaining > 0 && remaining < auditExportPage {
+			filter.Limit = remaining
+		}
+		entries, err := h.service.ListAudit(r.Context(), userID, filter)
+		if err != nil {
+			// Once lines are out the client can only get a short file
+			if encoder == nil {
+				writeAuditError(w, err)
+			}
+			return
+		}
+		if encoder == nil {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+			encoder = json.NewEncoder(w)
+		}
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				return
+			}
+		}
+		if len(entries) < filter.Limit {
+			return
+		}
+		if remaining > 0 {
+			if remaining -= len(entries); remaining == 0 {
+				return
+			}
+		}
+		filter.BeforeID = entries[len(entries)-1].ID
+	}
+}
+
+func parseAuditFilter(r *http.Request) (db.AuditFilter, error) {
+	query := r.URL.Query()
+	filter := db.AuditFilter{
+		Action:      query.Get("action"),
+		DeviceID:    query.Get("device_id"),
+		SessionName: query.Get("session_name"),
+	}
+	var err error
+	if filter.UserID, err = parseAuditID(query.Get("user_id"), "user_id"); err != nil {
+		return filter, err
+	}
+	if filter.BeforeID, err = parseAuditID(query.Get("before_id"), "before_id"); err != nil {
+		return filter, err
+	}
+	if filter.Since, err = parseAuditTime(query.Get("since"), "since"); err != nil {
+		return filter, err
+	}
+	if filter.Until, err = parseAuditTime(query.Get("until"), "until"); err != nil {
+		return filter, err
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			return filter, errors.New("limit must be a non-negative number")
+		}
+		filter.Limit = limit
+	}
+	return filter, nil
+}
+
+func parseAuditID(value, name string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, errors.New(name + " must be a positive number")
+	}
+	return id, nil
+}
+
+func parseAuditTime(value, name string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", errors.New(name + " must be RFC3339")
+	}
+	return parsed.UTC().Format(time.RFC3339Nano), nil
+}
+
+func writeAuditError(w http.ResponseWriter, err error) {
+	if errors.Is(err, service.ErrAuditForbidden) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// terminalInputContent is what a terminal_input message types: its text,
+// or a key with its modifiers such as "ctrl+c".
+func terminalInputContent(message []byte) string {
+	var msg struct {
+		Payload struct {
+			Action    string `json:"action"`
+			Key       string `json:"key"`
+			Modifiers []any  `json:"modifiers"`
+			Content   string `json:"content"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(message, &msg); err != nil {
+		return ""
+	}
+	if msg.Payload.Action != "key" {
+		return msg.Payload.Content
+	}
+	parts := make([]string, 0, len(msg.Payload.Modifiers)+1)
+	for _, modifier := range msg.Payload.Modifiers {
+		parts = append(parts, fmt.Sprint(modifier))
+	}
+	return strings.Join(append(parts, msg.Payload.Key), "+")
+}
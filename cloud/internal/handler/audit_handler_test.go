@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	cloudauth "github.com/mobile-coder/cloud/internal/auth"
+	"github.com/mobile-coder/cloud/internal/db"
+	"github.com/mobile-coder/cloud/internal/service"
+)
+
+type fakeAuditService struct {
+	total   int64 // entries 1..total exist, for every user
+	err     error
+	filters []db.AuditFilter
+}
+
+func (f *fakeAuditService) ListAudit(ctx context.Context, userID int64, filter db.AuditFilter) ([]db.AuditEntry, error) {
+	f.filters = append(f.filters, filter)
+	if f.err != nil {
+		return nil, f.err
+	}
+	next := f.total
+	if filter.BeforeID > 0 {
+		next = filter.BeforeID - 1
+	}
+	var entries []db.AuditEntry
+	for ; next > 0 && len(entries) < filter.Limit; next-- {
+		entries = append(entries, db.AuditEntry{ID: next, UserID: userID, Action: service.AuditTerminalInput})
+	}
+	return entries, nil
+}
+
+type recordingAudit struct {
+	events []service.AuditEvent
+}
+
+func (r *recordingAudit) Record(ctx context.Context, event service.AuditEvent) {
+	r.events = append(r.events, event)
+}
+
+func newAuditRequest(t *testing.T, manager *cloudauth.Manager, target string) *http.Request {
+	t.Helper()
+	token, err := manager.Issue(7, "user@example.com")
+	if err != nil {
+		t.Fatalf("Issue token: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("Authorization", token)
+	return req
+}
+
+func TestListAuditPassesFilters(t *testing.T) {
+	manager := cloudauth.NewManager("test-secret", time.Hour)
+	audit := &fakeAuditService{total: 3}
+	handler := NewAuditHandler(audit, manager)
+
+	rec := httptest.NewRecorder()
+	handler.ListAudit(rec, newAuditRequest(t, manager, "/api/audit?action=login&device_id=dev-1&since=2026-04-19T08:00:00%2B08:00&limit=2"))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	var payload struct {
+		Entries []db.AuditEntry `json:"entries"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&payload); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if len(payload.Entries) != 2 {
+		t.Fatalf("entries = %+v, want 2", payload.Entries)
+	}
+	want := db.AuditFilter{Action: "login", DeviceID: "dev-1", Since: "2026-04-19T00:00:00Z", Limit: 2}
+	if len(audit.filters) != 1 || audit.filters[0] != want {
+		t.Fatalf("filters = %+v, want %+v", audit.filters, want)
+	}
+}
+
+func TestListAuditRejectsBadQuery(t *testing.T) {
+	manager := cloudauth.NewManager("test-secret", time.Hour)
+	handler := NewAuditHandler(&fakeAuditService{}, manager)
+
+	for _, target := range []string{"/api/audit?since=yesterday", "/api/audit?user_id=-1", "/api/audit?limit=x"} {
+		rec := httptest.NewRecorder()
+		handler.ListAudit(rec, newAuditRequest(t, manager, target))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", target, rec.Code)
+		}
+	}
+}
+
+func TestListAuditForbidsOtherUsersForMembers(t *testing.T) {
+	manager := cloudauth.NewManager("test-secret", time.Hour)
+	handler := NewAuditHandler(&fakeAuditService{err: service.ErrAuditForbidden}, manager)
+
+	rec := httptest.NewRecorder()
+	handler.ListAudit(rec, newAuditRequest(t, manager, "/api/audit?user_id=9"))
+
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403", rec.Code)
+	}
+}
+
+func TestListAuditExportsEveryEntryAsJSONL(t *testing.T) {
+	manager := cloudauth.NewManager("test-secret", time.Hour)
+	audit := &fakeAuditService{total: auditExportPage + 5}
+	handler := NewAuditHandler(audit, manager)
+
+	rec := httptest.NewRecorder()
+	handler.ListAudit(rec, newAuditRequest(t, manager, "/api/audit?format=jsonl"))
+
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("status = %d, content type = %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var ids []int64
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		var entry db.AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		ids = append(ids, entry.ID)
+	}
+	if len(ids) != auditExportPage+5 || ids[0] != auditExportPage+5 || ids[len(ids)-1] != 1 {
+		t.Fatalf("exported %d entries from %v to %v", len(ids), ids[0], ids[len(ids)-1])
+	}
+	if len(audit.filters) != 2 || audit.filters[1].BeforeID != 6 {
+		t.Fatalf("filters = %+v, want a second page before entry 6", audit.filters)
+	}
+}
+
+func TestDeleteDeviceAuditsDeniedAttempt(t *testing.T) {
+	supabase := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Fatalf("unexpected supabase request: %s %s", r.Method, r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode([]map[string]any{{"id": 1, "user_id": 9, "device_id": "dev-1"}})
+	}))
+	defer supabase.Close()
+
+	manager := cloudauth.NewManager("test-secret", time.Hour)
+	handler := NewDeviceHandler(service.NewDeviceService(db.NewSupabaseDB(&db.Config{ProjectURL: supabase.URL, APIKey: "test-key"})), manager)
+	audit := &recordingAudit{}
+	handler.SetAuditRecorder(audit)
+
+	token, _ := manager.Issue(7, "user@example.com")
+	req := httptest.NewRequest(http.MethodPost, "/api/device/delete", bytes.NewReader([]byte(`{"device_id":"dev-1"}`)))
+	req.Header.Set("Authorization", token)
+	req.RemoteAddr = "203.0.113.5:41234"
+	rec := httptest.NewRecorder()
+	handler.DeleteDevice(rec, req)
+
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403", rec.Code)
+	}
+	if len(audit.events) != 1 {
+		t.Fatalf("events = %+v, want one", audit.events)
+	}
+	event := audit.events[0]
+	if event.Action != service.AuditDeviceDelete || event.Status != service.AuditStatusDenied || event.UserID != 7 || event.SourceIP != "203.0.113.5" {
+		t.Fatalf("event = %+v", event)
+	}
+}
+
+func TestTerminalInputContent(t *testing.T) {
+	for message, want := range map[string]string{
+		`{"type":"terminal_input","payload":{"content":"git status\n"}}`:                      "git status\n",
+		`{"type":"terminal_input","payload":{"action":"key","key":"c","modifiers":["ctrl"]}}`: "ctrl+c",
+		`{"type":"terminal_input","payload":{"action":"key","key":"Enter"}}`:                  "Enter",
+		`not json`: "",
+	} {
+		if got := terminalInputContent([]byte(message)); got != want {
+			t.Errorf("terminalInputContent(%s) = %q, want %q", message, got, want)
+		}
+	}
+}
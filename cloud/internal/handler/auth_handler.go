@@ -3,20 +3,42 @@ package handler
 import (
 	"encoding/json"
 	"net/http"
+	"strings"
 
 	cloudauth "github.com/mobile-coder/cloud/internal/auth"
+	"github.com/mobile-coder/cloud/internal/ratelimit"
 	"github.com/mobile-coder/cloud/internal/service"
 )
 
 type AuthHandler struct {
 	authService *service.AuthService
 	tokenManager *cloudauth.Manager
+	audit        auditRecorder
+	failures     *ratelimit.Limiter
 }
 
 func NewAuthHandler(authService *service.AuthService, tokenManager *cloudauth.Manager) *AuthHandler {
 	return &AuthHandler{authService: authService, tokenManager: tokenManager}
 }
 
+// SetLoginLimiter locks an account out after repeated wrong passwords.
+func (h *AuthHandler) SetLoginLimiter(failures *ratelimit.Limiter) {
+	h.failures = failures
+}
+
+// SetAuditRecorder records logins and token issuance in the audit log.
+func (h *AuthHandler) SetAuditRecorder(audit auditRecorder) {
+	h.audit = audit
+}
+
+func (h *AuthHandler) recordUserToken(r *http.Request, userID int64, via string) {
+	recordAudit(h.audit, r, service.AuditEvent{
+		Action: service.AuditTokenIssued,
+		UserID: userID,
+		Detail: map[string]string{"token_type": "user", "via": via},
+	})
+}
+
 type RegisterRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
@@ -46,7 +68,7 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := h.authService.Register(req.Email, req.Password)
+	user, err := h.authService.Register(r.Context(), req.Email, req.Password)
 	if err != nil {
 		if err == service.ErrUserAlreadyExists {
 			http.Error(w, err.Error(), http.StatusConflict)
@@ -61,6 +83,7 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "failed to issue token", http.StatusInternalServerError)
 		return
 	}
+	h.recordUserToken(r, user.ID, "register")
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(AuthResponse{
@@ -78,17 +101,32 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := h.authService.Login(req.Email, req.Password)
+	key := "login:" + strings.ToLower(strings.TrimSpace(req.Email))
+	if retryAfter := h.failures.Check(key); retryAfter > 0 {
+		ratelimit.TooManyRequests(w, retryAfter)
+		return
+	}
+
+	user, err := h.authService.Login(r.Context(), req.Email, req.Password)
 	if err != nil {
+		h.failures.Hit(key)
+		recordAudit(h.audit, r, service.AuditEvent{
+			Action: service.AuditLogin,
+			Status: service.AuditStatusFailed,
+			Detail: map[string]string{"email": req.Email},
+		})
 		http.Error(w, "invalid email or password", http.StatusUnauthorized)
 		return
 	}
+	h.failures.Reset(key)
+	recordAudit(h.audit, r, service.AuditEvent{Action: service.AuditLogin, UserID: user.ID})
 
 	token, err := h.tokenManager.Issue(user.ID, user.Email)
 	if err != nil {
 		http.Error(w, "failed to issue token", http.StatusInternalServerError)
 		return
 	}
+	h.recordUserToken(r, user.ID, "login")
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(AuthResponse{
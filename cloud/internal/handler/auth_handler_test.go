@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	cloudauth "github.com/mobile-coder/cloud/internal/auth"
+	"github.com/mobile-coder/cloud/internal/db"
+	"github.com/mobile-coder/cloud/internal/ratelimit"
+	"github.com/mobile-coder/cloud/internal/service"
+)
+
+func TestLoginLocksOutAccountAfterWrongPasswords(t *testing.T) {
+	lookups := 0
+	supabase := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups++
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode([]map[string]any{{"id": 7, "email": "a@example.com", "password": "not-the-hash"}})
+	}))
+	defer supabase.Close()
+
+	now := time.Date(2026, 4, 19, 9, 0, 0, 0, time.UTC)
+	limiter := ratelimit.NewWithClock(ratelimit.Policy{Limit: 3, Window: 15 * time.Minute, Lockout: time.Minute, MaxLockout: time.Hour},
+		func() time.Time { return now })
+	handler := NewAuthHandler(service.NewAuthService(db.NewSupabaseDB(&db.Config{ProjectURL: supabase.URL, APIKey: "test-key"})),
+		cloudauth.NewManager("test-secret", time.Hour))
+	handler.SetLoginLimiter(limiter)
+
+	login := func(email string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(LoginRequest{Email: email, Password: "guess"})
+		rec := httptest.NewRecorder()
+		handler.Login(rec, httptest.NewRequest(http.MethodPost, "/api/auth/login", bytes.NewReader(body)))
+		return rec
+	}
+
+	for i := 0; i < 3; i++ {
+		if rec := login("a@example.com"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: status = %d, want 401", i+1, rec.Code)
+		}
+	}
+	rec := login("A@example.com ")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "60" {
+		t.Fatalf("status = %d, Retry-After = %q, want 429 and 60", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if lookups != 3 {
+		t.Fatalf("lookups = %d, the locked out attempt should not reach the store", lookups)
+	}
+
+	now = now.Add(time.Minute)
+	if rec := login("a@example.com"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("after the lockout: status = %d, want 401", rec.Code)
+	}
+}
@@ -2,16 +2,39 @@ package handler
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"time"
 
 	cloudauth "github.com/mobile-coder/cloud/internal/auth"
+	"github.com/mobile-coder/cloud/internal/ratelimit"
 	"github.com/mobile-coder/cloud/internal/service"
+	"github.com/mobile-coder/cloud/internal/ws"
 )
 
+type agentInfoSource interface {
+	AgentInfo(deviceID string) *service.AgentInfo
+	AgentLastSeen(deviceID string) (time.Time, bool)
+	Presence(deviceID string) []ws.ClientPresence
+}
+
+// sessionCache drops per-session state kept in memory when sessions or
+// devices are deleted.
+type sessionCache interface {
+	ForgetSession(deviceID, sessionName string)
+	ForgetDevice(deviceID string)
+}
+
 type DeviceHandler struct {
 	deviceService *service.DeviceService
 	tokenManager  *cloudauth.Manager
+	agents        agentInfoSource
+	audit         auditRecorder
+	sessions      []sessionCache
+	failures      *ratelimit.Limiter // wrong bind codes per user or IP
+	bindCodes     *ratelimit.Limiter // wrong guesses per bind code
 }
 
 func NewDeviceHandler(deviceService *service.DeviceService, tokenManager *cloudauth.Manager) *DeviceHandler {
@@ -21,6 +44,32 @@ func NewDeviceHandler(deviceService *service.DeviceService, tokenManager *clouda
 	}
 }
 
+// SetAgentInfoSource lets device listings include the version and
+// capabilities of connected agents, and their live presence.
+func (h *DeviceHandler) SetAgentInfoSource(agents agentInfoSource) {
+	h.agents = agents
+}
+
+// SetRateLimits throttles bind code guessing: failures counts wrong codes
+// per user (or IP for agents and device checks) and locks them out; once
+// bindCodes locks a bind code out, it is invalidated.
+func (h *DeviceHandler) SetRateLimits(failures, bindCodes *ratelimit.Limiter) {
+	h.failures = failures
+	h.bindCodes = bindCodes
+}
+
+// SetAuditRecorder records binds, deletes and agent token issuance in the
+// audit log.
+func (h *DeviceHandler) SetAuditRecorder(audit auditRecorder) {
+	h.audit = audit
+}
+
+// SetSessionCache forgets cached session state on session and device
+// deletes, in every cache given.
+func (h *DeviceHandler) SetSessionCache(sessions ...sessionCache) {
+	h.sessions = sessions
+}
+
 type CreateBindCodeRequest struct {
 	DeviceName string `json:"device_name"`
 }
@@ -39,7 +88,13 @@ type DeviceCheckRequest struct {
 	BindCode string `json:"bind_code,omitempty"`
 }
 
-// Register allows Desktop Agent to register itself (no auth required)
+// minBindCodeLength keeps registered bind codes out of easy guessing range;
+// the agent generates six hex digits.
+const minBindCodeLength = 6
+
+// Register allows Desktop Agent to register itself. It is the only device
+// route without auth: the agent has no agent token until a user binds it,
+// only the short-lived registration token returned here.
 func (h *DeviceHandler) Register(w http.ResponseWriter, r *http.Request) {
 	var req DeviceRegisterRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -51,19 +106,33 @@ func (h *DeviceHandler) Register(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bind_code required", http.StatusBadRequest)
 		return
 	}
+	if len(req.BindCode) < minBindCodeLength {
+		http.Error(w, "bind_code too short", http.StatusBadRequest)
+		return
+	}
 
 	// Create device with the provided bind code
-	device, err := h.deviceService.RegisterDevice(req.BindCode, req.DeviceName)
+	device, err := h.deviceService.RegisterDevice(r.Context(), req.BindCode, req.DeviceName)
+	if errors.Is(err, service.ErrBindCodeInUse) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	registrationToken, err := h.tokenManager.IssueRegistration(device.DeviceID)
+	if err != nil {
+		http.Error(w, "failed to issue registration token", http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"device_id":  device.DeviceID,
-		"bind_code":  device.BindCode,
-		"expires_at": device.BindCodeExp,
+		"device_id":          device.DeviceID,
+		"bind_code":          device.BindCode,
+		"expires_at":         device.BindCodeExp,
+		"registration_token": registrationToken,
 	})
 }
 
@@ -77,7 +146,7 @@ func (h *DeviceHandler) CreateBindCode(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	device, err := h.deviceService.CreateBindCodeSimple(req.DeviceName)
+	device, err := h.deviceService.CreateBindCodeSimple(r.Context(), req.DeviceName)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -104,13 +173,31 @@ func (h *DeviceHandler) BindDevice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	device, err := h.deviceService.BindDeviceToUser(req.BindCode, claims.UserID)
+	key := "bind:user:" + strconv.FormatInt(claims.UserID, 10)
+	if retryAfter := h.failures.Check(key); retryAfter > 0 {
+		ratelimit.TooManyRequests(w, retryAfter)
+		return
+	}
+
+	device, err := h.deviceService.BindDeviceToUser(r.Context(), req.BindCode, claims.UserID)
 	if err != nil {
+		h.failures.Hit(key)
+		recordAudit(h.audit, r, service.AuditEvent{
+			Action: service.AuditDeviceBind,
+			Status: service.AuditStatusFailed,
+			UserID: claims.UserID,
+			Detail: map[string]string{"error": err.Error()},
+		})
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error()})
 		return
 	}
+	recordAudit(h.audit, r, service.AuditEvent{
+		Action:   service.AuditDeviceBind,
+		UserID:   claims.UserID,
+		DeviceID: device.DeviceID,
+	})
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -120,9 +207,23 @@ func (h *DeviceHandler) BindDevice(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// ListDevices returns every device, for admins only.
 func (h *DeviceHandler) ListDevices(w http.ResponseWriter, r *http.Request) {
-	// 简化版：无需用户登录，返回所有设备（或按需扩展）
-	devices, err := h.deviceService.ListAllDevices()
+	claims, err := requireClaimsFromRequest(r, h.tokenManager)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if claims.TokenType == "agent" {
+		http.Error(w, errForbidden.Error(), http.StatusForbidden)
+		return
+	}
+
+	devices, err := h.deviceService.ListAllDevicesForAdmin(r.Context(), claims.UserID)
+	if errors.Is(err, service.ErrDeviceListForbidden) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -134,7 +235,9 @@ func (h *DeviceHandler) ListDevices(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// BindAgent allows Desktop Agent to bind using a bind code (no auth required)
+// BindAgent lets a Desktop Agent consume its own bind code. It needs the
+// registration token from Register, or the agent token, of the device the
+// code belongs to.
 func (h *DeviceHandler) BindAgent(w http.ResponseWriter, r *http.Request) {
 	var req BindRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -142,13 +245,64 @@ func (h *DeviceHandler) BindAgent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// For Desktop Agent, we need to find the device by bind code first
-	// This is a simplified flow - the Desktop Agent uses bind code to get device_id
-	device, err := h.deviceService.BindDeviceByCode(req.BindCode)
+	claims, err := h.bindAgentClaims(r)
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if claims.TokenType == "user" {
+		http.Error(w, errForbidden.Error(), http.StatusForbidden)
+		return
+	}
+
+	key := "bind:ip:" + clientIP(r)
+	if retryAfter := h.failures.Check(key); retryAfter > 0 {
+		ratelimit.TooManyRequests(w, retryAfter)
+		return
+	}
+
+	device, err := h.deviceService.GetDeviceByDeviceID(r.Context(), claims.DeviceID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	// A registration token names its device and no user yet
+	if claims.TokenType == "agent" {
+		if err := ensureDeviceAccess(device, claims, claims.DeviceID); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	if req.BindCode == "" || req.BindCode != device.BindCode {
+		h.failures.Hit(key)
+		recordAudit(h.audit, r, service.AuditEvent{
+			Action:   service.AuditDeviceBind,
+			Status:   service.AuditStatusDenied,
+			UserID:   claims.UserID,
+			DeviceID: claims.DeviceID,
+			Detail:   map[string]string{"by": "agent", "error": "bind code of another device"},
+		})
+		http.Error(w, errForbidden.Error(), http.StatusForbidden)
+		return
+	}
+
+	device, err = h.deviceService.BindDeviceByCode(r.Context(), req.BindCode)
+	if err != nil {
+		h.failures.Hit(key)
+		recordAudit(h.audit, r, service.AuditEvent{
+			Action: service.AuditDeviceBind,
+			Status: service.AuditStatusFailed,
+			Detail: map[string]string{"by": "agent", "error": err.Error()},
+		})
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	recordAudit(h.audit, r, service.AuditEvent{
+		Action:   service.AuditDeviceBind,
+		UserID:   device.UserID,
+		DeviceID: device.DeviceID,
+		Detail:   map[string]string{"by": "agent"},
+	})
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -158,6 +312,18 @@ func (h *DeviceHandler) BindAgent(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// bindAgentClaims accepts a registration token or any token requireClaims
+// does.
+func (h *DeviceHandler) bindAgentClaims(r *http.Request) (*cloudauth.Claims, error) {
+	token := r.Header.Get("Authorization")
+	if token != "" && h.tokenManager != nil {
+		if claims, err := h.tokenManager.VerifyRegistration(token); err == nil {
+			return claims, nil
+		}
+	}
+	return requireClaims(token, h.tokenManager)
+}
+
 // CheckDevice checks if a device_id is valid
 func (h *DeviceHandler) CheckDevice(w http.ResponseWriter, r *http.Request) {
 	var req DeviceCheckRequest
@@ -166,7 +332,7 @@ func (h *DeviceHandler) CheckDevice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	device, err := h.deviceService.GetDeviceByDeviceID(req.DeviceID)
+	device, err := h.deviceService.GetDeviceByDeviceID(r.Context(), req.DeviceID)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
@@ -175,6 +341,20 @@ func (h *DeviceHandler) CheckDevice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 未登录也能调用，错误的绑定码按 IP 计数；同一绑定码被试错太多次后作废，
+	// agent 重新注册会拿到新的绑定码，设备不会被锁住
+	key := "bind:ip:" + clientIP(r)
+	if device.UserID > 0 && req.BindCode != "" {
+		if retryAfter := h.failures.Check(key); retryAfter > 0 {
+			ratelimit.TooManyRequests(w, retryAfter)
+			return
+		}
+		if req.BindCode != device.BindCode {
+			h.failures.Hit(key)
+			h.wrongBindCode(r, device)
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	response := map[string]interface{}{
 		"valid":  true,
@@ -187,25 +367,58 @@ func (h *DeviceHandler) CheckDevice(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "failed to issue agent token", http.StatusInternalServerError)
 			return
 		}
-		if err := h.deviceService.UpdateDeviceBindCode(device.DeviceID); err != nil {
+		if err := h.deviceService.UpdateDeviceBindCode(r.Context(), device.DeviceID); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		h.recordAgentToken(r, device, "bind_code")
+		h.failures.Reset(key)
 		response["agent_token"] = agentToken
 	} else if device.UserID > 0 && h.tokenManager != nil && r.Header.Get("Authorization") != "" {
-		claims, err := h.tokenManager.VerifyAllowExpired(r.Header.Get("Authorization"))
+		claims, err := h.tokenManager.VerifyForRefresh(r.Header.Get("Authorization"))
 		if err == nil && claims.TokenType == "agent" && claims.DeviceID == device.DeviceID && claims.UserID == device.UserID {
 			agentToken, err := h.tokenManager.IssueAgent(device.UserID, device.DeviceID)
 			if err != nil {
 				http.Error(w, "failed to issue agent token", http.StatusInternalServerError)
 				return
 			}
+			h.recordAgentToken(r, device, "refresh")
 			response["agent_token"] = agentToken
 		}
 	}
 	json.NewEncoder(w).Encode(response)
 }
 
+// wrongBindCode counts a wrong guess against the current bind code of
+// device and invalidates the code once it is locked out. The count is per
+// code, so a new code after registering again starts from zero.
+func (h *DeviceHandler) wrongBindCode(r *http.Request, device *service.Device) {
+	if device.BindCode == "" || h.bindCodes.Hit(device.DeviceID+":"+device.BindCode) == 0 {
+		return
+	}
+	if err := h.deviceService.InvalidateBindCode(r.Context(), device.DeviceID); err != nil {
+		slog.WarnContext(r.Context(), "invalidate bind code failed", "device_id", device.DeviceID, "error", err)
+		return
+	}
+	slog.WarnContext(r.Context(), "bind code invalidated after wrong attempts", "device_id", device.DeviceID)
+	recordAudit(h.audit, r, service.AuditEvent{
+		Action:   service.AuditDeviceBind,
+		Status:   service.AuditStatusDenied,
+		UserID:   device.UserID,
+		DeviceID: device.DeviceID,
+		Detail:   map[string]string{"error": "bind code invalidated after wrong attempts"},
+	})
+}
+
+func (h *DeviceHandler) recordAgentToken(r *http.Request, device *service.Device, via string) {
+	recordAudit(h.audit, r, service.AuditEvent{
+		Action:   service.AuditTokenIssued,
+		UserID:   device.UserID,
+		DeviceID: device.DeviceID,
+		Detail:   map[string]string{"token_type": "agent", "via": via},
+	})
+}
+
 // GetUserDevices 获取用户的所有设备
 func (h *DeviceHandler) GetUserDevices(w http.ResponseWriter, r *http.Request) {
 	claims, err := requireClaimsFromRequest(r, h.tokenManager)
@@ -214,11 +427,23 @@ func (h *DeviceHandler) GetUserDevices(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	devices, err := h.deviceService.GetUserDevices(claims.UserID)
+	devices, err := h.deviceService.GetUserDevices(r.Context(), claims.UserID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if h.agents != nil {
+		for i := range devices {
+			devices[i].Agent = h.agents.AgentInfo(devices[i].DeviceID)
+			// 以 hub 的在线状态为准，数据库里的 status 可能在服务重启前就过期了
+			if lastSeen, online := h.agents.AgentLastSeen(devices[i].DeviceID); online {
+				devices[i].Status = "online"
+				devices[i].LastActiveAt = lastSeen.UTC().Format(time.RFC3339)
+			} else if devices[i].UserID > 0 {
+				devices[i].Status = "offline"
+			}
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -240,7 +465,7 @@ func (h *DeviceHandler) GetDeviceSessions(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	device, err := h.deviceService.GetDeviceByDeviceID(deviceID)
+	device, err := h.deviceService.GetDeviceByDeviceID(r.Context(), deviceID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
@@ -250,7 +475,7 @@ func (h *DeviceHandler) GetDeviceSessions(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	sessions, err := h.deviceService.GetDeviceSessions(deviceID)
+	sessions, err := h.deviceService.GetDeviceSessions(r.Context(), deviceID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -262,6 +487,41 @@ func (h *DeviceHandler) GetDeviceSessions(w http.ResponseWriter, r *http.Request
 	})
 }
 
+// GetDevicePresence 返回设备当前连在本实例上的客户端（agent 和 H5），
+// 包括最后活跃时间和发送队列积压，用于排查连接问题
+func (h *DeviceHandler) GetDevicePresence(w http.ResponseWriter, r *http.Request) {
+	claims, err := requireClaimsFromRequest(r, h.tokenManager)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	deviceID := r.URL.Query().Get("device_id")
+	if deviceID == "" {
+		http.Error(w, "device_id required", http.StatusBadRequest)
+		return
+	}
+
+	device, err := h.deviceService.GetDeviceByDeviceID(r.Context(), deviceID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err := ensureDeviceAccess(device, claims, deviceID); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	clients := []ws.ClientPresence{}
+	if h.agents != nil {
+		clients = append(clients, h.agents.Presence(deviceID)...)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"clients": clients,
+	})
+}
+
 // CreateSessionRequest represents a session creation request
 type CreateSessionRequest struct {
 	DeviceID    string `json:"device_id"`
@@ -293,24 +553,24 @@ func (h *DeviceHandler) CreateSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	device, err := h.deviceService.GetDeviceByDeviceID(req.DeviceID)
+	device, err := h.deviceService.GetDeviceByDeviceID(r.Context(), req.DeviceID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	if err := ensureDeviceOwnership(device, claims.UserID); err != nil {
+	if err := ensureDeviceAccess(device, claims, req.DeviceID); err != nil {
 		http.Error(w, err.Error(), http.StatusForbidden)
 		return
 	}
 
-	log.Printf("CreateSession: deviceID=%s, sessionName=%s, projectPath=%s", req.DeviceID, req.SessionName, req.ProjectPath)
-	session, err := h.deviceService.CreateSession(req.DeviceID, req.SessionName, req.ProjectPath)
+	session, err := h.deviceService.CreateSession(r.Context(), req.DeviceID, req.SessionName, req.ProjectPath)
 	if err != nil {
-		log.Printf("CreateSession error: %v", err)
+		slog.WarnContext(r.Context(), "create session failed", "device_id", req.DeviceID, "session_name", req.SessionName, "error", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	log.Printf("CreateSession success: id=%d, sessionName=%s, status=%s", session.ID, session.SessionName, session.Status)
+	slog.InfoContext(r.Context(), "session created", "device_id", req.DeviceID, "session_name", session.SessionName,
+		"project_path", req.ProjectPath, "status", session.Status)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -342,16 +602,48 @@ func (h *DeviceHandler) DeleteSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, err := requireClaimsFromRequest(r, h.tokenManager); err != nil {
+	claims, err := requireClaimsFromRequest(r, h.tokenManager)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	err := h.deviceService.DeleteSession(req.SessionID)
+	session, err := h.deviceService.GetSession(r.Context(), req.SessionID)
+	if errors.Is(err, service.ErrSessionNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	device, err := h.deviceService.GetDeviceByDeviceID(r.Context(), session.DeviceID)
+	if err == nil {
+		err = ensureDeviceAccess(device, claims, session.DeviceID)
+	}
+	event := service.AuditEvent{
+		Action:      service.AuditSessionDelete,
+		UserID:      claims.UserID,
+		DeviceID:    session.DeviceID,
+		SessionName: session.SessionName,
+		Detail:      map[string]string{"session_id": strconv.FormatInt(req.SessionID, 10)},
+	}
+	if err != nil {
+		event.Status = service.AuditStatusDenied
+		recordAudit(h.audit, r, event)
+		http.Error(w, errForbidden.Error(), http.StatusForbidden)
+		return
+	}
+
+	err = h.deviceService.DeleteSession(r.Context(), req.SessionID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	for _, sessions := range h.sessions {
+		sessions.ForgetSession(session.DeviceID, session.SessionName)
+	}
+	recordAudit(h.audit, r, event)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
@@ -387,7 +679,7 @@ func (h *DeviceHandler) UpdateDevice(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
-	device, err := h.deviceService.GetDeviceByDeviceID(req.DeviceID)
+	device, err := h.deviceService.GetDeviceByDeviceID(r.Context(), req.DeviceID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
@@ -397,7 +689,7 @@ func (h *DeviceHandler) UpdateDevice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.deviceService.UpdateDeviceName(req.DeviceID, req.DeviceName)
+	err = h.deviceService.UpdateDeviceName(r.Context(), req.DeviceID, req.DeviceName)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -436,21 +728,35 @@ func (h *DeviceHandler) DeleteDevice(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
-	device, err := h.deviceService.GetDeviceByDeviceID(req.DeviceID)
+	device, err := h.deviceService.GetDeviceByDeviceID(r.Context(), req.DeviceID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 	if err := ensureDeviceOwnership(device, claims.UserID); err != nil {
+		recordAudit(h.audit, r, service.AuditEvent{
+			Action:   service.AuditDeviceDelete,
+			Status:   service.AuditStatusDenied,
+			UserID:   claims.UserID,
+			DeviceID: req.DeviceID,
+		})
 		http.Error(w, err.Error(), http.StatusForbidden)
 		return
 	}
 
-	err = h.deviceService.DeleteDevice(req.DeviceID)
+	err = h.deviceService.DeleteDevice(r.Context(), req.DeviceID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	for _, sessions := range h.sessions {
+		sessions.ForgetDevice(req.DeviceID)
+	}
+	recordAudit(h.audit, r, service.AuditEvent{
+		Action:   service.AuditDeviceDelete,
+		UserID:   claims.UserID,
+		DeviceID: req.DeviceID,
+	})
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
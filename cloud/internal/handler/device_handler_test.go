@@ -3,14 +3,20 @@ package handler
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	cloudauth "github.com/mobile-coder/cloud/internal/auth"
 	"github.com/mobile-coder/cloud/internal/db"
+	"github.com/mobile-coder/cloud/internal/ratelimit"
 	"github.com/mobile-coder/cloud/internal/service"
+	"github.com/mobile-coder/cloud/internal/ws"
 )
 
 func TestRequireClaimsAcceptsSignedToken(t *testing.T) {
@@ -137,3 +143,401 @@ func TestCheckDeviceRefreshesExpiredMatchingAgentToken(t *testing.T) {
 		t.Fatalf("claims = %+v, want matching agent token", claims)
 	}
 }
+
+func TestCheckDeviceDoesNotRefreshTokensPastTheGrace(t *testing.T) {
+	supabase := newSecuredDevices()
+	handler := NewDeviceHandler(service.NewDeviceService(supabase.database(t)), cloudauth.NewManager("test-secret", time.Hour))
+	staleToken, err := cloudauth.NewManager("test-secret", -cloudauth.RefreshGrace-time.Minute).IssueAgent(7, "dev-1")
+	if err != nil {
+		t.Fatalf("IssueAgent stale token: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.CheckDevice(rec, deviceRequest(t, http.MethodPost, "/api/device/check", `{"device_id":"dev-1"}`, staleToken))
+	var payload map[string]any
+	if err := json.NewDecoder(rec.Body).Decode(&payload); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if payload["agent_token"] != nil || payload["bound"] != true {
+		t.Fatalf("payload = %v, want the device bound but no agent token", payload)
+	}
+}
+
+func TestCheckDeviceLocksOutTheGuessingIP(t *testing.T) {
+	supabase := newSecuredDevices()
+	handler := NewDeviceHandler(service.NewDeviceService(supabase.database(t)), cloudauth.NewManager("test-secret", time.Hour))
+	handler.SetRateLimits(ratelimit.New(ratelimit.Policy{Limit: 3, Window: 10 * time.Minute, Lockout: time.Hour}), nil)
+
+	check := func(bindCode, remoteAddr string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(DeviceCheckRequest{DeviceID: "dev-1", BindCode: bindCode})
+		req := httptest.NewRequest(http.MethodPost, "/api/device/check", bytes.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		handler.CheckDevice(rec, req)
+		return rec
+	}
+
+	for _, guess := range []string{"000000", "000001", "000002"} {
+		if rec := check(guess, "203.0.113.5:4000"); rec.Code != http.StatusOK {
+			t.Fatalf("guess %s: status = %d, want 200", guess, rec.Code)
+		}
+	}
+	rec := check("a1b2c3", "203.0.113.5:4000")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("locked out IP: status = %d, Retry-After = %q, want 429 with Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if writes := supabase.Writes(); len(writes) != 0 {
+		t.Fatalf("writes = %v, want the bind code left alone", writes)
+	}
+
+	// Another client still gets its token with the right code
+	var payload struct {
+		AgentToken string `json:"agent_token"`
+	}
+	rec = check("a1b2c3", "198.51.100.7:4000")
+	if err := json.NewDecoder(rec.Body).Decode(&payload); err != nil || payload.AgentToken == "" {
+		t.Fatalf("status = %d, payload = %+v, err = %v, want an agent token", rec.Code, payload, err)
+	}
+}
+
+func TestCheckDeviceInvalidatesBindCodeAfterWrongGuesses(t *testing.T) {
+	supabase := newSecuredDevices()
+	handler := NewDeviceHandler(service.NewDeviceService(supabase.database(t)), cloudauth.NewManager("test-secret", time.Hour))
+	handler.SetRateLimits(nil, ratelimit.New(ratelimit.Policy{Limit: 3, Window: 10 * time.Minute, Lockout: time.Hour}))
+
+	check := func(bindCode, remoteAddr string) map[string]any {
+		body, _ := json.Marshal(DeviceCheckRequest{DeviceID: "dev-1", BindCode: bindCode})
+		req := httptest.NewRequest(http.MethodPost, "/api/device/check", bytes.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		handler.CheckDevice(rec, req)
+		var payload map[string]any
+		_ = json.NewDecoder(rec.Body).Decode(&payload)
+		return payload
+	}
+
+	// Guesses count against the code whichever IP they come from
+	check("000000", "203.0.113.5:4000")
+	check("000001", "198.51.100.7:4000")
+	if writes := supabase.Writes(); len(writes) != 0 {
+		t.Fatalf("writes = %v after 2 wrong guesses, want none", writes)
+	}
+	check("000002", "192.0.2.9:4000")
+	if writes := supabase.Writes(); len(writes) != 1 || writes[0] != "PATCH devices?device_id=eq.dev-1" {
+		t.Fatalf("writes = %v, want the bind code of dev-1 invalidated", writes)
+	}
+
+	// The agent registers again and its new code starts from zero
+	supabase.mu.Lock()
+	supabase.devices[0]["bind_code"] = "d4e5f6"
+	supabase.mu.Unlock()
+	check("000003", "203.0.113.5:4000")
+	check("000004", "203.0.113.5:4000")
+	if payload := check("d4e5f6", "203.0.113.5:4000"); payload["agent_token"] == nil {
+		t.Fatalf("payload = %v, want an agent token for the new code", payload)
+	}
+}
+
+// fakeSupabase answers PostgREST reads of devices, sessions and users with
+// the rows matching their eq filters, and records every write.
+type fakeSupabase struct {
+	mu       sync.Mutex
+	devices  []map[string]any
+	sessions []map[string]any
+	users    []map[string]any
+	writes   []string // "METHOD table?query"
+}
+
+func (f *fakeSupabase) database(t *testing.T) *db.SupabaseDB {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		table := strings.TrimPrefix(r.URL.Path, "/rest/v1/")
+		if r.Method != http.MethodGet {
+			f.writes = append(f.writes, r.Method+" "+table+"?"+r.URL.RawQuery)
+			w.Write([]byte("[]"))
+			return
+		}
+		rows := map[string][]map[string]any{"devices": f.devices, "sessions": f.sessions, "users": f.users}[table]
+		matched := []map[string]any{}
+		for _, row := range rows {
+			if rowMatches(row, r.URL.Query()) {
+				matched = append(matched, row)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(matched)
+	}))
+	t.Cleanup(server.Close)
+	return db.NewSupabaseDB(&db.Config{ProjectURL: server.URL, APIKey: "test-key"})
+}
+
+func (f *fakeSupabase) Writes() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.writes...)
+}
+
+func rowMatches(row map[string]any, query url.Values) bool {
+	for column, values := range query {
+		value, ok := strings.CutPrefix(values[0], "eq.")
+		if !ok {
+			continue
+		}
+		if fmt.Sprint(row[column]) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// newSecuredDevices has dev-1 owned by user 7 and dev-2 owned by user 9,
+// each with one session.
+func newSecuredDevices() *fakeSupabase {
+	return &fakeSupabase{
+		devices: []map[string]any{
+			{"id": 1, "user_id": 7, "device_id": "dev-1", "bind_code": "a1b2c3"},
+			{"id": 2, "user_id": 9, "device_id": "dev-2"},
+		},
+		sessions: []map[string]any{
+			{"id": 11, "device_id": "dev-1", "session_name": "api"},
+			{"id": 12, "device_id": "dev-2", "session_name": "web"},
+		},
+		users: []map[string]any{
+			{"id": 7, "email": "member@example.com", "role": "member"},
+			{"id": 8, "email": "admin@example.com", "role": service.UserRoleAdmin},
+		},
+	}
+}
+
+func deviceRequest(t *testing.T, method, target, body, token string) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	return req
+}
+
+func TestListDevicesIsAdminOnly(t *testing.T) {
+	manager := cloudauth.NewManager("test-secret", time.Hour)
+	handler := NewDeviceHandler(service.NewDeviceService(newSecuredDevices().database(t)), manager)
+	member, _ := manager.Issue(7, "member@example.com")
+	admin, _ := manager.Issue(8, "admin@example.com")
+	agent, _ := manager.IssueAgent(7, "dev-1")
+
+	for _, tc := range []struct {
+		token string
+		want  int
+	}{
+		{"", http.StatusUnauthorized},
+		{member, http.StatusForbidden},
+		{agent, http.StatusForbidden},
+		{admin, http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ListDevices(rec, deviceRequest(t, http.MethodGet, "/api/device/list", "", tc.token))
+		if rec.Code != tc.want {
+			t.Fatalf("status = %d, want %d", rec.Code, tc.want)
+		}
+		if tc.want == http.StatusOK && (!strings.Contains(rec.Body.String(), "dev-2") || strings.Contains(rec.Body.String(), "a1b2c3")) {
+			t.Fatalf("body = %s, want both devices and no bind codes", rec.Body.String())
+		}
+	}
+}
+
+func TestRegisterRejectsPendingBindCode(t *testing.T) {
+	store := newSecuredDevices()
+	pending := time.Now().Add(time.Hour).In(time.FixedZone("UTC+8", 8*3600)).Format("2006-01-02T15:04:05")
+	store.devices = append(store.devices, map[string]any{"id": 3, "user_id": 0, "device_id": "dev-3", "bind_code": "d4e5f6", "bind_code_exp": pending})
+	handler := NewDeviceHandler(service.NewDeviceService(store.database(t)), cloudauth.NewManager("test-secret", time.Hour))
+
+	for body, want := range map[string]int{
+		`{"bind_code":"d4e5f6","device_name":"laptop"}`: http.StatusConflict,
+		`{"bind_code":"1","device_name":"laptop"}`:      http.StatusBadRequest,
+	} {
+		rec := httptest.NewRecorder()
+		handler.Register(rec, deviceRequest(t, http.MethodPost, "/api/device/register", body, ""))
+		if rec.Code != want {
+			t.Fatalf("%s: status = %d, want %d", body, rec.Code, want)
+		}
+	}
+	if writes := store.Writes(); len(writes) != 0 {
+		t.Fatalf("writes = %v, want none", writes)
+	}
+}
+
+func TestBindAgentRequiresTheDevicesAgentToken(t *testing.T) {
+	store := newSecuredDevices()
+	manager := cloudauth.NewManager("test-secret", time.Hour)
+	handler := NewDeviceHandler(service.NewDeviceService(store.database(t)), manager)
+	user, _ := manager.Issue(7, "member@example.com")
+	otherAgent, _ := manager.IssueAgent(9, "dev-2")
+
+	for _, tc := range []struct {
+		token string
+		want  int
+	}{
+		{"", http.StatusUnauthorized},
+		{user, http.StatusForbidden},
+		// dev-2's agent may not consume the bind code of dev-1
+		{otherAgent, http.StatusForbidden},
+	} {
+		rec := httptest.NewRecorder()
+		handler.BindAgent(rec, deviceRequest(t, http.MethodPost, "/api/device/bind-agent", `{"bind_code":"a1b2c3"}`, tc.token))
+		if rec.Code != tc.want {
+			t.Fatalf("status = %d, want %d", rec.Code, tc.want)
+		}
+	}
+	if writes := store.Writes(); len(writes) != 0 {
+		t.Fatalf("writes = %v, want none", writes)
+	}
+}
+
+func TestBindAgentAcceptsTheRegistrationTokenOfTheDevice(t *testing.T) {
+	store := &fakeSupabase{devices: []map[string]any{
+		{"id": 3, "device_id": "dev-3", "bind_code": "c0ffee", "bind_code_exp": time.Now().Add(24 * time.Hour).Format("2006-01-02T15:04:05")},
+		{"id": 4, "device_id": "dev-4", "bind_code": "d00d00"},
+	}}
+	manager := cloudauth.NewManager("test-secret", time.Hour)
+	handler := NewDeviceHandler(service.NewDeviceService(store.database(t)), manager)
+	own, _ := manager.IssueRegistration("dev-3")
+	other, _ := manager.IssueRegistration("dev-4")
+
+	rec := httptest.NewRecorder()
+	handler.BindAgent(rec, deviceRequest(t, http.MethodPost, "/api/device/bind-agent", `{"bind_code":"c0ffee"}`, other))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("registration token of another device: status = %d, want 403", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	handler.BindAgent(rec, deviceRequest(t, http.MethodPost, "/api/device/bind-agent", `{"bind_code":"c0ffee"}`, own))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("registration token of the device: status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if writes := store.Writes(); len(writes) != 1 || !strings.Contains(writes[0], "device_id=eq.dev-3") {
+		t.Fatalf("writes = %v, want the bind code of dev-3 consumed", writes)
+	}
+}
+
+func TestDeviceRoutesRejectForeignTokens(t *testing.T) {
+	store := newSecuredDevices()
+	manager := cloudauth.NewManager("test-secret", time.Hour)
+	handler := NewDeviceHandler(service.NewDeviceService(store.database(t)), manager)
+	// User 7 owns dev-1 but not dev-2; the agent of dev-1 belongs to the
+	// same user yet may only act on dev-1.
+	user, _ := manager.Issue(7, "member@example.com")
+	agent, _ := manager.IssueAgent(7, "dev-1")
+
+	for _, tc := range []struct {
+		name   string
+		handle http.HandlerFunc
+		method string
+		target string
+		body   string
+		token  string
+	}{
+		{"sessions of a foreign device", handler.GetDeviceSessions, http.MethodGet, "/api/devices/sessions?device_id=dev-2", "", user},
+		{"create session on a foreign device", handler.CreateSession, http.MethodPost, "/api/sessions", `{"device_id":"dev-2","session_name":"x"}`, user},
+		{"create session with another device's agent token", handler.CreateSession, http.MethodPost, "/api/sessions", `{"device_id":"dev-2","session_name":"x"}`, agent},
+		{"delete a foreign session", handler.DeleteSession, http.MethodPost, "/api/sessions/delete", `{"session_id":12}`, user},
+		{"delete session with another device's agent token", handler.DeleteSession, http.MethodPost, "/api/sessions/delete", `{"session_id":12}`, agent},
+		{"rename a foreign device", handler.UpdateDevice, http.MethodPost, "/api/device/update", `{"device_id":"dev-2","device_name":"x"}`, user},
+		{"delete a foreign device", handler.DeleteDevice, http.MethodPost, "/api/device/delete", `{"device_id":"dev-2"}`, user},
+	} {
+		rec := httptest.NewRecorder()
+		tc.handle(rec, deviceRequest(t, tc.method, tc.target, tc.body, tc.token))
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s: status = %d, want 403", tc.name, rec.Code)
+		}
+	}
+	if writes := store.Writes(); len(writes) != 0 {
+		t.Fatalf("writes = %v, want none", writes)
+	}
+}
+
+func TestDeleteSessionChecksOwnership(t *testing.T) {
+	store := newSecuredDevices()
+	manager := cloudauth.NewManager("test-secret", time.Hour)
+	handler := NewDeviceHandler(service.NewDeviceService(store.database(t)), manager)
+	audit := &recordingAudit{}
+	handler.SetAuditRecorder(audit)
+	user, _ := manager.Issue(7, "member@example.com")
+
+	rec := httptest.NewRecorder()
+	handler.DeleteSession(rec, deviceRequest(t, http.MethodPost, "/api/sessions/delete", `{"session_id":12}`, user))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("foreign session: status = %d, want 403", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	handler.DeleteSession(rec, deviceRequest(t, http.MethodPost, "/api/sessions/delete", `{"session_id":99}`, user))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("missing session: status = %d, want 404", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	handler.DeleteSession(rec, deviceRequest(t, http.MethodPost, "/api/sessions/delete", `{"session_id":11}`, user))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("own session: status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+
+	if writes := store.Writes(); len(writes) != 1 || writes[0] != "DELETE sessions?id=eq.11" {
+		t.Fatalf("writes = %v, want only session 11 deleted", writes)
+	}
+	if len(audit.events) != 2 || audit.events[0].Status != service.AuditStatusDenied || audit.events[0].DeviceID != "dev-2" ||
+		audit.events[1].Status != "" || audit.events[1].SessionName != "api" {
+		t.Fatalf("events = %+v", audit.events)
+	}
+}
+
+type fakePresence []ws.ClientPresence
+
+func (f fakePresence) AgentInfo(deviceID string) *service.AgentInfo { return nil }
+
+func (f fakePresence) AgentLastSeen(deviceID string) (time.Time, bool) { return time.Time{}, false }
+
+func (f fakePresence) Presence(deviceID string) []ws.ClientPresence {
+	var clients []ws.ClientPresence
+	for _, client := range f {
+		if client.DeviceID == deviceID {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+func TestGetDevicePresenceListsOwnDevicesOnly(t *testing.T) {
+	manager := cloudauth.NewManager("test-secret", time.Hour)
+	handler := NewDeviceHandler(service.NewDeviceService(newSecuredDevices().database(t)), manager)
+	handler.SetAgentInfoSource(fakePresence{
+		{DeviceID: "dev-1", SessionName: "api", IsAgent: true, QueueDepth: 3},
+		{DeviceID: "dev-2", SessionName: "web", IsAgent: true},
+	})
+	member, _ := manager.Issue(7, "member@example.com")
+
+	for target, want := range map[string]int{
+		"/api/devices/presence?device_id=dev-1": http.StatusOK,
+		"/api/devices/presence?device_id=dev-2": http.StatusForbidden,
+		"/api/devices/presence":                 http.StatusBadRequest,
+	} {
+		rec := httptest.NewRecorder()
+		handler.GetDevicePresence(rec, deviceRequest(t, http.MethodGet, target, "", member))
+		if rec.Code != want {
+			t.Fatalf("%s: status = %d, want %d", target, rec.Code, want)
+		}
+		if want != http.StatusOK {
+			continue
+		}
+		var body struct {
+			Clients []ws.ClientPresence `json:"clients"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || len(body.Clients) != 1 || body.Clients[0].QueueDepth != 3 {
+			t.Fatalf("body = %+v (%v), want the agent of dev-1", body, err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handler.GetDevicePresence(rec, deviceRequest(t, http.MethodGet, "/api/devices/presence?device_id=dev-1", "", ""))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status without token = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	cloudauth "github.com/mobile-coder/cloud/internal/auth"
+	"github.com/mobile-coder/cloud/internal/service"
+)
+
+type taskDiffService interface {
+	GetTaskDiff(ctx context.Context, userID int64, taskID, base string) (*service.TaskDiff, error)
+}
+
+type DiffHandler struct {
+	diffService  taskDiffService
+	tokenManager *cloudauth.Manager
+}
+
+func NewDiffHandler(diffService taskDiffService, tokenManager *cloudauth.Manager) *DiffHandler {
+	return &DiffHandler{
+		diffService:  diffService,
+		tokenManager: tokenManager,
+	}
+}
+
+// GetTaskDiff returns the structured diff of a task's project, compared to
+// HEAD or to the branch given in ?base=.
+func (h *DiffHandler) GetTaskDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := requireClaimsFromRequest(r, h.tokenManager)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	taskID := r.URL.Query().Get("task_id")
+	if taskID == "" {
+		http.Error(w, "task_id is required", http.StatusBadRequest)
+		return
+	}
+
+	diff, err := h.diffService.GetTaskDiff(r.Context(), claims.UserID, taskID, r.URL.Query().Get("base"))
+	if err != nil {
+		writeAgentRequestError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"diff": diff,
+	})
+}
+
+// writeAgentRequestError maps errors of requests proxied to an agent.
+func writeAgentRequestError(w http.ResponseWriter, err error) {
+	var agentErr *service.AgentError
+	if errors.As(err, &agentErr) {
+		switch agentErr.Code {
+		case service.AgentErrorForbidden:
+			http.Error(w, agentErr.Message, http.StatusForbidden)
+			return
+		case service.AgentErrorNotFound:
+			http.Error(w, agentErr.Message, http.StatusNotFound)
+			return
+		case service.AgentErrorInvalid:
+			http.Error(w, agentErr.Message, http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch {
+	case errors.Is(err, service.ErrTaskNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, service.ErrAgentUnavailable):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, service.ErrAgentIncompatible):
+		http.Error(w, err.Error(), http.StatusUpgradeRequired)
+	case errors.Is(err, service.ErrAgentUnsupported):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+	case errors.Is(err, service.ErrAgentTimeout):
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	case errors.Is(err, service.ErrAgentRequestFailed):
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
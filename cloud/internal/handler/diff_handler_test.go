@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	cloudauth "github.com/mobile-coder/cloud/internal/auth"
+	"github.com/mobile-coder/cloud/internal/service"
+)
+
+type fakeTaskDiffService struct {
+	userID int64
+	taskID string
+	base   string
+	err    error
+}
+
+func (f *fakeTaskDiffService) GetTaskDiff(ctx context.Context, userID int64, taskID, base string) (*service.TaskDiff, error) {
+	f.userID, f.taskID, f.base = userID, taskID, base
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &service.TaskDiff{TaskID: taskID, Base: "HEAD", Files: []service.FileDiff{{Path: "main.go", Status: "modified", Additions: 3}}}, nil
+}
+
+func newDiffHandlerForTest(t *testing.T, svc *fakeTaskDiffService) (*DiffHandler, string) {
+	t.Helper()
+
+	manager := cloudauth.NewManager("test-secret", time.Hour)
+	token, err := manager.Issue(42, "user@example.com")
+	if err != nil {
+		t.Fatalf("Issue token: %v", err)
+	}
+	return NewDiffHandler(svc, manager), token
+}
+
+func TestDiffHandlerReturnsTaskDiff(t *testing.T) {
+	svc := &fakeTaskDiffService{}
+	handler, token := newDiffHandlerForTest(t, svc)
+
+	rr := httptest.NewRecorder()
+	handler.GetTaskDiff(rr, newNotificationRequest(http.MethodGet, "/api/tasks/diff?task_id=task-1&base=main", nil, token))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	if svc.userID != 42 || svc.taskID != "task-1" || svc.base != "main" {
+		t.Fatalf("service got user=%d task=%q base=%q", svc.userID, svc.taskID, svc.base)
+	}
+	var resp map[string]service.TaskDiff
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unmarshal response: %v", err)
+	}
+	if len(resp["diff"].Files) != 1 || resp["diff"].Files[0].Path != "main.go" {
+		t.Fatalf("diff = %+v", resp["diff"])
+	}
+
+	rr = httptest.NewRecorder()
+	handler.GetTaskDiff(rr, newNotificationRequest(http.MethodGet, "/api/tasks/diff", nil, token))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("missing task_id status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestDiffHandlerMapsAgentErrors(t *testing.T) {
+	cases := map[error]int{
+		service.ErrTaskNotFound:       http.StatusNotFound,
+		service.ErrAgentUnavailable:   http.StatusServiceUnavailable,
+		service.ErrAgentTimeout:       http.StatusGatewayTimeout,
+		service.ErrAgentRequestFailed: http.StatusBadGateway,
+	}
+	for err, want := range cases {
+		handler, token := newDiffHandlerForTest(t, &fakeTaskDiffService{err: err})
+		rr := httptest.NewRecorder()
+		handler.GetTaskDiff(rr, newNotificationRequest(http.MethodGet, "/api/tasks/diff?task_id=task-1", nil, token))
+		if rr.Code != want {
+			t.Fatalf("%v: status = %d, want %d", err, rr.Code, want)
+		}
+	}
+}
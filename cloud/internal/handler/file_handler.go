@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	cloudauth "github.com/mobile-coder/cloud/internal/auth"
+	"github.com/mobile-coder/cloud/internal/service"
+)
+
+type taskFileService interface {
+	ListFiles(ctx context.Context, userID int64, taskID, path string) (*service.DirListing, error)
+	ReadFile(ctx context.Context, userID int64, taskID, path string) (*service.FileContent, error)
+}
+
+type FileHandler struct {
+	fileService  taskFileService
+	tokenManager *cloudauth.Manager
+}
+
+func NewFileHandler(fileService taskFileService, tokenManager *cloudauth.Manager) *FileHandler {
+	return &FileHandler{
+		fileService:  fileService,
+		tokenManager: tokenManager,
+	}
+}
+
+// ListFiles lists ?path= (relative to the project root) of a task's project.
+func (h *FileHandler) ListFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := requireClaimsFromRequest(r, h.tokenManager)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	taskID := r.URL.Query().Get("task_id")
+	if taskID == "" {
+		http.Error(w, "task_id is required", http.StatusBadRequest)
+		return
+	}
+
+	listing, err := h.fileService.ListFiles(r.Context(), claims.UserID, taskID, r.URL.Query().Get("path"))
+	if err != nil {
+		writeAgentRequestError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"listing": listing,
+	})
+}
+
+// GetFile returns the file ?path= of a task's project.
+func (h *FileHandler) GetFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := requireClaimsFromRequest(r, h.tokenManager)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	taskID := r.URL.Query().Get("task_id")
+	path := r.URL.Query().Get("path")
+	if taskID == "" || path == "" {
+		http.Error(w, "task_id and path are required", http.StatusBadRequest)
+		return
+	}
+
+	file, err := h.fileService.ReadFile(r.Context(), claims.UserID, taskID, path)
+	if err != nil {
+		writeAgentRequestError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"file": file,
+	})
+}
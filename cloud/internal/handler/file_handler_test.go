@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	cloudauth "github.com/mobile-coder/cloud/internal/auth"
+	"github.com/mobile-coder/cloud/internal/service"
+)
+
+type fakeTaskFileService struct {
+	path string
+	err  error
+}
+
+func (f *fakeTaskFileService) ListFiles(ctx context.Context, userID int64, taskID, path string) (*service.DirListing, error) {
+	f.path = path
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &service.DirListing{TaskID: taskID, Path: path, Entries: []service.FileEntry{{Name: "main.go", Path: "main.go", Type: "file"}}}, nil
+}
+
+func (f *fakeTaskFileService) ReadFile(ctx context.Context, userID int64, taskID, path string) (*service.FileContent, error) {
+	f.path = path
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &service.FileContent{TaskID: taskID, Path: path, Content: "package main\n"}, nil
+}
+
+func newFileHandlerForTest(t *testing.T, svc *fakeTaskFileService) (*FileHandler, string) {
+	t.Helper()
+
+	manager := cloudauth.NewManager("test-secret", time.Hour)
+	token, err := manager.Issue(42, "user@example.com")
+	if err != nil {
+		t.Fatalf("Issue token: %v", err)
+	}
+	return NewFileHandler(svc, manager), token
+}
+
+func TestFileHandlerListsAndReadsFiles(t *testing.T) {
+	svc := &fakeTaskFileService{}
+	handler, token := newFileHandlerForTest(t, svc)
+
+	rr := httptest.NewRecorder()
+	handler.ListFiles(rr, newNotificationRequest(http.MethodGet, "/api/tasks/files?task_id=task-1&path=src", nil, token))
+	if rr.Code != http.StatusOK || svc.path != "src" {
+		t.Fatalf("list status = %d path = %q: %s", rr.Code, svc.path, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	handler.GetFile(rr, newNotificationRequest(http.MethodGet, "/api/tasks/file?task_id=task-1&path=main.go", nil, token))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("file status = %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp map[string]service.FileContent
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unmarshal response: %v", err)
+	}
+	if resp["file"].Content != "package main\n" {
+		t.Fatalf("file = %+v", resp["file"])
+	}
+
+	rr = httptest.NewRecorder()
+	handler.GetFile(rr, newNotificationRequest(http.MethodGet, "/api/tasks/file?task_id=task-1", nil, token))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("missing path status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestFileHandlerMapsAgentErrorCodes(t *testing.T) {
+	cases := map[string]int{
+		service.AgentErrorForbidden: http.StatusForbidden,
+		service.AgentErrorNotFound:  http.StatusNotFound,
+		service.AgentErrorInvalid:   http.StatusBadRequest,
+		"failed":                    http.StatusBadGateway,
+	}
+	for code, want := range cases {
+		svc := &fakeTaskFileService{err: &service.AgentError{Code: code, Message: "refused"}}
+		handler, token := newFileHandlerForTest(t, svc)
+		rr := httptest.NewRecorder()
+		handler.GetFile(rr, newNotificationRequest(http.MethodGet, "/api/tasks/file?task_id=task-1&path=x", nil, token))
+		if rr.Code != want {
+			t.Fatalf("%s: status = %d, want %d", code, rr.Code, want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	cloudauth "github.com/mobile-coder/cloud/internal/auth"
+	"github.com/mobile-coder/cloud/internal/service"
+)
+
+type gitActionService interface {
+	RunGitAction(ctx context.Context, userID int64, input service.GitActionInput) (*service.GitActionResult, error)
+}
+
+type GitActionHandler struct {
+	gitActionService gitActionService
+	tokenManager     *cloudauth.Manager
+}
+
+func NewGitActionHandler(gitActionService gitActionService, tokenManager *cloudauth.Manager) *GitActionHandler {
+	return &GitActionHandler{
+		gitActionService: gitActionService,
+		tokenManager:     tokenManager,
+	}
+}
+
+// RunGitAction commits, discards, stashes, branches or pushes in the project
+// of a task.
+func (h *GitActionHandler) RunGitAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := requireClaimsFromRequest(r, h.tokenManager)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var req service.GitActionInput
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TaskID == "" {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.SourceIP = clientIP(r)
+
+	result, err := h.gitActionService.RunGitAction(r.Context(), claims.UserID, req)
+	if err != nil {
+		writeGitActionError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"result": result,
+	})
+}
+
+func writeGitActionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, service.ErrInvalidGitAction):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, service.ErrGitActionForbidden), errors.Is(err, service.ErrGitActionNotAllowed):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, service.ErrGitActionFailed):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		writeAgentRequestError(w, err)
+	}
+}
@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	cloudauth "github.com/mobile-coder/cloud/internal/auth"
+	"github.com/mobile-coder/cloud/internal/service"
+)
+
+type fakeGitActionService struct {
+	inputs []service.GitActionInput
+	err    error
+}
+
+func (f *fakeGitActionService) RunGitAction(ctx context.Context, userID int64, input service.GitActionInput) (*service.GitActionResult, error) {
+	f.inputs = append(f.inputs, input)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &service.GitActionResult{Action: input.Action, OK: true, Summary: "git push: main pushed"}, nil
+}
+
+func newGitActionHandlerForTest(t *testing.T, svc *fakeGitActionService) (*GitActionHandler, string) {
+	t.Helper()
+
+	manager := cloudauth.NewManager("test-secret", time.Hour)
+	token, err := manager.Issue(42, "user@example.com")
+	if err != nil {
+		t.Fatalf("Issue token: %v", err)
+	}
+	return NewGitActionHandler(svc, manager), token
+}
+
+func TestGitActionHandlerRunsAction(t *testing.T) {
+	svc := &fakeGitActionService{}
+	handler, token := newGitActionHandlerForTest(t, svc)
+
+	body, _ := json.Marshal(service.GitActionInput{TaskID: "task-1", Action: "push"})
+	rr := httptest.NewRecorder()
+	handler.RunGitAction(rr, newNotificationRequest(http.MethodPost, "/api/tasks/git", body, token))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	if len(svc.inputs) != 1 || svc.inputs[0].Action != "push" {
+		t.Fatalf("inputs = %+v", svc.inputs)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.RunGitAction(rr, newNotificationRequest(http.MethodGet, "/api/tasks/git", nil, token))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET status = %d, want %d", rr.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestGitActionHandlerMapsErrors(t *testing.T) {
+	cases := map[error]int{
+		service.ErrInvalidGitAction:    http.StatusBadRequest,
+		service.ErrGitActionForbidden:  http.StatusForbidden,
+		service.ErrGitActionNotAllowed: http.StatusForbidden,
+		service.ErrGitActionFailed:     http.StatusConflict,
+		service.ErrAgentUnavailable:    http.StatusServiceUnavailable,
+	}
+	for err, want := range cases {
+		handler, token := newGitActionHandlerForTest(t, &fakeGitActionService{err: err})
+		body, _ := json.Marshal(service.GitActionInput{TaskID: "task-1", Action: "stash"})
+		rr := httptest.NewRecorder()
+		handler.RunGitAction(rr, newNotificationRequest(http.MethodPost, "/api/tasks/git", body, token))
+		if rr.Code != want {
+			t.Fatalf("%v: status = %d, want %d", err, rr.Code, want)
+		}
+	}
+}
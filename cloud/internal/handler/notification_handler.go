@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
@@ -13,9 +14,9 @@ import (
 )
 
 type notificationService interface {
-	ListNotifications(userID int64, unreadOnly bool, since *time.Time, limit int) ([]db.Notification, error)
-	MarkNotificationRead(userID, notificationID int64) error
-	MarkAllNotificationsRead(userID int64) error
+	ListNotifications(ctx context.Context, userID int64, unreadOnly bool, since *time.Time, limit int) ([]db.Notification, error)
+	MarkNotificationRead(ctx context.Context, userID, notificationID int64) error
+	MarkAllNotificationsRead(ctx context.Context, userID int64) error
 }
 
 type NotificationHandler struct {
@@ -25,7 +26,7 @@ type NotificationHandler struct {
 }
 
 type notificationRefresher interface {
-	RefreshNotificationsForUser(userID int64) error
+	RefreshNotificationsForUser(ctx context.Context, userID int64) error
 }
 
 func NewNotificationHandler(service notificationService, tokenManager *cloudauth.Manager, refresher ...notificationRefresher) *NotificationHandler {
@@ -39,11 +40,11 @@ func NewNotificationHandler(service notificationService, tokenManager *cloudauth
 	return handler
 }
 
-func (h *NotificationHandler) refreshNotifications(userID int64) error {
+func (h *NotificationHandler) refreshNotifications(ctx context.Context, userID int64) error {
 	if h.refresher == nil {
 		return nil
 	}
-	return h.refresher.RefreshNotificationsForUser(userID)
+	return h.refresher.RefreshNotificationsForUser(ctx, userID)
 }
 
 func (h *NotificationHandler) ListNotifications(w http.ResponseWriter, r *http.Request) {
@@ -65,7 +66,7 @@ func (h *NotificationHandler) ListNotifications(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	if err := h.refreshNotifications(claims.UserID); err != nil {
+	if err := h.refreshNotifications(r.Context(), claims.UserID); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -76,7 +77,7 @@ func (h *NotificationHandler) ListNotifications(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	notifications, err := h.service.ListNotifications(claims.UserID, unreadOnly, since, limit)
+	notifications, err := h.service.ListNotifications(r.Context(), claims.UserID, unreadOnly, since, limit)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -105,7 +106,7 @@ func (h *NotificationHandler) MarkNotificationRead(w http.ResponseWriter, r *htt
 		return
 	}
 
-	if err := h.service.MarkNotificationRead(claims.UserID, req.NotificationID); err != nil {
+	if err := h.service.MarkNotificationRead(r.Context(), claims.UserID, req.NotificationID); err != nil {
 		switch {
 		case errors.Is(err, service.ErrNotificationAccessDenied):
 			http.Error(w, err.Error(), http.StatusForbidden)
@@ -130,7 +131,7 @@ func (h *NotificationHandler) MarkAllNotificationsRead(w http.ResponseWriter, r
 		return
 	}
 
-	if err := h.service.MarkAllNotificationsRead(claims.UserID); err != nil {
+	if err := h.service.MarkAllNotificationsRead(r.Context(), claims.UserID); err != nil {
 		switch {
 		case errors.Is(err, service.ErrNotificationAccessDenied):
 			http.Error(w, err.Error(), http.StatusForbidden)
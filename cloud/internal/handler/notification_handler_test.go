@@ -2,6 +2,7 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
@@ -41,7 +42,7 @@ type notificationReadCall struct {
 	notificationID int64
 }
 
-func (f *fakeNotificationService) ListNotifications(userID int64, unreadOnly bool, since *time.Time, limit int) ([]db.Notification, error) {
+func (f *fakeNotificationService) ListNotifications(ctx context.Context, userID int64, unreadOnly bool, since *time.Time, limit int) ([]db.Notification, error) {
 	f.listCalls = append(f.listCalls, notificationListCall{
 		userID:     userID,
 		unreadOnly: unreadOnly,
@@ -54,7 +55,7 @@ func (f *fakeNotificationService) ListNotifications(userID int64, unreadOnly boo
 	return nil, nil
 }
 
-func (f *fakeNotificationService) MarkNotificationRead(userID, notificationID int64) error {
+func (f *fakeNotificationService) MarkNotificationRead(ctx context.Context, userID, notificationID int64) error {
 	f.markReadCalls = append(f.markReadCalls, notificationReadCall{
 		userID:         userID,
 		notificationID: notificationID,
@@ -65,7 +66,7 @@ func (f *fakeNotificationService) MarkNotificationRead(userID, notificationID in
 	return nil
 }
 
-func (f *fakeNotificationService) MarkAllNotificationsRead(userID int64) error {
+func (f *fakeNotificationService) MarkAllNotificationsRead(ctx context.Context, userID int64) error {
 	f.markAllCalls = append(f.markAllCalls, userID)
 	if f.markAllNotificationsReadFn != nil {
 		return f.markAllNotificationsReadFn(userID)
@@ -73,7 +74,7 @@ func (f *fakeNotificationService) MarkAllNotificationsRead(userID int64) error {
 	return nil
 }
 
-func (f *fakeNotificationRefresher) RefreshNotificationsForUser(userID int64) error {
+func (f *fakeNotificationRefresher) RefreshNotificationsForUser(ctx context.Context, userID int64) error {
 	f.refreshCalls = append(f.refreshCalls, userID)
 	if f.refreshFn != nil {
 		return f.refreshFn(userID)
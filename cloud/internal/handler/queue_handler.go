@@ -0,0 +1,237 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	cloudauth "github.com/mobile-coder/cloud/internal/auth"
+	"github.com/mobile-coder/cloud/internal/db"
+	"github.com/mobile-coder/cloud/internal/service"
+)
+
+type taskQueueService interface {
+	Enqueue(ctx context.Context, userID int64, deviceID, sessionName, title, prompt string) (*db.TaskQueueItem, error)
+	GetQueue(ctx context.Context, deviceID, sessionName string) (*service.TaskQueue, error)
+	Reorder(ctx context.Context, deviceID, sessionName string, itemIDs []int64) error
+	Cancel(ctx context.Context, userID, itemID int64) (*db.TaskQueueItem, error)
+	Resume(ctx context.Context, deviceID, sessionName string) error
+}
+
+type deviceLookup interface {
+	GetDeviceByDeviceID(ctx context.Context, deviceID string) (*service.Device, error)
+}
+
+type QueueHandler struct {
+	queueService  taskQueueService
+	deviceService deviceLookup
+	tokenManager  *cloudauth.Manager
+}
+
+func NewQueueHandler(queueService taskQueueService, deviceService deviceLookup, tokenManager *cloudauth.Manager) *QueueHandler {
+	return &QueueHandler{
+		queueService:  queueService,
+		deviceService: deviceService,
+		tokenManager:  tokenManager,
+	}
+}
+
+type EnqueuePromptRequest struct {
+	DeviceID    string `json:"device_id"`
+	SessionName string `json:"session_name"`
+	Title       string `json:"title"`
+	Prompt      string `json:"prompt"`
+}
+
+type ReorderQueueRequest struct {
+	DeviceID    string  `json:"device_id"`
+	SessionName string  `json:"session_name"`
+	ItemIDs     []int64 `json:"item_ids"`
+}
+
+type CancelQueueItemRequest struct {
+	ItemID int64 `json:"item_id"`
+}
+
+type ResumeQueueRequest struct {
+	DeviceID    string `json:"device_id"`
+	SessionName string `json:"session_name"`
+}
+
+// authorizeSession checks the caller owns the device the session runs on.
+func (h *QueueHandler) authorizeSession(w http.ResponseWriter, r *http.Request, deviceID, sessionName string) (*cloudauth.Claims, bool) {
+	claims, err := requireClaimsFromRequest(r, h.tokenManager)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, false
+	}
+	if deviceID == "" || sessionName == "" {
+		http.Error(w, "device_id and session_name required", http.StatusBadRequest)
+		return nil, false
+	}
+
+	device, err := h.deviceService.GetDeviceByDeviceID(r.Context(), deviceID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	if err := ensureDeviceOwnership(device, claims.UserID); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil, false
+	}
+	return claims, true
+}
+
+// GetQueue returns the pending and running prompts of a session.
+func (h *QueueHandler) GetQueue(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.URL.Query().Get("device_id")
+	sessionName := r.URL.Query().Get("session_name")
+	if _, ok := h.authorizeSession(w, r, deviceID, sessionName); !ok {
+		return
+	}
+
+	queue, err := h.queueService.GetQueue(r.Context(), deviceID, sessionName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"queue": queue,
+	})
+}
+
+// Enqueue appends a prompt to a session queue.
+func (h *QueueHandler) Enqueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req EnqueuePromptRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	claims, ok := h.authorizeSession(w, r, req.DeviceID, req.SessionName)
+	if !ok {
+		return
+	}
+
+	item, err := h.queueService.Enqueue(r.Context(), claims.UserID, req.DeviceID, req.SessionName, req.Title, req.Prompt)
+	if err != nil {
+		if errors.Is(err, service.ErrEmptyPrompt) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"item": item,
+	})
+}
+
+// Reorder sets the dispatch order of the queued prompts of a session.
+func (h *QueueHandler) Reorder(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ReorderQueueRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if _, ok := h.authorizeSession(w, r, req.DeviceID, req.SessionName); !ok {
+		return
+	}
+
+	if err := h.queueService.Reorder(r.Context(), req.DeviceID, req.SessionName, req.ItemIDs); err != nil {
+		if errors.Is(err, service.ErrInvalidQueueOrder) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "ok",
+	})
+}
+
+// Cancel drops a queued prompt before it is dispatched.
+func (h *QueueHandler) Cancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := requireClaimsFromRequest(r, h.tokenManager)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var req CancelQueueItemRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.ItemID <= 0 {
+		http.Error(w, "item_id required", http.StatusBadRequest)
+		return
+	}
+
+	item, err := h.queueService.Cancel(r.Context(), claims.UserID, req.ItemID)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrQueueItemNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, service.ErrQueueItemNotCancellable):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"item": item,
+	})
+}
+
+// Resume restarts a queue paused by a failure or a prompt awaiting input.
+func (h *QueueHandler) Resume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ResumeQueueRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if _, ok := h.authorizeSession(w, r, req.DeviceID, req.SessionName); !ok {
+		return
+	}
+
+	if err := h.queueService.Resume(r.Context(), req.DeviceID, req.SessionName); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "ok",
+	})
+}
@@ -0,0 +1,217 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	cloudauth "github.com/mobile-coder/cloud/internal/auth"
+	"github.com/mobile-coder/cloud/internal/db"
+	"github.com/mobile-coder/cloud/internal/service"
+	"github.com/mobile-coder/cloud/internal/ws"
+)
+
+type fakeTaskQueueService struct {
+	enqueued   []EnqueuePromptRequest
+	userIDs    []int64
+	reordered  []int64
+	resumed    []string
+	enqueueErr error
+	reorderErr error
+	cancelErr  error
+}
+
+func (f *fakeTaskQueueService) Enqueue(ctx context.Context, userID int64, deviceID, sessionName, title, prompt string) (*db.TaskQueueItem, error) {
+	if f.enqueueErr != nil {
+		return nil, f.enqueueErr
+	}
+	f.userIDs = append(f.userIDs, userID)
+	f.enqueued = append(f.enqueued, EnqueuePromptRequest{DeviceID: deviceID, SessionName: sessionName, Title: title, Prompt: prompt})
+	return &db.TaskQueueItem{ID: 1, UserID: userID, DeviceID: deviceID, SessionName: sessionName, Prompt: prompt, Status: string(service.QueueItemDispatched)}, nil
+}
+
+func (f *fakeTaskQueueService) GetQueue(ctx context.Context, deviceID, sessionName string) (*service.TaskQueue, error) {
+	return &service.TaskQueue{DeviceID: deviceID, SessionName: sessionName, Items: []db.TaskQueueItem{}}, nil
+}
+
+func (f *fakeTaskQueueService) Reorder(ctx context.Context, deviceID, sessionName string, itemIDs []int64) error {
+	if f.reorderErr != nil {
+		return f.reorderErr
+	}
+	f.reordered = itemIDs
+	return nil
+}
+
+func (f *fakeTaskQueueService) Cancel(ctx context.Context, userID, itemID int64) (*db.TaskQueueItem, error) {
+	if f.cancelErr != nil {
+		return nil, f.cancelErr
+	}
+	return &db.TaskQueueItem{ID: itemID, UserID: userID, Status: string(service.QueueItemCancelled)}, nil
+}
+
+func (f *fakeTaskQueueService) Resume(ctx context.Context, deviceID, sessionName string) error {
+	f.resumed = append(f.resumed, deviceID+"/"+sessionName)
+	return nil
+}
+
+func newQueueHandlerForTest(t *testing.T, svc *fakeTaskQueueService) (*QueueHandler, string) {
+	t.Helper()
+
+	manager := cloudauth.NewManager("test-secret", time.Hour)
+	token, err := manager.Issue(42, "user@example.com")
+	if err != nil {
+		t.Fatalf("Issue token: %v", err)
+	}
+	devices := &fakeDeviceLookup{devices: map[string]*service.Device{
+		"dev-own":   {UserID: 42, DeviceID: "dev-own"},
+		"dev-other": {UserID: 7, DeviceID: "dev-other"},
+	}}
+	return NewQueueHandler(svc, devices, manager), token
+}
+
+func TestQueueHandlerChecksSessionOwnership(t *testing.T) {
+	svc := &fakeTaskQueueService{}
+	handler, token := newQueueHandlerForTest(t, svc)
+
+	rr := httptest.NewRecorder()
+	handler.GetQueue(rr, newNotificationRequest(http.MethodGet, "/api/queue?device_id=dev-own&session_name=feature", nil, ""))
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("status without token = %d, want %d", rr.Code, http.StatusUnauthorized)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.GetQueue(rr, newNotificationRequest(http.MethodGet, "/api/queue?device_id=dev-other&session_name=feature", nil, token))
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("status for foreign device = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.GetQueue(rr, newNotificationRequest(http.MethodGet, "/api/queue?device_id=dev-own", nil, token))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("status without session = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+
+	body, _ := json.Marshal(EnqueuePromptRequest{DeviceID: "dev-other", SessionName: "feature", Prompt: "run tests"})
+	rr = httptest.NewRecorder()
+	handler.Enqueue(rr, newNotificationRequest(http.MethodPost, "/api/queue/enqueue", body, token))
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("enqueue status for foreign device = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+	if len(svc.enqueued) != 0 {
+		t.Fatalf("enqueued = %+v, want nothing for a foreign device", svc.enqueued)
+	}
+}
+
+func TestQueueHandlerEnqueue(t *testing.T) {
+	svc := &fakeTaskQueueService{}
+	handler, token := newQueueHandlerForTest(t, svc)
+
+	body, _ := json.Marshal(EnqueuePromptRequest{DeviceID: "dev-own", SessionName: "feature", Title: "Tests", Prompt: "run tests"})
+	rr := httptest.NewRecorder()
+	handler.Enqueue(rr, newNotificationRequest(http.MethodPost, "/api/queue/enqueue", body, token))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	if len(svc.enqueued) != 1 || svc.userIDs[0] != 42 || svc.enqueued[0].Prompt != "run tests" {
+		t.Fatalf("enqueued = %+v by %v, want the prompt of user 42", svc.enqueued, svc.userIDs)
+	}
+	var response struct {
+		Item db.TaskQueueItem `json:"item"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil || response.Item.ID != 1 {
+		t.Fatalf("response = %+v (%v), want the created item", response, err)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.Enqueue(rr, newNotificationRequest(http.MethodGet, "/api/queue/enqueue", nil, token))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET status = %d, want %d", rr.Code, http.StatusMethodNotAllowed)
+	}
+
+	svc.enqueueErr = service.ErrEmptyPrompt
+	body, _ = json.Marshal(EnqueuePromptRequest{DeviceID: "dev-own", SessionName: "feature", Prompt: " "})
+	rr = httptest.NewRecorder()
+	handler.Enqueue(rr, newNotificationRequest(http.MethodPost, "/api/queue/enqueue", body, token))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("empty prompt status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestQueueHandlerReorderRejectsInvalidOrder(t *testing.T) {
+	svc := &fakeTaskQueueService{reorderErr: service.ErrInvalidQueueOrder}
+	handler, token := newQueueHandlerForTest(t, svc)
+
+	body, _ := json.Marshal(ReorderQueueRequest{DeviceID: "dev-own", SessionName: "feature", ItemIDs: []int64{2}})
+	rr := httptest.NewRecorder()
+	handler.Reorder(rr, newNotificationRequest(http.MethodPost, "/api/queue/reorder", body, token))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestQueueHandlerCancelMapsErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		body string
+		err  error
+		want int
+	}{
+		{name: "missing item", body: `{}`, want: http.StatusBadRequest},
+		{name: "not found", body: `{"item_id":3}`, err: service.ErrQueueItemNotFound, want: http.StatusNotFound},
+		{name: "already running", body: `{"item_id":3}`, err: service.ErrQueueItemNotCancellable, want: http.StatusConflict},
+		{name: "cancelled", body: `{"item_id":3}`, want: http.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			handler, token := newQueueHandlerForTest(t, &fakeTaskQueueService{cancelErr: tc.err})
+			rr := httptest.NewRecorder()
+			handler.Cancel(rr, newNotificationRequest(http.MethodPost, "/api/queue/cancel", []byte(tc.body), token))
+			if rr.Code != tc.want {
+				t.Fatalf("status = %d, want %d", rr.Code, tc.want)
+			}
+		})
+	}
+}
+
+func TestQueueHandlerResume(t *testing.T) {
+	svc := &fakeTaskQueueService{}
+	handler, token := newQueueHandlerForTest(t, svc)
+
+	body, _ := json.Marshal(ResumeQueueRequest{DeviceID: "dev-own", SessionName: "feature"})
+	rr := httptest.NewRecorder()
+	handler.Resume(rr, newNotificationRequest(http.MethodPost, "/api/queue/resume", body, token))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	if len(svc.resumed) != 1 || svc.resumed[0] != "dev-own/feature" {
+		t.Fatalf("resumed = %v, want dev-own/feature", svc.resumed)
+	}
+}
+
+type recordingPromptDone struct {
+	items []int64
+}
+
+func (r *recordingPromptDone) HandlePromptDone(ctx context.Context, deviceID, sessionName string, itemID int64) {
+	r.items = append(r.items, itemID)
+}
+
+func TestPromptDoneIsOnlyTakenFromAgents(t *testing.T) {
+	done := &recordingPromptDone{}
+	handler := &WSHubHandler{}
+	handler.SetPromptDoneHandler(done)
+	envelope := &ws.Envelope{Type: "prompt_done", Payload: json.RawMessage(`{"queue_item_id":5}`)}
+
+	handler.handlePromptDone(context.Background(), &ws.Client{DeviceID: "dev-own", SessionName: "feature"}, envelope)
+	if len(done.items) != 0 {
+		t.Fatalf("items = %v, want a viewer's prompt_done ignored", done.items)
+	}
+
+	handler.handlePromptDone(context.Background(), &ws.Client{DeviceID: "dev-own", SessionName: "feature", IsAgent: true}, envelope)
+	if len(done.items) != 1 || done.items[0] != 5 {
+		t.Fatalf("items = %v, want [5]", done.items)
+	}
+}
@@ -0,0 +1,209 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	cloudauth "github.com/mobile-coder/cloud/internal/auth"
+	"github.com/mobile-coder/cloud/internal/db"
+	"github.com/mobile-coder/cloud/internal/service"
+)
+
+type scheduleService interface {
+	CreateSchedule(ctx context.Context, userID int64, input service.ScheduleInput) (*db.TaskSchedule, error)
+	ListSchedules(ctx context.Context, userID int64) ([]db.TaskSchedule, error)
+	SetScheduleEnabled(ctx context.Context, userID, scheduleID int64, enabled bool) (*db.TaskSchedule, error)
+	DeleteSchedule(ctx context.Context, userID, scheduleID int64) error
+	ListRuns(ctx context.Context, userID, scheduleID int64, limit int) ([]db.TaskScheduleRun, error)
+}
+
+type ScheduleHandler struct {
+	scheduleService scheduleService
+	deviceService   deviceLookup
+	tokenManager    *cloudauth.Manager
+}
+
+func NewScheduleHandler(scheduleService scheduleService, deviceService deviceLookup, tokenManager *cloudauth.Manager) *ScheduleHandler {
+	return &ScheduleHandler{
+		scheduleService: scheduleService,
+		deviceService:   deviceService,
+		tokenManager:    tokenManager,
+	}
+}
+
+type SetScheduleEnabledRequest struct {
+	ID      int64 `json:"id"`
+	Enabled bool  `json:"enabled"`
+}
+
+type DeleteScheduleRequest struct {
+	ID int64 `json:"id"`
+}
+
+func (h *ScheduleHandler) ListSchedules(w http.ResponseWriter, r *http.Request) {
+	claims, err := requireClaimsFromRequest(r, h.tokenManager)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	schedules, err := h.scheduleService.ListSchedules(r.Context(), claims.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"schedules": schedules,
+	})
+}
+
+func (h *ScheduleHandler) CreateSchedule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := requireClaimsFromRequest(r, h.tokenManager)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var req service.ScheduleInput
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.DeviceID == "" {
+		http.Error(w, "device_id required", http.StatusBadRequest)
+		return
+	}
+
+	device, err := h.deviceService.GetDeviceByDeviceID(r.Context(), req.DeviceID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err := ensureDeviceOwnership(device, claims.UserID); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	schedule, err := h.scheduleService.CreateSchedule(r.Context(), claims.UserID, req)
+	if err != nil {
+		writeScheduleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"schedule": schedule,
+	})
+}
+
+func (h *ScheduleHandler) SetScheduleEnabled(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := requireClaimsFromRequest(r, h.tokenManager)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var req SetScheduleEnabledRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID <= 0 {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	schedule, err := h.scheduleService.SetScheduleEnabled(r.Context(), claims.UserID, req.ID, req.Enabled)
+	if err != nil {
+		writeScheduleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"schedule": schedule,
+	})
+}
+
+func (h *ScheduleHandler) DeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "DELETE" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := requireClaimsFromRequest(r, h.tokenManager)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var req DeleteScheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID <= 0 {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.scheduleService.DeleteSchedule(r.Context(), claims.UserID, req.ID); err != nil {
+		writeScheduleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "ok",
+	})
+}
+
+func (h *ScheduleHandler) ListRuns(w http.ResponseWriter, r *http.Request) {
+	claims, err := requireClaimsFromRequest(r, h.tokenManager)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	scheduleID, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil || scheduleID <= 0 {
+		http.Error(w, "id required", http.StatusBadRequest)
+		return
+	}
+	limit := 0
+	if rawLimit := r.URL.Query().Get("limit"); rawLimit != "" {
+		if limit, err = strconv.Atoi(rawLimit); err != nil {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	runs, err := h.scheduleService.ListRuns(r.Context(), claims.UserID, scheduleID, limit)
+	if err != nil {
+		writeScheduleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"runs": runs,
+	})
+}
+
+func writeScheduleError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, service.ErrScheduleNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, service.ErrInvalidSchedule):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
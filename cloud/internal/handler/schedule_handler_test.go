@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	cloudauth "github.com/mobile-coder/cloud/internal/auth"
+	"github.com/mobile-coder/cloud/internal/db"
+	"github.com/mobile-coder/cloud/internal/service"
+)
+
+type fakeScheduleService struct {
+	createCalls []service.ScheduleInput
+	createErr   error
+	deleteErr   error
+}
+
+func (f *fakeScheduleService) CreateSchedule(ctx context.Context, userID int64, input service.ScheduleInput) (*db.TaskSchedule, error) {
+	f.createCalls = append(f.createCalls, input)
+	if f.createErr != nil {
+		return nil, f.createErr
+	}
+	return &db.TaskSchedule{ID: 1, UserID: userID, DeviceID: input.DeviceID, Name: input.Name, CronExpr: input.CronExpr}, nil
+}
+
+func (f *fakeScheduleService) ListSchedules(ctx context.Context, userID int64) ([]db.TaskSchedule, error) {
+	return []db.TaskSchedule{}, nil
+}
+
+func (f *fakeScheduleService) SetScheduleEnabled(ctx context.Context, userID, scheduleID int64, enabled bool) (*db.TaskSchedule, error) {
+	return &db.TaskSchedule{ID: scheduleID, UserID: userID, Enabled: enabled}, nil
+}
+
+func (f *fakeScheduleService) DeleteSchedule(ctx context.Context, userID, scheduleID int64) error {
+	return f.deleteErr
+}
+
+func (f *fakeScheduleService) ListRuns(ctx context.Context, userID, scheduleID int64, limit int) ([]db.TaskScheduleRun, error) {
+	return []db.TaskScheduleRun{}, nil
+}
+
+type fakeDeviceLookup struct {
+	devices map[string]*service.Device
+}
+
+func (f *fakeDeviceLookup) GetDeviceByDeviceID(ctx context.Context, deviceID string) (*service.Device, error) {
+	device, ok := f.devices[deviceID]
+	if !ok {
+		return nil, errors.New("device not found")
+	}
+	return device, nil
+}
+
+func newScheduleHandlerForTest(t *testing.T, svc *fakeScheduleService) (*ScheduleHandler, string) {
+	t.Helper()
+
+	manager := cloudauth.NewManager("test-secret", time.Hour)
+	token, err := manager.Issue(42, "user@example.com")
+	if err != nil {
+		t.Fatalf("Issue token: %v", err)
+	}
+	devices := &fakeDeviceLookup{devices: map[string]*service.Device{
+		"dev-own":   {UserID: 42, DeviceID: "dev-own"},
+		"dev-other": {UserID: 7, DeviceID: "dev-other"},
+	}}
+	return NewScheduleHandler(svc, devices, manager), token
+}
+
+func TestScheduleHandlerCreateScheduleChecksDeviceOwnership(t *testing.T) {
+	svc := &fakeScheduleService{}
+	handler, token := newScheduleHandlerForTest(t, svc)
+
+	body, _ := json.Marshal(service.ScheduleInput{DeviceID: "dev-other", Name: "Nightly", CronExpr: "0 2 * * *", ProjectPath: "/repo", Prompt: "update deps"})
+	rr := httptest.NewRecorder()
+	handler.CreateSchedule(rr, newNotificationRequest(http.MethodPost, "/api/schedules/create", body, token))
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+	if len(svc.createCalls) != 0 {
+		t.Fatalf("createCalls = %d, want 0", len(svc.createCalls))
+	}
+
+	body, _ = json.Marshal(service.ScheduleInput{DeviceID: "dev-own", Name: "Nightly", CronExpr: "0 2 * * *", ProjectPath: "/repo", Prompt: "update deps"})
+	rr = httptest.NewRecorder()
+	handler.CreateSchedule(rr, newNotificationRequest(http.MethodPost, "/api/schedules/create", body, token))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
+	var resp map[string]db.TaskSchedule
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unmarshal response: %v", err)
+	}
+	if resp["schedule"].CronExpr != "0 2 * * *" {
+		t.Fatalf("schedule = %+v, want created schedule", resp["schedule"])
+	}
+}
+
+func TestScheduleHandlerMapsServiceErrors(t *testing.T) {
+	svc := &fakeScheduleService{createErr: service.ErrInvalidSchedule, deleteErr: service.ErrScheduleNotFound}
+	handler, token := newScheduleHandlerForTest(t, svc)
+
+	body, _ := json.Marshal(service.ScheduleInput{DeviceID: "dev-own", CronExpr: "bad"})
+	rr := httptest.NewRecorder()
+	handler.CreateSchedule(rr, newNotificationRequest(http.MethodPost, "/api/schedules/create", body, token))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("create status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+
+	body, _ = json.Marshal(map[string]int64{"id": 9})
+	rr = httptest.NewRecorder()
+	handler.DeleteSchedule(rr, newNotificationRequest(http.MethodPost, "/api/schedules/delete", body, token))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("delete status = %d, want %d", rr.Code, http.StatusNotFound)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ListSchedules(rr, newNotificationRequest(http.MethodGet, "/api/schedules", nil, ""))
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("list status = %d, want %d", rr.Code, http.StatusUnauthorized)
+	}
+}
@@ -2,7 +2,10 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
+	"time"
 
 	cloudauth "github.com/mobile-coder/cloud/internal/auth"
 	"github.com/mobile-coder/cloud/internal/service"
@@ -27,7 +30,7 @@ func (h *TaskHandler) GetTasks(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tasks, err := h.taskService.ListTasksForUser(claims.UserID)
+	tasks, err := h.taskService.ListTasksForUser(r.Context(), claims.UserID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -52,7 +55,7 @@ func (h *TaskHandler) GetTask(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	task, err := h.taskService.GetTaskForUser(claims.UserID, taskID)
+	task, err := h.taskService.GetTaskForUser(r.Context(), claims.UserID, taskID)
 	if err != nil {
 		if err == service.ErrTaskNotFound {
 			http.Error(w, err.Error(), http.StatusNotFound)
@@ -67,3 +70,160 @@ func (h *TaskHandler) GetTask(w http.ResponseWriter, r *http.Request) {
 		"task": task,
 	})
 }
+
+type UpdateTaskRequest struct {
+	ID    string  `json:"id"`
+	Title *string `json:"title"`
+	Goal  *string `json:"goal"`
+}
+
+// UpdateTask edits the user-facing title or goal of a task.
+func (h *TaskHandler) UpdateTask(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "PUT" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := requireClaimsFromRequest(r, h.tokenManager)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var req UpdateTaskRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.ID == "" {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+
+	task, err := h.taskService.UpdateTaskForUser(r.Context(), claims.UserID, req.ID, service.TaskUpdate{
+		Title: req.Title,
+		Goal:  req.Goal,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrTaskNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, service.ErrInvalidTaskUpdate):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, service.ErrTaskRecordsUnavailable):
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"task": task,
+	})
+}
+
+// GetTaskTimeline returns a page of persisted task events, newest first.
+// Pass next_before and next_before_id of a page as before and before_id to
+// fetch the next one; events sharing a timestamp are ordered by ID.
+func (h *TaskHandler) GetTaskTimeline(w http.ResponseWriter, r *http.Request) {
+	claims, err := requireClaimsFromRequest(r, h.tokenManager)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	taskID := r.URL.Query().Get("task_id")
+	if taskID == "" {
+		http.Error(w, "task_id is required", http.StatusBadRequest)
+		return
+	}
+
+	before, err := parseTimelineBeforeQuery(r.URL.Query().Get("before"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	beforeID, err := parseTimelineBeforeIDQuery(r.URL.Query().Get("before_id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit, err := parseTimelineLimitQuery(r.URL.Query().Get("limit"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	events, err := h.taskService.ListTaskTimeline(r.Context(), claims.UserID, taskID, before, beforeID, limit)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrTaskNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, service.ErrTaskTimelineUnavailable):
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if events == nil {
+		events = []service.TaskEvent{}
+	}
+
+	nextBefore := ""
+	var nextBeforeID int64
+	if len(events) > 0 {
+		nextBefore = events[len(events)-1].Timestamp
+		nextBeforeID = events[len(events)-1].ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"events":         events,
+		"next_before":    nextBefore,
+		"next_before_id": nextBeforeID,
+	})
+}
+
+func parseTimelineBeforeQuery(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return nil, errors.New("before must be RFC3339")
+	}
+	return &parsed, nil
+}
+
+func parseTimelineBeforeIDQuery(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || id < 0 {
+		return 0, errors.New("before_id must be a non-negative number")
+	}
+	return id, nil
+}
+
+func parseTimelineLimitQuery(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.New("limit must be a number")
+	}
+	if limit < 0 {
+		return 0, errors.New("limit must be non-negative")
+	}
+	return limit, nil
+}
@@ -0,0 +1,228 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	cloudauth "github.com/mobile-coder/cloud/internal/auth"
+	"github.com/mobile-coder/cloud/internal/service"
+)
+
+type templateService interface {
+	ListTemplates(ctx context.Context, userID int64) ([]service.PromptTemplate, error)
+	CreateTemplate(ctx context.Context, userID int64, input service.TemplateInput) (*service.PromptTemplate, error)
+	UpdateTemplate(ctx context.Context, userID, templateID int64, input service.TemplateInput) (*service.PromptTemplate, error)
+	DeleteTemplate(ctx context.Context, userID, templateID int64) error
+	RenderTemplate(ctx context.Context, userID, templateID int64, variables map[string]string) (string, error)
+}
+
+// templateRenderer renders a template referenced by a terminal_input message.
+type templateRenderer interface {
+	RenderTemplate(ctx context.Context, userID, templateID int64, variables map[string]string) (string, error)
+}
+
+type TemplateHandler struct {
+	templateService templateService
+	tokenManager    *cloudauth.Manager
+}
+
+func NewTemplateHandler(templateService templateService, tokenManager *cloudauth.Manager) *TemplateHandler {
+	return &TemplateHandler{
+		templateService: templateService,
+		tokenManager:    tokenManager,
+	}
+}
+
+type UpdateTemplateRequest struct {
+	ID int64 `json:"id"`
+	service.TemplateInput
+}
+
+type DeleteTemplateRequest struct {
+	ID int64 `json:"id"`
+}
+
+type RenderTemplateRequest struct {
+	TemplateID int64             `json:"template_id"`
+	Variables  map[string]string `json:"variables"`
+}
+
+func (h *TemplateHandler) ListTemplates(w http.ResponseWriter, r *http.Request) {
+	claims, err := requireClaimsFromRequest(r, h.tokenManager)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	templates, err := h.templateService.ListTemplates(r.Context(), claims.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"templates": templates,
+	})
+}
+
+func (h *TemplateHandler) CreateTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := requireClaimsFromRequest(r, h.tokenManager)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var req service.TemplateInput
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	template, err := h.templateService.CreateTemplate(r.Context(), claims.UserID, req)
+	if err != nil {
+		writeTemplateError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"template": template,
+	})
+}
+
+func (h *TemplateHandler) UpdateTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "PUT" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := requireClaimsFromRequest(r, h.tokenManager)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var req UpdateTemplateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID <= 0 {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	template, err := h.templateService.UpdateTemplate(r.Context(), claims.UserID, req.ID, req.TemplateInput)
+	if err != nil {
+		writeTemplateError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"template": template,
+	})
+}
+
+func (h *TemplateHandler) DeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "DELETE" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := requireClaimsFromRequest(r, h.tokenManager)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var req DeleteTemplateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID <= 0 {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.templateService.DeleteTemplate(r.Context(), claims.UserID, req.ID); err != nil {
+		writeTemplateError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "ok",
+	})
+}
+
+// RenderTemplate previews a template with the given variables.
+func (h *TemplateHandler) RenderTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := requireClaimsFromRequest(r, h.tokenManager)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var req RenderTemplateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TemplateID <= 0 {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	content, err := h.templateService.RenderTemplate(r.Context(), claims.UserID, req.TemplateID, req.Variables)
+	if err != nil {
+		writeTemplateError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"content": content,
+	})
+}
+
+func writeTemplateError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, service.ErrTemplateNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, service.ErrTemplateForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, service.ErrInvalidTemplate), errors.Is(err, service.ErrMissingTemplateVariable):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// renderTemplateInput turns a terminal_input that references a template into
+// a plain content input. Messages without template_id are returned as is.
+func renderTemplateInput(ctx context.Context, renderer templateRenderer, userID int64, message []byte) ([]byte, error) {
+	var msg struct {
+		Type    string `json:"type"`
+		Payload struct {
+			TemplateID int64             `json:"template_id"`
+			Variables  map[string]string `json:"variables"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(message, &msg); err != nil || msg.Payload.TemplateID == 0 {
+		return message, nil
+	}
+
+	content, err := renderer.RenderTemplate(ctx, userID, msg.Payload.TemplateID, msg.Payload.Variables)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(map[string]interface{}{
+		"type": "terminal_input",
+		"payload": map[string]interface{}{
+			"content": content,
+		},
+	})
+}
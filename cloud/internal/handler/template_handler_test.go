@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/mobile-coder/cloud/internal/service"
+)
+
+type fakeTemplateRenderer struct {
+	userID     int64
+	templateID int64
+	variables  map[string]string
+	err        error
+}
+
+func (f *fakeTemplateRenderer) RenderTemplate(ctx context.Context, userID, templateID int64, variables map[string]string) (string, error) {
+	f.userID = userID
+	f.templateID = templateID
+	f.variables = variables
+	if f.err != nil {
+		return "", f.err
+	}
+	return "git checkout " + variables["branch"], nil
+}
+
+func TestRenderTemplateInputReplacesTemplateReference(t *testing.T) {
+	renderer := &fakeTemplateRenderer{}
+	message := []byte(`{"type":"terminal_input","payload":{"template_id":5,"variables":{"branch":"main"}}}`)
+
+	got, err := renderTemplateInput(context.Background(), renderer, 42, message)
+	if err != nil {
+		t.Fatalf("renderTemplateInput: %v", err)
+	}
+	if renderer.userID != 42 || renderer.templateID != 5 {
+		t.Fatalf("renderer got user=%d template=%d, want 42/5", renderer.userID, renderer.templateID)
+	}
+
+	var msg struct {
+		Type    string            `json:"type"`
+		Payload map[string]string `json:"payload"`
+	}
+	if err := json.Unmarshal(got, &msg); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if msg.Type != "terminal_input" || msg.Payload["content"] != "git checkout main" {
+		t.Fatalf("message = %s, want rendered content", got)
+	}
+}
+
+func TestRenderTemplateInputPassesPlainInputThrough(t *testing.T) {
+	message := []byte(`{"type":"terminal_input","payload":{"content":"ls"}}`)
+
+	got, err := renderTemplateInput(context.Background(), &fakeTemplateRenderer{}, 42, message)
+	if err != nil {
+		t.Fatalf("renderTemplateInput: %v", err)
+	}
+	if string(got) != string(message) {
+		t.Fatalf("message = %s, want unchanged", got)
+	}
+}
+
+func TestRenderTemplateInputReturnsRenderErrors(t *testing.T) {
+	renderer := &fakeTemplateRenderer{err: service.ErrMissingTemplateVariable}
+	message := []byte(`{"type":"terminal_input","payload":{"template_id":5}}`)
+
+	if _, err := renderTemplateInput(context.Background(), renderer, 42, message); !errors.Is(err, service.ErrMissingTemplateVariable) {
+		t.Fatalf("err = %v, want ErrMissingTemplateVariable", err)
+	}
+}
@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	cloudauth "github.com/mobile-coder/cloud/internal/auth"
+	"github.com/mobile-coder/cloud/internal/service"
+)
+
+type uploadService interface {
+	Upload(ctx context.Context, userID int64, taskID, filename string, content io.Reader) (*service.UploadResult, error)
+}
+
+type UploadHandler struct {
+	uploadService uploadService
+	tokenManager  *cloudauth.Manager
+}
+
+func NewUploadHandler(uploadService uploadService, tokenManager *cloudauth.Manager) *UploadHandler {
+	return &UploadHandler{
+		uploadService: uploadService,
+		tokenManager:  tokenManager,
+	}
+}
+
+// Upload streams the multipart field "file" into the project of ?task_id=
+// and types the stored path into the tool's prompt.
+func (h *UploadHandler) Upload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := requireClaimsFromRequest(r, h.tokenManager)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	taskID := r.URL.Query().Get("task_id")
+	if taskID == "" {
+		http.Error(w, "task_id is required", http.StatusBadRequest)
+		return
+	}
+
+	// 直接读取 multipart 流，不把整个文件缓存在云端
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "multipart body required", http.StatusBadRequest)
+		return
+	}
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			http.Error(w, "file field is required", http.StatusBadRequest)
+			return
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+
+		result, err := h.uploadService.Upload(r.Context(), claims.UserID, taskID, part.FileName(), part)
+		part.Close()
+		if err != nil {
+			writeUploadError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"upload": result,
+		})
+		return
+	}
+}
+
+func writeUploadError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, service.ErrInvalidUpload):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, service.ErrUploadTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, service.ErrUploadTypeNotAllowed):
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	default:
+		writeAgentRequestError(w, err)
+	}
+}
@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	cloudauth "github.com/mobile-coder/cloud/internal/auth"
+	"github.com/mobile-coder/cloud/internal/service"
+)
+
+type fakeUploadService struct {
+	filename string
+	content  string
+	err      error
+}
+
+func (f *fakeUploadService) Upload(ctx context.Context, userID int64, taskID, filename string, content io.Reader) (*service.UploadResult, error) {
+	data, _ := io.ReadAll(content)
+	f.filename, f.content = filename, string(data)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &service.UploadResult{TaskID: taskID, Path: ".mobilecoder/uploads/" + filename, Size: int64(len(data))}, nil
+}
+
+func newUploadRequest(t *testing.T, target, field, filename, content, token string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile(field, filename)
+	if err != nil {
+		t.Fatalf("CreateFormFile: %v", err)
+	}
+	part.Write([]byte(content))
+	writer.Close()
+
+	req := newNotificationRequest(http.MethodPost, target, body.Bytes(), token)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func TestUploadHandlerStreamsFilePart(t *testing.T) {
+	manager := cloudauth.NewManager("test-secret", time.Hour)
+	token, err := manager.Issue(42, "user@example.com")
+	if err != nil {
+		t.Fatalf("Issue token: %v", err)
+	}
+	svc := &fakeUploadService{}
+	handler := NewUploadHandler(svc, manager)
+
+	rr := httptest.NewRecorder()
+	handler.Upload(rr, newUploadRequest(t, "/api/tasks/upload?task_id=task-1", "file", "shot.png", "png-bytes", token))
+	if rr.Code != http.StatusOK || svc.filename != "shot.png" || svc.content != "png-bytes" {
+		t.Fatalf("status = %d upload = %+v: %s", rr.Code, svc, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	handler.Upload(rr, newUploadRequest(t, "/api/tasks/upload?task_id=task-1", "other", "shot.png", "x", token))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("missing file field status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+
+	cases := map[error]int{
+		service.ErrUploadTooLarge:       http.StatusRequestEntityTooLarge,
+		service.ErrUploadTypeNotAllowed: http.StatusUnsupportedMediaType,
+		service.ErrAgentUnavailable:     http.StatusServiceUnavailable,
+	}
+	for serviceErr, want := range cases {
+		svc.err = serviceErr
+		rr = httptest.NewRecorder()
+		handler.Upload(rr, newUploadRequest(t, "/api/tasks/upload?task_id=task-1", "file", "shot.png", "x", token))
+		if rr.Code != want {
+			t.Fatalf("%v status = %d, want %d", serviceErr, rr.Code, want)
+		}
+	}
+}
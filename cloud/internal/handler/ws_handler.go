@@ -1,24 +1,58 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/websocket"
 	cloudauth "github.com/mobile-coder/cloud/internal/auth"
+	"github.com/mobile-coder/cloud/internal/cors"
+	"github.com/mobile-coder/cloud/internal/metrics"
 	"github.com/mobile-coder/cloud/internal/service"
 	"github.com/mobile-coder/cloud/internal/ws"
+	"github.com/mobile-coder/logging"
+	"github.com/mobile-coder/tracing"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+// viewerMessageTypes are the messages a viewer may send. Requests to the
+// agent (git_action, get_diff, upload_*, submit_prompt, ...) go through the
+// cloud's HTTP handlers, which check roles and audit them.
+var viewerMessageTypes = map[string]bool{
+	"terminal_input": true,
+	"subscribe":      true,
+	"unsubscribe":    true,
+}
+
+// writeWait bounds a single frame write, so a peer that stopped reading
+// cannot block writePump forever.
+const writeWait = 10 * time.Second
+
+// workspaceStatusHandler stores the git status agents report for a session.
+type workspaceStatusHandler interface {
+	HandleWorkspaceStatus(ctx context.Context, deviceID, sessionName string, payload json.RawMessage) error
+}
+
+// promptDoneHandler advances a session's prompt queue when its agent
+// reports a queued prompt done.
+type promptDoneHandler interface {
+	HandlePromptDone(ctx context.Context, deviceID, sessionName string, itemID int64)
 }
 
 type WSHubHandler struct {
 	hub           *ws.Hub
 	deviceService *service.DeviceService
 	tokenManager  *cloudauth.Manager
+	templates     templateRenderer
+	workspaces    workspaceStatusHandler
+	promptDone    promptDoneHandler
+	audit         auditRecorder
+	encoding      string
+	pingInterval  time.Duration
+	readTimeout   time.Duration
+	upgrader      websocket.Upgrader
 }
 
 func NewWSHubHandler(hub *ws.Hub, deviceService *service.DeviceService, tokenManager *cloudauth.Manager) *WSHubHandler {
@@ -26,53 +60,116 @@ func NewWSHubHandler(hub *ws.Hub, deviceService *service.DeviceService, tokenMan
 		hub:           hub,
 		deviceService: deviceService,
 		tokenManager:  tokenManager,
+		encoding:      ws.EncodingJSON,
+		pingInterval:  25 * time.Second,
+		readTimeout:   60 * time.Second,
+		upgrader:      websocket.Upgrader{CheckOrigin: cors.New(nil, false).CheckOrigin},
 	}
 }
 
+// SetOriginPolicy decides which browser origins may open a socket, the
+// same ones the CORS middleware lets call the API. Without it the default
+// policy of cors.New applies.
+func (h *WSHubHandler) SetOriginPolicy(policy *cors.Policy) {
+	h.upgrader.CheckOrigin = policy.CheckOrigin
+}
+
+// SetHeartbeat sets how often the server pings each client and how long a
+// connection may stay silent (no frame, no pong) before it is dropped.
+func (h *WSHubHandler) SetHeartbeat(pingInterval, readTimeout time.Duration) {
+	h.pingInterval = pingInterval
+	h.readTimeout = readTimeout
+}
+
+// SetTransport enables permessage-deflate and the binary frame encoding
+// offered to agents that list it in hello.
+func (h *WSHubHandler) SetTransport(compression bool, encoding string) {
+	h.upgrader.EnableCompression = compression
+	h.encoding = encoding
+}
+
+// SetTemplateRenderer enables terminal_input messages that reference a
+// prompt template by ID.
+func (h *WSHubHandler) SetTemplateRenderer(renderer templateRenderer) {
+	h.templates = renderer
+}
+
+// SetAuditRecorder records terminal input from viewers in the audit log.
+func (h *WSHubHandler) SetAuditRecorder(audit auditRecorder) {
+	h.audit = audit
+}
+
+// SetWorkspaceStatusHandler routes workspace_status messages from agents to
+// the task service instead of broadcasting them.
+func (h *WSHubHandler) SetWorkspaceStatusHandler(handler workspaceStatusHandler) {
+	h.workspaces = handler
+}
+
+// SetPromptDoneHandler routes prompt_done messages from agents to the task
+// queue.
+func (h *WSHubHandler) SetPromptDoneHandler(handler promptDoneHandler) {
+	h.promptDone = handler
+}
+
 func (h *WSHubHandler) HandleConnection(w http.ResponseWriter, r *http.Request) {
 	deviceID := r.URL.Query().Get("device_id")
 	token := r.URL.Query().Get("token")
 	sessionName := r.URL.Query().Get("session_name")
 
-	log.Printf("WS connection request: device_id=%s, token=%s, session_name=%s", deviceID, token, sessionName)
+	// The connection keeps the request ID of its upgrade request
+	logger := slog.With("request_id", logging.RequestID(r.Context()), "device_id", deviceID, "session_name", sessionName)
+	logger.Debug("ws connection request", "viewer", token != "")
 
 	if deviceID == "" {
 		http.Error(w, "device_id required", http.StatusBadRequest)
 		return
 	}
+	// 先校验 Origin：未知站点的页面即使拿到了 token 也不能打开 viewer 连接
+	if !h.upgrader.CheckOrigin(r) {
+		logger.Warn("ws origin rejected", "origin", r.Header.Get("Origin"))
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
 
 	// token 参数用于标识客户端类型：
 	// - 有 token: H5 viewer（会收到终端输出）
-	// - 无 token: Desktop Agent（发送终端输出）
+	// - 无 token: Desktop Agent（发送终端输出），用 Authorization 头里的 agent token 认证
+	var claims *cloudauth.Claims
+	var err error
+	if token != "" {
+		claims, err = requireClaims(token, h.tokenManager)
+	} else {
+		claims, err = h.agentClaims(r)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	device, err := h.deviceService.GetDeviceByDeviceID(r.Context(), deviceID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err := ensureDeviceAccess(device, claims, deviceID); err != nil {
+		logger.Warn("ws connection denied", "user_id", claims.UserID, "agent", token == "")
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 	var userID int64
 	if token != "" {
-		claims, err := requireClaims(token, h.tokenManager)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnauthorized)
-			return
-		}
-		device, err := h.deviceService.GetDeviceByDeviceID(deviceID)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
-		}
-		if err := ensureDeviceOwnership(device, claims.UserID); err != nil {
-			http.Error(w, err.Error(), http.StatusForbidden)
-			return
-		}
 		userID = claims.UserID
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WS upgrade error: %v", err)
+		logger.Warn("ws upgrade failed", "error", err)
 		return
 	}
 
-	log.Printf("WS: connected device_id=%s, userID=%d, session_name=%s", deviceID, userID, sessionName)
-
 	// If no token, it's a Desktop Agent; if token exists, it's an H5 viewer
 	isAgent := (token == "")
+	logger = logger.With("user_id", userID, "agent", isAgent)
+	logger.Info("ws connected")
 
 	client := &ws.Client{
 		Conn:        conn,
@@ -80,20 +177,14 @@ func (h *WSHubHandler) HandleConnection(w http.ResponseWriter, r *http.Request)
 		UserID:      userID,
 		IsAgent:     isAgent,
 		SessionName: sessionName,
+		SourceIP:    clientIP(r),
 		Send:        make(chan []byte, 256),
+		Logger:      logger,
 	}
 
+	// Device and session status follow the hub's presence tracking
 	h.hub.Register(client)
 
-	// Desktop Agent (no token) - immediately update session status to active
-	// This handles reconnection scenarios where terminal_output might not be sent immediately
-	if token == "" && sessionName != "" {
-		go func() {
-			h.deviceService.UpdateSessionStatus(deviceID, sessionName, "active")
-			log.Printf("WS: Desktop Agent connected, updated session status to active")
-		}()
-	}
-
 	// If it's not an agent (i.e., it's an H5 viewer), send the last terminal output
 	if token != "" {
 		go func() {
@@ -105,63 +196,285 @@ func (h *WSHubHandler) HandleConnection(w http.ResponseWriter, r *http.Request)
 	go h.readPump(client)
 }
 
+// agentClaims verifies the agent token an agent dials with. An expired one
+// is refused; the agent refreshes it through /api/device/check first.
+func (h *WSHubHandler) agentClaims(r *http.Request) (*cloudauth.Claims, error) {
+	token := r.Header.Get("Authorization")
+	if token == "" || h.tokenManager == nil {
+		return nil, errUnauthorized
+	}
+	claims, err := h.tokenManager.Verify(token)
+	if err != nil || claims.TokenType != "agent" {
+		return nil, errUnauthorized
+	}
+	return claims, nil
+}
+
 func (h *WSHubHandler) readPump(client *ws.Client) {
 	defer func() {
 		h.hub.Unregister(client)
 		client.Conn.Close()
-
-		// If agent disconnects, update session status to inactive
-		if client.IsAgent {
-			// Get the active session and update its status
-			session, err := h.deviceService.GetActiveSession(client.DeviceID)
-			if err == nil && session != nil {
-				log.Printf("Agent disconnected, updating session status to inactive for deviceID=%s, session=%s", client.DeviceID, session.SessionName)
-				h.deviceService.UpdateSessionStatus(client.DeviceID, session.SessionName, "inactive")
-			}
-		}
 	}()
 
+	// A half-open connection sends nothing, not even pongs, and hits the
+	// read deadline.
+	client.Conn.SetReadDeadline(time.Now().Add(h.readTimeout))
+	client.Conn.SetPongHandler(func(string) error {
+		client.Touch()
+		return client.Conn.SetReadDeadline(time.Now().Add(h.readTimeout))
+	})
+
 	for {
-		_, message, err := client.Conn.ReadMessage()
+		messageType, frame, err := client.Conn.ReadMessage()
 		if err != nil {
+			client.Log().Info("ws closing", "error", err)
 			break
 		}
+		client.Touch()
+		client.Conn.SetReadDeadline(time.Now().Add(h.readTimeout))
+		envelope, message, err := ws.DecodeFrame(messageType, frame)
+		if err != nil {
+			client.Log().Warn("ws dropping malformed message", "error", err)
+			continue
+		}
+		client.Log().Debug("ws received", "type", envelope.Type, "payload", envelope.Payload)
+		countMessage("in", message, len(frame))
+
+		// Keystrokes start a trace; other messages continue the one they carry
+		ctx := context.Background()
+		var span *tracing.Span
+		if envelope.TraceParent != "" || envelope.Type == "terminal_input" {
+			ctx, span = tracing.Start(tracing.Extract(ctx, envelope.TraceParent), "ws.readPump",
+				"type", ws.MessageType(message), "device_id", client.DeviceID, "session_name", client.SessionName, "bytes", len(frame))
+		}
+		h.handleMessage(ctx, client, envelope, message)
+		span.End()
+	}
+}
 
-		// Parse message to determine type
-		var msg map[string]interface{}
-		json.Unmarshal(message, &msg)
-		msgType, _ := msg["type"].(string)
-		log.Printf("readPump: received msgType=%s from userID=%d", msgType, client.UserID)
-
-		// If client sends terminal_output, it's a Desktop Agent
-		if msgType == "terminal_output" {
-			client.IsAgent = true
-			// Update session status to active when agent connects
-			if client.SessionName != "" {
-				h.deviceService.UpdateSessionStatus(client.DeviceID, client.SessionName, "active")
+// handleMessage routes one message read from client.
+func (h *WSHubHandler) handleMessage(ctx context.Context, client *ws.Client, envelope *ws.Envelope, message []byte) {
+	msgType := envelope.Type
+	// Replies to cloud requests (get_diff, ...) go to the waiting caller
+	if client.IsAgent && envelope.ReplyTo != "" {
+		h.hub.DeliverResponse(client, message)
+		return
+	}
+	if client.IsAgent && msgType == "ack" {
+		h.hub.AckFromAgent(client, envelope.Ack)
+		return
+	}
+	// Sequenced agent messages are acked; replays of ones already
+	// handled before a reconnect are dropped.
+	if client.IsAgent && envelope.Seq > 0 {
+		fresh := h.hub.ReceiveFromAgent(client, envelope.Seq)
+		select {
+		case client.Send <- ws.EncodeAck(envelope.Seq):
+		default:
+		}
+		if !fresh {
+			return
+		}
+	}
+
+	// Whether a client is an agent was settled by its token at connect
+	if !client.IsAgent && !viewerMessageTypes[msgType] {
+		client.Log().Warn("ws dropping message a viewer may not send", "type", msgType)
+		return
+	}
+
+	if msgType == "terminal_output" {
+		// Broadcast terminal_output only to H5 viewers (not to agents)
+		h.hub.BroadcastToViewers(ctx, client.DeviceID, client.SessionName, message)
+	} else if msgType == "terminal_input" {
+		// terminal_input from H5 should only go to Desktop Agents
+		// Use sessionName for routing if available
+		if h.templates != nil {
+			rendered, err := renderTemplateInput(ctx, h.templates, client.UserID, message)
+			if err != nil {
+				reply, _ := ws.EncodeEnvelope("", "template_error", map[string]string{"error": err.Error()})
+				select {
+				case client.Send <- reply:
+				default:
+				}
+				return
 			}
-			// Broadcast terminal_output only to H5 viewers (not to agents)
-			h.hub.BroadcastToViewers(client.DeviceID, client.SessionName, message)
-		} else if msgType == "terminal_input" {
-			// terminal_input from H5 should only go to Desktop Agents
-			// Use sessionName for routing if available
-			h.hub.SendToAgents(client.DeviceID, client.SessionName, message)
-		} else {
-			// Forward other messages to all clients
-			h.hub.BroadcastToDevice(client.DeviceID, message)
+			message = rendered
 		}
+		// Whoever sent it, input that reaches an agent is a remote action
+		if h.audit != nil {
+			h.audit.Record(ctx, service.AuditEvent{
+				Action:      service.AuditTerminalInput,
+				UserID:      client.UserID,
+				DeviceID:    client.DeviceID,
+				SessionName: client.SessionName,
+				SourceIP:    client.SourceIP,
+				Content:     terminalInputContent(message),
+			})
+		}
+		// Buffered with a sequence number, so keystrokes typed while the
+		// agent reconnects are replayed rather than dropped
+		h.hub.DeliverToAgent(ctx, client.DeviceID, client.SessionName, message)
+	} else if msgType == "hello" {
+		h.handleHello(client, envelope)
+	} else if msgType == "workspace_status" && h.workspaces != nil {
+		h.handleWorkspaceStatus(ctx, client, envelope)
+	} else if msgType == "prompt_done" {
+		h.handlePromptDone(ctx, client, envelope)
+	} else if msgType == "subscribe" || msgType == "unsubscribe" {
+		h.handleSubscription(client, envelope)
+	} else {
+		// Forward other agent messages to all clients
+		h.hub.BroadcastToDevice(client.DeviceID, message)
+	}
+}
+
+// handleHello stores the agent's version and capabilities and tells the
+// agent whether the server can serve it.
+func (h *WSHubHandler) handleHello(client *ws.Client, envelope *ws.Envelope) {
+	if !client.IsAgent {
+		return
+	}
+	var info service.AgentInfo
+	if err := json.Unmarshal(envelope.Payload, &info); err != nil {
+		client.Log().Warn("ws invalid hello", "error", err)
+		return
+	}
+	compatible, rejected := ws.CheckAgentProtocol(info.ProtocolVersion)
+	info.Compatible = compatible
+	info.Encoding = ws.EncodingJSON
+	if compatible && h.encoding == ws.EncodingCBOR && info.SupportsEncoding(ws.EncodingCBOR) {
+		info.Encoding = ws.EncodingCBOR
+	}
+	info.ConnectedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	h.hub.SetAgentInfo(client, &info)
+	client.Log().Info("ws hello", "version", info.Version, "protocol", info.ProtocolVersion, "compatible", compatible)
+
+	result := map[string]interface{}{
+		"protocol_version":     ws.ProtocolVersion,
+		"min_protocol_version": ws.MinAgentProtocolVersion,
+		"compatible":           compatible,
+		"encoding":             info.Encoding,
+	}
+	// resume: agent 报告自己的发送流和收到的最后一条 seq，双方各自补发对方没收到的消息
+	var resume struct {
+		StreamID       string `json:"stream_id"`
+		ResumeStreamID string `json:"resume_stream_id"`
+		ResumeSeq      uint64 `json:"resume_seq"`
+	}
+	resuming := !rejected && info.Supports(service.CapabilityResume)
+	if resuming {
+		json.Unmarshal(envelope.Payload, &resume)
+		streamID, received := h.hub.OpenAgentStream(client, resume.StreamID)
+		result["stream_id"] = streamID
+		result["resume_seq"] = received
+	}
+	payload, _ := json.Marshal(result)
+	reply := ws.Envelope{ReplyTo: envelope.ID, Type: "hello_result", Version: ws.ProtocolVersion, Payload: payload}
+	if rejected {
+		reply.Error = &ws.EnvelopeError{Code: "incompatible", Message: service.ErrAgentIncompatible.Error()}
+	}
+	message, _ := json.Marshal(reply)
+	// The agent holds back its sequenced messages until hello_result, so
+	// wait for room in the queue; if there is none, reconnecting is the
+	// only way forward.
+	select {
+	case client.Send <- message:
+	case <-time.After(writeWait):
+		client.Log().Warn("ws hello_result not queued, closing", "queue", len(client.Send))
+		client.Conn.Close()
+		return
+	}
+	// The agent decodes both encodings, so switching right away is safe.
+	client.SetEncoding(info.Encoding)
+	if resuming {
+		h.hub.ResumeToAgent(client, resume.ResumeStreamID, resume.ResumeSeq)
 	}
 }
 
+func (h *WSHubHandler) handleWorkspaceStatus(ctx context.Context, client *ws.Client, envelope *ws.Envelope) {
+	if !client.IsAgent || client.SessionName == "" || len(envelope.Payload) == 0 {
+		return
+	}
+	if err := h.workspaces.HandleWorkspaceStatus(ctx, client.DeviceID, client.SessionName, envelope.Payload); err != nil {
+		client.Log().Warn("ws workspace status failed", "error", err)
+	}
+}
+
+// handlePromptDone passes the queue item an agent finished to the queue.
+// Viewers cannot advance a queue.
+func (h *WSHubHandler) handlePromptDone(ctx context.Context, client *ws.Client, envelope *ws.Envelope) {
+	var done struct {
+		QueueItemID int64 `json:"queue_item_id"`
+	}
+	if !client.IsAgent || h.promptDone == nil || client.SessionName == "" ||
+		json.Unmarshal(envelope.Payload, &done) != nil || done.QueueItemID <= 0 {
+		return
+	}
+	h.promptDone.HandlePromptDone(ctx, client.DeviceID, client.SessionName, done.QueueItemID)
+}
+
+// handleSubscription lets a viewer follow more sessions of its device on
+// the same connection.
+func (h *WSHubHandler) handleSubscription(client *ws.Client, envelope *ws.Envelope) {
+	var request struct {
+		SessionName string `json:"session_name"`
+	}
+	if client.IsAgent || json.Unmarshal(envelope.Payload, &request) != nil || request.SessionName == "" {
+		return
+	}
+	if envelope.Type == "subscribe" {
+		h.hub.Subscribe(client, request.SessionName)
+	} else {
+		h.hub.Unsubscribe(client, request.SessionName)
+	}
+}
+
+// countMessage records a frame of size bytes on the wire.
+func countMessage(direction string, message []byte, size int) {
+	msgType := ws.MessageType(message)
+	metrics.WSMessages.With(direction, msgType).Inc()
+	metrics.WSBytes.With(direction, msgType).Add(float64(size))
+}
+
 func (h *WSHubHandler) writePump(client *ws.Client) {
-	defer client.Conn.Close()
+	ticker := time.NewTicker(h.pingInterval)
+	defer func() {
+		ticker.Stop()
+		client.Conn.Close()
+	}()
 
+	write := func(message []byte) bool {
+		client.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+		messageType, frame := ws.OutgoingFrame(client, message)
+		countMessage("out", message, len(frame))
+		return client.Conn.WriteMessage(messageType, frame) == nil
+	}
 	for {
-		message, ok := <-client.Send
-		if !ok {
-			client.Conn.WriteMessage(websocket.CloseMessage, []byte{})
-			return
+		select {
+		case message, ok := <-client.Send:
+			if !ok {
+				client.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+				client.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if !write(message) {
+				return
+			}
+			// Terminal output coalesced while the client was behind goes
+			// out once everything queued before it has
+			if snapshot := client.TakeSnapshot(); snapshot != nil && !write(snapshot) {
+				return
+			}
+		case <-client.Wake():
+			if snapshot := client.TakeSnapshot(); snapshot != nil && !write(snapshot) {
+				return
+			}
+		case <-ticker.C:
+			client.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := client.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
 		}
-		client.Conn.WriteMessage(websocket.TextMessage, message)
 	}
 }
@@ -0,0 +1,245 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	cloudauth "github.com/mobile-coder/cloud/internal/auth"
+	"github.com/mobile-coder/cloud/internal/cors"
+	"github.com/mobile-coder/cloud/internal/service"
+	"github.com/mobile-coder/cloud/internal/ws"
+)
+
+type presenceRecorder chan service.AgentPresence
+
+func (r presenceRecorder) HandleAgentPresence(presence service.AgentPresence) {
+	r <- presence
+}
+
+func TestWSHubHandlerDropsSilentConnections(t *testing.T) {
+	hub := ws.NewHub()
+	changes := make(presenceRecorder, 4)
+	hub.AddPresenceHandler(changes)
+	go hub.Run()
+
+	manager := cloudauth.NewManager("test-secret", time.Hour)
+	handler := NewWSHubHandler(hub, service.NewDeviceService(newSecuredDevices().database(t)), manager)
+	handler.SetHeartbeat(20*time.Millisecond, 150*time.Millisecond)
+	server := httptest.NewServer(http.HandlerFunc(handler.HandleConnection))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	agentToken, _ := manager.IssueAgent(7, "dev-1")
+	header := http.Header{"Authorization": {agentToken}}
+
+	// An agent that keeps reading answers pings and stays connected
+	alive, _, err := websocket.DefaultDialer.Dial(url+"?device_id=dev-1&session_name=alive", header)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer alive.Close()
+	go func() {
+		for {
+			if _, _, err := alive.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	// A half-open agent never reads, so it never answers a ping
+	silent, _, err := websocket.DefaultDialer.Dial(url+"?device_id=dev-1&session_name=silent", header)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer silent.Close()
+
+	online := map[string]bool{}
+	deadline := time.After(2 * time.Second)
+	for !(online["alive"] && online["silent"]) {
+		select {
+		case presence := <-changes:
+			online[presence.SessionName] = presence.SessionOnline
+		case <-deadline:
+			t.Fatalf("agents not reported online: %v", online)
+		}
+	}
+
+	select {
+	case presence := <-changes:
+		if presence.SessionName != "silent" || presence.SessionOnline || !presence.DeviceOnline {
+			t.Fatalf("presence = %+v, want only the silent session offline", presence)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("silent connection was not dropped")
+	}
+	select {
+	case presence := <-changes:
+		t.Fatalf("unexpected presence change %+v", presence)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestWSHubHandlerAuthenticatesAgentsAndViewers(t *testing.T) {
+	hub := ws.NewHub()
+	go hub.Run()
+
+	manager := cloudauth.NewManager("test-secret", time.Hour)
+	handler := NewWSHubHandler(hub, service.NewDeviceService(newSecuredDevices().database(t)), manager)
+	server := httptest.NewServer(http.HandlerFunc(handler.HandleConnection))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "?device_id=dev-1&session_name=api"
+
+	user, _ := manager.Issue(7, "member@example.com")
+	stranger, _ := manager.Issue(9, "other@example.com")
+	foreignAgent, _ := manager.IssueAgent(9, "dev-2")
+	agent, _ := manager.IssueAgent(7, "dev-1")
+	expiredAgent, _ := cloudauth.NewManager("test-secret", -time.Second).IssueAgent(7, "dev-1")
+	registration, _ := manager.IssueRegistration("dev-1")
+
+	for _, tc := range []struct {
+		name          string
+		query         string
+		authorization string
+		want          int
+	}{
+		{"agent without a token", "", "", http.StatusUnauthorized},
+		{"agent with a user token", "", user, http.StatusUnauthorized},
+		{"agent of another device", "", foreignAgent, http.StatusForbidden},
+		{"viewer of a foreign device", "&token=" + stranger, "", http.StatusForbidden},
+		{"agent with an expired token", "", expiredAgent, http.StatusUnauthorized},
+		{"agent with a registration token", "", registration, http.StatusUnauthorized},
+		{"agent of the device", "", agent, http.StatusSwitchingProtocols},
+		{"owner viewer", "&token=" + user, "", http.StatusSwitchingProtocols},
+	} {
+		header := http.Header{}
+		if tc.authorization != "" {
+			header.Set("Authorization", tc.authorization)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(url+tc.query, header)
+		if conn != nil {
+			conn.Close()
+		}
+		if resp == nil {
+			t.Fatalf("%s: dial: %v", tc.name, err)
+		}
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+func TestWSHubHandlerRejectsUnknownOrigins(t *testing.T) {
+	hub := ws.NewHub()
+	go hub.Run()
+
+	manager := cloudauth.NewManager("test-secret", time.Hour)
+	handler := NewWSHubHandler(hub, service.NewDeviceService(newSecuredDevices().database(t)), manager)
+	server := httptest.NewServer(http.HandlerFunc(handler.HandleConnection))
+	defer server.Close()
+	user, _ := manager.Issue(7, "member@example.com")
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "?device_id=dev-1&session_name=api&token=" + user
+
+	dial := func(origin string) int {
+		conn, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {origin}})
+		if conn != nil {
+			conn.Close()
+		}
+		if resp == nil {
+			t.Fatalf("dial: %v", err)
+		}
+		return resp.StatusCode
+	}
+
+	// Without a policy the cors default applies: pages from the API's host,
+	// on any port
+	if status := dial("https://evil.example"); status != http.StatusForbidden {
+		t.Fatalf("foreign origin: status = %d, want 403", status)
+	}
+	if status := dial(server.URL); status != http.StatusSwitchingProtocols {
+		t.Fatalf("same origin: status = %d, want 101", status)
+	}
+	if status := dial("http://127.0.0.1:3001"); status != http.StatusSwitchingProtocols {
+		t.Fatalf("same host on another port: status = %d, want 101", status)
+	}
+
+	handler.SetOriginPolicy(cors.New([]string{"https://app.example.com"}, false))
+	if status := dial("https://app.example.com"); status != http.StatusSwitchingProtocols {
+		t.Fatalf("allowed origin: status = %d, want 101", status)
+	}
+	if status := dial(server.URL); status != http.StatusForbidden {
+		t.Fatalf("origin outside the policy: status = %d, want 403", status)
+	}
+}
+
+func TestWSHubHandlerAuditsInputOfViewerSendingOutput(t *testing.T) {
+	hub := ws.NewHub()
+	handler := NewWSHubHandler(hub, service.NewDeviceService(nil), cloudauth.NewManager("test-secret", time.Hour))
+	audit := &recordingAudit{}
+	handler.SetAuditRecorder(audit)
+	viewer := &ws.Client{DeviceID: "dev-1", SessionName: "feature", UserID: 7, Send: make(chan []byte, 8)}
+
+	// terminal_output from a viewer must not hide its keystrokes from the log
+	for _, message := range []string{
+		`{"type":"terminal_output","payload":{"content":"spoofed"}}`,
+		`{"type":"terminal_input","payload":{"content":"rm -rf build\n"}}`,
+	} {
+		envelope, err := ws.DecodeEnvelope([]byte(message))
+		if err != nil {
+			t.Fatalf("DecodeEnvelope: %v", err)
+		}
+		handler.handleMessage(context.Background(), viewer, envelope, []byte(message))
+	}
+
+	if len(audit.events) != 1 || audit.events[0].Action != service.AuditTerminalInput || audit.events[0].UserID != 7 {
+		t.Fatalf("audit events = %+v, want the viewer's input", audit.events)
+	}
+	if viewer.IsAgent {
+		t.Fatal("viewer became an agent by sending terminal_output")
+	}
+}
+
+func TestWSHubHandlerKeepsAgentRequestsFromViewers(t *testing.T) {
+	hub := ws.NewHub()
+	go hub.Run()
+	handler := NewWSHubHandler(hub, service.NewDeviceService(nil), cloudauth.NewManager("test-secret", time.Hour))
+	agent := &ws.Client{DeviceID: "dev-1", SessionName: "feature", IsAgent: true, Send: make(chan []byte, 8)}
+	viewer := &ws.Client{DeviceID: "dev-1", SessionName: "feature", UserID: 7, Send: make(chan []byte, 8)}
+	// Registered in order, so the viewer is in once the agent is online
+	hub.Register(viewer)
+	hub.Register(agent)
+	deadline := time.Now().Add(time.Second)
+	for _, online := hub.AgentLastSeen("dev-1"); !online; _, online = hub.AgentLastSeen("dev-1") {
+		if time.Now().After(deadline) {
+			t.Fatal("agent did not register")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// A member must not reach the agent's git, file or upload handlers
+	// around the role checks of the HTTP API
+	for _, message := range []string{
+		`{"type":"git_action","payload":{"action":"push"}}`,
+		`{"type":"upload_start","payload":{"name":"x.bin"}}`,
+		`{"type":"submit_prompt","payload":{"prompt":"rm -rf ."}}`,
+	} {
+		envelope, err := ws.DecodeEnvelope([]byte(message))
+		if err != nil {
+			t.Fatalf("DecodeEnvelope: %v", err)
+		}
+		handler.handleMessage(context.Background(), viewer, envelope, []byte(message))
+	}
+	if len(agent.Send) != 0 {
+		t.Fatalf("agent received %q from a viewer", <-agent.Send)
+	}
+
+	// Other agent messages still reach the device's viewers
+	status := `{"type":"session_status","payload":{}}`
+	envelope, _ := ws.DecodeEnvelope([]byte(status))
+	handler.handleMessage(context.Background(), agent, envelope, []byte(status))
+	if len(viewer.Send) == 0 {
+		t.Fatal("viewer did not receive the agent's message")
+	}
+}
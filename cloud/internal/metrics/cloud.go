@@ -0,0 +1,26 @@
+package metrics
+
+// Metrics recorded across the cloud server. Gauges of state the hub and
+// services keep themselves are registered in cmd/server.
+var (
+	HTTPRequestDuration = Default.NewHistogramVec("mobilecoder_http_request_duration_seconds",
+		"Latency of HTTP requests by route.", DefaultBuckets, "route", "method", "code")
+
+	WSMessages = Default.NewCounterVec("mobilecoder_ws_messages_total",
+		"WebSocket messages by direction (in, out) and envelope type.", "direction", "type")
+	WSBytes = Default.NewCounterVec("mobilecoder_ws_message_bytes_total",
+		"WebSocket payload bytes by direction (in, out) and envelope type.", "direction", "type")
+
+	StoreRequestDuration = Default.NewHistogramVec("mobilecoder_store_request_duration_seconds",
+		"Latency of Supabase REST calls by method and table.", DefaultBuckets, "method", "table")
+	StoreErrors = Default.NewCounterVec("mobilecoder_store_errors_total",
+		"Failed Supabase REST calls by method and table.", "method", "table")
+
+	NotificationsCreated = Default.NewCounterVec("mobilecoder_notifications_created_total",
+		"Notifications created by event type.", "type")
+
+	AuditEntriesNotStored = Default.NewCounterVec("mobilecoder_audit_entries_not_stored_total",
+		"Audit entries written to the server log instead of the store.")
+	AuditEntriesDropped = Default.NewCounterVec("mobilecoder_audit_entries_dropped_total",
+		"Audit entries that did not fit the full queue, written to the server log instead.")
+)
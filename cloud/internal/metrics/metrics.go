@@ -0,0 +1,318 @@
+// Package metrics keeps counters, gauges and histograms in memory and
+// serves them in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// maxSeries bounds the label combinations of one metric; label values past
+// it are recorded as "other" so a misbehaving client cannot grow memory.
+const maxSeries = 1000
+
+// Registry is a set of metrics written together by Handler.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+	names   map[string]bool
+}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// Default holds the metrics of the cloud server.
+var Default = NewRegistry()
+
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[name] {
+		panic("metrics: " + name + " registered twice")
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteTo writes every metric in the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	counter := &countingWriter{w: w}
+	buf := bufio.NewWriter(counter)
+	for _, m := range metrics {
+		m.write(buf)
+	}
+	err := buf.Flush()
+	return counter.n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// series tracks the label combinations of one metric.
+type series[T any] struct {
+	name   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]*T
+	keys   map[string][]string
+	warned bool
+}
+
+func (s *series[T]) get(values []string, create func() *T) *T {
+	if len(values) != len(s.labels) {
+		panic(fmt.Sprintf("metrics: %s wants %d label values, got %d", s.name, len(s.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if value, ok := s.values[key]; ok {
+		return value
+	}
+	if len(s.values) >= maxSeries {
+		if !s.warned {
+			s.warned = true
+			slog.Warn("metrics: too many series, recording new ones as other", "metric", s.name, "max", maxSeries)
+		}
+		values = make([]string, len(s.labels))
+		for i := range values {
+			values[i] = "other"
+		}
+		key = strings.Join(values, "\xff")
+		if value, ok := s.values[key]; ok {
+			return value
+		}
+	}
+	value := create()
+	s.values[key] = value
+	s.keys[key] = append([]string(nil), values...)
+	return value
+}
+
+// sorted returns the series in a stable order for output.
+func (s *series[T]) sorted() ([][]string, []*T) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	labels := make([][]string, len(keys))
+	values := make([]*T, len(keys))
+	for i, key := range keys {
+		labels[i] = s.keys[key]
+		values[i] = s.values[key]
+	}
+	return labels, values
+}
+
+func newSeries[T any](name string, labels []string) series[T] {
+	return series[T]{name: name, labels: labels, values: make(map[string]*T), keys: make(map[string][]string)}
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	bits atomic.Uint64
+}
+
+func (c *Counter) Inc() { c.Add(1) }
+
+func (c *Counter) Add(delta float64) {
+	for {
+		old := c.bits.Load()
+		next := math.Float64bits(math.Float64frombits(old) + delta)
+		if c.bits.CompareAndSwap(old, next) {
+			return
+		}
+	}
+}
+
+func (c *Counter) Value() float64 {
+	return math.Float64frombits(c.bits.Load())
+}
+
+type CounterVec struct {
+	help   string
+	series series[Counter]
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{help: help, series: newSeries[Counter](name, labels)}
+	r.register(name, c)
+	return c
+}
+
+// With returns the counter of the label values, in the order the labels
+// were declared.
+func (c *CounterVec) With(values ...string) *Counter {
+	return c.series.get(values, func() *Counter { return &Counter{} })
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	writeHeader(w, c.series.name, c.help, "counter")
+	labels, counters := c.series.sorted()
+	for i, counter := range counters {
+		writeSample(w, c.series.name, c.series.labels, labels[i], counter.Value())
+	}
+}
+
+// DefaultBuckets suit request latencies in seconds.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type Histogram struct {
+	buckets []float64
+	mu      sync.Mutex
+	counts  []uint64 // per bucket, not cumulative
+	count   uint64
+	sum     float64
+}
+
+func (h *Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.buckets, value)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += value
+}
+
+type HistogramVec struct {
+	help    string
+	buckets []float64
+	series  series[Histogram]
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{help: help, buckets: buckets, series: newSeries[Histogram](name, labels)}
+	r.register(name, h)
+	return h
+}
+
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return h.series.get(values, func() *Histogram {
+		return &Histogram{buckets: h.buckets, counts: make([]uint64, len(h.buckets))}
+	})
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	name := h.series.name
+	writeHeader(w, name, h.help, "histogram")
+	bucketLabels := append(append([]string(nil), h.series.labels...), "le")
+	labels, histograms := h.series.sorted()
+	for i, histogram := range histograms {
+		histogram.mu.Lock()
+		counts := append([]uint64(nil), histogram.counts...)
+		count, sum := histogram.count, histogram.sum
+		histogram.mu.Unlock()
+
+		values := make([]string, len(labels[i])+1)
+		copy(values, labels[i])
+		le := len(values) - 1
+		cumulative := uint64(0)
+		for j, bound := range h.buckets {
+			cumulative += counts[j]
+			values[le] = formatFloat(bound)
+			writeSample(w, name+"_bucket", bucketLabels, values, float64(cumulative))
+		}
+		values[le] = "+Inf"
+		writeSample(w, name+"_bucket", bucketLabels, values, float64(count))
+		writeSample(w, name+"_sum", h.series.labels, labels[i], sum)
+		writeSample(w, name+"_count", h.series.labels, labels[i], float64(count))
+	}
+}
+
+// Sample is one value reported by a func metric.
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+// funcMetric asks collect for its samples at every scrape; for state the
+// server already keeps, such as connected clients.
+type funcMetric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	collect func() []Sample
+}
+
+// NewGaugeFunc registers a gauge whose samples come from collect.
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, collect func() []Sample) {
+	r.register(name, &funcMetric{name: name, help: help, kind: "gauge", labels: labels, collect: collect})
+}
+
+// NewCounterFunc registers a counter kept elsewhere, e.g. in the hub.
+func (r *Registry) NewCounterFunc(name, help string, labels []string, collect func() []Sample) {
+	r.register(name, &funcMetric{name: name, help: help, kind: "counter", labels: labels, collect: collect})
+}
+
+func (f *funcMetric) write(w *bufio.Writer) {
+	writeHeader(w, f.name, f.help, f.kind)
+	for _, sample := range f.collect() {
+		writeSample(w, f.name, f.labels, sample.Labels, sample.Value)
+	}
+}
+
+func writeHeader(w *bufio.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, strings.ReplaceAll(help, "\n", " "), name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeSample(w *bufio.Writer, name string, labels, values []string, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(label)
+			w.WriteString(`="`)
+			w.WriteString(labelEscaper.Replace(values[i]))
+			w.WriteByte('"')
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistryWritesPrometheusText(t *testing.T) {
+	registry := NewRegistry()
+	messages := registry.NewCounterVec("test_messages_total", "Messages.", "type")
+	latency := registry.NewHistogramVec("test_latency_seconds", "Latency.", []float64{0.1, 1}, "route")
+	registry.NewGaugeFunc("test_connections", "Connections.", []string{"role"}, func() []Sample {
+		return []Sample{{Labels: []string{`we"ird`}, Value: 3}}
+	})
+
+	messages.With("terminal_output").Inc()
+	messages.With("terminal_output").Add(2)
+	latency.With("/api/tasks").Observe(0.05)
+	latency.With("/api/tasks").Observe(0.5)
+	latency.With("/api/tasks").Observe(5)
+
+	var out strings.Builder
+	registry.WriteTo(&out)
+	for _, want := range []string{
+		"# TYPE test_messages_total counter\n",
+		`test_messages_total{type="terminal_output"} 3` + "\n",
+		"# TYPE test_latency_seconds histogram\n",
+		`test_latency_seconds_bucket{route="/api/tasks",le="0.1"} 1` + "\n",
+		`test_latency_seconds_bucket{route="/api/tasks",le="1"} 2` + "\n",
+		`test_latency_seconds_bucket{route="/api/tasks",le="+Inf"} 3` + "\n",
+		`test_latency_seconds_sum{route="/api/tasks"} 5.55` + "\n",
+		`test_latency_seconds_count{route="/api/tasks"} 3` + "\n",
+		`test_connections{role="we\"ird"} 3` + "\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestCounterVecCapsSeries(t *testing.T) {
+	registry := NewRegistry()
+	counter := registry.NewCounterVec("test_capped_total", "Capped.", "type")
+	for i := 0; i < maxSeries+10; i++ {
+		counter.With(strings.Repeat("x", i+1)).Inc()
+	}
+	if got := counter.With("other").Value(); got != 10 {
+		t.Fatalf("other = %v, want the 10 series past the cap", got)
+	}
+}
+
+func TestHandlerRequiresToken(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounterVec("test_total", "Test.").With().Inc()
+	handler := Handler(registry, "scrape-secret")
+
+	for _, auth := range []string{"", "Bearer wrong", "scrape-secret"} {
+		request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if auth != "" {
+			request.Header.Set("Authorization", auth)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusUnauthorized {
+			t.Fatalf("Authorization %q: status = %d, want 401", auth, recorder.Code)
+		}
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	request.Header.Set("Authorization", "Bearer scrape-secret")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "test_total 1") {
+		t.Fatalf("status = %d, body = %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestInstrumentHTTPUsesMuxPattern(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/tasks/detail", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "task not found", http.StatusNotFound)
+	})
+	handler := InstrumentHTTP(mux)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/tasks/detail?id=task-1", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/nope", nil))
+
+	var out strings.Builder
+	Default.WriteTo(&out)
+	for _, want := range []string{
+		`mobilecoder_http_request_duration_seconds_count{route="/api/tasks/detail",method="GET",code="404"} 1`,
+		`mobilecoder_http_request_duration_seconds_count{route="unmatched",method="GET",code="404"} 1`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output lacks %q", want)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package ratelimit
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Middleware limits each client IP to the limiter's policy per path, and
+// answers 429 while the IP is locked out.
+func Middleware(limiter *Limiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Path + " " + clientIP(r)
+		if retryAfter := limiter.Check(key); retryAfter > 0 {
+			TooManyRequests(w, retryAfter)
+			return
+		}
+		limiter.Hit(key)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// TooManyRequests answers 429 with Retry-After in whole seconds.
+func TooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	http.Error(w, "too many attempts, try again later", http.StatusTooManyRequests)
+}
+
+// clientIP is the host of the remote address, which the server rewrites
+// from proxy headers when it trusts them.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,141 @@
+// Package ratelimit throttles brute-force attempts on the auth and bind
+// endpoints. A key (an IP, an account, a device) may have Limit events per
+// Window; the event that reaches the limit locks the key out, for twice as
+// long on each lockout that follows.
+//
+// State is kept in memory, so with several replicas each one counts on its
+// own.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Policy configures a Limiter.
+type Policy struct {
+	Limit      int           // events per Window that lock the key out
+	Window     time.Duration // fixed window the events are counted in
+	Lockout    time.Duration // first lockout, doubled on each one after
+	MaxLockout time.Duration // cap of the lockout; a key quiet this long starts over
+}
+
+type keyState struct {
+	count       int
+	windowStart time.Time
+	lockouts    int
+	lockedUntil time.Time
+}
+
+// Limiter counts events per key. The zero Limit disables it.
+type Limiter struct {
+	policy    Policy
+	now       func() time.Time
+	mu        sync.Mutex
+	keys      map[string]*keyState
+	lastSweep time.Time
+}
+
+func New(policy Policy) *Limiter {
+	return NewWithClock(policy, time.Now)
+}
+
+// NewWithClock is New with a custom clock, for tests.
+func NewWithClock(policy Policy, now func() time.Time) *Limiter {
+	if policy.MaxLockout < policy.Lockout {
+		policy.MaxLockout = policy.Lockout
+	}
+	return &Limiter{
+		policy: policy,
+		now:    now,
+		keys:   make(map[string]*keyState),
+	}
+}
+
+// Check returns how long key stays locked out, 0 if it may go ahead.
+func (l *Limiter) Check(key string) time.Duration {
+	if l == nil || l.policy.Limit <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	state := l.keys[key]
+	if state == nil {
+		return 0
+	}
+	return l.remaining(state, l.now())
+}
+
+// Hit records an event for key and returns the lockout it caused, 0 if
+// the key is still under its limit. Events while locked out are ignored.
+func (l *Limiter) Hit(key string) time.Duration {
+	if l == nil || l.policy.Limit <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	state := l.keys[key]
+	if state == nil {
+		state = &keyState{windowStart: now}
+		l.keys[key] = state
+	}
+	if remaining := l.remaining(state, now); remaining > 0 {
+		return remaining
+	}
+	// A key that behaved for a whole MaxLockout is forgiven earlier lockouts
+	if state.lockouts > 0 && now.Sub(state.lockedUntil) >= l.policy.MaxLockout {
+		state.lockouts = 0
+	}
+	if now.Sub(state.windowStart) >= l.policy.Window {
+		state.count, state.windowStart = 0, now
+	}
+	state.count++
+	if state.count < l.policy.Limit {
+		return 0
+	}
+
+	lockout := l.policy.Lockout
+	for i := 0; i < state.lockouts && lockout < l.policy.MaxLockout; i++ {
+		lockout *= 2
+	}
+	lockout = min(lockout, l.policy.MaxLockout)
+	state.lockouts++
+	state.lockedUntil = now.Add(lockout)
+	state.count, state.windowStart = 0, now
+	return lockout
+}
+
+// Reset forgets key, e.g. after a successful login.
+func (l *Limiter) Reset(key string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.keys, key)
+}
+
+func (l *Limiter) remaining(state *keyState, now time.Time) time.Duration {
+	if remaining := state.lockedUntil.Sub(now); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// sweep drops keys with nothing left to remember, at most once a window.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.policy.Window {
+		return
+	}
+	l.lastSweep = now
+	for key, state := range l.keys {
+		windowOver := now.Sub(state.windowStart) >= l.policy.Window
+		forgiven := state.lockouts == 0 || now.Sub(state.lockedUntil) >= l.policy.MaxLockout
+		if windowOver && forgiven && l.remaining(state, now) == 0 {
+			delete(l.keys, key)
+		}
+	}
+}
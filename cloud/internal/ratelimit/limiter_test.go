@@ -0,0 +1,136 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestLimiter(limit int) (*Limiter, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2026, 4, 19, 9, 0, 0, 0, time.UTC)}
+	limiter := NewWithClock(Policy{
+		Limit:      limit,
+		Window:     time.Minute,
+		Lockout:    time.Minute,
+		MaxLockout: 5 * time.Minute,
+	}, clock.Now)
+	return limiter, clock
+}
+
+func TestLimiterLocksOutAtTheLimit(t *testing.T) {
+	limiter, clock := newTestLimiter(3)
+
+	for i := 0; i < 2; i++ {
+		if lockout := limiter.Hit("login:a@example.com"); lockout != 0 {
+			t.Fatalf("hit %d locked out for %v", i+1, lockout)
+		}
+	}
+	if lockout := limiter.Hit("login:a@example.com"); lockout != time.Minute {
+		t.Fatalf("third hit lockout = %v, want 1m", lockout)
+	}
+	if limiter.Check("login:b@example.com") != 0 {
+		t.Fatal("another key is locked out")
+	}
+
+	clock.Advance(20 * time.Second)
+	if remaining := limiter.Check("login:a@example.com"); remaining != 40*time.Second {
+		t.Fatalf("remaining = %v, want 40s", remaining)
+	}
+	clock.Advance(40 * time.Second)
+	if remaining := limiter.Check("login:a@example.com"); remaining != 0 {
+		t.Fatalf("still locked out after the lockout: %v", remaining)
+	}
+}
+
+func TestLimiterDoublesRepeatedLockoutsUpToTheCap(t *testing.T) {
+	limiter, clock := newTestLimiter(1)
+
+	var lockouts []time.Duration
+	for i := 0; i < 5; i++ {
+		lockout := limiter.Hit("ip")
+		lockouts = append(lockouts, lockout)
+		clock.Advance(lockout)
+	}
+	want := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute}
+	for i := range want {
+		if lockouts[i] != want[i] {
+			t.Fatalf("lockouts = %v, want %v", lockouts, want)
+		}
+	}
+
+	// Quiet for a whole MaxLockout, the key starts over
+	clock.Advance(5 * time.Minute)
+	if lockout := limiter.Hit("ip"); lockout != time.Minute {
+		t.Fatalf("lockout after a quiet period = %v, want 1m", lockout)
+	}
+}
+
+func TestLimiterCountsPerWindowAndResets(t *testing.T) {
+	limiter, clock := newTestLimiter(2)
+
+	limiter.Hit("k")
+	clock.Advance(time.Minute)
+	if lockout := limiter.Hit("k"); lockout != 0 {
+		t.Fatalf("hit in a new window locked out for %v", lockout)
+	}
+	limiter.Reset("k")
+	if lockout := limiter.Hit("k"); lockout != 0 {
+		t.Fatalf("hit after Reset locked out for %v", lockout)
+	}
+}
+
+func TestLimiterWithZeroLimitAllowsEverything(t *testing.T) {
+	limiter, _ := newTestLimiter(0)
+	for i := 0; i < 100; i++ {
+		if limiter.Hit("k") != 0 || limiter.Check("k") != 0 {
+			t.Fatal("disabled limiter locked out")
+		}
+	}
+	var nilLimiter *Limiter
+	if nilLimiter.Hit("k") != 0 || nilLimiter.Check("k") != 0 {
+		t.Fatal("nil limiter locked out")
+	}
+}
+
+func TestMiddlewareAnswers429WithRetryAfter(t *testing.T) {
+	limiter, clock := newTestLimiter(2)
+	served := 0
+	handler := Middleware(limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+	}))
+
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/auth/login", nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	request("198.51.100.7:1000")
+	request("198.51.100.7:1001")
+	clock.Advance(1500 * time.Millisecond)
+	rec := request("198.51.100.7:1002")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "59" {
+		t.Fatalf("status = %d, Retry-After = %q, want 429 and 59", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec := request("198.51.100.8:1000"); rec.Code != http.StatusOK {
+		t.Fatalf("other IP got %d", rec.Code)
+	}
+	if served != 3 {
+		t.Fatalf("served = %d, want 3", served)
+	}
+}
@@ -0,0 +1,53 @@
+package service
+
+// Capabilities an agent may report in its hello handshake.
+const (
+	CapabilityDiff      = "diff"
+	CapabilityGitAction = "git_action"
+	CapabilityFiles     = "files"
+	CapabilityUpload    = "upload"
+	CapabilityResume    = "resume"
+)
+
+// AgentTool is an AI tool found on the agent's machine.
+type AgentTool struct {
+	Name      string `json:"name"`
+	Installed bool   `json:"installed"`
+	Version   string `json:"version,omitempty"`
+}
+
+// AgentInfo is what an agent reports in its hello handshake. Compatible is
+// decided by the cloud from the protocol version.
+type AgentInfo struct {
+	Version         string      `json:"version"`
+	ProtocolVersion int         `json:"protocol_version"`
+	OS              string      `json:"os"`
+	Arch            string      `json:"arch"`
+	TmuxVersion     string      `json:"tmux_version,omitempty"`
+	Tools           []AgentTool `json:"tools"`
+	Capabilities    []string    `json:"capabilities"`
+	Encodings       []string    `json:"encodings,omitempty"` // frame encodings the agent can read
+	Encoding        string      `json:"encoding,omitempty"`  // encoding chosen by the cloud
+	Compatible      bool        `json:"compatible"`
+	ConnectedAt     string      `json:"connected_at"`
+}
+
+// Supports reports whether the agent announced the capability.
+func (i *AgentInfo) Supports(capability string) bool {
+	for _, c := range i.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsEncoding reports whether the agent can read frames in encoding.
+func (i *AgentInfo) SupportsEncoding(encoding string) bool {
+	for _, e := range i.Encodings {
+		if e == encoding {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+var (
+	ErrAgentUnavailable   = errors.New("agent is not connected")
+	ErrAgentTimeout       = errors.New("agent did not respond in time")
+	ErrAgentRequestFailed = errors.New("agent request failed")
+	ErrAgentIncompatible  = errors.New("agent protocol version is not supported, please update the agent")
+	ErrAgentUnsupported   = errors.New("agent does not support this feature, please update the agent")
+)
+
+// Error codes an agent may attach to a failed reply.
+const (
+	AgentErrorForbidden = "forbidden"
+	AgentErrorNotFound  = "not_found"
+	AgentErrorInvalid   = "invalid"
+)
+
+// AgentError is a failure reported by the agent itself.
+type AgentError struct {
+	Code    string
+	Message string
+}
+
+func (e *AgentError) Error() string {
+	return ErrAgentRequestFailed.Error() + ": " + e.Message
+}
+
+func (e *AgentError) Unwrap() error {
+	return ErrAgentRequestFailed
+}
+
+// agentRequester sends a request to the agent serving a session and waits
+// for the reply carrying the same request_id.
+type agentRequester interface {
+	RequestAgent(ctx context.Context, deviceID, sessionName, msgType string, payload interface{}) (json.RawMessage, error)
+}
+
+// agentRequestError maps context errors of a pending request to service
+// errors.
+func agentRequestError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrAgentTimeout
+	}
+	return err
+}
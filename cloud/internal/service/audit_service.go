@@ -0,0 +1,225 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/mobile-coder/cloud/internal/db"
+	"github.com/mobile-coder/cloud/internal/metrics"
+	"github.com/mobile-coder/logging"
+)
+
+// Audited actions.
+const (
+	AuditTerminalInput = "terminal_input"
+	AuditDeviceBind    = "device_bind"
+	AuditDeviceDelete  = "device_delete"
+	AuditSessionDelete = "session_delete"
+	AuditLogin         = "login"
+	AuditTokenIssued   = "token_issued"
+	AuditGitAction     = "git_action"
+)
+
+// Audit statuses.
+const (
+	AuditStatusOK     = "ok"
+	AuditStatusFailed = "failed"
+	AuditStatusDenied = "denied"
+)
+
+const (
+	auditQueueSize    = 1024
+	auditBatchSize    = 100
+	auditWriteTries   = 3
+	auditDefaultLimit = 100
+	auditMaxLimit     = 1000
+)
+
+var ErrAuditForbidden = errors.New("audit entries of other users require the operator role")
+
+type auditStore interface {
+	GetUserByID(ctx context.Context, userID int64) (*db.User, error)
+	CreateAuditEntries(ctx context.Context, entries []db.AuditEntry) error
+	ListAuditEntries(ctx context.Context, filter db.AuditFilter) ([]db.AuditEntry, error)
+}
+
+// AuditEvent is a remote action to record. Content is stored as a SHA-256
+// hash, and in full only when the service keeps content.
+type AuditEvent struct {
+	Action      string
+	Status      string // AuditStatusOK if empty
+	UserID      int64
+	DeviceID    string
+	SessionName string
+	SourceIP    string
+	Content     string
+	Detail      map[string]string
+}
+
+// AuditService appends remote actions to the audit log. Entries are written
+// in batches by Run, so keystrokes never wait for the database. Entries the
+// store keeps refusing go to the server log instead (see logUnstored).
+type AuditService struct {
+	store        auditStore
+	storeContent bool
+	now          func() time.Time
+	retryDelay   time.Duration
+	queue        chan db.AuditEntry
+	done         chan struct{} // closed when Run has written the queue out
+
+	mu     sync.RWMutex // guards closed against sends on the closed queue
+	closed bool
+}
+
+func NewAuditService(database *db.SupabaseDB, storeContent bool) *AuditService {
+	service := &AuditService{
+		storeContent: storeContent,
+		now:          time.Now,
+		retryDelay:   time.Second,
+		queue:        make(chan db.AuditEntry, auditQueueSize),
+		done:         make(chan struct{}),
+	}
+	if database != nil {
+		service.store = database
+	}
+	return service
+}
+
+// Record queues event without blocking. While the writer is a full queue
+// behind, the entry goes to the server log instead, so a store outage never
+// stalls the connection recording it.
+func (s *AuditService) Record(ctx context.Context, event AuditEvent) {
+	entry := db.AuditEntry{
+		Action:      event.Action,
+		Status:      event.Status,
+		UserID:      event.UserID,
+		DeviceID:    event.DeviceID,
+		SessionName: event.SessionName,
+		SourceIP:    event.SourceIP,
+		RequestID:   logging.RequestID(ctx),
+		Detail:      event.Detail,
+		CreatedAt:   s.now().UTC().Format(time.RFC3339Nano),
+	}
+	if entry.Status == "" {
+		entry.Status = AuditStatusOK
+	}
+	if event.Content != "" {
+		sum := sha256.Sum256([]byte(event.Content))
+		entry.ContentHash = hex.EncodeToString(sum[:])
+		if s.storeContent {
+			content := event.Content
+			entry.Content = &content
+		}
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		logUnstored([]db.AuditEntry{entry}, errors.New("audit service closed"))
+		return
+	}
+	select {
+	case s.queue <- entry:
+	default:
+		metrics.AuditEntriesDropped.With().Add(1)
+		logUnstored([]db.AuditEntry{entry}, errors.New("audit queue full"))
+	}
+}
+
+// Close stops taking entries and waits until Run has written the queued
+// ones.
+func (s *AuditService) Close() {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+	<-s.done
+}
+
+// Run writes queued entries until Close.
+func (s *AuditService) Run() {
+	defer close(s.done)
+	for entry := range s.queue {
+		batch := []db.AuditEntry{entry}
+	drain:
+		for len(batch) < auditBatchSize {
+			select {
+			case entry, ok := <-s.queue:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, entry)
+			default:
+				break drain
+			}
+		}
+		// A batch holds entries of many requests, so it is a trace of its own
+		s.write(context.Background(), batch)
+	}
+}
+
+func (s *AuditService) write(ctx context.Context, batch []db.AuditEntry) {
+	var err error
+	for try := 1; try <= auditWriteTries; try++ {
+		if err = s.store.CreateAuditEntries(ctx, batch); err == nil {
+			return
+		}
+		if try < auditWriteTries {
+			time.Sleep(time.Duration(try) * s.retryDelay)
+		}
+	}
+	logUnstored(batch, err)
+}
+
+// logUnstored writes entries the store did not take to the server log, one
+// record each, so they can be restored from there. Content stays out; the
+// hash identifies it.
+func logUnstored(entries []db.AuditEntry, err error) {
+	for _, entry := range entries {
+		slog.Error("audit entry not stored",
+			"action", entry.Action,
+			"status", entry.Status,
+			"user_id", entry.UserID,
+			"device_id", entry.DeviceID,
+			"session_name", entry.SessionName,
+			"source_ip", entry.SourceIP,
+			"request_id", entry.RequestID,
+			"content_hash", entry.ContentHash,
+			"detail", entry.Detail,
+			"created_at", entry.CreatedAt,
+			"error", err,
+		)
+	}
+	metrics.AuditEntriesNotStored.With().Add(float64(len(entries)))
+}
+
+// ListAudit returns entries matching filter, newest first. Members see
+// their own entries; operators may ask for any user's, or everyone's with
+// a zero UserID.
+func (s *AuditService) ListAudit(ctx context.Context, userID int64, filter db.AuditFilter) ([]db.AuditEntry, error) {
+	if filter.UserID != userID {
+		user, err := s.store.GetUserByID(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		if !hasRole(user, UserRoleOperator) {
+			if filter.UserID != 0 {
+				return nil, ErrAuditForbidden
+			}
+			filter.UserID = userID
+		}
+	}
+	if filter.Limit <= 0 {
+		filter.Limit = auditDefaultLimit
+	}
+	if filter.Limit > auditMaxLimit {
+		filter.Limit = auditMaxLimit
+	}
+	return s.store.ListAuditEntries(ctx, filter)
+}
@@ -0,0 +1,227 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/mobile-coder/cloud/internal/db"
+	"github.com/mobile-coder/logging"
+)
+
+type fakeAuditStore struct {
+	users   map[int64]*db.User
+	failN   int
+	writes  chan []db.AuditEntry
+	filters []db.AuditFilter
+}
+
+func (f *fakeAuditStore) GetUserByID(ctx context.Context, userID int64) (*db.User, error) {
+	return f.users[userID], nil
+}
+
+func (f *fakeAuditStore) CreateAuditEntries(ctx context.Context, entries []db.AuditEntry) error {
+	if f.failN > 0 {
+		f.failN--
+		return errors.New("supabase unavailable")
+	}
+	f.writes <- entries
+	return nil
+}
+
+func (f *fakeAuditStore) ListAuditEntries(ctx context.Context, filter db.AuditFilter) ([]db.AuditEntry, error) {
+	f.filters = append(f.filters, filter)
+	return nil, nil
+}
+
+func newAuditServiceForTest(storeContent bool) (*AuditService, *fakeAuditStore) {
+	store := &fakeAuditStore{
+		users:  map[int64]*db.User{7: {ID: 7, Role: "member"}, 8: {ID: 8, Role: UserRoleAdmin}, 9: {ID: 9, Role: UserRoleOperator}},
+		writes: make(chan []db.AuditEntry, 10),
+	}
+	service := NewAuditService(nil, storeContent)
+	service.store = store
+	service.now = func() time.Time { return time.Date(2026, 4, 19, 9, 0, 0, 0, time.UTC) }
+	service.retryDelay = time.Millisecond
+	return service, store
+}
+
+func nextAuditWrite(t *testing.T, store *fakeAuditStore) []db.AuditEntry {
+	t.Helper()
+	select {
+	case entries := <-store.writes:
+		return entries
+	case <-time.After(time.Second):
+		t.Fatal("audit entries were not written")
+		return nil
+	}
+}
+
+func TestAuditServiceHashesContent(t *testing.T) {
+	service, store := newAuditServiceForTest(false)
+	go service.Run()
+
+	ctx := logging.WithRequestID(context.Background(), "req-1")
+	service.Record(ctx, AuditEvent{
+		Action:      AuditTerminalInput,
+		UserID:      7,
+		DeviceID:    "dev-1",
+		SessionName: "feature",
+		SourceIP:    "203.0.113.5",
+		Content:     "rm -rf build",
+	})
+
+	entries := nextAuditWrite(t, store)
+	if len(entries) != 1 {
+		t.Fatalf("entries = %+v, want one", entries)
+	}
+	entry := entries[0]
+	// sha256("rm -rf build")
+	if entry.ContentHash != "17f69ae2697b61fda85f4efef12aad45a1bb7dda951b5dacf0132eb76e0807be" {
+		t.Fatalf("content hash = %q", entry.ContentHash)
+	}
+	if entry.Content != nil {
+		t.Fatalf("content stored without AUDIT_STORE_CONTENT: %q", *entry.Content)
+	}
+	if entry.Status != AuditStatusOK || entry.RequestID != "req-1" || entry.SourceIP != "203.0.113.5" || entry.CreatedAt != "2026-04-19T09:00:00Z" {
+		t.Fatalf("entry = %+v", entry)
+	}
+}
+
+func TestAuditServiceStoresContentWhenEnabled(t *testing.T) {
+	service, store := newAuditServiceForTest(true)
+	go service.Run()
+
+	service.Record(context.Background(), AuditEvent{Action: AuditTerminalInput, Content: "ls"})
+	service.Record(context.Background(), AuditEvent{Action: AuditLogin, UserID: 7})
+
+	var entries []db.AuditEntry
+	for len(entries) < 2 {
+		entries = append(entries, nextAuditWrite(t, store)...)
+	}
+	if entries[0].Content == nil || *entries[0].Content != "ls" {
+		t.Fatalf("content = %v, want the input kept", entries[0].Content)
+	}
+	if entries[1].ContentHash != "" || entries[1].Content != nil {
+		t.Fatalf("login entry = %+v, want no content", entries[1])
+	}
+}
+
+func TestAuditServiceRetriesFailedWrites(t *testing.T) {
+	service, store := newAuditServiceForTest(false)
+	store.failN = auditWriteTries - 1
+	go service.Run()
+
+	service.Record(context.Background(), AuditEvent{Action: AuditDeviceDelete, UserID: 7, DeviceID: "dev-1"})
+	if entries := nextAuditWrite(t, store); len(entries) != 1 || entries[0].DeviceID != "dev-1" {
+		t.Fatalf("entries = %+v", entries)
+	}
+}
+
+func TestAuditServiceLogsEntriesItCannotStore(t *testing.T) {
+	var out bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&out, nil)))
+	defer slog.SetDefault(previous)
+
+	service, store := newAuditServiceForTest(false)
+	store.failN = auditWriteTries
+	go service.Run()
+	service.Record(context.Background(), AuditEvent{Action: AuditDeviceDelete, UserID: 7, DeviceID: "dev-1"})
+	service.Close()
+
+	var record map[string]any
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("log = %q: %v", out.String(), err)
+	}
+	if record["msg"] != "audit entry not stored" || record["action"] != AuditDeviceDelete || record["device_id"] != "dev-1" {
+		t.Fatalf("log record = %v, want the unstored entry", record)
+	}
+}
+
+func TestAuditServiceLogsEntriesWhenTheQueueIsFull(t *testing.T) {
+	var out bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&out, nil)))
+	defer slog.SetDefault(previous)
+
+	// Without Run nothing drains the queue, as during a store outage
+	service, _ := newAuditServiceForTest(false)
+	for i := 0; i < auditQueueSize; i++ {
+		service.Record(context.Background(), AuditEvent{Action: AuditLogin, UserID: 7})
+	}
+	if out.Len() != 0 {
+		t.Fatalf("log = %q before the queue was full", out.String())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		service.Record(context.Background(), AuditEvent{Action: AuditTerminalInput, UserID: 7, DeviceID: "dev-1"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Record blocked on the full queue")
+	}
+
+	var record map[string]any
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("log = %q: %v", out.String(), err)
+	}
+	if record["msg"] != "audit entry not stored" || record["action"] != AuditTerminalInput || record["error"] != "audit queue full" {
+		t.Fatalf("log record = %v, want the entry that did not fit", record)
+	}
+}
+
+func TestAuditServiceCloseWritesQueuedEntries(t *testing.T) {
+	service, store := newAuditServiceForTest(false)
+	store.writes = make(chan []db.AuditEntry, auditQueueSize)
+	for i := 0; i < 5; i++ {
+		service.Record(context.Background(), AuditEvent{Action: AuditLogin, UserID: 7})
+	}
+	go service.Run()
+	service.Close()
+
+	written := 0
+	for len(store.writes) > 0 {
+		written += len(<-store.writes)
+	}
+	if written != 5 {
+		t.Fatalf("written = %d, want every queued entry", written)
+	}
+	// Late entries are logged rather than sent on the closed queue
+	service.Record(context.Background(), AuditEvent{Action: AuditLogin, UserID: 7})
+}
+
+func TestAuditServiceScopesMembersToTheirOwnEntries(t *testing.T) {
+	service, store := newAuditServiceForTest(false)
+
+	if _, err := service.ListAudit(context.Background(), 7, db.AuditFilter{Action: AuditLogin}); err != nil {
+		t.Fatalf("ListAudit: %v", err)
+	}
+	if _, err := service.ListAudit(context.Background(), 7, db.AuditFilter{UserID: 9}); !errors.Is(err, ErrAuditForbidden) {
+		t.Fatalf("err = %v, want ErrAuditForbidden", err)
+	}
+	if _, err := service.ListAudit(context.Background(), 9, db.AuditFilter{Limit: 5000}); err != nil {
+		t.Fatalf("ListAudit as operator: %v", err)
+	}
+	// Admins include the operator role
+	if _, err := service.ListAudit(context.Background(), 8, db.AuditFilter{UserID: 7}); err != nil {
+		t.Fatalf("ListAudit as admin: %v", err)
+	}
+
+	if len(store.filters) != 3 {
+		t.Fatalf("filters = %+v, want three queries", store.filters)
+	}
+	if got := store.filters[0]; got.UserID != 7 || got.Action != AuditLogin || got.Limit != auditDefaultLimit {
+		t.Fatalf("member filter = %+v", got)
+	}
+	if got := store.filters[1]; got.UserID != 0 || got.Limit != auditMaxLimit {
+		t.Fatalf("operator filter = %+v, want every user and a capped limit", got)
+	}
+}
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
@@ -25,21 +26,21 @@ func hashPassword(password string) string {
 }
 
 // Register creates a new user
-func (s *AuthService) Register(email, password string) (*db.User, error) {
+func (s *AuthService) Register(ctx context.Context, email, password string) (*db.User, error) {
 	// Check if user already exists
-	existingUser, _ := s.db.GetUserByEmail(email)
+	existingUser, _ := s.db.GetUserByEmail(ctx, email)
 	if existingUser != nil {
 		return nil, ErrUserAlreadyExists
 	}
 
 	hashedPassword := hashPassword(password)
 	// Use email as username for simplicity
-	return s.db.CreateUser(email, hashedPassword, email)
+	return s.db.CreateUser(ctx, email, hashedPassword, email)
 }
 
 // Login validates credentials and returns user
-func (s *AuthService) Login(email, password string) (*db.User, error) {
-	user, err := s.db.GetUserByEmail(email)
+func (s *AuthService) Login(ctx context.Context, email, password string) (*db.User, error) {
+	user, err := s.db.GetUserByEmail(ctx, email)
 	if err != nil {
 		return nil, ErrInvalidCredentials
 	}
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronNextMatchesExpressions(t *testing.T) {
+	base := time.Date(2026, 4, 15, 10, 7, 30, 0, time.UTC) // Wednesday
+
+	cases := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2026, 4, 15, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, 4, 15, 10, 15, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2026, 4, 16, 2, 0, 0, 0, time.UTC)},
+		{"30 9 * * 1-5", time.Date(2026, 4, 16, 9, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2026, 4, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 */3 *", time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{"5,10 12 * * *", time.Date(2026, 4, 15, 12, 5, 0, 0, time.UTC)},
+		// Both day fields restricted: either one matches.
+		{"0 0 20 * 5", time.Date(2026, 4, 17, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tc := range cases {
+		cron, err := ParseCron(tc.expr)
+		if err != nil {
+			t.Fatalf("ParseCron(%q): %v", tc.expr, err)
+		}
+		if got := cron.Next(base); !got.Equal(tc.want) {
+			t.Fatalf("Next(%q) = %s, want %s", tc.expr, got, tc.want)
+		}
+	}
+}
+
+func TestParseCronRejectsInvalidExpressions(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Fatalf("ParseCron(%q) succeeded, want error", expr)
+		}
+	}
+}
+
+func TestCronNextUsesLocation(t *testing.T) {
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skipf("timezone data unavailable: %v", err)
+	}
+	cron, _ := ParseCron("0 2 * * *")
+
+	got := cron.Next(time.Date(2026, 4, 15, 12, 0, 0, 0, time.UTC).In(shanghai))
+	want := time.Date(2026, 4, 15, 18, 0, 0, 0, time.UTC)
+	if !got.Equal(want) {
+		t.Fatalf("Next = %s, want %s", got.UTC(), want)
+	}
+}
+
+func TestCronPrevMirrorsNext(t *testing.T) {
+	for _, expr := range []string{"* * * * *", "*/15 9-17 * * 1-5", "0 2 * * *", "30 4 1,15 * 5", "0 0 29 2 *"} {
+		cron, err := ParseCron(expr)
+		if err != nil {
+			t.Fatalf("ParseCron(%q): %v", expr, err)
+		}
+		from := time.Date(2026, 4, 15, 10, 7, 30, 0, time.UTC)
+		next := cron.Next(from)
+		if got := cron.Prev(next.Add(time.Second)); !got.Equal(next) {
+			t.Fatalf("%q: Prev(Next+1s) = %s, want %s", expr, got, next)
+		}
+		if got := cron.Next(cron.Prev(next)); !got.Equal(next) {
+			t.Fatalf("%q: Next(Prev(next)) = %s, want %s", expr, got, next)
+		}
+	}
+}
+
+func TestDueOccurrencesKeepsLatestWithoutWalkingEveryMissedMinute(t *testing.T) {
+	cron, _ := ParseCron("* * * * *")
+	now := time.Date(2026, 4, 15, 10, 0, 0, 0, time.UTC)
+
+	due, truncated := dueOccurrences(cron, now.AddDate(-1, 0, 0), now)
+	if !truncated || len(due) != scheduleMaxCatchUpRuns {
+		t.Fatalf("len(due) = %d, truncated = %v; want %d, true", len(due), truncated, scheduleMaxCatchUpRuns)
+	}
+	if !due[len(due)-1].Equal(now) || !due[0].Equal(now.Add(-time.Duration(scheduleMaxCatchUpRuns-1)*time.Minute)) {
+		t.Fatalf("due = %s .. %s, want the latest occurrences oldest first", due[0], due[len(due)-1])
+	}
+
+	due, truncated = dueOccurrences(cron, now.Add(-2*time.Minute), now.Add(30*time.Second))
+	if truncated || len(due) != 3 {
+		t.Fatalf("due = %v, truncated = %v; want 3 occurrences", due, truncated)
+	}
+}
@@ -1,18 +1,22 @@
 package service
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
-	"log"
+	"log/slog"
 	"time"
 
 	"github.com/mobile-coder/cloud/internal/db"
 )
 
 var (
-	ErrDeviceNotFound  = errors.New("device not found")
-	ErrBindCodeExpired = errors.New("bind code expired")
+	ErrDeviceNotFound      = errors.New("device not found")
+	ErrBindCodeExpired     = errors.New("bind code expired")
+	ErrBindCodeInUse       = errors.New("bind code in use")
+	ErrSessionNotFound     = errors.New("session not found")
+	ErrDeviceListForbidden = errors.New("only admins may list all devices")
 )
 
 type Device struct {
@@ -20,10 +24,11 @@ type Device struct {
 	UserID       int64
 	DeviceID     string
 	DeviceName   string
-	BindCode     string
-	BindCodeExp  time.Time
+	BindCode     string    `json:"-"` // 只在注册时返回给 agent，列表里不能泄露
+	BindCodeExp  time.Time `json:"-"`
 	Status       string
 	LastActiveAt string
+	Agent        *AgentInfo // 在线 agent 的握手信息，离线或旧版 agent 为空
 }
 
 type Session struct {
@@ -35,6 +40,17 @@ type Session struct {
 	CreatedAt   string
 }
 
+// AgentPresence is a change in which agents the hub has connected: the
+// session's agent came or went, and whether any agent of the device is
+// still connected.
+type AgentPresence struct {
+	DeviceID      string
+	SessionName   string
+	SessionOnline bool
+	DeviceOnline  bool
+	LastSeen      time.Time
+}
+
 type DeviceService struct {
 	db *db.SupabaseDB
 }
@@ -50,12 +66,22 @@ func generateCode(length int) string {
 }
 
 // RegisterDevice creates a device with user-provided bind code (for Desktop Agent)
-func (s *DeviceService) RegisterDevice(bindCode, deviceName string) (*Device, error) {
+// A code still pending on any device is refused with ErrBindCodeInUse,
+// so a new registration cannot take over a code someone is about to enter.
+func (s *DeviceService) RegisterDevice(ctx context.Context, bindCode, deviceName string) (*Device, error) {
+	if existing, err := s.db.GetDeviceByBindCode(ctx, bindCode); err == nil {
+		loc := time.FixedZone("UTC+8", 8*3600)
+		exp, err := time.ParseInLocation("2006-01-02T15:04:05", existing.BindCodeExp, loc)
+		if err != nil || time.Now().Before(exp) {
+			return nil, ErrBindCodeInUse
+		}
+	}
+
 	deviceID := generateCode(16)
 	bindCodeExp := time.Now().Add(10 * time.Minute).Format(time.RFC3339)
 
 	// UserID is 0 until H5 binds the device
-	device, err := s.db.CreateDevice(0, deviceID, deviceName, bindCode, bindCodeExp)
+	device, err := s.db.CreateDevice(ctx, 0, deviceID, deviceName, bindCode, bindCodeExp)
 	if err != nil {
 		return nil, err
 	}
@@ -73,12 +99,12 @@ func (s *DeviceService) RegisterDevice(bindCode, deviceName string) (*Device, er
 	}, nil
 }
 
-func (s *DeviceService) CreateBindCode(userID int64, deviceName string) (*Device, error) {
+func (s *DeviceService) CreateBindCode(ctx context.Context, userID int64, deviceName string) (*Device, error) {
 	deviceID := generateCode(16)
 	bindCode := generateCode(6)
 	bindCodeExp := time.Now().Add(10 * time.Minute).Format(time.RFC3339)
 
-	device, err := s.db.CreateDevice(userID, deviceID, deviceName, bindCode, bindCodeExp)
+	device, err := s.db.CreateDevice(ctx, userID, deviceID, deviceName, bindCode, bindCodeExp)
 	if err != nil {
 		return nil, err
 	}
@@ -97,8 +123,8 @@ func (s *DeviceService) CreateBindCode(userID int64, deviceName string) (*Device
 	}, nil
 }
 
-func (s *DeviceService) BindDevice(userID int64, bindCode string) (*Device, error) {
-	device, err := s.db.GetDeviceByBindCode(bindCode)
+func (s *DeviceService) BindDevice(ctx context.Context, userID int64, bindCode string) (*Device, error) {
+	device, err := s.db.GetDeviceByBindCode(ctx, bindCode)
 	if err != nil {
 		return nil, ErrDeviceNotFound
 	}
@@ -108,7 +134,7 @@ func (s *DeviceService) BindDevice(userID int64, bindCode string) (*Device, erro
 	loc := time.FixedZone("UTC+8", 8*3600)
 	parsedTime, err := time.ParseInLocation("2006-01-02T15:04:05", device.BindCodeExp, loc)
 	if err != nil {
-		log.Printf("Failed to parse bind_code_exp: %v, value: %s", err, device.BindCodeExp)
+		slog.Warn("device service: invalid bind_code_exp", "device_id", device.DeviceID, "value", device.BindCodeExp, "error", err)
 		return nil, ErrBindCodeExpired
 	}
 	if time.Now().After(parsedTime) {
@@ -116,7 +142,7 @@ func (s *DeviceService) BindDevice(userID int64, bindCode string) (*Device, erro
 	}
 
 	// Update device status
-	err = s.db.UpdateDeviceBindCode(device.DeviceID)
+	err = s.db.UpdateDeviceBindCode(ctx, device.DeviceID)
 	if err != nil {
 		return nil, err
 	}
@@ -132,8 +158,8 @@ func (s *DeviceService) BindDevice(userID int64, bindCode string) (*Device, erro
 	}, nil
 }
 
-func (s *DeviceService) GetUserDevices(userID int64) ([]Device, error) {
-	devices, err := s.db.GetUserDevices(userID)
+func (s *DeviceService) GetUserDevices(ctx context.Context, userID int64) ([]Device, error) {
+	devices, err := s.db.GetUserDevices(ctx, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -153,13 +179,13 @@ func (s *DeviceService) GetUserDevices(userID int64) ([]Device, error) {
 }
 
 // CreateBindCodeSimple - 简化版，无需用户登录
-func (s *DeviceService) CreateBindCodeSimple(deviceName string) (*Device, error) {
+func (s *DeviceService) CreateBindCodeSimple(ctx context.Context, deviceName string) (*Device, error) {
 	deviceID := generateCode(16)
 	bindCode := generateCode(6)
 	// 简化版：绑定码永久有效
 	bindCodeExp := ""
 
-	device, err := s.db.CreateDevice(0, deviceID, deviceName, bindCode, bindCodeExp)
+	device, err := s.db.CreateDevice(ctx, 0, deviceID, deviceName, bindCode, bindCodeExp)
 	if err != nil {
 		return nil, err
 	}
@@ -176,8 +202,8 @@ func (s *DeviceService) CreateBindCodeSimple(deviceName string) (*Device, error)
 }
 
 // BindDeviceSimple - 简化版，无需用户登录，绑定码永久有效
-func (s *DeviceService) BindDeviceSimple(bindCode string) (*Device, error) {
-	device, err := s.db.GetDeviceByBindCode(bindCode)
+func (s *DeviceService) BindDeviceSimple(ctx context.Context, bindCode string) (*Device, error) {
+	device, err := s.db.GetDeviceByBindCode(ctx, bindCode)
 	if err != nil {
 		return nil, ErrDeviceNotFound
 	}
@@ -185,7 +211,7 @@ func (s *DeviceService) BindDeviceSimple(bindCode string) (*Device, error) {
 	// 简化版：不再检查绑定码过期时间
 
 	// 更新设备状态
-	err = s.db.UpdateDeviceBindCode(device.DeviceID)
+	err = s.db.UpdateDeviceBindCode(ctx, device.DeviceID)
 	if err != nil {
 		return nil, err
 	}
@@ -199,9 +225,21 @@ func (s *DeviceService) BindDeviceSimple(bindCode string) (*Device, error) {
 	}, nil
 }
 
+// ListAllDevicesForAdmin is ListAllDevices for userID, who must be an admin.
+func (s *DeviceService) ListAllDevicesForAdmin(ctx context.Context, userID int64) ([]Device, error) {
+	user, err := s.db.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !hasRole(user, UserRoleAdmin) {
+		return nil, ErrDeviceListForbidden
+	}
+	return s.ListAllDevices(ctx)
+}
+
 // ListAllDevices - 列出所有设备（简化版）
-func (s *DeviceService) ListAllDevices() ([]Device, error) {
-	devices, err := s.db.ListAllDevices()
+func (s *DeviceService) ListAllDevices(ctx context.Context) ([]Device, error) {
+	devices, err := s.db.ListAllDevices(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -226,8 +264,8 @@ func (s *DeviceService) ListAllDevices() ([]Device, error) {
 }
 
 // BindDeviceByCode binds a device using just the bind code (for Desktop Agent)
-func (s *DeviceService) BindDeviceByCode(bindCode string) (*Device, error) {
-	device, err := s.db.GetDeviceByBindCode(bindCode)
+func (s *DeviceService) BindDeviceByCode(ctx context.Context, bindCode string) (*Device, error) {
+	device, err := s.db.GetDeviceByBindCode(ctx, bindCode)
 	if err != nil {
 		return nil, ErrDeviceNotFound
 	}
@@ -236,7 +274,7 @@ func (s *DeviceService) BindDeviceByCode(bindCode string) (*Device, error) {
 	loc := time.FixedZone("UTC+8", 8*3600)
 	parsedTime, err := time.ParseInLocation("2006-01-02T15:04:05", device.BindCodeExp, loc)
 	if err != nil {
-		log.Printf("Failed to parse bind_code_exp: %v, value: %s", err, device.BindCodeExp)
+		slog.Warn("device service: invalid bind_code_exp", "device_id", device.DeviceID, "value", device.BindCodeExp, "error", err)
 		return nil, ErrBindCodeExpired
 	}
 	if time.Now().After(parsedTime) {
@@ -244,7 +282,7 @@ func (s *DeviceService) BindDeviceByCode(bindCode string) (*Device, error) {
 	}
 
 	// Update device status to online
-	err = s.db.UpdateDeviceBindCode(device.DeviceID)
+	err = s.db.UpdateDeviceBindCode(ctx, device.DeviceID)
 	if err != nil {
 		return nil, err
 	}
@@ -259,9 +297,9 @@ func (s *DeviceService) BindDeviceByCode(bindCode string) (*Device, error) {
 }
 
 // BindDeviceToUser 将设备绑定到用户
-func (s *DeviceService) BindDeviceToUser(bindCode string, userID int64) (*Device, error) {
+func (s *DeviceService) BindDeviceToUser(ctx context.Context, bindCode string, userID int64) (*Device, error) {
 	// 通过绑定码找到设备
-	device, err := s.db.GetDeviceByBindCode(bindCode)
+	device, err := s.db.GetDeviceByBindCode(ctx, bindCode)
 	if err != nil {
 		return nil, ErrDeviceNotFound
 	}
@@ -270,13 +308,13 @@ func (s *DeviceService) BindDeviceToUser(bindCode string, userID int64) (*Device
 	}
 
 	// 检查用户已绑定设备数量
-	userDevices, err := s.db.GetUserDevices(userID)
+	userDevices, err := s.db.GetUserDevices(ctx, userID)
 	if err == nil && len(userDevices) >= 5 {
 		return nil, errors.New("max devices reached")
 	}
 
 	// 绑定用户
-	err = s.db.BindDeviceToUser(device.DeviceID, userID)
+	err = s.db.BindDeviceToUser(ctx, device.DeviceID, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -292,8 +330,8 @@ func (s *DeviceService) BindDeviceToUser(bindCode string, userID int64) (*Device
 }
 
 // GetDeviceByDeviceID gets a device by device_id
-func (s *DeviceService) GetDeviceByDeviceID(deviceID string) (*Device, error) {
-	device, err := s.db.GetDeviceByDeviceID(deviceID)
+func (s *DeviceService) GetDeviceByDeviceID(ctx context.Context, deviceID string) (*Device, error) {
+	device, err := s.db.GetDeviceByDeviceID(ctx, deviceID)
 	if err != nil {
 		return nil, ErrDeviceNotFound
 	}
@@ -308,13 +346,19 @@ func (s *DeviceService) GetDeviceByDeviceID(deviceID string) (*Device, error) {
 	}, nil
 }
 
-func (s *DeviceService) UpdateDeviceBindCode(deviceID string) error {
-	return s.db.UpdateDeviceBindCode(deviceID)
+func (s *DeviceService) UpdateDeviceBindCode(ctx context.Context, deviceID string) error {
+	return s.db.UpdateDeviceBindCode(ctx, deviceID)
+}
+
+// InvalidateBindCode clears a bind code that is being guessed; the agent
+// has to register again.
+func (s *DeviceService) InvalidateBindCode(ctx context.Context, deviceID string) error {
+	return s.db.ClearDeviceBindCode(ctx, deviceID)
 }
 
 // GetDeviceSessions 获取设备的所有 Session
-func (s *DeviceService) GetDeviceSessions(deviceID string) ([]Session, error) {
-	sessions, err := s.db.GetSessionsByDevice(deviceID)
+func (s *DeviceService) GetDeviceSessions(ctx context.Context, deviceID string) ([]Session, error) {
+	sessions, err := s.db.GetSessionsByDevice(ctx, deviceID)
 	if err != nil {
 		return nil, err
 	}
@@ -334,8 +378,8 @@ func (s *DeviceService) GetDeviceSessions(deviceID string) ([]Session, error) {
 }
 
 // CreateSession 创建设备的 Session（如果已存在则更新）
-func (s *DeviceService) CreateSession(deviceID, sessionName, projectPath string) (*Session, error) {
-	session, err := s.db.CreateOrUpdateSession(deviceID, sessionName, projectPath)
+func (s *DeviceService) CreateSession(ctx context.Context, deviceID, sessionName, projectPath string) (*Session, error) {
+	session, err := s.db.CreateOrUpdateSession(ctx, deviceID, sessionName, projectPath)
 	if err != nil {
 		return nil, err
 	}
@@ -351,13 +395,36 @@ func (s *DeviceService) CreateSession(deviceID, sessionName, projectPath string)
 }
 
 // UpdateSessionStatus updates session status when agent disconnects
-func (s *DeviceService) UpdateSessionStatus(deviceID, sessionName, status string) error {
-	return s.db.UpdateSessionStatus(deviceID, sessionName, status)
+func (s *DeviceService) UpdateSessionStatus(ctx context.Context, deviceID, sessionName, status string) error {
+	return s.db.UpdateSessionStatus(ctx, deviceID, sessionName, status)
+}
+
+// HandleAgentPresence keeps device and session status in step with the
+// agents the hub sees, including ones dropped by a missed heartbeat.
+func (s *DeviceService) HandleAgentPresence(presence AgentPresence) {
+	// Presence changes come from the hub rather than a request
+	ctx := context.Background()
+	if presence.SessionName != "" {
+		status := "inactive"
+		if presence.SessionOnline {
+			status = "active"
+		}
+		if err := s.db.UpdateSessionStatus(ctx, presence.DeviceID, presence.SessionName, status); err != nil {
+			slog.Warn("presence: update session failed", "device_id", presence.DeviceID, "session_name", presence.SessionName, "error", err)
+		}
+	}
+	status := "offline"
+	if presence.DeviceOnline {
+		status = "online"
+	}
+	if err := s.db.UpdateDeviceStatus(ctx, presence.DeviceID, status, presence.LastSeen.UTC().Format(time.RFC3339)); err != nil {
+		slog.Warn("presence: update device failed", "device_id", presence.DeviceID, "error", err)
+	}
 }
 
 // GetActiveSession gets the active session for a device
-func (s *DeviceService) GetActiveSession(deviceID string) (*Session, error) {
-	session, err := s.db.GetActiveSession(deviceID)
+func (s *DeviceService) GetActiveSession(ctx context.Context, deviceID string) (*Session, error) {
+	session, err := s.db.GetActiveSession(ctx, deviceID)
 	if err != nil {
 		return nil, err
 	}
@@ -374,17 +441,36 @@ func (s *DeviceService) GetActiveSession(deviceID string) (*Session, error) {
 	}, nil
 }
 
+// GetSession returns the session with sessionID, or ErrSessionNotFound.
+func (s *DeviceService) GetSession(ctx context.Context, sessionID int64) (*Session, error) {
+	session, err := s.db.GetSessionByID(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil {
+		return nil, ErrSessionNotFound
+	}
+	return &Session{
+		ID:          session.ID,
+		DeviceID:    session.DeviceID,
+		SessionName: session.SessionName,
+		ProjectPath: session.ProjectPath,
+		Status:      session.Status,
+		CreatedAt:   session.CreatedAt,
+	}, nil
+}
+
 // DeleteSession deletes a session
-func (s *DeviceService) DeleteSession(sessionID int64) error {
-	return s.db.DeleteSession(sessionID)
+func (s *DeviceService) DeleteSession(ctx context.Context, sessionID int64) error {
+	return s.db.DeleteSession(ctx, sessionID)
 }
 
 // UpdateDeviceName updates the device name
-func (s *DeviceService) UpdateDeviceName(deviceID, deviceName string) error {
-	return s.db.UpdateDeviceName(deviceID, deviceName)
+func (s *DeviceService) UpdateDeviceName(ctx context.Context, deviceID, deviceName string) error {
+	return s.db.UpdateDeviceName(ctx, deviceID, deviceName)
 }
 
 // DeleteDevice deletes a device
-func (s *DeviceService) DeleteDevice(deviceID string) error {
-	return s.db.DeleteDevice(deviceID)
+func (s *DeviceService) DeleteDevice(ctx context.Context, deviceID string) error {
+	return s.db.DeleteDevice(ctx, deviceID)
 }
@@ -0,0 +1,220 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mobile-coder/cloud/internal/db"
+)
+
+const (
+	GitActionCommit       = "commit"
+	GitActionDiscard      = "discard"
+	GitActionStash        = "stash"
+	GitActionCreateBranch = "create_branch"
+	GitActionPush         = "push"
+)
+
+// gitActionTimeout leaves room for a slow push.
+const gitActionTimeout = 60 * time.Second
+
+var (
+	ErrInvalidGitAction    = errors.New("invalid git action")
+	ErrGitActionForbidden  = errors.New("git actions require the operator or admin role")
+	ErrGitActionNotAllowed = errors.New("git action not allowed by agent config")
+	ErrGitActionFailed     = errors.New("git action failed")
+)
+
+var gitActions = map[string]bool{
+	GitActionCommit:       true,
+	GitActionDiscard:      true,
+	GitActionStash:        true,
+	GitActionCreateBranch: true,
+	GitActionPush:         true,
+}
+
+type gitActionStore interface {
+	GetUserByID(ctx context.Context, userID int64) (*db.User, error)
+}
+
+// auditRecorder appends remote actions to the audit log.
+type auditRecorder interface {
+	Record(ctx context.Context, event AuditEvent)
+}
+
+// taskEventRecorder surfaces action results on the task timeline.
+type taskEventRecorder interface {
+	RecordTaskEvent(ctx context.Context, deviceID, sessionName string, event TaskEvent)
+}
+
+// GitActionInput is a remote git action on the project of a task.
+type GitActionInput struct {
+	TaskID   string   `json:"task_id"`
+	Action   string   `json:"action"`
+	Message  string   `json:"message,omitempty"`
+	Paths    []string `json:"paths,omitempty"` // commit; tracked changes if empty
+	Path     string   `json:"path,omitempty"`
+	Branch   string   `json:"branch,omitempty"`
+	Remote   string   `json:"remote,omitempty"`
+	SourceIP string   `json:"-"` // for the audit log
+}
+
+// GitActionResult is the agent's report of an action.
+type GitActionResult struct {
+	Action  string `json:"action"`
+	OK      bool   `json:"ok"`
+	Denied  bool   `json:"denied,omitempty"`
+	Output  string `json:"output,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Commit  string `json:"commit,omitempty"`
+	Branch  string `json:"branch,omitempty"`
+	Summary string `json:"summary"`
+}
+
+// GitActionService runs allowlisted git actions through the agent of a task.
+type GitActionService struct {
+	store   gitActionStore
+	tasks   taskLookup
+	agents  agentRequester
+	events  taskEventRecorder
+	audit   auditRecorder
+	now     func() time.Time
+	timeout time.Duration
+}
+
+func NewGitActionService(database *db.SupabaseDB, tasks *TaskService, agents agentRequester, events taskEventRecorder) *GitActionService {
+	service := &GitActionService{
+		tasks:   tasks,
+		agents:  agents,
+		events:  events,
+		now:     time.Now,
+		timeout: gitActionTimeout,
+	}
+	if database != nil {
+		service.store = database
+	}
+	return service
+}
+
+// SetAuditRecorder records every attempted action, including refused ones,
+// in the audit log.
+func (s *GitActionService) SetAuditRecorder(audit auditRecorder) {
+	s.audit = audit
+}
+
+// RunGitAction checks the user's role, asks the agent to run the action and
+// records an audit entry and a task event for the outcome.
+func (s *GitActionService) RunGitAction(ctx context.Context, userID int64, input GitActionInput) (*GitActionResult, error) {
+	if !gitActions[input.Action] {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidGitAction, input.Action)
+	}
+	if input.Action == GitActionCommit && input.Message == "" {
+		return nil, fmt.Errorf("%w: commit message required", ErrInvalidGitAction)
+	}
+	if input.Action == GitActionDiscard && input.Path == "" {
+		return nil, fmt.Errorf("%w: path required", ErrInvalidGitAction)
+	}
+	if input.Action == GitActionCreateBranch && input.Branch == "" {
+		return nil, fmt.Errorf("%w: branch required", ErrInvalidGitAction)
+	}
+
+	task, err := s.tasks.GetTaskForUser(ctx, userID, input.TaskID)
+	if err != nil {
+		return nil, err
+	}
+	event := AuditEvent{
+		Action:      AuditGitAction,
+		UserID:      userID,
+		DeviceID:    task.DeviceID,
+		SessionName: task.SessionName,
+		SourceIP:    input.SourceIP,
+		Detail:      gitActionDetail(task.ID, input),
+	}
+
+	user, err := s.store.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !hasRole(user, UserRoleOperator) {
+		s.record(ctx, event, AuditStatusDenied, ErrGitActionForbidden.Error())
+		return nil, ErrGitActionForbidden
+	}
+
+	requestCtx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	raw, err := s.agents.RequestAgent(requestCtx, task.DeviceID, task.SessionName, "git_action", input)
+	if err != nil {
+		err = agentRequestError(err)
+		s.record(ctx, event, AuditStatusFailed, err.Error())
+		return nil, err
+	}
+
+	var result GitActionResult
+	if err := json.Unmarshal(raw, &result); err != nil {
+		s.record(ctx, event, AuditStatusFailed, "invalid agent reply")
+		return nil, fmt.Errorf("%w: invalid git action result: %v", ErrAgentRequestFailed, err)
+	}
+	if result.Output != "" {
+		event.Detail["output"] = result.Output
+	}
+	if result.Commit != "" {
+		event.Detail["commit"] = result.Commit
+	}
+	switch {
+	case result.Denied:
+		s.record(ctx, event, AuditStatusDenied, result.Error)
+	case result.OK:
+		s.record(ctx, event, AuditStatusOK, result.Error)
+	default:
+		s.record(ctx, event, AuditStatusFailed, result.Error)
+	}
+
+	if s.events != nil && result.Summary != "" {
+		s.events.RecordTaskEvent(ctx, task.DeviceID, task.SessionName, TaskEvent{
+			Summary:   result.Summary,
+			Timestamp: s.now().UTC().Format(time.RFC3339Nano),
+			Kind:      TaskEventKindToolStep,
+		})
+	}
+
+	switch {
+	case result.Denied:
+		return &result, fmt.Errorf("%w: %s", ErrGitActionNotAllowed, result.Error)
+	case !result.OK:
+		return &result, fmt.Errorf("%w: %s", ErrGitActionFailed, result.Error)
+	}
+	return &result, nil
+}
+
+func (s *GitActionService) record(ctx context.Context, event AuditEvent, status, errText string) {
+	if s.audit == nil {
+		return
+	}
+	event.Status = status
+	if errText != "" {
+		event.Detail["error"] = errText
+	}
+	s.audit.Record(ctx, event)
+}
+
+// gitActionDetail is the audit detail of an action: the task, the git
+// action and its parameters.
+func gitActionDetail(taskID string, input GitActionInput) map[string]string {
+	detail := map[string]string{"task_id": taskID, "git_action": input.Action}
+	for key, value := range map[string]string{
+		"message": input.Message,
+		"paths":   strings.Join(input.Paths, "\n"),
+		"path":    input.Path,
+		"branch":  input.Branch,
+		"remote":  input.Remote,
+	} {
+		if value != "" {
+			detail[key] = value
+		}
+	}
+	return detail
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mobile-coder/cloud/internal/db"
+)
+
+type fakeGitActionStore struct {
+	users map[int64]*db.User
+}
+
+func (f *fakeGitActionStore) GetUserByID(ctx context.Context, userID int64) (*db.User, error) {
+	return f.users[userID], nil
+}
+
+type recordingAudit struct {
+	entries []AuditEvent
+}
+
+func (r *recordingAudit) Record(ctx context.Context, event AuditEvent) {
+	r.entries = append(r.entries, event)
+}
+
+type recordingTaskEvents struct {
+	events []TaskEvent
+}
+
+func (r *recordingTaskEvents) RecordTaskEvent(ctx context.Context, deviceID, sessionName string, event TaskEvent) {
+	r.events = append(r.events, event)
+}
+
+func newGitActionServiceForTest(role string, agents *fakeAgentRequester) (*GitActionService, *recordingAudit, *recordingTaskEvents) {
+	audit := &recordingAudit{}
+	events := &recordingTaskEvents{}
+	service := NewGitActionService(nil, nil, agents, events)
+	service.store = &fakeGitActionStore{users: map[int64]*db.User{7: {ID: 7, Role: role}}}
+	service.SetAuditRecorder(audit)
+	service.tasks = &fakeTaskLookup{tasks: map[string]*Task{
+		"task-1": {ID: "task-1", DeviceID: "dev-1", SessionName: "feature"},
+	}}
+	service.now = func() time.Time { return time.Date(2026, 4, 18, 9, 0, 0, 0, time.UTC) }
+	return service, audit, events
+}
+
+func TestGitActionServiceRunsActionForOperator(t *testing.T) {
+	agents := &fakeAgentRequester{reply: `{"action":"commit","ok":true,"commit":"abc123","summary":"git commit abc123: Fix login"}`}
+	service, audit, events := newGitActionServiceForTest(UserRoleOperator, agents)
+
+	result, err := service.RunGitAction(context.Background(), 7, GitActionInput{TaskID: "task-1", Action: GitActionCommit, Message: "Fix login"})
+	if err != nil {
+		t.Fatalf("RunGitAction: %v", err)
+	}
+	if result.Commit != "abc123" || agents.msgType != "git_action" || agents.sessionName != "feature" {
+		t.Fatalf("result = %+v, request = %s to %s", result, agents.msgType, agents.sessionName)
+	}
+	if len(audit.entries) != 1 || audit.entries[0].Status != AuditStatusOK || audit.entries[0].Action != AuditGitAction || audit.entries[0].Detail["message"] != "Fix login" {
+		t.Fatalf("audit = %+v, want one ok entry with params", audit.entries)
+	}
+	if len(events.events) != 1 || events.events[0].Summary != "git commit abc123: Fix login" {
+		t.Fatalf("events = %+v, want the result summary", events.events)
+	}
+}
+
+func TestGitActionServiceAllowsAdmins(t *testing.T) {
+	agents := &fakeAgentRequester{reply: `{"action":"stash","ok":true,"summary":"git stash: working tree changes stashed"}`}
+	service, _, _ := newGitActionServiceForTest(UserRoleAdmin, agents)
+
+	if _, err := service.RunGitAction(context.Background(), 7, GitActionInput{TaskID: "task-1", Action: GitActionStash}); err != nil {
+		t.Fatalf("RunGitAction as admin: %v", err)
+	}
+}
+
+func TestGitActionServiceRequiresOperatorRole(t *testing.T) {
+	agents := &fakeAgentRequester{reply: `{}`}
+	service, audit, _ := newGitActionServiceForTest("member", agents)
+
+	_, err := service.RunGitAction(context.Background(), 7, GitActionInput{TaskID: "task-1", Action: GitActionPush})
+	if !errors.Is(err, ErrGitActionForbidden) {
+		t.Fatalf("err = %v, want ErrGitActionForbidden", err)
+	}
+	if agents.msgType != "" {
+		t.Fatal("agent should not be asked for a non-operator")
+	}
+	if len(audit.entries) != 1 || audit.entries[0].Status != AuditStatusDenied {
+		t.Fatalf("audit = %+v, want one denied entry", audit.entries)
+	}
+}
+
+func TestGitActionServiceReportsAgentRefusalAndFailure(t *testing.T) {
+	agents := &fakeAgentRequester{reply: `{"action":"push","denied":true,"error":"git push is not allowed for /repo","summary":"git push refused by agent allowlist"}`}
+	service, audit, _ := newGitActionServiceForTest(UserRoleOperator, agents)
+	if _, err := service.RunGitAction(context.Background(), 7, GitActionInput{TaskID: "task-1", Action: GitActionPush}); !errors.Is(err, ErrGitActionNotAllowed) {
+		t.Fatalf("err = %v, want ErrGitActionNotAllowed", err)
+	}
+
+	agents.reply = `{"action":"stash","ok":false,"error":"git stash: exit status 1","summary":"git stash failed"}`
+	if _, err := service.RunGitAction(context.Background(), 7, GitActionInput{TaskID: "task-1", Action: GitActionStash}); !errors.Is(err, ErrGitActionFailed) {
+		t.Fatalf("err = %v, want ErrGitActionFailed", err)
+	}
+	if len(audit.entries) != 2 || audit.entries[0].Status != AuditStatusDenied || audit.entries[1].Status != AuditStatusFailed {
+		t.Fatalf("audit = %+v, want denied then failed", audit.entries)
+	}
+
+	if _, err := service.RunGitAction(context.Background(), 7, GitActionInput{TaskID: "task-1", Action: "rebase"}); !errors.Is(err, ErrInvalidGitAction) {
+		t.Fatalf("err = %v, want ErrInvalidGitAction", err)
+	}
+	if _, err := service.RunGitAction(context.Background(), 7, GitActionInput{TaskID: "task-1", Action: GitActionCommit}); !errors.Is(err, ErrInvalidGitAction) {
+		t.Fatalf("err = %v, want ErrInvalidGitAction for commit without message", err)
+	}
+}
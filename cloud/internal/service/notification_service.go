@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strings"
@@ -8,6 +9,7 @@ import (
 	"time"
 
 	"github.com/mobile-coder/cloud/internal/db"
+	"github.com/mobile-coder/cloud/internal/metrics"
 )
 
 const (
@@ -45,13 +47,13 @@ func (t NotificationEventType) IsValid() bool {
 }
 
 type notificationStore interface {
-	CreateNotification(*db.Notification) (*db.Notification, error)
-	ListNotificationsByUser(userID int64, limit int, since string, unreadOnly bool) ([]db.Notification, error)
-	GetNotificationByID(notificationID int64) (*db.Notification, error)
-	GetLatestNotificationByDedupeKey(userID int64, dedupeKey string) (*db.Notification, error)
-	MarkNotificationRead(notificationID int64, readAt string) error
-	MarkAllNotificationsRead(userID int64, readAt string) error
-	DeleteNotificationsByIDs(userID int64, notificationIDs []int64) error
+	CreateNotification(context.Context, *db.Notification) (*db.Notification, error)
+	ListNotificationsByUser(ctx context.Context, userID int64, limit int, since string, unreadOnly bool) ([]db.Notification, error)
+	GetNotificationByID(ctx context.Context, notificationID int64) (*db.Notification, error)
+	GetLatestNotificationByDedupeKey(ctx context.Context, userID int64, dedupeKey string) (*db.Notification, error)
+	MarkNotificationRead(ctx context.Context, notificationID int64, readAt string) error
+	MarkAllNotificationsRead(ctx context.Context, userID int64, readAt string) error
+	DeleteNotificationsByIDs(ctx context.Context, userID int64, notificationIDs []int64) error
 }
 
 type NotificationService struct {
@@ -75,7 +77,7 @@ func NewNotificationService(database *db.SupabaseDB) *NotificationService {
 	}
 }
 
-func (s *NotificationService) CreateNotification(userID int64, eventType NotificationEventType, taskID, deviceID, sessionName, title, body string) (*db.Notification, error) {
+func (s *NotificationService) CreateNotification(ctx context.Context, userID int64, eventType NotificationEventType, taskID, deviceID, sessionName, title, body string) (*db.Notification, error) {
 	if !eventType.IsValid() {
 		return nil, ErrInvalidNotificationEventType
 	}
@@ -85,17 +87,17 @@ func (s *NotificationService) CreateNotification(userID int64, eventType Notific
 	defer release()
 
 	now := s.now().UTC()
-	if err := s.applyRetention(userID); err != nil {
+	if err := s.applyRetention(ctx, userID); err != nil {
 		return nil, err
 	}
 
-	if existing, err := s.store.GetLatestNotificationByDedupeKey(userID, dedupeKey); err != nil {
+	if existing, err := s.store.GetLatestNotificationByDedupeKey(ctx, userID, dedupeKey); err != nil {
 		return nil, err
 	} else if existing != nil && notificationIsRecent(existing, now) {
 		return existing, nil
 	}
 
-	created, err := s.store.CreateNotification(&db.Notification{
+	created, err := s.store.CreateNotification(ctx, &db.Notification{
 		UserID:      userID,
 		TaskID:      taskID,
 		DeviceID:    deviceID,
@@ -108,11 +110,12 @@ func (s *NotificationService) CreateNotification(userID int64, eventType Notific
 	if err != nil {
 		return nil, err
 	}
+	metrics.NotificationsCreated.With(string(eventType)).Inc()
 
 	return created, nil
 }
 
-func (s *NotificationService) ListNotifications(userID int64, unreadOnly bool, since *time.Time, limit int) ([]db.Notification, error) {
+func (s *NotificationService) ListNotifications(ctx context.Context, userID int64, unreadOnly bool, since *time.Time, limit int) ([]db.Notification, error) {
 	if limit <= 0 {
 		limit = notificationDefaultLimit
 	}
@@ -120,7 +123,7 @@ func (s *NotificationService) ListNotifications(userID int64, unreadOnly bool, s
 		limit = notificationMaxLimit
 	}
 
-	if err := s.applyRetention(userID); err != nil {
+	if err := s.applyRetention(ctx, userID); err != nil {
 		return nil, err
 	}
 
@@ -129,11 +132,11 @@ func (s *NotificationService) ListNotifications(userID int64, unreadOnly bool, s
 		sinceValue = since.UTC().Format(time.RFC3339)
 	}
 
-	return s.store.ListNotificationsByUser(userID, limit, sinceValue, unreadOnly)
+	return s.store.ListNotificationsByUser(ctx, userID, limit, sinceValue, unreadOnly)
 }
 
-func (s *NotificationService) MarkNotificationRead(userID, notificationID int64) error {
-	notification, err := s.store.GetNotificationByID(notificationID)
+func (s *NotificationService) MarkNotificationRead(ctx context.Context, userID, notificationID int64) error {
+	notification, err := s.store.GetNotificationByID(ctx, notificationID)
 	if err != nil {
 		return err
 	}
@@ -144,15 +147,15 @@ func (s *NotificationService) MarkNotificationRead(userID, notificationID int64)
 		return ErrNotificationAccessDenied
 	}
 
-	return s.store.MarkNotificationRead(notificationID, s.now().UTC().Format(time.RFC3339))
+	return s.store.MarkNotificationRead(ctx, notificationID, s.now().UTC().Format(time.RFC3339))
 }
 
-func (s *NotificationService) MarkAllNotificationsRead(userID int64) error {
-	return s.store.MarkAllNotificationsRead(userID, s.now().UTC().Format(time.RFC3339))
+func (s *NotificationService) MarkAllNotificationsRead(ctx context.Context, userID int64) error {
+	return s.store.MarkAllNotificationsRead(ctx, userID, s.now().UTC().Format(time.RFC3339))
 }
 
-func (s *NotificationService) applyRetention(userID int64) error {
-	notifications, err := s.store.ListNotificationsByUser(userID, 0, "", false)
+func (s *NotificationService) applyRetention(ctx context.Context, userID int64) error {
+	notifications, err := s.store.ListNotificationsByUser(ctx, userID, 0, "", false)
 	if err != nil {
 		return err
 	}
@@ -171,7 +174,7 @@ func (s *NotificationService) applyRetention(userID int64) error {
 		return nil
 	}
 
-	return s.store.DeleteNotificationsByIDs(userID, ids)
+	return s.store.DeleteNotificationsByIDs(ctx, userID, ids)
 }
 
 func (s *NotificationService) acquireDedupeLock(dedupeKey string) func() {
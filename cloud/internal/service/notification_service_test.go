@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"sync"
 	"testing"
@@ -48,7 +49,7 @@ type deleteIDsCall struct {
 	ids    []int64
 }
 
-func (f *fakeNotificationStore) CreateNotification(notification *db.Notification) (*db.Notification, error) {
+func (f *fakeNotificationStore) CreateNotification(ctx context.Context, notification *db.Notification) (*db.Notification, error) {
 	f.mu.Lock()
 	f.createCalls = append(f.createCalls, notification)
 	f.mu.Unlock()
@@ -58,7 +59,7 @@ func (f *fakeNotificationStore) CreateNotification(notification *db.Notification
 	return notification, nil
 }
 
-func (f *fakeNotificationStore) ListNotificationsByUser(userID int64, limit int, since string, unreadOnly bool) ([]db.Notification, error) {
+func (f *fakeNotificationStore) ListNotificationsByUser(ctx context.Context, userID int64, limit int, since string, unreadOnly bool) ([]db.Notification, error) {
 	f.mu.Lock()
 	f.listCalls = append(f.listCalls, listNotificationsCall{userID: userID, limit: limit, since: since, unreadOnly: unreadOnly})
 	f.mu.Unlock()
@@ -68,21 +69,21 @@ func (f *fakeNotificationStore) ListNotificationsByUser(userID int64, limit int,
 	return nil, nil
 }
 
-func (f *fakeNotificationStore) GetNotificationByID(notificationID int64) (*db.Notification, error) {
+func (f *fakeNotificationStore) GetNotificationByID(ctx context.Context, notificationID int64) (*db.Notification, error) {
 	if f.getNotificationByIDFn != nil {
 		return f.getNotificationByIDFn(notificationID)
 	}
 	return nil, nil
 }
 
-func (f *fakeNotificationStore) GetLatestNotificationByDedupeKey(userID int64, dedupeKey string) (*db.Notification, error) {
+func (f *fakeNotificationStore) GetLatestNotificationByDedupeKey(ctx context.Context, userID int64, dedupeKey string) (*db.Notification, error) {
 	if f.getLatestNotificationByKeyFn != nil {
 		return f.getLatestNotificationByKeyFn(userID, dedupeKey)
 	}
 	return nil, nil
 }
 
-func (f *fakeNotificationStore) MarkNotificationRead(notificationID int64, readAt string) error {
+func (f *fakeNotificationStore) MarkNotificationRead(ctx context.Context, notificationID int64, readAt string) error {
 	f.mu.Lock()
 	f.markReadCalls = append(f.markReadCalls, markReadCall{notificationID: notificationID, readAt: readAt})
 	f.mu.Unlock()
@@ -92,7 +93,7 @@ func (f *fakeNotificationStore) MarkNotificationRead(notificationID int64, readA
 	return nil
 }
 
-func (f *fakeNotificationStore) MarkAllNotificationsRead(userID int64, readAt string) error {
+func (f *fakeNotificationStore) MarkAllNotificationsRead(ctx context.Context, userID int64, readAt string) error {
 	f.mu.Lock()
 	f.markAllReadCalls = append(f.markAllReadCalls, markAllReadCall{userID: userID, readAt: readAt})
 	f.mu.Unlock()
@@ -102,7 +103,7 @@ func (f *fakeNotificationStore) MarkAllNotificationsRead(userID int64, readAt st
 	return nil
 }
 
-func (f *fakeNotificationStore) DeleteNotificationsByIDs(userID int64, notificationIDs []int64) error {
+func (f *fakeNotificationStore) DeleteNotificationsByIDs(ctx context.Context, userID int64, notificationIDs []int64) error {
 	ids := append([]int64(nil), notificationIDs...)
 	f.mu.Lock()
 	f.deleteIDCalls = append(f.deleteIDCalls, deleteIDsCall{userID: userID, ids: ids})
@@ -128,6 +129,7 @@ func TestNotificationServiceCreateNotificationPersistsAndRetains(t *testing.T) {
 	}
 
 	notification, err := service.CreateNotification(
+		context.Background(),
 		7,
 		NotificationEventTaskCompleted,
 		"dev-1:release-train",
@@ -198,7 +200,7 @@ func TestNotificationServiceListNotificationsAppliesFilters(t *testing.T) {
 	}
 	since := time.Date(2026, 4, 11, 9, 0, 0, 0, time.UTC)
 
-	notifications, err := service.ListNotifications(7, true, &since, 250)
+	notifications, err := service.ListNotifications(context.Background(), 7, true, &since, 250)
 	if err != nil {
 		t.Fatalf("ListNotifications returned error: %v", err)
 	}
@@ -237,7 +239,7 @@ func TestNotificationServiceMarkNotificationRead(t *testing.T) {
 		return time.Date(2026, 4, 11, 10, 0, 0, 0, time.UTC)
 	}
 
-	if err := service.MarkNotificationRead(7, 88); err != nil {
+	if err := service.MarkNotificationRead(context.Background(), 7, 88); err != nil {
 		t.Fatalf("MarkNotificationRead returned error: %v", err)
 	}
 	if len(store.markReadCalls) != 1 {
@@ -255,7 +257,7 @@ func TestNotificationServiceMarkNotificationReadRejectsForeignNotification(t *te
 	service.store = store
 	service.now = func() time.Time { return time.Unix(0, 0).UTC() }
 
-	err := service.MarkNotificationRead(7, 88)
+	err := service.MarkNotificationRead(context.Background(), 7, 88)
 	if !errors.Is(err, ErrNotificationAccessDenied) {
 		t.Fatalf("error = %v, want ErrNotificationAccessDenied", err)
 	}
@@ -266,7 +268,7 @@ func TestNotificationServiceRejectsInvalidEventType(t *testing.T) {
 	service := NewNotificationService(nil)
 	service.store = store
 
-	_, err := service.CreateNotification(7, NotificationEventType("bogus"), "dev-1:tests", "dev-1", "tests", "标题", "正文")
+	_, err := service.CreateNotification(context.Background(), 7, NotificationEventType("bogus"), "dev-1:tests", "dev-1", "tests", "标题", "正文")
 	if !errors.Is(err, ErrInvalidNotificationEventType) {
 		t.Fatalf("error = %v, want ErrInvalidNotificationEventType", err)
 	}
@@ -307,7 +309,7 @@ func TestNotificationServiceRetentionKeepsLatest200Notifications(t *testing.T) {
 	service.store = store
 	service.now = func() time.Time { return time.Date(2026, 4, 11, 10, 0, 0, 0, time.UTC) }
 
-	if err := service.applyRetention(7); err != nil {
+	if err := service.applyRetention(context.Background(), 7); err != nil {
 		t.Fatalf("applyRetention returned error: %v", err)
 	}
 	if len(store.deleteIDCalls) != 1 {
@@ -360,7 +362,7 @@ func TestNotificationServiceDedupesByConditionOnly(t *testing.T) {
 	service.store = store
 	service.now = func() time.Time { return time.Date(2026, 4, 11, 10, 0, 0, 0, time.UTC) }
 
-	first, err := service.CreateNotification(7, NotificationEventTaskCompleted, "dev-1:release-train", "dev-1", "release-train", "任务已完成", "release-train 已结束，可查看结果")
+	first, err := service.CreateNotification(context.Background(), 7, NotificationEventTaskCompleted, "dev-1:release-train", "dev-1", "release-train", "任务已完成", "release-train 已结束，可查看结果")
 	if err != nil {
 		t.Fatalf("first CreateNotification returned error: %v", err)
 	}
@@ -368,7 +370,7 @@ func TestNotificationServiceDedupesByConditionOnly(t *testing.T) {
 		t.Fatalf("first notification = %+v, want ID 11", first)
 	}
 
-	second, err := service.CreateNotification(7, NotificationEventTaskCompleted, "dev-1:release-train", "dev-1", "release-train", "完成啦", "你可以回来看结果了")
+	second, err := service.CreateNotification(context.Background(), 7, NotificationEventTaskCompleted, "dev-1:release-train", "dev-1", "release-train", "完成啦", "你可以回来看结果了")
 	if err != nil {
 		t.Fatalf("second CreateNotification returned error: %v", err)
 	}
@@ -433,13 +435,13 @@ func TestNotificationServiceSerializesConcurrentCreatesForSameCondition(t *testi
 	results := make(chan result, 2)
 
 	go func() {
-		notification, err := service.CreateNotification(7, NotificationEventTaskCompleted, "dev-1:release-train", "dev-1", "release-train", "任务已完成", "release-train 已结束，可查看结果")
+		notification, err := service.CreateNotification(context.Background(), 7, NotificationEventTaskCompleted, "dev-1:release-train", "dev-1", "release-train", "任务已完成", "release-train 已结束，可查看结果")
 		results <- result{notification: notification, err: err}
 	}()
 
 	<-startCreate
 	go func() {
-		notification, err := service.CreateNotification(7, NotificationEventTaskCompleted, "dev-1:release-train", "dev-1", "release-train", "另一条文案", "同一条件不该重复插入")
+		notification, err := service.CreateNotification(context.Background(), 7, NotificationEventTaskCompleted, "dev-1:release-train", "dev-1", "release-train", "另一条文案", "同一条件不该重复插入")
 		results <- result{notification: notification, err: err}
 	}()
 
@@ -0,0 +1,28 @@
+package service
+
+import "github.com/mobile-coder/cloud/internal/db"
+
+// User roles. Each role includes the ones before it: operators may run
+// remote git actions and read everyone's audit entries, admins may also
+// list every device.
+const (
+	UserRoleMember   = "member"
+	UserRoleOperator = "operator"
+	UserRoleAdmin    = "admin"
+)
+
+var userRoleRanks = map[string]int{
+	UserRoleMember:   1,
+	UserRoleOperator: 2,
+	UserRoleAdmin:    3,
+}
+
+// hasRole reports whether user has role or one that includes it. Unknown
+// roles have no rights.
+func hasRole(user *db.User, role string) bool {
+	if user == nil {
+		return false
+	}
+	rank := userRoleRanks[user.Role]
+	return rank > 0 && rank >= userRoleRanks[role]
+}
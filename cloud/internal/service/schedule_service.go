@@ -0,0 +1,503 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mobile-coder/cloud/internal/db"
+)
+
+// CatchUpPolicy decides what happens to runs that were missed while the
+// target device was offline.
+type CatchUpPolicy string
+
+const (
+	// CatchUpSkip drops missed runs and only runs occurrences that are due now.
+	CatchUpSkip CatchUpPolicy = "skip"
+	// CatchUpLatest runs the most recent missed occurrence once.
+	CatchUpLatest CatchUpPolicy = "latest"
+	// CatchUpAll runs every missed occurrence, up to scheduleMaxCatchUpRuns.
+	CatchUpAll CatchUpPolicy = "all"
+)
+
+func (p CatchUpPolicy) IsValid() bool {
+	switch p {
+	case CatchUpSkip, CatchUpLatest, CatchUpAll:
+		return true
+	}
+	return false
+}
+
+type ScheduleRunStatus string
+
+const (
+	ScheduleRunDispatched ScheduleRunStatus = "dispatched"
+	ScheduleRunSkipped    ScheduleRunStatus = "skipped"
+	ScheduleRunCompleted  ScheduleRunStatus = "completed"
+	ScheduleRunFailed     ScheduleRunStatus = "failed"
+)
+
+const (
+	scheduleTickInterval     = 30 * time.Second
+	scheduleOnTimeWindow     = 2 * time.Minute
+	scheduleMaxCatchUpRuns   = 20
+	scheduleRunsDefaultLimit = 20
+	scheduleRunsMaxLimit     = 100
+)
+
+var (
+	ErrScheduleNotFound = errors.New("schedule not found")
+	ErrInvalidSchedule  = errors.New("invalid schedule")
+)
+
+var scheduleTools = map[string]bool{
+	"claude": true,
+	"codex":  true,
+	"cursor": true,
+}
+
+type scheduleStore interface {
+	CreateTaskSchedule(context.Context, *db.TaskSchedule) (*db.TaskSchedule, error)
+	GetTaskSchedule(ctx context.Context, scheduleID int64) (*db.TaskSchedule, error)
+	ListTaskSchedulesByUser(ctx context.Context, userID int64) ([]db.TaskSchedule, error)
+	ListEnabledTaskSchedules(ctx context.Context) ([]db.TaskSchedule, error)
+	UpdateTaskSchedule(ctx context.Context, scheduleID int64, fields map[string]interface{}) error
+	DeleteTaskSchedule(ctx context.Context, scheduleID int64) error
+	CreateTaskScheduleRun(context.Context, *db.TaskScheduleRun) (*db.TaskScheduleRun, error)
+	ListTaskScheduleRuns(ctx context.Context, scheduleID int64, limit int) ([]db.TaskScheduleRun, error)
+	GetDispatchedScheduleRun(ctx context.Context, deviceID, sessionName string) (*db.TaskScheduleRun, error)
+	UpdateTaskScheduleRun(ctx context.Context, runID int64, fields map[string]interface{}) error
+}
+
+// deviceAgentSender delivers a message to any agent connected for a device.
+type deviceAgentSender interface {
+	SendToDeviceAgent(deviceID string, message []byte) bool
+}
+
+type scheduleNotifier interface {
+	CreateNotification(ctx context.Context, userID int64, eventType NotificationEventType, taskID, deviceID, sessionName, title, body string) (*db.Notification, error)
+}
+
+// ScheduleInput holds the user supplied fields of a schedule.
+type ScheduleInput struct {
+	DeviceID    string `json:"device_id"`
+	Name        string `json:"name"`
+	CronExpr    string `json:"cron_expr"`
+	Timezone    string `json:"timezone"`
+	Tool        string `json:"tool"`
+	ProjectPath string `json:"project_path"`
+	Prompt      string `json:"prompt"`
+	CatchUp     string `json:"catch_up"`
+}
+
+// ScheduleService starts agent sessions from cron schedules. At each
+// occurrence it asks an agent of the target device to create a session,
+// records the run, and notifies the owner when the session's task finishes.
+type ScheduleService struct {
+	store         scheduleStore
+	sender        deviceAgentSender
+	tasks         queueTaskStarter
+	notifier      scheduleNotifier
+	defaultPolicy CatchUpPolicy
+	now           func() time.Time
+}
+
+func NewScheduleService(database *db.SupabaseDB, sender deviceAgentSender, tasks queueTaskStarter, notifier scheduleNotifier, defaultPolicy CatchUpPolicy) *ScheduleService {
+	if !defaultPolicy.IsValid() {
+		defaultPolicy = CatchUpLatest
+	}
+	return &ScheduleService{
+		store:         database,
+		sender:        sender,
+		tasks:         tasks,
+		notifier:      notifier,
+		defaultPolicy: defaultPolicy,
+		now:           time.Now,
+	}
+}
+
+func (s *ScheduleService) CreateSchedule(ctx context.Context, userID int64, input ScheduleInput) (*db.TaskSchedule, error) {
+	input.Name = strings.TrimSpace(input.Name)
+	input.ProjectPath = strings.TrimSpace(input.ProjectPath)
+	if input.Timezone == "" {
+		input.Timezone = "UTC"
+	}
+	if input.Tool == "" {
+		input.Tool = "claude"
+	}
+	if input.DeviceID == "" || input.Name == "" || input.ProjectPath == "" || strings.TrimSpace(input.Prompt) == "" {
+		return nil, fmt.Errorf("%w: device_id, name, project_path and prompt required", ErrInvalidSchedule)
+	}
+	if !scheduleTools[input.Tool] {
+		return nil, fmt.Errorf("%w: unknown tool %q", ErrInvalidSchedule, input.Tool)
+	}
+	if input.CatchUp != "" && !CatchUpPolicy(input.CatchUp).IsValid() {
+		return nil, fmt.Errorf("%w: catch_up must be skip, latest or all", ErrInvalidSchedule)
+	}
+
+	cron, location, err := parseScheduleTiming(input.CronExpr, input.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	next := cron.Next(s.now().In(location))
+	if next.IsZero() {
+		return nil, fmt.Errorf("%w: cron expression never matches", ErrInvalidSchedule)
+	}
+
+	return s.store.CreateTaskSchedule(ctx, &db.TaskSchedule{
+		UserID:      userID,
+		DeviceID:    input.DeviceID,
+		Name:        input.Name,
+		CronExpr:    strings.Join(strings.Fields(input.CronExpr), " "),
+		Timezone:    input.Timezone,
+		Tool:        input.Tool,
+		ProjectPath: input.ProjectPath,
+		Prompt:      input.Prompt,
+		CatchUp:     input.CatchUp,
+		Enabled:     true,
+		NextRunAt:   next.UTC().Format(time.RFC3339),
+	})
+}
+
+func (s *ScheduleService) ListSchedules(ctx context.Context, userID int64) ([]db.TaskSchedule, error) {
+	schedules, err := s.store.ListTaskSchedulesByUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if schedules == nil {
+		schedules = []db.TaskSchedule{}
+	}
+	return schedules, nil
+}
+
+// SetScheduleEnabled pauses or resumes a schedule. Resuming starts from the
+// next occurrence, so runs missed while disabled are not caught up.
+func (s *ScheduleService) SetScheduleEnabled(ctx context.Context, userID, scheduleID int64, enabled bool) (*db.TaskSchedule, error) {
+	schedule, err := s.scheduleForUser(ctx, userID, scheduleID)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]interface{}{
+		"enabled":    enabled,
+		"updated_at": s.now().UTC().Format(time.RFC3339),
+	}
+	if enabled && !schedule.Enabled {
+		cron, location, err := parseScheduleTiming(schedule.CronExpr, schedule.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		next := cron.Next(s.now().In(location)).UTC().Format(time.RFC3339)
+		fields["next_run_at"] = next
+		schedule.NextRunAt = next
+	}
+	if err := s.store.UpdateTaskSchedule(ctx, scheduleID, fields); err != nil {
+		return nil, err
+	}
+	schedule.Enabled = enabled
+	return schedule, nil
+}
+
+func (s *ScheduleService) DeleteSchedule(ctx context.Context, userID, scheduleID int64) error {
+	if _, err := s.scheduleForUser(ctx, userID, scheduleID); err != nil {
+		return err
+	}
+	return s.store.DeleteTaskSchedule(ctx, scheduleID)
+}
+
+func (s *ScheduleService) ListRuns(ctx context.Context, userID, scheduleID int64, limit int) ([]db.TaskScheduleRun, error) {
+	if _, err := s.scheduleForUser(ctx, userID, scheduleID); err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = scheduleRunsDefaultLimit
+	}
+	if limit > scheduleRunsMaxLimit {
+		limit = scheduleRunsMaxLimit
+	}
+	runs, err := s.store.ListTaskScheduleRuns(ctx, scheduleID, limit)
+	if err != nil {
+		return nil, err
+	}
+	if runs == nil {
+		runs = []db.TaskScheduleRun{}
+	}
+	return runs, nil
+}
+
+// Run checks for due schedules until the process exits.
+func (s *ScheduleService) Run() {
+	ticker := time.NewTicker(scheduleTickInterval)
+	defer ticker.Stop()
+
+	s.tick(context.Background())
+	for range ticker.C {
+		s.tick(context.Background())
+	}
+}
+
+func (s *ScheduleService) tick(ctx context.Context) {
+	schedules, err := s.store.ListEnabledTaskSchedules(ctx)
+	if err != nil {
+		slog.Warn("schedule service: list schedules failed", "error", err)
+		return
+	}
+	for i := range schedules {
+		s.runDue(ctx, &schedules[i])
+	}
+}
+
+// runDue dispatches the due occurrences of a schedule according to its
+// catch-up policy. When the device has no connected agent nothing is
+// recorded, so the missed occurrences are handled once it reconnects.
+func (s *ScheduleService) runDue(ctx context.Context, schedule *db.TaskSchedule) {
+	cron, location, err := parseScheduleTiming(schedule.CronExpr, schedule.Timezone)
+	if err != nil {
+		slog.Warn("schedule service: invalid timing", "schedule_id", schedule.ID, "error", err)
+		return
+	}
+
+	now := s.now().In(location)
+	next, err := time.Parse(time.RFC3339, schedule.NextRunAt)
+	if err != nil {
+		next = cron.Next(now)
+		s.updateSchedule(ctx, schedule.ID, map[string]interface{}{"next_run_at": next.UTC().Format(time.RFC3339)})
+		return
+	}
+	if next.After(now) {
+		return
+	}
+
+	due, truncated := dueOccurrences(cron, next.In(location), now)
+	if truncated {
+		slog.Info("schedule service: missed runs", "schedule_id", schedule.ID, "since", next.UTC().Format(time.RFC3339), "kept", len(due))
+	}
+	run, skip := s.selectRuns(schedule, due, now)
+
+	for i, occurrence := range run {
+		sessionName, err := s.dispatch(ctx, schedule, occurrence)
+		if err != nil {
+			if i == 0 {
+				// Device offline: leave next_run_at so the runs are caught up later.
+				return
+			}
+			slog.Warn("schedule service: stopped dispatching", "schedule_id", schedule.ID, "error", err)
+			skip = append(skip, run[i:]...)
+			break
+		}
+		slog.Info("schedule service: started session", "schedule_id", schedule.ID, "session_name", sessionName)
+	}
+
+	for _, occurrence := range skip {
+		if _, err := s.store.CreateTaskScheduleRun(ctx, &db.TaskScheduleRun{
+			ScheduleID:   schedule.ID,
+			UserID:       schedule.UserID,
+			DeviceID:     schedule.DeviceID,
+			ScheduledFor: occurrence.UTC().Format(time.RFC3339),
+			Status:       string(ScheduleRunSkipped),
+			Error:        "missed while device was offline",
+			FinishedAt:   s.now().UTC().Format(time.RFC3339),
+		}); err != nil {
+			slog.Warn("schedule service: record skipped run failed", "schedule_id", schedule.ID, "error", err)
+		}
+	}
+
+	fields := map[string]interface{}{
+		"next_run_at": cron.Next(now).UTC().Format(time.RFC3339),
+	}
+	if len(run) > 0 {
+		fields["last_run_at"] = run[len(run)-1].UTC().Format(time.RFC3339)
+	}
+	s.updateSchedule(ctx, schedule.ID, fields)
+}
+
+// selectRuns splits due occurrences into the ones to run and the ones to skip.
+func (s *ScheduleService) selectRuns(schedule *db.TaskSchedule, due []time.Time, now time.Time) ([]time.Time, []time.Time) {
+	if len(due) == 0 {
+		return nil, nil
+	}
+	policy := CatchUpPolicy(schedule.CatchUp)
+	if !policy.IsValid() {
+		policy = s.defaultPolicy
+	}
+
+	latest := len(due) - 1
+	switch policy {
+	case CatchUpAll:
+		return due, nil
+	case CatchUpSkip:
+		if now.Sub(due[latest]) <= scheduleOnTimeWindow {
+			return due[latest:], due[:latest]
+		}
+		return nil, due
+	default:
+		return due[latest:], due[:latest]
+	}
+}
+
+func (s *ScheduleService) dispatch(ctx context.Context, schedule *db.TaskSchedule, occurrence time.Time) (string, error) {
+	sessionName := scheduleSessionName(schedule, occurrence)
+	message, _ := json.Marshal(map[string]interface{}{
+		"type": "create_session",
+		"payload": map[string]interface{}{
+			"session_name": sessionName,
+			"tool":         schedule.Tool,
+			"project_path": schedule.ProjectPath,
+			"prompt":       schedule.Prompt,
+			"schedule_id":  schedule.ID,
+		},
+	})
+	if s.sender == nil || !s.sender.SendToDeviceAgent(schedule.DeviceID, message) {
+		return "", fmt.Errorf("no agent connected for device %s", schedule.DeviceID)
+	}
+
+	run := &db.TaskScheduleRun{
+		ScheduleID:   schedule.ID,
+		UserID:       schedule.UserID,
+		DeviceID:     schedule.DeviceID,
+		SessionName:  sessionName,
+		ScheduledFor: occurrence.UTC().Format(time.RFC3339),
+		Status:       string(ScheduleRunDispatched),
+	}
+	if s.tasks != nil {
+		task, err := s.tasks.StartTask(ctx, schedule.UserID, schedule.DeviceID, sessionName, schedule.Name, schedule.Prompt)
+		if err != nil && !errors.Is(err, ErrTaskRecordsUnavailable) {
+			slog.Warn("schedule service: start task failed", "schedule_id", schedule.ID, "error", err)
+		}
+		if task != nil {
+			run.TaskID = task.ID
+		}
+	}
+	if _, err := s.store.CreateTaskScheduleRun(ctx, run); err != nil {
+		slog.Warn("schedule service: record run failed", "schedule_id", schedule.ID, "error", err)
+	}
+	return sessionName, nil
+}
+
+// HandleTaskEvent finishes the run that started a session once its task
+// completes or fails, and notifies the schedule owner.
+func (s *ScheduleService) HandleTaskEvent(ctx context.Context, deviceID, sessionName string, event TaskEvent) {
+	var status ScheduleRunStatus
+	switch event.Kind {
+	case TaskEventKindCompleted:
+		status = ScheduleRunCompleted
+	case TaskEventKindError:
+		status = ScheduleRunFailed
+	default:
+		return
+	}
+
+	run, err := s.store.GetDispatchedScheduleRun(ctx, deviceID, sessionName)
+	if err != nil {
+		slog.Warn("schedule service: find run failed", "task_id", sessionTaskID(deviceID, sessionName), "error", err)
+		return
+	}
+	if run == nil {
+		return
+	}
+
+	fields := map[string]interface{}{
+		"status":      string(status),
+		"finished_at": s.now().UTC().Format(time.RFC3339),
+	}
+	if status == ScheduleRunFailed {
+		fields["error"] = event.Summary
+	}
+	if err := s.store.UpdateTaskScheduleRun(ctx, run.ID, fields); err != nil {
+		slog.Warn("schedule service: finish run failed", "run_id", run.ID, "error", err)
+		return
+	}
+
+	if s.notifier == nil {
+		return
+	}
+	name := fmt.Sprintf("schedule #%d", run.ScheduleID)
+	if schedule, err := s.store.GetTaskSchedule(ctx, run.ScheduleID); err == nil && schedule != nil {
+		name = schedule.Name
+	}
+	title := "Scheduled task completed: " + name
+	if status == ScheduleRunFailed {
+		title = "Scheduled task failed: " + name
+	}
+	taskID := run.TaskID
+	if taskID == "" {
+		taskID = sessionTaskID(deviceID, sessionName)
+	}
+	if _, err := s.notifier.CreateNotification(ctx, run.UserID, NotificationEventTaskCompleted, taskID, deviceID, sessionName, title, event.Summary); err != nil {
+		slog.Warn("schedule service: notify run failed", "run_id", run.ID, "error", err)
+	}
+}
+
+func (s *ScheduleService) scheduleForUser(ctx context.Context, userID, scheduleID int64) (*db.TaskSchedule, error) {
+	schedule, err := s.store.GetTaskSchedule(ctx, scheduleID)
+	if err != nil {
+		return nil, err
+	}
+	if schedule == nil || schedule.UserID != userID {
+		return nil, ErrScheduleNotFound
+	}
+	return schedule, nil
+}
+
+func (s *ScheduleService) updateSchedule(ctx context.Context, scheduleID int64, fields map[string]interface{}) {
+	fields["updated_at"] = s.now().UTC().Format(time.RFC3339)
+	if err := s.store.UpdateTaskSchedule(ctx, scheduleID, fields); err != nil {
+		slog.Warn("schedule service: update schedule failed", "schedule_id", scheduleID, "error", err)
+	}
+}
+
+func parseScheduleTiming(expr, timezone string) (*CronSchedule, *time.Location, error) {
+	cron, err := ParseCron(expr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidSchedule, err)
+	}
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: unknown timezone %q", ErrInvalidSchedule, timezone)
+	}
+	return cron, location, nil
+}
+
+// dueOccurrences returns the latest scheduleMaxCatchUpRuns occurrences from
+// first up to now, oldest first, and whether older ones were left out. It
+// walks back from now, so a schedule missed for months costs no more than
+// one missed a few times.
+func dueOccurrences(cron *CronSchedule, first, now time.Time) ([]time.Time, bool) {
+	var due []time.Time
+	t := cron.Prev(now.Add(time.Nanosecond))
+	for !t.IsZero() && !t.Before(first) {
+		if len(due) == scheduleMaxCatchUpRuns {
+			slices.Reverse(due)
+			return due, true
+		}
+		due = append(due, t)
+		t = cron.Prev(t)
+	}
+	slices.Reverse(due)
+	return due, false
+}
+
+// scheduleSessionName follows the agent's "<tool>-<device>-<dir>" naming and
+// adds the schedule and occurrence so every run gets its own session.
+func scheduleSessionName(schedule *db.TaskSchedule, occurrence time.Time) string {
+	devicePrefix := schedule.DeviceID
+	if len(devicePrefix) > 6 {
+		devicePrefix = devicePrefix[:6]
+	}
+	dirName := filepath.Base(schedule.ProjectPath)
+	if dirName == "" || dirName == "/" || dirName == "." {
+		dirName = "root"
+	}
+	dirName = strings.ReplaceAll(dirName, " ", "_")
+	return fmt.Sprintf("%s-%s-%s-s%d-%s", schedule.Tool, devicePrefix, dirName, schedule.ID, occurrence.UTC().Format("0601021504"))
+}
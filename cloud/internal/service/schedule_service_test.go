@@ -0,0 +1,386 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mobile-coder/cloud/internal/db"
+)
+
+type fakeScheduleStore struct {
+	mu        sync.Mutex
+	schedules map[int64]*db.TaskSchedule
+	runs      []db.TaskScheduleRun
+	nextID    int64
+}
+
+func newFakeScheduleStore() *fakeScheduleStore {
+	return &fakeScheduleStore{schedules: make(map[int64]*db.TaskSchedule)}
+}
+
+func (f *fakeScheduleStore) CreateTaskSchedule(ctx context.Context, schedule *db.TaskSchedule) (*db.TaskSchedule, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	created := *schedule
+	created.ID = f.nextID
+	f.schedules[created.ID] = &created
+	result := created
+	return &result, nil
+}
+
+func (f *fakeScheduleStore) GetTaskSchedule(ctx context.Context, scheduleID int64) (*db.TaskSchedule, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	schedule, ok := f.schedules[scheduleID]
+	if !ok {
+		return nil, nil
+	}
+	result := *schedule
+	return &result, nil
+}
+
+func (f *fakeScheduleStore) ListTaskSchedulesByUser(ctx context.Context, userID int64) ([]db.TaskSchedule, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var schedules []db.TaskSchedule
+	for _, schedule := range f.schedules {
+		if schedule.UserID == userID {
+			schedules = append(schedules, *schedule)
+		}
+	}
+	return schedules, nil
+}
+
+func (f *fakeScheduleStore) ListEnabledTaskSchedules(ctx context.Context) ([]db.TaskSchedule, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var schedules []db.TaskSchedule
+	for _, schedule := range f.schedules {
+		if schedule.Enabled {
+			schedules = append(schedules, *schedule)
+		}
+	}
+	return schedules, nil
+}
+
+func (f *fakeScheduleStore) UpdateTaskSchedule(ctx context.Context, scheduleID int64, fields map[string]interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	schedule := f.schedules[scheduleID]
+	if schedule == nil {
+		return nil
+	}
+	for key, value := range fields {
+		str, _ := value.(string)
+		switch key {
+		case "enabled":
+			schedule.Enabled, _ = value.(bool)
+		case "next_run_at":
+			schedule.NextRunAt = str
+		case "last_run_at":
+			schedule.LastRunAt = str
+		}
+	}
+	return nil
+}
+
+func (f *fakeScheduleStore) DeleteTaskSchedule(ctx context.Context, scheduleID int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.schedules, scheduleID)
+	return nil
+}
+
+func (f *fakeScheduleStore) CreateTaskScheduleRun(ctx context.Context, run *db.TaskScheduleRun) (*db.TaskScheduleRun, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	created := *run
+	created.ID = int64(len(f.runs) + 1)
+	f.runs = append(f.runs, created)
+	return &created, nil
+}
+
+func (f *fakeScheduleStore) ListTaskScheduleRuns(ctx context.Context, scheduleID int64, limit int) ([]db.TaskScheduleRun, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var runs []db.TaskScheduleRun
+	for i := len(f.runs) - 1; i >= 0; i-- {
+		if f.runs[i].ScheduleID == scheduleID {
+			runs = append(runs, f.runs[i])
+		}
+	}
+	if limit > 0 && len(runs) > limit {
+		runs = runs[:limit]
+	}
+	return runs, nil
+}
+
+func (f *fakeScheduleStore) GetDispatchedScheduleRun(ctx context.Context, deviceID, sessionName string) (*db.TaskScheduleRun, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := len(f.runs) - 1; i >= 0; i-- {
+		run := f.runs[i]
+		if run.DeviceID == deviceID && run.SessionName == sessionName && run.Status == string(ScheduleRunDispatched) {
+			return &run, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeScheduleStore) UpdateTaskScheduleRun(ctx context.Context, runID int64, fields map[string]interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.runs {
+		if f.runs[i].ID != runID {
+			continue
+		}
+		if status, ok := fields["status"].(string); ok {
+			f.runs[i].Status = status
+		}
+		if finishedAt, ok := fields["finished_at"].(string); ok {
+			f.runs[i].FinishedAt = finishedAt
+		}
+		if message, ok := fields["error"].(string); ok {
+			f.runs[i].Error = message
+		}
+	}
+	return nil
+}
+
+func (f *fakeScheduleStore) runsWithStatus(status ScheduleRunStatus) []db.TaskScheduleRun {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var runs []db.TaskScheduleRun
+	for _, run := range f.runs {
+		if run.Status == string(status) {
+			runs = append(runs, run)
+		}
+	}
+	return runs
+}
+
+type recordingDeviceSender struct {
+	connected bool
+	sessions  []string
+}
+
+func (r *recordingDeviceSender) SendToDeviceAgent(deviceID string, message []byte) bool {
+	if !r.connected {
+		return false
+	}
+	var msg struct {
+		Type    string `json:"type"`
+		Payload struct {
+			SessionName string `json:"session_name"`
+		} `json:"payload"`
+	}
+	json.Unmarshal(message, &msg)
+	r.sessions = append(r.sessions, msg.Payload.SessionName)
+	return true
+}
+
+type recordingScheduleNotifier struct {
+	titles []string
+	bodies []string
+}
+
+func (r *recordingScheduleNotifier) CreateNotification(ctx context.Context, userID int64, eventType NotificationEventType, taskID, deviceID, sessionName, title, body string) (*db.Notification, error) {
+	r.titles = append(r.titles, title)
+	r.bodies = append(r.bodies, body)
+	return &db.Notification{UserID: userID, Title: title, Body: body}, nil
+}
+
+type scheduleTestClock struct {
+	now time.Time
+}
+
+func (c *scheduleTestClock) Now() time.Time {
+	return c.now
+}
+
+func newScheduleServiceForTest(store *fakeScheduleStore, sender *recordingDeviceSender, notifier *recordingScheduleNotifier, clock *scheduleTestClock) *ScheduleService {
+	service := NewScheduleService(nil, sender, &recordingTaskStarter{}, notifier, CatchUpLatest)
+	service.store = store
+	service.now = clock.Now
+	return service
+}
+
+func createNightlySchedule(t *testing.T, service *ScheduleService, catchUp string) *db.TaskSchedule {
+	t.Helper()
+	schedule, err := service.CreateSchedule(context.Background(), 7, ScheduleInput{
+		DeviceID:    "device-123",
+		Name:        "Update deps",
+		CronExpr:    "0 2 * * *",
+		Tool:        "codex",
+		ProjectPath: "/Users/me/repo-a",
+		Prompt:      "update dependencies and summarize",
+		CatchUp:     catchUp,
+	})
+	if err != nil {
+		t.Fatalf("CreateSchedule: %v", err)
+	}
+	return schedule
+}
+
+func TestScheduleServiceDispatchesDueRunAndAdvances(t *testing.T) {
+	store := newFakeScheduleStore()
+	sender := &recordingDeviceSender{connected: true}
+	clock := &scheduleTestClock{now: time.Date(2026, 4, 15, 12, 0, 0, 0, time.UTC)}
+	service := newScheduleServiceForTest(store, sender, &recordingScheduleNotifier{}, clock)
+
+	schedule := createNightlySchedule(t, service, "")
+	if schedule.NextRunAt != "2026-04-16T02:00:00Z" {
+		t.Fatalf("NextRunAt = %q, want next 02:00", schedule.NextRunAt)
+	}
+
+	service.tick(context.Background())
+	if len(sender.sessions) != 0 {
+		t.Fatalf("sessions = %v, want nothing before the run is due", sender.sessions)
+	}
+
+	clock.now = time.Date(2026, 4, 16, 2, 0, 10, 0, time.UTC)
+	service.tick(context.Background())
+
+	if len(sender.sessions) != 1 || sender.sessions[0] != "codex-device-repo-a-s1-2604160200" {
+		t.Fatalf("sessions = %v, want one scheduled session", sender.sessions)
+	}
+	runs := store.runsWithStatus(ScheduleRunDispatched)
+	if len(runs) != 1 || runs[0].TaskID != "task-Update deps" || runs[0].ScheduledFor != "2026-04-16T02:00:00Z" {
+		t.Fatalf("runs = %+v, want dispatched run with task", runs)
+	}
+	if store.schedules[schedule.ID].NextRunAt != "2026-04-17T02:00:00Z" {
+		t.Fatalf("NextRunAt = %q, want following day", store.schedules[schedule.ID].NextRunAt)
+	}
+}
+
+func TestScheduleServiceKeepsMissedRunsWhileDeviceOffline(t *testing.T) {
+	store := newFakeScheduleStore()
+	sender := &recordingDeviceSender{}
+	clock := &scheduleTestClock{now: time.Date(2026, 4, 15, 12, 0, 0, 0, time.UTC)}
+	service := newScheduleServiceForTest(store, sender, &recordingScheduleNotifier{}, clock)
+	schedule := createNightlySchedule(t, service, "")
+
+	clock.now = time.Date(2026, 4, 16, 2, 1, 0, 0, time.UTC)
+	service.tick(context.Background())
+
+	if len(store.runs) != 0 {
+		t.Fatalf("runs = %+v, want none while offline", store.runs)
+	}
+	if store.schedules[schedule.ID].NextRunAt != "2026-04-16T02:00:00Z" {
+		t.Fatalf("NextRunAt = %q, want unchanged while offline", store.schedules[schedule.ID].NextRunAt)
+	}
+}
+
+func TestScheduleServiceAppliesCatchUpPolicies(t *testing.T) {
+	cases := []struct {
+		catchUp    string
+		dispatched int
+		skipped    int
+	}{
+		{catchUp: "skip", dispatched: 0, skipped: 3},
+		{catchUp: "latest", dispatched: 1, skipped: 2},
+		{catchUp: "all", dispatched: 3, skipped: 0},
+		{catchUp: "", dispatched: 1, skipped: 2},
+	}
+
+	for _, tc := range cases {
+		store := newFakeScheduleStore()
+		sender := &recordingDeviceSender{}
+		clock := &scheduleTestClock{now: time.Date(2026, 4, 15, 12, 0, 0, 0, time.UTC)}
+		service := newScheduleServiceForTest(store, sender, &recordingScheduleNotifier{}, clock)
+		schedule := createNightlySchedule(t, service, tc.catchUp)
+
+		// Offline for three nightly runs, back online mid-morning.
+		clock.now = time.Date(2026, 4, 18, 9, 0, 0, 0, time.UTC)
+		sender.connected = true
+		service.tick(context.Background())
+
+		if got := len(store.runsWithStatus(ScheduleRunDispatched)); got != tc.dispatched {
+			t.Fatalf("catch_up=%q dispatched = %d, want %d", tc.catchUp, got, tc.dispatched)
+		}
+		if got := len(store.runsWithStatus(ScheduleRunSkipped)); got != tc.skipped {
+			t.Fatalf("catch_up=%q skipped = %d, want %d", tc.catchUp, got, tc.skipped)
+		}
+		if store.schedules[schedule.ID].NextRunAt != "2026-04-19T02:00:00Z" {
+			t.Fatalf("catch_up=%q NextRunAt = %q, want next night", tc.catchUp, store.schedules[schedule.ID].NextRunAt)
+		}
+	}
+}
+
+func TestScheduleServiceSkipPolicyRunsOnTimeOccurrence(t *testing.T) {
+	store := newFakeScheduleStore()
+	sender := &recordingDeviceSender{connected: true}
+	clock := &scheduleTestClock{now: time.Date(2026, 4, 15, 12, 0, 0, 0, time.UTC)}
+	service := newScheduleServiceForTest(store, sender, &recordingScheduleNotifier{}, clock)
+	createNightlySchedule(t, service, "skip")
+
+	clock.now = time.Date(2026, 4, 16, 2, 0, 30, 0, time.UTC)
+	service.tick(context.Background())
+
+	if len(sender.sessions) != 1 {
+		t.Fatalf("sessions = %v, want the on-time run", sender.sessions)
+	}
+}
+
+func TestScheduleServiceRecordsCompletionAndNotifies(t *testing.T) {
+	store := newFakeScheduleStore()
+	sender := &recordingDeviceSender{connected: true}
+	notifier := &recordingScheduleNotifier{}
+	clock := &scheduleTestClock{now: time.Date(2026, 4, 15, 12, 0, 0, 0, time.UTC)}
+	service := newScheduleServiceForTest(store, sender, notifier, clock)
+	createNightlySchedule(t, service, "")
+
+	clock.now = time.Date(2026, 4, 16, 2, 0, 0, 0, time.UTC)
+	service.tick(context.Background())
+	sessionName := sender.sessions[0]
+
+	service.HandleTaskEvent(context.Background(), "device-123", sessionName, TaskEvent{Kind: TaskEventKindToolStep, Summary: "Running go get -u"})
+	if len(notifier.titles) != 0 {
+		t.Fatalf("notifications = %v, want none for tool steps", notifier.titles)
+	}
+
+	service.HandleTaskEvent(context.Background(), "device-123", sessionName, TaskEvent{Kind: TaskEventKindCompleted, Summary: "Task completed"})
+	if runs := store.runsWithStatus(ScheduleRunCompleted); len(runs) != 1 || runs[0].FinishedAt == "" {
+		t.Fatalf("runs = %+v, want completed run", store.runs)
+	}
+	if len(notifier.titles) != 1 || notifier.titles[0] != "Scheduled task completed: Update deps" {
+		t.Fatalf("notifications = %v, want completion notice", notifier.titles)
+	}
+
+	service.HandleTaskEvent(context.Background(), "device-123", sessionName, TaskEvent{Kind: TaskEventKindCompleted, Summary: "Task completed"})
+	if len(notifier.titles) != 1 {
+		t.Fatalf("notifications = %v, want a single notice per run", notifier.titles)
+	}
+}
+
+func TestScheduleServiceValidatesInputAndOwnership(t *testing.T) {
+	store := newFakeScheduleStore()
+	clock := &scheduleTestClock{now: time.Date(2026, 4, 15, 12, 0, 0, 0, time.UTC)}
+	service := newScheduleServiceForTest(store, &recordingDeviceSender{}, &recordingScheduleNotifier{}, clock)
+
+	invalid := []ScheduleInput{
+		{DeviceID: "device-123", Name: "x", CronExpr: "bad", ProjectPath: "/repo", Prompt: "p"},
+		{DeviceID: "device-123", Name: "x", CronExpr: "0 2 * * *", ProjectPath: "/repo", Prompt: "p", Tool: "vim"},
+		{DeviceID: "device-123", Name: "x", CronExpr: "0 2 * * *", ProjectPath: "/repo", Prompt: "p", CatchUp: "sometimes"},
+		{DeviceID: "device-123", Name: "x", CronExpr: "0 2 * * *", ProjectPath: "/repo", Prompt: "p", Timezone: "Mars/Base"},
+		{DeviceID: "device-123", Name: "x", CronExpr: "0 2 * * *", Prompt: "p"},
+	}
+	for _, input := range invalid {
+		if _, err := service.CreateSchedule(context.Background(), 7, input); !errors.Is(err, ErrInvalidSchedule) {
+			t.Fatalf("CreateSchedule(%+v) err = %v, want ErrInvalidSchedule", input, err)
+		}
+	}
+
+	schedule := createNightlySchedule(t, service, "")
+	if _, err := service.SetScheduleEnabled(context.Background(), 8, schedule.ID, false); err != ErrScheduleNotFound {
+		t.Fatalf("err = %v, want ErrScheduleNotFound for other user", err)
+	}
+	if err := service.DeleteSchedule(context.Background(), 8, schedule.ID); err != ErrScheduleNotFound {
+		t.Fatalf("err = %v, want ErrScheduleNotFound for other user", err)
+	}
+}
@@ -0,0 +1,122 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	// diffRequestTimeout bounds how long /api/tasks/diff waits for the agent.
+	diffRequestTimeout = 15 * time.Second
+	// maxDiffContentBytes is the hunk content the agent may include.
+	maxDiffContentBytes = 512 * 1024
+	// maxDiffResponseBytes caps the reply; larger diffs lose their hunks.
+	maxDiffResponseBytes = 1024 * 1024
+)
+
+// DiffLine is one line of a hunk. Kind is context, add or delete.
+type DiffLine struct {
+	Kind    string `json:"kind"`
+	Content string `json:"content"`
+	OldLine int    `json:"old_line,omitempty"`
+	NewLine int    `json:"new_line,omitempty"`
+}
+
+type DiffHunk struct {
+	Header   string     `json:"header"`
+	OldStart int        `json:"old_start"`
+	OldLines int        `json:"old_lines"`
+	NewStart int        `json:"new_start"`
+	NewLines int        `json:"new_lines"`
+	Lines    []DiffLine `json:"lines"`
+}
+
+// FileDiff is the diff of one file. Binary and oversized files only carry
+// their counts.
+type FileDiff struct {
+	Path      string     `json:"path"`
+	OldPath   string     `json:"old_path,omitempty"`
+	Status    string     `json:"status"`
+	Additions int        `json:"additions"`
+	Deletions int        `json:"deletions"`
+	Binary    bool       `json:"binary,omitempty"`
+	Truncated bool       `json:"truncated,omitempty"`
+	Hunks     []DiffHunk `json:"hunks"`
+}
+
+// TaskDiff is the working tree of a task's project compared to HEAD or a
+// base branch, as produced by the agent.
+type TaskDiff struct {
+	TaskID    string     `json:"task_id"`
+	Base      string     `json:"base"`
+	Files     []FileDiff `json:"files"`
+	Additions int        `json:"additions"`
+	Deletions int        `json:"deletions"`
+	Truncated bool       `json:"truncated,omitempty"`
+}
+
+type taskLookup interface {
+	GetTaskForUser(ctx context.Context, userID int64, taskID string) (*Task, error)
+}
+
+// DiffService fetches structured diffs from the agent running a task.
+type DiffService struct {
+	tasks       taskLookup
+	agents      agentRequester
+	timeout     time.Duration
+	maxResponse int
+}
+
+func NewDiffService(tasks *TaskService, agents agentRequester) *DiffService {
+	return &DiffService{
+		tasks:       tasks,
+		agents:      agents,
+		timeout:     diffRequestTimeout,
+		maxResponse: maxDiffResponseBytes,
+	}
+}
+
+// GetTaskDiff asks the agent of the task's session for its diff. An empty
+// base compares against HEAD.
+func (s *DiffService) GetTaskDiff(ctx context.Context, userID int64, taskID, base string) (*TaskDiff, error) {
+	task, err := s.tasks.GetTaskForUser(ctx, userID, taskID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	raw, err := s.agents.RequestAgent(ctx, task.DeviceID, task.SessionName, "get_diff", map[string]interface{}{
+		"base":      base,
+		"max_bytes": maxDiffContentBytes,
+	})
+	if err != nil {
+		return nil, agentRequestError(err)
+	}
+
+	var diff TaskDiff
+	if err := json.Unmarshal(raw, &diff); err != nil {
+		return nil, fmt.Errorf("%w: invalid diff: %v", ErrAgentRequestFailed, err)
+	}
+	diff.TaskID = task.ID
+	if diff.Files == nil {
+		diff.Files = []FileDiff{}
+	}
+	if len(raw) > s.maxResponse {
+		summarizeDiff(&diff)
+	}
+	return &diff, nil
+}
+
+// summarizeDiff keeps the per-file counts but drops every hunk.
+func summarizeDiff(diff *TaskDiff) {
+	for i := range diff.Files {
+		if len(diff.Files[i].Hunks) > 0 {
+			diff.Files[i].Hunks = []DiffHunk{}
+			diff.Files[i].Truncated = true
+		}
+	}
+	diff.Truncated = true
+}
@@ -0,0 +1,104 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeTaskLookup struct {
+	tasks map[string]*Task
+}
+
+func (f *fakeTaskLookup) GetTaskForUser(ctx context.Context, userID int64, taskID string) (*Task, error) {
+	task, ok := f.tasks[taskID]
+	if !ok || userID != 7 {
+		return nil, ErrTaskNotFound
+	}
+	return task, nil
+}
+
+type fakeAgentRequester struct {
+	deviceID    string
+	sessionName string
+	msgType     string
+	payload     interface{}
+	reply       string
+	err         error
+	wait        bool
+}
+
+func (f *fakeAgentRequester) RequestAgent(ctx context.Context, deviceID, sessionName, msgType string, payload interface{}) (json.RawMessage, error) {
+	f.deviceID, f.sessionName, f.msgType, f.payload = deviceID, sessionName, msgType, payload
+	if f.wait {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return json.RawMessage(f.reply), nil
+}
+
+func newDiffServiceForTest(agents *fakeAgentRequester) *DiffService {
+	service := NewDiffService(nil, agents)
+	service.tasks = &fakeTaskLookup{tasks: map[string]*Task{
+		"task-1": {ID: "task-1", DeviceID: "dev-1", SessionName: "feature"},
+	}}
+	return service
+}
+
+const diffReply = `{"base":"HEAD","additions":2,"deletions":1,"files":[{"path":"main.go","status":"modified","additions":2,"deletions":1,"hunks":[{"header":"@@ -1 +1,2 @@","old_start":1,"old_lines":1,"new_start":1,"new_lines":2,"lines":[{"kind":"delete","content":"a","old_line":1},{"kind":"add","content":"b","new_line":1},{"kind":"add","content":"c","new_line":2}]}]},{"path":"logo.png","status":"added","binary":true,"hunks":[]}]}`
+
+func TestDiffServiceRequestsDiffFromTaskSession(t *testing.T) {
+	agents := &fakeAgentRequester{reply: diffReply}
+	service := newDiffServiceForTest(agents)
+
+	diff, err := service.GetTaskDiff(context.Background(), 7, "task-1", "main")
+	if err != nil {
+		t.Fatalf("GetTaskDiff: %v", err)
+	}
+	if agents.deviceID != "dev-1" || agents.sessionName != "feature" || agents.msgType != "get_diff" {
+		t.Fatalf("request = %s/%s %s, want dev-1/feature get_diff", agents.deviceID, agents.sessionName, agents.msgType)
+	}
+	if payload := agents.payload.(map[string]interface{}); payload["base"] != "main" {
+		t.Fatalf("payload = %+v, want base main", payload)
+	}
+	if diff.TaskID != "task-1" || len(diff.Files) != 2 || len(diff.Files[0].Hunks[0].Lines) != 3 || !diff.Files[1].Binary {
+		t.Fatalf("diff = %+v", diff)
+	}
+
+	if _, err := service.GetTaskDiff(context.Background(), 8, "task-1", ""); !errors.Is(err, ErrTaskNotFound) {
+		t.Fatalf("err = %v, want ErrTaskNotFound for other user", err)
+	}
+}
+
+func TestDiffServiceSummarizesOversizedReply(t *testing.T) {
+	service := newDiffServiceForTest(&fakeAgentRequester{reply: diffReply})
+	service.maxResponse = len(diffReply) - 1
+
+	diff, err := service.GetTaskDiff(context.Background(), 7, "task-1", "")
+	if err != nil {
+		t.Fatalf("GetTaskDiff: %v", err)
+	}
+	if !diff.Truncated || !diff.Files[0].Truncated || len(diff.Files[0].Hunks) != 0 || diff.Files[0].Additions != 2 {
+		t.Fatalf("diff = %+v, want counts without hunks", diff)
+	}
+}
+
+func TestDiffServiceTimesOut(t *testing.T) {
+	service := newDiffServiceForTest(&fakeAgentRequester{wait: true})
+	service.timeout = 10 * time.Millisecond
+
+	if _, err := service.GetTaskDiff(context.Background(), 7, "task-1", ""); !errors.Is(err, ErrAgentTimeout) {
+		t.Fatalf("err = %v, want ErrAgentTimeout", err)
+	}
+
+	service = newDiffServiceForTest(&fakeAgentRequester{reply: `"not a diff"`})
+	if _, err := service.GetTaskDiff(context.Background(), 7, "task-1", ""); err == nil || !strings.Contains(err.Error(), "invalid diff") {
+		t.Fatalf("err = %v, want invalid diff", err)
+	}
+}
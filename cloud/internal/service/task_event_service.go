@@ -0,0 +1,211 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mobile-coder/cloud/internal/db"
+)
+
+const (
+	taskEventRetentionLimit    = 2000
+	taskEventRetentionAge      = 7 * 24 * time.Hour
+	taskEventRetentionInterval = 10 * time.Minute
+	taskEventRecentLimit       = 10
+	taskEventDefaultLimit      = 50
+	taskEventMaxLimit          = 200
+)
+
+// TaskIDResolver maps a session to the task currently running in it.
+type TaskIDResolver interface {
+	ResolveTaskID(ctx context.Context, deviceID, sessionName string) string
+}
+
+type taskEventStore interface {
+	CreateTaskEvent(context.Context, *db.TaskEvent) (*db.TaskEvent, error)
+	ListTaskEvents(ctx context.Context, taskID string, before string, beforeID int64, limit, offset int) ([]db.TaskEvent, error)
+	ListRecentTaskEvents(ctx context.Context, taskIDs []string, perTask int) ([]db.TaskEvent, error)
+	DeleteTaskEventsBefore(ctx context.Context, taskID string, cutoff string) error
+	DeleteTaskEventsByIDs(ctx context.Context, taskID string, eventIDs []int64) error
+}
+
+// TaskEventService persists task timeline events so they survive restarts
+// and can be paged through beyond the hub's in-memory window.
+type TaskEventService struct {
+	store    taskEventStore
+	resolver TaskIDResolver
+	now      func() time.Time
+
+	mu            sync.Mutex
+	lastRetention map[string]time.Time
+}
+
+func NewTaskEventService(database *db.SupabaseDB) *TaskEventService {
+	return &TaskEventService{
+		store:         database,
+		now:           time.Now,
+		lastRetention: make(map[string]time.Time),
+	}
+}
+
+// SetTaskResolver attributes session events to persisted task records.
+func (s *TaskEventService) SetTaskResolver(resolver TaskIDResolver) {
+	s.resolver = resolver
+}
+
+// HandleTaskEvent stores an event reported by the hub for a session.
+func (s *TaskEventService) HandleTaskEvent(ctx context.Context, deviceID, sessionName string, event TaskEvent) {
+	taskID := sessionTaskID(deviceID, sessionName)
+	if s.resolver != nil {
+		taskID = s.resolver.ResolveTaskID(ctx, deviceID, sessionName)
+	}
+	if err := s.RecordTaskEvent(ctx, taskID, deviceID, sessionName, event); err != nil {
+		slog.Warn("task event service: record event failed", "task_id", taskID, "error", err)
+	}
+}
+
+func (s *TaskEventService) RecordTaskEvent(ctx context.Context, taskID, deviceID, sessionName string, event TaskEvent) error {
+	createdAt := event.Timestamp
+	if createdAt == "" {
+		createdAt = s.now().UTC().Format(time.RFC3339Nano)
+	}
+
+	if _, err := s.store.CreateTaskEvent(ctx, &db.TaskEvent{
+		TaskID:      taskID,
+		DeviceID:    deviceID,
+		SessionName: sessionName,
+		Kind:        string(event.Kind),
+		Summary:     event.Summary,
+		CreatedAt:   createdAt,
+	}); err != nil {
+		return err
+	}
+
+	return s.maybeApplyRetention(ctx, taskID)
+}
+
+// ListTaskEvents returns a page of events older than the (before, beforeID)
+// cursor, newest first.
+func (s *TaskEventService) ListTaskEvents(ctx context.Context, taskID string, before *time.Time, beforeID int64, limit int) ([]TaskEvent, error) {
+	if limit <= 0 {
+		limit = taskEventDefaultLimit
+	}
+	if limit > taskEventMaxLimit {
+		limit = taskEventMaxLimit
+	}
+
+	beforeValue := ""
+	if before != nil && !before.IsZero() {
+		beforeValue = before.UTC().Format(time.RFC3339Nano)
+	}
+
+	records, err := s.store.ListTaskEvents(ctx, taskID, beforeValue, beforeID, limit, 0)
+	if err != nil {
+		return nil, err
+	}
+	return taskEventsFromRecords(records), nil
+}
+
+// GetRecentEvents returns the newest events of a task for enrichment.
+func (s *TaskEventService) GetRecentEvents(ctx context.Context, taskID string) []TaskEvent {
+	records, err := s.store.ListTaskEvents(ctx, taskID, "", 0, taskEventRecentLimit, 0)
+	if err != nil {
+		slog.Warn("task event service: list recent events failed", "task_id", taskID, "error", err)
+		return nil
+	}
+	return taskEventsFromRecords(records)
+}
+
+// GetRecentEventsForTasks returns the newest events of several tasks with a
+// single store call, keyed by task ID.
+func (s *TaskEventService) GetRecentEventsForTasks(ctx context.Context, taskIDs []string) map[string][]TaskEvent {
+	if len(taskIDs) == 0 {
+		return nil
+	}
+
+	records, err := s.store.ListRecentTaskEvents(ctx, taskIDs, taskEventRecentLimit)
+	if err != nil {
+		slog.Warn("task event service: list recent events failed", "tasks", len(taskIDs), "error", err)
+		return nil
+	}
+
+	byTask := make(map[string][]db.TaskEvent, len(taskIDs))
+	for _, record := range records {
+		byTask[record.TaskID] = append(byTask[record.TaskID], record)
+	}
+	events := make(map[string][]TaskEvent, len(byTask))
+	for taskID, taskRecords := range byTask {
+		sort.SliceStable(taskRecords, func(i, j int) bool {
+			if taskRecords[i].CreatedAt != taskRecords[j].CreatedAt {
+				return taskRecords[i].CreatedAt > taskRecords[j].CreatedAt
+			}
+			return taskRecords[i].ID > taskRecords[j].ID
+		})
+		events[taskID] = taskEventsFromRecords(taskRecords)
+	}
+	return events
+}
+
+func (s *TaskEventService) maybeApplyRetention(ctx context.Context, taskID string) error {
+	now := s.now()
+
+	s.mu.Lock()
+	if last, ok := s.lastRetention[taskID]; ok && now.Sub(last) < taskEventRetentionInterval {
+		s.mu.Unlock()
+		return nil
+	}
+	s.lastRetention[taskID] = now
+	s.mu.Unlock()
+
+	return s.applyRetention(ctx, taskID, now)
+}
+
+func (s *TaskEventService) applyRetention(ctx context.Context, taskID string, now time.Time) error {
+	cutoff := now.Add(-taskEventRetentionAge).UTC().Format(time.RFC3339Nano)
+	if err := s.store.DeleteTaskEventsBefore(ctx, taskID, cutoff); err != nil {
+		return err
+	}
+
+	overflow, err := s.store.ListTaskEvents(ctx, taskID, "", 0, 0, taskEventRetentionLimit)
+	if err != nil {
+		return err
+	}
+	ids := make([]int64, 0, len(overflow))
+	for _, event := range overflow {
+		if event.ID > 0 {
+			ids = append(ids, event.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	return s.store.DeleteTaskEventsByIDs(ctx, taskID, ids)
+}
+
+func taskEventsFromRecords(records []db.TaskEvent) []TaskEvent {
+	if len(records) == 0 {
+		return nil
+	}
+
+	events := make([]TaskEvent, 0, len(records))
+	for _, record := range records {
+		events = append(events, TaskEvent{
+			ID:        record.ID,
+			Summary:   record.Summary,
+			Timestamp: record.CreatedAt,
+			Kind:      TaskEventKind(record.Kind),
+		})
+	}
+	return events
+}
+
+func sessionTaskID(deviceID, sessionName string) string {
+	if sessionName == "" {
+		return deviceID
+	}
+	return deviceID + ":" + sessionName
+}
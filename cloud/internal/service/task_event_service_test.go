@@ -0,0 +1,290 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mobile-coder/cloud/internal/db"
+)
+
+type fakeTaskEventStore struct {
+	mu     sync.Mutex
+	events []db.TaskEvent
+	nextID int64
+
+	listCalls         []listTaskEventsCall
+	recentCalls       [][]string
+	deleteBeforeCalls []string
+	deleteIDCalls     [][]int64
+}
+
+type listTaskEventsCall struct {
+	taskID   string
+	before   string
+	beforeID int64
+	limit    int
+	offset   int
+}
+
+func (f *fakeTaskEventStore) CreateTaskEvent(ctx context.Context, event *db.TaskEvent) (*db.TaskEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	created := *event
+	created.ID = f.nextID
+	// Keep newest first, like the store's ordering.
+	f.events = append([]db.TaskEvent{created}, f.events...)
+	return &created, nil
+}
+
+func (f *fakeTaskEventStore) ListTaskEvents(ctx context.Context, taskID string, before string, beforeID int64, limit, offset int) ([]db.TaskEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.listCalls = append(f.listCalls, listTaskEventsCall{taskID: taskID, before: before, beforeID: beforeID, limit: limit, offset: offset})
+
+	var matched []db.TaskEvent
+	for _, event := range f.events {
+		if event.TaskID != taskID {
+			continue
+		}
+		if before != "" && (event.CreatedAt > before || event.CreatedAt == before && (beforeID == 0 || event.ID >= beforeID)) {
+			continue
+		}
+		matched = append(matched, event)
+	}
+	if offset >= len(matched) {
+		return nil, nil
+	}
+	matched = matched[offset:]
+	if limit > 0 && len(matched) > limit {
+		matched = matched[:limit]
+	}
+	return matched, nil
+}
+
+func (f *fakeTaskEventStore) ListRecentTaskEvents(ctx context.Context, taskIDs []string, perTask int) ([]db.TaskEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.recentCalls = append(f.recentCalls, append([]string(nil), taskIDs...))
+
+	var matched []db.TaskEvent
+	for _, taskID := range taskIDs {
+		count := 0
+		for _, event := range f.events {
+			if event.TaskID == taskID && count < perTask {
+				matched = append(matched, event)
+				count++
+			}
+		}
+	}
+	return matched, nil
+}
+
+func (f *fakeTaskEventStore) DeleteTaskEventsBefore(ctx context.Context, taskID string, cutoff string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleteBeforeCalls = append(f.deleteBeforeCalls, cutoff)
+	return nil
+}
+
+func (f *fakeTaskEventStore) DeleteTaskEventsByIDs(ctx context.Context, taskID string, eventIDs []int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleteIDCalls = append(f.deleteIDCalls, append([]int64(nil), eventIDs...))
+	return nil
+}
+
+func newTaskEventServiceForTest(store *fakeTaskEventStore, now time.Time) *TaskEventService {
+	service := NewTaskEventService(nil)
+	service.store = store
+	service.now = func() time.Time { return now }
+	return service
+}
+
+func TestTaskEventServiceHandleTaskEventPersistsUnderSessionTaskID(t *testing.T) {
+	store := &fakeTaskEventStore{}
+	service := newTaskEventServiceForTest(store, time.Date(2026, 4, 12, 9, 0, 0, 0, time.UTC))
+
+	service.HandleTaskEvent(context.Background(), "dev-1", "feature", TaskEvent{
+		Summary:   "all green",
+		Timestamp: "2026-04-12T09:00:00Z",
+		Kind:      TaskEventKindTestResult,
+	})
+
+	events := service.GetRecentEvents(context.Background(), "dev-1:feature")
+	if len(events) != 1 {
+		t.Fatalf("len(events) = %d, want 1", len(events))
+	}
+	if events[0].Summary != "all green" || events[0].Kind != TaskEventKindTestResult {
+		t.Fatalf("events[0] = %+v, want persisted test result", events[0])
+	}
+	if events[0].Timestamp != "2026-04-12T09:00:00Z" {
+		t.Fatalf("events[0].Timestamp = %q, want original event time", events[0].Timestamp)
+	}
+}
+
+func TestTaskEventServiceListTaskEventsPagesWithBefore(t *testing.T) {
+	store := &fakeTaskEventStore{}
+	service := newTaskEventServiceForTest(store, time.Date(2026, 4, 12, 12, 0, 0, 0, time.UTC))
+
+	for _, ts := range []string{"2026-04-12T09:00:00Z", "2026-04-12T10:00:00Z", "2026-04-12T11:00:00Z"} {
+		if err := service.RecordTaskEvent(context.Background(), "dev-1:feature", "dev-1", "feature", TaskEvent{Summary: ts, Timestamp: ts, Kind: TaskEventKindInfo}); err != nil {
+			t.Fatalf("RecordTaskEvent: %v", err)
+		}
+	}
+
+	firstPage, err := service.ListTaskEvents(context.Background(), "dev-1:feature", nil, 0, 2)
+	if err != nil {
+		t.Fatalf("ListTaskEvents: %v", err)
+	}
+	if len(firstPage) != 2 || firstPage[0].Summary != "2026-04-12T11:00:00Z" {
+		t.Fatalf("firstPage = %+v, want two newest events", firstPage)
+	}
+
+	before, _ := time.Parse(time.RFC3339, firstPage[1].Timestamp)
+	secondPage, err := service.ListTaskEvents(context.Background(), "dev-1:feature", &before, 0, 2)
+	if err != nil {
+		t.Fatalf("ListTaskEvents second page: %v", err)
+	}
+	if len(secondPage) != 1 || secondPage[0].Summary != "2026-04-12T09:00:00Z" {
+		t.Fatalf("secondPage = %+v, want oldest event", secondPage)
+	}
+}
+
+func TestTaskEventServiceListTaskEventsKeepsEventsSharingATimestamp(t *testing.T) {
+	store := &fakeTaskEventStore{}
+	service := newTaskEventServiceForTest(store, time.Date(2026, 4, 12, 12, 0, 0, 0, time.UTC))
+
+	for _, summary := range []string{"first", "second", "third"} {
+		if err := service.RecordTaskEvent(context.Background(), "dev-1:feature", "dev-1", "feature", TaskEvent{Summary: summary, Timestamp: "2026-04-12T10:00:00Z", Kind: TaskEventKindInfo}); err != nil {
+			t.Fatalf("RecordTaskEvent: %v", err)
+		}
+	}
+
+	firstPage, err := service.ListTaskEvents(context.Background(), "dev-1:feature", nil, 0, 2)
+	if err != nil {
+		t.Fatalf("ListTaskEvents: %v", err)
+	}
+	if len(firstPage) != 2 || firstPage[1].Summary != "second" {
+		t.Fatalf("firstPage = %+v, want third and second", firstPage)
+	}
+
+	before, _ := time.Parse(time.RFC3339, firstPage[1].Timestamp)
+	secondPage, err := service.ListTaskEvents(context.Background(), "dev-1:feature", &before, firstPage[1].ID, 2)
+	if err != nil {
+		t.Fatalf("ListTaskEvents second page: %v", err)
+	}
+	if len(secondPage) != 1 || secondPage[0].Summary != "first" {
+		t.Fatalf("secondPage = %+v, want the event sharing the cursor timestamp", secondPage)
+	}
+}
+
+func TestTaskEventServiceGetRecentEventsForTasksUsesOneCall(t *testing.T) {
+	store := &fakeTaskEventStore{}
+	service := newTaskEventServiceForTest(store, time.Date(2026, 4, 12, 12, 0, 0, 0, time.UTC))
+
+	for _, taskID := range []string{"dev-1:feature", "dev-1:main"} {
+		if err := service.RecordTaskEvent(context.Background(), taskID, "dev-1", "x", TaskEvent{Summary: taskID, Timestamp: "2026-04-12T10:00:00Z", Kind: TaskEventKindInfo}); err != nil {
+			t.Fatalf("RecordTaskEvent: %v", err)
+		}
+	}
+
+	events := service.GetRecentEventsForTasks(context.Background(), []string{"dev-1:feature", "dev-1:main", "dev-2:idle"})
+	if len(store.recentCalls) != 1 {
+		t.Fatalf("recent calls = %d, want 1", len(store.recentCalls))
+	}
+	if len(events["dev-1:feature"]) != 1 || events["dev-1:main"][0].Summary != "dev-1:main" {
+		t.Fatalf("events = %+v, want one event per task", events)
+	}
+	if len(events["dev-2:idle"]) != 0 {
+		t.Fatalf("events[dev-2:idle] = %+v, want none", events["dev-2:idle"])
+	}
+}
+
+func TestTaskEventServiceClampsLimit(t *testing.T) {
+	store := &fakeTaskEventStore{}
+	service := newTaskEventServiceForTest(store, time.Now())
+
+	if _, err := service.ListTaskEvents(context.Background(), "dev-1:feature", nil, 0, 10000); err != nil {
+		t.Fatalf("ListTaskEvents: %v", err)
+	}
+	if _, err := service.ListTaskEvents(context.Background(), "dev-1:feature", nil, 0, 0); err != nil {
+		t.Fatalf("ListTaskEvents: %v", err)
+	}
+
+	if got := store.listCalls[0].limit; got != taskEventMaxLimit {
+		t.Fatalf("limit = %d, want %d", got, taskEventMaxLimit)
+	}
+	if got := store.listCalls[1].limit; got != taskEventDefaultLimit {
+		t.Fatalf("limit = %d, want %d", got, taskEventDefaultLimit)
+	}
+}
+
+func TestTaskEventServiceAppliesRetentionAtMostOncePerInterval(t *testing.T) {
+	store := &fakeTaskEventStore{}
+	now := time.Date(2026, 4, 12, 9, 0, 0, 0, time.UTC)
+	service := newTaskEventServiceForTest(store, now)
+	service.now = func() time.Time { return now }
+
+	for i := 0; i < taskEventRetentionLimit+3; i++ {
+		store.events = append(store.events, db.TaskEvent{ID: int64(i + 1), TaskID: "dev-1:feature", CreatedAt: "2026-04-12T08:00:00Z"})
+	}
+
+	if err := service.RecordTaskEvent(context.Background(), "dev-1:feature", "dev-1", "feature", TaskEvent{Summary: "step", Kind: TaskEventKindInfo}); err != nil {
+		t.Fatalf("RecordTaskEvent: %v", err)
+	}
+	if len(store.deleteBeforeCalls) != 1 {
+		t.Fatalf("deleteBeforeCalls = %d, want 1", len(store.deleteBeforeCalls))
+	}
+	if want := now.Add(-taskEventRetentionAge).Format(time.RFC3339Nano); store.deleteBeforeCalls[0] != want {
+		t.Fatalf("cutoff = %q, want %q", store.deleteBeforeCalls[0], want)
+	}
+	if len(store.deleteIDCalls) != 1 || len(store.deleteIDCalls[0]) != 4 {
+		t.Fatalf("deleteIDCalls = %v, want one call removing 4 overflow events", store.deleteIDCalls)
+	}
+
+	now = now.Add(time.Minute)
+	if err := service.RecordTaskEvent(context.Background(), "dev-1:feature", "dev-1", "feature", TaskEvent{Summary: "step 2", Kind: TaskEventKindInfo}); err != nil {
+		t.Fatalf("RecordTaskEvent: %v", err)
+	}
+	if len(store.deleteBeforeCalls) != 1 {
+		t.Fatalf("deleteBeforeCalls = %d, want retention throttled", len(store.deleteBeforeCalls))
+	}
+
+	now = now.Add(taskEventRetentionInterval)
+	if err := service.RecordTaskEvent(context.Background(), "dev-1:feature", "dev-1", "feature", TaskEvent{Summary: "step 3", Kind: TaskEventKindInfo}); err != nil {
+		t.Fatalf("RecordTaskEvent: %v", err)
+	}
+	if len(store.deleteBeforeCalls) != 2 {
+		t.Fatalf("deleteBeforeCalls = %d, want retention after interval", len(store.deleteBeforeCalls))
+	}
+}
+
+func TestTaskServiceListTaskTimelineRequiresOwnedTask(t *testing.T) {
+	store := &fakeTaskEventStore{}
+	events := newTaskEventServiceForTest(store, time.Now())
+	events.HandleTaskEvent(context.Background(), "dev-1", "feature", TaskEvent{Summary: "compile ok", Timestamp: "2026-04-12T09:00:00Z", Kind: TaskEventKindInfo})
+
+	service := NewTaskService(&fakeTaskDeviceSource{
+		devicesByUser: map[int64][]Device{
+			7: {{DeviceID: "dev-1", DeviceName: "MacBook", Status: "online"}},
+		},
+		sessionsByDevice: map[string][]Session{
+			"dev-1": {{ID: 10, DeviceID: "dev-1", SessionName: "feature", Status: "active"}},
+		},
+	}, events)
+
+	timeline, err := service.ListTaskTimeline(context.Background(), 7, "dev-1:feature", nil, 0, 0)
+	if err != nil {
+		t.Fatalf("ListTaskTimeline: %v", err)
+	}
+	if len(timeline) != 1 || timeline[0].Summary != "compile ok" {
+		t.Fatalf("timeline = %+v, want persisted event", timeline)
+	}
+
+	if _, err := service.ListTaskTimeline(context.Background(), 8, "dev-1:feature", nil, 0, 0); err != ErrTaskNotFound {
+		t.Fatalf("err = %v, want ErrTaskNotFound for other user", err)
+	}
+}
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	fileRequestTimeout = 10 * time.Second
+	// maxFileContentBytes is the file content the agent returns; longer files
+	// come back truncated.
+	maxFileContentBytes = 256 * 1024
+)
+
+// FileEntry is an item of a directory listing, relative to the project root.
+type FileEntry struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Type    string `json:"type"`
+	Size    int64  `json:"size"`
+	ModTime string `json:"mod_time"`
+}
+
+type DirListing struct {
+	TaskID    string      `json:"task_id"`
+	Path      string      `json:"path"`
+	Entries   []FileEntry `json:"entries"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+// FileContent is a text file of the project. Binary files carry no content.
+type FileContent struct {
+	TaskID    string `json:"task_id"`
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	ModTime   string `json:"mod_time"`
+	Binary    bool   `json:"binary"`
+	Truncated bool   `json:"truncated,omitempty"`
+	Content   string `json:"content"`
+}
+
+// FileService browses the project of a task through its agent, read-only.
+type FileService struct {
+	tasks   taskLookup
+	agents  agentRequester
+	timeout time.Duration
+}
+
+func NewFileService(tasks *TaskService, agents agentRequester) *FileService {
+	return &FileService{
+		tasks:   tasks,
+		agents:  agents,
+		timeout: fileRequestTimeout,
+	}
+}
+
+// ListFiles lists a directory of the task's project; an empty path is the root.
+func (s *FileService) ListFiles(ctx context.Context, userID int64, taskID, path string) (*DirListing, error) {
+	task, raw, err := s.request(ctx, userID, taskID, "list_dir", map[string]interface{}{"path": path})
+	if err != nil {
+		return nil, err
+	}
+
+	var listing DirListing
+	if err := json.Unmarshal(raw, &listing); err != nil {
+		return nil, fmt.Errorf("%w: invalid listing: %v", ErrAgentRequestFailed, err)
+	}
+	listing.TaskID = task.ID
+	if listing.Entries == nil {
+		listing.Entries = []FileEntry{}
+	}
+	return &listing, nil
+}
+
+// ReadFile returns a file of the task's project.
+func (s *FileService) ReadFile(ctx context.Context, userID int64, taskID, path string) (*FileContent, error) {
+	task, raw, err := s.request(ctx, userID, taskID, "read_file", map[string]interface{}{
+		"path":      path,
+		"max_bytes": maxFileContentBytes,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var file FileContent
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return nil, fmt.Errorf("%w: invalid file: %v", ErrAgentRequestFailed, err)
+	}
+	file.TaskID = task.ID
+	return &file, nil
+}
+
+func (s *FileService) request(ctx context.Context, userID int64, taskID, msgType string, payload map[string]interface{}) (*Task, json.RawMessage, error) {
+	task, err := s.tasks.GetTaskForUser(ctx, userID, taskID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	raw, err := s.agents.RequestAgent(ctx, task.DeviceID, task.SessionName, msgType, payload)
+	if err != nil {
+		return nil, nil, agentRequestError(err)
+	}
+	return task, raw, nil
+}
@@ -0,0 +1,58 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func newFileServiceForTest(agents *fakeAgentRequester) *FileService {
+	service := NewFileService(nil, agents)
+	service.tasks = &fakeTaskLookup{tasks: map[string]*Task{
+		"task-1": {ID: "task-1", DeviceID: "dev-1", SessionName: "feature"},
+	}}
+	return service
+}
+
+func TestFileServiceListsAndReadsThroughAgent(t *testing.T) {
+	agents := &fakeAgentRequester{reply: `{"path":"docs","entries":[{"name":"guide.md","path":"docs/guide.md","type":"file","size":8}]}`}
+	service := newFileServiceForTest(agents)
+
+	listing, err := service.ListFiles(context.Background(), 7, "task-1", "docs")
+	if err != nil {
+		t.Fatalf("ListFiles: %v", err)
+	}
+	if agents.msgType != "list_dir" || agents.payload.(map[string]interface{})["path"] != "docs" {
+		t.Fatalf("request = %s %+v", agents.msgType, agents.payload)
+	}
+	if listing.TaskID != "task-1" || len(listing.Entries) != 1 || listing.Entries[0].Path != "docs/guide.md" {
+		t.Fatalf("listing = %+v", listing)
+	}
+
+	agents.reply = `{"path":"main.go","size":13,"binary":false,"content":"package main\n"}`
+	file, err := service.ReadFile(context.Background(), 7, "task-1", "main.go")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	payload := agents.payload.(map[string]interface{})
+	if agents.msgType != "read_file" || payload["max_bytes"] != maxFileContentBytes {
+		t.Fatalf("request = %s %+v", agents.msgType, payload)
+	}
+	if file.Content != "package main\n" || file.TaskID != "task-1" {
+		t.Fatalf("file = %+v", file)
+	}
+}
+
+func TestFileServicePassesAgentErrors(t *testing.T) {
+	agents := &fakeAgentRequester{err: &AgentError{Code: AgentErrorForbidden, Message: "path is outside the project"}}
+	service := newFileServiceForTest(agents)
+
+	_, err := service.ReadFile(context.Background(), 7, "task-1", "../secret")
+	var agentErr *AgentError
+	if !errors.As(err, &agentErr) || agentErr.Code != AgentErrorForbidden || !errors.Is(err, ErrAgentRequestFailed) {
+		t.Fatalf("err = %v, want forbidden AgentError", err)
+	}
+	if _, err := service.ListFiles(context.Background(), 8, "task-1", ""); !errors.Is(err, ErrTaskNotFound) {
+		t.Fatalf("err = %v, want ErrTaskNotFound", err)
+	}
+}
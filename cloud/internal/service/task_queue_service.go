@@ -0,0 +1,398 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mobile-coder/cloud/internal/db"
+)
+
+type QueueItemStatus string
+
+const (
+	QueueItemQueued     QueueItemStatus = "queued"
+	QueueItemDispatched QueueItemStatus = "dispatched"
+	QueueItemCompleted  QueueItemStatus = "completed"
+	QueueItemFailed     QueueItemStatus = "failed"
+	QueueItemCancelled  QueueItemStatus = "cancelled"
+)
+
+var (
+	ErrQueueItemNotFound       = errors.New("queue item not found")
+	ErrQueueItemNotCancellable = errors.New("only queued items can be cancelled")
+	ErrInvalidQueueOrder       = errors.New("item_ids must list every queued item exactly once")
+	ErrEmptyPrompt             = errors.New("prompt required")
+)
+
+type taskQueueStore interface {
+	CreateTaskQueueItem(context.Context, *db.TaskQueueItem) (*db.TaskQueueItem, error)
+	GetTaskQueueItem(ctx context.Context, itemID int64) (*db.TaskQueueItem, error)
+	ListTaskQueueItems(ctx context.Context, deviceID, sessionName string, statuses []string) ([]db.TaskQueueItem, error)
+	UpdateTaskQueueItem(ctx context.Context, itemID int64, fields map[string]interface{}) error
+	GetTaskQueue(ctx context.Context, deviceID, sessionName string) (*db.TaskQueue, error)
+	SaveTaskQueue(context.Context, *db.TaskQueue) error
+}
+
+// agentSender delivers a message to the agent serving a session. It reports
+// whether an agent was connected to receive it.
+type agentSender interface {
+	SendToAgents(deviceID string, sessionName string, message []byte) bool
+}
+
+type queueTaskStarter interface {
+	StartTask(ctx context.Context, userID int64, deviceID, sessionName, title, goal string) (*db.Task, error)
+}
+
+// TaskQueue is the state of a session's prompt queue returned to clients.
+type TaskQueue struct {
+	DeviceID    string             `json:"device_id"`
+	SessionName string             `json:"session_name"`
+	Paused      bool               `json:"paused"`
+	PauseReason string             `json:"pause_reason,omitempty"`
+	Items       []db.TaskQueueItem `json:"items"`
+}
+
+// queueSignalBuffer bounds the signals waiting for the queue worker.
+const queueSignalBuffer = 256
+
+// TaskQueueService runs queued prompts one after another in a session: the
+// next prompt is submitted when the agent reports the current one done, and
+// failures or prompts waiting for input pause the queue. Signals are
+// applied by Run, off the goroutines that report them.
+type TaskQueueService struct {
+	store   taskQueueStore
+	sender  agentSender
+	tasks   queueTaskStarter
+	now     func() time.Time
+	signals chan queueSignal
+
+	mu sync.Mutex
+}
+
+// queueSignal is something that happened to the prompt running in a
+// session: done carries the queue item the agent finished, otherwise event
+// is a failure or a prompt waiting for input.
+type queueSignal struct {
+	ctx         context.Context // trace of the message that raised it
+	deviceID    string
+	sessionName string
+	done        int64
+	event       TaskEvent
+}
+
+func NewTaskQueueService(database *db.SupabaseDB, sender agentSender, tasks queueTaskStarter) *TaskQueueService {
+	return &TaskQueueService{
+		store:   database,
+		sender:  sender,
+		tasks:   tasks,
+		now:     time.Now,
+		signals: make(chan queueSignal, queueSignalBuffer),
+	}
+}
+
+// Run applies queue signals until the process exits.
+func (s *TaskQueueService) Run() {
+	for signal := range s.signals {
+		s.applySignal(signal.ctx, signal)
+	}
+}
+
+func (s *TaskQueueService) Enqueue(ctx context.Context, userID int64, deviceID, sessionName, title, prompt string) (*db.TaskQueueItem, error) {
+	if strings.TrimSpace(prompt) == "" {
+		return nil, ErrEmptyPrompt
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	items, err := s.store.ListTaskQueueItems(ctx, deviceID, sessionName, []string{string(QueueItemQueued), string(QueueItemDispatched)})
+	if err != nil {
+		return nil, err
+	}
+	position := 0
+	for _, item := range items {
+		if item.Position >= position {
+			position = item.Position + 1
+		}
+	}
+
+	created, err := s.store.CreateTaskQueueItem(ctx, &db.TaskQueueItem{
+		UserID:      userID,
+		DeviceID:    deviceID,
+		SessionName: sessionName,
+		Title:       strings.TrimSpace(title),
+		Prompt:      prompt,
+		Position:    position,
+		Status:      string(QueueItemQueued),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.dispatchNextLocked(ctx, deviceID, sessionName); err != nil {
+		return nil, err
+	}
+	if refreshed, err := s.store.GetTaskQueueItem(ctx, created.ID); err == nil && refreshed != nil {
+		return refreshed, nil
+	}
+	return created, nil
+}
+
+func (s *TaskQueueService) GetQueue(ctx context.Context, deviceID, sessionName string) (*TaskQueue, error) {
+	items, err := s.store.ListTaskQueueItems(ctx, deviceID, sessionName, []string{string(QueueItemQueued), string(QueueItemDispatched)})
+	if err != nil {
+		return nil, err
+	}
+	state, err := s.store.GetTaskQueue(ctx, deviceID, sessionName)
+	if err != nil {
+		return nil, err
+	}
+
+	queue := &TaskQueue{
+		DeviceID:    deviceID,
+		SessionName: sessionName,
+		Items:       items,
+	}
+	if queue.Items == nil {
+		queue.Items = []db.TaskQueueItem{}
+	}
+	if state != nil {
+		queue.Paused = state.Paused
+		queue.PauseReason = state.PauseReason
+	}
+	return queue, nil
+}
+
+// Reorder assigns dispatch positions to the queued items in the given order.
+func (s *TaskQueueService) Reorder(ctx context.Context, deviceID, sessionName string, itemIDs []int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	items, err := s.store.ListTaskQueueItems(ctx, deviceID, sessionName, []string{string(QueueItemQueued)})
+	if err != nil {
+		return err
+	}
+	if len(itemIDs) != len(items) {
+		return ErrInvalidQueueOrder
+	}
+	queued := make(map[int64]bool, len(items))
+	for _, item := range items {
+		queued[item.ID] = true
+	}
+	for _, id := range itemIDs {
+		if !queued[id] {
+			return ErrInvalidQueueOrder
+		}
+		delete(queued, id)
+	}
+
+	base := 0
+	if dispatched, err := s.store.ListTaskQueueItems(ctx, deviceID, sessionName, []string{string(QueueItemDispatched)}); err == nil {
+		for _, item := range dispatched {
+			if item.Position >= base {
+				base = item.Position + 1
+			}
+		}
+	}
+	for i, id := range itemIDs {
+		if err := s.store.UpdateTaskQueueItem(ctx, id, map[string]interface{}{"position": base + i}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Cancel removes a queued item owned by the user from its queue.
+func (s *TaskQueueService) Cancel(ctx context.Context, userID, itemID int64) (*db.TaskQueueItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, err := s.store.GetTaskQueueItem(ctx, itemID)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil || item.UserID != userID {
+		return nil, ErrQueueItemNotFound
+	}
+	if item.Status != string(QueueItemQueued) {
+		return nil, ErrQueueItemNotCancellable
+	}
+
+	if err := s.store.UpdateTaskQueueItem(ctx, itemID, map[string]interface{}{
+		"status":      string(QueueItemCancelled),
+		"finished_at": s.now().UTC().Format(time.RFC3339),
+	}); err != nil {
+		return nil, err
+	}
+	item.Status = string(QueueItemCancelled)
+	return item, nil
+}
+
+// Resume clears a pause and dispatches the next prompt if none is running.
+func (s *TaskQueueService) Resume(ctx context.Context, deviceID, sessionName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.store.SaveTaskQueue(ctx, &db.TaskQueue{
+		DeviceID:    deviceID,
+		SessionName: sessionName,
+		Paused:      false,
+		UpdatedAt:   s.now().UTC().Format(time.RFC3339),
+	}); err != nil {
+		return err
+	}
+	return s.dispatchNextLocked(ctx, deviceID, sessionName)
+}
+
+// HandlePromptDone advances the queue of a session after its agent
+// reported the prompt of itemID done.
+func (s *TaskQueueService) HandlePromptDone(ctx context.Context, deviceID, sessionName string, itemID int64) {
+	s.signal(queueSignal{ctx: context.WithoutCancel(ctx), deviceID: deviceID, sessionName: sessionName, done: itemID})
+}
+
+// HandleTaskEvent pauses the queue of a session when an event classified
+// from its terminal output reports a failure or a prompt waiting for input.
+// Completion is only taken from the agent, see HandlePromptDone.
+func (s *TaskQueueService) HandleTaskEvent(ctx context.Context, deviceID, sessionName string, event TaskEvent) {
+	switch event.Kind {
+	case TaskEventKindError, TaskEventKindNeedsInput:
+		s.signal(queueSignal{ctx: context.WithoutCancel(ctx), deviceID: deviceID, sessionName: sessionName, event: event})
+	}
+}
+
+func (s *TaskQueueService) signal(signal queueSignal) {
+	select {
+	case s.signals <- signal:
+	default:
+		slog.Warn("task queue service: signal buffer full, dropping signal", "task_id", sessionTaskID(signal.deviceID, signal.sessionName), "queue_item_id", signal.done)
+	}
+}
+
+func (s *TaskQueueService) applySignal(ctx context.Context, signal queueSignal) {
+	deviceID, sessionName := signal.deviceID, signal.sessionName
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dispatched, err := s.store.ListTaskQueueItems(ctx, deviceID, sessionName, []string{string(QueueItemDispatched)})
+	if err != nil {
+		slog.Warn("task queue service: list dispatched items failed", "task_id", sessionTaskID(deviceID, sessionName), "error", err)
+		return
+	}
+	if len(dispatched) == 0 {
+		return
+	}
+	current := dispatched[0]
+	now := s.now().UTC().Format(time.RFC3339)
+
+	switch {
+	case signal.done != 0:
+		// 只认当前正在执行的那一项，迟到或重复的信号忽略
+		if signal.done != current.ID {
+			return
+		}
+		if err := s.store.UpdateTaskQueueItem(ctx, current.ID, map[string]interface{}{
+			"status":      string(QueueItemCompleted),
+			"finished_at": now,
+		}); err != nil {
+			slog.Warn("task queue service: complete item failed", "item_id", current.ID, "error", err)
+			return
+		}
+		if err := s.dispatchNextLocked(ctx, deviceID, sessionName); err != nil {
+			slog.Warn("task queue service: dispatch next failed", "task_id", sessionTaskID(deviceID, sessionName), "error", err)
+		}
+	case signal.event.Kind == TaskEventKindError:
+		if err := s.store.UpdateTaskQueueItem(ctx, current.ID, map[string]interface{}{
+			"status":      string(QueueItemFailed),
+			"finished_at": now,
+		}); err != nil {
+			slog.Warn("task queue service: fail item failed", "item_id", current.ID, "error", err)
+		}
+		s.pauseLocked(ctx, deviceID, sessionName, "Task failed: "+signal.event.Summary)
+	case signal.event.Kind == TaskEventKindNeedsInput:
+		s.pauseLocked(ctx, deviceID, sessionName, "Task needs input: "+signal.event.Summary)
+	}
+}
+
+func (s *TaskQueueService) dispatchNextLocked(ctx context.Context, deviceID, sessionName string) error {
+	state, err := s.store.GetTaskQueue(ctx, deviceID, sessionName)
+	if err != nil {
+		return err
+	}
+	if state != nil && state.Paused {
+		return nil
+	}
+
+	items, err := s.store.ListTaskQueueItems(ctx, deviceID, sessionName, []string{string(QueueItemQueued), string(QueueItemDispatched)})
+	if err != nil {
+		return err
+	}
+	var next *db.TaskQueueItem
+	for i := range items {
+		if items[i].Status == string(QueueItemDispatched) {
+			return nil
+		}
+		if next == nil {
+			next = &items[i]
+		}
+	}
+	if next == nil {
+		return nil
+	}
+
+	message, _ := json.Marshal(map[string]interface{}{
+		"type": "submit_prompt",
+		"payload": map[string]interface{}{
+			"prompt":        next.Prompt,
+			"queue_item_id": next.ID,
+		},
+	})
+	if s.sender == nil || !s.sender.SendToAgents(deviceID, sessionName, message) {
+		s.pauseLocked(ctx, deviceID, sessionName, "Agent is not connected")
+		return nil
+	}
+
+	fields := map[string]interface{}{
+		"status":        string(QueueItemDispatched),
+		"dispatched_at": s.now().UTC().Format(time.RFC3339),
+	}
+	if s.tasks != nil {
+		title := next.Title
+		if title == "" {
+			title = summarizePrompt(next.Prompt)
+		}
+		task, err := s.tasks.StartTask(ctx, next.UserID, deviceID, sessionName, title, next.Prompt)
+		if err != nil && !errors.Is(err, ErrTaskRecordsUnavailable) {
+			slog.Warn("task queue service: start task failed", "item_id", next.ID, "error", err)
+		}
+		if task != nil {
+			fields["task_id"] = task.ID
+		}
+	}
+	return s.store.UpdateTaskQueueItem(ctx, next.ID, fields)
+}
+
+func (s *TaskQueueService) pauseLocked(ctx context.Context, deviceID, sessionName, reason string) {
+	if err := s.store.SaveTaskQueue(ctx, &db.TaskQueue{
+		DeviceID:    deviceID,
+		SessionName: sessionName,
+		Paused:      true,
+		PauseReason: reason,
+		UpdatedAt:   s.now().UTC().Format(time.RFC3339),
+	}); err != nil {
+		slog.Warn("task queue service: pause failed", "task_id", sessionTaskID(deviceID, sessionName), "error", err)
+	}
+}
+
+func summarizePrompt(prompt string) string {
+	line := strings.TrimSpace(strings.SplitN(strings.TrimSpace(prompt), "\n", 2)[0])
+	if len([]rune(line)) > 60 {
+		return string([]rune(line)[:60]) + "…"
+	}
+	return line
+}
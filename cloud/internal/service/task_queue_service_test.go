@@ -0,0 +1,356 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mobile-coder/cloud/internal/db"
+)
+
+type fakeTaskQueueStore struct {
+	mu     sync.Mutex
+	items  map[int64]*db.TaskQueueItem
+	queues map[string]*db.TaskQueue
+	nextID int64
+}
+
+func newFakeTaskQueueStore() *fakeTaskQueueStore {
+	return &fakeTaskQueueStore{
+		items:  make(map[int64]*db.TaskQueueItem),
+		queues: make(map[string]*db.TaskQueue),
+	}
+}
+
+func (f *fakeTaskQueueStore) CreateTaskQueueItem(ctx context.Context, item *db.TaskQueueItem) (*db.TaskQueueItem, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	created := *item
+	created.ID = f.nextID
+	f.items[created.ID] = &created
+	result := created
+	return &result, nil
+}
+
+func (f *fakeTaskQueueStore) GetTaskQueueItem(ctx context.Context, itemID int64) (*db.TaskQueueItem, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	item, ok := f.items[itemID]
+	if !ok {
+		return nil, nil
+	}
+	result := *item
+	return &result, nil
+}
+
+func (f *fakeTaskQueueStore) ListTaskQueueItems(ctx context.Context, deviceID, sessionName string, statuses []string) ([]db.TaskQueueItem, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var items []db.TaskQueueItem
+	for _, item := range f.items {
+		if item.DeviceID != deviceID || item.SessionName != sessionName {
+			continue
+		}
+		if len(statuses) > 0 && !containsString(statuses, item.Status) {
+			continue
+		}
+		items = append(items, *item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Position != items[j].Position {
+			return items[i].Position < items[j].Position
+		}
+		return items[i].ID < items[j].ID
+	})
+	return items, nil
+}
+
+func (f *fakeTaskQueueStore) UpdateTaskQueueItem(ctx context.Context, itemID int64, fields map[string]interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	item := f.items[itemID]
+	if item == nil {
+		return nil
+	}
+	for key, value := range fields {
+		str, _ := value.(string)
+		switch key {
+		case "status":
+			item.Status = str
+		case "position":
+			item.Position, _ = value.(int)
+		case "task_id":
+			item.TaskID = str
+		case "dispatched_at":
+			item.DispatchedAt = str
+		case "finished_at":
+			item.FinishedAt = str
+		}
+	}
+	return nil
+}
+
+func (f *fakeTaskQueueStore) GetTaskQueue(ctx context.Context, deviceID, sessionName string) (*db.TaskQueue, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	queue, ok := f.queues[sessionTaskID(deviceID, sessionName)]
+	if !ok {
+		return nil, nil
+	}
+	result := *queue
+	return &result, nil
+}
+
+func (f *fakeTaskQueueStore) SaveTaskQueue(ctx context.Context, queue *db.TaskQueue) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	saved := *queue
+	f.queues[sessionTaskID(queue.DeviceID, queue.SessionName)] = &saved
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+type recordingAgentSender struct {
+	connected bool
+	prompts   []string
+}
+
+func (r *recordingAgentSender) SendToAgents(deviceID string, sessionName string, message []byte) bool {
+	if !r.connected {
+		return false
+	}
+	var msg struct {
+		Type    string `json:"type"`
+		Payload struct {
+			Prompt string `json:"prompt"`
+		} `json:"payload"`
+	}
+	json.Unmarshal(message, &msg)
+	if msg.Type == "submit_prompt" {
+		r.prompts = append(r.prompts, msg.Payload.Prompt)
+	}
+	return true
+}
+
+type recordingTaskStarter struct {
+	titles []string
+}
+
+func (r *recordingTaskStarter) StartTask(ctx context.Context, userID int64, deviceID, sessionName, title, goal string) (*db.Task, error) {
+	r.titles = append(r.titles, title)
+	return &db.Task{ID: "task-" + title, UserID: userID, DeviceID: deviceID, SessionName: sessionName, Title: title, Goal: goal}, nil
+}
+
+func newTaskQueueServiceForTest(store *fakeTaskQueueStore, sender *recordingAgentSender, starter *recordingTaskStarter) *TaskQueueService {
+	service := NewTaskQueueService(nil, sender, starter)
+	service.store = store
+	service.now = func() time.Time {
+		return time.Date(2026, 4, 14, 10, 0, 0, 0, time.UTC)
+	}
+	return service
+}
+
+// applyQueueSignals applies the pending signals like Run does.
+func applyQueueSignals(service *TaskQueueService) {
+	for {
+		select {
+		case signal := <-service.signals:
+			service.applySignal(context.Background(), signal)
+		default:
+			return
+		}
+	}
+}
+
+func TestTaskQueueDispatchesNextPromptOnCompletion(t *testing.T) {
+	store := newFakeTaskQueueStore()
+	sender := &recordingAgentSender{connected: true}
+	starter := &recordingTaskStarter{}
+	service := newTaskQueueServiceForTest(store, sender, starter)
+
+	first, err := service.Enqueue(context.Background(), 7, "dev-1", "feature", "First", "write the parser")
+	if err != nil {
+		t.Fatalf("Enqueue first: %v", err)
+	}
+	if first.Status != string(QueueItemDispatched) || first.TaskID != "task-First" {
+		t.Fatalf("first = %+v, want dispatched with task", first)
+	}
+	second, err := service.Enqueue(context.Background(), 7, "dev-1", "feature", "", "add tests for the parser")
+	if err != nil {
+		t.Fatalf("Enqueue second: %v", err)
+	}
+	if second.Status != string(QueueItemQueued) {
+		t.Fatalf("second.Status = %q, want queued while first runs", second.Status)
+	}
+	if len(sender.prompts) != 1 {
+		t.Fatalf("prompts = %v, want only the first prompt sent", sender.prompts)
+	}
+
+	// Output that merely looks finished does not advance the queue.
+	service.HandleTaskEvent(context.Background(), "dev-1", "feature", TaskEvent{Kind: TaskEventKindCompleted, Summary: "Task completed"})
+	applyQueueSignals(service)
+	if store.items[first.ID].Status != string(QueueItemDispatched) {
+		t.Fatalf("first status = %q, want dispatched until the agent reports it done", store.items[first.ID].Status)
+	}
+
+	// A late signal for another item is ignored.
+	service.HandlePromptDone(context.Background(), "dev-1", "feature", second.ID)
+	applyQueueSignals(service)
+	if store.items[second.ID].Status != string(QueueItemQueued) {
+		t.Fatalf("second status = %q, want queued after a stray signal", store.items[second.ID].Status)
+	}
+
+	service.HandlePromptDone(context.Background(), "dev-1", "feature", first.ID)
+	applyQueueSignals(service)
+
+	if store.items[first.ID].Status != string(QueueItemCompleted) {
+		t.Fatalf("first status = %q, want completed", store.items[first.ID].Status)
+	}
+	if store.items[second.ID].Status != string(QueueItemDispatched) {
+		t.Fatalf("second status = %q, want dispatched", store.items[second.ID].Status)
+	}
+	if len(sender.prompts) != 2 || sender.prompts[1] != "add tests for the parser" {
+		t.Fatalf("prompts = %v, want second prompt sent", sender.prompts)
+	}
+	if starter.titles[1] != "add tests for the parser" {
+		t.Fatalf("second task title = %q, want summarized prompt", starter.titles[1])
+	}
+}
+
+func TestTaskQueuePausesOnErrorUntilResumed(t *testing.T) {
+	store := newFakeTaskQueueStore()
+	sender := &recordingAgentSender{connected: true}
+	service := newTaskQueueServiceForTest(store, sender, &recordingTaskStarter{})
+
+	first, _ := service.Enqueue(context.Background(), 7, "dev-1", "feature", "First", "migrate the schema")
+	second, _ := service.Enqueue(context.Background(), 7, "dev-1", "feature", "Second", "backfill data")
+
+	service.HandleTaskEvent(context.Background(), "dev-1", "feature", TaskEvent{Kind: TaskEventKindError, Summary: "panic: nil map"})
+	applyQueueSignals(service)
+
+	if store.items[first.ID].Status != string(QueueItemFailed) {
+		t.Fatalf("first status = %q, want failed", store.items[first.ID].Status)
+	}
+	queue, err := service.GetQueue(context.Background(), "dev-1", "feature")
+	if err != nil {
+		t.Fatalf("GetQueue: %v", err)
+	}
+	if !queue.Paused || queue.PauseReason != "Task failed: panic: nil map" {
+		t.Fatalf("queue = %+v, want paused with failure reason", queue)
+	}
+	if store.items[second.ID].Status != string(QueueItemQueued) {
+		t.Fatalf("second status = %q, want still queued while paused", store.items[second.ID].Status)
+	}
+
+	if err := service.Resume(context.Background(), "dev-1", "feature"); err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	if store.items[second.ID].Status != string(QueueItemDispatched) {
+		t.Fatalf("second status = %q, want dispatched after resume", store.items[second.ID].Status)
+	}
+}
+
+func TestTaskQueuePausesWhenTaskNeedsInput(t *testing.T) {
+	store := newFakeTaskQueueStore()
+	service := newTaskQueueServiceForTest(store, &recordingAgentSender{connected: true}, &recordingTaskStarter{})
+
+	first, _ := service.Enqueue(context.Background(), 7, "dev-1", "feature", "First", "deploy")
+	service.HandleTaskEvent(context.Background(), "dev-1", "feature", TaskEvent{Kind: TaskEventKindNeedsInput, Summary: "Continue? (y/n)"})
+	applyQueueSignals(service)
+
+	if store.items[first.ID].Status != string(QueueItemDispatched) {
+		t.Fatalf("first status = %q, want still dispatched", store.items[first.ID].Status)
+	}
+	queue, _ := service.GetQueue(context.Background(), "dev-1", "feature")
+	if !queue.Paused {
+		t.Fatal("queue should pause while the task waits for input")
+	}
+}
+
+func TestTaskQueueReorderAndCancel(t *testing.T) {
+	store := newFakeTaskQueueStore()
+	service := newTaskQueueServiceForTest(store, &recordingAgentSender{connected: true}, &recordingTaskStarter{})
+
+	service.Enqueue(context.Background(), 7, "dev-1", "feature", "Running", "one")
+	b, _ := service.Enqueue(context.Background(), 7, "dev-1", "feature", "B", "two")
+	c, _ := service.Enqueue(context.Background(), 7, "dev-1", "feature", "C", "three")
+
+	if err := service.Reorder(context.Background(), "dev-1", "feature", []int64{b.ID}); err != ErrInvalidQueueOrder {
+		t.Fatalf("err = %v, want ErrInvalidQueueOrder for partial order", err)
+	}
+	if err := service.Reorder(context.Background(), "dev-1", "feature", []int64{c.ID, b.ID}); err != nil {
+		t.Fatalf("Reorder: %v", err)
+	}
+	queue, _ := service.GetQueue(context.Background(), "dev-1", "feature")
+	if len(queue.Items) != 3 || queue.Items[1].ID != c.ID || queue.Items[2].ID != b.ID {
+		t.Fatalf("items = %+v, want running, C, B", queue.Items)
+	}
+
+	if _, err := service.Cancel(context.Background(), 8, c.ID); err != ErrQueueItemNotFound {
+		t.Fatalf("err = %v, want ErrQueueItemNotFound for other user", err)
+	}
+	if _, err := service.Cancel(context.Background(), 7, c.ID); err != nil {
+		t.Fatalf("Cancel: %v", err)
+	}
+	if _, err := service.Cancel(context.Background(), 7, c.ID); err != ErrQueueItemNotCancellable {
+		t.Fatalf("err = %v, want ErrQueueItemNotCancellable for cancelled item", err)
+	}
+	queue, _ = service.GetQueue(context.Background(), "dev-1", "feature")
+	if len(queue.Items) != 2 {
+		t.Fatalf("items = %+v, want cancelled item removed", queue.Items)
+	}
+}
+
+func TestTaskQueuePausesWhenAgentIsOffline(t *testing.T) {
+	store := newFakeTaskQueueStore()
+	starter := &recordingTaskStarter{}
+	service := newTaskQueueServiceForTest(store, &recordingAgentSender{}, starter)
+
+	item, err := service.Enqueue(context.Background(), 7, "dev-1", "feature", "First", "write docs")
+	if err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	if item.Status != string(QueueItemQueued) {
+		t.Fatalf("item.Status = %q, want queued", item.Status)
+	}
+	if len(starter.titles) != 0 {
+		t.Fatalf("started tasks = %v, want none without an agent", starter.titles)
+	}
+	queue, _ := service.GetQueue(context.Background(), "dev-1", "feature")
+	if !queue.Paused || queue.PauseReason != "Agent is not connected" {
+		t.Fatalf("queue = %+v, want paused for offline agent", queue)
+	}
+}
+
+func TestTaskQueueRunAppliesSignalsInTheBackground(t *testing.T) {
+	store := newFakeTaskQueueStore()
+	service := newTaskQueueServiceForTest(store, &recordingAgentSender{connected: true}, &recordingTaskStarter{})
+	go service.Run()
+
+	first, _ := service.Enqueue(context.Background(), 7, "dev-1", "feature", "First", "one")
+	service.HandlePromptDone(context.Background(), "dev-1", "feature", first.ID)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		item, _ := store.GetTaskQueueItem(context.Background(), first.ID)
+		if item.Status == string(QueueItemCompleted) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("first status = %q, want completed by Run", item.Status)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,315 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/mobile-coder/cloud/internal/db"
+)
+
+var (
+	ErrTaskRecordsUnavailable = errors.New("task records unavailable")
+	ErrInvalidTaskUpdate      = errors.New("invalid task update")
+)
+
+type taskRecordStore interface {
+	CreateTask(context.Context, *db.Task) (*db.Task, error)
+	GetTaskByID(ctx context.Context, taskID string) (*db.Task, error)
+	ListTasksByUser(ctx context.Context, userID int64) ([]db.Task, error)
+	CountTasks(ctx context.Context, state string) (int, error)
+	UpdateTask(ctx context.Context, taskID string, fields map[string]interface{}) error
+	LinkTaskSession(ctx context.Context, taskID, deviceID, sessionName string) error
+	GetLatestTaskSession(ctx context.Context, deviceID, sessionName string) (*db.TaskSession, error)
+	ListTaskSessions(ctx context.Context, taskID string) ([]db.TaskSession, error)
+}
+
+// TaskUpdate carries user-editable task fields; nil fields are left unchanged.
+type TaskUpdate struct {
+	Title *string
+	Goal  *string
+}
+
+// EnableTaskRecords makes the service persist tasks as first-class records
+// instead of deriving a new task from every session row.
+func (s *TaskService) EnableTaskRecords(database *db.SupabaseDB) {
+	if database == nil {
+		return
+	}
+	s.records = database
+}
+
+// ResolveTaskID returns the ID of the task currently running in a session.
+// It falls back to the session-derived ID when records are disabled.
+func (s *TaskService) ResolveTaskID(ctx context.Context, deviceID, sessionName string) string {
+	key := sessionTaskID(deviceID, sessionName)
+	if s.records == nil {
+		return key
+	}
+
+	s.mu.Lock()
+	taskID, ok := s.sessionTasks[key]
+	s.mu.Unlock()
+	if ok {
+		return taskID
+	}
+
+	link, err := s.records.GetLatestTaskSession(ctx, deviceID, sessionName)
+	if err != nil || link == nil {
+		return key
+	}
+	s.rememberSessionTask(key, link.TaskID)
+	return link.TaskID
+}
+
+// StartTask creates a new task record for a session. Later output of the
+// session is attributed to the new task. The task queue and the scheduler
+// call it when they start work in a session.
+func (s *TaskService) StartTask(ctx context.Context, userID int64, deviceID, sessionName, title, goal string) (*db.Task, error) {
+	if s.records == nil {
+		return nil, ErrTaskRecordsUnavailable
+	}
+
+	record := &db.Task{
+		ID:          "task-" + generateCode(16),
+		UserID:      userID,
+		DeviceID:    deviceID,
+		SessionName: sessionName,
+		Title:       strings.TrimSpace(title),
+		TitleEdited: strings.TrimSpace(title) != "",
+		Goal:        goal,
+		State:       string(TaskStateRunning),
+	}
+	if record.Title == "" {
+		record.Title = sessionName
+	}
+	return s.createTaskRecord(ctx, record)
+}
+
+// UpdateTaskForUser edits the title or goal of a task owned by the user.
+func (s *TaskService) UpdateTaskForUser(ctx context.Context, userID int64, taskID string, update TaskUpdate) (*Task, error) {
+	if s.records == nil {
+		return nil, ErrTaskRecordsUnavailable
+	}
+
+	record, err := s.records.GetTaskByID(ctx, taskID)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		// 会话还没有产生过事件，先为它建好任务记录
+		if err := s.RefreshTasksForUser(ctx, userID); err != nil {
+			return nil, err
+		}
+		if record, err = s.records.GetTaskByID(ctx, taskID); err != nil {
+			return nil, err
+		}
+	}
+	if record == nil || record.UserID != userID {
+		return nil, ErrTaskNotFound
+	}
+
+	fields := map[string]interface{}{}
+	if update.Title != nil {
+		title := strings.TrimSpace(*update.Title)
+		if title == "" {
+			return nil, ErrInvalidTaskUpdate
+		}
+		fields["title"] = title
+		fields["title_edited"] = true
+	}
+	if update.Goal != nil {
+		fields["goal"] = *update.Goal
+	}
+	if len(fields) == 0 {
+		return nil, ErrInvalidTaskUpdate
+	}
+	fields["updated_at"] = s.now().UTC().Format(time.RFC3339)
+
+	if err := s.records.UpdateTask(ctx, taskID, fields); err != nil {
+		return nil, err
+	}
+	return s.GetTaskForUser(ctx, userID, taskID)
+}
+
+func (s *TaskService) loadTaskRecords(ctx context.Context, userID int64) (map[string]db.Task, error) {
+	if s.records == nil {
+		return nil, nil
+	}
+
+	records, err := s.records.ListTasksByUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[string]db.Task, len(records))
+	for _, record := range records {
+		byID[record.ID] = record
+	}
+	return byID, nil
+}
+
+// findTaskRecord returns the user's current task record of a session, or
+// nil when it has none yet. It never writes.
+func (s *TaskService) findTaskRecord(ctx context.Context, userID int64, records map[string]db.Task, session Session) (*db.Task, error) {
+	key := sessionTaskID(session.DeviceID, session.SessionName)
+
+	taskID := s.ResolveTaskID(ctx, session.DeviceID, session.SessionName)
+	if record, ok := records[taskID]; ok {
+		return &record, nil
+	}
+	if taskID != key {
+		record, err := s.records.GetTaskByID(ctx, taskID)
+		if err != nil {
+			return nil, err
+		}
+		if record != nil && record.UserID == userID {
+			records[record.ID] = *record
+			return record, nil
+		}
+	}
+	if record, ok := records[key]; ok {
+		return &record, nil
+	}
+	return nil, nil
+}
+
+// taskRecordForSession finds the current task of a session, creating the
+// first one on demand. The first task reuses the session-derived ID so
+// timeline events and notifications recorded before reach it, unless that
+// ID already belongs to another user, e.g. after the device was rebound.
+func (s *TaskService) taskRecordForSession(ctx context.Context, userID int64, records map[string]db.Task, device Device, session Session) (*db.Task, error) {
+	record, err := s.findTaskRecord(ctx, userID, records, session)
+	if err != nil || record != nil {
+		return record, err
+	}
+
+	key := sessionTaskID(session.DeviceID, session.SessionName)
+	taskID := key
+	existing, err := s.records.GetTaskByID(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case existing == nil:
+	case existing.UserID == userID:
+		if err := s.records.LinkTaskSession(ctx, existing.ID, session.DeviceID, session.SessionName); err != nil {
+			return nil, err
+		}
+		s.rememberSessionTask(key, existing.ID)
+		records[existing.ID] = *existing
+		return existing, nil
+	default:
+		// 设备换了主人，旧任务不能交给新用户
+		taskID = "task-" + generateCode(16)
+	}
+
+	created, err := s.createTaskRecord(ctx, &db.Task{
+		ID:          taskID,
+		UserID:      userID,
+		DeviceID:    session.DeviceID,
+		SessionName: session.SessionName,
+		Title:       deriveTaskTitle(device, session),
+		State:       string(deriveTaskState(device, session)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	records[created.ID] = *created
+	return created, nil
+}
+
+func (s *TaskService) createTaskRecord(ctx context.Context, record *db.Task) (*db.Task, error) {
+	created, err := s.records.CreateTask(ctx, record)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.records.LinkTaskSession(ctx, created.ID, created.DeviceID, created.SessionName); err != nil {
+		return nil, err
+	}
+	s.rememberSessionTask(sessionTaskID(created.DeviceID, created.SessionName), created.ID)
+	return created, nil
+}
+
+func (s *TaskService) rememberSessionTask(sessionKey, taskID string) {
+	s.mu.Lock()
+	s.sessionTasks[sessionKey] = taskID
+	s.mu.Unlock()
+}
+
+func applyTaskRecord(task Task, record *db.Task) Task {
+	task.ID = record.ID
+	if record.TitleEdited && record.Title != "" {
+		task.Title = record.Title
+	}
+	task.Goal = record.Goal
+	task.CreatedAt = record.CreatedAt
+	task.FinishedAt = record.FinishedAt
+	task.FinalState = TaskState(record.FinalState)
+	return task
+}
+
+// syncTaskRecord writes the derived state back to the record and stamps
+// finished_at/final_state when the task completes.
+func (s *TaskService) syncTaskRecord(ctx context.Context, record *db.Task, task *Task) {
+	if record == nil || record.State == string(task.State) {
+		return
+	}
+
+	now := s.now().UTC().Format(time.RFC3339)
+	fields := map[string]interface{}{
+		"state":      string(task.State),
+		"updated_at": now,
+	}
+	switch {
+	case task.State == TaskStateCompleted && record.FinishedAt == "":
+		fields["finished_at"] = now
+		fields["final_state"] = string(task.State)
+		task.FinishedAt = now
+		task.FinalState = task.State
+	case task.State != TaskStateCompleted && record.FinishedAt != "":
+		fields["finished_at"] = nil
+		fields["final_state"] = nil
+		task.FinishedAt = ""
+		task.FinalState = ""
+	}
+
+	if err := s.records.UpdateTask(ctx, record.ID, fields); err != nil {
+		slog.Warn("task service: sync task failed", "task_id", record.ID, "error", err)
+	}
+}
+
+func (s *TaskService) attachTaskSessions(ctx context.Context, task *Task) {
+	if s.records == nil {
+		return
+	}
+
+	links, err := s.records.ListTaskSessions(ctx, task.ID)
+	if err != nil {
+		slog.Warn("task service: list sessions failed", "task_id", task.ID, "error", err)
+		return
+	}
+	for _, link := range links {
+		task.Sessions = append(task.Sessions, link.SessionName)
+	}
+}
+
+func taskFromRecord(record *db.Task) Task {
+	return Task{
+		ID:             record.ID,
+		Title:          record.Title,
+		DeviceID:       record.DeviceID,
+		SessionName:    record.SessionName,
+		Tool:           deriveTaskTool(Session{SessionName: record.SessionName}),
+		State:          TaskState(record.State),
+		Summary:        "Task finished",
+		StateReason:    "Session moved on to a newer task",
+		LastActivityAt: record.UpdatedAt,
+		Goal:           record.Goal,
+		CreatedAt:      record.CreatedAt,
+		FinishedAt:     record.FinishedAt,
+		FinalState:     TaskState(record.FinalState),
+	}
+}
@@ -0,0 +1,424 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mobile-coder/cloud/internal/db"
+)
+
+type fakeTaskRecordStore struct {
+	mu      sync.Mutex
+	tasks   map[string]*db.Task
+	links   []db.TaskSession
+	updates []taskRecordUpdate
+	creates int
+}
+
+type taskRecordUpdate struct {
+	taskID string
+	fields map[string]interface{}
+}
+
+func newFakeTaskRecordStore() *fakeTaskRecordStore {
+	return &fakeTaskRecordStore{tasks: make(map[string]*db.Task)}
+}
+
+func (f *fakeTaskRecordStore) CreateTask(ctx context.Context, task *db.Task) (*db.Task, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.creates++
+	created := *task
+	created.CreatedAt = "2026-04-13T09:00:00Z"
+	f.tasks[created.ID] = &created
+	result := created
+	return &result, nil
+}
+
+func (f *fakeTaskRecordStore) GetTaskByID(ctx context.Context, taskID string) (*db.Task, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	task, ok := f.tasks[taskID]
+	if !ok {
+		return nil, nil
+	}
+	result := *task
+	return &result, nil
+}
+
+func (f *fakeTaskRecordStore) ListTasksByUser(ctx context.Context, userID int64) ([]db.Task, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var tasks []db.Task
+	for _, task := range f.tasks {
+		if task.UserID == userID {
+			tasks = append(tasks, *task)
+		}
+	}
+	return tasks, nil
+}
+
+func (f *fakeTaskRecordStore) CountTasks(ctx context.Context, state string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	count := 0
+	for _, task := range f.tasks {
+		if task.State == state {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (f *fakeTaskRecordStore) UpdateTask(ctx context.Context, taskID string, fields map[string]interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.updates = append(f.updates, taskRecordUpdate{taskID: taskID, fields: fields})
+	task := f.tasks[taskID]
+	if task == nil {
+		return nil
+	}
+	for key, value := range fields {
+		str, _ := value.(string)
+		switch key {
+		case "title":
+			task.Title = str
+		case "title_edited":
+			task.TitleEdited, _ = value.(bool)
+		case "goal":
+			task.Goal = str
+		case "state":
+			task.State = str
+		case "final_state":
+			task.FinalState = str
+		case "finished_at":
+			task.FinishedAt = str
+		case "updated_at":
+			task.UpdatedAt = str
+		case "workspace":
+			task.Workspace, _ = json.Marshal(value)
+		}
+	}
+	return nil
+}
+
+func (f *fakeTaskRecordStore) LinkTaskSession(ctx context.Context, taskID, deviceID, sessionName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.links = append(f.links, db.TaskSession{
+		ID:          int64(len(f.links) + 1),
+		TaskID:      taskID,
+		DeviceID:    deviceID,
+		SessionName: sessionName,
+	})
+	return nil
+}
+
+func (f *fakeTaskRecordStore) GetLatestTaskSession(ctx context.Context, deviceID, sessionName string) (*db.TaskSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := len(f.links) - 1; i >= 0; i-- {
+		if f.links[i].DeviceID == deviceID && f.links[i].SessionName == sessionName {
+			link := f.links[i]
+			return &link, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeTaskRecordStore) ListTaskSessions(ctx context.Context, taskID string) ([]db.TaskSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var links []db.TaskSession
+	for _, link := range f.links {
+		if link.TaskID == taskID {
+			links = append(links, link)
+		}
+	}
+	return links, nil
+}
+
+func newTaskServiceWithRecords(source *fakeTaskDeviceSource, store *fakeTaskRecordStore) *TaskService {
+	service := NewTaskService(source, &fakeTaskEventSource{})
+	service.records = store
+	service.now = func() time.Time {
+		return time.Date(2026, 4, 13, 9, 30, 0, 0, time.UTC)
+	}
+	return service
+}
+
+func singleSessionSource(status string) *fakeTaskDeviceSource {
+	return &fakeTaskDeviceSource{
+		devicesByUser: map[int64][]Device{
+			7: {{DeviceID: "dev-1", DeviceName: "MacBook", Status: "online"}},
+		},
+		sessionsByDevice: map[string][]Session{
+			"dev-1": {{ID: 10, DeviceID: "dev-1", SessionName: "feature", ProjectPath: "/Users/me/repo-a", Status: status}},
+		},
+	}
+}
+
+func TestTaskServiceCreatesTaskRecordOncePerSession(t *testing.T) {
+	store := newFakeTaskRecordStore()
+	service := newTaskServiceWithRecords(singleSessionSource("active"), store)
+
+	for i := 0; i < 2; i++ {
+		if err := service.RefreshTasksForUser(context.Background(), 7); err != nil {
+			t.Fatalf("RefreshTasksForUser: %v", err)
+		}
+		tasks, err := service.ListTasksForUser(context.Background(), 7)
+		if err != nil {
+			t.Fatalf("ListTasksForUser: %v", err)
+		}
+		if len(tasks) != 1 || tasks[0].ID != "dev-1:feature" {
+			t.Fatalf("tasks = %+v, want one task with session-derived ID", tasks)
+		}
+		if tasks[0].CreatedAt == "" {
+			t.Fatal("tasks[0].CreatedAt should come from the record")
+		}
+	}
+
+	if store.creates != 1 {
+		t.Fatalf("creates = %d, want 1", store.creates)
+	}
+	if len(store.links) != 1 {
+		t.Fatalf("links = %d, want 1", len(store.links))
+	}
+}
+
+func TestTaskServiceCountsTasksByStoredState(t *testing.T) {
+	store := newFakeTaskRecordStore()
+	store.tasks["other"] = &db.Task{ID: "other", UserID: 9, State: string(TaskStateCompleted)}
+	service := newTaskServiceWithRecords(singleSessionSource("active"), store)
+
+	if err := service.RefreshTasksForUser(context.Background(), 7); err != nil {
+		t.Fatalf("RefreshTasksForUser: %v", err)
+	}
+	counts, err := service.CountTasksByState(context.Background())
+	if err != nil {
+		t.Fatalf("CountTasksByState: %v", err)
+	}
+	if counts[TaskStateRunning] != 1 || counts[TaskStateCompleted] != 1 || counts[TaskStateWaiting] != 0 {
+		t.Fatalf("counts = %v, want one running and one completed", counts)
+	}
+
+	if _, err := NewTaskService(singleSessionSource("active")).CountTasksByState(context.Background()); !errors.Is(err, ErrTaskRecordsUnavailable) {
+		t.Fatalf("err = %v, want ErrTaskRecordsUnavailable", err)
+	}
+}
+
+func TestTaskServiceKeepsTaskAcrossSessionRestart(t *testing.T) {
+	store := newFakeTaskRecordStore()
+	source := singleSessionSource("active")
+	first := newTaskServiceWithRecords(source, store)
+	if err := first.RefreshTasksForUser(context.Background(), 7); err != nil {
+		t.Fatalf("RefreshTasksForUser: %v", err)
+	}
+
+	// A restarted server has an empty cache and must find the record again.
+	source.sessionsByDevice["dev-1"][0].ID = 11
+	restarted := newTaskServiceWithRecords(source, store)
+	if err := restarted.RefreshTasksForUser(context.Background(), 7); err != nil {
+		t.Fatalf("RefreshTasksForUser: %v", err)
+	}
+	tasks, err := restarted.ListTasksForUser(context.Background(), 7)
+	if err != nil {
+		t.Fatalf("ListTasksForUser: %v", err)
+	}
+	if len(tasks) != 1 || tasks[0].ID != "dev-1:feature" {
+		t.Fatalf("tasks = %+v, want the existing task", tasks)
+	}
+	if store.creates != 1 {
+		t.Fatalf("creates = %d, want 1", store.creates)
+	}
+}
+
+func TestTaskServiceUsesEditedTitleAndGoal(t *testing.T) {
+	store := newFakeTaskRecordStore()
+	service := newTaskServiceWithRecords(singleSessionSource("active"), store)
+	if _, err := service.ListTasksForUser(context.Background(), 7); err != nil {
+		t.Fatalf("ListTasksForUser: %v", err)
+	}
+
+	title := "Fix login flow"
+	goal := "Make OAuth redirect work on mobile"
+	task, err := service.UpdateTaskForUser(context.Background(), 7, "dev-1:feature", TaskUpdate{Title: &title, Goal: &goal})
+	if err != nil {
+		t.Fatalf("UpdateTaskForUser: %v", err)
+	}
+	if task.Title != title || task.Goal != goal {
+		t.Fatalf("task title/goal = %q/%q, want %q/%q", task.Title, task.Goal, title, goal)
+	}
+	if len(task.Sessions) != 1 || task.Sessions[0] != "feature" {
+		t.Fatalf("task.Sessions = %v, want [feature]", task.Sessions)
+	}
+
+	if _, err := service.UpdateTaskForUser(context.Background(), 8, "dev-1:feature", TaskUpdate{Title: &title}); err != ErrTaskNotFound {
+		t.Fatalf("err = %v, want ErrTaskNotFound for other user", err)
+	}
+	empty := " "
+	if _, err := service.UpdateTaskForUser(context.Background(), 7, "dev-1:feature", TaskUpdate{Title: &empty}); err != ErrInvalidTaskUpdate {
+		t.Fatalf("err = %v, want ErrInvalidTaskUpdate for blank title", err)
+	}
+}
+
+func TestTaskServiceStampsFinishedAtOnCompletion(t *testing.T) {
+	store := newFakeTaskRecordStore()
+	source := singleSessionSource("active")
+	service := newTaskServiceWithRecords(source, store)
+	if err := service.RefreshTasksForUser(context.Background(), 7); err != nil {
+		t.Fatalf("RefreshTasksForUser: %v", err)
+	}
+
+	source.sessionsByDevice["dev-1"][0].Status = "inactive"
+	if err := service.RefreshTasksForUser(context.Background(), 7); err != nil {
+		t.Fatalf("RefreshTasksForUser: %v", err)
+	}
+	tasks, err := service.ListTasksForUser(context.Background(), 7)
+	if err != nil {
+		t.Fatalf("ListTasksForUser: %v", err)
+	}
+	if tasks[0].FinishedAt != "2026-04-13T09:30:00Z" || tasks[0].FinalState != TaskStateCompleted {
+		t.Fatalf("finished_at/final_state = %q/%q, want stamped completion", tasks[0].FinishedAt, tasks[0].FinalState)
+	}
+
+	record := store.tasks["dev-1:feature"]
+	if record.State != string(TaskStateCompleted) || record.FinishedAt == "" || record.FinalState != string(TaskStateCompleted) {
+		t.Fatalf("record = %+v, want completed record", record)
+	}
+}
+
+func TestTaskServiceStartTaskAttributesSessionToNewTask(t *testing.T) {
+	store := newFakeTaskRecordStore()
+	service := newTaskServiceWithRecords(singleSessionSource("active"), store)
+	if err := service.RefreshTasksForUser(context.Background(), 7); err != nil {
+		t.Fatalf("RefreshTasksForUser: %v", err)
+	}
+
+	started, err := service.StartTask(context.Background(), 7, "dev-1", "feature", "Run tests", "go test ./...")
+	if err != nil {
+		t.Fatalf("StartTask: %v", err)
+	}
+	if got := service.ResolveTaskID(context.Background(), "dev-1", "feature"); got != started.ID {
+		t.Fatalf("ResolveTaskID = %q, want %q", got, started.ID)
+	}
+
+	tasks, err := service.ListTasksForUser(context.Background(), 7)
+	if err != nil {
+		t.Fatalf("ListTasksForUser: %v", err)
+	}
+	if len(tasks) != 1 || tasks[0].ID != started.ID || tasks[0].Title != "Run tests" {
+		t.Fatalf("tasks = %+v, want the started task", tasks)
+	}
+
+	previous, err := service.GetTaskForUser(context.Background(), 7, "dev-1:feature")
+	if err != nil {
+		t.Fatalf("GetTaskForUser previous: %v", err)
+	}
+	if previous.ID != "dev-1:feature" || previous.Summary != "Task finished" {
+		t.Fatalf("previous = %+v, want the earlier task record", previous)
+	}
+
+	current, err := service.GetTaskForUser(context.Background(), 7, started.ID)
+	if err != nil {
+		t.Fatalf("GetTaskForUser current: %v", err)
+	}
+	if current.Goal != "go test ./..." {
+		t.Fatalf("current.Goal = %q, want started goal", current.Goal)
+	}
+}
+
+func TestTaskServiceListingDoesNotWrite(t *testing.T) {
+	store := newFakeTaskRecordStore()
+	emitter := &fakeTaskNotificationEmitter{}
+	service := newTaskServiceWithRecords(singleSessionSource("inactive"), store)
+	service.notificationEmitter = emitter
+
+	tasks, err := service.ListTasksForUser(context.Background(), 7)
+	if err != nil {
+		t.Fatalf("ListTasksForUser: %v", err)
+	}
+	if len(tasks) != 1 || tasks[0].ID != "dev-1:feature" {
+		t.Fatalf("tasks = %+v, want the session-derived task", tasks)
+	}
+	if _, err := service.GetTaskForUser(context.Background(), 7, "dev-1:feature"); err != nil {
+		t.Fatalf("GetTaskForUser: %v", err)
+	}
+
+	if store.creates != 0 || len(store.links) != 0 || len(store.updates) != 0 {
+		t.Fatalf("store writes = %d creates, %d links, %d updates, want none", store.creates, len(store.links), len(store.updates))
+	}
+	if emitter.callCount() != 0 {
+		t.Fatalf("notifications = %d, want none", emitter.callCount())
+	}
+}
+
+func TestTaskServiceDoesNotReuseAnotherUsersTask(t *testing.T) {
+	store := newFakeTaskRecordStore()
+	store.tasks["dev-1:feature"] = &db.Task{ID: "dev-1:feature", UserID: 9, DeviceID: "dev-1", SessionName: "feature", Goal: "secret"}
+	service := newTaskServiceWithRecords(singleSessionSource("active"), store)
+
+	if err := service.RefreshTasksForUser(context.Background(), 7); err != nil {
+		t.Fatalf("RefreshTasksForUser: %v", err)
+	}
+	tasks, err := service.ListTasksForUser(context.Background(), 7)
+	if err != nil {
+		t.Fatalf("ListTasksForUser: %v", err)
+	}
+	if len(tasks) != 1 || tasks[0].ID == "dev-1:feature" || tasks[0].Goal != "" {
+		t.Fatalf("tasks = %+v, want a new task of user 7", tasks)
+	}
+	if store.tasks[tasks[0].ID].UserID != 7 {
+		t.Fatalf("record owner = %d, want 7", store.tasks[tasks[0].ID].UserID)
+	}
+	// The session-derived ID now leads to the user's own task.
+	task, err := service.GetTaskForUser(context.Background(), 7, "dev-1:feature")
+	if err != nil {
+		t.Fatalf("GetTaskForUser: %v", err)
+	}
+	if task.ID != tasks[0].ID || task.Goal != "" {
+		t.Fatalf("task = %+v, want the task of user 7", task)
+	}
+}
+
+func TestTaskServiceRefreshesTaskOnEvent(t *testing.T) {
+	store := newFakeTaskRecordStore()
+	devices := &fakeTaskDeviceLookup{
+		fakeTaskDeviceSource: singleSessionSource("active"),
+		devices: map[string]Device{
+			"dev-1": {UserID: 7, DeviceID: "dev-1", DeviceName: "MacBook", Status: "online"},
+		},
+	}
+	service := newTaskServiceWithRecords(devices.fakeTaskDeviceSource, store)
+	service.source = devices
+
+	service.HandleTaskEvent(context.Background(), "dev-1", "feature", TaskEvent{Summary: "started", Kind: TaskEventKindInfo})
+	record := store.tasks["dev-1:feature"]
+	if record == nil || record.UserID != 7 {
+		t.Fatalf("record = %+v, want a record of user 7", record)
+	}
+
+	devices.sessionsByDevice["dev-1"][0].Status = "inactive"
+	service.HandleTaskEvent(context.Background(), "dev-1", "feature", TaskEvent{Summary: "done", Kind: TaskEventKindInfo})
+	record = store.tasks["dev-1:feature"]
+	if record.State != string(TaskStateCompleted) || record.FinishedAt == "" {
+		t.Fatalf("record = %+v, want the completed state written back", record)
+	}
+}
+
+type fakeTaskDeviceLookup struct {
+	*fakeTaskDeviceSource
+	devices map[string]Device
+}
+
+func (f *fakeTaskDeviceLookup) GetDeviceByDeviceID(ctx context.Context, deviceID string) (*Device, error) {
+	device, ok := f.devices[deviceID]
+	if !ok {
+		return nil, nil
+	}
+	return &device, nil
+}
@@ -1,8 +1,10 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -22,22 +24,29 @@ const (
 )
 
 type Task struct {
-	ID             string      `json:"id"`
-	Title          string      `json:"title"`
-	DeviceID       string      `json:"device_id"`
-	DeviceName     string      `json:"device_name"`
-	SessionName    string      `json:"session_name"`
-	ProjectPath    string      `json:"project_path"`
-	Tool           string      `json:"tool"`
-	State          TaskState   `json:"state"`
-	Summary        string      `json:"summary"`
-	StateReason    string      `json:"state_reason"`
-	RecentEvent    string      `json:"recent_event"`
-	LastActivityAt string      `json:"last_activity_at"`
-	Timeline       []TaskEvent `json:"timeline,omitempty"`
+	ID             string           `json:"id"`
+	Title          string           `json:"title"`
+	DeviceID       string           `json:"device_id"`
+	DeviceName     string           `json:"device_name"`
+	SessionName    string           `json:"session_name"`
+	ProjectPath    string           `json:"project_path"`
+	Tool           string           `json:"tool"`
+	State          TaskState        `json:"state"`
+	Summary        string           `json:"summary"`
+	StateReason    string           `json:"state_reason"`
+	RecentEvent    string           `json:"recent_event"`
+	LastActivityAt string           `json:"last_activity_at"`
+	Timeline       []TaskEvent      `json:"timeline,omitempty"`
+	Goal           string           `json:"goal,omitempty"`
+	CreatedAt      string           `json:"created_at,omitempty"`
+	FinishedAt     string           `json:"finished_at,omitempty"`
+	FinalState     TaskState        `json:"final_state,omitempty"`
+	Sessions       []string         `json:"sessions,omitempty"`
+	Workspace      *WorkspaceStatus `json:"workspace,omitempty"`
 }
 
 type TaskEvent struct {
+	ID        int64         `json:"id,omitempty"`
 	Summary   string        `json:"summary"`
 	Timestamp string        `json:"timestamp"`
 	Kind      TaskEventKind `json:"kind"`
@@ -55,34 +64,58 @@ const (
 )
 
 type taskDeviceSource interface {
-	GetUserDevices(userID int64) ([]Device, error)
-	GetDeviceSessions(deviceID string) ([]Session, error)
+	GetUserDevices(ctx context.Context, userID int64) ([]Device, error)
+	GetDeviceSessions(ctx context.Context, deviceID string) ([]Session, error)
+}
+
+// taskDeviceLookup lets the event and presence handlers find the owner of
+// a device.
+type taskDeviceLookup interface {
+	GetDeviceByDeviceID(ctx context.Context, deviceID string) (*Device, error)
 }
 
 type taskEventSource interface {
-	GetRecentEvents(taskID string) []TaskEvent
+	GetRecentEvents(ctx context.Context, taskID string) []TaskEvent
+}
+
+// taskEventBatchSource is implemented by sources that can load the recent
+// events of many tasks in one call.
+type taskEventBatchSource interface {
+	GetRecentEventsForTasks(ctx context.Context, taskIDs []string) map[string][]TaskEvent
+}
+
+type taskTimelineSource interface {
+	ListTaskEvents(ctx context.Context, taskID string, before *time.Time, beforeID int64, limit int) ([]TaskEvent, error)
 }
 
 type taskNotificationEmitter interface {
-	CreateNotification(userID int64, eventType NotificationEventType, taskID, deviceID, sessionName, title, body string) (*db.Notification, error)
+	CreateNotification(ctx context.Context, userID int64, eventType NotificationEventType, taskID, deviceID, sessionName, title, body string) (*db.Notification, error)
 }
 
 type TaskService struct {
 	source              taskDeviceSource
 	eventSource         taskEventSource
 	notificationEmitter taskNotificationEmitter
+	records             taskRecordStore
 	now                 func() time.Time
 
 	mu                    sync.Mutex
 	lastNotificationState map[string]string
+	sessionTasks          map[string]string
+	workspaces            map[string]workspaceEntry // by task ID, while the session is online
 }
 
-var ErrTaskNotFound = errors.New("task not found")
+var (
+	ErrTaskNotFound            = errors.New("task not found")
+	ErrTaskTimelineUnavailable = errors.New("task timeline unavailable")
+)
 
 func NewTaskService(source taskDeviceSource, eventSource ...taskEventSource) *TaskService {
 	service := &TaskService{source: source}
 	service.now = time.Now
 	service.lastNotificationState = make(map[string]string)
+	service.sessionTasks = make(map[string]string)
+	service.workspaces = make(map[string]workspaceEntry)
 	if len(eventSource) > 0 {
 		service.eventSource = eventSource[0]
 	}
@@ -92,39 +125,135 @@ func NewTaskService(source taskDeviceSource, eventSource ...taskEventSource) *Ta
 	return service
 }
 
-func (s *TaskService) ListTasksForUser(userID int64) ([]Task, error) {
-	devices, err := s.source.GetUserDevices(userID)
+// ListTasksForUser derives the tasks of the user's sessions. It only reads:
+// records are created and synced, and notifications emitted, by
+// RefreshTasksForUser and the task event and presence handlers.
+func (s *TaskService) ListTasksForUser(ctx context.Context, userID int64) ([]Task, error) {
+	devices, err := s.source.GetUserDevices(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	tasks, err := s.listTasks(ctx, userID, devices, "", false)
 	if err != nil {
 		return nil, err
 	}
 
-	var tasks []Task
+	sort.SliceStable(tasks, func(i, j int) bool {
+		return taskStateRank(tasks[i].State) < taskStateRank(tasks[j].State)
+	})
+
+	return tasks, nil
+}
+
+// RefreshTasksForUser creates missing task records, writes the derived state
+// back and emits notifications for state changes.
+func (s *TaskService) RefreshTasksForUser(ctx context.Context, userID int64) error {
+	devices, err := s.source.GetUserDevices(ctx, userID)
+	if err != nil {
+		return err
+	}
+	_, err = s.listTasks(ctx, userID, devices, "", true)
+	return err
+}
+
+// HandleTaskEvent refreshes the task of a session after the hub reported an
+// event for it. Register it after the task event store so the new event is
+// already part of the timeline.
+func (s *TaskService) HandleTaskEvent(ctx context.Context, deviceID, sessionName string, event TaskEvent) {
+	s.refreshDevice(ctx, deviceID, sessionName)
+}
+
+// HandleAgentPresence refreshes the tasks of a device whose agent came or
+// went, e.g. to notify that it disconnected. Register it after the device
+// service so the stored status is current.
+func (s *TaskService) HandleAgentPresence(presence AgentPresence) {
+	if !presence.SessionOnline {
+		s.ForgetSession(presence.DeviceID, presence.SessionName)
+	}
+	s.refreshDevice(context.Background(), presence.DeviceID, presence.SessionName)
+}
+
+func (s *TaskService) refreshDevice(ctx context.Context, deviceID, sessionName string) {
+	lookup, ok := s.source.(taskDeviceLookup)
+	if !ok {
+		return
+	}
+	device, err := lookup.GetDeviceByDeviceID(ctx, deviceID)
+	if err != nil || device == nil || device.UserID == 0 {
+		return
+	}
+	if _, err := s.listTasks(ctx, device.UserID, []Device{*device}, sessionName, true); err != nil {
+		slog.Warn("task service: refresh tasks failed", "device_id", deviceID, "session_name", sessionName, "error", err)
+	}
+}
+
+// listTasks derives the tasks of the given devices, limited to one session
+// when sessionName is set. With refresh it also persists records, state and
+// notifications; otherwise it has no side effects on the store.
+func (s *TaskService) listTasks(ctx context.Context, userID int64, devices []Device, sessionName string, refresh bool) ([]Task, error) {
+	records, err := s.loadTaskRecords(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var listed []listedTask
 	for _, device := range devices {
-		sessions, err := s.source.GetDeviceSessions(device.DeviceID)
+		sessions, err := s.source.GetDeviceSessions(ctx, device.DeviceID)
 		if err != nil {
 			return nil, err
 		}
 		for _, session := range sessions {
-			task := s.mapSessionToTask(device, session)
-			s.emitTaskNotification(userID, task)
-			tasks = append(tasks, task)
+			if sessionName != "" && session.SessionName != sessionName {
+				continue
+			}
+			listed = append(listed, s.mapSessionToTask(ctx, userID, records, device, session, refresh))
 		}
 	}
 
-	sort.SliceStable(tasks, func(i, j int) bool {
-		return taskStateRank(tasks[i].State) < taskStateRank(tasks[j].State)
-	})
+	// 一次取回所有任务的最近事件，避免每个任务查一次
+	taskIDs := make([]string, 0, len(listed))
+	for _, item := range listed {
+		taskIDs = append(taskIDs, item.task.ID)
+	}
+	recent := s.recentEvents(ctx, taskIDs)
 
+	tasks := make([]Task, 0, len(listed))
+	for _, item := range listed {
+		task := enrichTask(item.task, recent[item.task.ID])
+		s.attachWorkspace(&task, item.record)
+		if refresh {
+			s.syncTaskRecord(ctx, item.record, &task)
+			s.emitTaskNotification(ctx, userID, task)
+		}
+		tasks = append(tasks, task)
+	}
 	return tasks, nil
 }
 
-func (s *TaskService) RefreshNotificationsForUser(userID int64) error {
-	_, err := s.ListTasksForUser(userID)
-	return err
+// CountTasksByState counts the task records of all users in each state, as
+// last written back by RefreshTasksForUser.
+func (s *TaskService) CountTasksByState(ctx context.Context) (map[TaskState]int, error) {
+	if s.records == nil {
+		return nil, ErrTaskRecordsUnavailable
+	}
+	counts := make(map[TaskState]int)
+	for _, state := range []TaskState{TaskStateRunning, TaskStateWaiting, TaskStateAttention, TaskStateCompleted} {
+		count, err := s.records.CountTasks(ctx, string(state))
+		if err != nil {
+			return nil, err
+		}
+		counts[state] = count
+	}
+	return counts, nil
+}
+
+func (s *TaskService) RefreshNotificationsForUser(ctx context.Context, userID int64) error {
+	return s.RefreshTasksForUser(ctx, userID)
 }
 
-func (s *TaskService) GetTaskForUser(userID int64, taskID string) (*Task, error) {
-	tasks, err := s.ListTasksForUser(userID)
+func (s *TaskService) GetTaskForUser(ctx context.Context, userID int64, taskID string) (*Task, error) {
+	tasks, err := s.ListTasksForUser(ctx, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -132,6 +261,30 @@ func (s *TaskService) GetTaskForUser(userID int64, taskID string) (*Task, error)
 	for _, task := range tasks {
 		if task.ID == taskID {
 			taskCopy := task
+			s.attachTaskSessions(ctx, &taskCopy)
+			return &taskCopy, nil
+		}
+	}
+
+	// Finished tasks whose session has moved on are only reachable by ID.
+	if s.records != nil {
+		record, err := s.records.GetTaskByID(ctx, taskID)
+		if err != nil {
+			return nil, err
+		}
+		if record != nil && record.UserID == userID {
+			task := taskFromRecord(record)
+			s.attachWorkspace(&task, record)
+			s.attachTaskSessions(ctx, &task)
+			return &task, nil
+		}
+	}
+
+	// Older links address tasks by device:session.
+	for _, task := range tasks {
+		if sessionTaskID(task.DeviceID, task.SessionName) == taskID {
+			taskCopy := task
+			s.attachTaskSessions(ctx, &taskCopy)
 			return &taskCopy, nil
 		}
 	}
@@ -139,6 +292,22 @@ func (s *TaskService) GetTaskForUser(userID int64, taskID string) (*Task, error)
 	return nil, ErrTaskNotFound
 }
 
+// ListTaskTimeline returns a page of persisted events for a task owned by the user.
+// before and beforeID are the timestamp and ID of the oldest event already seen.
+func (s *TaskService) ListTaskTimeline(ctx context.Context, userID int64, taskID string, before *time.Time, beforeID int64, limit int) ([]TaskEvent, error) {
+	timeline, ok := s.eventSource.(taskTimelineSource)
+	if !ok {
+		return nil, ErrTaskTimelineUnavailable
+	}
+
+	task, err := s.GetTaskForUser(ctx, userID, taskID)
+	if err != nil {
+		return nil, err
+	}
+
+	return timeline.ListTaskEvents(ctx, task.ID, before, beforeID, limit)
+}
+
 func taskStateRank(state TaskState) int {
 	switch state {
 	case TaskStateRunning:
@@ -153,7 +322,7 @@ func taskStateRank(state TaskState) int {
 }
 
 func mapSessionToTask(device Device, session Session) Task {
-	taskID := session.DeviceID + ":" + session.SessionName
+	taskID := sessionTaskID(session.DeviceID, session.SessionName)
 	state := deriveTaskState(device, session)
 	task := Task{
 		ID:             taskID,
@@ -186,12 +355,26 @@ func deriveTaskTool(session Session) string {
 	}
 }
 
-func (s *TaskService) enrichTask(task Task) Task {
-	if s.eventSource == nil {
-		return task
+// recentEvents loads the newest events of the given tasks, in one call when
+// the event source supports batching.
+func (s *TaskService) recentEvents(ctx context.Context, taskIDs []string) map[string][]TaskEvent {
+	if s.eventSource == nil || len(taskIDs) == 0 {
+		return nil
+	}
+	if batch, ok := s.eventSource.(taskEventBatchSource); ok {
+		return batch.GetRecentEventsForTasks(ctx, taskIDs)
+	}
+
+	events := make(map[string][]TaskEvent, len(taskIDs))
+	for _, taskID := range taskIDs {
+		if timeline := s.eventSource.GetRecentEvents(ctx, taskID); len(timeline) > 0 {
+			events[taskID] = timeline
+		}
 	}
+	return events
+}
 
-	timeline := s.eventSource.GetRecentEvents(task.ID)
+func enrichTask(task Task, timeline []TaskEvent) Task {
 	if len(timeline) == 0 {
 		return task
 	}
@@ -206,7 +389,7 @@ func (s *TaskService) enrichTask(task Task) Task {
 	return task
 }
 
-func (s *TaskService) emitTaskNotification(userID int64, task Task) {
+func (s *TaskService) emitTaskNotification(ctx context.Context, userID int64, task Task) {
 	if s.notificationEmitter == nil {
 		return
 	}
@@ -232,6 +415,7 @@ func (s *TaskService) emitTaskNotification(userID int64, task Task) {
 	}
 
 	_, _ = s.notificationEmitter.CreateNotification(
+		ctx,
 		userID,
 		eventType,
 		task.ID,
@@ -242,8 +426,34 @@ func (s *TaskService) emitTaskNotification(userID int64, task Task) {
 	)
 }
 
-func (s *TaskService) mapSessionToTask(device Device, session Session) Task {
-	return s.enrichTask(mapSessionToTask(device, session))
+// listedTask is a session-derived task and its record, before the recent
+// events are applied.
+type listedTask struct {
+	task   Task
+	record *db.Task
+}
+
+func (s *TaskService) mapSessionToTask(ctx context.Context, userID int64, records map[string]db.Task, device Device, session Session, refresh bool) listedTask {
+	task := mapSessionToTask(device, session)
+	if s.records == nil {
+		return listedTask{task: task}
+	}
+
+	var record *db.Task
+	var err error
+	if refresh {
+		record, err = s.taskRecordForSession(ctx, userID, records, device, session)
+	} else {
+		record, err = s.findTaskRecord(ctx, userID, records, session)
+	}
+	if err != nil {
+		slog.Warn("task service: load task record failed", "task_id", task.ID, "error", err)
+		return listedTask{task: task}
+	}
+	if record == nil {
+		return listedTask{task: task}
+	}
+	return listedTask{task: applyTaskRecord(task, record), record: record}
 }
 
 func deriveTaskState(device Device, session Session) TaskState {
@@ -362,6 +572,9 @@ func taskNotificationMessage(task Task, eventType NotificationEventType) (string
 
 	switch eventType {
 	case NotificationEventTaskCompleted:
+		if task.Workspace != nil && task.Workspace.IsRepo {
+			return "任务已完成", fmt.Sprintf("%s 已完成（%s），可以查看结果。", title, task.Workspace.DiffSummary())
+		}
 		return "任务已完成", fmt.Sprintf("%s 已完成，可以查看结果。", title)
 	case NotificationEventTaskWaitingInput:
 		return "需要你确认", fmt.Sprintf("%s 正在等待你的输入。", title)
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"sync"
 	"testing"
 	"time"
@@ -32,19 +33,19 @@ type taskNotificationCall struct {
 	body        string
 }
 
-func (f *fakeTaskDeviceSource) GetUserDevices(userID int64) ([]Device, error) {
+func (f *fakeTaskDeviceSource) GetUserDevices(ctx context.Context, userID int64) ([]Device, error) {
 	return f.devicesByUser[userID], nil
 }
 
-func (f *fakeTaskDeviceSource) GetDeviceSessions(deviceID string) ([]Session, error) {
+func (f *fakeTaskDeviceSource) GetDeviceSessions(ctx context.Context, deviceID string) ([]Session, error) {
 	return f.sessionsByDevice[deviceID], nil
 }
 
-func (f *fakeTaskEventSource) GetRecentEvents(taskID string) []TaskEvent {
+func (f *fakeTaskEventSource) GetRecentEvents(ctx context.Context, taskID string) []TaskEvent {
 	return f.eventsByTask[taskID]
 }
 
-func (f *fakeTaskNotificationEmitter) CreateNotification(userID int64, eventType NotificationEventType, taskID, deviceID, sessionName, title, body string) (*db.Notification, error) {
+func (f *fakeTaskNotificationEmitter) CreateNotification(ctx context.Context, userID int64, eventType NotificationEventType, taskID, deviceID, sessionName, title, body string) (*db.Notification, error) {
 	f.mu.Lock()
 	f.calls = append(f.calls, taskNotificationCall{
 		userID:      userID,
@@ -108,7 +109,7 @@ func TestTaskServiceListTasksForUser(t *testing.T) {
 		},
 	})
 
-	tasks, err := service.ListTasksForUser(7)
+	tasks, err := service.ListTasksForUser(context.Background(), 7)
 	if err != nil {
 		t.Fatalf("ListTasksForUser returned error: %v", err)
 	}
@@ -191,7 +192,7 @@ func TestTaskServiceGetTaskForUser(t *testing.T) {
 		},
 	}, &fakeTaskEventSource{})
 
-	task, err := service.GetTaskForUser(7, "dev-1:feature-branch")
+	task, err := service.GetTaskForUser(context.Background(), 7, "dev-1:feature-branch")
 	if err != nil {
 		t.Fatalf("GetTaskForUser returned error: %v", err)
 	}
@@ -217,7 +218,7 @@ func TestTaskServiceDerivesWaitingStateAndFallbackActivity(t *testing.T) {
 		},
 	}, &fakeTaskEventSource{})
 
-	tasks, err := service.ListTasksForUser(7)
+	tasks, err := service.ListTasksForUser(context.Background(), 7)
 	if err != nil {
 		t.Fatalf("ListTasksForUser returned error: %v", err)
 	}
@@ -255,7 +256,7 @@ func TestTaskServiceUsesRecentEventKindToOverrideState(t *testing.T) {
 		},
 	})
 
-	tasks, err := service.ListTasksForUser(7)
+	tasks, err := service.ListTasksForUser(context.Background(), 7)
 	if err != nil {
 		t.Fatalf("ListTasksForUser returned error: %v", err)
 	}
@@ -290,7 +291,7 @@ func TestTaskServiceUsesErrorEventKindForAttentionState(t *testing.T) {
 		},
 	})
 
-	tasks, err := service.ListTasksForUser(7)
+	tasks, err := service.ListTasksForUser(context.Background(), 7)
 	if err != nil {
 		t.Fatalf("ListTasksForUser returned error: %v", err)
 	}
@@ -325,7 +326,7 @@ func TestTaskServiceUsesCompletedEventKindForCompletedState(t *testing.T) {
 		},
 	})
 
-	tasks, err := service.ListTasksForUser(7)
+	tasks, err := service.ListTasksForUser(context.Background(), 7)
 	if err != nil {
 		t.Fatalf("ListTasksForUser returned error: %v", err)
 	}
@@ -360,16 +361,16 @@ func TestTaskServiceEmitsCompletedNotificationOnceOnCompletionTransition(t *test
 		return time.Date(2026, 4, 10, 9, 35, 0, 0, time.UTC)
 	}
 
-	if _, err := service.ListTasksForUser(7); err != nil {
-		t.Fatalf("ListTasksForUser running returned error: %v", err)
+	if err := service.RefreshTasksForUser(context.Background(), 7); err != nil {
+		t.Fatalf("RefreshTasksForUser running returned error: %v", err)
 	}
 	if emitter.callCount() != 0 {
 		t.Fatalf("callCount = %d, want 0 before completion", emitter.callCount())
 	}
 
 	source.sessionsByDevice["dev-1"][0].Status = "inactive"
-	if _, err := service.ListTasksForUser(7); err != nil {
-		t.Fatalf("ListTasksForUser completed returned error: %v", err)
+	if err := service.RefreshTasksForUser(context.Background(), 7); err != nil {
+		t.Fatalf("RefreshTasksForUser completed returned error: %v", err)
 	}
 	if emitter.callCount() != 1 {
 		t.Fatalf("callCount = %d, want 1 after completion", emitter.callCount())
@@ -378,8 +379,8 @@ func TestTaskServiceEmitsCompletedNotificationOnceOnCompletionTransition(t *test
 		t.Fatalf("eventType = %q, want %q", emitter.lastCall().eventType, NotificationEventTaskCompleted)
 	}
 
-	if _, err := service.ListTasksForUser(7); err != nil {
-		t.Fatalf("ListTasksForUser duplicate returned error: %v", err)
+	if err := service.RefreshTasksForUser(context.Background(), 7); err != nil {
+		t.Fatalf("RefreshTasksForUser duplicate returned error: %v", err)
 	}
 	if emitter.callCount() != 1 {
 		t.Fatalf("callCount = %d, want 1 after duplicate completed state", emitter.callCount())
@@ -406,16 +407,16 @@ func TestTaskServiceEmitsWaitingNotificationOnceOnWaitingTransition(t *testing.T
 		return time.Date(2026, 4, 10, 9, 35, 0, 0, time.UTC)
 	}
 
-	if _, err := service.ListTasksForUser(7); err != nil {
-		t.Fatalf("ListTasksForUser running returned error: %v", err)
+	if err := service.RefreshTasksForUser(context.Background(), 7); err != nil {
+		t.Fatalf("RefreshTasksForUser running returned error: %v", err)
 	}
 	if emitter.callCount() != 0 {
 		t.Fatalf("callCount = %d, want 0 before waiting", emitter.callCount())
 	}
 
 	source.sessionsByDevice["dev-1"][0].Status = "waiting_input"
-	if _, err := service.ListTasksForUser(7); err != nil {
-		t.Fatalf("ListTasksForUser waiting returned error: %v", err)
+	if err := service.RefreshTasksForUser(context.Background(), 7); err != nil {
+		t.Fatalf("RefreshTasksForUser waiting returned error: %v", err)
 	}
 	if emitter.callCount() != 1 {
 		t.Fatalf("callCount = %d, want 1 after waiting", emitter.callCount())
@@ -424,8 +425,8 @@ func TestTaskServiceEmitsWaitingNotificationOnceOnWaitingTransition(t *testing.T
 		t.Fatalf("eventType = %q, want %q", emitter.lastCall().eventType, NotificationEventTaskWaitingInput)
 	}
 
-	if _, err := service.ListTasksForUser(7); err != nil {
-		t.Fatalf("ListTasksForUser duplicate waiting returned error: %v", err)
+	if err := service.RefreshTasksForUser(context.Background(), 7); err != nil {
+		t.Fatalf("RefreshTasksForUser duplicate waiting returned error: %v", err)
 	}
 	if emitter.callCount() != 1 {
 		t.Fatalf("callCount = %d, want 1 after duplicate waiting state", emitter.callCount())
@@ -452,8 +453,8 @@ func TestTaskServiceEmitsIdleTooLongNotificationOnceForStaleRunningTask(t *testi
 		return time.Date(2026, 4, 10, 9, 20, 0, 0, time.UTC)
 	}
 
-	if _, err := service.ListTasksForUser(7); err != nil {
-		t.Fatalf("ListTasksForUser idle returned error: %v", err)
+	if err := service.RefreshTasksForUser(context.Background(), 7); err != nil {
+		t.Fatalf("RefreshTasksForUser idle returned error: %v", err)
 	}
 	if emitter.callCount() != 1 {
 		t.Fatalf("callCount = %d, want 1 after idle-too-long", emitter.callCount())
@@ -462,8 +463,8 @@ func TestTaskServiceEmitsIdleTooLongNotificationOnceForStaleRunningTask(t *testi
 		t.Fatalf("eventType = %q, want %q", emitter.lastCall().eventType, NotificationEventTaskIdleTooLong)
 	}
 
-	if _, err := service.ListTasksForUser(7); err != nil {
-		t.Fatalf("ListTasksForUser duplicate idle returned error: %v", err)
+	if err := service.RefreshTasksForUser(context.Background(), 7); err != nil {
+		t.Fatalf("RefreshTasksForUser duplicate idle returned error: %v", err)
 	}
 	if emitter.callCount() != 1 {
 		t.Fatalf("callCount = %d, want 1 after duplicate idle state", emitter.callCount())
@@ -490,16 +491,16 @@ func TestTaskServiceEmitsDisconnectedNotificationOnceWhenDeviceGoesOffline(t *te
 		return time.Date(2026, 4, 10, 9, 35, 0, 0, time.UTC)
 	}
 
-	if _, err := service.ListTasksForUser(7); err != nil {
-		t.Fatalf("ListTasksForUser online returned error: %v", err)
+	if err := service.RefreshTasksForUser(context.Background(), 7); err != nil {
+		t.Fatalf("RefreshTasksForUser online returned error: %v", err)
 	}
 	if emitter.callCount() != 0 {
 		t.Fatalf("callCount = %d, want 0 before disconnect", emitter.callCount())
 	}
 
 	source.devicesByUser[7][0].Status = "offline"
-	if _, err := service.ListTasksForUser(7); err != nil {
-		t.Fatalf("ListTasksForUser offline returned error: %v", err)
+	if err := service.RefreshTasksForUser(context.Background(), 7); err != nil {
+		t.Fatalf("RefreshTasksForUser offline returned error: %v", err)
 	}
 	if emitter.callCount() != 1 {
 		t.Fatalf("callCount = %d, want 1 after disconnect", emitter.callCount())
@@ -508,8 +509,8 @@ func TestTaskServiceEmitsDisconnectedNotificationOnceWhenDeviceGoesOffline(t *te
 		t.Fatalf("eventType = %q, want %q", emitter.lastCall().eventType, NotificationEventAgentDisconnected)
 	}
 
-	if _, err := service.ListTasksForUser(7); err != nil {
-		t.Fatalf("ListTasksForUser duplicate offline returned error: %v", err)
+	if err := service.RefreshTasksForUser(context.Background(), 7); err != nil {
+		t.Fatalf("RefreshTasksForUser duplicate offline returned error: %v", err)
 	}
 	if emitter.callCount() != 1 {
 		t.Fatalf("callCount = %d, want 1 after duplicate offline state", emitter.callCount())
@@ -0,0 +1,239 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// UploadFrameMagic starts every binary upload frame:
+	// "MCUP" | version | id length | upload id | seq (uint32 BE) | crc32 (uint32 BE) | data
+	UploadFrameMagic   = "MCUP"
+	uploadFrameVersion = 1
+
+	uploadChunkSize = 64 * 1024
+	// uploadTimeout covers the whole transfer, including slow phone uplinks.
+	uploadTimeout = 2 * time.Minute
+	// uploadControlTimeout bounds each start/finish/abort round trip.
+	uploadControlTimeout = 15 * time.Second
+)
+
+var (
+	ErrInvalidUpload        = errors.New("invalid upload")
+	ErrUploadTooLarge       = errors.New("upload exceeds size limit")
+	ErrUploadTypeNotAllowed = errors.New("file type not allowed")
+)
+
+// agentUploader streams binary frames to the agent of a session.
+type agentUploader interface {
+	agentRequester
+	SendFrameToAgent(ctx context.Context, deviceID, sessionName string, frame []byte) error
+}
+
+// UploadResult describes a file stored in the task's project. Path is
+// relative to the project root and has been typed into the tool's prompt.
+type UploadResult struct {
+	TaskID      string `json:"task_id"`
+	Path        string `json:"path"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+}
+
+// UploadService streams files from the phone into the project of a task.
+type UploadService struct {
+	tasks        taskLookup
+	agents       agentUploader
+	maxBytes     int64
+	allowedTypes map[string]bool
+	chunkSize    int
+	timeout      time.Duration
+}
+
+func NewUploadService(tasks *TaskService, agents agentUploader, maxBytes int64, allowedTypes []string) *UploadService {
+	service := &UploadService{
+		tasks:        tasks,
+		agents:       agents,
+		maxBytes:     maxBytes,
+		allowedTypes: make(map[string]bool),
+		chunkSize:    uploadChunkSize,
+		timeout:      uploadTimeout,
+	}
+	for _, contentType := range allowedTypes {
+		service.allowedTypes[contentType] = true
+	}
+	return service
+}
+
+// Upload checks the content type, streams the file to the agent in chunks
+// and returns where the agent stored it.
+func (s *UploadService) Upload(ctx context.Context, userID int64, taskID, filename string, content io.Reader) (*UploadResult, error) {
+	if filename == "" {
+		return nil, fmt.Errorf("%w: filename required", ErrInvalidUpload)
+	}
+
+	// 按内容判断类型，不信任客户端声明的 Content-Type
+	head := make([]byte, 512)
+	n, err := io.ReadFull(content, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+	if n == 0 {
+		return nil, fmt.Errorf("%w: empty file", ErrInvalidUpload)
+	}
+	contentType := sniffContentType(filename, head)
+	if !s.allowedTypes[contentType] {
+		return nil, fmt.Errorf("%w: %s", ErrUploadTypeNotAllowed, contentType)
+	}
+
+	task, err := s.tasks.GetTaskForUser(ctx, userID, taskID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	uploadID, err := newUploadID()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.control(ctx, task, "upload_start", map[string]interface{}{
+		"upload_id":    uploadID,
+		"filename":     filename,
+		"content_type": contentType,
+		"max_bytes":    s.maxBytes,
+	}); err != nil {
+		return nil, err
+	}
+
+	size, sum, err := s.stream(ctx, task, uploadID, io.MultiReader(bytes.NewReader(head), content))
+	if err != nil {
+		s.abort(task, uploadID)
+		return nil, err
+	}
+
+	raw, err := s.control(ctx, task, "upload_finish", map[string]interface{}{
+		"upload_id": uploadID,
+		"size":      size,
+		"sha256":    sum,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var reply struct {
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(raw, &reply); err != nil || reply.Path == "" {
+		return nil, fmt.Errorf("%w: invalid upload result", ErrAgentRequestFailed)
+	}
+	return &UploadResult{
+		TaskID:      task.ID,
+		Path:        reply.Path,
+		ContentType: contentType,
+		Size:        size,
+		SHA256:      sum,
+	}, nil
+}
+
+// stream sends content as numbered frames and returns its size and SHA-256.
+func (s *UploadService) stream(ctx context.Context, task *Task, uploadID string, content io.Reader) (int64, string, error) {
+	hash := sha256.New()
+	buf := make([]byte, s.chunkSize)
+	var size int64
+	for seq := uint32(0); ; seq++ {
+		n, err := io.ReadFull(content, buf)
+		if n > 0 {
+			size += int64(n)
+			if s.maxBytes > 0 && size > s.maxBytes {
+				return 0, "", ErrUploadTooLarge
+			}
+			hash.Write(buf[:n])
+			if err := s.agents.SendFrameToAgent(ctx, task.DeviceID, task.SessionName, EncodeUploadFrame(uploadID, seq, buf[:n])); err != nil {
+				return 0, "", agentRequestError(err)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return size, hex.EncodeToString(hash.Sum(nil)), nil
+		}
+		if err != nil {
+			return 0, "", fmt.Errorf("%w: %v", ErrInvalidUpload, err)
+		}
+	}
+}
+
+func (s *UploadService) control(ctx context.Context, task *Task, msgType string, payload map[string]interface{}) (json.RawMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, uploadControlTimeout)
+	defer cancel()
+	raw, err := s.agents.RequestAgent(ctx, task.DeviceID, task.SessionName, msgType, payload)
+	if err != nil {
+		return nil, agentRequestError(err)
+	}
+	return raw, nil
+}
+
+// abort lets the agent drop the partial file; failures only leave a .part
+// file behind, so they are ignored.
+func (s *UploadService) abort(task *Task, uploadID string) {
+	s.control(context.Background(), task, "upload_abort", map[string]interface{}{"upload_id": uploadID})
+}
+
+// EncodeUploadFrame builds a binary upload frame; the agent decodes it with
+// the same layout.
+func EncodeUploadFrame(uploadID string, seq uint32, data []byte) []byte {
+	frame := make([]byte, 0, 14+len(uploadID)+len(data))
+	frame = append(frame, UploadFrameMagic...)
+	frame = append(frame, uploadFrameVersion, byte(len(uploadID)))
+	frame = append(frame, uploadID...)
+	frame = binary.BigEndian.AppendUint32(frame, seq)
+	frame = binary.BigEndian.AppendUint32(frame, crc32.ChecksumIEEE(data))
+	return append(frame, data...)
+}
+
+// sniffContentType detects the type from the content. Sniffing cannot tell
+// text formats apart, so plain text takes the textual type of the file
+// extension, e.g. application/json for .json; binary content never does.
+func sniffContentType(filename string, head []byte) string {
+	contentType := mediaType(http.DetectContentType(head))
+	if contentType != "text/plain" {
+		return contentType
+	}
+	if byExtension := mediaType(mime.TypeByExtension(filepath.Ext(filename))); isTextType(byExtension) {
+		return byExtension
+	}
+	return contentType
+}
+
+func mediaType(contentType string) string {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		return mediaType
+	}
+	return contentType
+}
+
+func isTextType(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/") || contentType == "application/json" || strings.HasSuffix(contentType, "+json")
+}
+
+func newUploadID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "up-" + hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+type fakeAgentUploader struct {
+	requests []string
+	payloads []map[string]interface{}
+	frames   [][]byte
+	finish   string
+}
+
+func (f *fakeAgentUploader) RequestAgent(ctx context.Context, deviceID, sessionName, msgType string, payload interface{}) (json.RawMessage, error) {
+	f.requests = append(f.requests, msgType)
+	f.payloads = append(f.payloads, payload.(map[string]interface{}))
+	if msgType == "upload_finish" {
+		return json.RawMessage(f.finish), nil
+	}
+	return json.RawMessage(`{}`), nil
+}
+
+func (f *fakeAgentUploader) SendFrameToAgent(ctx context.Context, deviceID, sessionName string, frame []byte) error {
+	f.frames = append(f.frames, append([]byte(nil), frame...))
+	return nil
+}
+
+func newUploadServiceForTest(agents *fakeAgentUploader, maxBytes int64) *UploadService {
+	service := NewUploadService(nil, agents, maxBytes, []string{"image/png", "text/plain"})
+	service.tasks = &fakeTaskLookup{tasks: map[string]*Task{
+		"task-1": {ID: "task-1", DeviceID: "dev-1", SessionName: "feature"},
+	}}
+	service.chunkSize = 4
+	return service
+}
+
+func TestUploadServiceStreamsChunksToAgent(t *testing.T) {
+	agents := &fakeAgentUploader{finish: `{"path":".mobilecoder/uploads/notes.txt"}`}
+	service := newUploadServiceForTest(agents, 1024)
+
+	content := "hello, agent"
+	result, err := service.Upload(context.Background(), 7, "task-1", "notes.txt", strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if strings.Join(agents.requests, ",") != "upload_start,upload_finish" {
+		t.Fatalf("requests = %v", agents.requests)
+	}
+	if len(agents.frames) != 3 || !bytes.HasPrefix(agents.frames[0], []byte(UploadFrameMagic)) {
+		t.Fatalf("frames = %d, want 3 upload frames", len(agents.frames))
+	}
+	sum := sha256.Sum256([]byte(content))
+	finish := agents.payloads[1]
+	if finish["sha256"] != hex.EncodeToString(sum[:]) || finish["size"] != int64(len(content)) || finish["upload_id"] != agents.payloads[0]["upload_id"] {
+		t.Fatalf("finish payload = %+v", finish)
+	}
+	if result.Path != ".mobilecoder/uploads/notes.txt" || result.ContentType != "text/plain" || result.TaskID != "task-1" {
+		t.Fatalf("result = %+v", result)
+	}
+}
+
+func TestSniffContentTypeUsesExtensionForText(t *testing.T) {
+	cases := []struct {
+		filename string
+		head     string
+		want     string
+	}{
+		{filename: "config.json", head: `{"a": 1}`, want: "application/json"},
+		{filename: "notes.txt", head: "hello", want: "text/plain"},
+		{filename: "notes", head: "hello", want: "text/plain"},
+		{filename: "page.json", head: "\x89PNG\r\n\x1a\n\x00\x00", want: "image/png"},
+		{filename: "script.exe", head: "hello", want: "text/plain"},
+	}
+	for _, tc := range cases {
+		if got := sniffContentType(tc.filename, []byte(tc.head)); got != tc.want {
+			t.Fatalf("sniffContentType(%q) = %q, want %q", tc.filename, got, tc.want)
+		}
+	}
+}
+
+func TestUploadServiceEnforcesTypeAndSize(t *testing.T) {
+	agents := &fakeAgentUploader{}
+	service := newUploadServiceForTest(agents, 8)
+
+	if _, err := service.Upload(context.Background(), 7, "task-1", "a.pdf", strings.NewReader("%PDF-1.7 ...")); !errors.Is(err, ErrUploadTypeNotAllowed) {
+		t.Fatalf("err = %v, want ErrUploadTypeNotAllowed", err)
+	}
+	if len(agents.requests) != 0 {
+		t.Fatalf("requests = %v, want none before the type check passes", agents.requests)
+	}
+
+	if _, err := service.Upload(context.Background(), 7, "task-1", "big.txt", strings.NewReader("more than eight bytes")); !errors.Is(err, ErrUploadTooLarge) {
+		t.Fatalf("err = %v, want ErrUploadTooLarge", err)
+	}
+	if agents.requests[len(agents.requests)-1] != "upload_abort" {
+		t.Fatalf("requests = %v, want upload_abort last", agents.requests)
+	}
+	if _, err := service.Upload(context.Background(), 8, "task-1", "a.txt", strings.NewReader("hi")); !errors.Is(err, ErrTaskNotFound) {
+		t.Fatalf("err = %v, want ErrTaskNotFound", err)
+	}
+}
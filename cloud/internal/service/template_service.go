@@ -0,0 +1,261 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mobile-coder/cloud/internal/db"
+)
+
+const (
+	templateNameMaxLength    = 100
+	templateContentMaxLength = 8000
+)
+
+var (
+	ErrTemplateNotFound        = errors.New("template not found")
+	ErrTemplateForbidden       = errors.New("only the author or a team admin can change this template")
+	ErrInvalidTemplate         = errors.New("invalid template")
+	ErrMissingTemplateVariable = errors.New("missing template variable")
+)
+
+var templateVariablePattern = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+type templateStore interface {
+	CreatePromptTemplate(context.Context, *db.PromptTemplate) (*db.PromptTemplate, error)
+	GetPromptTemplate(ctx context.Context, templateID int64) (*db.PromptTemplate, error)
+	ListPromptTemplates(ctx context.Context, userID int64, teamIDs []int64) ([]db.PromptTemplate, error)
+	UpdatePromptTemplate(ctx context.Context, templateID int64, fields map[string]interface{}) error
+	DeletePromptTemplate(ctx context.Context, templateID int64) error
+	ListTeamMembershipsByUser(ctx context.Context, userID int64) ([]db.TeamMember, error)
+}
+
+// PromptTemplate is a stored template together with the variables its
+// content expects.
+type PromptTemplate struct {
+	db.PromptTemplate
+	Variables []string `json:"variables"`
+}
+
+// TemplateInput holds the editable fields of a template. TeamID shares a new
+// template with a team the author belongs to; it cannot be changed later.
+type TemplateInput struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Content     string `json:"content"`
+	TeamID      *int64 `json:"team_id"`
+}
+
+// TemplateService stores personal and team prompt templates and renders
+// them with {{variable}} substitution.
+type TemplateService struct {
+	store templateStore
+	now   func() time.Time
+}
+
+func NewTemplateService(database *db.SupabaseDB) *TemplateService {
+	return &TemplateService{
+		store: database,
+		now:   time.Now,
+	}
+}
+
+func (s *TemplateService) ListTemplates(ctx context.Context, userID int64) ([]PromptTemplate, error) {
+	memberships, err := s.store.ListTeamMembershipsByUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	teamIDs := make([]int64, 0, len(memberships))
+	for _, membership := range memberships {
+		teamIDs = append(teamIDs, membership.TeamID)
+	}
+
+	records, err := s.store.ListPromptTemplates(ctx, userID, teamIDs)
+	if err != nil {
+		return nil, err
+	}
+	templates := make([]PromptTemplate, 0, len(records))
+	for _, record := range records {
+		templates = append(templates, newPromptTemplate(record))
+	}
+	return templates, nil
+}
+
+func (s *TemplateService) CreateTemplate(ctx context.Context, userID int64, input TemplateInput) (*PromptTemplate, error) {
+	if err := validateTemplateInput(input); err != nil {
+		return nil, err
+	}
+	if input.TeamID != nil {
+		if _, ok, err := s.teamRole(ctx, userID, *input.TeamID); err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, fmt.Errorf("%w: not a member of team %d", ErrInvalidTemplate, *input.TeamID)
+		}
+	}
+
+	created, err := s.store.CreatePromptTemplate(ctx, &db.PromptTemplate{
+		UserID:      userID,
+		TeamID:      input.TeamID,
+		Name:        strings.TrimSpace(input.Name),
+		Description: strings.TrimSpace(input.Description),
+		Content:     input.Content,
+	})
+	if err != nil {
+		return nil, err
+	}
+	template := newPromptTemplate(*created)
+	return &template, nil
+}
+
+func (s *TemplateService) UpdateTemplate(ctx context.Context, userID, templateID int64, input TemplateInput) (*PromptTemplate, error) {
+	if err := validateTemplateInput(input); err != nil {
+		return nil, err
+	}
+	record, err := s.editableTemplate(ctx, userID, templateID)
+	if err != nil {
+		return nil, err
+	}
+
+	record.Name = strings.TrimSpace(input.Name)
+	record.Description = strings.TrimSpace(input.Description)
+	record.Content = input.Content
+	record.UpdatedAt = s.now().UTC().Format(time.RFC3339)
+	if err := s.store.UpdatePromptTemplate(ctx, templateID, map[string]interface{}{
+		"name":        record.Name,
+		"description": record.Description,
+		"content":     record.Content,
+		"updated_at":  record.UpdatedAt,
+	}); err != nil {
+		return nil, err
+	}
+	template := newPromptTemplate(*record)
+	return &template, nil
+}
+
+func (s *TemplateService) DeleteTemplate(ctx context.Context, userID, templateID int64) error {
+	if _, err := s.editableTemplate(ctx, userID, templateID); err != nil {
+		return err
+	}
+	return s.store.DeletePromptTemplate(ctx, templateID)
+}
+
+// RenderTemplate fills in a template the user can see. Every variable used
+// by the template must be provided; extra values are ignored.
+func (s *TemplateService) RenderTemplate(ctx context.Context, userID, templateID int64, variables map[string]string) (string, error) {
+	record, err := s.visibleTemplate(ctx, userID, templateID)
+	if err != nil {
+		return "", err
+	}
+	return RenderTemplateContent(record.Content, variables)
+}
+
+// RenderTemplateContent substitutes {{name}} placeholders in content.
+func RenderTemplateContent(content string, variables map[string]string) (string, error) {
+	var missing []string
+	for _, name := range templateVariables(content) {
+		if _, ok := variables[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("%w: %s", ErrMissingTemplateVariable, strings.Join(missing, ", "))
+	}
+
+	return templateVariablePattern.ReplaceAllStringFunc(content, func(match string) string {
+		name := templateVariablePattern.FindStringSubmatch(match)[1]
+		return variables[name]
+	}), nil
+}
+
+func (s *TemplateService) visibleTemplate(ctx context.Context, userID, templateID int64) (*db.PromptTemplate, error) {
+	record, err := s.store.GetPromptTemplate(ctx, templateID)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, ErrTemplateNotFound
+	}
+	if record.TeamID == nil {
+		if record.UserID != userID {
+			return nil, ErrTemplateNotFound
+		}
+		return record, nil
+	}
+	if _, ok, err := s.teamRole(ctx, userID, *record.TeamID); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrTemplateNotFound
+	}
+	return record, nil
+}
+
+func (s *TemplateService) editableTemplate(ctx context.Context, userID, templateID int64) (*db.PromptTemplate, error) {
+	record, err := s.visibleTemplate(ctx, userID, templateID)
+	if err != nil {
+		return nil, err
+	}
+	if record.UserID == userID {
+		return record, nil
+	}
+	role, _, err := s.teamRole(ctx, userID, *record.TeamID)
+	if err != nil {
+		return nil, err
+	}
+	if role != "admin" {
+		return nil, ErrTemplateForbidden
+	}
+	return record, nil
+}
+
+func (s *TemplateService) teamRole(ctx context.Context, userID, teamID int64) (string, bool, error) {
+	memberships, err := s.store.ListTeamMembershipsByUser(ctx, userID)
+	if err != nil {
+		return "", false, err
+	}
+	for _, membership := range memberships {
+		if membership.TeamID == teamID {
+			return membership.Role, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+func validateTemplateInput(input TemplateInput) error {
+	name := strings.TrimSpace(input.Name)
+	if name == "" || strings.TrimSpace(input.Content) == "" {
+		return fmt.Errorf("%w: name and content required", ErrInvalidTemplate)
+	}
+	if len([]rune(name)) > templateNameMaxLength {
+		return fmt.Errorf("%w: name longer than %d characters", ErrInvalidTemplate, templateNameMaxLength)
+	}
+	if len([]rune(input.Content)) > templateContentMaxLength {
+		return fmt.Errorf("%w: content longer than %d characters", ErrInvalidTemplate, templateContentMaxLength)
+	}
+	return nil
+}
+
+func newPromptTemplate(record db.PromptTemplate) PromptTemplate {
+	return PromptTemplate{
+		PromptTemplate: record,
+		Variables:      templateVariables(record.Content),
+	}
+}
+
+// templateVariables lists the distinct variable names used in content.
+func templateVariables(content string) []string {
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, match := range templateVariablePattern.FindAllStringSubmatch(content, -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			names = append(names, match[1])
+		}
+	}
+	sort.Strings(names)
+	return names
+}
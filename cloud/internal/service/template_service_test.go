@@ -0,0 +1,180 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mobile-coder/cloud/internal/db"
+)
+
+type fakeTemplateStore struct {
+	templates   map[int64]*db.PromptTemplate
+	memberships map[int64][]db.TeamMember
+	nextID      int64
+	deleted     []int64
+}
+
+func newFakeTemplateStore() *fakeTemplateStore {
+	return &fakeTemplateStore{
+		templates:   make(map[int64]*db.PromptTemplate),
+		memberships: make(map[int64][]db.TeamMember),
+	}
+}
+
+func (f *fakeTemplateStore) CreatePromptTemplate(ctx context.Context, template *db.PromptTemplate) (*db.PromptTemplate, error) {
+	f.nextID++
+	created := *template
+	created.ID = f.nextID
+	f.templates[created.ID] = &created
+	result := created
+	return &result, nil
+}
+
+func (f *fakeTemplateStore) GetPromptTemplate(ctx context.Context, templateID int64) (*db.PromptTemplate, error) {
+	template, ok := f.templates[templateID]
+	if !ok {
+		return nil, nil
+	}
+	result := *template
+	return &result, nil
+}
+
+func (f *fakeTemplateStore) ListPromptTemplates(ctx context.Context, userID int64, teamIDs []int64) ([]db.PromptTemplate, error) {
+	var templates []db.PromptTemplate
+	for id := int64(1); id <= f.nextID; id++ {
+		template, ok := f.templates[id]
+		if !ok {
+			continue
+		}
+		if template.TeamID == nil && template.UserID == userID {
+			templates = append(templates, *template)
+			continue
+		}
+		for _, teamID := range teamIDs {
+			if template.TeamID != nil && *template.TeamID == teamID {
+				templates = append(templates, *template)
+			}
+		}
+	}
+	return templates, nil
+}
+
+func (f *fakeTemplateStore) UpdatePromptTemplate(ctx context.Context, templateID int64, fields map[string]interface{}) error {
+	template := f.templates[templateID]
+	if template == nil {
+		return nil
+	}
+	template.Name, _ = fields["name"].(string)
+	template.Description, _ = fields["description"].(string)
+	template.Content, _ = fields["content"].(string)
+	return nil
+}
+
+func (f *fakeTemplateStore) DeletePromptTemplate(ctx context.Context, templateID int64) error {
+	f.deleted = append(f.deleted, templateID)
+	delete(f.templates, templateID)
+	return nil
+}
+
+func (f *fakeTemplateStore) ListTeamMembershipsByUser(ctx context.Context, userID int64) ([]db.TeamMember, error) {
+	return f.memberships[userID], nil
+}
+
+func newTemplateServiceForTest(store *fakeTemplateStore) *TemplateService {
+	service := NewTemplateService(nil)
+	service.store = store
+	service.now = func() time.Time {
+		return time.Date(2026, 4, 16, 9, 0, 0, 0, time.UTC)
+	}
+	return service
+}
+
+func TestRenderTemplateContentSubstitutesVariables(t *testing.T) {
+	got, err := RenderTemplateContent("Review {{ file }} on {{branch}}, then push {{branch}}", map[string]string{
+		"branch": "feature/login",
+		"file":   "auth.go",
+		"extra":  "ignored",
+	})
+	if err != nil {
+		t.Fatalf("RenderTemplateContent: %v", err)
+	}
+	if want := "Review auth.go on feature/login, then push feature/login"; got != want {
+		t.Fatalf("rendered = %q, want %q", got, want)
+	}
+
+	if _, err := RenderTemplateContent("Fix {{file}} on {{branch}}", map[string]string{"file": "a.go"}); !errors.Is(err, ErrMissingTemplateVariable) {
+		t.Fatalf("err = %v, want ErrMissingTemplateVariable", err)
+	}
+}
+
+func TestTemplateServiceSharesTeamTemplatesWithMembers(t *testing.T) {
+	store := newFakeTemplateStore()
+	teamID := int64(3)
+	store.memberships[7] = []db.TeamMember{{TeamID: teamID, UserID: 7, Role: "member"}}
+	store.memberships[8] = []db.TeamMember{{TeamID: teamID, UserID: 8, Role: "admin"}}
+	service := newTemplateServiceForTest(store)
+
+	personal, err := service.CreateTemplate(context.Background(), 7, TemplateInput{Name: "Review", Content: "Review {{file}}"})
+	if err != nil {
+		t.Fatalf("CreateTemplate personal: %v", err)
+	}
+	if len(personal.Variables) != 1 || personal.Variables[0] != "file" {
+		t.Fatalf("Variables = %v, want [file]", personal.Variables)
+	}
+	shared, err := service.CreateTemplate(context.Background(), 7, TemplateInput{Name: "Rebase", Content: "git rebase {{branch}}", TeamID: &teamID})
+	if err != nil {
+		t.Fatalf("CreateTemplate team: %v", err)
+	}
+
+	other := int64(9)
+	if _, err := service.CreateTemplate(context.Background(), 7, TemplateInput{Name: "X", Content: "y", TeamID: &other}); !errors.Is(err, ErrInvalidTemplate) {
+		t.Fatalf("err = %v, want ErrInvalidTemplate for foreign team", err)
+	}
+
+	templates, err := service.ListTemplates(context.Background(), 8)
+	if err != nil {
+		t.Fatalf("ListTemplates: %v", err)
+	}
+	if len(templates) != 1 || templates[0].ID != shared.ID {
+		t.Fatalf("templates = %+v, want only the team template", templates)
+	}
+
+	if _, err := service.RenderTemplate(context.Background(), 8, personal.ID, map[string]string{"file": "a.go"}); err != ErrTemplateNotFound {
+		t.Fatalf("err = %v, want ErrTemplateNotFound for another user's template", err)
+	}
+	rendered, err := service.RenderTemplate(context.Background(), 8, shared.ID, map[string]string{"branch": "main"})
+	if err != nil || rendered != "git rebase main" {
+		t.Fatalf("rendered = %q, %v; want team template rendered", rendered, err)
+	}
+}
+
+func TestTemplateServiceRestrictsEditsToAuthorAndTeamAdmins(t *testing.T) {
+	store := newFakeTemplateStore()
+	teamID := int64(3)
+	store.memberships[7] = []db.TeamMember{{TeamID: teamID, UserID: 7, Role: "member"}}
+	store.memberships[8] = []db.TeamMember{{TeamID: teamID, UserID: 8, Role: "admin"}}
+	store.memberships[10] = []db.TeamMember{{TeamID: teamID, UserID: 10, Role: "member"}}
+	service := newTemplateServiceForTest(store)
+
+	shared, _ := service.CreateTemplate(context.Background(), 7, TemplateInput{Name: "Rebase", Content: "git rebase {{branch}}", TeamID: &teamID})
+	input := TemplateInput{Name: "Rebase onto", Content: "git rebase {{base}}"}
+
+	if _, err := service.UpdateTemplate(context.Background(), 10, shared.ID, input); err != ErrTemplateForbidden {
+		t.Fatalf("err = %v, want ErrTemplateForbidden for plain member", err)
+	}
+	updated, err := service.UpdateTemplate(context.Background(), 8, shared.ID, input)
+	if err != nil {
+		t.Fatalf("UpdateTemplate admin: %v", err)
+	}
+	if updated.Name != "Rebase onto" || updated.Variables[0] != "base" {
+		t.Fatalf("updated = %+v, want new name and variables", updated)
+	}
+	if err := service.DeleteTemplate(context.Background(), 7, shared.ID); err != nil {
+		t.Fatalf("DeleteTemplate author: %v", err)
+	}
+	if len(store.deleted) != 1 {
+		t.Fatalf("deleted = %v, want one template", store.deleted)
+	}
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/mobile-coder/cloud/internal/db"
+)
+
+// WorkspaceFile is a changed path reported by the agent.
+type WorkspaceFile struct {
+	Path      string `json:"path"`
+	Status    string `json:"status"`
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+	Binary    bool   `json:"binary,omitempty"`
+}
+
+// WorkspaceCommit is the HEAD commit of the project repository.
+type WorkspaceCommit struct {
+	Hash        string `json:"hash"`
+	Subject     string `json:"subject"`
+	Author      string `json:"author"`
+	CommittedAt string `json:"committed_at"`
+}
+
+// WorkspaceStatus is the latest git state of the project a task runs in,
+// as sent by the agent in workspace_status messages.
+type WorkspaceStatus struct {
+	IsRepo       bool             `json:"is_repo"`
+	Branch       string           `json:"branch,omitempty"`
+	Upstream     string           `json:"upstream,omitempty"`
+	Ahead        int              `json:"ahead"`
+	Behind       int              `json:"behind"`
+	Dirty        bool             `json:"dirty"`
+	FilesChanged int              `json:"files_changed"`
+	Additions    int              `json:"additions"`
+	Deletions    int              `json:"deletions"`
+	Files        []WorkspaceFile  `json:"files"`
+	LastCommit   *WorkspaceCommit `json:"last_commit,omitempty"`
+	UpdatedAt    string           `json:"updated_at,omitempty"`
+}
+
+// DiffSummary is the one-line change total shown on task cards and in
+// completion notifications.
+func (w *WorkspaceStatus) DiffSummary() string {
+	noun := "files"
+	if w.FilesChanged == 1 {
+		noun = "file"
+	}
+	return fmt.Sprintf("%d %s changed, +%d/-%d", w.FilesChanged, noun, w.Additions, w.Deletions)
+}
+
+// workspaceEntry is a cached workspace status and the session that reported
+// it. The cache only saves decoding the record while the agent is connected.
+type workspaceEntry struct {
+	session string
+	status  *WorkspaceStatus
+}
+
+// HandleWorkspaceStatus stores the git status an agent reported for a
+// session on the task currently running in it.
+func (s *TaskService) HandleWorkspaceStatus(ctx context.Context, deviceID, sessionName string, payload json.RawMessage) error {
+	var status WorkspaceStatus
+	if err := json.Unmarshal(payload, &status); err != nil {
+		return fmt.Errorf("invalid workspace status: %w", err)
+	}
+	status.UpdatedAt = s.now().UTC().Format(time.RFC3339)
+
+	taskID := s.ResolveTaskID(ctx, deviceID, sessionName)
+	s.mu.Lock()
+	if s.workspaces == nil {
+		s.workspaces = make(map[string]workspaceEntry)
+	}
+	s.workspaces[taskID] = workspaceEntry{session: sessionTaskID(deviceID, sessionName), status: &status}
+	s.mu.Unlock()
+
+	if s.records == nil {
+		return nil
+	}
+	return s.records.UpdateTask(ctx, taskID, map[string]interface{}{
+		"workspace":  status,
+		"updated_at": status.UpdatedAt,
+	})
+}
+
+// attachWorkspace sets the latest known workspace status on the task,
+// falling back to the one persisted on its record.
+func (s *TaskService) attachWorkspace(task *Task, record *db.Task) {
+	s.mu.Lock()
+	status := s.workspaces[task.ID].status
+	s.mu.Unlock()
+	if status != nil {
+		task.Workspace = status
+		return
+	}
+	if record == nil || len(record.Workspace) == 0 || string(record.Workspace) == "null" {
+		return
+	}
+
+	var stored WorkspaceStatus
+	if err := json.Unmarshal(record.Workspace, &stored); err != nil {
+		slog.Warn("task service: decode workspace failed", "task_id", task.ID, "error", err)
+		return
+	}
+	task.Workspace = &stored
+}
+
+// ForgetSession drops the cached workspace status of a session once its
+// agent disconnects or the session is deleted; the record keeps the last one.
+func (s *TaskService) ForgetSession(deviceID, sessionName string) {
+	key := sessionTaskID(deviceID, sessionName)
+	s.forgetWorkspaces(func(session string) bool { return session == key })
+}
+
+// ForgetDevice drops the cached workspace status of every session of a
+// deleted device.
+func (s *TaskService) ForgetDevice(deviceID string) {
+	s.forgetWorkspaces(func(session string) bool {
+		return session == deviceID || strings.HasPrefix(session, deviceID+":")
+	})
+}
+
+func (s *TaskService) forgetWorkspaces(match func(session string) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for taskID, entry := range s.workspaces {
+		if match(entry.session) {
+			delete(s.workspaces, taskID)
+		}
+	}
+}
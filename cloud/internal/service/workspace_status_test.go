@@ -0,0 +1,95 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+const workspacePayload = `{"is_repo":true,"branch":"feature/login","ahead":1,"behind":0,"dirty":true,"files_changed":5,"additions":120,"deletions":30,"files":[{"path":"main.go","status":"modified","additions":100,"deletions":30}],"last_commit":{"hash":"abc123","subject":"Fix login","author":"Ada","committed_at":"2026-04-17T10:00:00Z"}}`
+
+func TestTaskServiceStoresWorkspaceStatusOnTask(t *testing.T) {
+	store := newFakeTaskRecordStore()
+	source := singleSessionSource("active")
+	service := newTaskServiceWithRecords(source, store)
+	if err := service.RefreshTasksForUser(context.Background(), 7); err != nil {
+		t.Fatalf("RefreshTasksForUser: %v", err)
+	}
+
+	if err := service.HandleWorkspaceStatus(context.Background(), "dev-1", "feature", json.RawMessage(workspacePayload)); err != nil {
+		t.Fatalf("HandleWorkspaceStatus: %v", err)
+	}
+
+	task, err := service.GetTaskForUser(context.Background(), 7, "dev-1:feature")
+	if err != nil {
+		t.Fatalf("GetTaskForUser: %v", err)
+	}
+	if task.Workspace == nil || task.Workspace.Branch != "feature/login" || task.Workspace.LastCommit.Subject != "Fix login" {
+		t.Fatalf("task.Workspace = %+v, want reported status", task.Workspace)
+	}
+	if got := task.Workspace.DiffSummary(); got != "5 files changed, +120/-30" {
+		t.Fatalf("DiffSummary = %q", got)
+	}
+
+	// A restarted server reads the status persisted on the record.
+	restarted := newTaskServiceWithRecords(source, store)
+	task, err = restarted.GetTaskForUser(context.Background(), 7, "dev-1:feature")
+	if err != nil {
+		t.Fatalf("GetTaskForUser after restart: %v", err)
+	}
+	if task.Workspace == nil || task.Workspace.FilesChanged != 5 {
+		t.Fatalf("task.Workspace after restart = %+v, want persisted status", task.Workspace)
+	}
+}
+
+func TestTaskServiceRejectsInvalidWorkspaceStatus(t *testing.T) {
+	service := newTaskServiceWithRecords(singleSessionSource("active"), newFakeTaskRecordStore())
+	if err := service.HandleWorkspaceStatus(context.Background(), "dev-1", "feature", json.RawMessage(`"oops"`)); err == nil {
+		t.Fatal("expected error for invalid payload")
+	}
+}
+
+func TestTaskCompletionNotificationIncludesDiffSummary(t *testing.T) {
+	source := singleSessionSource("inactive")
+	emitter := &fakeTaskNotificationEmitter{}
+	service := NewTaskService(source, &fakeTaskEventSource{})
+	service.notificationEmitter = emitter
+	if err := service.HandleWorkspaceStatus(context.Background(), "dev-1", "feature", json.RawMessage(workspacePayload)); err != nil {
+		t.Fatalf("HandleWorkspaceStatus: %v", err)
+	}
+
+	if err := service.RefreshTasksForUser(context.Background(), 7); err != nil {
+		t.Fatalf("RefreshTasksForUser: %v", err)
+	}
+	if len(emitter.calls) != 1 || emitter.calls[0].eventType != NotificationEventTaskCompleted {
+		t.Fatalf("calls = %+v, want one completion notification", emitter.calls)
+	}
+	if want := "feature 已完成（5 files changed, +120/-30），可以查看结果。"; emitter.calls[0].body != want {
+		t.Fatalf("body = %q, want %q", emitter.calls[0].body, want)
+	}
+}
+
+func TestTaskServiceForgetsWorkspaceOfGoneSessions(t *testing.T) {
+	service := NewTaskService(singleSessionSource("active"), &fakeTaskEventSource{})
+	for _, session := range []string{"feature", "bugfix"} {
+		if err := service.HandleWorkspaceStatus(context.Background(), "dev-1", session, json.RawMessage(workspacePayload)); err != nil {
+			t.Fatalf("HandleWorkspaceStatus(%s): %v", session, err)
+		}
+	}
+	if err := service.HandleWorkspaceStatus(context.Background(), "dev-2", "feature", json.RawMessage(workspacePayload)); err != nil {
+		t.Fatalf("HandleWorkspaceStatus(dev-2): %v", err)
+	}
+
+	service.HandleAgentPresence(AgentPresence{DeviceID: "dev-1", SessionName: "feature", DeviceOnline: true})
+	if _, ok := service.workspaces["dev-1:feature"]; ok {
+		t.Fatal("workspace of a disconnected session still cached")
+	}
+	if len(service.workspaces) != 2 {
+		t.Fatalf("workspaces = %v, want the other sessions kept", service.workspaces)
+	}
+
+	service.ForgetDevice("dev-1")
+	if _, ok := service.workspaces["dev-2:feature"]; !ok || len(service.workspaces) != 1 {
+		t.Fatalf("workspaces = %v, want only dev-2:feature", service.workspaces)
+	}
+}
@@ -0,0 +1,146 @@
+package ws
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backplane connects the hubs of several cloud replicas: messages for
+// clients connected elsewhere are published on a channel, and state that
+// late joiners need (terminal snapshots, which agents are online) is kept
+// in a shared key/value store with expiry.
+type Backplane interface {
+	Publish(channel string, message []byte) error
+	// Subscribe calls handler for every message on channel, in order and
+	// one at a time, until Close.
+	Subscribe(channel string, handler func(message []byte)) error
+	Set(key string, value []byte, ttl time.Duration) error
+	// Get returns ErrBackplaneMiss for missing or expired keys.
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+	Close() error
+}
+
+var ErrBackplaneMiss = errors.New("backplane key not found")
+
+// NewBackplane returns the backplane configured by url: "" for none (a
+// single replica), "memory" for hubs in one process, or redis://host:port.
+func NewBackplane(url string) (Backplane, error) {
+	switch {
+	case url == "":
+		return nil, nil
+	case url == "memory":
+		return NewMemoryBackplane(), nil
+	case strings.HasPrefix(url, "redis://"):
+		return NewRedisBackplane(url)
+	}
+	return nil, errors.New("unsupported backplane url: " + url)
+}
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+type memorySubscriber struct {
+	messages chan []byte
+	done     chan struct{}
+}
+
+// MemoryBackplane is a Backplane for hubs in the same process; tests use
+// it to run several replicas side by side.
+type MemoryBackplane struct {
+	mu          sync.Mutex
+	subscribers map[string][]*memorySubscriber
+	values      map[string]memoryEntry
+	closed      bool
+}
+
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{
+		subscribers: make(map[string][]*memorySubscriber),
+		values:      make(map[string]memoryEntry),
+	}
+}
+
+func (b *MemoryBackplane) Publish(channel string, message []byte) error {
+	b.mu.Lock()
+	subscribers := b.subscribers[channel]
+	b.mu.Unlock()
+	for _, subscriber := range subscribers {
+		copied := append([]byte(nil), message...)
+		select {
+		case subscriber.messages <- copied:
+		case <-subscriber.done:
+		}
+	}
+	return nil
+}
+
+func (b *MemoryBackplane) Subscribe(channel string, handler func(message []byte)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errors.New("backplane closed")
+	}
+	subscriber := &memorySubscriber{messages: make(chan []byte, 1024), done: make(chan struct{})}
+	b.subscribers[channel] = append(b.subscribers[channel], subscriber)
+	go func() {
+		for {
+			select {
+			case message := <-subscriber.messages:
+				handler(message)
+			case <-subscriber.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (b *MemoryBackplane) Set(key string, value []byte, ttl time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entry := memoryEntry{value: append([]byte(nil), value...)}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+	b.values[key] = entry
+	return nil
+}
+
+func (b *MemoryBackplane) Get(key string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entry, ok := b.values[key]
+	if !ok || (!entry.expires.IsZero() && time.Now().After(entry.expires)) {
+		delete(b.values, key)
+		return nil, ErrBackplaneMiss
+	}
+	return append([]byte(nil), entry.value...), nil
+}
+
+func (b *MemoryBackplane) Delete(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.values, key)
+	return nil
+}
+
+func (b *MemoryBackplane) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	for _, subscribers := range b.subscribers {
+		for _, subscriber := range subscribers {
+			close(subscriber.done)
+		}
+	}
+	b.subscribers = map[string][]*memorySubscriber{}
+	return nil
+}
@@ -0,0 +1,347 @@
+package ws
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mobile-coder/cloud/internal/service"
+)
+
+// testBackplaneContract checks what the hub relies on: ordered fan-out to
+// every subscriber and expiring keys.
+func testBackplaneContract(t *testing.T, first, second Backplane) {
+	t.Helper()
+	received := make(chan string, 16)
+	for _, b := range []Backplane{first, second} {
+		if err := b.Subscribe("events", func(message []byte) { received <- string(message) }); err != nil {
+			t.Fatalf("Subscribe: %v", err)
+		}
+	}
+	if err := first.Subscribe("other", func([]byte) { t.Error("message crossed channels") }); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := first.Publish("events", []byte("m"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+	}
+	got := map[string]int{}
+	var order []string
+	for i := 0; i < 6; i++ {
+		select {
+		case message := <-received:
+			got[message]++
+			order = append(order, message)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("received %v, want every message twice", order)
+		}
+	}
+	if got["m0"] != 2 || got["m1"] != 2 || got["m2"] != 2 {
+		t.Fatalf("received %v", order)
+	}
+
+	if err := first.Set("snapshot", []byte("screen"), time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if value, err := second.Get("snapshot"); err != nil || string(value) != "screen" {
+		t.Fatalf("Get = %q, %v", value, err)
+	}
+	first.Set("short", []byte("x"), 20*time.Millisecond)
+	time.Sleep(60 * time.Millisecond)
+	if _, err := second.Get("short"); !errors.Is(err, ErrBackplaneMiss) {
+		t.Fatalf("expired key: err = %v, want ErrBackplaneMiss", err)
+	}
+	second.Delete("snapshot")
+	if _, err := first.Get("snapshot"); !errors.Is(err, ErrBackplaneMiss) {
+		t.Fatalf("deleted key: err = %v, want ErrBackplaneMiss", err)
+	}
+}
+
+func TestMemoryBackplane(t *testing.T) {
+	backplane := NewMemoryBackplane()
+	defer backplane.Close()
+	testBackplaneContract(t, backplane, backplane)
+}
+
+func TestRedisBackplaneAgainstLocalStandIn(t *testing.T) {
+	server := newFakeRedis(t, "secret")
+	defer server.Close()
+
+	url := "redis://:secret@" + server.Addr()
+	first, err := NewRedisBackplane(url)
+	if err != nil {
+		t.Fatalf("NewRedisBackplane: %v", err)
+	}
+	defer first.Close()
+	second, err := NewRedisBackplane(url)
+	if err != nil {
+		t.Fatalf("NewRedisBackplane: %v", err)
+	}
+	defer second.Close()
+	testBackplaneContract(t, first, second)
+
+	if _, err := NewRedisBackplane("redis://:wrong@" + server.Addr()); err == nil {
+		t.Fatal("wrong password should fail")
+	}
+}
+
+func TestHubsShareAgentsAndViewersThroughBackplane(t *testing.T) {
+	backplane := NewMemoryBackplane()
+	defer backplane.Close()
+	replicaA, replicaB := NewHub(), NewHub()
+	for _, hub := range []*Hub{replicaA, replicaB} {
+		if err := hub.SetBackplane(backplane); err != nil {
+			t.Fatalf("SetBackplane: %v", err)
+		}
+		go hub.Run()
+	}
+
+	// The agent is connected to replica A, the phone to replica B
+	agent := &Client{DeviceID: "dev-1", SessionName: "feature", IsAgent: true, Send: make(chan []byte, 16)}
+	replicaA.Register(agent)
+	replicaA.SetAgentInfo(agent, &service.AgentInfo{Version: "v1.5.0", Compatible: true,
+		Capabilities: []string{service.CapabilityDiff, service.CapabilityResume}})
+	replicaA.ResumeToAgent(agent, "", 0)
+	viewer := &Client{DeviceID: "dev-1", SessionName: "feature", UserID: 42, Send: make(chan []byte, 16)}
+	replicaB.Register(viewer)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for replicaB.AgentInfo("dev-1") == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("replica B never saw the agent on replica A")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, online := replicaB.AgentLastSeen("dev-1"); !online {
+		t.Fatal("AgentLastSeen on replica B = offline")
+	}
+
+	output := []byte(`{"type":"terminal_output","payload":{"content":"$ go test\nok\n"}}`)
+	replicaA.BroadcastToViewers(context.Background(), "dev-1", "feature", output)
+	expectMessage(t, viewer.Send, "ok")
+
+	// A phone joining replica B later still gets the snapshot
+	late := &Client{DeviceID: "dev-1", SessionName: "feature", UserID: 42, Send: make(chan []byte, 16)}
+	replicaB.Register(late)
+	replicaB.SendLastOutput(late)
+	expectMessage(t, late.Send, "go test")
+
+	if !replicaB.DeliverToAgent(context.Background(), "dev-1", "feature", []byte(`{"type":"terminal_input","payload":{"data":"ls\n"}}`)) {
+		t.Fatal("DeliverToAgent on replica B = false")
+	}
+	expectMessage(t, agent.Send, "ls")
+
+	replies := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_, err := replicaB.RequestAgent(ctx, "dev-1", "feature", "get_diff", map[string]string{})
+		replies <- err
+	}()
+	request, _ := DecodeEnvelope(expectMessage(t, agent.Send, "get_diff"))
+	replicaA.DeliverResponse(agent, []byte(`{"reply_to":"`+request.ID+`","type":"get_diff_result","payload":{}}`))
+	if err := <-replies; err != nil {
+		t.Fatalf("RequestAgent across replicas: %v", err)
+	}
+	if _, err := replicaB.RequestAgent(context.Background(), "dev-1", "feature", "list_dir", nil); !errors.Is(err, service.ErrAgentUnsupported) {
+		t.Fatalf("err = %v, want capabilities of the remote agent honoured", err)
+	}
+
+	replicaA.Unregister(agent)
+	deadline = time.Now().Add(2 * time.Second)
+	for replicaB.AgentInfo("dev-1") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("agent record outlived the agent")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestAgentStreamMovesBetweenReplicas(t *testing.T) {
+	backplane := NewMemoryBackplane()
+	defer backplane.Close()
+	replicaA, replicaB := NewHub(), NewHub()
+	replicaA.SetBackplane(backplane)
+	replicaB.SetBackplane(backplane)
+	info := &service.AgentInfo{Capabilities: []string{service.CapabilityResume}}
+	input := func(data string) []byte {
+		return []byte(`{"type":"terminal_input","payload":{"data":"` + data + `"}}`)
+	}
+
+	first := &Client{DeviceID: "dev-1", SessionName: "feature", IsAgent: true, Send: make(chan []byte, 4), Info: info}
+	replicaA.addClient(first)
+	streamID, _ := replicaA.OpenAgentStream(first, "agent-1")
+	replicaA.ResumeToAgent(first, "", 0)
+	replicaA.DeliverToAgent(context.Background(), "dev-1", "feature", input("a"))
+	if env, _ := DecodeEnvelope(<-first.Send); env.Seq != 1 {
+		t.Fatalf("seq = %d, want 1", env.Seq)
+	}
+	replicaA.ReceiveFromAgent(first, 1)
+	replicaA.removeClient(first)
+
+	// Typed on replica B while the agent is away, then the agent
+	// reconnects to replica B
+	replicaB.DeliverToAgent(context.Background(), "dev-1", "feature", input("b"))
+	second := &Client{DeviceID: "dev-1", SessionName: "feature", IsAgent: true, Send: make(chan []byte, 4), Info: info}
+	replicaB.addClient(second)
+	id, received := replicaB.OpenAgentStream(second, "agent-1")
+	if id != streamID || received != 1 {
+		t.Fatalf("OpenAgentStream on replica B = %s, %d; want %s, 1", id, received, streamID)
+	}
+	replicaB.ResumeToAgent(second, streamID, 1)
+	env, _ := DecodeEnvelope(<-second.Send)
+	if env.Seq != 2 || !strings.Contains(string(env.Payload), `"b"`) || len(second.Send) != 0 {
+		t.Fatalf("replayed seq %d %s and %d more, want only seq 2 with b", env.Seq, env.Payload, len(second.Send))
+	}
+
+	replicaB.ForgetSession("dev-1", "feature")
+	if _, err := backplane.Get(streamKeyPrefix + string(SessionRoom("dev-1", "feature"))); !errors.Is(err, ErrBackplaneMiss) {
+		t.Fatalf("shared stream after ForgetSession: err = %v, want ErrBackplaneMiss", err)
+	}
+}
+
+func expectMessage(t *testing.T, messages chan []byte, contains string) []byte {
+	t.Helper()
+	select {
+	case message := <-messages:
+		if !strings.Contains(string(message), contains) {
+			t.Fatalf("message = %s, want %q", message, contains)
+		}
+		return message
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no message containing %q", contains)
+	}
+	return nil
+}
+
+// fakeRedis is a local stand-in for Redis with the commands the backplane
+// uses: AUTH, PUBLISH, SUBSCRIBE, SET [PX], GET and DEL.
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	mu          sync.Mutex
+	values      map[string]memoryEntry
+	subscribers map[string][]*fakeRedisConn
+}
+
+type fakeRedisConn struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (c *fakeRedisConn) write(reply string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.Write([]byte(reply))
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	server := &fakeRedis{
+		listener:    listener,
+		password:    password,
+		values:      make(map[string]memoryEntry),
+		subscribers: make(map[string][]*fakeRedisConn),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(&fakeRedisConn{conn: conn})
+		}
+	}()
+	return server
+}
+
+func (s *fakeRedis) Addr() string { return s.listener.Addr().String() }
+
+func (s *fakeRedis) Close() { s.listener.Close() }
+
+func bulk(value string) string {
+	return "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+}
+
+func (s *fakeRedis) serve(conn *fakeRedisConn) {
+	defer conn.conn.Close()
+	reader := bufio.NewReader(conn.conn)
+	authed := s.password == ""
+	for {
+		request, err := readRESP(reader)
+		if err != nil {
+			return
+		}
+		items, _ := request.([]interface{})
+		var args []string
+		for _, item := range items {
+			value, _ := item.([]byte)
+			args = append(args, string(value))
+		}
+		if len(args) == 0 {
+			conn.write("-ERR empty command\r\n")
+			continue
+		}
+		command := strings.ToUpper(args[0])
+		if command == "AUTH" {
+			if len(args) == 2 && args[1] == s.password {
+				authed = true
+				conn.write("+OK\r\n")
+			} else {
+				conn.write("-WRONGPASS invalid password\r\n")
+			}
+			continue
+		}
+		if !authed {
+			conn.write("-NOAUTH Authentication required.\r\n")
+			continue
+		}
+
+		s.mu.Lock()
+		switch command {
+		case "PUBLISH":
+			subscribers := s.subscribers[args[1]]
+			message := "*3\r\n" + bulk("message") + bulk(args[1]) + bulk(args[2])
+			for _, subscriber := range subscribers {
+				subscriber.write(message)
+			}
+			conn.write(":" + strconv.Itoa(len(subscribers)) + "\r\n")
+		case "SUBSCRIBE":
+			s.subscribers[args[1]] = append(s.subscribers[args[1]], conn)
+			conn.write("*3\r\n" + bulk("subscribe") + bulk(args[1]) + ":1\r\n")
+		case "SET":
+			entry := memoryEntry{value: []byte(args[2])}
+			if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+				ms, _ := strconv.Atoi(args[4])
+				entry.expires = time.Now().Add(time.Duration(ms) * time.Millisecond)
+			}
+			s.values[args[1]] = entry
+			conn.write("+OK\r\n")
+		case "GET":
+			entry, ok := s.values[args[1]]
+			if !ok || (!entry.expires.IsZero() && time.Now().After(entry.expires)) {
+				conn.write("$-1\r\n")
+			} else {
+				conn.write(bulk(string(entry.value)))
+			}
+		case "DEL":
+			delete(s.values, args[1])
+			conn.write(":1\r\n")
+		default:
+			conn.write("-ERR unknown command\r\n")
+		}
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,183 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/mobile-coder/cbor"
+)
+
+func TestDecodeFrameReadsBothEncodings(t *testing.T) {
+	text := []byte(`{"id":"req-1","type":"get_diff_result","version":1,"payload":{"files":[{"path":"main.go","additions":12}],"summary":"ок ✓"}}`)
+	frame, err := cbor.FromJSON(text)
+	if err != nil {
+		t.Fatalf("FromJSON: %v", err)
+	}
+
+	for name, tc := range map[string]struct {
+		messageType int
+		frame       []byte
+	}{
+		"json": {websocket.TextMessage, text},
+		"cbor": {websocket.BinaryMessage, frame},
+	} {
+		envelope, message, err := DecodeFrame(tc.messageType, tc.frame)
+		if err != nil {
+			t.Fatalf("%s: DecodeFrame: %v", name, err)
+		}
+		if envelope.ID != "req-1" || envelope.Type != "get_diff_result" || envelope.Version != 1 {
+			t.Fatalf("%s: envelope = %+v", name, envelope)
+		}
+		var want, got interface{}
+		json.Unmarshal(text, &want)
+		json.Unmarshal(message, &got)
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("%s: message = %s, want %s", name, message, text)
+		}
+	}
+
+	for name, bad := range map[string][]byte{
+		"upload chunk": []byte("MCUP\x01"),
+		"truncated":    frame[:len(frame)-2],
+		"no type":      {0xa0},
+	} {
+		if _, _, err := DecodeFrame(websocket.BinaryMessage, bad); err == nil {
+			t.Fatalf("%s: DecodeFrame accepted a malformed frame", name)
+		}
+	}
+}
+
+// terminalOutputFixture is a realistic 5000-line terminal_output envelope:
+// colored test runner output with paths, timings and some repetition.
+func terminalOutputFixture() []byte {
+	var content strings.Builder
+	for i := 0; i < 5000; i++ {
+		switch i % 5 {
+		case 0:
+			fmt.Fprintf(&content, "\x1b[32m=== RUN\x1b[0m   TestHandler/case_%d\n", i)
+		case 1:
+			fmt.Fprintf(&content, "    handler_test.go:%d: request \"/api/tasks?id=%d\" -> 200 OK (%d.%03dms)\n", 40+i%300, i, i%17, i%1000)
+		case 2:
+			fmt.Fprintf(&content, "\x1b[2m[%05d]\x1b[0m internal/service/task_service.go:%d +0x%x\n", i, i%900, i*7919)
+		case 3:
+			fmt.Fprintf(&content, "\x1b[1;34m●\x1b[0m Reading cloud/internal/ws/hub.go (%d lines)\n", 300+i%200)
+		default:
+			fmt.Fprintf(&content, "\x1b[32m--- PASS\x1b[0m: TestHandler/case_%d (0.%02ds)\n", i-4, i%100)
+		}
+	}
+	message, _ := EncodeEnvelope("", "terminal_output", map[string]interface{}{
+		"content":      content.String(),
+		"session_name": "claude-feature",
+		"timestamp":    1761000000123,
+	})
+	return message
+}
+
+// countingConn counts the bytes a connection writes to the network.
+type countingConn struct {
+	net.Conn
+	written *int64
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	atomic.AddInt64(c.written, int64(len(p)))
+	return c.Conn.Write(p)
+}
+
+// wireBytes sends message through a real WebSocket connection and returns
+// the bytes the sender put on the wire, including frame headers.
+func wireBytes(t testing.TB, message []byte, compression bool, encoding string) int64 {
+	t.Helper()
+	received := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{EnableCompression: compression}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		messageType, frame, err := conn.ReadMessage()
+		if err != nil {
+			received <- nil
+			return
+		}
+		_, decoded, _ := DecodeFrame(messageType, frame)
+		received <- decoded
+	}))
+	defer server.Close()
+
+	var written int64
+	dialer := websocket.Dialer{
+		EnableCompression: compression,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return countingConn{Conn: conn, written: &written}, nil
+		},
+	}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	handshake := atomic.LoadInt64(&written)
+	client := &Client{}
+	client.SetEncoding(encoding)
+	if err := conn.WriteMessage(OutgoingFrame(client, message)); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+	if decoded := <-received; !json.Valid(decoded) || len(decoded) < len(message)/2 {
+		t.Fatalf("server received %d bytes of invalid envelope", len(decoded))
+	}
+	return atomic.LoadInt64(&written) - handshake
+}
+
+func TestTerminalOutputBytesOnTheWire(t *testing.T) {
+	message := terminalOutputFixture()
+
+	plain := wireBytes(t, message, false, EncodingJSON)
+	cbor := wireBytes(t, message, false, EncodingCBOR)
+	deflate := wireBytes(t, message, true, EncodingJSON)
+	cborDeflate := wireBytes(t, message, true, EncodingCBOR)
+	t.Logf("5000-line terminal_output on the wire: json=%d cbor=%d json+deflate=%d cbor+deflate=%d bytes", plain, cbor, deflate, cborDeflate)
+
+	if cbor >= plain {
+		t.Fatalf("cbor = %d bytes, want less than json %d", cbor, plain)
+	}
+	if deflate*4 > plain || cborDeflate*4 > plain {
+		t.Fatalf("deflate should cut terminal output at least 4x: json=%d json+deflate=%d cbor+deflate=%d", plain, deflate, cborDeflate)
+	}
+}
+
+func BenchmarkTerminalOutputWire(b *testing.B) {
+	message := terminalOutputFixture()
+	for _, tc := range []struct {
+		name        string
+		compression bool
+		encoding    string
+	}{
+		{"json", false, EncodingJSON},
+		{"cbor", false, EncodingCBOR},
+		{"json+deflate", true, EncodingJSON},
+		{"cbor+deflate", true, EncodingCBOR},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			var total int64
+			for i := 0; i < b.N; i++ {
+				total += wireBytes(b, message, tc.compression, tc.encoding)
+			}
+			b.ReportMetric(float64(total)/float64(b.N), "wire-bytes/op")
+		})
+	}
+}
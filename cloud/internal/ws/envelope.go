@@ -0,0 +1,174 @@
+package ws
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/gorilla/websocket"
+	"github.com/mobile-coder/cbor"
+	"github.com/mobile-coder/cloud/internal/service"
+	"github.com/mobile-coder/tracing"
+)
+
+// ProtocolVersion is the envelope version this server speaks.
+const ProtocolVersion = 1
+
+// MinAgentProtocolVersion is the oldest agent protocol the server accepts.
+const MinAgentProtocolVersion = 1
+
+// Frame encodings an agent can ask for in hello. JSON text frames are the
+// default; CBOR (RFC 8949) binary frames carry the same envelope.
+const (
+	EncodingJSON = "json"
+	EncodingCBOR = "cbor"
+)
+
+// Envelope is the JSON frame exchanged over the hub WebSocket. Plain events
+// (terminal_input, terminal_output, ...) only carry type and payload; a
+// request sets ID and its reply sets ReplyTo to that ID. Messages that must
+// survive a reconnect carry Seq, and an "ack" envelope acknowledges every
+// Seq up to Ack. TraceParent is the W3C trace context of the work that
+// produced the message, e.g. a keystroke on the phone.
+type Envelope struct {
+	ID          string          `json:"id,omitempty"`
+	ReplyTo     string          `json:"reply_to,omitempty"`
+	Type        string          `json:"type"`
+	Version     int             `json:"version,omitempty"`
+	Seq         uint64          `json:"seq,omitempty"`
+	Ack         uint64          `json:"ack,omitempty"`
+	TraceParent string          `json:"traceparent,omitempty"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	Error       *EnvelopeError  `json:"error,omitempty"`
+}
+
+// EnvelopeError is the failure of a request. Code is one of the
+// service.AgentError* codes or "failed".
+type EnvelopeError struct {
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+var errMissingType = errors.New("envelope has no type")
+
+// DecodeEnvelope parses a text frame.
+func DecodeEnvelope(data []byte) (*Envelope, error) {
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+	if envelope.Type == "" && envelope.ReplyTo == "" {
+		return nil, errMissingType
+	}
+	return &envelope, nil
+}
+
+// DecodeFrame decodes a frame read from a client. CBOR frames are decoded
+// straight into the envelope; message is the envelope as JSON, which is
+// what the hub relays to other clients.
+func DecodeFrame(messageType int, frame []byte) (envelope *Envelope, message []byte, err error) {
+	if messageType != websocket.BinaryMessage {
+		envelope, err = DecodeEnvelope(frame)
+		return envelope, frame, err
+	}
+	if !cbor.IsFrame(frame) {
+		return nil, nil, cbor.ErrInvalid
+	}
+	envelope = &Envelope{}
+	if err := cbor.Unmarshal(frame, envelope); err != nil {
+		return nil, nil, err
+	}
+	if envelope.Type == "" && envelope.ReplyTo == "" {
+		return nil, nil, errMissingType
+	}
+	if message, err = json.Marshal(envelope); err != nil {
+		return nil, nil, err
+	}
+	return envelope, message, nil
+}
+
+// EncodeEnvelope builds a frame of msgType around payload.
+func EncodeEnvelope(id, msgType string, payload interface{}) ([]byte, error) {
+	return encodeTracedEnvelope(context.Background(), id, msgType, payload)
+}
+
+// encodeTracedEnvelope is EncodeEnvelope carrying the trace of ctx.
+func encodeTracedEnvelope(ctx context.Context, id, msgType string, payload interface{}) ([]byte, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(Envelope{
+		ID:          id,
+		Type:        msgType,
+		Version:     ProtocolVersion,
+		TraceParent: tracing.TraceParent(ctx),
+		Payload:     raw,
+	})
+}
+
+// EncodeAck builds the envelope acknowledging every message up to seq.
+func EncodeAck(seq uint64) []byte {
+	message, _ := json.Marshal(Envelope{Type: "ack", Version: ProtocolVersion, Ack: seq})
+	return message
+}
+
+// CheckAgentProtocol decides whether the server can talk to an agent. An
+// agent older than MinAgentProtocolVersion is rejected; a newer one keeps
+// its terminal but remote requests are refused.
+func CheckAgentProtocol(agentVersion int) (compatible bool, rejected bool) {
+	switch {
+	case agentVersion < MinAgentProtocolVersion:
+		return false, true
+	case agentVersion > ProtocolVersion:
+		return false, false
+	default:
+		return true, false
+	}
+}
+
+// MessageType names a frame for metrics: the envelope type, "upload_frame"
+// for binary upload chunks, or "other" for anything unexpected so clients
+// cannot invent label values. It looks for the first "type" key instead
+// of decoding, as terminal snapshots are large and envelopes put type
+// before payload.
+func MessageType(message []byte) string {
+	if bytes.HasPrefix(message, []byte(service.UploadFrameMagic)) {
+		return "upload_frame"
+	}
+	key := []byte(`"type":"`)
+	i := bytes.Index(message, key)
+	if i < 0 {
+		return "other"
+	}
+	rest := message[i+len(key):]
+	end := bytes.IndexByte(rest, '"')
+	if end <= 0 || end > 40 {
+		return "other"
+	}
+	for _, c := range rest[:end] {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_') {
+			return "other"
+		}
+	}
+	return string(rest[:end])
+}
+
+// TraceParent returns the traceparent of an envelope without decoding it.
+// Go puts it before the payload, so only the head of the message is
+// searched; large terminal snapshots are not scanned.
+func TraceParent(message []byte) string {
+	head := message[:min(len(message), 512)]
+	key := []byte(`"traceparent":"`)
+	i := bytes.Index(head, key)
+	if i < 0 {
+		return ""
+	}
+	rest := message[i+len(key):]
+	end := bytes.IndexByte(rest, '"')
+	if end < 0 || end > 64 {
+		return ""
+	}
+	return string(rest[:end])
+}
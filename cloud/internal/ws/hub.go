@@ -1,97 +1,207 @@
 package ws
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
-	"log"
+	"fmt"
+	"log/slog"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/mobile-coder/cbor"
 	"github.com/mobile-coder/cloud/internal/service"
+	"github.com/mobile-coder/tracing"
 )
 
-type Message struct {
-	Type    string          `json:"type"`
-	Payload json.RawMessage `json:"payload"`
-}
-
 type Client struct {
 	Conn        *websocket.Conn
 	DeviceID    string
 	UserID      int64
 	IsAgent     bool   // true for Desktop Agent, false for H5 viewer
 	SessionName string // current session name for agent
+	SourceIP    string // address the connection came from, for the audit log
 	Send        chan []byte
+	Info        *service.AgentInfo // hello handshake of an agent, guarded by Hub.mu
+	Logger      *slog.Logger       // carries the connection's request_id, device and session
+	encoding    atomic.Value       // frame encoding chosen in hello, EncodingJSON if unset
+	lastSeen    atomic.Int64       // unix nanos of the last frame or pong
+	rooms       map[Room]bool      // guarded by Hub.mu
+	closed      bool               // Send was closed on unregister, guarded by Hub.mu
+
+	queueMu     sync.Mutex
+	snapshot    []byte        // newest terminal output waiting for room in Send
+	wake        chan struct{} // tells writePump a snapshot is waiting
+	behindSince time.Time     // when the client stopped keeping up, zero if it does
+	dropped     atomic.Uint64
+	coalesced   atomic.Uint64
+	kicked      atomic.Bool // disconnected for being too slow
+}
+
+// Log returns the client's logger, or the default one if it has none.
+func (c *Client) Log() *slog.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return slog.Default()
+}
+
+// SetEncoding switches the frames written to the client to encoding.
+func (c *Client) SetEncoding(encoding string) {
+	c.encoding.Store(encoding)
+}
+
+// Encoding returns the frame encoding of the client.
+func (c *Client) Encoding() string {
+	if encoding, ok := c.encoding.Load().(string); ok {
+		return encoding
+	}
+	return EncodingJSON
+}
+
+// TaskEventHandler receives task events derived from agent terminal output,
+// e.g. to persist them in the task timeline store.
+type TaskEventHandler interface {
+	HandleTaskEvent(ctx context.Context, deviceID, sessionName string, event service.TaskEvent)
 }
 
 type Hub struct {
-	clients       map[string]map[*Client]bool // key can be deviceID or sessionName
-	lastOutput    map[string][]byte           // deviceID -> last terminal output
-	recentEvents  map[string][]service.TaskEvent
-	lastEventLine map[string]string
-	mu            sync.RWMutex
-	register      chan *Client
-	unregister    chan *Client
+	rooms             map[Room]map[*Client]bool // see rooms.go for the routing table
+	lastOutput        map[Room][]byte           // session room -> last terminal output
+	recentEvents      map[string][]service.TaskEvent
+	lastEventLine     map[string]string
+	eventHandlers     []TaskEventHandler
+	taskEvents        chan taskEventJob         // handed to eventHandlers off the agent read loop
+	pending           map[string]pendingRequest // request id -> waiting RequestAgent
+	streams           map[Room]*agentStream     // session room -> reliable input stream of the agent
+	presenceHandlers  []PresenceHandler
+	presenceMu        sync.Mutex
+	presenceQueue     []service.AgentPresence // changes waiting for presenceHandlers, one per session
+	presenceReady     chan struct{}
+	backplane         Backplane // nil with a single replica
+	replicaID         string
+	agentsChanged     chan struct{}
+	slowClientTimeout time.Duration
+	droppedFrames     atomic.Uint64
+	coalescedFrames   atomic.Uint64
+	slowDisconnects   atomic.Uint64
+	mu                sync.RWMutex
+	register          chan *Client
+	unregister        chan *Client
+}
+
+// pendingRequest is a RequestAgent call waiting for its reply. Only the
+// agent it was sent to may answer it.
+type pendingRequest struct {
+	deviceID    string
+	sessionName string // empty for requests to any agent of the device
+	replies     chan *Envelope
+}
+
+// answeredBy reports whether the agent of deviceID and sessionName may
+// reply to the request.
+func (p pendingRequest) answeredBy(deviceID, sessionName string) bool {
+	return p.deviceID == deviceID && (p.sessionName == "" || p.sessionName == sessionName)
 }
 
+// newRequestID returns an unguessable request id, so a reply cannot be
+// aimed at another agent's request by counting.
+func newRequestID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return "req-" + hex.EncodeToString(buf)
+}
+
+// taskEventQueueSize bounds the task events waiting for the handlers.
+const taskEventQueueSize = 1024
+
 var ansiSequencePattern = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]`)
 
-func NewHub() *Hub {
+func NewHub(eventHandlers ...TaskEventHandler) *Hub {
 	return &Hub{
-		clients:       make(map[string]map[*Client]bool),
-		lastOutput:    make(map[string][]byte),
-		recentEvents:  make(map[string][]service.TaskEvent),
-		lastEventLine: make(map[string]string),
-		register:      make(chan *Client),
-		unregister:    make(chan *Client),
+		rooms:             make(map[Room]map[*Client]bool),
+		lastOutput:        make(map[Room][]byte),
+		recentEvents:      make(map[string][]service.TaskEvent),
+		lastEventLine:     make(map[string]string),
+		eventHandlers:     eventHandlers,
+		pending:           make(map[string]pendingRequest),
+		streams:           make(map[Room]*agentStream),
+		taskEvents:        make(chan taskEventJob, taskEventQueueSize),
+		presenceReady:     make(chan struct{}, 1),
+		agentsChanged:     make(chan struct{}, 1),
+		slowClientTimeout: defaultSlowClientTimeout,
+		register:          make(chan *Client),
+		unregister:        make(chan *Client),
 	}
 }
 
 func (h *Hub) Run() {
+	go h.runPresenceHandlers()
+	go h.runTaskEventHandlers()
+	if h.backplane != nil {
+		go h.runAgentRecords()
+	}
+	sweep := time.NewTicker(streamSweepInterval)
+	defer sweep.Stop()
 	for {
 		select {
+		case now := <-sweep.C:
+			h.evictIdleStreams(now)
+
 		case client := <-h.register:
 			h.mu.Lock()
-			// Use sessionName as key if available, otherwise use deviceID
-			key := client.DeviceID
-			if client.SessionName != "" {
-				key = client.SessionName
+			room := client.room()
+			client.Touch()
+			h.addClient(client)
+			client.Log().Debug("hub registered client", "room", room, "room_clients", len(h.rooms[room]))
+			// 会话的第一个 agent 上线
+			changed := client.IsAgent && h.agentCount(room) == 1
+			presence := h.agentPresence(client)
+			h.mu.Unlock()
+			if changed {
+				h.notifyPresence(presence)
 			}
-			if h.clients[key] == nil {
-				h.clients[key] = make(map[*Client]bool)
+			if client.IsAgent && h.backplane != nil {
+				h.markAgentsChanged()
 			}
-			h.clients[key][client] = true
-			log.Printf("Hub: registered client, key=%s, isAgent=%v, totalClients=%d",
-				key, client.IsAgent, len(h.clients[key]))
-			h.mu.Unlock()
 
 		case client := <-h.unregister:
 			h.mu.Lock()
-			// Use sessionName as key if available, otherwise use deviceID
-			key := client.DeviceID
-			if client.SessionName != "" {
-				key = client.SessionName
-			}
-			if clients, ok := h.clients[key]; ok {
-				if _, exists := clients[client]; exists {
-					delete(clients, client)
-					close(client.Send)
-					log.Printf("Hub: unregistered client, key=%s, isAgent=%v, remainingClients=%d",
-						key, client.IsAgent, len(clients))
-				}
-				// 只在没有客户端时删除 key
-				if len(clients) == 0 {
-					delete(h.clients, key)
-					log.Printf("Hub: key=%s has no clients, removed", key)
-				}
+			room := client.room()
+			changed := false
+			if h.removeClient(client) {
+				client.closed = true
+				close(client.Send)
+				client.Log().Debug("hub unregistered client", "room", room, "room_clients", len(h.rooms[room]))
+				// 会话的最后一个 agent 断开（包括心跳超时）
+				changed = client.IsAgent && h.agentCount(room) == 0
 			}
+			presence := h.agentPresence(client)
 			h.mu.Unlock()
+			if changed {
+				h.notifyPresence(presence)
+			}
+			if client.IsAgent && h.backplane != nil {
+				h.markAgentsChanged()
+			}
 		}
 	}
 }
 
+// AddTaskEventHandler registers another receiver of task events. Call it
+// before agents connect.
+func (h *Hub) AddTaskEventHandler(handler TaskEventHandler) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.eventHandlers = append(h.eventHandlers, handler)
+}
+
 func (h *Hub) Register(client *Client) {
 	h.register <- client
 }
@@ -100,87 +210,342 @@ func (h *Hub) Unregister(client *Client) {
 	h.unregister <- client
 }
 
+// SendToDevice sends message to every client of the device on this
+// replica and reports whether any of them took it.
 func (h *Hub) SendToDevice(deviceID string, message []byte) bool {
+	return h.sendToRoom(DeviceRoom(deviceID), message) > 0
+}
+
+// BroadcastToUser sends message to every viewer of the user on this
+// replica.
+func (h *Hub) BroadcastToUser(userID int64, message []byte) {
+	h.sendToRoom(UserRoom(userID), message)
+}
+
+// sendToRoom queues message for every client in room and returns how many
+// took it.
+func (h *Hub) sendToRoom(room Room, message []byte) int {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	if clients, ok := h.clients[deviceID]; ok {
-		for client := range clients {
-			select {
-			case client.Send <- message:
-				return true
-			default:
-				return false
-			}
+	sent := 0
+	for client := range h.rooms[room] {
+		if h.enqueue(client, message) {
+			sent++
 		}
 	}
+	return sent
+}
+
+// SendToAgents sends message only to Desktop Agent clients
+// Uses sessionName if provided, otherwise falls back to deviceID
+// Returns false when no agent accepted the message
+// An agent connected to another replica gets it through the backplane
+func (h *Hub) SendToAgents(deviceID string, sessionName string, message []byte) bool {
+	room := routeRoom(deviceID, sessionName)
+	// Only messages that are part of a trace get a span
+	var span *tracing.Span
+	if traceParent := TraceParent(message); traceParent != "" {
+		_, span = tracing.Start(tracing.Extract(context.Background(), traceParent), "hub.SendToAgents", "room", string(room))
+		defer span.End()
+	}
+	sent, found := h.trySendToAgent(room, message)
+	span.SetAttributes("sent", sent, "remote", !found)
+	if found {
+		slog.Debug("hub send to agent", "room", room, "sent", sent)
+		return sent
+	}
+	if _, ok := h.remoteAgent(room); ok {
+		return h.publish(eventAgent, deviceID, sessionName, message)
+	}
 	return false
 }
 
-func (h *Hub) BroadcastToUser(userID int64, message []byte) {
+// SendToDeviceAgent sends message to one Desktop Agent of the device, whatever
+// session it serves. Used for device-level commands such as creating a session.
+func (h *Hub) SendToDeviceAgent(deviceID string, message []byte) bool {
+	if h.sendToDeviceAgentLocal(deviceID, message) {
+		return true
+	}
+	if _, ok := h.remoteDeviceAgent(deviceID); ok {
+		return h.publish(eventDeviceAgent, deviceID, "", message)
+	}
+	return false
+}
+
+func (h *Hub) sendToDeviceAgentLocal(deviceID string, message []byte) bool {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	for _, clients := range h.clients {
-		for client := range clients {
-			if client.UserID == userID {
-				select {
-				case client.Send <- message:
-				default:
-				}
+
+	for client := range h.rooms[DeviceRoom(deviceID)] {
+		if !client.IsAgent {
+			continue
+		}
+		select {
+		case client.Send <- message:
+			client.Log().Debug("hub sent to device agent")
+			return true
+		default:
+		}
+	}
+	return false
+}
+
+// SendFrameToAgent queues a binary upload frame for the agent of a session.
+// Unlike SendToAgents it waits for room in the send buffer until ctx is done,
+// so a large upload does not overrun a slow agent.
+func (h *Hub) SendFrameToAgent(ctx context.Context, deviceID, sessionName string, frame []byte) error {
+	room := routeRoom(deviceID, sessionName)
+	for {
+		sent, found := h.trySendToAgent(room, frame)
+		if sent {
+			return nil
+		}
+		if !found {
+			if _, ok := h.remoteAgent(room); ok && h.publish(eventAgent, deviceID, sessionName, frame) {
+				return nil
 			}
+			return service.ErrAgentUnavailable
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
 		}
 	}
 }
 
-// SendToAgents sends message only to Desktop Agent clients
-// Uses sessionName if provided, otherwise falls back to deviceID
-func (h *Hub) SendToAgents(deviceID string, sessionName string, message []byte) {
+func (h *Hub) trySendToAgent(room Room, message []byte) (sent, found bool) {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
+	for client := range h.rooms[room] {
+		if !client.IsAgent {
+			continue
+		}
+		select {
+		case client.Send <- message:
+			return true, true
+		default:
+			return false, true
+		}
+	}
+	return false, false
+}
 
-	// Use sessionName as key if available
-	key := deviceID
-	if sessionName != "" {
-		key = sessionName
+// OutgoingFrame tells writePump how to frame a message: upload chunks are
+// binary, envelopes are JSON text or CBOR depending on the client.
+func OutgoingFrame(client *Client, message []byte) (int, []byte) {
+	if bytes.HasPrefix(message, []byte(service.UploadFrameMagic)) {
+		return websocket.BinaryMessage, message
+	}
+	if client.Encoding() == EncodingCBOR {
+		if frame, err := cbor.FromJSON(message); err == nil {
+			return websocket.BinaryMessage, frame
+		}
 	}
+	return websocket.TextMessage, message
+}
 
-	log.Printf("SendToAgents: looking for agents for key=%s, total clients=%d", key, len(h.clients[key]))
-	if clients, ok := h.clients[key]; ok {
-		for client := range clients {
-			log.Printf("SendToAgents: client IsAgent=%v, deviceID=%s, sessionName=%s", client.IsAgent, client.DeviceID, client.SessionName)
-			if client.IsAgent {
-				select {
-				case client.Send <- message:
-					log.Printf("SendToAgents: sent to agent userID=%d", client.UserID)
-				default:
-				}
-				// Only send to the first agent to prevent duplicate messages
-				return
-			}
+// requestCapabilities maps cloud requests to the capability an agent must
+// announce in hello to receive them.
+var requestCapabilities = map[string]string{
+	"get_diff":      service.CapabilityDiff,
+	"git_action":    service.CapabilityGitAction,
+	"list_dir":      service.CapabilityFiles,
+	"read_file":     service.CapabilityFiles,
+	"upload_start":  service.CapabilityUpload,
+	"upload_finish": service.CapabilityUpload,
+	"upload_abort":  service.CapabilityUpload,
+}
+
+// SetAgentInfo stores the hello handshake of an agent client.
+func (h *Hub) SetAgentInfo(client *Client, info *service.AgentInfo) {
+	h.mu.Lock()
+	client.Info = info
+	h.mu.Unlock()
+	if h.backplane != nil {
+		h.markAgentsChanged()
+	}
+}
+
+// AgentInfo returns the handshake of the most recently connected agent of
+// the device, or nil when no agent that sent hello is online.
+func (h *Hub) AgentInfo(deviceID string) *service.AgentInfo {
+	if info := h.localAgentInfo(deviceID); info != nil {
+		return info
+	}
+	if record, ok := h.remoteDeviceAgent(deviceID); ok {
+		return record.Info
+	}
+	return nil
+}
+
+func (h *Hub) localAgentInfo(deviceID string) *service.AgentInfo {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var latest *service.AgentInfo
+	for client := range h.rooms[DeviceRoom(deviceID)] {
+		if !client.IsAgent || client.Info == nil {
+			continue
+		}
+		if latest == nil || client.Info.ConnectedAt > latest.ConnectedAt {
+			latest = client.Info
 		}
 	}
+	return latest
 }
 
-// BroadcastToViewers sends message only to the latest H5 viewer (not Desktop Agents)
-// This prevents duplicate messages when multiple H5 pages are open
-// Uses sessionName if provided, otherwise falls back to deviceID
-func (h *Hub) BroadcastToViewers(deviceID string, sessionName string, message []byte) {
-	h.RecordTerminalOutput(deviceID, sessionName, message)
+// agentInfo returns the handshake of the agent in room, here or on another
+// replica, or nil.
+func (h *Hub) agentInfo(room Room) *service.AgentInfo {
+	h.mu.RLock()
+	for client := range h.rooms[room] {
+		if client.IsAgent && client.Info != nil {
+			h.mu.RUnlock()
+			return client.Info
+		}
+	}
+	local := h.agentCount(room) > 0
+	h.mu.RUnlock()
+	if local {
+		return nil
+	}
+	if record, ok := h.remoteAgent(room); ok {
+		return record.Info
+	}
+	return nil
+}
+
+// checkAgentRequest refuses requests the agent of the session announced it
+// cannot handle. Agents that never sent hello are tried anyway.
+func (h *Hub) checkAgentRequest(deviceID, sessionName, msgType string) error {
+	info := h.agentInfo(routeRoom(deviceID, sessionName))
+	if info == nil {
+		return nil
+	}
+	if !info.Compatible {
+		return service.ErrAgentIncompatible
+	}
+	if capability, ok := requestCapabilities[msgType]; ok && !info.Supports(capability) {
+		return fmt.Errorf("%w: %s", service.ErrAgentUnsupported, capability)
+	}
+	return nil
+}
+
+// defaultRequestTimeout bounds a RequestAgent call whose ctx has no deadline.
+const defaultRequestTimeout = 30 * time.Second
+
+// RequestAgent sends a request envelope to the agent of a session and waits
+// for the envelope replying to its id, until ctx is done or cancelled.
+func (h *Hub) RequestAgent(ctx context.Context, deviceID, sessionName, msgType string, payload interface{}) (json.RawMessage, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultRequestTimeout)
+		defer cancel()
+	}
 
-	// Use sessionName as key if available
-	key := deviceID
-	if sessionName != "" {
-		key = sessionName
+	if err := h.checkAgentRequest(deviceID, sessionName, msgType); err != nil {
+		return nil, err
 	}
 
+	ctx, span := tracing.Start(ctx, "hub.RequestAgent "+msgType, "device_id", deviceID, "session_name", sessionName)
+	defer span.End()
+
+	id := newRequestID()
+	message, err := encodeTracedEnvelope(ctx, id, msgType, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	replies := make(chan *Envelope, 1)
+	h.mu.Lock()
+	h.pending[id] = pendingRequest{deviceID: deviceID, sessionName: sessionName, replies: replies}
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		delete(h.pending, id)
+		h.mu.Unlock()
+	}()
+
+	if !h.SendToAgents(deviceID, sessionName, message) {
+		return nil, service.ErrAgentUnavailable
+	}
+
+	select {
+	case reply := <-replies:
+		if reply.Error != nil {
+			return nil, &service.AgentError{Code: reply.Error.Code, Message: reply.Error.Message}
+		}
+		return reply.Payload, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// DeliverResponse hands an envelope the agent client replied with to the
+// pending RequestAgent call, which may wait on another replica. Replies to
+// requests sent to another device or session are dropped. It returns false
+// for messages that are not replies.
+func (h *Hub) DeliverResponse(client *Client, message []byte) bool {
+	isReply, delivered := h.deliverResponseLocal(client.DeviceID, client.SessionName, message)
+	if isReply && !delivered {
+		h.publish(eventReply, client.DeviceID, client.SessionName, message)
+	}
+	return isReply
+}
+
+func (h *Hub) deliverResponseLocal(deviceID, sessionName string, message []byte) (isReply, delivered bool) {
+	envelope, err := DecodeEnvelope(message)
+	if err != nil || envelope.ReplyTo == "" {
+		return false, false
+	}
+
+	h.mu.RLock()
+	request, ok := h.pending[envelope.ReplyTo]
+	h.mu.RUnlock()
+	if !ok {
+		// Not ours, or the caller gave up; drop the late reply.
+		return true, false
+	}
+	if !request.answeredBy(deviceID, sessionName) {
+		// The request waits here, so there is no other replica to try.
+		slog.Warn("hub: dropped reply from another agent", "reply_to", envelope.ReplyTo,
+			"device_id", deviceID, "session_name", sessionName, "want_device_id", request.deviceID)
+		return true, true
+	}
+	select {
+	case request.replies <- envelope:
+	default:
+	}
+	return true, true
+}
+
+// BroadcastToViewers sends message to the H5 viewers (not Desktop Agents)
+// in the session room, including viewers subscribed from other sessions
+func (h *Hub) BroadcastToViewers(ctx context.Context, deviceID string, sessionName string, message []byte) {
+	room := routeRoom(deviceID, sessionName)
+	_, span := tracing.Start(ctx, "hub.BroadcastToViewers", "room", string(room), "bytes", len(message))
+	defer span.End()
+
+	h.RecordTerminalOutput(ctx, deviceID, sessionName, message)
+	h.sendToViewers(room, message)
+	// Viewers on other replicas, and late joiners there
+	if h.backplane != nil {
+		h.storeSnapshot(room, message)
+		h.publish(eventViewers, deviceID, sessionName, message)
+	}
+}
+
+func (h *Hub) sendToViewers(room Room, message []byte) {
 	h.mu.Lock()
 	// Save last output for new viewers
-	h.lastOutput[key] = make([]byte, len(message))
-	copy(h.lastOutput[key], message)
+	h.lastOutput[room] = make([]byte, len(message))
+	copy(h.lastOutput[room], message)
 	h.mu.Unlock()
 
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	if clients, ok := h.clients[key]; ok {
+	if clients, ok := h.rooms[room]; ok {
 		// Find all H5 viewers and send to each
 		var viewers []*Client
 		for client := range clients {
@@ -188,19 +553,15 @@ func (h *Hub) BroadcastToViewers(deviceID string, sessionName string, message []
 				viewers = append(viewers, client)
 			}
 		}
-		log.Printf("BroadcastToViewers: key=%s, viewerCount=%d, msgLen=%d", key, len(viewers), len(message))
-		// Send to each viewer
+		slog.Debug("hub broadcast to viewers", "room", room, "viewers", len(viewers), "bytes", len(message))
+		// Slow viewers get the newest snapshot once they catch up
 		for _, viewer := range viewers {
-			select {
-			case viewer.Send <- message:
-				log.Printf("BroadcastToViewers: sent to userID=%d", viewer.UserID)
-			default:
-			}
+			h.enqueueSnapshot(viewer, message)
 		}
 	}
 }
 
-func (h *Hub) RecordTerminalOutput(deviceID string, sessionName string, message []byte) {
+func (h *Hub) RecordTerminalOutput(ctx context.Context, deviceID string, sessionName string, message []byte) {
 	summary := extractLatestTerminalLine(message)
 	if summary == "" {
 		return
@@ -209,24 +570,61 @@ func (h *Hub) RecordTerminalOutput(deviceID string, sessionName string, message
 	key := taskKey(deviceID, sessionName)
 
 	h.mu.Lock()
-	defer h.mu.Unlock()
-
 	if h.lastEventLine[key] == summary {
+		h.mu.Unlock()
 		return
 	}
 
 	h.lastEventLine[key] = summary
-	event := service.TaskEvent{
+	h.mu.Unlock()
+
+	h.RecordTaskEvent(ctx, deviceID, sessionName, service.TaskEvent{
 		Summary:   summary,
-		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
 		Kind:      classifyTaskEvent(summary),
-	}
+	})
+}
 
+// RecordTaskEvent adds an event to the recent events of a session and queues
+// it for the task event handlers. Used for events that do not come from
+// terminal output, e.g. results of remote git actions. The handlers run in
+// the trace of ctx.
+func (h *Hub) RecordTaskEvent(ctx context.Context, deviceID, sessionName string, event service.TaskEvent) {
+	key := taskKey(deviceID, sessionName)
+
+	h.mu.Lock()
 	events := append([]service.TaskEvent{event}, h.recentEvents[key]...)
 	if len(events) > 10 {
 		events = events[:10]
 	}
 	h.recentEvents[key] = events
+	h.mu.Unlock()
+
+	// handler 会访问数据库，不能阻塞 agent 的 readPump
+	select {
+	case h.taskEvents <- taskEventJob{ctx: context.WithoutCancel(ctx), deviceID: deviceID, sessionName: sessionName, event: event}:
+	default:
+		slog.Warn("hub: task event queue full, dropping event", "device_id", deviceID, "session", sessionName, "kind", event.Kind)
+	}
+}
+
+type taskEventJob struct {
+	ctx         context.Context
+	deviceID    string
+	sessionName string
+	event       service.TaskEvent
+}
+
+// runTaskEventHandlers delivers queued task events to the handlers in order.
+func (h *Hub) runTaskEventHandlers() {
+	for job := range h.taskEvents {
+		h.mu.RLock()
+		handlers := h.eventHandlers
+		h.mu.RUnlock()
+		for _, handler := range handlers {
+			handler.HandleTaskEvent(job.ctx, job.deviceID, job.sessionName, job.event)
+		}
+	}
 }
 
 func (h *Hub) GetRecentEvents(taskID string) []service.TaskEvent {
@@ -244,35 +642,43 @@ func (h *Hub) GetRecentEvents(taskID string) []service.TaskEvent {
 }
 
 // SendLastOutput sends the last terminal output to a new viewer
+// Falls back to the snapshot shared by the replica the agent is on
 func (h *Hub) SendLastOutput(client *Client) {
+	h.sendLastOutput(client, client.room())
+}
+
+func (h *Hub) sendLastOutput(client *Client, room Room) {
 	h.mu.RLock()
-	defer h.mu.RUnlock()
-	// Use sessionName as key if available, otherwise use deviceID
-	key := client.DeviceID
-	if client.SessionName != "" {
-		key = client.SessionName
+	output, ok := h.lastOutput[room]
+	h.mu.RUnlock()
+	if !ok {
+		output = h.loadSnapshot(room)
 	}
-	if output, ok := h.lastOutput[key]; ok && len(output) > 0 {
-		select {
-		case client.Send <- output:
-			log.Printf("SendLastOutput: sent to userID=%d, len=%d, key=%s", client.UserID, len(output), key)
-		default:
-		}
+
+	// The client may have gone while the snapshot was loaded; its Send
+	// is closed then
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if len(output) > 0 && !client.closed {
+		outcome := h.enqueueSnapshot(client, output)
+		client.Log().Debug("hub last output", "room", room, "bytes", len(output), "outcome", outcome, "queue", client.QueueDepth())
 	}
 }
 
-// BroadcastToDevice sends to all clients (for backward compatibility)
+// BroadcastToDevice sends to every client of the device, whatever session
+// it is in, here and on other replicas
 func (h *Hub) BroadcastToDevice(deviceID string, message []byte) {
+	h.broadcastLocal(deviceID, message)
+	h.publish(eventDevice, deviceID, "", message)
+}
+
+func (h *Hub) broadcastLocal(deviceID string, message []byte) {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	if clients, ok := h.clients[deviceID]; ok {
-		log.Printf("BroadcastToDevice: deviceID=%s, message=%s, clientCount=%d", deviceID, string(message), len(clients))
+	if clients, ok := h.rooms[DeviceRoom(deviceID)]; ok {
+		slog.Debug("hub broadcast to device", "device_id", deviceID, "type", MessageType(message), "payload", message, "clients", len(clients))
 		for client := range clients {
-			select {
-			case client.Send <- message:
-				log.Printf("BroadcastToDevice: sent to client userID=%d, isAgent=%v", client.UserID, client.IsAgent)
-			default:
-			}
+			h.enqueue(client, message)
 		}
 	}
 }
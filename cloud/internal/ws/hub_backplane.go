@@ -0,0 +1,338 @@
+package ws
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/mobile-coder/cloud/internal/service"
+	"github.com/mobile-coder/tracing"
+)
+
+// Backplane channel and keys shared by all replicas.
+const (
+	backplaneChannel   = "mobilecoder:hub"
+	snapshotKeyPrefix  = "mobilecoder:snapshot:"
+	agentKeyPrefix     = "mobilecoder:agent:"  // session room -> agentRecord
+	deviceKeyPrefix    = "mobilecoder:device:" // deviceID -> agentRecord
+	streamKeyPrefix    = "mobilecoder:stream:" // session room -> sharedStream
+	snapshotTTL        = 24 * time.Hour
+	agentRecordTTL     = 30 * time.Second
+	agentRecordRefresh = 10 * time.Second
+)
+
+// Kinds of events replicas exchange. Each names the local delivery the
+// receiving replicas repeat for their own clients.
+const (
+	eventViewers     = "viewers"      // BroadcastToViewers
+	eventDevice      = "device"       // BroadcastToDevice
+	eventAgent       = "agent"        // SendToAgents / SendFrameToAgent
+	eventDeviceAgent = "device_agent" // SendToDeviceAgent
+	eventInput       = "input"        // DeliverToAgent
+	eventReply       = "reply"        // DeliverResponse
+)
+
+type backplaneEvent struct {
+	Origin      string `json:"origin"`
+	Kind        string `json:"kind"`
+	DeviceID    string `json:"device_id"`
+	SessionName string `json:"session_name,omitempty"`
+	Message     []byte `json:"message"`
+}
+
+// agentRecord tells other replicas that an agent is connected here.
+type agentRecord struct {
+	Replica     string             `json:"replica"`
+	DeviceID    string             `json:"device_id"`
+	SessionName string             `json:"session_name,omitempty"`
+	Info        *service.AgentInfo `json:"info,omitempty"`
+	LastSeen    time.Time          `json:"last_seen"`
+}
+
+// SetBackplane connects the hub to the other replicas. Call it before Run.
+func (h *Hub) SetBackplane(backplane Backplane) error {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	h.replicaID = hex.EncodeToString(buf)
+	h.backplane = backplane
+	return backplane.Subscribe(backplaneChannel, h.handleBackplaneEvent)
+}
+
+// publish sends an event to the other replicas. Callers must not hold h.mu.
+func (h *Hub) publish(kind, deviceID, sessionName string, message []byte) bool {
+	if h.backplane == nil {
+		return false
+	}
+	data, _ := json.Marshal(backplaneEvent{
+		Origin:      h.replicaID,
+		Kind:        kind,
+		DeviceID:    deviceID,
+		SessionName: sessionName,
+		Message:     message,
+	})
+	if err := h.backplane.Publish(backplaneChannel, data); err != nil {
+		slog.Warn("backplane publish failed", "kind", kind, "error", err)
+		return false
+	}
+	return true
+}
+
+func (h *Hub) handleBackplaneEvent(data []byte) {
+	var event backplaneEvent
+	if err := json.Unmarshal(data, &event); err != nil || event.Origin == h.replicaID {
+		return
+	}
+	room := routeRoom(event.DeviceID, event.SessionName)
+	switch event.Kind {
+	case eventViewers:
+		// The trace continues from the replica the agent is connected to
+		ctx := tracing.Extract(context.Background(), TraceParent(event.Message))
+		_, span := tracing.Start(ctx, "hub.BroadcastToViewers", "room", string(room), "backplane", true)
+		h.sendToViewers(room, event.Message)
+		span.End()
+	case eventDevice:
+		h.broadcastLocal(event.DeviceID, event.Message)
+	case eventAgent:
+		h.trySendToAgent(room, event.Message)
+	case eventDeviceAgent:
+		h.sendToDeviceAgentLocal(event.DeviceID, event.Message)
+	case eventInput:
+		if h.hasLocalAgent(room) {
+			h.DeliverToAgent(tracing.Extract(context.Background(), TraceParent(event.Message)), event.DeviceID, event.SessionName, event.Message)
+		}
+	case eventReply:
+		h.deliverResponseLocal(event.DeviceID, event.SessionName, event.Message)
+	}
+}
+
+// hasLocalAgent reports whether an agent in room is connected to this
+// replica.
+func (h *Hub) hasLocalAgent(room Room) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.agentCount(room) > 0
+}
+
+// remoteAgent returns the record of an agent in room connected to another
+// replica.
+func (h *Hub) remoteAgent(room Room) (*agentRecord, bool) {
+	return h.loadAgentRecord(agentKeyPrefix + string(room))
+}
+
+func (h *Hub) remoteDeviceAgent(deviceID string) (*agentRecord, bool) {
+	return h.loadAgentRecord(deviceKeyPrefix + deviceID)
+}
+
+func (h *Hub) loadAgentRecord(key string) (*agentRecord, bool) {
+	if h.backplane == nil {
+		return nil, false
+	}
+	data, err := h.backplane.Get(key)
+	if err != nil {
+		return nil, false
+	}
+	var record agentRecord
+	if json.Unmarshal(data, &record) != nil || record.Replica == h.replicaID {
+		return nil, false
+	}
+	return &record, true
+}
+
+// storeSnapshot shares the latest terminal output of room with late
+// joiners on other replicas.
+func (h *Hub) storeSnapshot(room Room, message []byte) {
+	if h.backplane == nil {
+		return
+	}
+	if err := h.backplane.Set(snapshotKeyPrefix+string(room), message, snapshotTTL); err != nil {
+		slog.Warn("backplane store snapshot failed", "room", room, "error", err)
+	}
+}
+
+func (h *Hub) loadSnapshot(room Room) []byte {
+	if h.backplane == nil {
+		return nil
+	}
+	data, err := h.backplane.Get(snapshotKeyPrefix + string(room))
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// sharedStream is an agentStream as stored in the backplane: what another
+// replica needs to take the stream over when the agent reconnects to it.
+type sharedStream struct {
+	ID            string        `json:"id"`
+	NextSeq       uint64        `json:"next_seq"`
+	Outbox        []sharedFrame `json:"outbox,omitempty"`
+	AgentStreamID string        `json:"agent_stream_id,omitempty"`
+	LastReceived  uint64        `json:"last_received"`
+}
+
+type sharedFrame struct {
+	Seq     uint64 `json:"seq"`
+	Message []byte `json:"message"`
+}
+
+// shareStream captures stream after a change and returns the function that
+// stores it in the backplane. h.mu must be held; call the function after
+// releasing it. A capture older than one already stored is skipped.
+func (h *Hub) shareStream(room Room, stream *agentStream) func() {
+	if h.backplane == nil {
+		return func() {}
+	}
+	shared := sharedStream{ID: stream.id, NextSeq: stream.nextSeq, AgentStreamID: stream.agentStreamID, LastReceived: stream.lastReceived}
+	for _, frame := range stream.outbox {
+		shared.Outbox = append(shared.Outbox, sharedFrame{Seq: frame.seq, Message: frame.message})
+	}
+	data, _ := json.Marshal(shared)
+	stream.version++
+	version := stream.version
+	return func() {
+		stream.storeMu.Lock()
+		defer stream.storeMu.Unlock()
+		if version < stream.storedVersion {
+			return
+		}
+		if err := h.backplane.Set(streamKeyPrefix+string(room), data, streamIdleTimeout); err != nil {
+			slog.Warn("backplane store stream failed", "room", room, "error", err)
+			return
+		}
+		stream.storedVersion = version
+	}
+}
+
+// loadStream returns the stream of room as last stored by any replica, or
+// nil. Callers must not hold h.mu.
+func (h *Hub) loadStream(room Room) *agentStream {
+	if h.backplane == nil {
+		return nil
+	}
+	data, err := h.backplane.Get(streamKeyPrefix + string(room))
+	if err != nil {
+		return nil
+	}
+	var shared sharedStream
+	if json.Unmarshal(data, &shared) != nil || shared.ID == "" {
+		return nil
+	}
+	stream := &agentStream{id: shared.ID, nextSeq: shared.NextSeq, agentStreamID: shared.AgentStreamID, lastReceived: shared.LastReceived}
+	for _, frame := range shared.Outbox {
+		stream.outbox = append(stream.outbox, streamFrame{seq: frame.Seq, message: frame.Message})
+	}
+	return stream
+}
+
+// adoptStream makes shared, when loaded, the stream of room unless an agent
+// connected here still uses the local one; h.mu must be held.
+func (h *Hub) adoptStream(room Room, shared *agentStream) *agentStream {
+	if local, ok := h.streams[room]; ok && local.client != nil && h.rooms[room][local.client] {
+		return local
+	}
+	if shared == nil {
+		return h.stream(room)
+	}
+	h.streams[room] = shared
+	return shared
+}
+
+func (h *Hub) deleteSharedStream(room Room) {
+	if h.backplane != nil {
+		h.backplane.Delete(streamKeyPrefix + string(room))
+	}
+}
+
+// markAgentsChanged asks the record refresher to publish the local agents
+// now instead of at the next tick.
+func (h *Hub) markAgentsChanged() {
+	select {
+	case h.agentsChanged <- struct{}{}:
+	default:
+	}
+}
+
+// runAgentRecords keeps the records of local agents fresh in the backplane
+// and removes the ones that left.
+func (h *Hub) runAgentRecords() {
+	ticker := time.NewTicker(agentRecordRefresh)
+	defer ticker.Stop()
+	published := map[string]bool{}
+	for {
+		select {
+		case <-ticker.C:
+		case <-h.agentsChanged:
+		}
+
+		records := map[string]agentRecord{}
+		h.mu.RLock()
+		for room, clients := range h.rooms {
+			for client := range clients {
+				// Agents are in their device room and maybe a session room;
+				// record each once, under the room it connected for
+				if !client.IsAgent || client.room() != room {
+					continue
+				}
+				record := agentRecord{Replica: h.replicaID, DeviceID: client.DeviceID, SessionName: client.SessionName, Info: client.Info, LastSeen: client.LastSeen()}
+				if existing, ok := records[agentKeyPrefix+string(room)]; !ok || record.LastSeen.After(existing.LastSeen) {
+					records[agentKeyPrefix+string(room)] = record
+				}
+				if existing, ok := records[deviceKeyPrefix+client.DeviceID]; !ok || record.LastSeen.After(existing.LastSeen) {
+					records[deviceKeyPrefix+client.DeviceID] = record
+				}
+			}
+		}
+		h.mu.RUnlock()
+
+		for key, record := range records {
+			data, _ := json.Marshal(record)
+			if err := h.backplane.Set(key, data, agentRecordTTL); err != nil {
+				slog.Warn("backplane store failed", "key", key, "error", err)
+			}
+		}
+		for key := range published {
+			if _, ok := records[key]; !ok {
+				h.deleteAgentRecord(key)
+			}
+		}
+		published = map[string]bool{}
+		for key := range records {
+			published[key] = true
+		}
+	}
+}
+
+// deleteAgentRecord removes a record this replica wrote, unless another
+// replica has taken it over since.
+func (h *Hub) deleteAgentRecord(key string) {
+	data, err := h.backplane.Get(key)
+	if err != nil {
+		return
+	}
+	var record agentRecord
+	if json.Unmarshal(data, &record) == nil && record.Replica == h.replicaID {
+		h.backplane.Delete(key)
+	}
+}
+
+// withRemoteAgents corrects a presence change for agents connected to other
+// replicas, e.g. an agent that moved from this replica to another.
+func (h *Hub) withRemoteAgents(presence service.AgentPresence) service.AgentPresence {
+	if h.backplane == nil {
+		return presence
+	}
+	if !presence.SessionOnline {
+		if _, ok := h.remoteAgent(routeRoom(presence.DeviceID, presence.SessionName)); ok {
+			presence.SessionOnline = true
+		}
+	}
+	if !presence.DeviceOnline {
+		if _, ok := h.remoteDeviceAgent(presence.DeviceID); ok {
+			presence.DeviceOnline = true
+		}
+	}
+	return presence
+}
@@ -1,15 +1,20 @@
 package ws
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"testing"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/mobile-coder/cloud/internal/service"
 )
 
 func TestRecordTerminalOutputStoresRecentEventForTask(t *testing.T) {
 	hub := NewHub()
 
-	hub.RecordTerminalOutput("dev-1", "feature", []byte(`{"type":"terminal_output","payload":{"content":"running tests\nall green\n"}}`))
+	hub.RecordTerminalOutput(context.Background(), "dev-1", "feature", []byte(`{"type":"terminal_output","payload":{"content":"running tests\nall green\n"}}`))
 
 	events := hub.GetRecentEvents("dev-1:feature")
 	if len(events) != 1 {
@@ -27,8 +32,8 @@ func TestRecordTerminalOutputIgnoresDuplicateLatestLine(t *testing.T) {
 	hub := NewHub()
 	message := []byte(`{"type":"terminal_output","payload":{"content":"step 1\nstep 2\n"}}`)
 
-	hub.RecordTerminalOutput("dev-1", "feature", message)
-	hub.RecordTerminalOutput("dev-1", "feature", message)
+	hub.RecordTerminalOutput(context.Background(), "dev-1", "feature", message)
+	hub.RecordTerminalOutput(context.Background(), "dev-1", "feature", message)
 
 	events := hub.GetRecentEvents("dev-1:feature")
 	if len(events) != 1 {
@@ -39,8 +44,8 @@ func TestRecordTerminalOutputIgnoresDuplicateLatestLine(t *testing.T) {
 func TestRecordTerminalOutputStripsAnsiAndKeepsLatestEvents(t *testing.T) {
 	hub := NewHub()
 
-	hub.RecordTerminalOutput("dev-1", "feature", []byte("{\"type\":\"terminal_output\",\"payload\":{\"content\":\"\\u001b[32mcompile ok\\u001b[0m\\n\"}}"))
-	hub.RecordTerminalOutput("dev-1", "feature", []byte(`{"type":"terminal_output","payload":{"content":"tests passed\n"}}`))
+	hub.RecordTerminalOutput(context.Background(), "dev-1", "feature", []byte("{\"type\":\"terminal_output\",\"payload\":{\"content\":\"\\u001b[32mcompile ok\\u001b[0m\\n\"}}"))
+	hub.RecordTerminalOutput(context.Background(), "dev-1", "feature", []byte(`{"type":"terminal_output","payload":{"content":"tests passed\n"}}`))
 
 	events := hub.GetRecentEvents("dev-1:feature")
 	if len(events) != 2 {
@@ -57,8 +62,8 @@ func TestRecordTerminalOutputStripsAnsiAndKeepsLatestEvents(t *testing.T) {
 func TestRecordTerminalOutputClassifiesWaitingAndErrorSignals(t *testing.T) {
 	hub := NewHub()
 
-	hub.RecordTerminalOutput("dev-1", "feature", []byte(`{"type":"terminal_output","payload":{"content":"Waiting for confirmation before deleting files\n"}}`))
-	hub.RecordTerminalOutput("dev-1", "feature", []byte(`{"type":"terminal_output","payload":{"content":"Error: test command failed\n"}}`))
+	hub.RecordTerminalOutput(context.Background(), "dev-1", "feature", []byte(`{"type":"terminal_output","payload":{"content":"Waiting for confirmation before deleting files\n"}}`))
+	hub.RecordTerminalOutput(context.Background(), "dev-1", "feature", []byte(`{"type":"terminal_output","payload":{"content":"Error: test command failed\n"}}`))
 
 	events := hub.GetRecentEvents("dev-1:feature")
 	if len(events) != 2 {
@@ -75,8 +80,8 @@ func TestRecordTerminalOutputClassifiesWaitingAndErrorSignals(t *testing.T) {
 func TestRecordTerminalOutputClassifiesCompletedAndToolStepSignals(t *testing.T) {
 	hub := NewHub()
 
-	hub.RecordTerminalOutput("dev-1", "feature", []byte(`{"type":"terminal_output","payload":{"content":"Updating dependencies...\n"}}`))
-	hub.RecordTerminalOutput("dev-1", "feature", []byte(`{"type":"terminal_output","payload":{"content":"Task completed successfully\n"}}`))
+	hub.RecordTerminalOutput(context.Background(), "dev-1", "feature", []byte(`{"type":"terminal_output","payload":{"content":"Updating dependencies...\n"}}`))
+	hub.RecordTerminalOutput(context.Background(), "dev-1", "feature", []byte(`{"type":"terminal_output","payload":{"content":"Task completed successfully\n"}}`))
 
 	events := hub.GetRecentEvents("dev-1:feature")
 	if len(events) != 2 {
@@ -89,3 +94,466 @@ func TestRecordTerminalOutputClassifiesCompletedAndToolStepSignals(t *testing.T)
 		t.Fatalf("events[1].Kind = %q, want %q", events[1].Kind, service.TaskEventKindToolStep)
 	}
 }
+
+type recordedTaskEvent struct {
+	deviceID    string
+	sessionName string
+	event       service.TaskEvent
+}
+
+type recordingTaskEventHandler struct {
+	events chan recordedTaskEvent
+}
+
+func (r *recordingTaskEventHandler) HandleTaskEvent(ctx context.Context, deviceID, sessionName string, event service.TaskEvent) {
+	r.events <- recordedTaskEvent{deviceID: deviceID, sessionName: sessionName, event: event}
+}
+
+func TestRecordTerminalOutputForwardsNewEventsToHandlers(t *testing.T) {
+	handler := &recordingTaskEventHandler{events: make(chan recordedTaskEvent, 4)}
+	hub := NewHub(handler)
+	go hub.Run()
+	message := []byte(`{"type":"terminal_output","payload":{"content":"tests passed\n"}}`)
+
+	hub.RecordTerminalOutput(context.Background(), "dev-1", "feature", message)
+	hub.RecordTerminalOutput(context.Background(), "dev-1", "feature", message)
+
+	var got recordedTaskEvent
+	select {
+	case got = <-handler.events:
+	case <-time.After(time.Second):
+		t.Fatal("handler did not receive the event")
+	}
+	if got.deviceID != "dev-1" || got.sessionName != "feature" {
+		t.Fatalf("handler got %s/%s, want dev-1/feature", got.deviceID, got.sessionName)
+	}
+	if got.event.Kind != service.TaskEventKindTestResult {
+		t.Fatalf("event.Kind = %q, want %q", got.event.Kind, service.TaskEventKindTestResult)
+	}
+
+	select {
+	case extra := <-handler.events:
+		t.Fatalf("handler got a repeated event %+v", extra)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRecordTaskEventDoesNotWaitForHandlers(t *testing.T) {
+	blocked := make(chan struct{})
+	handler := &blockingTaskEventHandler{release: blocked}
+	hub := NewHub(handler)
+	go hub.Run()
+	defer close(blocked)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < taskEventQueueSize+10; i++ {
+			hub.RecordTaskEvent(context.Background(), "dev-1", "feature", service.TaskEvent{Summary: "step", Kind: service.TaskEventKindInfo})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("RecordTaskEvent blocked on a slow handler")
+	}
+}
+
+type blockingTaskEventHandler struct {
+	release chan struct{}
+}
+
+func (b *blockingTaskEventHandler) HandleTaskEvent(context.Context, string, string, service.TaskEvent) {
+	<-b.release
+}
+
+func TestSendToDeviceAgentPicksAgentOfDevice(t *testing.T) {
+	hub := NewHub()
+	viewer := &Client{DeviceID: "dev-1", SessionName: "feature", Send: make(chan []byte, 1)}
+	other := &Client{DeviceID: "dev-2", SessionName: "main", IsAgent: true, Send: make(chan []byte, 1)}
+	agent := &Client{DeviceID: "dev-1", SessionName: "feature", IsAgent: true, Send: make(chan []byte, 1)}
+	hub.addClient(viewer)
+	hub.addClient(agent)
+	hub.addClient(other)
+
+	if !hub.SendToDeviceAgent("dev-1", []byte(`{"type":"create_session"}`)) {
+		t.Fatal("SendToDeviceAgent = false, want true")
+	}
+	if len(agent.Send) != 1 || len(viewer.Send) != 0 || len(other.Send) != 0 {
+		t.Fatalf("queued agent/viewer/other = %d/%d/%d, want 1/0/0", len(agent.Send), len(viewer.Send), len(other.Send))
+	}
+	if hub.SendToDeviceAgent("dev-3", []byte(`{}`)) {
+		t.Fatal("SendToDeviceAgent = true for device without agents")
+	}
+}
+
+func TestRequestAgentReturnsMatchingReply(t *testing.T) {
+	hub := NewHub()
+	agent := &Client{DeviceID: "dev-1", SessionName: "feature", IsAgent: true, Send: make(chan []byte, 1)}
+	hub.addClient(agent)
+
+	go func() {
+		request, err := DecodeEnvelope(<-agent.Send)
+		if err != nil || request.Type != "get_diff" || request.Version != ProtocolVersion {
+			return
+		}
+		hub.DeliverResponse(agent, []byte(`{"type":"diff_result","reply_to":"other","payload":{"files":[]}}`))
+		// Another agent cannot answer the request, even knowing its id.
+		intruder := &Client{DeviceID: "dev-2", SessionName: "feature", IsAgent: true}
+		hub.DeliverResponse(intruder, []byte(`{"type":"diff_result","reply_to":"`+request.ID+`","payload":{"base":"forged"}}`))
+		hub.DeliverResponse(&Client{DeviceID: "dev-1", SessionName: "other", IsAgent: true}, []byte(`{"type":"diff_result","reply_to":"`+request.ID+`","payload":{"base":"forged"}}`))
+		hub.DeliverResponse(agent, []byte(`{"type":"diff_result","reply_to":"`+request.ID+`","payload":{"base":"HEAD"}}`))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	payload, err := hub.RequestAgent(ctx, "dev-1", "feature", "get_diff", map[string]string{})
+	if err != nil {
+		t.Fatalf("RequestAgent: %v", err)
+	}
+	if string(payload) != `{"base":"HEAD"}` {
+		t.Fatalf("payload = %s", payload)
+	}
+	if len(hub.pending) != 0 {
+		t.Fatalf("pending = %d, want 0", len(hub.pending))
+	}
+}
+
+func TestRequestAgentReportsErrorsAndTimeouts(t *testing.T) {
+	hub := NewHub()
+	if _, err := hub.RequestAgent(context.Background(), "dev-1", "feature", "get_diff", nil); !errors.Is(err, service.ErrAgentUnavailable) {
+		t.Fatalf("err = %v, want ErrAgentUnavailable", err)
+	}
+
+	agent := &Client{DeviceID: "dev-1", SessionName: "feature", IsAgent: true, Send: make(chan []byte, 2)}
+	hub.addClient(agent)
+	go func() {
+		request, _ := DecodeEnvelope(<-agent.Send)
+		hub.DeliverResponse(agent, []byte(`{"type":"diff_result","reply_to":"`+request.ID+`","error":{"code":"invalid","message":"not a git repository"}}`))
+	}()
+	_, err := hub.RequestAgent(context.Background(), "dev-1", "feature", "get_diff", nil)
+	var agentErr *service.AgentError
+	if !errors.Is(err, service.ErrAgentRequestFailed) || !errors.As(err, &agentErr) || agentErr.Code != service.AgentErrorInvalid {
+		t.Fatalf("err = %v, want invalid AgentError", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := hub.RequestAgent(ctx, "dev-1", "feature", "get_diff", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want deadline exceeded", err)
+	}
+	if hub.DeliverResponse(agent, []byte(`{"type":"terminal_output","payload":{}}`)) {
+		t.Fatal("DeliverResponse = true for a message without reply_to")
+	}
+}
+
+func TestRequestAgentAppliesDefaultTimeoutAndCancellation(t *testing.T) {
+	hub := NewHub()
+	agent := &Client{DeviceID: "dev-1", SessionName: "feature", IsAgent: true, Send: make(chan []byte, 1)}
+	hub.addClient(agent)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-agent.Send
+		cancel()
+	}()
+	if _, err := hub.RequestAgent(ctx, "dev-1", "feature", "get_diff", nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if len(hub.pending) != 0 {
+		t.Fatalf("pending = %d, want 0 after cancellation", len(hub.pending))
+	}
+}
+
+func TestSendFrameToAgentWaitsForRoomAndFramesBinary(t *testing.T) {
+	hub := NewHub()
+	agent := &Client{DeviceID: "dev-1", SessionName: "feature", IsAgent: true, Send: make(chan []byte, 1)}
+	hub.addClient(agent)
+
+	frame := service.EncodeUploadFrame("up-1", 0, []byte("data"))
+	if err := hub.SendFrameToAgent(context.Background(), "dev-1", "feature", frame); err != nil {
+		t.Fatalf("SendFrameToAgent: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if err := hub.SendFrameToAgent(ctx, "dev-1", "feature", frame); err != context.DeadlineExceeded {
+		t.Fatalf("full buffer err = %v, want deadline exceeded", err)
+	}
+	agent.SetEncoding(EncodingCBOR)
+	if messageType, sent := OutgoingFrame(agent, <-agent.Send); messageType != websocket.BinaryMessage || !bytes.Equal(sent, frame) {
+		t.Fatal("upload frames must be sent unchanged as binary messages")
+	}
+	if messageType, _ := OutgoingFrame(&Client{}, []byte(`{"type":"x"}`)); messageType != websocket.TextMessage {
+		t.Fatal("envelopes default to JSON text frames")
+	}
+	if err := hub.SendFrameToAgent(context.Background(), "dev-1", "other", frame); err != service.ErrAgentUnavailable {
+		t.Fatalf("err = %v, want ErrAgentUnavailable", err)
+	}
+}
+
+func TestCheckAgentProtocol(t *testing.T) {
+	if compatible, rejected := CheckAgentProtocol(ProtocolVersion); !compatible || rejected {
+		t.Fatalf("current protocol: compatible=%v rejected=%v", compatible, rejected)
+	}
+	if compatible, rejected := CheckAgentProtocol(MinAgentProtocolVersion - 1); compatible || !rejected {
+		t.Fatalf("old protocol: compatible=%v rejected=%v, want rejected", compatible, rejected)
+	}
+	if compatible, rejected := CheckAgentProtocol(ProtocolVersion + 1); compatible || rejected {
+		t.Fatalf("newer protocol: compatible=%v rejected=%v, want degraded", compatible, rejected)
+	}
+}
+
+func TestRequestAgentHonoursHelloCapabilities(t *testing.T) {
+	hub := NewHub()
+	agent := &Client{DeviceID: "dev-1", SessionName: "feature", IsAgent: true, Send: make(chan []byte, 4)}
+	hub.addClient(agent)
+
+	if hub.AgentInfo("dev-1") != nil {
+		t.Fatal("AgentInfo should be nil before hello")
+	}
+	hub.SetAgentInfo(agent, &service.AgentInfo{
+		Version:         "v1.4.0",
+		ProtocolVersion: ProtocolVersion,
+		Capabilities:    []string{service.CapabilityDiff},
+		Compatible:      true,
+		ConnectedAt:     "2026-04-20T10:00:00Z",
+	})
+	if info := hub.AgentInfo("dev-1"); info == nil || info.Version != "v1.4.0" {
+		t.Fatalf("AgentInfo = %+v", info)
+	}
+
+	if _, err := hub.RequestAgent(context.Background(), "dev-1", "feature", "list_dir", nil); !errors.Is(err, service.ErrAgentUnsupported) {
+		t.Fatalf("err = %v, want ErrAgentUnsupported", err)
+	}
+	if len(agent.Send) != 0 {
+		t.Fatal("unsupported request should not reach the agent")
+	}
+
+	agent.Info.Compatible = false
+	if _, err := hub.RequestAgent(context.Background(), "dev-1", "feature", "get_diff", nil); !errors.Is(err, service.ErrAgentIncompatible) {
+		t.Fatalf("err = %v, want ErrAgentIncompatible", err)
+	}
+}
+
+func TestDeliverToAgentBuffersAndReplaysAfterResume(t *testing.T) {
+	hub := NewHub()
+	input := func(data string) []byte {
+		return []byte(`{"type":"terminal_input","payload":{"data":"` + data + `"}}`)
+	}
+
+	// Typed while the agent is away
+	if !hub.DeliverToAgent(context.Background(), "dev-1", "feature", input("a")) || !hub.DeliverToAgent(context.Background(), "dev-1", "feature", input("b")) {
+		t.Fatal("input should be buffered while the agent is away")
+	}
+
+	first := &Client{DeviceID: "dev-1", SessionName: "feature", IsAgent: true, Send: make(chan []byte, 4),
+		Info: &service.AgentInfo{Capabilities: []string{service.CapabilityResume}}}
+	hub.addClient(first)
+	streamID, received := hub.OpenAgentStream(first, "agent-1")
+	if received != 0 {
+		t.Fatalf("received = %d, want 0 for a new agent stream", received)
+	}
+	hub.ResumeToAgent(first, "", 0)
+	hub.DeliverToAgent(context.Background(), "dev-1", "feature", input("c"))
+	for i, want := range []string{"a", "b", "c"} {
+		env, _ := DecodeEnvelope(<-first.Send)
+		if env.Seq != uint64(i+1) || !bytes.Contains(env.Payload, []byte(want)) {
+			t.Fatalf("frame %d = seq %d %s, want %q", i, env.Seq, env.Payload, want)
+		}
+	}
+	hub.AckFromAgent(first, 1)
+
+	// The agent reconnects having handled a and b; only c is replayed
+	second := &Client{DeviceID: "dev-1", SessionName: "feature", IsAgent: true, Send: make(chan []byte, 4),
+		Info: first.Info}
+	hub.removeClient(first)
+	hub.addClient(second)
+	if !hub.ReceiveFromAgent(second, 1) || hub.ReceiveFromAgent(second, 1) {
+		t.Fatal("a replayed agent message should be reported once")
+	}
+	if id, received := hub.OpenAgentStream(second, "agent-1"); id != streamID || received != 1 {
+		t.Fatalf("OpenAgentStream = %s, %d; want %s, 1", id, received, streamID)
+	}
+	hub.ResumeToAgent(second, streamID, 2)
+	env, _ := DecodeEnvelope(<-second.Send)
+	if env.Seq != 3 || len(second.Send) != 0 {
+		t.Fatalf("replayed seq %d and %d more, want only seq 3", env.Seq, len(second.Send))
+	}
+
+	// A restarted agent starts its own seq over
+	if _, received := hub.OpenAgentStream(second, "agent-2"); received != 0 {
+		t.Fatalf("received = %d after agent restart, want 0", received)
+	}
+}
+
+func TestDeliverToAgentSendsDirectlyToAgentsWithoutResume(t *testing.T) {
+	message := []byte(`{"type":"terminal_input","payload":{"data":"ls\n"}}`)
+	for name, info := range map[string]*service.AgentInfo{
+		"hello without resume": {Capabilities: []string{service.CapabilityDiff}},
+		// Agents from before hello never resume, so their stream is never
+		// flushed
+		"no hello": nil,
+	} {
+		hub := NewHub()
+		agent := &Client{DeviceID: "dev-1", SessionName: "feature", IsAgent: true, Send: make(chan []byte, 4), Info: info}
+		hub.addClient(agent)
+
+		if !hub.DeliverToAgent(context.Background(), "dev-1", "feature", message) {
+			t.Fatalf("%s: DeliverToAgent = false", name)
+		}
+		select {
+		case got := <-agent.Send:
+			if !bytes.Equal(got, message) {
+				t.Fatalf("%s: sent %s, want the message unchanged", name, got)
+			}
+		default:
+			t.Fatalf("%s: input was buffered instead of sent", name)
+		}
+	}
+}
+
+func TestHubDropsStreamsOfGoneSessions(t *testing.T) {
+	hub := NewHub()
+	input := []byte(`{"type":"terminal_input","payload":{"data":"a"}}`)
+	for _, session := range []string{"idle", "deleted", "other", "live"} {
+		hub.DeliverToAgent(context.Background(), "dev-1", session, input)
+	}
+	hub.DeliverToAgent(context.Background(), "dev-2", "kept", input)
+	agent := &Client{DeviceID: "dev-1", SessionName: "live", IsAgent: true, Send: make(chan []byte, 4)}
+	hub.addClient(agent)
+
+	hub.ForgetSession("dev-1", "deleted")
+	if _, ok := hub.streams[SessionRoom("dev-1", "deleted")]; ok || len(hub.streams) != 4 {
+		t.Fatalf("streams = %v, want the deleted session dropped", hub.streams)
+	}
+
+	start := time.Now()
+	hub.evictIdleStreams(start)
+	hub.evictIdleStreams(start.Add(streamIdleTimeout - time.Second))
+	if len(hub.streams) != 4 {
+		t.Fatalf("streams = %d, want none dropped before the idle timeout", len(hub.streams))
+	}
+	hub.evictIdleStreams(start.Add(streamIdleTimeout))
+	if _, ok := hub.streams[SessionRoom("dev-1", "live")]; !ok || len(hub.streams) != 1 {
+		t.Fatalf("streams = %v, want only the session with an agent kept", hub.streams)
+	}
+
+	hub.DeliverToAgent(context.Background(), "dev-2", "kept", input)
+	hub.ForgetDevice("dev-1")
+	if _, ok := hub.streams[SessionRoom("dev-2", "kept")]; !ok || len(hub.streams) != 1 {
+		t.Fatalf("streams = %v, want only dev-2 kept after deleting dev-1", hub.streams)
+	}
+}
+
+type presenceRecorder chan service.AgentPresence
+
+func (r presenceRecorder) HandleAgentPresence(presence service.AgentPresence) {
+	r <- presence
+}
+
+func TestNotifyPresenceCoalescesWithoutBlocking(t *testing.T) {
+	hub := NewHub()
+	// Nothing runs the handlers yet; the hub must not block
+	for i := 0; i < 1000; i++ {
+		hub.notifyPresence(service.AgentPresence{DeviceID: "dev-1", SessionName: []string{"s0", "s1", "s2"}[i%3], SessionOnline: i%2 == 0})
+	}
+	if len(hub.presenceQueue) != 3 {
+		t.Fatalf("queued = %d, want one change per session", len(hub.presenceQueue))
+	}
+
+	changes := make(presenceRecorder, 8)
+	hub.AddPresenceHandler(changes)
+	go hub.runPresenceHandlers()
+	for _, want := range []service.AgentPresence{
+		{DeviceID: "dev-1", SessionName: "s0", SessionOnline: false}, // i = 999
+		{DeviceID: "dev-1", SessionName: "s1", SessionOnline: false}, // i = 997
+		{DeviceID: "dev-1", SessionName: "s2", SessionOnline: true},  // i = 998
+	} {
+		select {
+		case got := <-changes:
+			if got.SessionName != want.SessionName || got.SessionOnline != want.SessionOnline {
+				t.Fatalf("presence = %+v, want %+v", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("presence change not handled")
+		}
+	}
+}
+
+func TestHubReportsAgentPresenceChanges(t *testing.T) {
+	hub := NewHub()
+	changes := make(presenceRecorder, 8)
+	hub.AddPresenceHandler(changes)
+	go hub.Run()
+
+	expect := func(sessionOnline, deviceOnline bool) {
+		t.Helper()
+		select {
+		case presence := <-changes:
+			if presence.DeviceID != "dev-1" || presence.SessionName != "feature" || presence.SessionOnline != sessionOnline || presence.DeviceOnline != deviceOnline {
+				t.Fatalf("presence = %+v, want session=%v device=%v", presence, sessionOnline, deviceOnline)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no presence change")
+		}
+	}
+
+	first := &Client{DeviceID: "dev-1", SessionName: "feature", IsAgent: true, Send: make(chan []byte, 1)}
+	second := &Client{DeviceID: "dev-1", SessionName: "feature", IsAgent: true, Send: make(chan []byte, 1)}
+	other := &Client{DeviceID: "dev-1", SessionName: "bugfix", IsAgent: true, Send: make(chan []byte, 1)}
+	viewer := &Client{DeviceID: "dev-1", SessionName: "feature", UserID: 42, Send: make(chan []byte, 1)}
+
+	hub.Register(first)
+	expect(true, true)
+	if lastSeen, online := hub.AgentLastSeen("dev-1"); !online || lastSeen.IsZero() {
+		t.Fatalf("AgentLastSeen = %v, %v", lastSeen, online)
+	}
+
+	// A reconnect overlapping the old connection and viewers change nothing
+	hub.Register(second)
+	hub.Register(viewer)
+	hub.Unregister(first)
+	hub.Unregister(viewer)
+	hub.Register(other)
+	select {
+	case presence := <-changes:
+		if presence.SessionName != "bugfix" {
+			t.Fatalf("unexpected presence change %+v", presence)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no presence change for the second session")
+	}
+	if got := len(hub.Presence("dev-1")); got != 2 {
+		t.Fatalf("len(Presence) = %d, want 2", got)
+	}
+
+	hub.Unregister(second)
+	expect(false, true)
+	hub.Unregister(other)
+	select {
+	case presence := <-changes:
+		if presence.SessionOnline || presence.DeviceOnline {
+			t.Fatalf("presence = %+v, want device offline", presence)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no presence change for the last agent")
+	}
+	if _, online := hub.AgentLastSeen("dev-1"); online {
+		t.Fatal("device should be offline")
+	}
+}
+
+func TestMessageTypeBoundsMetricLabels(t *testing.T) {
+	for message, want := range map[string]string{
+		`{"type":"terminal_output","payload":{"content":"{\"type\":\"x\"}"}}`: "terminal_output",
+		`{"id":"req-1","type":"get_diff","version":1}`:                        "get_diff",
+		`{"type":"DROP TABLE"}`:                                               "other",
+		`not json`:                                                            "other",
+		string(service.EncodeUploadFrame("up-1", 0, []byte("data"))):          "upload_frame",
+	} {
+		if got := MessageType([]byte(message)); got != want {
+			t.Errorf("MessageType(%.30q) = %q, want %q", message, got, want)
+		}
+	}
+}
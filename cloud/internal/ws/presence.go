@@ -0,0 +1,170 @@
+package ws
+
+import (
+	"strings"
+	"time"
+
+	"github.com/mobile-coder/cloud/internal/service"
+)
+
+// PresenceHandler is told when the agent of a session connects or goes
+// away, e.g. to update device and session status.
+type PresenceHandler interface {
+	HandleAgentPresence(presence service.AgentPresence)
+}
+
+// ClientPresence is one connected client as the hub last saw it.
+type ClientPresence struct {
+	DeviceID    string    `json:"device_id"`
+	SessionName string    `json:"session_name,omitempty"`
+	UserID      int64     `json:"user_id,omitempty"`
+	IsAgent     bool      `json:"is_agent"`
+	LastSeen    time.Time `json:"last_seen"`
+	QueueDepth  int       `json:"queue_depth"` // frames waiting to be written, see Client.QueueDepth
+	Behind      float64   `json:"behind_seconds"`
+	Dropped     uint64    `json:"dropped"`
+	Coalesced   uint64    `json:"coalesced"`
+}
+
+// Touch records that a frame (or pong) arrived from the client.
+func (c *Client) Touch() {
+	c.lastSeen.Store(time.Now().UnixNano())
+}
+
+// LastSeen returns when the client was last heard from.
+func (c *Client) LastSeen() time.Time {
+	return time.Unix(0, c.lastSeen.Load())
+}
+
+// AddPresenceHandler registers a receiver of agent presence changes. Call
+// it before agents connect.
+func (h *Hub) AddPresenceHandler(handler PresenceHandler) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.presenceHandlers = append(h.presenceHandlers, handler)
+}
+
+// Presence lists the connected clients of a device, agents and viewers.
+func (h *Hub) Presence(deviceID string) []ClientPresence {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var presence []ClientPresence
+	for client := range h.rooms[DeviceRoom(deviceID)] {
+		presence = append(presence, client.presence())
+	}
+	return presence
+}
+
+// Clients lists every client connected to this replica.
+func (h *Hub) Clients() []ClientPresence {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var presence []ClientPresence
+	for room, clients := range h.rooms {
+		if !strings.HasPrefix(string(room), deviceRoomPrefix) {
+			continue
+		}
+		// Every client is in exactly one device room
+		for client := range clients {
+			presence = append(presence, client.presence())
+		}
+	}
+	return presence
+}
+
+func (c *Client) presence() ClientPresence {
+	return ClientPresence{
+		DeviceID:    c.DeviceID,
+		SessionName: c.SessionName,
+		UserID:      c.UserID,
+		IsAgent:     c.IsAgent,
+		LastSeen:    c.LastSeen(),
+		QueueDepth:  c.QueueDepth(),
+		Behind:      c.Behind().Seconds(),
+		Dropped:     c.dropped.Load(),
+		Coalesced:   c.coalesced.Load(),
+	}
+}
+
+// AgentLastSeen returns when an agent of the device was last heard from,
+// and false when none is connected to any replica.
+func (h *Hub) AgentLastSeen(deviceID string) (time.Time, bool) {
+	if lastSeen, ok := h.localAgentLastSeen(deviceID); ok {
+		return lastSeen, true
+	}
+	if record, ok := h.remoteDeviceAgent(deviceID); ok {
+		return record.LastSeen, true
+	}
+	return time.Time{}, false
+}
+
+func (h *Hub) localAgentLastSeen(deviceID string) (time.Time, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var lastSeen time.Time
+	found := false
+	for client := range h.rooms[DeviceRoom(deviceID)] {
+		if client.IsAgent {
+			found = true
+			if seen := client.LastSeen(); seen.After(lastSeen) {
+				lastSeen = seen
+			}
+		}
+	}
+	return lastSeen, found
+}
+
+// agentPresence describes the agents of client's session and device after
+// it registered or unregistered; h.mu must be held.
+func (h *Hub) agentPresence(client *Client) service.AgentPresence {
+	presence := service.AgentPresence{
+		DeviceID:    client.DeviceID,
+		SessionName: client.SessionName,
+		LastSeen:    client.LastSeen(),
+	}
+	presence.DeviceOnline = h.agentCount(DeviceRoom(client.DeviceID)) > 0
+	presence.SessionOnline = h.agentCount(client.room()) > 0
+	return presence
+}
+
+// notifyPresence queues a presence change without blocking the hub; handlers
+// run one at a time in order so a quick reconnect never ends up as offline.
+// A change still waiting replaces the older one of the same session, so
+// only the latest state of each session is handled.
+func (h *Hub) notifyPresence(presence service.AgentPresence) {
+	h.presenceMu.Lock()
+	replaced := false
+	for i, queued := range h.presenceQueue {
+		if queued.DeviceID == presence.DeviceID && queued.SessionName == presence.SessionName {
+			h.presenceQueue[i] = presence
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		h.presenceQueue = append(h.presenceQueue, presence)
+	}
+	h.presenceMu.Unlock()
+	select {
+	case h.presenceReady <- struct{}{}:
+	default:
+	}
+}
+
+func (h *Hub) runPresenceHandlers() {
+	for range h.presenceReady {
+		h.presenceMu.Lock()
+		queue := h.presenceQueue
+		h.presenceQueue = nil
+		h.presenceMu.Unlock()
+		for _, presence := range queue {
+			presence = h.withRemoteAgents(presence)
+			h.mu.RLock()
+			handlers := h.presenceHandlers
+			h.mu.RUnlock()
+			for _, handler := range handlers {
+				handler.HandleAgentPresence(presence)
+			}
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package ws
+
+import "time"
+
+// defaultSlowClientTimeout is how long a viewer may stay behind before the
+// hub disconnects it. It reconnects and starts over from the last snapshot.
+const defaultSlowClientTimeout = 30 * time.Second
+
+// Per-client queueing: frames go into Send without blocking. Terminal
+// output is a full snapshot of the pane, so when Send is full only the
+// newest snapshot is kept aside and written once Send drains; older ones
+// are coalesced away. Other frames that do not fit are dropped and counted.
+// A viewer that stays behind longer than the slow client timeout is
+// disconnected.
+
+// SetSlowClientTimeout changes how long a viewer may stay behind. Call it
+// before clients connect.
+func (h *Hub) SetSlowClientTimeout(timeout time.Duration) {
+	if timeout > 0 {
+		h.slowClientTimeout = timeout
+	}
+}
+
+// enqueue queues message for client without blocking and reports whether
+// it fit.
+func (h *Hub) enqueue(client *Client, message []byte) bool {
+	select {
+	case client.Send <- message:
+		return true
+	default:
+	}
+	client.dropped.Add(1)
+	h.droppedFrames.Add(1)
+	h.fellBehind(client)
+	return false
+}
+
+// What became of a snapshot handed to enqueueSnapshot.
+const (
+	snapshotQueued    = "queued"    // went into Send
+	snapshotHeld      = "held"      // kept aside until Send drains
+	snapshotCoalesced = "coalesced" // kept aside, replacing an older snapshot
+)
+
+// enqueueSnapshot queues terminal output for client, replacing a snapshot
+// still waiting for room, and reports which of the above happened.
+func (h *Hub) enqueueSnapshot(client *Client, message []byte) string {
+	outcome := snapshotHeld
+	client.queueMu.Lock()
+	if client.snapshot == nil {
+		select {
+		case client.Send <- message:
+			client.queueMu.Unlock()
+			return snapshotQueued
+		default:
+		}
+	} else {
+		client.coalesced.Add(1)
+		h.coalescedFrames.Add(1)
+		outcome = snapshotCoalesced
+	}
+	client.snapshot = message
+	client.queueMu.Unlock()
+
+	select {
+	case client.wakeChan() <- struct{}{}:
+	default:
+	}
+	h.fellBehind(client)
+	return outcome
+}
+
+// fellBehind starts or checks the slow client clock of client.
+func (h *Hub) fellBehind(client *Client) {
+	client.queueMu.Lock()
+	now := time.Now()
+	if client.behindSince.IsZero() {
+		client.behindSince = now
+	}
+	behind := now.Sub(client.behindSince)
+	client.queueMu.Unlock()
+
+	if client.IsAgent || behind < h.slowClientTimeout {
+		return
+	}
+	if client.kicked.CompareAndSwap(false, true) {
+		h.slowDisconnects.Add(1)
+		client.Log().Warn("hub disconnecting slow viewer", "room", client.room(),
+			"behind", behind.Round(time.Second), "queue", len(client.Send))
+		// readPump fails and unregisters the client
+		if client.Conn != nil {
+			client.Conn.Close()
+		}
+	}
+}
+
+// QueueDepth returns the frames waiting to be written to the client,
+// counting a snapshot kept aside.
+func (c *Client) QueueDepth() int {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	depth := len(c.Send)
+	if c.snapshot != nil {
+		depth++
+	}
+	return depth
+}
+
+// Behind returns how long the client has been unable to keep up, or zero.
+func (c *Client) Behind() time.Duration {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	if c.behindSince.IsZero() {
+		return 0
+	}
+	return time.Since(c.behindSince)
+}
+
+func (c *Client) wakeChan() chan struct{} {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	if c.wake == nil {
+		c.wake = make(chan struct{}, 1)
+	}
+	return c.wake
+}
+
+// Wake fires when a coalesced snapshot is waiting; writePump then calls
+// TakeSnapshot.
+func (c *Client) Wake() <-chan struct{} {
+	return c.wakeChan()
+}
+
+// TakeSnapshot returns the snapshot waiting for the client once everything
+// queued before it has been written, or nil. A drained queue means the
+// client has caught up.
+func (c *Client) TakeSnapshot() []byte {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	if len(c.Send) > 0 {
+		return nil
+	}
+	snapshot := c.snapshot
+	c.snapshot = nil
+	c.behindSince = time.Time{}
+	return snapshot
+}
+
+// QueueStats are the hub-wide counters of frames that did not reach a
+// client as sent.
+type QueueStats struct {
+	Dropped         uint64 `json:"dropped"`          // did not fit and were discarded
+	Coalesced       uint64 `json:"coalesced"`        // snapshots replaced by a newer one
+	SlowDisconnects uint64 `json:"slow_disconnects"` // viewers dropped for staying behind
+}
+
+func (h *Hub) QueueStats() QueueStats {
+	return QueueStats{
+		Dropped:         h.droppedFrames.Load(),
+		Coalesced:       h.coalescedFrames.Load(),
+		SlowDisconnects: h.slowDisconnects.Load(),
+	}
+}
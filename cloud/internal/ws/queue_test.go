@@ -0,0 +1,98 @@
+package ws
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func terminalOutput(content string) []byte {
+	return []byte(`{"type":"terminal_output","payload":{"content":"` + content + `\n"}}`)
+}
+
+func TestSlowViewerGetsNewestSnapshot(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	viewer := &Client{DeviceID: "dev-1", SessionName: "feature", UserID: 42, Send: make(chan []byte, 2)}
+	hub.Register(viewer)
+	waitForClients(t, hub, DeviceRoom("dev-1"), 1)
+
+	for i := 1; i <= 5; i++ {
+		hub.BroadcastToViewers(context.Background(), "dev-1", "feature", terminalOutput("frame "+strconv.Itoa(i)))
+	}
+	// Other frames that do not fit are dropped and counted
+	hub.BroadcastToDevice("dev-1", []byte(`{"type":"notice"}`))
+
+	presence := hub.Presence("dev-1")
+	if len(presence) != 1 || presence[0].QueueDepth != 3 || presence[0].Coalesced != 2 || presence[0].Dropped != 1 || presence[0].Behind <= 0 {
+		t.Fatalf("presence = %+v, want depth 3 with the held snapshot, 2 coalesced, 1 dropped, behind", presence)
+	}
+	if stats := hub.QueueStats(); stats.Coalesced != 2 || stats.Dropped != 1 {
+		t.Fatalf("QueueStats = %+v", stats)
+	}
+
+	// Like writePump: the snapshot waits until the frames before it are out
+	select {
+	case <-viewer.Wake():
+	default:
+		t.Fatal("Wake did not fire for the coalesced snapshot")
+	}
+	expectMessage(t, viewer.Send, "frame 1")
+	if snapshot := viewer.TakeSnapshot(); snapshot != nil {
+		t.Fatalf("snapshot %s taken before the queue drained", snapshot)
+	}
+	expectMessage(t, viewer.Send, "frame 2")
+	if snapshot := viewer.TakeSnapshot(); snapshot == nil || !bytes.Contains(snapshot, []byte("frame 5")) {
+		t.Fatalf("snapshot = %s, want the newest frame", snapshot)
+	}
+	if viewer.TakeSnapshot() != nil {
+		t.Fatal("snapshot taken twice")
+	}
+
+	// Caught up: output goes straight into the queue again
+	hub.BroadcastToViewers(context.Background(), "dev-1", "feature", terminalOutput("frame 6"))
+	expectMessage(t, viewer.Send, "frame 6")
+	if viewer.QueueDepth() != 0 || viewer.Behind() != 0 {
+		t.Fatalf("depth = %d, behind = %s after catching up", viewer.QueueDepth(), viewer.Behind())
+	}
+}
+
+func TestEnqueueSnapshotReportsOutcome(t *testing.T) {
+	hub := NewHub()
+	viewer := &Client{DeviceID: "dev-1", SessionName: "feature", Send: make(chan []byte, 1)}
+	for i, want := range []string{snapshotQueued, snapshotHeld, snapshotCoalesced} {
+		if got := hub.enqueueSnapshot(viewer, terminalOutput("frame "+strconv.Itoa(i))); got != want {
+			t.Fatalf("snapshot %d: outcome = %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestHubDisconnectsViewersThatStayBehind(t *testing.T) {
+	hub := NewHub()
+	hub.SetSlowClientTimeout(30 * time.Millisecond)
+	go hub.Run()
+	viewer := &Client{DeviceID: "dev-1", SessionName: "feature", UserID: 42, Send: make(chan []byte, 1)}
+	agent := &Client{DeviceID: "dev-1", SessionName: "feature", IsAgent: true, Send: make(chan []byte, 1)}
+	hub.Register(viewer)
+	hub.Register(agent)
+	waitForClients(t, hub, DeviceRoom("dev-1"), 2)
+
+	// Nobody drains either queue
+	deadline := time.Now().Add(2 * time.Second)
+	for !viewer.kicked.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("slow viewer was not disconnected")
+		}
+		hub.BroadcastToViewers(context.Background(), "dev-1", "feature", terminalOutput("tick"))
+		hub.BroadcastToDevice("dev-1", []byte(`{"type":"notice"}`))
+		time.Sleep(5 * time.Millisecond)
+	}
+	if agent.kicked.Load() {
+		t.Fatal("agents are never disconnected for being slow")
+	}
+	if stats := hub.QueueStats(); stats.SlowDisconnects != 1 {
+		t.Fatalf("SlowDisconnects = %d, want 1", stats.SlowDisconnects)
+	}
+}
@@ -0,0 +1,307 @@
+package ws
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RedisBackplane is a Backplane over Redis pub/sub and keys. It speaks
+// RESP directly: one connection for commands and one per subscription,
+// redialed when they drop.
+type RedisBackplane struct {
+	addr     string
+	password string
+
+	mu     sync.Mutex // guards conn and serialises commands
+	conn   net.Conn
+	reader *bufio.Reader
+
+	closeOnce sync.Once
+	done      chan struct{}
+	subsMu    sync.Mutex
+	subs      []net.Conn
+}
+
+const redisDialTimeout = 5 * time.Second
+
+// NewRedisBackplane connects to redis://[:password@]host:port.
+func NewRedisBackplane(rawURL string) (*RedisBackplane, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	b := &RedisBackplane{addr: parsed.Host, done: make(chan struct{})}
+	if parsed.User != nil {
+		b.password, _ = parsed.User.Password()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.connectLocked(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *RedisBackplane) dial() (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", b.addr, redisDialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(conn)
+	if b.password != "" {
+		if _, err := redisRoundTrip(conn, reader, "AUTH", b.password); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	return conn, reader, nil
+}
+
+func (b *RedisBackplane) connectLocked() error {
+	conn, reader, err := b.dial()
+	if err != nil {
+		return err
+	}
+	b.conn, b.reader = conn, reader
+	return nil
+}
+
+// do runs a command, redialing once if the connection dropped.
+func (b *RedisBackplane) do(args ...string) (interface{}, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for attempt := 0; ; attempt++ {
+		if b.conn == nil {
+			if err := b.connectLocked(); err != nil {
+				return nil, err
+			}
+		}
+		reply, err := redisRoundTrip(b.conn, b.reader, args...)
+		var redisErr redisError
+		if err == nil || errors.As(err, &redisErr) || attempt > 0 {
+			return reply, err
+		}
+		b.conn.Close()
+		b.conn = nil
+	}
+}
+
+func (b *RedisBackplane) Publish(channel string, message []byte) error {
+	_, err := b.do("PUBLISH", channel, string(message))
+	return err
+}
+
+func (b *RedisBackplane) Set(key string, value []byte, ttl time.Duration) error {
+	args := []string{"SET", key, string(value)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	_, err := b.do(args...)
+	return err
+}
+
+func (b *RedisBackplane) Get(key string) ([]byte, error) {
+	reply, err := b.do("GET", key)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, ErrBackplaneMiss
+	}
+	return value, nil
+}
+
+func (b *RedisBackplane) Delete(key string) error {
+	_, err := b.do("DEL", key)
+	return err
+}
+
+// Subscribe reads the channel on its own connection until Close,
+// resubscribing after a dropped connection. Messages published while it
+// was down are lost, as with any Redis pub/sub.
+func (b *RedisBackplane) Subscribe(channel string, handler func(message []byte)) error {
+	conn, reader, err := b.subscribe(channel)
+	if err != nil {
+		return err
+	}
+	go func() {
+		backoff := 100 * time.Millisecond
+		for {
+			err := b.readSubscription(reader, handler)
+			b.dropSubscription(conn)
+			select {
+			case <-b.done:
+				return
+			default:
+			}
+			slog.Warn("backplane subscription lost", "channel", channel, "error", err)
+			for {
+				time.Sleep(backoff)
+				if conn, reader, err = b.subscribe(channel); err == nil {
+					backoff = 100 * time.Millisecond
+					break
+				}
+				select {
+				case <-b.done:
+					return
+				default:
+				}
+				if backoff < 5*time.Second {
+					backoff *= 2
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (b *RedisBackplane) subscribe(channel string) (net.Conn, *bufio.Reader, error) {
+	conn, reader, err := b.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := redisRoundTrip(conn, reader, "SUBSCRIBE", channel); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	b.subsMu.Lock()
+	defer b.subsMu.Unlock()
+	select {
+	case <-b.done:
+		conn.Close()
+		return nil, nil, errors.New("backplane closed")
+	default:
+	}
+	b.subs = append(b.subs, conn)
+	return conn, reader, nil
+}
+
+func (b *RedisBackplane) dropSubscription(conn net.Conn) {
+	conn.Close()
+	b.subsMu.Lock()
+	defer b.subsMu.Unlock()
+	for i, sub := range b.subs {
+		if sub == conn {
+			b.subs = append(b.subs[:i], b.subs[i+1:]...)
+			break
+		}
+	}
+}
+
+func (b *RedisBackplane) readSubscription(reader *bufio.Reader, handler func(message []byte)) error {
+	for {
+		reply, err := readRESP(reader)
+		if err != nil {
+			return err
+		}
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 3 {
+			continue
+		}
+		if kind, _ := items[0].([]byte); string(kind) != "message" {
+			continue
+		}
+		if message, ok := items[2].([]byte); ok {
+			handler(message)
+		}
+	}
+}
+
+func (b *RedisBackplane) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.done)
+		b.subsMu.Lock()
+		for _, conn := range b.subs {
+			conn.Close()
+		}
+		b.subsMu.Unlock()
+		b.mu.Lock()
+		if b.conn != nil {
+			b.conn.Close()
+		}
+		b.mu.Unlock()
+	})
+	return nil
+}
+
+// redisError is an error reply from the server; the connection stays
+// usable.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func redisRoundTrip(w io.Writer, reader *bufio.Reader, args ...string) (interface{}, error) {
+	if err := writeRESPCommand(w, args...); err != nil {
+		return nil, err
+	}
+	return readRESP(reader)
+}
+
+func writeRESPCommand(w io.Writer, args ...string) error {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// readRESP reads one reply: simple strings and bulk strings as []byte,
+// integers as int64, nil bulk strings as nil and arrays as []interface{}.
+func readRESP(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	body := string(line[1 : len(line)-2])
+	switch line[0] {
+	case '+':
+		return []byte(body), nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRESP(reader); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
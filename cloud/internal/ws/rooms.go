@@ -0,0 +1,151 @@
+package ws
+
+import "strconv"
+
+// Room is a set of clients a message can be addressed to. Every client is
+// in the room of its device and, when it connected with one, the room of
+// its session; viewers are also in the room of their user. A viewer can
+// subscribe to more session rooms of its device.
+//
+// Routing of each message type:
+//
+//	message                           from    to
+//	terminal_output                   agent   viewers in the session room (BroadcastToViewers)
+//	terminal_input                    viewer  agent in the session room, sequenced (DeliverToAgent)
+//	get_diff, list_dir, ... requests  cloud   agent in the session room (RequestAgent)
+//	replies (reply_to set)            agent   the waiting RequestAgent caller (DeliverResponse)
+//	create_session                    cloud   one agent in the device room (SendToDeviceAgent)
+//	hello, ack, workspace_status      agent   the cloud only
+//	prompt_done                       agent   the task queue of the session (HandlePromptDone)
+//	subscribe, unsubscribe            viewer  the cloud only
+//	notifications                     cloud   every client in the user room (BroadcastToUser)
+//	anything else                     any     every client in the device room (BroadcastToDevice)
+//
+// Lookups are one map access per room; nothing scans all clients.
+type Room string
+
+const deviceRoomPrefix = "device:"
+
+func DeviceRoom(deviceID string) Room {
+	return Room(deviceRoomPrefix + deviceID)
+}
+
+func SessionRoom(deviceID, sessionName string) Room {
+	return Room("session:" + deviceID + "/" + sessionName)
+}
+
+func UserRoom(userID int64) Room {
+	return Room("user:" + strconv.FormatInt(userID, 10))
+}
+
+// routeRoom is the room a message for deviceID/sessionName goes to: the
+// session room, or the device room without a session.
+func routeRoom(deviceID, sessionName string) Room {
+	if sessionName != "" {
+		return SessionRoom(deviceID, sessionName)
+	}
+	return DeviceRoom(deviceID)
+}
+
+// room is the room the client connected for.
+func (c *Client) room() Room {
+	return routeRoom(c.DeviceID, c.SessionName)
+}
+
+// addClient puts a registering client in its rooms; h.mu must be held.
+func (h *Hub) addClient(client *Client) {
+	h.join(client, DeviceRoom(client.DeviceID))
+	if client.SessionName != "" {
+		h.join(client, SessionRoom(client.DeviceID, client.SessionName))
+	}
+	if client.UserID > 0 {
+		h.join(client, UserRoom(client.UserID))
+	}
+}
+
+// removeClient takes a client out of all its rooms and reports whether it
+// was registered; h.mu must be held.
+func (h *Hub) removeClient(client *Client) bool {
+	if len(client.rooms) == 0 {
+		return false
+	}
+	for room := range client.rooms {
+		h.leave(client, room)
+	}
+	return true
+}
+
+// join and leave keep h.rooms and client.rooms in step; h.mu must be held.
+func (h *Hub) join(client *Client, room Room) {
+	members := h.rooms[room]
+	if members == nil {
+		members = make(map[*Client]bool)
+		h.rooms[room] = members
+	}
+	members[client] = true
+	if client.rooms == nil {
+		client.rooms = make(map[Room]bool)
+	}
+	client.rooms[room] = true
+}
+
+func (h *Hub) leave(client *Client, room Room) {
+	if members, ok := h.rooms[room]; ok {
+		delete(members, client)
+		if len(members) == 0 {
+			delete(h.rooms, room)
+		}
+	}
+	delete(client.rooms, room)
+}
+
+// Subscribe adds a registered viewer to another session of its device, so
+// it gets that session's terminal output too, starting with the last one.
+func (h *Hub) Subscribe(client *Client, sessionName string) bool {
+	if client.IsAgent || sessionName == "" {
+		return false
+	}
+	room := SessionRoom(client.DeviceID, sessionName)
+	h.mu.Lock()
+	registered := len(client.rooms) > 0
+	if registered {
+		h.join(client, room)
+	}
+	h.mu.Unlock()
+	if registered {
+		h.sendLastOutput(client, room)
+	}
+	return registered
+}
+
+// Unsubscribe undoes Subscribe. The session a viewer connected for stays.
+func (h *Hub) Unsubscribe(client *Client, sessionName string) {
+	if sessionName == "" || sessionName == client.SessionName {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.leave(client, SessionRoom(client.DeviceID, sessionName))
+}
+
+// Rooms lists the rooms a client is in.
+func (h *Hub) Rooms(client *Client) []Room {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	rooms := make([]Room, 0, len(client.rooms))
+	for room := range client.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// agentCount counts the agents in room; h.mu must be held.
+func (h *Hub) agentCount(room Room) int {
+	count := 0
+	for client := range h.rooms[room] {
+		if client.IsAgent {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,192 @@
+package ws
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHubRoutesThroughRooms(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	newClient := func(deviceID, sessionName string, userID int64, isAgent bool) *Client {
+		client := &Client{DeviceID: deviceID, SessionName: sessionName, UserID: userID, IsAgent: isAgent, Send: make(chan []byte, 8)}
+		hub.Register(client)
+		return client
+	}
+	agent := newClient("dev-1", "feature", 0, true)
+	viewer := newClient("dev-1", "feature", 42, false)
+	bugfix := newClient("dev-1", "bugfix", 42, false)
+	deviceOnly := newClient("dev-1", "", 42, false)
+	// Same session name on another device of another user
+	elsewhere := newClient("dev-2", "feature", 7, false)
+	waitForClients(t, hub, DeviceRoom("dev-1"), 4)
+	waitForClients(t, hub, DeviceRoom("dev-2"), 1)
+
+	expectQueued := func(want map[*Client]int) {
+		t.Helper()
+		names := map[*Client]string{agent: "agent", viewer: "viewer", bugfix: "bugfix", deviceOnly: "deviceOnly", elsewhere: "elsewhere"}
+		for client, name := range names {
+			if got := len(client.Send); got != want[client] {
+				t.Errorf("%s has %d queued, want %d", name, got, want[client])
+			}
+			for len(client.Send) > 0 {
+				<-client.Send
+			}
+		}
+	}
+
+	// BroadcastToDevice reaches session clients too, but not other devices
+	hub.BroadcastToDevice("dev-1", []byte(`{"type":"notice"}`))
+	expectQueued(map[*Client]int{agent: 1, viewer: 1, bugfix: 1, deviceOnly: 1})
+
+	// SendToDevice no longer stops at the first client
+	if !hub.SendToDevice("dev-1", []byte(`{"type":"notice"}`)) {
+		t.Fatal("SendToDevice = false")
+	}
+	expectQueued(map[*Client]int{agent: 1, viewer: 1, bugfix: 1, deviceOnly: 1})
+	if hub.SendToDevice("dev-3", []byte(`{}`)) {
+		t.Fatal("SendToDevice = true for a device without clients")
+	}
+
+	hub.BroadcastToUser(42, []byte(`{"type":"notice"}`))
+	expectQueued(map[*Client]int{viewer: 1, bugfix: 1, deviceOnly: 1})
+
+	// Terminal output stays in its session, on its device
+	hub.BroadcastToViewers(context.Background(), "dev-1", "feature", []byte(`{"type":"terminal_output","payload":{"content":"feature\n"}}`))
+	expectQueued(map[*Client]int{viewer: 1})
+
+	// A viewer can follow another session and gets its last output at once
+	if !hub.Subscribe(bugfix, "feature") {
+		t.Fatal("Subscribe = false for a registered viewer")
+	}
+	expectMessage(t, bugfix.Send, "feature")
+	hub.BroadcastToViewers(context.Background(), "dev-1", "feature", []byte(`{"type":"terminal_output","payload":{"content":"more\n"}}`))
+	expectQueued(map[*Client]int{viewer: 1, bugfix: 1})
+	if hub.Subscribe(agent, "bugfix") {
+		t.Fatal("agents cannot subscribe to other sessions")
+	}
+
+	hub.Unsubscribe(bugfix, "feature")
+	hub.Unsubscribe(bugfix, "bugfix") // its own session stays
+	hub.BroadcastToViewers(context.Background(), "dev-1", "feature", []byte(`{"type":"terminal_output","payload":{"content":"again\n"}}`))
+	hub.BroadcastToViewers(context.Background(), "dev-1", "bugfix", []byte(`{"type":"terminal_output","payload":{"content":"fix\n"}}`))
+	expectQueued(map[*Client]int{viewer: 1, bugfix: 1})
+
+	hub.Unregister(bugfix)
+	waitForClients(t, hub, DeviceRoom("dev-1"), 3)
+	if rooms := hub.Rooms(bugfix); len(rooms) != 0 {
+		t.Fatalf("unregistered client still in %v", rooms)
+	}
+	if hub.Subscribe(bugfix, "feature") {
+		t.Fatal("Subscribe = true after Unregister")
+	}
+}
+
+// Run with -race: registration, subscriptions and every kind of delivery
+// happen at once.
+func TestHubRoomsConcurrently(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	const devices, viewersPerDevice = 4, 8
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for d := 0; d < devices; d++ {
+		deviceID := fmt.Sprintf("dev-%d", d)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				hub.BroadcastToDevice(deviceID, []byte(`{"type":"notice"}`))
+				hub.BroadcastToViewers(context.Background(), deviceID, "s0", []byte(`{"type":"terminal_output","payload":{"content":"x\n"}}`))
+				hub.SendToDevice(deviceID, []byte(`{}`))
+				hub.BroadcastToUser(1, []byte(`{}`))
+				hub.SendToDeviceAgent(deviceID, []byte(`{}`))
+				hub.Presence(deviceID)
+			}
+		}()
+	}
+
+	var clients sync.WaitGroup
+	for d := 0; d < devices; d++ {
+		for v := 0; v < viewersPerDevice; v++ {
+			client := &Client{DeviceID: fmt.Sprintf("dev-%d", d), SessionName: fmt.Sprintf("s%d", v%2), UserID: int64(v%3 + 1),
+				IsAgent: v == 0, Send: make(chan []byte, 4)}
+			clients.Add(1)
+			go func() {
+				defer clients.Done()
+				// Drain like writePump until the hub closes Send
+				go func() {
+					for range client.Send {
+					}
+				}()
+				hub.Register(client)
+				for i := 0; i < 20; i++ {
+					hub.Subscribe(client, "s0")
+					hub.Subscribe(client, "s1")
+					hub.Unsubscribe(client, "s0")
+				}
+				hub.Unregister(client)
+			}()
+		}
+	}
+	clients.Wait()
+	close(stop)
+	wg.Wait()
+
+	// Run may still be handling the last Unregister
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		hub.mu.RLock()
+		left := len(hub.rooms)
+		hub.mu.RUnlock()
+		if left == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d rooms left after every client unregistered", left)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func waitForClients(t *testing.T, hub *Hub, room Room, want int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		hub.mu.RLock()
+		got := len(hub.rooms[room])
+		hub.mu.RUnlock()
+		if got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s has %d clients, want %d", room, got, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSendLastOutputSkipsUnregisteredClient(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	hub.BroadcastToViewers(context.Background(), "dev-1", "feature", []byte(`{"type":"terminal_output","payload":{"content":"$ "}}`))
+
+	viewer := &Client{DeviceID: "dev-1", SessionName: "feature", UserID: 7, Send: make(chan []byte, 4)}
+	hub.Register(viewer)
+	hub.Unregister(viewer)
+	for range viewer.Send {
+	}
+
+	// Gone before its last output was queued: no send on the closed channel
+	hub.SendLastOutput(viewer)
+}
@@ -0,0 +1,316 @@
+package ws
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mobile-coder/cloud/internal/service"
+	"github.com/mobile-coder/tracing"
+)
+
+// maxStreamFrames bounds the unacked frames kept for an agent session. When
+// an agent stays away longer than that, the oldest input is dropped.
+const maxStreamFrames = 1024
+
+// A stream whose agent has been gone for streamIdleTimeout is dropped,
+// with whatever input it still buffered; the hub checks every
+// streamSweepInterval.
+const (
+	streamIdleTimeout   = 15 * time.Minute
+	streamSweepInterval = time.Minute
+)
+
+type streamFrame struct {
+	seq     uint64
+	message []byte
+}
+
+// agentStream is the reliable link to the agent of one session. It
+// outlives connections so input typed while the agent reconnects is
+// replayed once it resumes. With a backplane the replica the agent is
+// connected to owns the stream and stores every change, so the replica the
+// agent reconnects to next can take it over (see shareStream).
+type agentStream struct {
+	id      string // identifies this cloud-side stream; changes on restart
+	nextSeq uint64
+	outbox  []streamFrame
+	client  *Client // connection that resumed last
+	sentSeq uint64  // highest seq handed to client
+
+	agentStreamID string // the agent's outbound stream
+	lastReceived  uint64 // highest seq received from the agent
+
+	idleSince time.Time // first sweep that found no agent in the room
+
+	version       uint64     // changes captured for the backplane, guarded by h.mu
+	storeMu       sync.Mutex // guards storedVersion
+	storedVersion uint64     // newest change stored in the backplane
+}
+
+func newStreamID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// stream returns the stream of a session room; h.mu must be held.
+func (h *Hub) stream(room Room) *agentStream {
+	stream, ok := h.streams[room]
+	if !ok {
+		stream = &agentStream{id: newStreamID()}
+		h.streams[room] = stream
+	}
+	return stream
+}
+
+// evictIdleStreams drops the streams of rooms that have had no agent for
+// streamIdleTimeout, so sessions that are gone do not keep their state.
+func (h *Hub) evictIdleStreams(now time.Time) {
+	var saves []func()
+	defer func() {
+		for _, save := range saves {
+			save()
+		}
+	}()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for room, stream := range h.streams {
+		if h.agentCount(room) > 0 {
+			stream.idleSince = time.Time{}
+			// Keep the shared copy of a quiet session from expiring
+			saves = append(saves, h.shareStream(room, stream))
+			continue
+		}
+		if stream.idleSince.IsZero() {
+			stream.idleSince = now
+			continue
+		}
+		if now.Sub(stream.idleSince) >= streamIdleTimeout {
+			slog.Debug("hub dropping idle stream", "room", room, "unacked", len(stream.outbox))
+			delete(h.streams, room)
+		}
+	}
+}
+
+// ForgetSession drops the stream and last output of a deleted session, on
+// this replica and in the backplane.
+func (h *Hub) ForgetSession(deviceID, sessionName string) {
+	room := routeRoom(deviceID, sessionName)
+	h.forgetRooms(func(r Room) bool { return r == room })
+	h.deleteSharedStream(room)
+}
+
+// ForgetDevice drops the streams and last output of every session of a
+// deleted device. Shared streams of sessions this replica never saw expire
+// on their own.
+func (h *Hub) ForgetDevice(deviceID string) {
+	sessionPrefix := string(SessionRoom(deviceID, ""))
+	rooms := h.forgetRooms(func(room Room) bool {
+		return room == DeviceRoom(deviceID) || strings.HasPrefix(string(room), sessionPrefix)
+	})
+	for _, room := range rooms {
+		h.deleteSharedStream(room)
+	}
+}
+
+// forgetRooms drops the local state of the rooms that match and returns
+// the ones that had a stream.
+func (h *Hub) forgetRooms(match func(Room) bool) []Room {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var forgotten []Room
+	for room := range h.streams {
+		if match(room) {
+			delete(h.streams, room)
+			forgotten = append(forgotten, room)
+		}
+	}
+	for room := range h.lastOutput {
+		if match(room) {
+			delete(h.lastOutput, room)
+		}
+	}
+	return forgotten
+}
+
+// legacyAgent reports whether the agent in room does not take part in
+// resume: it never said hello (agents from before hello), or said hello
+// without the resume capability. Its stream is never flushed, so input
+// goes to it directly. h.mu must be held.
+func (h *Hub) legacyAgent(room Room) bool {
+	if stream, ok := h.streams[room]; ok && stream.client != nil && h.rooms[room][stream.client] {
+		return false
+	}
+	for client := range h.rooms[room] {
+		if client.IsAgent && (client.Info == nil || !client.Info.Supports(service.CapabilityResume)) {
+			return true
+		}
+	}
+	return false
+}
+
+// DeliverToAgent sends input to the agent of a session without losing it:
+// the message gets a sequence number and stays buffered until the agent
+// acks it, including while the agent is reconnecting. Agents that do not
+// resume get the message as before. The message carries the trace of ctx
+// to the agent.
+func (h *Hub) DeliverToAgent(ctx context.Context, deviceID, sessionName string, message []byte) bool {
+	room := routeRoom(deviceID, sessionName)
+	envelope, err := DecodeEnvelope(message)
+	if err != nil {
+		return false
+	}
+	ctx, span := tracing.Start(ctx, "hub.DeliverToAgent", "room", string(room))
+	defer span.End()
+	if traceParent := tracing.TraceParent(ctx); traceParent != "" && traceParent != envelope.TraceParent {
+		envelope.TraceParent = traceParent
+		if message, err = json.Marshal(envelope); err != nil {
+			return false
+		}
+	}
+	// The agent is connected to another replica, which keeps its stream
+	if h.backplane != nil && !h.hasLocalAgent(room) {
+		if _, ok := h.remoteAgent(room); ok {
+			return h.publish(eventInput, deviceID, sessionName, message)
+		}
+	}
+
+	// No agent anywhere: continue the stream a replica stored last
+	var shared *agentStream
+	if h.backplane != nil && !h.hasLocalAgent(room) {
+		shared = h.loadStream(room)
+	}
+
+	h.mu.Lock()
+	if h.legacyAgent(room) {
+		h.mu.Unlock()
+		return h.SendToAgents(deviceID, sessionName, message)
+	}
+	stream := h.adoptStream(room, shared)
+	stream.nextSeq++
+	envelope.Seq = stream.nextSeq
+	sequenced, err := json.Marshal(envelope)
+	if err != nil {
+		h.mu.Unlock()
+		return false
+	}
+	if len(stream.outbox) == maxStreamFrames {
+		slog.Warn("hub outbox full, dropping frame", "room", room, "seq", stream.outbox[0].seq)
+		stream.outbox = stream.outbox[1:]
+	}
+	stream.outbox = append(stream.outbox, streamFrame{seq: envelope.Seq, message: sequenced})
+	h.flushStream(room, stream)
+	save := h.shareStream(room, stream)
+	h.mu.Unlock()
+	save()
+	span.SetAttributes("seq", envelope.Seq)
+	return true
+}
+
+// flushStream hands unsent frames to the resumed connection in order and
+// stops when its buffer is full; the rest goes out on the next ack or
+// resume. h.mu must be held.
+func (h *Hub) flushStream(room Room, s *agentStream) {
+	client := s.client
+	if client == nil || !h.rooms[room][client] {
+		return
+	}
+	for _, frame := range s.outbox {
+		if frame.seq <= s.sentSeq {
+			continue
+		}
+		select {
+		case client.Send <- frame.message:
+			s.sentSeq = frame.seq
+		default:
+			return
+		}
+	}
+}
+
+// AckFromAgent drops frames the agent has processed.
+func (h *Hub) AckFromAgent(client *Client, seq uint64) {
+	room := client.room()
+	h.mu.Lock()
+	stream, ok := h.streams[room]
+	if !ok {
+		h.mu.Unlock()
+		return
+	}
+	stream.ack(seq)
+	h.flushStream(room, stream)
+	save := h.shareStream(room, stream)
+	h.mu.Unlock()
+	save()
+}
+
+func (s *agentStream) ack(seq uint64) {
+	i := 0
+	for i < len(s.outbox) && s.outbox[i].seq <= seq {
+		i++
+	}
+	s.outbox = s.outbox[i:]
+}
+
+// ReceiveFromAgent records a sequenced message from the agent and reports
+// whether it is new. Replayed duplicates are acked again but not handled.
+func (h *Hub) ReceiveFromAgent(client *Client, seq uint64) bool {
+	room := client.room()
+	h.mu.Lock()
+	stream := h.stream(room)
+	if seq <= stream.lastReceived {
+		h.mu.Unlock()
+		return false
+	}
+	stream.lastReceived = seq
+	save := h.shareStream(room, stream)
+	h.mu.Unlock()
+	save()
+	return true
+}
+
+// OpenAgentStream starts the resume handshake of an agent connection. A new
+// agent stream id (agent restarted) resets what was received from it. It
+// returns the cloud stream id and the last seq received from the agent,
+// which the agent uses to replay its unacked messages. An agent that was
+// connected to another replica before continues the stream stored there.
+func (h *Hub) OpenAgentStream(client *Client, agentStreamID string) (string, uint64) {
+	room := client.room()
+	shared := h.loadStream(room)
+	h.mu.Lock()
+	stream := h.adoptStream(room, shared)
+	if stream.agentStreamID != agentStreamID {
+		stream.agentStreamID = agentStreamID
+		stream.lastReceived = 0
+	}
+	streamID, received := stream.id, stream.lastReceived
+	save := h.shareStream(room, stream)
+	h.mu.Unlock()
+	save()
+	return streamID, received
+}
+
+// ResumeToAgent replays frames the agent has not seen. seenStreamID and
+// seenSeq are what the agent last received; another stream id means the
+// agent saw nothing of this stream.
+func (h *Hub) ResumeToAgent(client *Client, seenStreamID string, seenSeq uint64) {
+	room := client.room()
+	h.mu.Lock()
+	stream := h.stream(room)
+	if seenStreamID != stream.id {
+		seenSeq = 0
+	}
+	stream.ack(seenSeq)
+	stream.client = client
+	stream.sentSeq = seenSeq
+	h.flushStream(room, stream)
+	save := h.shareStream(room, stream)
+	h.mu.Unlock()
+	save()
+}
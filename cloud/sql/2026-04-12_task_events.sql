@@ -0,0 +1,24 @@
+create table if not exists public.task_events (
+  id bigint generated by default as identity primary key,
+  task_id text not null,
+  device_id text not null,
+  session_name text not null default '',
+  kind text not null check (
+    kind in (
+      'info',
+      'needs_input',
+      'error',
+      'test_result',
+      'completed',
+      'tool_step'
+    )
+  ),
+  summary text not null,
+  created_at timestamptz not null default timezone('utc', now())
+);
+
+create index if not exists task_events_task_created_idx
+  on public.task_events (task_id, created_at desc);
+
+create index if not exists task_events_created_idx
+  on public.task_events (created_at);
@@ -0,0 +1,31 @@
+create table if not exists public.tasks (
+  id text primary key,
+  user_id bigint not null,
+  device_id text not null,
+  session_name text not null default '',
+  title text not null default '',
+  title_edited boolean not null default false,
+  goal text not null default '',
+  state text not null default 'running' check (
+    state in ('running', 'waiting', 'completed', 'attention')
+  ),
+  final_state text null,
+  created_at timestamptz not null default timezone('utc', now()),
+  updated_at timestamptz not null default timezone('utc', now()),
+  finished_at timestamptz null
+);
+
+create index if not exists tasks_user_created_idx
+  on public.tasks (user_id, created_at desc);
+
+create table if not exists public.task_sessions (
+  id bigint generated by default as identity primary key,
+  task_id text not null references public.tasks (id) on delete cascade,
+  device_id text not null,
+  session_name text not null,
+  linked_at timestamptz not null default timezone('utc', now()),
+  unique (task_id, device_id, session_name)
+);
+
+create index if not exists task_sessions_session_linked_idx
+  on public.task_sessions (device_id, session_name, linked_at desc);
@@ -0,0 +1,28 @@
+create table if not exists public.task_queue_items (
+  id bigint generated by default as identity primary key,
+  user_id bigint not null,
+  device_id text not null,
+  session_name text not null,
+  title text not null default '',
+  prompt text not null,
+  position integer not null default 0,
+  status text not null default 'queued' check (
+    status in ('queued', 'dispatched', 'completed', 'failed', 'cancelled')
+  ),
+  task_id text null,
+  created_at timestamptz not null default timezone('utc', now()),
+  dispatched_at timestamptz null,
+  finished_at timestamptz null
+);
+
+create index if not exists task_queue_items_session_status_idx
+  on public.task_queue_items (device_id, session_name, status, position);
+
+create table if not exists public.task_queues (
+  device_id text not null,
+  session_name text not null,
+  paused boolean not null default false,
+  pause_reason text not null default '',
+  updated_at timestamptz not null default timezone('utc', now()),
+  primary key (device_id, session_name)
+);
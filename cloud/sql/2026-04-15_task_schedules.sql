@@ -0,0 +1,47 @@
+create table if not exists public.task_schedules (
+  id bigint generated by default as identity primary key,
+  user_id bigint not null,
+  device_id text not null,
+  name text not null,
+  cron_expr text not null,
+  timezone text not null default 'UTC',
+  tool text not null default 'claude',
+  project_path text not null,
+  prompt text not null,
+  catch_up text not null default '' check (
+    catch_up in ('', 'skip', 'latest', 'all')
+  ),
+  enabled boolean not null default true,
+  next_run_at timestamptz null,
+  last_run_at timestamptz null,
+  created_at timestamptz not null default timezone('utc', now()),
+  updated_at timestamptz not null default timezone('utc', now())
+);
+
+create index if not exists task_schedules_user_idx
+  on public.task_schedules (user_id, created_at desc);
+
+create index if not exists task_schedules_enabled_next_idx
+  on public.task_schedules (enabled, next_run_at);
+
+create table if not exists public.task_schedule_runs (
+  id bigint generated by default as identity primary key,
+  schedule_id bigint not null references public.task_schedules (id) on delete cascade,
+  user_id bigint not null,
+  device_id text not null,
+  session_name text not null default '',
+  task_id text null,
+  scheduled_for timestamptz not null,
+  status text not null check (
+    status in ('dispatched', 'skipped', 'completed', 'failed')
+  ),
+  error text not null default '',
+  created_at timestamptz not null default timezone('utc', now()),
+  finished_at timestamptz null
+);
+
+create index if not exists task_schedule_runs_schedule_idx
+  on public.task_schedule_runs (schedule_id, scheduled_for desc);
+
+create index if not exists task_schedule_runs_session_idx
+  on public.task_schedule_runs (device_id, session_name, status);
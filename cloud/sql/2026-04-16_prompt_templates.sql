@@ -0,0 +1,33 @@
+create table if not exists public.teams (
+  id bigint generated by default as identity primary key,
+  name text not null,
+  created_at timestamptz not null default timezone('utc', now())
+);
+
+create table if not exists public.team_members (
+  team_id bigint not null references public.teams (id) on delete cascade,
+  user_id bigint not null,
+  role text not null default 'member' check (role in ('member', 'admin')),
+  created_at timestamptz not null default timezone('utc', now()),
+  primary key (team_id, user_id)
+);
+
+create index if not exists team_members_user_idx
+  on public.team_members (user_id);
+
+create table if not exists public.prompt_templates (
+  id bigint generated by default as identity primary key,
+  user_id bigint not null,
+  team_id bigint null references public.teams (id) on delete cascade,
+  name text not null,
+  description text not null default '',
+  content text not null,
+  created_at timestamptz not null default timezone('utc', now()),
+  updated_at timestamptz not null default timezone('utc', now())
+);
+
+create index if not exists prompt_templates_user_idx
+  on public.prompt_templates (user_id, updated_at desc);
+
+create index if not exists prompt_templates_team_idx
+  on public.prompt_templates (team_id, updated_at desc);
@@ -0,0 +1,3 @@
+-- Latest git status (branch, changed files, last commit) reported by the agent.
+alter table public.tasks
+  add column if not exists workspace jsonb null;
@@ -0,0 +1,8 @@
+-- Remote git actions (commit, discard, stash, create branch, push) are only
+-- available to operators (and admins, see 2026-04-20_admin_role.sql):
+--   update public.users set role = 'operator' where email = 'you@example.com';
+-- Every attempt is recorded in audit_log (2026-04-19_audit_log.sql) with
+-- action git_action.
+alter table public.users
+  add column if not exists role text not null default 'member'
+  check (role in ('member', 'operator'));
@@ -0,0 +1,42 @@
+-- Trail of remote actions: terminal input, device bind/delete, session
+-- delete, logins and token issuance. Rows are never updated or deleted;
+-- content holds the full input only when AUDIT_STORE_CONTENT=true.
+create table if not exists public.audit_log (
+  id bigint generated by default as identity primary key,
+  action text not null,
+  status text not null check (status in ('ok', 'failed', 'denied')),
+  user_id bigint not null default 0,
+  device_id text not null default '',
+  session_name text not null default '',
+  source_ip text not null default '',
+  request_id text not null default '',
+  content_hash text not null default '',
+  content text,
+  detail jsonb not null default '{}'::jsonb,
+  created_at timestamptz not null default timezone('utc', now())
+);
+
+create index if not exists audit_log_user_created_idx
+  on public.audit_log (user_id, id desc);
+
+create index if not exists audit_log_device_created_idx
+  on public.audit_log (device_id, id desc);
+
+create or replace function public.audit_log_append_only()
+returns trigger
+language plpgsql
+as $$
+begin
+  raise exception 'audit_log is append-only';
+end;
+$$;
+
+drop trigger if exists audit_log_append_only on public.audit_log;
+create trigger audit_log_append_only
+  before update or delete on public.audit_log
+  for each row execute function public.audit_log_append_only();
+
+drop trigger if exists audit_log_no_truncate on public.audit_log;
+create trigger audit_log_no_truncate
+  before truncate on public.audit_log
+  for each statement execute function public.audit_log_append_only();
@@ -0,0 +1,5 @@
+-- Admins may list every device (/api/device/list) and have every operator right:
+--   update public.users set role = 'admin' where email = 'you@example.com';
+alter table public.users drop constraint if exists users_role_check;
+alter table public.users
+  add constraint users_role_check check (role in ('member', 'operator', 'admin'));
@@ -0,0 +1,18 @@
+-- Newest events of several tasks in one call, so listing tasks does not
+-- query the timeline once per task.
+create index if not exists task_events_task_created_id_idx
+  on public.task_events (task_id, created_at desc, id desc);
+
+create or replace function public.recent_task_events(task_ids text[], per_task int)
+returns setof public.task_events
+language sql stable as $$
+  select e.*
+  from unnest(task_ids) as t(task_id)
+  cross join lateral (
+    select *
+    from public.task_events ev
+    where ev.task_id = t.task_id
+    order by ev.created_at desc, ev.id desc
+    limit per_task
+  ) e;
+$$;
@@ -0,0 +1,218 @@
+// Package logging sets up the slog logger shared by the cloud server and
+// the desktop agent: leveled text or JSON output, request IDs, and a
+// redaction layer that keeps tokens, passwords and terminal content out of
+// the logs.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Options configure New. The zero value logs info and above as text to
+// stderr with redaction on.
+type Options struct {
+	Level  string // debug, info, warn or error
+	Format string // text or json
+	// Debug lets terminal content and message payloads through. Tokens and
+	// passwords are redacted regardless.
+	Debug  bool
+	Output io.Writer
+}
+
+// New returns a logger configured by opts.
+func New(opts Options) *slog.Logger {
+	output := opts.Output
+	if output == nil {
+		output = os.Stderr
+	}
+	handlerOpts := &slog.HandlerOptions{Level: ParseLevel(opts.Level)}
+	var handler slog.Handler
+	if strings.EqualFold(opts.Format, "json") {
+		handler = slog.NewJSONHandler(output, handlerOpts)
+	} else {
+		handler = slog.NewTextHandler(output, handlerOpts)
+	}
+	return slog.New(&redactHandler{next: handler, debug: opts.Debug})
+}
+
+// Setup installs the logger as the slog default. Calls to the standard log
+// package go through it too, at info level.
+func Setup(opts Options) *slog.Logger {
+	logger := New(opts)
+	slog.SetDefault(logger)
+	return logger
+}
+
+// ParseLevel reads a level name; anything unknown is info.
+func ParseLevel(level string) slog.Level {
+	switch strings.ToLower(strings.TrimSpace(level)) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context whose log records carry id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID of ctx, or "".
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// NewRequestID returns a random ID for a request or connection.
+func NewRequestID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+const redacted = "[REDACTED]"
+
+// Attribute keys whose values are secrets; keys ending in _token,
+// _password or _secret count too.
+var secretKeys = map[string]bool{
+	"token":         true,
+	"password":      true,
+	"password_hash": true,
+	"authorization": true,
+	"apikey":        true,
+	"api_key":       true,
+	"secret":        true,
+	"bind_code":     true,
+}
+
+// Attribute keys holding terminal content or message bodies, logged as
+// their size unless Debug is set.
+var contentKeys = map[string]bool{
+	"content":  true,
+	"payload":  true,
+	"input":    true,
+	"output":   true,
+	"body":     true,
+	"response": true,
+}
+
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	return secretKeys[key] || strings.HasSuffix(key, "_token") || strings.HasSuffix(key, "_password") || strings.HasSuffix(key, "_secret")
+}
+
+// Secrets that turn up inside free text: query strings, headers and JSON
+// bodies such as Supabase responses.
+var secretPatterns = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`(?i)\b(token|password|secret|api_?key|bind_code)=[^&\s"]+`), "${1}=" + redacted},
+	{regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9._~+/=-]+`), "Bearer " + redacted},
+	{regexp.MustCompile(`(?i)"(token|access_token|password|password_hash|secret|api_?key|bind_code)"\s*:\s*"[^"]*"`), `"${1}":"` + redacted + `"`},
+}
+
+// Scrub removes secrets from free text.
+func Scrub(text string) string {
+	for _, secret := range secretPatterns {
+		text = secret.pattern.ReplaceAllString(text, secret.replacement)
+	}
+	return text
+}
+
+// redactHandler rewrites records before the output handler sees them.
+type redactHandler struct {
+	next  slog.Handler
+	debug bool
+}
+
+func (h *redactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *redactHandler) Handle(ctx context.Context, record slog.Record) error {
+	out := slog.NewRecord(record.Time, record.Level, Scrub(record.Message), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		out.AddAttrs(h.redact(attr))
+		return true
+	})
+	if id := RequestID(ctx); id != "" {
+		out.AddAttrs(slog.String("request_id", id))
+	}
+	return h.next.Handle(ctx, out)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redactedAttrs := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		redactedAttrs[i] = h.redact(attr)
+	}
+	return &redactHandler{next: h.next.WithAttrs(redactedAttrs), debug: h.debug}
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{next: h.next.WithGroup(name), debug: h.debug}
+}
+
+func (h *redactHandler) redact(attr slog.Attr) slog.Attr {
+	attr.Value = attr.Value.Resolve()
+	if attr.Value.Kind() == slog.KindGroup {
+		group := attr.Value.Group()
+		redactedGroup := make([]any, len(group))
+		for i, member := range group {
+			redactedGroup[i] = h.redact(member)
+		}
+		return slog.Group(attr.Key, redactedGroup...)
+	}
+	if isSecretKey(attr.Key) {
+		return slog.String(attr.Key, redacted)
+	}
+	if !h.debug && contentKeys[strings.ToLower(attr.Key)] {
+		return slog.String(attr.Key, fmt.Sprintf("[%d bytes]", valueSize(attr.Value)))
+	}
+	switch attr.Value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, Scrub(attr.Value.String()))
+	case slog.KindAny:
+		switch value := attr.Value.Any().(type) {
+		case error:
+			return slog.String(attr.Key, Scrub(value.Error()))
+		case []byte:
+			return slog.String(attr.Key, Scrub(string(value)))
+		case json.RawMessage:
+			// Stays JSON: the patterns only rewrite inside strings
+			return slog.Any(attr.Key, json.RawMessage(Scrub(string(value))))
+		}
+	}
+	return attr
+}
+
+func valueSize(value slog.Value) int {
+	if value.Kind() == slog.KindAny {
+		switch data := value.Any().(type) {
+		case []byte:
+			return len(data)
+		case json.RawMessage:
+			return len(data)
+		}
+	}
+	return len(value.String())
+}
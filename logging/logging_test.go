@@ -0,0 +1,100 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedactsSecretsAndContent(t *testing.T) {
+	var out bytes.Buffer
+	logger := New(Options{Format: "json", Output: &out})
+
+	logger.Info("connect ws://cloud/ws?token=abc123&device_id=dev-1",
+		"token", "abc123",
+		"access_token", "xyz",
+		"content", "ls -la\r\n",
+		"response", []byte(`{"password_hash":"$2a$10$hash"}`),
+		"error", errors.New(`supabase error: {"password":"hunter2"}`),
+		"payload", json.RawMessage(`{"data":"rm -rf build"}`),
+		"device_id", "dev-1",
+	)
+
+	line := out.String()
+	for _, secret := range []string{"abc123", "xyz", "ls -la", "$2a$10$hash", "hunter2", "rm -rf"} {
+		if strings.Contains(line, secret) {
+			t.Errorf("log line leaks %q: %s", secret, line)
+		}
+	}
+	var record map[string]any
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["content"] != "[8 bytes]" || record["payload"] != "[23 bytes]" || record["device_id"] != "dev-1" {
+		t.Fatalf("record = %v", record)
+	}
+}
+
+func TestDebugLogsContentButNotSecrets(t *testing.T) {
+	var out bytes.Buffer
+	logger := New(Options{Debug: true, Output: &out}).With("password", "hunter2")
+
+	logger.Info("terminal", "content", "ls -la", "body", `{"token":"abc123"}`,
+		"payload", json.RawMessage(`{"token":"def456","data":"pwd"}`))
+
+	line := out.String()
+	if !strings.Contains(line, "ls -la") {
+		t.Errorf("debug log lacks content: %s", line)
+	}
+	if !strings.Contains(line, "pwd") {
+		t.Errorf("debug log lacks the payload: %s", line)
+	}
+	if strings.Contains(line, "hunter2") || strings.Contains(line, "abc123") || strings.Contains(line, "def456") {
+		t.Errorf("debug log leaks a secret: %s", line)
+	}
+}
+
+func TestLevelFiltersRecords(t *testing.T) {
+	var out bytes.Buffer
+	logger := New(Options{Level: "warn", Output: &out})
+	logger.Info("hidden")
+	logger.Warn("shown")
+	if strings.Contains(out.String(), "hidden") || !strings.Contains(out.String(), "shown") {
+		t.Fatalf("output = %q", out.String())
+	}
+}
+
+func TestMiddlewareAddsRequestID(t *testing.T) {
+	var out bytes.Buffer
+	logger := New(Options{Output: &out})
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger.InfoContext(r.Context(), "handled")
+	}))
+
+	request := httptest.NewRequest(http.MethodGet, "/api/tasks", nil)
+	request.Header.Set(RequestIDHeader, "req-42")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if got := recorder.Header().Get(RequestIDHeader); got != "req-42" {
+		t.Fatalf("response request ID = %q", got)
+	}
+	if !strings.Contains(out.String(), "request_id=req-42") {
+		t.Fatalf("log lacks the request ID: %s", out.String())
+	}
+
+	request = httptest.NewRequest(http.MethodGet, "/api/tasks", nil)
+	request.Header.Set(RequestIDHeader, "bad id\n")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if got := recorder.Header().Get(RequestIDHeader); got == "" || strings.Contains(got, " ") {
+		t.Fatalf("unsafe request ID kept: %q", got)
+	}
+	if RequestID(context.Background()) != "" {
+		t.Fatal("background context has a request ID")
+	}
+}
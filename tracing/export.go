@@ -0,0 +1,298 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spanData is a finished span on its way to the exporter.
+type spanData struct {
+	Name    string
+	Kind    int
+	Context SpanContext
+	Parent  SpanID
+	Start   time.Time
+	End     time.Time
+	Attrs   []attribute
+	Error   string
+}
+
+type exporter interface {
+	export(ctx context.Context, service string, spans []spanData) error
+}
+
+// Batching: spans are exported every batchInterval or once batchSize are
+// queued. When the exporter falls behind, spans past maxQueued are dropped
+// rather than slowing the terminal down.
+const (
+	batchSize     = 256
+	batchInterval = 2 * time.Second
+	maxQueued     = 4096
+)
+
+type batcher struct {
+	exporter exporter
+	service  string
+	mu       sync.Mutex
+	queue    []spanData
+	dropped  int
+	flush    chan struct{}
+	done     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+func newBatcher(exporter exporter, service string) *batcher {
+	b := &batcher{
+		exporter: exporter,
+		service:  service,
+		flush:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *batcher) add(span spanData) {
+	b.mu.Lock()
+	if len(b.queue) >= maxQueued {
+		b.dropped++
+		b.mu.Unlock()
+		return
+	}
+	b.queue = append(b.queue, span)
+	full := len(b.queue) >= batchSize
+	b.mu.Unlock()
+	if full {
+		select {
+		case b.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (b *batcher) run() {
+	defer close(b.stopped)
+	ticker := time.NewTicker(batchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.flush:
+		case <-b.done:
+			b.export(context.Background())
+			return
+		}
+		b.export(context.Background())
+	}
+}
+
+func (b *batcher) export(ctx context.Context) {
+	b.mu.Lock()
+	spans, dropped := b.queue, b.dropped
+	b.queue, b.dropped = nil, 0
+	b.mu.Unlock()
+	if dropped > 0 {
+		slog.Warn("tracing: export queue full, spans dropped", "dropped", dropped)
+	}
+	for len(spans) > 0 {
+		n := min(len(spans), batchSize)
+		if err := b.exporter.export(ctx, b.service, spans[:n]); err != nil {
+			slog.Warn("tracing: export failed", "spans", n, "error", err)
+		}
+		spans = spans[n:]
+	}
+}
+
+func (b *batcher) shutdown(ctx context.Context) error {
+	b.stopOnce.Do(func() { close(b.done) })
+	select {
+	case <-b.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stdoutExporter writes one JSON object per span, for local testing.
+type stdoutExporter struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func newStdoutExporter(out io.Writer) *stdoutExporter {
+	if out == nil {
+		out = os.Stdout
+	}
+	return &stdoutExporter{out: out}
+}
+
+type stdoutSpan struct {
+	Service    string         `json:"service,omitempty"`
+	Name       string         `json:"name"`
+	TraceID    string         `json:"trace_id"`
+	SpanID     string         `json:"span_id"`
+	ParentID   string         `json:"parent_id,omitempty"`
+	Start      time.Time      `json:"start"`
+	DurationMs float64        `json:"duration_ms"`
+	Attributes map[string]any `json:"attributes,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+func (e *stdoutExporter) export(_ context.Context, service string, spans []spanData) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, span := range spans {
+		line := stdoutSpan{
+			Service:    service,
+			Name:       span.Name,
+			TraceID:    hex.EncodeToString(span.Context.TraceID[:]),
+			SpanID:     hex.EncodeToString(span.Context.SpanID[:]),
+			Start:      span.Start,
+			DurationMs: float64(span.End.Sub(span.Start).Microseconds()) / 1000,
+			Error:      span.Error,
+		}
+		if span.Parent != (SpanID{}) {
+			line.ParentID = hex.EncodeToString(span.Parent[:])
+		}
+		if len(span.Attrs) > 0 {
+			line.Attributes = make(map[string]any, len(span.Attrs))
+			for _, attr := range span.Attrs {
+				line.Attributes[attr.key] = attr.value
+			}
+		}
+		if err := encoder.Encode(line); err != nil {
+			return err
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err := e.out.Write(buf.Bytes())
+	return err
+}
+
+// otlpExporter posts spans to a collector in the OTLP/HTTP JSON encoding.
+type otlpExporter struct {
+	url    string
+	client *http.Client
+}
+
+func newOTLPExporter(endpoint string) *otlpExporter {
+	if endpoint == "" {
+		endpoint = "http://localhost:4318"
+	}
+	return &otlpExporter{
+		url:    strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type otlpKeyValue struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 2 = error
+	Message string `json:"message,omitempty"`
+}
+
+func (e *otlpExporter) export(ctx context.Context, service string, spans []spanData) error {
+	encoded := make([]otlpSpan, len(spans))
+	for i, span := range spans {
+		encoded[i] = otlpSpan{
+			TraceID:           hex.EncodeToString(span.Context.TraceID[:]),
+			SpanID:            hex.EncodeToString(span.Context.SpanID[:]),
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		}
+		if span.Parent != (SpanID{}) {
+			encoded[i].ParentSpanID = hex.EncodeToString(span.Parent[:])
+		}
+		for _, attr := range span.Attrs {
+			encoded[i].Attributes = append(encoded[i].Attributes, otlpKeyValue{Key: attr.key, Value: otlpValue(attr.value)})
+		}
+		if span.Error != "" {
+			encoded[i].Status = &otlpStatus{Code: 2, Message: span.Error}
+		}
+	}
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": []otlpKeyValue{
+				{Key: "service.name", Value: otlpValue(service)},
+			}},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]string{"name": "github.com/mobile-coder/tracing"},
+				"spans": encoded,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// otlpValue wraps a Go value in an OTLP AnyValue; 64-bit integers are
+// strings in the JSON encoding.
+func otlpValue(value any) map[string]any {
+	switch v := value.(type) {
+	case string:
+		return map[string]any{"stringValue": v}
+	case bool:
+		return map[string]any{"boolValue": v}
+	case int:
+		return map[string]any{"intValue": strconv.FormatInt(int64(v), 10)}
+	case int64:
+		return map[string]any{"intValue": strconv.FormatInt(v, 10)}
+	case uint64:
+		return map[string]any{"intValue": strconv.FormatUint(v, 10)}
+	case float64:
+		return map[string]any{"doubleValue": v}
+	case time.Duration:
+		return map[string]any{"stringValue": v.String()}
+	default:
+		return map[string]any{"stringValue": fmt.Sprint(v)}
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/mobile-coder/tracing
+
+go 1.25.6
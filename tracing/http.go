@@ -0,0 +1,69 @@
+package tracing
+
+import (
+	"net/http"
+	"strings"
+)
+
+// TraceParentHeader carries trace context in HTTP requests.
+const TraceParentHeader = "traceparent"
+
+// Middleware records a server span per request, continuing the trace in
+// the traceparent header if present. WebSocket upgrades are skipped: the
+// connection outlives the request, and its messages are traced instead.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := Extract(r.Context(), r.Header.Get(TraceParentHeader))
+		ctx, span := start(ctx, "HTTP "+r.Method, kindServer, []any{"http.method", r.Method, "url.path", r.URL.Path})
+		if span == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		r = r.WithContext(ctx)
+		next.ServeHTTP(recorder, r)
+		// The mux fills in the matched pattern while serving
+		if r.Pattern != "" {
+			span.SetName(r.Method + " " + r.Pattern)
+			span.SetAttributes("http.route", r.Pattern)
+		}
+		span.SetAttributes("http.status_code", recorder.status)
+		if recorder.status >= 500 {
+			span.RecordError(httpError(recorder.status))
+		}
+		span.End()
+	})
+}
+
+type httpError int
+
+func (e httpError) Error() string {
+	return http.StatusText(int(e))
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
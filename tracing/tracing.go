@@ -0,0 +1,291 @@
+// Package tracing records spans shared by the cloud server and the desktop
+// agent and exports them to an OpenTelemetry collector (OTLP/HTTP JSON) or
+// to stdout. Trace context travels as a W3C traceparent, in HTTP headers and
+// in the WebSocket envelope.
+//
+// Until Setup enables an exporter, Start returns a nil *Span; its methods
+// are no-ops, so call sites need no checks.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Options configure Setup.
+type Options struct {
+	Service  string // service.name of the spans
+	Exporter string // otlp, stdout, or empty/none to turn tracing off
+	Endpoint string // OTLP/HTTP base URL, http://localhost:4318 if empty
+	// SampleRatio is the share of new traces recorded, 0 meaning all.
+	// Traces started elsewhere follow the caller's decision.
+	SampleRatio float64
+	Output      io.Writer // stdout exporter only, os.Stdout if nil
+}
+
+var current atomic.Pointer[tracer]
+
+// Setup starts exporting spans. The returned shutdown flushes spans still
+// queued; call it before the process exits.
+func Setup(opts Options) (shutdown func(context.Context) error, err error) {
+	var exporter exporter
+	switch strings.ToLower(opts.Exporter) {
+	case "", "none":
+		current.Store(nil)
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exporter = newStdoutExporter(opts.Output)
+	case "otlp":
+		exporter = newOTLPExporter(opts.Endpoint)
+	default:
+		return nil, fmt.Errorf("tracing: unknown exporter %q", opts.Exporter)
+	}
+	ratio := opts.SampleRatio
+	if ratio <= 0 || ratio > 1 {
+		ratio = 1
+	}
+	t := &tracer{service: opts.Service, ratio: ratio, batcher: newBatcher(exporter, opts.Service)}
+	current.Store(t)
+	return func(ctx context.Context) error {
+		current.CompareAndSwap(t, nil)
+		return t.batcher.shutdown(ctx)
+	}, nil
+}
+
+type tracer struct {
+	service string
+	ratio   float64
+	batcher *batcher
+}
+
+// sample decides whether a new trace is recorded, from its ID so every
+// process agrees.
+func (t *tracer) sample(id TraceID) bool {
+	if t.ratio >= 1 {
+		return true
+	}
+	return float64(binary.BigEndian.Uint64(id[8:])) < t.ratio*math.MaxUint64
+}
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+// SpanContext identifies a span across processes.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+func (c SpanContext) IsValid() bool {
+	return c.TraceID != TraceID{} && c.SpanID != SpanID{}
+}
+
+// TraceParent formats c as a W3C traceparent header value.
+func (c SpanContext) TraceParent() string {
+	if !c.IsValid() {
+		return ""
+	}
+	flags := "00"
+	if c.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(c.TraceID[:]) + "-" + hex.EncodeToString(c.SpanID[:]) + "-" + flags
+}
+
+var errInvalidTraceParent = errors.New("tracing: invalid traceparent")
+
+// ParseTraceParent reads a W3C traceparent header value.
+func ParseTraceParent(value string) (SpanContext, error) {
+	var c SpanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return c, errInvalidTraceParent
+	}
+	if _, err := hex.Decode(c.TraceID[:], []byte(parts[1])); err != nil {
+		return c, errInvalidTraceParent
+	}
+	if _, err := hex.Decode(c.SpanID[:], []byte(parts[2])); err != nil {
+		return c, errInvalidTraceParent
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return c, errInvalidTraceParent
+	}
+	c.Sampled = flags[0]&1 == 1
+	if !c.IsValid() {
+		return c, errInvalidTraceParent
+	}
+	return c, nil
+}
+
+type spanKey struct{}
+
+// Extract returns ctx with the remote parent described by traceparent, or
+// ctx itself if traceparent is empty or malformed.
+func Extract(ctx context.Context, traceparent string) context.Context {
+	if traceparent == "" {
+		return ctx
+	}
+	parent, err := ParseTraceParent(traceparent)
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, parent)
+}
+
+// SpanContextFrom returns the span context carried by ctx, from a local
+// span or an extracted remote parent.
+func SpanContextFrom(ctx context.Context) SpanContext {
+	if ctx == nil {
+		return SpanContext{}
+	}
+	switch value := ctx.Value(spanKey{}).(type) {
+	case *Span:
+		return value.context
+	case SpanContext:
+		return value
+	}
+	return SpanContext{}
+}
+
+// TraceParent returns the traceparent to send along with work done for
+// ctx, "" if ctx is not traced.
+func TraceParent(ctx context.Context) string {
+	return SpanContextFrom(ctx).TraceParent()
+}
+
+// Span is one timed operation. A nil *Span records nothing.
+type Span struct {
+	tracer  *tracer
+	name    string
+	kind    int
+	context SpanContext
+	parent  SpanID
+	start   time.Time
+
+	mu    sync.Mutex
+	attrs []attribute
+	err   string
+	ended bool
+}
+
+type attribute struct {
+	key   string
+	value any
+}
+
+// Span kinds, as numbered by OTLP.
+const (
+	kindInternal = 1
+	kindServer   = 2
+)
+
+// Start begins a span named name as a child of the span in ctx, or as the
+// root of a new trace. attrs are key-value pairs, as in log/slog. The span
+// is nil while tracing is off.
+func Start(ctx context.Context, name string, attrs ...any) (context.Context, *Span) {
+	return start(ctx, name, kindInternal, attrs)
+}
+
+func start(ctx context.Context, name string, kind int, attrs []any) (context.Context, *Span) {
+	t := current.Load()
+	if t == nil {
+		return ctx, nil
+	}
+	parent := SpanContextFrom(ctx)
+	span := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	if parent.IsValid() {
+		span.context.TraceID = parent.TraceID
+		span.context.Sampled = parent.Sampled
+		span.parent = parent.SpanID
+	} else {
+		rand.Read(span.context.TraceID[:])
+		span.context.Sampled = t.sample(span.context.TraceID)
+	}
+	rand.Read(span.context.SpanID[:])
+	span.SetAttributes(attrs...)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Context returns the span's identity, for propagation.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// SetAttributes adds key-value pairs to the span.
+func (s *Span) SetAttributes(attrs ...any) {
+	if s == nil || !s.context.Sampled {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i+1 < len(attrs); i += 2 {
+		key, ok := attrs[i].(string)
+		if !ok {
+			continue
+		}
+		s.attrs = append(s.attrs, attribute{key: key, value: attrs[i+1]})
+	}
+}
+
+// SetName renames the span, e.g. once the HTTP route is known.
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name = name
+}
+
+// RecordError marks the span failed; a nil err is ignored.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err.Error()
+}
+
+// End finishes the span and queues it for export. Later calls do nothing.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	end := time.Now()
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	data := spanData{
+		Name:    s.name,
+		Kind:    s.kind,
+		Context: s.context,
+		Parent:  s.parent,
+		Start:   s.start,
+		End:     end,
+		Attrs:   s.attrs,
+		Error:   s.err,
+	}
+	s.mu.Unlock()
+	if s.context.Sampled {
+		s.tracer.batcher.add(data)
+	}
+}
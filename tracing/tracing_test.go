@@ -0,0 +1,171 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// setupStdout exports spans to the returned buffer once flush is called.
+func setupStdout(t *testing.T) (out *bytes.Buffer, flush func()) {
+	t.Helper()
+	out = &bytes.Buffer{}
+	shutdown, err := Setup(Options{Service: "test", Exporter: "stdout", Output: out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out, func() {
+		if err := shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func decodeSpans(t *testing.T, out *bytes.Buffer) []stdoutSpan {
+	t.Helper()
+	var spans []stdoutSpan
+	decoder := json.NewDecoder(out)
+	for {
+		var span stdoutSpan
+		if err := decoder.Decode(&span); err == io.EOF {
+			return spans
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		spans = append(spans, span)
+	}
+}
+
+func TestSpansContinueRemoteTrace(t *testing.T) {
+	out, flush := setupStdout(t)
+
+	// The agent side of a keystroke, continuing the hub's span
+	hubParent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx, input := Start(Extract(context.Background(), hubParent), "agent.terminal_input", "session_name", "feature")
+	_, tmux := Start(ctx, "tmux send-keys")
+	tmux.RecordError(errors.New("no server running"))
+	tmux.End()
+	input.End()
+	input.End()
+	flush()
+
+	spans := decodeSpans(t, out)
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	tmuxSpan, inputSpan := spans[0], spans[1]
+	if inputSpan.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || inputSpan.ParentID != "00f067aa0ba902b7" {
+		t.Fatalf("input span = %+v, want it in the remote trace", inputSpan)
+	}
+	if tmuxSpan.ParentID != inputSpan.SpanID || tmuxSpan.Error != "no server running" {
+		t.Fatalf("tmux span = %+v", tmuxSpan)
+	}
+	if inputSpan.Attributes["session_name"] != "feature" {
+		t.Fatalf("attributes = %v", inputSpan.Attributes)
+	}
+	if got := TraceParent(ctx); got != "00-4bf92f3577b34da6a3ce929d0e0e4736-"+inputSpan.SpanID+"-01" {
+		t.Fatalf("TraceParent = %q", got)
+	}
+}
+
+func TestUnsampledParentIsNotExported(t *testing.T) {
+	out, flush := setupStdout(t)
+	ctx, span := Start(Extract(context.Background(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"), "skipped")
+	span.End()
+	flush()
+	if out.Len() != 0 {
+		t.Fatalf("exported an unsampled span: %s", out.String())
+	}
+	if !strings.HasSuffix(TraceParent(ctx), "-00") {
+		t.Fatalf("TraceParent = %q, want the unsampled flag kept", TraceParent(ctx))
+	}
+}
+
+func TestTracingOffReturnsNilSpan(t *testing.T) {
+	if _, err := Setup(Options{}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, span := Start(context.Background(), "off")
+	if span != nil {
+		t.Fatal("span recorded while tracing is off")
+	}
+	span.SetAttributes("k", "v")
+	span.End()
+	if TraceParent(ctx) != "" {
+		t.Fatal("untraced context has a traceparent")
+	}
+}
+
+func TestParseTraceParentRejectsMalformed(t *testing.T) {
+	for _, value := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01",
+	} {
+		if _, err := ParseTraceParent(value); err == nil {
+			t.Errorf("ParseTraceParent(%q) succeeded", value)
+		}
+	}
+}
+
+func TestOTLPExporterPostsJSON(t *testing.T) {
+	requests := make(chan map[string]any, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("collector got %s %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		requests <- body
+	}))
+	defer collector.Close()
+
+	shutdown, err := Setup(Options{Service: "mobilecoder-cloud", Exporter: "otlp", Endpoint: collector.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := Start(context.Background(), "hub.DeliverToAgent", "seq", uint64(7))
+	span.End()
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	body := <-requests
+	encoded, _ := json.Marshal(body)
+	for _, want := range []string{
+		`"stringValue":"mobilecoder-cloud"`,
+		`"name":"hub.DeliverToAgent"`,
+		`{"key":"seq","value":{"intValue":"7"}}`,
+	} {
+		if !strings.Contains(string(encoded), want) {
+			t.Errorf("request lacks %s: %s", want, encoded)
+		}
+	}
+}
+
+func TestMiddlewareNamesSpanByRoute(t *testing.T) {
+	out, flush := setupStdout(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/tasks/detail", func(w http.ResponseWriter, r *http.Request) {
+		if TraceParent(r.Context()) == "" {
+			t.Error("handler context is not traced")
+		}
+	})
+	request := httptest.NewRequest(http.MethodGet, "/api/tasks/detail?id=1", nil)
+	request.Header.Set(TraceParentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	Middleware(mux).ServeHTTP(httptest.NewRecorder(), request)
+	flush()
+
+	spans := decodeSpans(t, out)
+	if len(spans) != 1 || spans[0].Name != "GET /api/tasks/detail" || spans[0].ParentID != "00f067aa0ba902b7" {
+		t.Fatalf("spans = %+v", spans)
+	}
+}